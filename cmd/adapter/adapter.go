@@ -17,17 +17,25 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	pmodel "github.com/prometheus/common/model"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	openapinamer "k8s.io/apiserver/pkg/endpoints/openapi"
 	genericapiserver "k8s.io/apiserver/pkg/server"
 	"k8s.io/client-go/metadata"
@@ -36,6 +44,7 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/transport"
 	"k8s.io/component-base/logs"
+	"k8s.io/component-base/tracing"
 	"k8s.io/klog/v2"
 
 	customexternalmetrics "sigs.k8s.io/custom-metrics-apiserver/pkg/apiserver"
@@ -43,6 +52,7 @@ import (
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 	"sigs.k8s.io/metrics-server/pkg/api"
 
+	"sigs.k8s.io/prometheus-adapter/cmd/config-gen/utils"
 	generatedopenapi "sigs.k8s.io/prometheus-adapter/pkg/api/generated/openapi"
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
 	mprom "sigs.k8s.io/prometheus-adapter/pkg/client/metrics"
@@ -50,9 +60,15 @@ import (
 	cmprov "sigs.k8s.io/prometheus-adapter/pkg/custom-provider"
 	extprov "sigs.k8s.io/prometheus-adapter/pkg/external-provider"
 	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
 	resprov "sigs.k8s.io/prometheus-adapter/pkg/resourceprovider"
+	"sigs.k8s.io/prometheus-adapter/pkg/snapshot"
 )
 
+// defaultRulesRateInterval is the rate interval used by the default rules
+// when --merge-default-rules is set, matching the config-gen default.
+const defaultRulesRateInterval = 5 * time.Minute
+
 type PrometheusAdapter struct {
 	basecmd.AdapterBase
 
@@ -62,6 +78,16 @@ type PrometheusAdapter struct {
 	PrometheusAuthInCluster bool
 	// PrometheusAuthConf is the kubeconfig file that contains auth details used to connect to Prometheus
 	PrometheusAuthConf string
+	// PrometheusProxyURL is the URL of the HTTP, HTTPS or SOCKS5 proxy through which Prometheus is reached
+	PrometheusProxyURL string
+	// PrometheusUnixSocket is the path of the Unix domain socket on which Prometheus is reached
+	PrometheusUnixSocket string
+	// PrometheusMaxIdleConnsPerHost is the number of idle connections kept open to each Prometheus host
+	PrometheusMaxIdleConnsPerHost int
+	// PrometheusIdleConnTimeout is how long idle connections to Prometheus are kept open
+	PrometheusIdleConnTimeout time.Duration
+	// PrometheusDisableHTTP2 restricts connections to Prometheus to HTTP/1.1
+	PrometheusDisableHTTP2 bool
 	// PrometheusCAFile points to the file containing the ca-root for connecting with Prometheus
 	PrometheusCAFile string
 	// PrometheusClientTLSCertFile points to the file containing the client TLS cert for connecting with Prometheus
@@ -70,10 +96,51 @@ type PrometheusAdapter struct {
 	PrometheusClientTLSKeyFile string
 	// PrometheusTokenFile points to the file that contains the bearer token when connecting with Prometheus
 	PrometheusTokenFile string
+	// PrometheusOAuth2TokenURL is the token endpoint used to obtain OAuth2 access tokens, using the
+	// client credentials flow, when connecting with Prometheus
+	PrometheusOAuth2TokenURL string
+	// PrometheusOAuth2ClientID is the OAuth2 client ID used to obtain access tokens
+	PrometheusOAuth2ClientID string
+	// PrometheusOAuth2ClientSecretFile points to the file containing the OAuth2 client secret
+	PrometheusOAuth2ClientSecretFile string
+	// PrometheusOAuth2Scopes are the scopes requested for OAuth2 access tokens
+	PrometheusOAuth2Scopes []string
+	// PrometheusAuthSigV4 signs requests to Prometheus with AWS Signature Version 4, for Amazon
+	// Managed Service for Prometheus
+	PrometheusAuthSigV4 bool
+	// PrometheusSigV4Region is the AWS region requests are signed for
+	PrometheusSigV4Region string
+	// PrometheusSigV4RoleARN is the ARN of an AWS role to assume for signing requests
+	PrometheusSigV4RoleARN string
 	// PrometheusHeaders is a k=v list of headers to set on requests to PrometheusURL
 	PrometheusHeaders []string
+	// PrometheusQueryTimeout is the duration after which queries to Prometheus are cancelled
+	PrometheusQueryTimeout time.Duration
+	// PrometheusMaxRetries is the number of times requests to Prometheus failing with a transient error are retried
+	PrometheusMaxRetries int
+	// PrometheusRetryBackoff is the delay before the first retry of a request to Prometheus
+	PrometheusRetryBackoff time.Duration
+	// PrometheusRetryOnCodes are the HTTP status codes of Prometheus responses considered transient errors
+	PrometheusRetryOnCodes []int
+	// PrometheusCircuitBreakerFailures is the number of consecutive transient errors after which requests to
+	// Prometheus stop being sent for a while
+	PrometheusCircuitBreakerFailures int
+	// PrometheusCircuitBreakerOpenDuration is the period for which requests to Prometheus stop being sent
+	PrometheusCircuitBreakerOpenDuration time.Duration
 	// PrometheusVerb is a verb to set on requests to PrometheusURL
 	PrometheusVerb string
+	// PrometheusEndpointVerbs override PrometheusVerb for some endpoints of the Prometheus API, by endpoint name
+	PrometheusEndpointVerbs map[string]string
+	// PrometheusDisableCompression disables requesting gzip-compressed responses from Prometheus
+	PrometheusDisableCompression bool
+	// PrometheusPartialResponse, if set to true or false, allows or denies partial responses from Thanos Query
+	PrometheusPartialResponse string
+	// PrometheusFallbackURLs are the URLs of Prometheus replicas to which queries failing on PrometheusURL are sent
+	PrometheusFallbackURLs []string
+	// PrometheusFanOut, if set, sends queries to PrometheusURL and PrometheusFallbackURLs concurrently, and merges the results
+	PrometheusFanOut bool
+	// PrometheusBackends is a name=url list of additional Prometheus backends, which rules may refer to by name
+	PrometheusBackends []string
 	// AdapterConfigFile points to the file containing the metrics discovery configuration.
 	AdapterConfigFile string
 	// MetricsRelistInterval is the interval at which to relist the set of available metrics
@@ -81,8 +148,158 @@ type PrometheusAdapter struct {
 	// MetricsMaxAge is the period to query available metrics for
 	MetricsMaxAge time.Duration
 	// DisableHTTP2 indicates that http2 should not be enabled.
-	DisableHTTP2  bool
-	metricsConfig *adaptercfg.MetricsDiscoveryConfig
+	DisableHTTP2 bool
+	// ShutdownDelayDuration is how long the server keeps serving requests after
+	// SIGTERM, while reporting itself as not ready
+	ShutdownDelayDuration time.Duration
+	// ShutdownGracePeriod is how long in-flight requests are given to complete
+	// once the server stops accepting requests, if set
+	ShutdownGracePeriod time.Duration
+	// ExposeQueryInErrors attaches the rendered Prometheus query to metric NotFound errors
+	ExposeQueryInErrors bool
+	// ExposeRuleInErrors attaches the rule a metric comes from to errors about it
+	ExposeRuleInErrors bool
+	// ShardIndex is the shard of custom metrics series discovery run by this replica
+	ShardIndex int
+	// ShardTotal is the number of shards custom metrics series discovery is split into
+	ShardTotal int
+	// ShardNamespace is the namespace of the ConfigMaps through which shards share the series they discover
+	ShardNamespace string
+	// RegistrySnapshotFile is the file to which a snapshot of the exposed metrics is written after each relist
+	RegistrySnapshotFile string
+	// RegistryCacheFile is the file in which the discovered custom metrics series are kept across restarts
+	RegistryCacheFile string
+	// MaxConcurrentSeriesQueries is the maximum number of concurrent series queries while relisting
+	MaxConcurrentSeriesQueries int
+	// SeriesQueriesQPS is the maximum rate at which series queries are started while relisting
+	SeriesQueriesQPS float32
+	// SeriesQueriesBurst is the number of series queries which may be started at once above SeriesQueriesQPS
+	SeriesQueriesBurst int
+	// ExternalMetricsMaxConcurrentQueries is the maximum number of concurrent Prometheus queries per external metric
+	ExternalMetricsMaxConcurrentQueries int
+	// ExternalMetricsNameDiscovery discovers external metrics through the label values API instead of listing series
+	ExternalMetricsNameDiscovery bool
+	// ExternalMetricsAllNamespaces is the namespace in which external metrics are queried across all namespaces
+	ExternalMetricsAllNamespaces string
+	// MergeDefaultRules starts from the default discovery rules generated by config-gen, merging AdapterConfigFile on top
+	MergeDefaultRules bool
+	// EnableExternalMetricOverrides serves an admin endpoint for temporarily overriding external metric values
+	EnableExternalMetricOverrides bool
+	// ExternalMetricOverridesMaxTTL is the maximum duration of an external metric override
+	ExternalMetricOverridesMaxTTL time.Duration
+	// DumpConfigAndExit prints the effective metrics discovery configuration instead of serving the metrics APIs
+	DumpConfigAndExit bool
+	// WatchConfig reloads AdapterConfigFile whenever it changes
+	WatchConfig bool
+	// StaleSampleCutoff is the age beyond which custom metrics samples are treated as missing
+	StaleSampleCutoff time.Duration
+	// QueryCacheTTL is the period for which the results of identical custom metrics queries are shared
+	QueryCacheTTL time.Duration
+	// QueryBatchWindow is the period over which requests for the same custom metric are batched into one query
+	QueryBatchWindow time.Duration
+	// QueryChunkSize is the maximum number of objects matched by a single custom metrics query
+	QueryChunkSize int
+	// QueryChunkConcurrency is the maximum number of chunks of a single custom metrics request queried at once
+	QueryChunkConcurrency int
+	// UnknownMetricCacheTTL is the period for which requests for a custom metric found to be unknown are answered
+	// with NotFound without looking it up again
+	UnknownMetricCacheTTL time.Duration
+	// QueryPlanCacheSize is the number of rendered custom metrics query plans kept for reuse
+	QueryPlanCacheSize int
+	// DiscoveryMetricsLimit is the maximum number of metrics advertised in the discovery document of each metrics API
+	DiscoveryMetricsLimit int
+	// MaxSeriesPerRule is the maximum number of series the series query of a rule may match during a relist
+	MaxSeriesPerRule int
+	// MaxQuerySamples is the maximum number of samples a metrics query may return
+	MaxQuerySamples int
+	// MaxQueryRegexLength is the maximum length of the regular expressions of the label matchers of a metrics query
+	MaxQueryRegexLength int
+	// RejectMetricNameCollisions makes relists in which several rules produce the same metric fail, rather than
+	// serving the metric from the last of these rules
+	RejectMetricNameCollisions bool
+	// SelectorPushdown translates the label selectors of custom metrics requests into matchers on series labels,
+	// rather than listing the matching objects, for the rules mapping their labels
+	SelectorPushdown bool
+	// EnableQueryExplain serves an endpoint showing the query used to answer a metrics API request
+	EnableQueryExplain bool
+	// EnableConfigDump serves an endpoint showing the effective metrics discovery configuration
+	EnableConfigDump bool
+	// EnableExternalMetricLabels serves an endpoint listing the labels known for each external metric
+	EnableExternalMetricLabels bool
+	// EnableRuleCRDs adds the rules from PrometheusAdapterRule objects to those from AdapterConfigFile
+	EnableRuleCRDs bool
+	// ClusterName, if set, restricts all the queries to the series whose ClusterLabel is ClusterName
+	ClusterName string
+	// ClusterLabel is the label holding the name of the cluster of series, if ClusterName is set
+	ClusterLabel string
+	// UnresolvedResourcesRefreshInterval is the interval at which resources referenced by rules, but unknown to
+	// the API server, are looked up again
+	UnresolvedResourcesRefreshInterval time.Duration
+	// QueryFailureEventThreshold is the number of consecutive failures of the query of a metric after which
+	// an event is emitted on the APIService serving it
+	QueryFailureEventThreshold int
+	// QueryFailureCondition maintains a condition on the metrics APIServices naming the metrics whose queries keep failing
+	QueryFailureCondition bool
+	// TracingEndpoint is the OTLP gRPC endpoint to which spans are exported, if tracing is enabled
+	TracingEndpoint string
+	// TracingSamplingRatePerMillion is the number of requests traced per million, unless sampled by the caller
+	TracingSamplingRatePerMillion int32
+	// ReadinessCheckPrometheus only reports the adapter ready while Prometheus reports itself ready
+	ReadinessCheckPrometheus bool
+	// TerminatingPods is how the resource usage of pods being deleted is reported: serve, skip or zero
+	TerminatingPods string
+	// PartialPodMetrics reports the resource usage of pods missing either CPU or memory usage
+	PartialPodMetrics bool
+
+	// tracerProvider traces requests, if tracing is enabled
+	tracerProvider          oteltrace.TracerProvider
+	metricsConfig           *adaptercfg.MetricsDiscoveryConfig
+	externalMetricOverrides *extprov.OverrideStore
+
+	// used to apply a reloaded configuration to the running providers
+	customNamersPreparer   cmprov.NamersPreparer
+	externalNamersPreparer extprov.NamersPreparer
+	resourceProvider       *resprov.ReloadableProvider
+
+	// used by the readiness checks
+	relistCheckers  []syncChecker
+	prometheusReady func(ctx context.Context) error
+
+	// relistLimiter bounds the series queries of the relists of both providers
+	relistLimiter *prom.RequestLimiter
+	// relisted is called after the metrics of either provider were updated
+	relisted relistHooks
+	// snapshotMu serializes writes of the registry snapshot
+	snapshotMu sync.Mutex
+
+	// rulesMu guards the configuration and rules applied to the running providers
+	rulesMu  sync.Mutex
+	crdRules adaptercfg.RuleSpec
+}
+
+// relistHooks are the functions to call after the available metrics of a
+// provider were updated.  Providers may relist as soon as they're started,
+// so hooks may be added concurrently with the calls.
+type relistHooks struct {
+	mu    sync.Mutex
+	hooks []func()
+}
+
+// add registers a function to call after each update.
+func (h *relistHooks) add(hook func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = append(h.hooks, hook)
+}
+
+// run calls the registered functions.
+func (h *relistHooks) run() {
+	h.mu.Lock()
+	hooks := h.hooks
+	h.mu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
 }
 
 func (cmd *PrometheusAdapter) makePromClient() (prom.Client, error) {
@@ -90,22 +307,46 @@ func (cmd *PrometheusAdapter) makePromClient() (prom.Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid Prometheus URL %q: %v", baseURL, err)
 	}
+	backends, err := parseBackendArgs(cmd.PrometheusBackends)
+	if err != nil {
+		return nil, err
+	}
+	// the socket is dialed whatever the host, so requests to other servers
+	// would silently end up on it too
+	if cmd.PrometheusUnixSocket != "" && (len(backends) > 0 || len(cmd.PrometheusFallbackURLs) > 0) {
+		return nil, fmt.Errorf("may not use prometheus-unix-socket along with prometheus-backend or prometheus-fallback-url")
+	}
 
-	if cmd.PrometheusVerb != http.MethodGet && cmd.PrometheusVerb != http.MethodPost {
-		return nil, fmt.Errorf("unsupported Prometheus HTTP verb %q; supported verbs: \"GET\" and \"POST\"", cmd.PrometheusVerb)
+	verbs, err := prom.ParseVerbs(cmd.PrometheusVerb, cmd.PrometheusEndpointVerbs)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.PrometheusPartialResponse != "" {
+		if _, err := strconv.ParseBool(cmd.PrometheusPartialResponse); err != nil {
+			return nil, fmt.Errorf("invalid value %q for --prometheus-partial-response, must be \"true\" or \"false\"", cmd.PrometheusPartialResponse)
+		}
+	}
+
+	conn, err := newPrometheusConnection(cmd.PrometheusProxyURL, cmd.PrometheusUnixSocket, connectionPool{
+		maxIdleConnsPerHost: cmd.PrometheusMaxIdleConnsPerHost,
+		idleConnTimeout:     cmd.PrometheusIdleConnTimeout,
+		disableHTTP2:        cmd.PrometheusDisableHTTP2,
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	var httpClient *http.Client
 
 	if cmd.PrometheusCAFile != "" {
-		prometheusCAClient, err := makePrometheusCAClient(cmd.PrometheusCAFile, cmd.PrometheusClientTLSCertFile, cmd.PrometheusClientTLSKeyFile)
+		prometheusCAClient, err := makePrometheusCAClient(cmd.PrometheusCAFile, cmd.PrometheusClientTLSCertFile, cmd.PrometheusClientTLSKeyFile, conn)
 		if err != nil {
 			return nil, err
 		}
 		httpClient = prometheusCAClient
 		klog.Info("successfully loaded ca from file")
 	} else {
-		kubeconfigHTTPClient, err := makeKubeconfigHTTPClient(cmd.PrometheusAuthInCluster, cmd.PrometheusAuthConf)
+		kubeconfigHTTPClient, err := makeKubeconfigHTTPClient(cmd.PrometheusAuthInCluster, cmd.PrometheusAuthConf, conn)
 		if err != nil {
 			return nil, err
 		}
@@ -124,30 +365,175 @@ func (cmd *PrometheusAdapter) makePromClient() (prom.Client, error) {
 		}
 		httpClient.Transport = transport.NewBearerAuthRoundTripper(string(data), wrappedTransport)
 	}
-	genericPromClient := prom.NewGenericAPIClient(httpClient, baseURL, parseHeaderArgs(cmd.PrometheusHeaders))
+	if cmd.PrometheusOAuth2TokenURL != "" {
+		if cmd.PrometheusTokenFile != "" {
+			return nil, fmt.Errorf("may not use both prometheus-token-file and prometheus-oauth2-token-url at the same time")
+		}
+		wrappedTransport := http.DefaultTransport
+		if httpClient.Transport != nil {
+			wrappedTransport = httpClient.Transport
+		}
+		oauth2Transport, err := makeOAuth2Transport(cmd.PrometheusOAuth2TokenURL, cmd.PrometheusOAuth2ClientID,
+			cmd.PrometheusOAuth2ClientSecretFile, cmd.PrometheusOAuth2Scopes, wrappedTransport)
+		if err != nil {
+			return nil, err
+		}
+		// don't modify a shared client (e.g. http.DefaultClient when no other auth is used)
+		httpClient = &http.Client{Transport: oauth2Transport}
+	}
+	if cmd.PrometheusAuthSigV4 {
+		if cmd.PrometheusTokenFile != "" || cmd.PrometheusOAuth2TokenURL != "" {
+			return nil, fmt.Errorf("may not use prometheus-auth-sigv4 together with prometheus-token-file or prometheus-oauth2-token-url")
+		}
+		wrappedTransport := http.DefaultTransport
+		if httpClient.Transport != nil {
+			wrappedTransport = httpClient.Transport
+		}
+		sigV4Transport, err := makeSigV4Transport(cmd.PrometheusSigV4Region, cmd.PrometheusSigV4RoleARN, wrappedTransport)
+		if err != nil {
+			return nil, err
+		}
+		httpClient = &http.Client{Transport: sigV4Transport}
+	}
+	if cmd.tracerProvider != nil {
+		// Prometheus can trace the queries of traced requests as well
+		httpClient = withTracing(httpClient, cmd.tracerProvider)
+	}
+	headers := parseHeaderArgs(cmd.PrometheusHeaders)
+	cmd.prometheusReady = func(ctx context.Context) error {
+		return prom.CheckReady(ctx, httpClient, baseURL, headers)
+	}
+
+	// the fallbacks, like the additional backends, share the connection settings of the default backend
+	fallbacks := make([]prom.GenericAPIClient, 0, len(cmd.PrometheusFallbackURLs))
+	for _, rawURL := range cmd.PrometheusFallbackURLs {
+		fallbackURL, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Prometheus fallback URL %q: %v", rawURL, err)
+		}
+		fallbacks = append(fallbacks, cmd.makeGenericPromClientForURL(httpClient, fallbackURL, headers))
+	}
+	primary := cmd.makeGenericPromClientForURL(httpClient, baseURL, headers)
+	var defaultClient prom.Client
+	if cmd.PrometheusFanOut {
+		replicas := []prom.Client{prom.NewClientForAPIWithVerbs(primary, verbs)}
+		for _, fallback := range fallbacks {
+			replicas = append(replicas, prom.NewClientForAPIWithVerbs(fallback, verbs))
+		}
+		defaultClient = prom.NewFanOutClient(replicas...)
+	} else {
+		defaultClient = prom.NewClientForAPIWithVerbs(prom.WithFallbacks(primary, fallbacks, cmd.PrometheusRetryOnCodes), verbs)
+	}
+
+	backendClients := make(map[string]prom.Client, len(backends))
+	for name, backendURL := range backends {
+		backendClients[name] = prom.NewClientForAPIWithVerbs(cmd.makeGenericPromClientForURL(httpClient, backendURL, headers), verbs)
+	}
+	return prom.WithQueryTimeout(prom.NewRoutingClient(defaultClient, backendClients), cmd.PrometheusQueryTimeout), nil
+}
+
+func (cmd *PrometheusAdapter) makeGenericPromClientForURL(httpClient *http.Client, baseURL *url.URL, headers http.Header) prom.GenericAPIClient {
+	genericPromClient := prom.NewGenericAPIClientWithCompression(httpClient, baseURL, headers, !cmd.PrometheusDisableCompression)
+	if allow, err := strconv.ParseBool(cmd.PrometheusPartialResponse); err == nil {
+		genericPromClient = prom.WithPartialResponse(genericPromClient, allow)
+	}
 	instrumentedGenericPromClient := mprom.InstrumentGenericAPIClient(genericPromClient, baseURL.String())
-	return prom.NewClientForAPI(instrumentedGenericPromClient, cmd.PrometheusVerb), nil
+	retryingGenericPromClient := prom.WithRetries(instrumentedGenericPromClient, prom.RetryPolicy{
+		MaxRetries:   cmd.PrometheusMaxRetries,
+		Backoff:      cmd.PrometheusRetryBackoff,
+		MaxBackoff:   10 * cmd.PrometheusRetryBackoff,
+		RetryOnCodes: cmd.PrometheusRetryOnCodes,
+	})
+	return prom.WithCircuitBreaker(retryingGenericPromClient, prom.CircuitBreakerPolicy{
+		FailureThreshold: cmd.PrometheusCircuitBreakerFailures,
+		OpenDuration:     cmd.PrometheusCircuitBreakerOpenDuration,
+		FailureCodes:     cmd.PrometheusRetryOnCodes,
+	})
 }
 
 func (cmd *PrometheusAdapter) addFlags() {
 	cmd.Flags().StringVar(&cmd.PrometheusURL, "prometheus-url", cmd.PrometheusURL,
-		"URL for connecting to Prometheus.")
+		"URL for connecting to Prometheus. It may include a path prefix (e.g. /select/0/prometheus) and "+
+			"query parameters, which are sent along with every request.")
 	cmd.Flags().BoolVar(&cmd.PrometheusAuthInCluster, "prometheus-auth-incluster", cmd.PrometheusAuthInCluster,
 		"use auth details from the in-cluster kubeconfig when connecting to prometheus.")
 	cmd.Flags().StringVar(&cmd.PrometheusAuthConf, "prometheus-auth-config", cmd.PrometheusAuthConf,
 		"kubeconfig file used to configure auth when connecting to Prometheus.")
+	cmd.Flags().StringVar(&cmd.PrometheusProxyURL, "prometheus-proxy-url", cmd.PrometheusProxyURL,
+		"Optional URL of the HTTP, HTTPS or SOCKS5 (socks5://) proxy through which Prometheus, and its fallbacks "+
+			"and backends, are reached")
+	cmd.Flags().StringVar(&cmd.PrometheusUnixSocket, "prometheus-unix-socket", cmd.PrometheusUnixSocket,
+		"Optional path of a Unix domain socket on which Prometheus is reached, e.g. exposed by a local sidecar. "+
+			"The host of prometheus-url is then only used in requests. It may not be combined with "+
+			"prometheus-backend or prometheus-fallback-url")
+	cmd.Flags().IntVar(&cmd.PrometheusMaxIdleConnsPerHost, "prometheus-max-idle-conns-per-host", cmd.PrometheusMaxIdleConnsPerHost,
+		"Number of idle connections kept open to each Prometheus host, for reuse by later requests. "+
+			"Defaults to 0, which keeps the default of the HTTP client")
+	cmd.Flags().DurationVar(&cmd.PrometheusIdleConnTimeout, "prometheus-idle-conn-timeout", cmd.PrometheusIdleConnTimeout,
+		"How long idle connections to Prometheus are kept open. Defaults to 0, which keeps the default of the HTTP client")
+	cmd.Flags().BoolVar(&cmd.PrometheusDisableHTTP2, "prometheus-disable-http2", cmd.PrometheusDisableHTTP2,
+		"Restrict connections to Prometheus to HTTP/1.1, e.g. when it is reached through an ingress mishandling HTTP/2")
 	cmd.Flags().StringVar(&cmd.PrometheusCAFile, "prometheus-ca-file", cmd.PrometheusCAFile,
 		"Optional CA file to use when connecting with Prometheus")
 	cmd.Flags().StringVar(&cmd.PrometheusClientTLSCertFile, "prometheus-client-tls-cert-file", cmd.PrometheusClientTLSCertFile,
-		"Optional client TLS cert file to use when connecting with Prometheus, auto-renewal is not supported")
+		"Optional client TLS cert file to use when connecting with Prometheus. It's reloaded when modified")
 	cmd.Flags().StringVar(&cmd.PrometheusClientTLSKeyFile, "prometheus-client-tls-key-file", cmd.PrometheusClientTLSKeyFile,
-		"Optional client TLS key file to use when connecting with Prometheus, auto-renewal is not supported")
+		"Optional client TLS key file to use when connecting with Prometheus. It's reloaded when modified")
 	cmd.Flags().StringVar(&cmd.PrometheusTokenFile, "prometheus-token-file", cmd.PrometheusTokenFile,
 		"Optional file containing the bearer token to use when connecting with Prometheus")
+	cmd.Flags().StringVar(&cmd.PrometheusOAuth2TokenURL, "prometheus-oauth2-token-url", cmd.PrometheusOAuth2TokenURL,
+		"Optional OAuth2 token endpoint from which to obtain access tokens, using the client credentials flow, "+
+			"when connecting with Prometheus. Requires prometheus-oauth2-client-id and prometheus-oauth2-client-secret-file")
+	cmd.Flags().StringVar(&cmd.PrometheusOAuth2ClientID, "prometheus-oauth2-client-id", cmd.PrometheusOAuth2ClientID,
+		"OAuth2 client ID used to obtain access tokens from prometheus-oauth2-token-url")
+	cmd.Flags().StringVar(&cmd.PrometheusOAuth2ClientSecretFile, "prometheus-oauth2-client-secret-file", cmd.PrometheusOAuth2ClientSecretFile,
+		"File containing the OAuth2 client secret used to obtain access tokens from prometheus-oauth2-token-url")
+	cmd.Flags().StringSliceVar(&cmd.PrometheusOAuth2Scopes, "prometheus-oauth2-scopes", cmd.PrometheusOAuth2Scopes,
+		"Comma-separated scopes to request for OAuth2 access tokens")
+	cmd.Flags().BoolVar(&cmd.PrometheusAuthSigV4, "prometheus-auth-sigv4", cmd.PrometheusAuthSigV4,
+		"Sign requests to Prometheus with AWS Signature Version 4, using the default AWS credentials chain, "+
+			"to query Amazon Managed Service for Prometheus workspaces directly")
+	cmd.Flags().StringVar(&cmd.PrometheusSigV4Region, "prometheus-sigv4-region", cmd.PrometheusSigV4Region,
+		"AWS region requests to Prometheus are signed for. Defaults to the region of the AWS configuration")
+	cmd.Flags().StringVar(&cmd.PrometheusSigV4RoleARN, "prometheus-sigv4-role-arn", cmd.PrometheusSigV4RoleARN,
+		"Optional ARN of an AWS role to assume for signing requests to Prometheus")
 	cmd.Flags().StringArrayVar(&cmd.PrometheusHeaders, "prometheus-header", cmd.PrometheusHeaders,
 		"Optional header to set on requests to prometheus-url. Can be repeated")
+	cmd.Flags().DurationVar(&cmd.PrometheusQueryTimeout, "prometheus-query-timeout", cmd.PrometheusQueryTimeout,
+		"Duration after which queries to Prometheus are cancelled, and the metrics API request fails with a "+
+			"504 Gateway Timeout. Zero means no timeout")
+	cmd.Flags().IntVar(&cmd.PrometheusMaxRetries, "prometheus-max-retries", cmd.PrometheusMaxRetries,
+		"Number of times requests to Prometheus failing with a transient error (a connection error, or a response "+
+			"with one of prometheus-retry-on-codes) are retried, with exponential backoff")
+	cmd.Flags().DurationVar(&cmd.PrometheusRetryBackoff, "prometheus-retry-backoff", cmd.PrometheusRetryBackoff,
+		"Delay before the first retry of a request to Prometheus, doubled for each following retry")
+	cmd.Flags().IntSliceVar(&cmd.PrometheusRetryOnCodes, "prometheus-retry-on-codes", cmd.PrometheusRetryOnCodes,
+		"HTTP status codes of Prometheus responses considered transient errors, which are retried and counted by the circuit breaker")
+	cmd.Flags().IntVar(&cmd.PrometheusCircuitBreakerFailures, "prometheus-circuit-breaker-failures", cmd.PrometheusCircuitBreakerFailures,
+		"Number of consecutive requests to a Prometheus backend failing with a transient error after which requests to it "+
+			"fail immediately for prometheus-circuit-breaker-open-duration. Zero disables the circuit breaker")
+	cmd.Flags().DurationVar(&cmd.PrometheusCircuitBreakerOpenDuration, "prometheus-circuit-breaker-open-duration", cmd.PrometheusCircuitBreakerOpenDuration,
+		"Period for which requests to a failing Prometheus backend fail immediately, before a single request is let through to check it")
 	cmd.Flags().StringVar(&cmd.PrometheusVerb, "prometheus-verb", cmd.PrometheusVerb,
-		"HTTP verb to set on requests to Prometheus. Possible values: \"GET\", \"POST\"")
+		"HTTP verb to set on requests to Prometheus. Possible values: \"GET\", \"POST\". Endpoints rejecting POST "+
+			"requests are sent GET requests instead")
+	cmd.Flags().StringToStringVar(&cmd.PrometheusEndpointVerbs, "prometheus-endpoint-verb", cmd.PrometheusEndpointVerbs,
+		"HTTP verb to set on requests to an endpoint of the Prometheus API, overriding prometheus-verb, as "+
+			"<endpoint>=<verb>, where the endpoint is one of query, query_range, series and label_values. May be repeated")
+	cmd.Flags().BoolVar(&cmd.PrometheusDisableCompression, "prometheus-disable-compression", cmd.PrometheusDisableCompression,
+		"Don't ask Prometheus for gzip-compressed responses, e.g. when it is reached through a proxy mishandling them")
+	cmd.Flags().StringVar(&cmd.PrometheusPartialResponse, "prometheus-partial-response", cmd.PrometheusPartialResponse,
+		"Whether Thanos Query may serve partial data when some of its stores are unavailable: \"true\" or \"false\". "+
+			"If unset, the partial_response parameter isn't sent, and the server's default applies")
+	cmd.Flags().StringArrayVar(&cmd.PrometheusFallbackURLs, "prometheus-fallback-url", cmd.PrometheusFallbackURLs,
+		"URL of a Prometheus replica to which queries are sent when prometheus-url fails with a transient error or "+
+			"times out. Can be repeated, in which case the fallbacks are tried in order")
+	cmd.Flags().BoolVar(&cmd.PrometheusFanOut, "prometheus-fan-out", cmd.PrometheusFanOut,
+		"Send each query to prometheus-url and all the prometheus-fallback-url replicas concurrently, and merge the "+
+			"results, keeping the freshest sample of each series, instead of only using the replicas when prometheus-url fails")
+	cmd.Flags().StringArrayVar(&cmd.PrometheusBackends, "prometheus-backend", cmd.PrometheusBackends,
+		"Additional Prometheus backend, as name=url, which rules may refer to using prometheusRef. "+
+			"Connection settings are shared with prometheus-url. Can be repeated")
 	cmd.Flags().StringVar(&cmd.AdapterConfigFile, "config", cmd.AdapterConfigFile,
 		"Configuration file containing details of how to transform between Prometheus metrics "+
 			"and custom metrics API resources")
@@ -157,6 +543,147 @@ func (cmd *PrometheusAdapter) addFlags() {
 		"period for which to query the set of available metrics from Prometheus")
 	cmd.Flags().BoolVar(&cmd.DisableHTTP2, "disable-http2", cmd.DisableHTTP2,
 		"Disable HTTP/2 support")
+	cmd.Flags().DurationVar(&cmd.ShutdownDelayDuration, "shutdown-delay-duration", cmd.ShutdownDelayDuration,
+		"Time to keep serving requests after SIGTERM, while reporting the adapter as not ready, so that clients "+
+			"stop sending it requests before it stops listening")
+	cmd.Flags().DurationVar(&cmd.ShutdownGracePeriod, "shutdown-grace-period", cmd.ShutdownGracePeriod,
+		"Time given to in-flight requests, and their Prometheus queries, to complete once the adapter stops "+
+			"accepting requests on shutdown. Defaults to the request timeout")
+	cmd.Flags().BoolVar(&cmd.ExposeQueryInErrors, "expose-query-in-errors", cmd.ExposeQueryInErrors,
+		"Include the rendered Prometheus query in the details of custom metrics NotFound errors. "+
+			"Useful for debugging, but reveals the query to anyone able to read the metrics API")
+	cmd.Flags().BoolVar(&cmd.ExposeRuleInErrors, "expose-rule-in-errors", cmd.ExposeRuleInErrors,
+		"Include the ID or series query of the rule a metric comes from in errors returned when "+
+			"its query can't be built or run. Useful for debugging, but reveals the rules to anyone able to read the metrics APIs")
+	cmd.Flags().IntVar(&cmd.ShardIndex, "shard-index", cmd.ShardIndex,
+		"Shard of custom metrics series discovery run by this replica, from 0 to shard-total - 1. "+
+			"A negative value takes it from the ordinal at the end of the hostname, as set for StatefulSet pods")
+	cmd.Flags().IntVar(&cmd.ShardTotal, "shard-total", cmd.ShardTotal,
+		"Number of shards custom metrics series discovery is split into between replicas, which share "+
+			"the series they discover through ConfigMaps. Values below 2 disable sharding")
+	cmd.Flags().StringVar(&cmd.ShardNamespace, "shard-namespace", cmd.ShardNamespace,
+		"Namespace of the ConfigMaps through which shards share the series they discover. "+
+			"Defaults to the namespace of the adapter's service account")
+	cmd.Flags().StringVar(&cmd.RegistrySnapshotFile, "registry-snapshot-file", cmd.RegistrySnapshotFile,
+		"Optional local file to which a protobuf snapshot of all exposed metrics is written at each "+
+			"metrics relist, for use by tooling running alongside the adapter")
+	cmd.Flags().StringVar(&cmd.RegistryCacheFile, "registry-cache-file", cmd.RegistryCacheFile,
+		"Optional local file in which the custom metrics series discovered at each relist are saved, and from "+
+			"which they are loaded on startup, so that custom metrics are served before the first relist completes")
+	cmd.Flags().BoolVar(&cmd.ExternalMetricsNameDiscovery, "external-metrics-name-discovery", cmd.ExternalMetricsNameDiscovery,
+		"Discover external metrics by listing the metric names matching each rule through the Prometheus label "+
+			"values API, instead of listing all of their series. Requires Prometheus 2.24 or later")
+	cmd.Flags().StringVar(&cmd.ExternalMetricsAllNamespaces, "external-metrics-all-namespaces", cmd.ExternalMetricsAllNamespaces,
+		"Namespace in which external metrics are queried across all namespaces, without matching the namespace "+
+			"label, e.g. for cluster-level autoscalers. Empty disables it")
+	cmd.Flags().IntVar(&cmd.MaxConcurrentSeriesQueries, "max-concurrent-series-queries", cmd.MaxConcurrentSeriesQueries,
+		"Maximum number of series queries run concurrently against Prometheus while relisting the series of the "+
+			"custom and external metrics rules. Zero means unlimited")
+	cmd.Flags().Float32Var(&cmd.SeriesQueriesQPS, "series-queries-qps", cmd.SeriesQueriesQPS,
+		"Maximum number of series queries started per second while relisting the series of the custom and "+
+			"external metrics rules. Zero means unlimited")
+	cmd.Flags().IntVar(&cmd.SeriesQueriesBurst, "series-queries-burst", cmd.SeriesQueriesBurst,
+		"Number of series queries which may be started at once, above --series-queries-qps")
+	cmd.Flags().IntVar(&cmd.ExternalMetricsMaxConcurrentQueries, "external-metrics-max-concurrent-queries", cmd.ExternalMetricsMaxConcurrentQueries,
+		"Maximum number of concurrent Prometheus queries for any single external metric. "+
+			"Further requests for that metric wait for a free slot. Zero means unlimited")
+	cmd.Flags().BoolVar(&cmd.MergeDefaultRules, "merge-default-rules", cmd.MergeDefaultRules,
+		"Start from the default rules generated by config-gen, and merge the configuration file on top of them. "+
+			"Rules in the configuration file replace default rules with the same id, and are otherwise added")
+	cmd.Flags().BoolVar(&cmd.DumpConfigAndExit, "dump-config-and-exit", cmd.DumpConfigAndExit,
+		"Print the effective metrics discovery configuration, with the default rules merged in and the rule defaults "+
+			"applied, as YAML, and exit. The running adapter serves it on "+configDumpPath+" if --enable-config-dump is set")
+	cmd.Flags().BoolVar(&cmd.EnableConfigDump, "enable-config-dump", cmd.EnableConfigDump,
+		"Serve "+configDumpPath+", which shows the effective metrics discovery configuration, including the rules from "+
+			"PrometheusAdapterRule objects, with the values of their Prometheus headers redacted. Access is controlled by "+
+			"RBAC on that non-resource URL")
+	cmd.Flags().BoolVar(&cmd.EnableExternalMetricOverrides, "enable-external-metric-overrides", cmd.EnableExternalMetricOverrides,
+		"Serve "+extprov.OverridesPath+", which allows temporarily overriding the value of external metrics "+
+			"(e.g. for game days). Access is controlled by RBAC on that non-resource URL")
+	cmd.Flags().DurationVar(&cmd.ExternalMetricOverridesMaxTTL, "external-metric-overrides-max-ttl", cmd.ExternalMetricOverridesMaxTTL,
+		"Maximum duration of an external metric override")
+	cmd.Flags().BoolVar(&cmd.WatchConfig, "watch-config", cmd.WatchConfig,
+		"Watch the configuration file, and apply changes to the rules without restarting")
+	cmd.Flags().DurationVar(&cmd.StaleSampleCutoff, "stale-sample-cutoff", cmd.StaleSampleCutoff,
+		"Age beyond which samples returned by Prometheus for custom metrics are treated as missing, so that "+
+			"autoscalers don't act on stale data. Zero disables the cutoff")
+	cmd.Flags().DurationVar(&cmd.QueryCacheTTL, "query-cache-ttl", cmd.QueryCacheTTL,
+		"Period for which the results of identical custom metrics queries are shared, so that a burst of "+
+			"requests for the same metric results in a single Prometheus query. Zero disables caching")
+	cmd.Flags().DurationVar(&cmd.QueryBatchWindow, "query-batch-window", cmd.QueryBatchWindow,
+		"Period over which requests for the same custom metric in the same namespace are collected, and "+
+			"answered by a single Prometheus query matching all of the requested objects. Zero disables batching")
+	cmd.Flags().IntVar(&cmd.QueryChunkSize, "query-chunk-size", cmd.QueryChunkSize,
+		"Maximum number of objects matched by a single custom metrics query. Requests for more objects are split "+
+			"into several queries, so that the regular expression matching their names stays within the limits of "+
+			"Prometheus. Zero disables chunking")
+	cmd.Flags().IntVar(&cmd.QueryChunkConcurrency, "query-chunk-concurrency", cmd.QueryChunkConcurrency,
+		"Maximum number of chunks of a single custom metrics request (see --query-chunk-size) queried at once. "+
+			"Further chunks wait for a free slot, and are cancelled as soon as one chunk fails")
+	cmd.Flags().DurationVar(&cmd.UnknownMetricCacheTTL, "unknown-metric-cache-ttl", cmd.UnknownMetricCacheTTL,
+		"Period for which requests for a custom metric found to be unknown (e.g. from HPAs referencing a nonexistent "+
+			"metric) are answered with NotFound without looking it up again, and during which it's only logged once. "+
+			"Zero disables caching")
+	cmd.Flags().IntVar(&cmd.QueryPlanCacheSize, "query-plan-cache-size", cmd.QueryPlanCacheSize,
+		"Number of the most recently rendered custom metrics queries kept for reuse, so that polling the same metric "+
+			"of the same objects doesn't render the query templates again (e.g. 1024). Zero disables caching")
+	cmd.Flags().IntVar(&cmd.DiscoveryMetricsLimit, "discovery-metrics-limit", cmd.DiscoveryMetricsLimit,
+		"Maximum number of metrics advertised in the discovery document of the custom and external metrics APIs. "+
+			"The others are advertised as wildcard entries (e.g. pods/*), and are still served. Zero means unlimited")
+	cmd.Flags().IntVar(&cmd.MaxSeriesPerRule, "max-series-per-rule", cmd.MaxSeriesPerRule,
+		"Maximum number of series the series query of a custom or external metrics rule may match. Relists fail "+
+			"when a rule matches more, and keep serving the previous series. Rules may lower it. Zero means unlimited")
+	cmd.Flags().IntVar(&cmd.MaxQuerySamples, "max-query-samples", cmd.MaxQuerySamples,
+		"Maximum number of samples a custom or external metrics query may return. Requests for which it returns "+
+			"more fail. Rules may lower it. Zero means unlimited")
+	cmd.Flags().IntVar(&cmd.MaxQueryRegexLength, "max-query-regex-length", cmd.MaxQueryRegexLength,
+		"Maximum length of the regular expressions of the label matchers of a custom or external metrics query, e.g. "+
+			"the one matching the names of the requested objects. Requests exceeding it fail without querying "+
+			"Prometheus. Rules may lower it. Zero means unlimited")
+	cmd.Flags().BoolVar(&cmd.RejectMetricNameCollisions, "reject-metric-name-collisions", cmd.RejectMetricNameCollisions,
+		"Reject the series discovered by a relist when several rules produce the same metric, and keep serving "+
+			"the metrics from the previous relist, rather than serving the metric from the last of these rules")
+	cmd.Flags().BoolVar(&cmd.SelectorPushdown, "selector-pushdown", cmd.SelectorPushdown,
+		"Answer custom metrics requests for the objects matching a label selector with a single query matching the selector "+
+			"on series labels, without listing the objects, for the rules mapping the labels of the selector in resources.objectLabels")
+	cmd.Flags().BoolVar(&cmd.EnableQueryExplain, "enable-query-explain", cmd.EnableQueryExplain,
+		"Serve "+queryExplainPath+", which shows the rule and the PromQL query used to answer a custom or external "+
+			"metrics API request, without running it. Access is controlled by RBAC on that non-resource URL")
+	cmd.Flags().BoolVar(&cmd.EnableExternalMetricLabels, "enable-external-metric-labels", cmd.EnableExternalMetricLabels,
+		"Serve "+extprov.LabelsPath+", which lists the labels of the series each external metric is discovered from, "+
+			"i.e. the labels which can be used in its selectors. Access is controlled by RBAC on that non-resource URL")
+	cmd.Flags().StringVar(&cmd.TerminatingPods, "terminating-pods", cmd.TerminatingPods,
+		"How the resource metrics API reports the usage of pods being deleted, whose samples may linger in Prometheus "+
+			"after their containers were killed: serve reports it like for other pods, skip leaves them out, and zero "+
+			"reports zero usage. Their metrics are annotated with "+resprov.TerminatingAnnotation+" in all cases")
+	cmd.Flags().BoolVar(&cmd.PartialPodMetrics, "partial-pod-metrics", cmd.PartialPodMetrics,
+		"Report the resource usage of pods for which only one of CPU and memory usage is known, without "+
+			"the other, instead of leaving them out. Their metrics are annotated with "+resprov.MissingUsageAnnotation)
+	cmd.Flags().BoolVar(&cmd.ReadinessCheckPrometheus, "readiness-check-prometheus", cmd.ReadinessCheckPrometheus,
+		"Only report the adapter as ready on /readyz while the /-/ready endpoint of prometheus-url reports Prometheus as ready")
+	cmd.Flags().BoolVar(&cmd.EnableRuleCRDs, "enable-rule-crds", cmd.EnableRuleCRDs,
+		"Watch "+adaptercfg.RuleKind+" objects in all namespaces, and add their rules to those from the configuration file. "+
+			"The custom and external metrics APIs are always served when set")
+	cmd.Flags().StringVar(&cmd.ClusterName, "cluster-name", cmd.ClusterName,
+		"Name of the cluster whose metrics are served, for Prometheus servers (e.g. Thanos or Mimir) holding the series "+
+			"of several clusters. When set, a matcher on --cluster-label is added to every series query and metrics query")
+	cmd.Flags().StringVar(&cmd.ClusterLabel, "cluster-label", cmd.ClusterLabel,
+		"Label holding the name of the cluster of series, used with --cluster-name")
+	cmd.Flags().DurationVar(&cmd.UnresolvedResourcesRefreshInterval, "unresolved-resources-refresh-interval", cmd.UnresolvedResourcesRefreshInterval,
+		"Interval at which the resources mapped in resources.overrides of rules, but unknown to the API server (e.g. because "+
+			"their CustomResourceDefinitions aren't installed yet), are looked up again, applying the rules once they are known. "+
+			"Zero disables it, leaving these resources ignored until a restart or a configuration reload")
+	cmd.Flags().IntVar(&cmd.QueryFailureEventThreshold, "query-failure-event-threshold", cmd.QueryFailureEventThreshold,
+		"Number of consecutive failures to build or run the query of a custom or external metric after which a warning "+
+			"event is emitted on the APIService serving it, and again after each as many further failures. Zero disables the events")
+	cmd.Flags().BoolVar(&cmd.QueryFailureCondition, "query-failure-condition", cmd.QueryFailureCondition,
+		"Maintain a "+queryFailureConditionType+" condition on the custom and external metrics APIServices, naming the "+
+			"metrics whose queries keep failing. Requires query-failure-event-threshold")
+	cmd.Flags().StringVar(&cmd.TracingEndpoint, "tracing-endpoint", cmd.TracingEndpoint,
+		"OTLP gRPC endpoint, e.g. localhost:4317, to which spans of metrics API requests and of the Prometheus queries "+
+			"answering them are exported. The connection is insecure. Empty disables tracing")
+	cmd.Flags().Int32Var(&cmd.TracingSamplingRatePerMillion, "tracing-sampling-rate-per-million", cmd.TracingSamplingRatePerMillion,
+		"Number of metrics API requests traced per million. Requests whose caller sampled them are traced regardless")
 
 	// Add logging flags
 	logs.AddFlags(cmd.Flags())
@@ -164,12 +691,31 @@ func (cmd *PrometheusAdapter) addFlags() {
 
 func (cmd *PrometheusAdapter) loadConfig() error {
 	// load metrics discovery configuration
-	if cmd.AdapterConfigFile == "" {
+	if cmd.AdapterConfigFile == "" && !cmd.MergeDefaultRules && !cmd.EnableRuleCRDs {
 		return fmt.Errorf("no metrics discovery configuration file specified (make sure to use --config)")
 	}
-	metricsConfig, err := adaptercfg.FromFile(cmd.AdapterConfigFile)
+	metricsConfig := &adaptercfg.MetricsDiscoveryConfig{}
+	if cmd.AdapterConfigFile != "" {
+		var err error
+		metricsConfig, err = adaptercfg.FromFile(cmd.AdapterConfigFile)
+		if err != nil {
+			return fmt.Errorf("unable to load metrics discovery configuration: %v", err)
+		}
+	}
+
+	if cmd.MergeDefaultRules {
+		metricsConfig = adaptercfg.Merge(utils.DefaultConfig(defaultRulesRateInterval, ""), metricsConfig)
+	}
+
+	backends, err := parseBackendArgs(cmd.PrometheusBackends)
 	if err != nil {
-		return fmt.Errorf("unable to load metrics discovery configuration: %v", err)
+		return err
+	}
+	if err := checkPrometheusRefs(metricsConfig.Rules, backends); err != nil {
+		return err
+	}
+	if err := checkPrometheusRefs(metricsConfig.ExternalRules, backends); err != nil {
+		return err
 	}
 
 	cmd.metricsConfig = metricsConfig
@@ -177,8 +723,37 @@ func (cmd *PrometheusAdapter) loadConfig() error {
 	return nil
 }
 
-func (cmd *PrometheusAdapter) makeProvider(promClient prom.Client, stopCh <-chan struct{}) (provider.CustomMetricsProvider, error) {
-	if len(cmd.metricsConfig.Rules) == 0 {
+// cluster returns the cluster the queries are restricted to, if any.
+func (cmd *PrometheusAdapter) cluster() *naming.Cluster {
+	if cmd.ClusterName == "" {
+		return nil
+	}
+	return &naming.Cluster{Label: pmodel.LabelName(cmd.ClusterLabel), Name: cmd.ClusterName}
+}
+
+// namerOptions returns the options the rules are compiled with.
+func (cmd *PrometheusAdapter) namerOptions() []naming.NamerOption {
+	opts := []naming.NamerOption{naming.WithLimits(naming.Limits{
+		MaxSeries: cmd.MaxSeriesPerRule,
+		Query: queryplan.Limits{
+			MaxSamples:     cmd.MaxQuerySamples,
+			MaxRegexLength: cmd.MaxQueryRegexLength,
+		},
+	})}
+	if cluster := cmd.cluster(); cluster != nil {
+		opts = append(opts, naming.WithCluster(*cluster))
+	}
+	return opts
+}
+
+// customNamerOptions returns the options the custom metrics rules are compiled
+// with.
+func (cmd *PrometheusAdapter) customNamerOptions() []naming.NamerOption {
+	return append(cmd.namerOptions(), naming.ForCustomMetrics())
+}
+
+func (cmd *PrometheusAdapter) makeProvider(promClient prom.Client, failures queryplan.FailureReporter, stopCh <-chan struct{}) (provider.CustomMetricsProvider, error) {
+	if len(cmd.metricsConfig.Rules) == 0 && !cmd.EnableRuleCRDs {
 		return nil, nil
 	}
 
@@ -197,20 +772,59 @@ func (cmd *PrometheusAdapter) makeProvider(promClient prom.Client, stopCh <-chan
 	}
 
 	// extract the namers
-	namers, err := naming.NamersFromConfig(cmd.metricsConfig.Rules, mapper)
+	namers, err := naming.NamersFromConfig(cmd.metricsConfig.Rules, mapper, cmd.customNamerOptions()...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct naming scheme from metrics rules: %v", err)
 	}
 
+	shard, err := cmd.makeRelistShard()
+	if err != nil {
+		return nil, err
+	}
+
+	var seriesCache cmprov.SeriesCache
+	if cmd.RegistryCacheFile != "" {
+		seriesCache = cmprov.NewFileSeriesCache(cmd.RegistryCacheFile)
+	}
+
 	// construct the provider and start it
-	cmProvider, runner := cmprov.NewPrometheusProvider(mapper, dynClient, promClient, namers, cmd.MetricsRelistInterval, cmd.MetricsMaxAge)
+	cmProvider, runner := cmprov.NewPrometheusProvider(cmprov.Options{
+		Mapper:                mapper,
+		KubeClient:            dynClient,
+		Client:                promClient,
+		Namers:                namers,
+		UpdateInterval:        cmd.MetricsRelistInterval,
+		MaxAge:                cmd.MetricsMaxAge,
+		RelistLimiter:         cmd.relistLimiter,
+		ExposeQueryInErrors:   cmd.ExposeQueryInErrors,
+		ExposeRuleInErrors:    cmd.ExposeRuleInErrors,
+		QueryCacheTTL:         cmd.QueryCacheTTL,
+		QueryBatchWindow:      cmd.QueryBatchWindow,
+		StaleSampleCutoff:     cmd.StaleSampleCutoff,
+		QueryChunkSize:        cmd.QueryChunkSize,
+		QueryChunkConcurrency: cmd.QueryChunkConcurrency,
+		UnknownMetricCacheTTL: cmd.UnknownMetricCacheTTL,
+		QueryPlanCacheSize:    cmd.QueryPlanCacheSize,
+		RejectCollisions:      cmd.RejectMetricNameCollisions,
+		SelectorPushdown:      cmd.SelectorPushdown,
+		Shard:                 shard,
+		SeriesCache:           seriesCache,
+		Failures:              failures,
+		OnUpdate:              cmd.relisted.run,
+	})
 	runner.RunUntil(stopCh)
+	if preparer, ok := runner.(cmprov.NamersPreparer); ok {
+		cmd.customNamersPreparer = preparer
+	}
+	if checker, ok := runner.(cmprov.SyncChecker); ok {
+		cmd.relistCheckers = append(cmd.relistCheckers, checker)
+	}
 
 	return cmProvider, nil
 }
 
-func (cmd *PrometheusAdapter) makeExternalProvider(promClient prom.Client, stopCh <-chan struct{}) (provider.ExternalMetricsProvider, error) {
-	if len(cmd.metricsConfig.ExternalRules) == 0 {
+func (cmd *PrometheusAdapter) makeExternalProvider(promClient prom.Client, failures queryplan.FailureReporter, stopCh <-chan struct{}) (provider.ExternalMetricsProvider, error) {
+	if len(cmd.metricsConfig.ExternalRules) == 0 && !cmd.EnableRuleCRDs {
 		return nil, nil
 	}
 
@@ -221,14 +835,38 @@ func (cmd *PrometheusAdapter) makeExternalProvider(promClient prom.Client, stopC
 	}
 
 	// extract the namers
-	namers, err := naming.NamersFromConfig(cmd.metricsConfig.ExternalRules, mapper)
+	namers, err := naming.NamersFromConfig(cmd.metricsConfig.ExternalRules, mapper, cmd.namerOptions()...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct naming scheme from metrics rules: %v", err)
 	}
 
+	if cmd.EnableExternalMetricOverrides {
+		cmd.externalMetricOverrides = extprov.NewOverrideStore(cmd.ExternalMetricOverridesMaxTTL)
+	}
+
 	// construct the provider and start it
-	emProvider, runner := extprov.NewExternalPrometheusProvider(promClient, namers, cmd.MetricsRelistInterval, cmd.MetricsMaxAge)
+	emProvider, runner := extprov.NewExternalPrometheusProvider(extprov.Options{
+		Client:                        promClient,
+		Namers:                        namers,
+		UpdateInterval:                cmd.MetricsRelistInterval,
+		MaxAge:                        cmd.MetricsMaxAge,
+		MaxConcurrentQueriesPerMetric: cmd.ExternalMetricsMaxConcurrentQueries,
+		RelistLimiter:                 cmd.relistLimiter,
+		Overrides:                     cmd.externalMetricOverrides,
+		DiscoverNames:                 cmd.ExternalMetricsNameDiscovery,
+		AllNamespaces:                 cmd.ExternalMetricsAllNamespaces,
+		ExposeRuleInErrors:            cmd.ExposeRuleInErrors,
+		RejectCollisions:              cmd.RejectMetricNameCollisions,
+		Failures:                      failures,
+		OnUpdate:                      cmd.relisted.run,
+	})
 	runner.RunUntil(stopCh)
+	if preparer, ok := runner.(extprov.NamersPreparer); ok {
+		cmd.externalNamersPreparer = preparer
+	}
+	if checker, ok := runner.(extprov.SyncChecker); ok {
+		cmd.relistCheckers = append(cmd.relistCheckers, checker)
+	}
 
 	return emProvider, nil
 }
@@ -244,10 +882,18 @@ func (cmd *PrometheusAdapter) addResourceMetricsAPI(promClient prom.Client, stop
 		return err
 	}
 
-	provider, err := resprov.NewProvider(promClient, mapper, cmd.metricsConfig.ResourceRules)
+	provider, err := resprov.NewReloadableProvider(resprov.Options{
+		Client:            promClient,
+		Mapper:            mapper,
+		Rules:             cmd.metricsConfig.ResourceRules,
+		Cluster:           cmd.cluster(),
+		TerminatingPods:   resprov.TerminatingPodsPolicy(cmd.TerminatingPods),
+		PartialPodMetrics: cmd.PartialPodMetrics,
+	})
 	if err != nil {
 		return fmt.Errorf("unable to construct resource metrics API provider: %v", err)
 	}
+	cmd.resourceProvider = provider
 
 	rest, err := cmd.ClientConfig()
 	if err != nil {
@@ -295,23 +941,62 @@ func (cmd *PrometheusAdapter) addResourceMetricsAPI(promClient prom.Client, stop
 	return nil
 }
 
+// writeRegistrySnapshot writes the metrics currently exposed by the given providers
+// (either of which may be nil) to the registry snapshot file.  Nothing is written
+// until all the providers have listed the available metrics, so that the snapshot
+// never lacks the metrics of a provider which hasn't relisted yet.
+func (cmd *PrometheusAdapter) writeRegistrySnapshot(cmProvider provider.CustomMetricsProvider, emProvider provider.ExternalMetricsProvider) {
+	if err := cmd.checkRelisted(nil); err != nil {
+		return
+	}
+
+	cmd.snapshotMu.Lock()
+	defer cmd.snapshotMu.Unlock()
+	snap := &snapshot.RegistrySnapshot{
+		Timestamp: time.Now(),
+	}
+	if cmProvider != nil {
+		snap.CustomMetrics = cmProvider.ListAllMetrics()
+	}
+	if emProvider != nil {
+		snap.ExternalMetrics = emProvider.ListAllExternalMetrics()
+	}
+
+	if err := snapshot.WriteFile(cmd.RegistrySnapshotFile, snap); err != nil {
+		klog.Errorf("unable to write registry snapshot: %v", err)
+	}
+}
+
 func main() {
 	logs.InitLogs()
 	defer logs.FlushLogs()
 
 	// set up flags
 	cmd := &PrometheusAdapter{
-		PrometheusURL:         "https://localhost",
-		PrometheusVerb:        http.MethodGet,
-		MetricsRelistInterval: 10 * time.Minute,
+		PrometheusURL:                 "https://localhost",
+		PrometheusVerb:                http.MethodGet,
+		MetricsRelistInterval:         10 * time.Minute,
+		ExternalMetricOverridesMaxTTL: time.Hour,
+		QueryChunkConcurrency:         cmprov.DefaultQueryChunkConcurrency,
+		SeriesQueriesBurst:            10,
+		ClusterLabel:                  "cluster",
+		TerminatingPods:               string(resprov.TerminatingPodsServe),
+
+		UnresolvedResourcesRefreshInterval: time.Minute,
+
+		PrometheusRetryBackoff:               100 * time.Millisecond,
+		PrometheusRetryOnCodes:               []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		PrometheusCircuitBreakerOpenDuration: 30 * time.Second,
 	}
 	cmd.Name = "prometheus-metrics-adapter"
 
-	cmd.addFlags()
-	if err := cmd.Flags().Parse(os.Args); err != nil {
-		klog.Fatalf("unable to parse flags: %v", err)
+	if err := newAdapterCommand(cmd).Execute(); err != nil {
+		klog.Fatal(err)
 	}
+}
 
+// runServer runs the adapter, serving the metrics APIs until SIGTERM or SIGINT is received.
+func (cmd *PrometheusAdapter) runServer() error {
 	if cmd.OpenAPIConfig == nil {
 		cmd.OpenAPIConfig = genericapiserver.DefaultOpenAPIConfig(generatedopenapi.GetOpenAPIDefinitions, openapinamer.NewDefinitionNamer(api.Scheme, customexternalmetrics.Scheme))
 		cmd.OpenAPIConfig.Info.Title = "prometheus-metrics-adapter"
@@ -329,71 +1014,202 @@ func main() {
 		cmd.MetricsMaxAge = cmd.MetricsRelistInterval
 	}
 
-	// make the prometheus client
+	// stop channel closed on SIGTERM and SIGINT
+	stopCh := genericapiserver.SetupSignalHandler()
+
+	// trace requests, if requested
+	tp, err := cmd.setupTracing(stopCh)
+	if err != nil {
+		return err
+	}
+	cmd.tracerProvider = tp
+
+	// make the prometheus client, tracking its queries so that they can be
+	// drained on shutdown
 	promClient, err := cmd.makePromClient()
 	if err != nil {
-		klog.Fatalf("unable to construct Prometheus client: %v", err)
+		return fmt.Errorf("unable to construct Prometheus client: %v", err)
 	}
+	queries := &inFlightQueries{}
+	promClient = queries.client(promClient)
 
 	// load the config
 	if err := cmd.loadConfig(); err != nil {
-		klog.Fatalf("unable to load metrics discovery config: %v", err)
+		return fmt.Errorf("unable to load metrics discovery config: %v", err)
 	}
 
-	// stop channel closed on SIGTERM and SIGINT
-	stopCh := genericapiserver.SetupSignalHandler()
+	// stop channel of the relists, closed as soon as shutdown starts
+	relistStopCh := make(chan struct{})
+
+	// report repeated query failures as events, if requested
+	var failures queryplan.FailureReporter
+	if reporter, err := cmd.makeQueryFailureReporter(stopCh); err != nil {
+		return fmt.Errorf("unable to construct query failure reporter: %v", err)
+	} else if reporter != nil {
+		failures = reporter
+	}
+
+	// both providers share the limits on the series queries of their relists
+	cmd.relistLimiter = prom.NewRequestLimiter(cmd.MaxConcurrentSeriesQueries, cmd.SeriesQueriesQPS, cmd.SeriesQueriesBurst)
 
 	// construct the provider
-	cmProvider, err := cmd.makeProvider(promClient, stopCh)
+	cmProvider, err := cmd.makeProvider(promClient, failures, relistStopCh)
 	if err != nil {
-		klog.Fatalf("unable to construct custom metrics provider: %v", err)
+		return fmt.Errorf("unable to construct custom metrics provider: %v", err)
 	}
 
 	// attach the provider to the server, if it's needed
+	var discoveredCMProvider provider.CustomMetricsProvider
 	if cmProvider != nil {
-		cmd.WithCustomMetrics(cmProvider)
+		discoveredCMProvider = withDiscoveryLimit(cmProvider, cmd.DiscoveryMetricsLimit)
+		cmd.WithCustomMetrics(discoveredCMProvider)
 	}
 
 	// construct the external provider
-	emProvider, err := cmd.makeExternalProvider(promClient, stopCh)
+	emProvider, err := cmd.makeExternalProvider(promClient, failures, relistStopCh)
 	if err != nil {
-		klog.Fatalf("unable to construct external metrics provider: %v", err)
+		return fmt.Errorf("unable to construct external metrics provider: %v", err)
 	}
 
 	// attach the provider to the server, if it's needed
+	var discoveredEMProvider provider.ExternalMetricsProvider
 	if emProvider != nil {
-		cmd.WithExternalMetrics(emProvider)
+		discoveredEMProvider = withExternalDiscoveryLimit(emProvider, cmd.DiscoveryMetricsLimit)
+		cmd.WithExternalMetrics(discoveredEMProvider)
+	}
+
+	// write out the registry snapshot after each successful relist, if requested
+	if cmd.RegistrySnapshotFile != "" {
+		cmd.relisted.add(func() {
+			cmd.writeRegistrySnapshot(cmProvider, emProvider)
+		})
+		// the first relists may have completed already
+		cmd.writeRegistrySnapshot(cmProvider, emProvider)
+	}
+
+	// pass the limit and continue parameters of custom metrics LIST requests on
+	// to the provider.  This must happen before the server is constructed.
+	config, err := cmd.Config()
+	if err != nil {
+		return fmt.Errorf("unable to construct server configuration: %v", err)
+	}
+	buildHandlerChain := config.GenericConfig.BuildHandlerChainFunc
+	config.GenericConfig.BuildHandlerChainFunc = func(apiHandler http.Handler, c *genericapiserver.Config) http.Handler {
+		handler := buildHandlerChain(cmprov.WithListPagination(apiHandler), c)
+		if cmd.tracerProvider != nil {
+			handler = tracing.WithTracing(handler, cmd.tracerProvider, "MetricsAPI")
+		}
+		return handler
 	}
 
 	// attach resource metrics support, if it's needed
 	if err := cmd.addResourceMetricsAPI(promClient, stopCh); err != nil {
-		klog.Fatalf("unable to install resource metrics API: %v", err)
+		return fmt.Errorf("unable to install resource metrics API: %v", err)
+	}
+
+	// reload the configuration when it changes, if requested
+	if cmd.WatchConfig && cmd.AdapterConfigFile != "" {
+		if err := cmd.watchConfig(stopCh); err != nil {
+			return err
+		}
+	}
+
+	// add the rules from PrometheusAdapterRule objects, if requested
+	if cmd.EnableRuleCRDs {
+		if err := cmd.watchRuleCRDs(stopCh); err != nil {
+			return err
+		}
+	}
+
+	// apply the rules again once the resources they reference are installed
+	if cmd.UnresolvedResourcesRefreshInterval > 0 {
+		if err := cmd.refreshUnresolvedResources(cmd.UnresolvedResourcesRefreshInterval, stopCh); err != nil {
+			return fmt.Errorf("unable to construct RESTMapper: %v", err)
+		}
 	}
 
 	// disable HTTP/2 to mitigate CVE-2023-44487 until the Go standard library
 	// and golang.org/x/net are fully fixed.
 	server, err := cmd.Server()
 	if err != nil {
-		klog.Fatalf("unable to fetch server: %v", err)
+		return fmt.Errorf("unable to fetch server: %v", err)
 	}
 	server.GenericAPIServer.SecureServingInfo.DisableHTTP2 = cmd.DisableHTTP2
+	cmd.configureShutdown(server.GenericAPIServer)
+	if err := addShutdownHooks(server.GenericAPIServer, relistStopCh); err != nil {
+		return fmt.Errorf("unable to add shutdown hooks: %v", err)
+	}
+	if err := cmd.addReadyzChecks(server.GenericAPIServer); err != nil {
+		return fmt.Errorf("unable to add readiness checks: %v", err)
+	}
+
+	// publish the custom and external metrics APIs in the aggregated discovery
+	// document, as their metrics are discovered
+	if manager := server.GenericAPIServer.AggregatedDiscoveryGroupManager; manager != nil {
+		discovery := newAggregatedDiscovery(manager, discoveredCMProvider, discoveredEMProvider)
+		cmd.relisted.add(discovery.update)
+		// the first relists may have completed already
+		discovery.update()
+	}
+
+	// serve the external metric overrides, if enabled.  Like any other path, it's
+	// subject to authentication and authorization by the generic API server.
+	if cmd.externalMetricOverrides != nil {
+		server.GenericAPIServer.Handler.NonGoRestfulMux.Handle(extprov.OverridesPath, cmd.externalMetricOverrides)
+	}
+
+	// serve the effective configuration, if enabled.  Like any other path, it's
+	// subject to authentication and authorization by the generic API server.
+	if cmd.EnableConfigDump {
+		server.GenericAPIServer.Handler.NonGoRestfulMux.Handle(configDumpPath, &configDumpHandler{cmd: cmd})
+	}
+
+	// serve the query explanations, if enabled
+	if cmd.EnableQueryExplain {
+		handler := &queryExplainHandler{}
+		if planner, ok := cmProvider.(cmprov.QueryPlanner); ok {
+			handler.custom = planner
+		}
+		if planner, ok := emProvider.(extprov.QueryPlanner); ok {
+			handler.external = planner
+		}
+		server.GenericAPIServer.Handler.NonGoRestfulMux.Handle(queryExplainPath, handler)
+	}
+
+	// serve the labels of external metrics, if enabled
+	if cmd.EnableExternalMetricLabels {
+		if lister, ok := emProvider.(extprov.LabelLister); ok {
+			server.GenericAPIServer.Handler.NonGoRestfulMux.Handle(extprov.LabelsPath, extprov.NewLabelsHandler(lister))
+		}
+	}
 
 	// run the server
 	if err := cmd.Run(stopCh); err != nil {
-		klog.Fatalf("unable to run custom metrics adapter: %v", err)
+		return fmt.Errorf("unable to run custom metrics adapter: %v", err)
 	}
+
+	// give the queries still in flight, such as those of relists, the grace
+	// period to complete
+	drainQueries(queries, server.GenericAPIServer.ShutdownTimeout)
+	return nil
 }
 
-// makeKubeconfigHTTPClient constructs an HTTP for connecting with the given auth options.
-func makeKubeconfigHTTPClient(inClusterAuth bool, kubeConfigPath string) (*http.Client, error) {
+// makeKubeconfigHTTPClient constructs an HTTP for connecting with the given auth options,
+// through the given connection, if any.
+func makeKubeconfigHTTPClient(inClusterAuth bool, kubeConfigPath string, conn *prometheusConnection) (*http.Client, error) {
 	// make sure we're not trying to use two different sources of auth
 	if inClusterAuth && kubeConfigPath != "" {
 		return nil, fmt.Errorf("may not use both in-cluster auth and an explicit kubeconfig at the same time")
 	}
 
-	// return the default client if we're using no auth
+	// return the default client if we're using no auth, and connecting directly
 	if !inClusterAuth && kubeConfigPath == "" {
-		return http.DefaultClient, nil
+		if conn == nil {
+			return http.DefaultClient, nil
+		}
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		conn.configureTransport(tr)
+		return &http.Client{Transport: tr}, nil
 	}
 
 	var authConf *rest.Config
@@ -412,14 +1228,36 @@ func makeKubeconfigHTTPClient(inClusterAuth bool, kubeConfigPath string) (*http.
 			return nil, fmt.Errorf("unable to construct in-cluster auth configuration for connecting to Prometheus: %v", err)
 		}
 	}
-	tr, err := rest.TransportFor(authConf)
+	if conn == nil {
+		tr, err := rest.TransportFor(authConf)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct client transport for connecting to Prometheus: %v", err)
+		}
+		return &http.Client{Transport: tr}, nil
+	}
+
+	// the transports built by client-go can't be tuned, so build our own,
+	// with the proxy and the client certificate rotation of the ones of
+	// client-go, and only wrap it with the auth of the configuration
+	tlsConfig, err := rest.TLSConfigFor(authConf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct TLS configuration for connecting to Prometheus: %v", err)
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	if authConf.Proxy != nil {
+		tr.Proxy = authConf.Proxy
+	}
+	conn.configureTransport(tr)
+	rotateClientCertificates(tr, certRotationInterval, wait.NeverStop)
+	rt, err := rest.HTTPWrappersForConfig(authConf, tr)
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct client transport for connecting to Prometheus: %v", err)
 	}
-	return &http.Client{Transport: tr}, nil
+	return &http.Client{Transport: rt}, nil
 }
 
-func makePrometheusCAClient(caFilePath string, tlsCertFilePath string, tlsKeyFilePath string) (*http.Client, error) {
+func makePrometheusCAClient(caFilePath string, tlsCertFilePath string, tlsKeyFilePath string, conn *prometheusConnection) (*http.Client, error) {
 	data, err := os.ReadFile(caFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read prometheus-ca-file: %v", err)
@@ -431,31 +1269,91 @@ func makePrometheusCAClient(caFilePath string, tlsCertFilePath string, tlsKeyFil
 	}
 
 	if (tlsCertFilePath != "") && (tlsKeyFilePath != "") {
-		tlsClientCerts, err := tls.LoadX509KeyPair(tlsCertFilePath, tlsKeyFilePath)
+		reloader, err := newKeyPairReloader(tlsCertFilePath, tlsKeyFilePath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read TLS key pair: %v", err)
-		}
-		return &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					RootCAs:      pool,
-					Certificates: []tls.Certificate{tlsClientCerts},
-					MinVersion:   tls.VersionTLS12,
-				},
+			return nil, err
+		}
+		tr := &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:              pool,
+				GetClientCertificate: reloader.GetClientCertificate,
+				MinVersion:           tls.VersionTLS12,
 			},
-		}, nil
+		}
+		conn.configureTransport(tr)
+		return &http.Client{Transport: tr}, nil
 	}
 
-	return &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs:    pool,
-				MinVersion: tls.VersionTLS12,
-			},
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
 		},
+	}
+	conn.configureTransport(tr)
+	return &http.Client{Transport: tr}, nil
+}
+
+// makeOAuth2Transport returns a transport authenticating requests with access
+// tokens obtained from the given token endpoint using the OAuth2 client
+// credentials flow.  Tokens are cached, and renewed when they expire.
+func makeOAuth2Transport(tokenURL, clientID, clientSecretFile string, scopes []string, base http.RoundTripper) (http.RoundTripper, error) {
+	if clientID == "" || clientSecretFile == "" {
+		return nil, fmt.Errorf("prometheus-oauth2-client-id and prometheus-oauth2-client-secret-file are required when using prometheus-oauth2-token-url")
+	}
+	if _, err := url.Parse(tokenURL); err != nil {
+		return nil, fmt.Errorf("invalid prometheus-oauth2-token-url %q: %v", tokenURL, err)
+	}
+	secret, err := os.ReadFile(clientSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prometheus-oauth2-client-secret-file: %v", err)
+	}
+
+	config := &clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: strings.TrimSpace(string(secret)),
+		TokenURL:     tokenURL,
+		Scopes:       scopes,
+	}
+	return &oauth2.Transport{
+		Source: config.TokenSource(context.Background()),
+		Base:   base,
 	}, nil
 }
 
+// parseBackendArgs parses the name=url pairs passed to --prometheus-backend.
+func parseBackendArgs(args []string) (map[string]*url.URL, error) {
+	backends := make(map[string]*url.URL, len(args))
+	for _, arg := range args {
+		name, rawURL, found := strings.Cut(arg, "=")
+		if !found || name == "" || rawURL == "" {
+			return nil, fmt.Errorf("invalid Prometheus backend %q, expected name=url", arg)
+		}
+		if _, ok := backends[name]; ok {
+			return nil, fmt.Errorf("duplicate Prometheus backend %q", name)
+		}
+		backendURL, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL for Prometheus backend %q: %v", name, err)
+		}
+		backends[name] = backendURL
+	}
+	return backends, nil
+}
+
+// checkPrometheusRefs makes sure that the given rules only refer to known Prometheus backends.
+func checkPrometheusRefs(rules []adaptercfg.DiscoveryRule, backends map[string]*url.URL) error {
+	for _, rule := range rules {
+		if rule.PrometheusRef == "" {
+			continue
+		}
+		if _, ok := backends[rule.PrometheusRef]; !ok {
+			return fmt.Errorf("rule with series query %q refers to unknown Prometheus backend %q (see --prometheus-backend)", rule.SeriesQuery, rule.PrometheusRef)
+		}
+	}
+	return nil
+}
+
 func parseHeaderArgs(args []string) http.Header {
 	headers := make(http.Header, len(args))
 	for _, h := range args {
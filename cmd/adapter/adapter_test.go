@@ -17,11 +17,16 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+
+	"sigs.k8s.io/prometheus-adapter/pkg/snapshot"
 )
 
 const certsDir = "testdata"
@@ -59,7 +64,7 @@ func TestMakeKubeconfigHTTPClient(t *testing.T) {
 
 	for _, test := range tests {
 		t.Logf("Running test for: inClusterAuth %v, kubeconfigPath %v", test.inClusterAuth, test.kubeconfigPath)
-		kubeconfigHTTPClient, err := makeKubeconfigHTTPClient(test.inClusterAuth, test.kubeconfigPath)
+		kubeconfigHTTPClient, err := makeKubeconfigHTTPClient(test.inClusterAuth, test.kubeconfigPath, nil)
 		if test.success {
 			if err != nil {
 				t.Errorf("Error is %v, expected nil", err)
@@ -116,7 +121,7 @@ func TestMakePrometheusCAClient(t *testing.T) {
 
 	for _, test := range tests {
 		t.Logf("Running test for: caFilePath %v, tlsCertFilePath %v, tlsKeyFilePath %v", test.caFilePath, test.tlsCertFilePath, test.tlsKeyFilePath)
-		prometheusCAClient, err := makePrometheusCAClient(test.caFilePath, test.tlsCertFilePath, test.tlsKeyFilePath)
+		prometheusCAClient, err := makePrometheusCAClient(test.caFilePath, test.tlsCertFilePath, test.tlsKeyFilePath, nil)
 		if test.success {
 			if err != nil {
 				t.Errorf("Error is %v, expected nil", err)
@@ -127,13 +132,17 @@ func TestMakePrometheusCAClient(t *testing.T) {
 				continue
 			}
 			if test.tlsUsed {
-				if prometheusCAClient.Transport.(*http.Transport).TLSClientConfig.Certificates == nil {
-					t.Error("TLS certificates is nil, expected []tls.Certificate")
+				getCert := prometheusCAClient.Transport.(*http.Transport).TLSClientConfig.GetClientCertificate
+				if getCert == nil {
+					t.Error("GetClientCertificate is nil, expected a TLS certificate callback")
 					continue
 				}
+				if cert, err := getCert(nil); err != nil || cert == nil || len(cert.Certificate) == 0 {
+					t.Errorf("Expected a TLS certificate, got %v (error %v)", cert, err)
+				}
 			} else {
-				if prometheusCAClient.Transport.(*http.Transport).TLSClientConfig.Certificates != nil {
-					t.Errorf("TLS certificates is %+v, expected nil", prometheusCAClient.Transport.(*http.Transport).TLSClientConfig.Certificates)
+				if prometheusCAClient.Transport.(*http.Transport).TLSClientConfig.GetClientCertificate != nil {
+					t.Error("GetClientCertificate is set, expected nil")
 				}
 			}
 		} else if err == nil {
@@ -142,6 +151,54 @@ func TestMakePrometheusCAClient(t *testing.T) {
 	}
 }
 
+func TestMakeOAuth2Transport(t *testing.T) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			t.Errorf("unable to parse token request: %v", err)
+		}
+		if req.Form.Get("grant_type") != "client_credentials" || req.Form.Get("scope") != "metrics.read" {
+			t.Errorf("unexpected token request %v", req.Form)
+		}
+		if id, secret, _ := req.BasicAuth(); id != "adapter" || secret != "s3cret" {
+			t.Errorf("expected client credentials adapter:s3cret, got %s:%s", id, secret)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"t0ken","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer tokenServer.Close()
+
+	var authorization string
+	promServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get("Authorization")
+	}))
+	defer promServer.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := makeOAuth2Transport(tokenServer.URL, "", secretFile, nil, http.DefaultTransport); err == nil {
+		t.Error("expected an error without a client ID")
+	}
+	if _, err := makeOAuth2Transport(tokenServer.URL, "adapter", filepath.Join(certsDir, "missing"), nil, http.DefaultTransport); err == nil {
+		t.Error("expected an error with a missing client secret file")
+	}
+
+	tr, err := makeOAuth2Transport(tokenServer.URL, "adapter", secretFile, []string{"metrics.read"}, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("Error is %v, expected nil", err)
+	}
+	res, err := (&http.Client{Transport: tr}).Get(promServer.URL)
+	if err != nil {
+		t.Fatalf("Error is %v, expected nil", err)
+	}
+	res.Body.Close()
+	if authorization != "Bearer t0ken" {
+		t.Errorf("Expected the Authorization header %q, got %q", "Bearer t0ken", authorization)
+	}
+}
+
 func TestParseHeaderArgs(t *testing.T) {
 	tests := []struct {
 		args    []string
@@ -179,6 +236,33 @@ func TestParseHeaderArgs(t *testing.T) {
 	}
 }
 
+func TestParseBackendArgs(t *testing.T) {
+	backends, err := parseBackendArgs([]string{"thanos=https://thanos:9090", "other=http://other/prom?timeout=5s"})
+	if err != nil {
+		t.Fatalf("Error not expected. Received: %v", err)
+	}
+	if len(backends) != 2 {
+		t.Fatalf("Expected 2 backends, got %d", len(backends))
+	}
+	if got := backends["thanos"].String(); got != "https://thanos:9090" {
+		t.Errorf("Expected URL %q for backend thanos, got %q", "https://thanos:9090", got)
+	}
+	if got := backends["other"].String(); got != "http://other/prom?timeout=5s" {
+		t.Errorf("Expected URL %q for backend other, got %q", "http://other/prom?timeout=5s", got)
+	}
+
+	for _, args := range [][]string{
+		{"thanos"},
+		{"=https://thanos:9090"},
+		{"thanos="},
+		{"thanos=https://a", "thanos=https://b"},
+	} {
+		if _, err := parseBackendArgs(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
 func TestFlags(t *testing.T) {
 	cmd := &PrometheusAdapter{
 		PrometheusURL: "https://localhost",
@@ -209,3 +293,54 @@ func TestFlags(t *testing.T) {
 		}
 	}
 }
+
+func TestCommands(t *testing.T) {
+	cmd := &PrometheusAdapter{
+		PrometheusURL: "https://localhost",
+	}
+	root := newAdapterCommand(cmd)
+
+	for _, name := range []string{"serve", "check", "explain", "version"} {
+		sub, _, err := root.Find([]string{name})
+		if err != nil || sub == root {
+			t.Errorf("Subcommand %q expected to be present, was absent", name)
+			continue
+		}
+		// adapter flags should be available to every subcommand
+		if sub.Flags().Lookup("prometheus-url") == nil && sub.InheritedFlags().Lookup("prometheus-url") == nil {
+			t.Errorf("Subcommand %q expected to accept the adapter flags", name)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	root.SetOut(out)
+	root.SetArgs([]string{"version", "--prometheus-url=https://prometheus"})
+	if err := root.Execute(); err != nil {
+		t.Fatalf("Error is %v, expected nil", err)
+	}
+	if got := strings.TrimSpace(out.String()); got != version {
+		t.Errorf("Expected version %q, got %q", version, got)
+	}
+	if cmd.PrometheusURL != "https://prometheus" {
+		t.Errorf("Expected flags to be parsed for subcommands, got prometheus-url %q", cmd.PrometheusURL)
+	}
+}
+
+func TestRegistrySnapshotIsOnlyWrittenOnceAllProvidersRelisted(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.pb")
+	cmd := &PrometheusAdapter{
+		RegistrySnapshotFile: snapshotFile,
+		relistCheckers:       []syncChecker{fakeSyncChecker(true), fakeSyncChecker(false)},
+	}
+
+	cmd.writeRegistrySnapshot(nil, nil)
+	if _, err := os.Stat(snapshotFile); !os.IsNotExist(err) {
+		t.Errorf("Expected no snapshot to be written before all the providers relisted, got %v", err)
+	}
+
+	cmd.relistCheckers[1] = fakeSyncChecker(true)
+	cmd.writeRegistrySnapshot(nil, nil)
+	if _, err := snapshot.ReadFile(snapshotFile); err != nil {
+		t.Errorf("Expected a snapshot to be written once all the providers relisted, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	apidiscoveryv2 "k8s.io/api/apidiscovery/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/endpoints"
+	"k8s.io/apiserver/pkg/endpoints/discovery"
+	discoveryendpoint "k8s.io/apiserver/pkg/endpoints/discovery/aggregated"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	customexternalmetrics "sigs.k8s.io/custom-metrics-apiserver/pkg/apiserver"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// aggregatedDiscovery publishes the custom and external metrics APIs in the
+// aggregated discovery document served at /apis, in which custom-metrics-apiserver
+// doesn't add them, so that clients relying on it (kubectl, client-go discovery
+// caches and the aggregation layer) don't have to fall back to the legacy
+// discovery endpoints.  Their resources are the discovered metrics, so they're
+// updated after each relist.  The resource metrics API is installed as a regular API
+// group, which is already published.
+type aggregatedDiscovery struct {
+	manager discoveryendpoint.ResourceManager
+	groups  []discoveredGroup
+}
+
+// discoveredGroup is an API group whose resources are listed dynamically.
+type discoveredGroup struct {
+	versions []schema.GroupVersion
+	lister   discovery.APIResourceLister
+}
+
+// newAggregatedDiscovery returns the aggregated discovery of the given
+// providers, which may be nil if their API isn't served.
+func newAggregatedDiscovery(manager discoveryendpoint.ResourceManager, cmProvider provider.CustomMetricsProvider, emProvider provider.ExternalMetricsProvider) *aggregatedDiscovery {
+	d := &aggregatedDiscovery{manager: manager}
+	if cmProvider != nil {
+		d.groups = append(d.groups, discoveredGroup{
+			versions: customexternalmetrics.Scheme.PrioritizedVersionsForGroup(custom_metrics.GroupName),
+			lister:   provider.NewCustomMetricResourceLister(cmProvider),
+		})
+	}
+	if emProvider != nil {
+		d.groups = append(d.groups, discoveredGroup{
+			versions: customexternalmetrics.Scheme.PrioritizedVersionsForGroup(external_metrics.GroupName),
+			lister:   provider.NewExternalMetricResourceLister(emProvider),
+		})
+	}
+	return d
+}
+
+// update publishes the current resources of the groups.  Unchanged groups
+// leave the document, and its ETag, as they are.
+func (d *aggregatedDiscovery) update() {
+	for _, group := range d.groups {
+		listed := withConsistentScopes(group.lister.ListAPIResources())
+		for _, gv := range group.versions {
+			resources := make([]metav1.APIResource, len(listed))
+			for i, resource := range listed {
+				resource.Group, resource.Version = gv.Group, gv.Version
+				resources[i] = resource
+			}
+			converted, err := endpoints.ConvertGroupVersionIntoToDiscovery(resources)
+			if err != nil {
+				klog.Errorf("unable to publish %s in the aggregated discovery document: %v", gv, err)
+				continue
+			}
+			d.manager.AddGroupVersion(gv.Group, apidiscoveryv2.APIVersionDiscovery{
+				Version:   gv.Version,
+				Resources: converted,
+				Freshness: apidiscoveryv2.DiscoveryFreshnessCurrent,
+			})
+		}
+	}
+}
+
+// withConsistentScopes leaves out the metrics whose scope differs from the
+// first listed for the same resource, e.g. the namespaced metrics of
+// namespaces when root-scoped ones exist too, since the aggregated discovery
+// document can't represent them.  They're still served, and listed in the
+// legacy discovery endpoints.
+func withConsistentScopes(resources []metav1.APIResource) []metav1.APIResource {
+	namespaced := make(map[string]bool, len(resources))
+	consistent := resources[:0:0]
+	for _, resource := range resources {
+		parent, _, _ := strings.Cut(resource.Name, "/")
+		if scope, seen := namespaced[parent]; seen && scope != resource.Namespaced {
+			klog.V(2).Infof("leaving %s out of the aggregated discovery document: its scope differs from the other metrics of %s", resource.Name, parent)
+			continue
+		}
+		namespaced[parent] = resource.Namespaced
+		consistent = append(consistent, resource)
+	}
+	return consistent
+}
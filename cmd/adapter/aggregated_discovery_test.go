@@ -0,0 +1,126 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	apidiscoveryv2 "k8s.io/api/apidiscovery/v2"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	discoveryendpoint "k8s.io/apiserver/pkg/endpoints/discovery/aggregated"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func TestAggregatedDiscoveryPublishesTheMetricsAPIs(t *testing.T) {
+	lister := &fakeMetricsLister{
+		custom: []provider.CustomMetricInfo{
+			{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"},
+			{GroupResource: schema.GroupResource{Resource: "nodes"}, Metric: "fan_speed"},
+		},
+		external: []provider.ExternalMetricInfo{{Metric: "queue_depth"}},
+	}
+	manager := discoveryendpoint.NewResourceManager("apis")
+	newAggregatedDiscovery(manager, lister, lister).update()
+
+	req := httptest.NewRequest(http.MethodGet, "/apis", nil)
+	req.Header.Set("Accept", "application/json;g=apidiscovery.k8s.io;v=v2;as=APIGroupDiscoveryList")
+	rec := httptest.NewRecorder()
+	manager.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the aggregated discovery document to be served, got status %d: %s", rec.Code, rec.Body)
+	}
+	var doc apidiscoveryv2.APIGroupDiscoveryList
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Unable to decode the aggregated discovery document: %v", err)
+	}
+
+	groups := map[string]apidiscoveryv2.APIGroupDiscovery{}
+	for _, group := range doc.Items {
+		groups[group.Name] = group
+	}
+	custom, found := groups["custom.metrics.k8s.io"]
+	if !found {
+		t.Fatalf("Expected custom.metrics.k8s.io to be published, got %v", doc.Items)
+	}
+	if len(custom.Versions) != 2 || custom.Versions[0].Version != "v1beta2" || custom.Versions[1].Version != "v1beta1" {
+		t.Fatalf("Expected versions v1beta2 and v1beta1 of custom.metrics.k8s.io, in that order, got %v", custom.Versions)
+	}
+	subresources := map[string]string{}
+	for _, resource := range custom.Versions[0].Resources {
+		for _, sub := range resource.Subresources {
+			subresources[resource.Resource+"/"+sub.Subresource] = sub.ResponseKind.Version + "/" + sub.ResponseKind.Kind
+			if resource.Resource == "pods" && resource.Scope != apidiscoveryv2.ScopeNamespace {
+				t.Errorf("Expected pod metrics to be namespaced, got scope %q", resource.Scope)
+			}
+		}
+	}
+	expected := map[string]string{"pods/http_requests": "v1beta2/MetricValueList", "nodes/fan_speed": "v1beta2/MetricValueList"}
+	if !reflect.DeepEqual(subresources, expected) {
+		t.Errorf("Expected custom metrics %v, got %v", expected, subresources)
+	}
+
+	external, found := groups["external.metrics.k8s.io"]
+	if !found {
+		t.Fatalf("Expected external.metrics.k8s.io to be published, got %v", doc.Items)
+	}
+	if len(external.Versions) != 1 || len(external.Versions[0].Resources) != 1 || external.Versions[0].Resources[0].Resource != "queue_depth" {
+		t.Errorf("Expected the queue_depth external metric, got %v", external.Versions)
+	}
+}
+
+func TestAggregatedDiscoverySkipsMetricsOfMixedScope(t *testing.T) {
+	lister := &fakeMetricsLister{
+		custom: []provider.CustomMetricInfo{
+			{GroupResource: schema.GroupResource{Resource: "namespaces"}, Metric: "quota_used"},
+			{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: true, Metric: "pods_running"},
+			{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"},
+		},
+	}
+	manager := discoveryendpoint.NewResourceManager("apis")
+	newAggregatedDiscovery(manager, lister, nil).update()
+
+	req := httptest.NewRequest(http.MethodGet, "/apis", nil)
+	req.Header.Set("Accept", "application/json;g=apidiscovery.k8s.io;v=v2;as=APIGroupDiscoveryList")
+	rec := httptest.NewRecorder()
+	manager.ServeHTTP(rec, req)
+	var doc apidiscoveryv2.APIGroupDiscoveryList
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Unable to decode the aggregated discovery document: %v", err)
+	}
+	if len(doc.Items) != 1 || len(doc.Items[0].Versions) == 0 {
+		t.Fatalf("Expected custom.metrics.k8s.io to be published, got %v", doc.Items)
+	}
+
+	subresources := map[string]apidiscoveryv2.ResourceScope{}
+	for _, resource := range doc.Items[0].Versions[0].Resources {
+		for _, sub := range resource.Subresources {
+			subresources[resource.Resource+"/"+sub.Subresource] = resource.Scope
+		}
+	}
+	expected := map[string]apidiscoveryv2.ResourceScope{
+		"namespaces/quota_used": apidiscoveryv2.ScopeCluster,
+		"pods/http_requests":    apidiscoveryv2.ScopeNamespace,
+	}
+	if !reflect.DeepEqual(subresources, expected) {
+		t.Errorf("Expected custom metrics %v, got %v", expected, subresources)
+	}
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	pmodel "github.com/prometheus/common/model"
+	plabels "github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	adaptercfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+	resprov "sigs.k8s.io/prometheus-adapter/pkg/resourceprovider"
+)
+
+// checkOptions are the options of the check subcommand.
+type checkOptions struct {
+	showMetrics bool
+	seriesFile  string
+}
+
+func newCheckCommand(cmd *PrometheusAdapter) *cobra.Command {
+	opts := &checkOptions{}
+	c := &cobra.Command{
+		Use:   "check",
+		Short: "Check that the metrics discovery configuration is valid",
+		Long: `Load the metrics discovery configuration and compile all of its rules,
+exactly as the server would at startup, reporting any errors.  Compiling
+resource overrides requires access to the Kubernetes API server.
+
+With --show-metrics, the series query of each rule is run as well, and the
+metrics each rule would expose are printed, along with the resources they
+are associated with.  Series are discovered on the configured Prometheus,
+unless --series-file is given: series are then read from a file instead
+(for instance, the "data" field of a Prometheus /api/v1/series response),
+and only built-in Kubernetes resources are known, so that configurations
+can be checked without access to either Prometheus or the API server.`,
+		Args: cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			return cmd.runCheck(c.OutOrStdout(), opts)
+		},
+	}
+
+	c.Flags().BoolVar(&opts.showMetrics, "show-metrics", false,
+		"Run the series query of every rule, and print the metrics each rule would expose")
+	c.Flags().StringVar(&opts.seriesFile, "series-file", "",
+		"JSON or YAML file containing a list of series, as label name to value maps, to use instead of querying Prometheus.  Implies --show-metrics")
+
+	return c
+}
+
+// runCheck loads the configuration and compiles all the rules it contains,
+// then prints the metrics exposed by each rule if requested.
+func (cmd *PrometheusAdapter) runCheck(out io.Writer, opts *checkOptions) error {
+	if cmd.MetricsMaxAge == 0 {
+		cmd.MetricsMaxAge = cmd.MetricsRelistInterval
+	}
+	if err := cmd.loadConfig(); err != nil {
+		return err
+	}
+
+	var promClient prom.Client
+	var mapper apimeta.RESTMapper
+	if opts.seriesFile != "" {
+		series, err := loadSeriesFile(opts.seriesFile)
+		if err != nil {
+			return err
+		}
+		promClient = &staticSeriesClient{series: series}
+		mapper = staticRESTMapper()
+	} else {
+		var err error
+		mapper, err = cmd.RESTMapper()
+		if err != nil {
+			return fmt.Errorf("unable to construct RESTMapper: %v", err)
+		}
+	}
+
+	if cmd.metricsConfig.ResourceRules != nil {
+		if _, err := resprov.NewProvider(resprov.Options{Mapper: mapper, Rules: cmd.metricsConfig.ResourceRules, Cluster: cmd.cluster()}); err != nil {
+			return fmt.Errorf("invalid resource metrics rules: %v", err)
+		}
+	}
+
+	if !opts.showMetrics && opts.seriesFile == "" {
+		if _, err := naming.NamersFromConfig(cmd.metricsConfig.Rules, mapper, cmd.customNamerOptions()...); err != nil {
+			return fmt.Errorf("invalid custom metrics rules: %v", err)
+		}
+		if _, err := naming.NamersFromConfig(cmd.metricsConfig.ExternalRules, mapper, cmd.namerOptions()...); err != nil {
+			return fmt.Errorf("invalid external metrics rules: %v", err)
+		}
+		fmt.Fprintf(out, "%s: %d custom metrics rules, %d external metrics rules, resource metrics rules: %t\n",
+			cmd.AdapterConfigFile, len(cmd.metricsConfig.Rules), len(cmd.metricsConfig.ExternalRules), cmd.metricsConfig.ResourceRules != nil)
+		return nil
+	}
+
+	if promClient == nil {
+		var err error
+		promClient, err = cmd.makePromClient()
+		if err != nil {
+			return fmt.Errorf("unable to construct Prometheus client: %v", err)
+		}
+	}
+	if cmd.metricsConfig.ResourceRules != nil {
+		fmt.Fprintf(out, "resource metrics rules: ok\n")
+	}
+
+	// collisions is the number of metrics exposed by several rules
+	collisions := 0
+
+	for _, kind := range []struct {
+		name     string
+		rules    []adaptercfg.DiscoveryRule
+		opts     []naming.NamerOption
+		external bool
+	}{
+		{name: "custom", rules: cmd.metricsConfig.Rules, opts: cmd.customNamerOptions()},
+		{name: "external", rules: cmd.metricsConfig.ExternalRules, opts: cmd.namerOptions(), external: true},
+	} {
+		namers, err := naming.NamersFromConfig(kind.rules, mapper, kind.opts...)
+		if err != nil {
+			return fmt.Errorf("invalid %s metrics rules: %v", kind.name, err)
+		}
+		// exposedBy is the index of the first rule exposing each metric
+		exposedBy := make(map[string]int)
+
+		for i, namer := range namers {
+			startTime := pmodel.Now().Add(-1 * cmd.MetricsMaxAge)
+			series, err := naming.ListSeries(context.Background(), promClient, namer, pmodel.Interval{Start: startTime, End: 0})
+			if err != nil {
+				return fmt.Errorf("unable to fetch series for %s metrics rule %d (%s): %v", kind.name, i, namer.Selector(), err)
+			}
+			filtered := namer.FilterSeries(series)
+
+			rule := kind.rules[i]
+			fmt.Fprintf(out, "%s metrics rule %d", kind.name, i)
+			if rule.ID != "" {
+				fmt.Fprintf(out, " (%s)", rule.ID)
+			}
+			fmt.Fprintf(out, ":\n")
+			switch {
+			case rule.Query != "":
+				fmt.Fprintf(out, "  query-only:  %s\n", rule.Query)
+			case rule.Static != nil:
+				fmt.Fprintf(out, "  static:      %s\n", strings.Join(rule.Static.Names, ", "))
+			default:
+				fmt.Fprintf(out, "  seriesQuery: %s\n", rule.SeriesQuery)
+			}
+			fmt.Fprintf(out, "  series:      %d matched, %d after filters\n", len(series), len(filtered))
+
+			exposed := sets.New[string]()
+			for _, s := range filtered {
+				name, err := namer.MetricNameForSeries(s)
+				if err != nil {
+					fmt.Fprintf(out, "  warning:     unable to name series %s: %v\n", s.String(), err)
+					continue
+				}
+				if kind.external {
+					exposed.Insert(name)
+					continue
+				}
+
+				resources, namespaced := namer.ResourcesForSeries(s)
+				if len(resources) == 0 {
+					fmt.Fprintf(out, "  warning:     series %s isn't associated with any resource\n", s.String())
+				}
+				for _, gr := range resources {
+					if namespaced && !namer.ClusterScoped(gr) {
+						exposed.Insert(fmt.Sprintf("%s/%s (namespaced)", gr.String(), name))
+					} else {
+						exposed.Insert(fmt.Sprintf("%s/%s", gr.String(), name))
+					}
+				}
+			}
+
+			if exposed.Len() == 0 {
+				fmt.Fprintf(out, "  exposes:     nothing\n")
+				continue
+			}
+			fmt.Fprintf(out, "  exposes:\n")
+			for _, metric := range sets.List(exposed) {
+				fmt.Fprintf(out, "    %s\n", metric)
+			}
+			for _, metric := range sets.List(exposed) {
+				first, found := exposedBy[metric]
+				if !found {
+					exposedBy[metric] = i
+					continue
+				}
+				fmt.Fprintf(out, "  warning:     %s is also exposed by %s metrics rule %d\n", metric, kind.name, first)
+				collisions++
+			}
+		}
+	}
+
+	if collisions > 0 && cmd.RejectMetricNameCollisions {
+		return fmt.Errorf("%d metrics are exposed by several rules", collisions)
+	}
+	return nil
+}
+
+// loadSeriesFile reads a list of series, each given as a map of label names
+// to values (including __name__), from the given JSON or YAML file.
+func loadSeriesFile(path string) ([]prom.Series, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read series file: %v", err)
+	}
+	var rawSeries []map[string]string
+	if err := yaml.Unmarshal(contents, &rawSeries); err != nil {
+		return nil, fmt.Errorf("unable to parse series file: %v", err)
+	}
+
+	series := make([]prom.Series, 0, len(rawSeries))
+	for _, raw := range rawSeries {
+		s := prom.Series{Labels: pmodel.LabelSet{}}
+		for name, value := range raw {
+			if name == pmodel.MetricNameLabel {
+				s.Name = value
+				continue
+			}
+			s.Labels[pmodel.LabelName(name)] = pmodel.LabelValue(value)
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// clusterScopedKinds are the built-in kinds known to staticRESTMapper which
+// aren't namespaced, and are commonly found in metrics.
+var clusterScopedKinds = sets.New("Node", "Namespace", "PersistentVolume", "StorageClass")
+
+// staticRESTMapper returns a RESTMapper which knows about the built-in
+// Kubernetes resources, without contacting the API server.
+func staticRESTMapper() apimeta.RESTMapper {
+	mapper := apimeta.NewDefaultRESTMapper(scheme.Scheme.PrioritizedVersionsAllGroups())
+	for gvk := range scheme.Scheme.AllKnownTypes() {
+		if gvk.Version == runtime.APIVersionInternal || strings.HasSuffix(gvk.Kind, "List") {
+			continue
+		}
+		scope := apimeta.RESTScopeNamespace
+		if clusterScopedKinds.Has(gvk.Kind) {
+			scope = apimeta.RESTScopeRoot
+		}
+		mapper.Add(gvk, scope)
+	}
+	return mapper
+}
+
+// staticSeriesClient is a prom.Client serving series from a fixed list.  It
+// doesn't support queries.
+type staticSeriesClient struct {
+	series []prom.Series
+}
+
+func (c *staticSeriesClient) Series(_ context.Context, _ pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	var res []prom.Series
+	for _, sel := range selectors {
+		matchers, err := parser.ParseMetricSelector(string(sel))
+		if err != nil {
+			return nil, fmt.Errorf("invalid series selector %q: %v", sel, err)
+		}
+		for _, s := range c.series {
+			if seriesMatches(s, matchers) {
+				res = append(res, s)
+			}
+		}
+	}
+	return res, nil
+}
+
+func (c *staticSeriesClient) LabelValues(ctx context.Context, label string, interval pmodel.Interval, selectors ...prom.Selector) ([]string, error) {
+	series, err := c.Series(ctx, interval, selectors...)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	found := make(map[string]struct{})
+	for _, s := range series {
+		value := string(s.Labels[pmodel.LabelName(label)])
+		if label == pmodel.MetricNameLabel {
+			value = s.Name
+		}
+		if _, seen := found[value]; value != "" && !seen {
+			found[value] = struct{}{}
+			res = append(res, value)
+		}
+	}
+	return res, nil
+}
+
+func (c *staticSeriesClient) Query(context.Context, pmodel.Time, prom.Selector) (prom.QueryResult, error) {
+	return prom.QueryResult{}, fmt.Errorf("queries aren't supported when reading series from a file")
+}
+
+func (c *staticSeriesClient) QueryRange(context.Context, prom.Range, prom.Selector) (prom.QueryResult, error) {
+	return prom.QueryResult{}, fmt.Errorf("queries aren't supported when reading series from a file")
+}
+
+// seriesMatches checks whether the given series matches all the given label matchers.
+func seriesMatches(s prom.Series, matchers []*plabels.Matcher) bool {
+	for _, m := range matchers {
+		value := string(s.Labels[pmodel.LabelName(m.Name)])
+		if m.Name == pmodel.MetricNameLabel {
+			value = s.Name
+		}
+		if !m.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
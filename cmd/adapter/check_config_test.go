@@ -0,0 +1,167 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+const checkRules = `rules:
+- id: http
+  seriesQuery: '{__name__=~"^http_.*_total$",namespace!="",pod!=""}'
+  resources:
+    template: <<.Resource>>
+  name:
+    matches: ^(.*)_total$
+    as: ${1}_per_second
+  metricsQuery: sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)
+externalRules:
+- seriesQuery: '{__name__="queue_depth",queue!=""}'
+  resources:
+    template: <<.Resource>>
+  metricsQuery: sum(<<.Series>>{<<.LabelMatchers>>}) by (queue)
+`
+
+const checkSeries = `[
+  {"__name__": "http_requests_total", "namespace": "default", "pod": "web-0"},
+  {"__name__": "http_requests_total", "pod": "web-1"},
+  {"__name__": "http_errors", "namespace": "default", "pod": "web-0"},
+  {"__name__": "queue_depth", "queue": "jobs"}
+]`
+
+func TestCheckShowsMetricsFromSeriesFile(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	seriesFile := filepath.Join(dir, "series.json")
+	if err := os.WriteFile(configFile, []byte(checkRules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(seriesFile, []byte(checkSeries), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &PrometheusAdapter{}
+	root := newAdapterCommand(cmd)
+	out := new(bytes.Buffer)
+	root.SetOut(out)
+	root.SetArgs([]string{"check", "--config=" + configFile, "--series-file=" + seriesFile})
+	if err := root.Execute(); err != nil {
+		t.Fatalf("Error is %v, expected nil", err)
+	}
+
+	for _, expected := range []string{
+		"custom metrics rule 0 (http):",
+		"series:      1 matched, 1 after filters",
+		"namespaces/http_requests_per_second",
+		"pods/http_requests_per_second (namespaced)",
+		"external metrics rule 0:",
+		"    queue_depth",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestCheckReportsMetricNameCollisions(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	seriesFile := filepath.Join(dir, "series.json")
+	rules := checkRules + `- seriesQuery: '{__name__="queue_backlog",queue!=""}'
+  resources:
+    template: <<.Resource>>
+  name:
+    as: queue_depth
+  metricsQuery: sum(<<.Series>>{<<.LabelMatchers>>}) by (queue)
+`
+	series := `[
+  {"__name__": "http_requests_total", "namespace": "default", "pod": "web-0"},
+  {"__name__": "queue_depth", "queue": "jobs"},
+  {"__name__": "queue_backlog", "queue": "jobs"}
+]`
+	if err := os.WriteFile(configFile, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(seriesFile, []byte(series), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reject := range []bool{false, true} {
+		cmd := &PrometheusAdapter{}
+		root := newAdapterCommand(cmd)
+		out := new(bytes.Buffer)
+		root.SetOut(out)
+		root.SetArgs([]string{"check", "--config=" + configFile, "--series-file=" + seriesFile, "--reject-metric-name-collisions=" + strconv.FormatBool(reject)})
+		err := root.Execute()
+		if reject && err == nil {
+			t.Errorf("Expected an error when rejecting collisions")
+		} else if !reject && err != nil {
+			t.Errorf("Error is %v, expected nil", err)
+		}
+
+		expected := "warning:     queue_depth is also exposed by external metrics rule 0"
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestStaticSeriesClientMatchesSelectors(t *testing.T) {
+	series := []prom.Series{
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"namespace": "default", "pod": "web-0"}},
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "web-1"}},
+		{Name: "node_load1", Labels: pmodel.LabelSet{"node": "node-1"}},
+	}
+
+	tests := []struct {
+		selector string
+		expected int
+	}{
+		{selector: `http_requests_total`, expected: 2},
+		{selector: `{__name__=~"http_.*"}`, expected: 2},
+		{selector: `{__name__=~"http_.*",namespace!=""}`, expected: 1},
+		{selector: `http_requests_total{pod=~'web-[01]', namespace=""}`, expected: 1},
+		{selector: "{node!~`node-.*`}", expected: 2},
+		{selector: `{pod="web-0",}`, expected: 1},
+	}
+	for _, test := range tests {
+		matched, err := (&staticSeriesClient{series: series}).Series(context.Background(), pmodel.Interval{}, prom.Selector(test.selector))
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", test.selector, err)
+			continue
+		}
+		if len(matched) != test.expected {
+			t.Errorf("Expected %q to match %d series, matched %d", test.selector, test.expected, len(matched))
+		}
+	}
+
+	for _, invalid := range []string{``, `{pod}`, `{pod="web-0"`, `{pod=web-0}`, `{pod=~"("}`, `{pod="a" node="b"}`} {
+		if _, err := (&staticSeriesClient{series: series}).Series(context.Background(), pmodel.Interval{}, prom.Selector(invalid)); err == nil {
+			t.Errorf("Expected an error parsing %q", invalid)
+		}
+	}
+}
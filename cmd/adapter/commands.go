@@ -0,0 +1,221 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	adaptercfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+)
+
+// version is the adapter version, set at build time via -ldflags.
+var version = "unknown"
+
+// newAdapterCommand builds the adapter command tree.  All adapter flags are
+// shared by every subcommand, and running the root command without a
+// subcommand serves the metrics APIs, as the adapter always has.
+func newAdapterCommand(cmd *PrometheusAdapter) *cobra.Command {
+	root := &cobra.Command{
+		Use:   "adapter",
+		Short: "Serve the Kubernetes metrics APIs using metrics from Prometheus",
+		Args:  cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			return cmd.serve(c.OutOrStdout())
+		},
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	root.CompletionOptions.DisableDefaultCmd = true
+
+	// register the adapter flags as persistent flags so that the operational
+	// subcommands can connect to the same Prometheus and load the same config
+	// as the server does.
+	cmd.FlagSet = root.PersistentFlags()
+	cmd.addFlags()
+
+	root.AddCommand(
+		&cobra.Command{
+			Use:   "serve",
+			Short: "Serve the custom, external and resource metrics APIs (the default)",
+			Args:  cobra.NoArgs,
+			RunE: func(c *cobra.Command, args []string) error {
+				return cmd.serve(c.OutOrStdout())
+			},
+		},
+		newCheckCommand(cmd),
+		newExplainCommand(cmd),
+		&cobra.Command{
+			Use:   "version",
+			Short: "Print the adapter version",
+			Args:  cobra.NoArgs,
+			Run: func(c *cobra.Command, args []string) {
+				fmt.Fprintln(c.OutOrStdout(), version)
+			},
+		},
+	)
+
+	return root
+}
+
+// serve serves the metrics APIs, or only prints the effective configuration
+// if requested.
+func (cmd *PrometheusAdapter) serve(out io.Writer) error {
+	if cmd.DumpConfigAndExit {
+		return cmd.runDumpConfig(out)
+	}
+	return cmd.runServer()
+}
+
+// explainOptions are the options of the explain subcommand.
+type explainOptions struct {
+	resource  string
+	namespace string
+	names     []string
+}
+
+func newExplainCommand(cmd *PrometheusAdapter) *cobra.Command {
+	opts := &explainOptions{}
+	c := &cobra.Command{
+		Use:   "explain METRIC",
+		Short: "Show which rules and series produce a metric, and the queries used to fetch it",
+		Long: `Discover the series available in Prometheus, and show every custom or
+external metrics rule producing the given metric name, along with the series
+it was derived from and the resources it is associated with.  When --resource
+(for custom metrics) and --names are given, the rendered query is shown too.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			return cmd.runExplain(c.OutOrStdout(), args[0], opts)
+		},
+	}
+
+	c.Flags().StringVar(&opts.resource, "resource", "",
+		"Resource (e.g. pods or deployments.apps) for which to render custom metrics queries")
+	c.Flags().StringVar(&opts.namespace, "namespace", "",
+		"Namespace for which to render queries")
+	c.Flags().StringSliceVar(&opts.names, "names", nil,
+		"Resource names for which to render custom metrics queries")
+
+	return c
+}
+
+// runExplain prints every rule producing the given metric name.
+func (cmd *PrometheusAdapter) runExplain(out io.Writer, metricName string, opts *explainOptions) error {
+	if cmd.MetricsMaxAge == 0 {
+		cmd.MetricsMaxAge = cmd.MetricsRelistInterval
+	}
+
+	promClient, err := cmd.makePromClient()
+	if err != nil {
+		return fmt.Errorf("unable to construct Prometheus client: %v", err)
+	}
+	if err := cmd.loadConfig(); err != nil {
+		return err
+	}
+	mapper, err := cmd.RESTMapper()
+	if err != nil {
+		return fmt.Errorf("unable to construct RESTMapper: %v", err)
+	}
+
+	var resource *schema.GroupResource
+	if opts.resource != "" {
+		gr := schema.ParseGroupResource(opts.resource)
+		resource = &gr
+	}
+
+	found := false
+	for _, kind := range []struct {
+		name     string
+		rules    []adaptercfg.DiscoveryRule
+		opts     []naming.NamerOption
+		external bool
+	}{
+		{name: "custom", rules: cmd.metricsConfig.Rules, opts: cmd.customNamerOptions()},
+		{name: "external", rules: cmd.metricsConfig.ExternalRules, opts: cmd.namerOptions(), external: true},
+	} {
+		namers, err := naming.NamersFromConfig(kind.rules, mapper, kind.opts...)
+		if err != nil {
+			return fmt.Errorf("unable to construct naming scheme from %s metrics rules: %v", kind.name, err)
+		}
+
+		for i, namer := range namers {
+			startTime := pmodel.Now().Add(-1 * cmd.MetricsMaxAge)
+			series, err := naming.ListSeries(context.Background(), promClient, namer, pmodel.Interval{Start: startTime, End: 0})
+			if err != nil {
+				return fmt.Errorf("unable to fetch series for %s metrics rule %d (%s): %v", kind.name, i, namer.Selector(), err)
+			}
+
+			for _, s := range namer.FilterSeries(series) {
+				name, err := namer.MetricNameForSeries(s)
+				if err != nil || name != metricName {
+					continue
+				}
+				found = true
+
+				rule := kind.rules[i]
+				fmt.Fprintf(out, "%s metrics rule %d:\n", kind.name, i)
+				switch {
+				case rule.Query != "":
+					fmt.Fprintf(out, "  query-only:   %s\n", rule.Query)
+				case rule.Static != nil:
+					fmt.Fprintf(out, "  static:       %s\n", strings.Join(rule.Static.Names, ", "))
+					fmt.Fprintf(out, "  metricsQuery: %s\n", rule.MetricsQuery)
+				default:
+					fmt.Fprintf(out, "  seriesQuery:  %s\n", rule.SeriesQuery)
+					fmt.Fprintf(out, "  metricsQuery: %s\n", rule.MetricsQuery)
+				}
+				fmt.Fprintf(out, "  series:       %s\n", s.String())
+
+				if kind.external {
+					query, err := namer.QueryForExternalSeries(s.Name, opts.namespace, naming.SelectorWithLabels(labels.Everything(), namer.NameLabelsForSeries(s)))
+					if err != nil {
+						return fmt.Errorf("unable to render query: %v", err)
+					}
+					fmt.Fprintf(out, "  query:        %s\n", query)
+					continue
+				}
+
+				resources, _ := namer.ResourcesForSeries(s)
+				for _, gr := range resources {
+					fmt.Fprintf(out, "  resource:     %s\n", gr.String())
+				}
+				if resource == nil || len(opts.names) == 0 {
+					continue
+				}
+				query, err := namer.QueryForSeries(s.Name, *resource, opts.namespace, naming.SelectorWithLabels(labels.Everything(), namer.NameLabelsForSeries(s)), opts.names...)
+				if err != nil {
+					return fmt.Errorf("unable to render query: %v", err)
+				}
+				fmt.Fprintf(out, "  query:        %s\n", query)
+			}
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("no rule produces a metric named %q from the series currently in Prometheus", metricName)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"k8s.io/klog/v2"
+
+	adaptercfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+// configDumpPath is the path on which the effective configuration is served.
+const configDumpPath = "/debug/config"
+
+// redactedValue replaces the values of the headers of the served configuration.
+const redactedValue = "<redacted>"
+
+// effectiveConfig returns the configuration applied to the running providers:
+// the loaded configuration, with the default rules merged in and the rule
+// defaults applied, followed by the rules from PrometheusAdapterRule objects.
+// The values of the Prometheus headers of the rules, which may hold credentials
+// or tenant IDs, are redacted.
+func (cmd *PrometheusAdapter) effectiveConfig() *adaptercfg.MetricsDiscoveryConfig {
+	cmd.rulesMu.Lock()
+	defer cmd.rulesMu.Unlock()
+
+	cfg := *cmd.metricsConfig
+	cfg.Rules = withRedactedHeaders(append(append([]adaptercfg.DiscoveryRule{}, cfg.Rules...), cmd.crdRules.Rules...))
+	cfg.ExternalRules = withRedactedHeaders(append(append([]adaptercfg.DiscoveryRule{}, cfg.ExternalRules...), cmd.crdRules.ExternalRules...))
+	return &cfg
+}
+
+// withRedactedHeaders replaces the values of the Prometheus headers of the
+// given rules, keeping their names.  The rules must be a copy, their headers
+// aren't modified.
+func withRedactedHeaders(rules []adaptercfg.DiscoveryRule) []adaptercfg.DiscoveryRule {
+	for i := range rules {
+		if len(rules[i].PrometheusHeaders) == 0 {
+			continue
+		}
+		headers := make(map[string]string, len(rules[i].PrometheusHeaders))
+		for name := range rules[i].PrometheusHeaders {
+			headers[name] = redactedValue
+		}
+		rules[i].PrometheusHeaders = headers
+	}
+	return rules
+}
+
+// writeConfig writes the given configuration to the given writer, as YAML.
+func writeConfig(out io.Writer, cfg *adaptercfg.MetricsDiscoveryConfig) error {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("unable to marshal the metrics discovery configuration: %v", err)
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+// runDumpConfig loads the configuration as the server would at startup, and
+// writes it out.
+func (cmd *PrometheusAdapter) runDumpConfig(out io.Writer) error {
+	if err := cmd.loadConfig(); err != nil {
+		return err
+	}
+	return writeConfig(out, cmd.metricsConfig)
+}
+
+// configDumpHandler serves the effective configuration of the adapter, as YAML,
+// so that users can check what it actually loaded, e.g. from a ConfigMap.
+type configDumpHandler struct {
+	cmd *PrometheusAdapter
+}
+
+func (h *configDumpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	if err := writeConfig(w, h.cmd.effectiveConfig()); err != nil {
+		klog.Errorf("unable to serve the metrics discovery configuration: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	adaptercfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+const configDumpRules = `defaults:
+  metricsQuery: sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)
+rules:
+- id: http
+  seriesQuery: '{__name__="http_requests_total",namespace!="",pod!=""}'
+  resources:
+    template: <<.Resource>>
+`
+
+func TestDumpConfigAndExit(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(configDumpRules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := &PrometheusAdapter{AdapterConfigFile: configFile, DumpConfigAndExit: true}
+
+	var out bytes.Buffer
+	if err := cmd.serve(&out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// the rule defaults are applied to the rules
+	cfg, err := adaptercfg.FromYAML(out.Bytes())
+	if err != nil {
+		t.Fatalf("Unable to parse the dumped configuration: %v\n%s", err, out.String())
+	}
+	if len(cfg.Rules) != 1 || cfg.Rules[0].MetricsQuery != "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)" {
+		t.Errorf("Expected the rule to inherit the default metrics query, got:\n%s", out.String())
+	}
+}
+
+func TestConfigDumpHandlerIncludesRuleCRDs(t *testing.T) {
+	cfg, err := adaptercfg.FromYAML([]byte(configDumpRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Rules[0].PrometheusHeaders = map[string]string{"X-Scope-OrgID": "tenant-a"}
+	cmd := &PrometheusAdapter{metricsConfig: cfg}
+	cmd.crdRules.ExternalRules = []adaptercfg.DiscoveryRule{{ID: "from-crd", SeriesQuery: "queue_depth"}}
+
+	rec := httptest.NewRecorder()
+	(&configDumpHandler{cmd: cmd}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, configDumpPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "id: http") || !strings.Contains(body, "id: from-crd") {
+		t.Errorf("Expected the configuration and the rules from PrometheusAdapterRule objects, got:\n%s", body)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "tenant-a") || !strings.Contains(body, "X-Scope-OrgID: <redacted>") {
+		t.Errorf("Expected the names of the Prometheus headers, without their values, got:\n%s", body)
+	}
+	if len(cmd.metricsConfig.ExternalRules) != 0 || cmd.metricsConfig.Rules[0].PrometheusHeaders["X-Scope-OrgID"] != "tenant-a" {
+		t.Errorf("Expected the loaded configuration to be left untouched")
+	}
+
+	rec = httptest.NewRecorder()
+	(&configDumpHandler{cmd: cmd}).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, configDumpPath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST requests, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// wildcardMetric is the name under which the metrics left out of the
+// discovery document are advertised.  Requests for these metrics are still
+// served under their own name.
+const wildcardMetric = "*"
+
+// limitedCustomMetricsProvider advertises at most limit custom metrics in the
+// discovery document of the API.  The others are replaced with one wildcard
+// entry per resource, e.g. pods/*.
+type limitedCustomMetricsProvider struct {
+	provider.CustomMetricsProvider
+	limit int
+}
+
+// withDiscoveryLimit returns the given provider, advertising at most limit of
+// its metrics in the discovery document.  A non-positive limit returns the
+// provider unchanged.
+func withDiscoveryLimit(prov provider.CustomMetricsProvider, limit int) provider.CustomMetricsProvider {
+	if limit <= 0 {
+		return prov
+	}
+	return &limitedCustomMetricsProvider{CustomMetricsProvider: prov, limit: limit}
+}
+
+func (p *limitedCustomMetricsProvider) ListAllMetrics() []provider.CustomMetricInfo {
+	metrics := p.CustomMetricsProvider.ListAllMetrics()
+	if len(metrics) <= p.limit {
+		return metrics
+	}
+
+	sorted := append([]provider.CustomMetricInfo(nil), metrics...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].GroupResource != sorted[j].GroupResource {
+			return sorted[i].GroupResource.String() < sorted[j].GroupResource.String()
+		}
+		if sorted[i].Namespaced != sorted[j].Namespaced {
+			return sorted[j].Namespaced
+		}
+		return sorted[i].Metric < sorted[j].Metric
+	})
+
+	type wildcardKey struct {
+		resource   schema.GroupResource
+		namespaced bool
+	}
+	res := sorted[:p.limit:p.limit]
+	seen := make(map[wildcardKey]struct{})
+	for _, info := range sorted[p.limit:] {
+		key := wildcardKey{resource: info.GroupResource, namespaced: info.Namespaced}
+		if _, found := seen[key]; found {
+			continue
+		}
+		seen[key] = struct{}{}
+		res = append(res, provider.CustomMetricInfo{GroupResource: info.GroupResource, Namespaced: info.Namespaced, Metric: wildcardMetric})
+	}
+	return res
+}
+
+// limitedExternalMetricsProvider advertises at most limit external metrics in
+// the discovery document of the API.  The others are replaced with a single
+// wildcard entry.
+type limitedExternalMetricsProvider struct {
+	provider.ExternalMetricsProvider
+	limit int
+}
+
+// withExternalDiscoveryLimit is like withDiscoveryLimit, for external metrics.
+func withExternalDiscoveryLimit(prov provider.ExternalMetricsProvider, limit int) provider.ExternalMetricsProvider {
+	if limit <= 0 {
+		return prov
+	}
+	return &limitedExternalMetricsProvider{ExternalMetricsProvider: prov, limit: limit}
+}
+
+func (p *limitedExternalMetricsProvider) ListAllExternalMetrics() []provider.ExternalMetricInfo {
+	metrics := p.ExternalMetricsProvider.ListAllExternalMetrics()
+	if len(metrics) <= p.limit {
+		return metrics
+	}
+
+	sorted := append([]provider.ExternalMetricInfo(nil), metrics...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Metric < sorted[j].Metric })
+	return append(sorted[:p.limit:p.limit], provider.ExternalMetricInfo{Metric: wildcardMetric})
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+type fakeMetricsLister struct {
+	provider.CustomMetricsProvider
+	provider.ExternalMetricsProvider
+
+	custom   []provider.CustomMetricInfo
+	external []provider.ExternalMetricInfo
+}
+
+func (l *fakeMetricsLister) ListAllMetrics() []provider.CustomMetricInfo {
+	return l.custom
+}
+
+func (l *fakeMetricsLister) ListAllExternalMetrics() []provider.ExternalMetricInfo {
+	return l.external
+}
+
+func TestDiscoveryLimit(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+	nodes := schema.GroupResource{Resource: "nodes"}
+	lister := &fakeMetricsLister{
+		custom: []provider.CustomMetricInfo{
+			{GroupResource: pods, Namespaced: true, Metric: "memory_usage"},
+			{GroupResource: pods, Namespaced: true, Metric: "cpu_usage"},
+			{GroupResource: nodes, Metric: "fan_speed"},
+			{GroupResource: pods, Namespaced: true, Metric: "http_requests"},
+		},
+		external: []provider.ExternalMetricInfo{{Metric: "queue_depth"}, {Metric: "queue_age"}},
+	}
+
+	if got := withDiscoveryLimit(lister, 0).ListAllMetrics(); !reflect.DeepEqual(got, lister.custom) {
+		t.Errorf("Expected all metrics without a limit, got %v", got)
+	}
+	if got := withDiscoveryLimit(lister, 4).ListAllMetrics(); !reflect.DeepEqual(got, lister.custom) {
+		t.Errorf("Expected all metrics within the limit, got %v", got)
+	}
+
+	expected := []provider.CustomMetricInfo{
+		{GroupResource: nodes, Metric: "fan_speed"},
+		{GroupResource: pods, Namespaced: true, Metric: "cpu_usage"},
+		{GroupResource: pods, Namespaced: true, Metric: "*"},
+	}
+	if got := withDiscoveryLimit(lister, 2).ListAllMetrics(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	expectedExternal := []provider.ExternalMetricInfo{{Metric: "queue_age"}, {Metric: "*"}}
+	if got := withExternalDiscoveryLimit(lister, 1).ListAllExternalMetrics(); !reflect.DeepEqual(got, expectedExternal) {
+		t.Errorf("Expected %v, got %v", expectedExternal, got)
+	}
+}
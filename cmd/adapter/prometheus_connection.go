@@ -0,0 +1,171 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/connrotation"
+	"k8s.io/klog/v2"
+)
+
+// certRotationInterval is how often the client certificate of a kubeconfig is
+// checked for rotation, as in the transports built by client-go.
+const certRotationInterval = 5 * time.Minute
+
+// connectionPool tunes how connections to Prometheus are kept alive and
+// reused.  Zero values keep the defaults of the transport.
+type connectionPool struct {
+	// maxIdleConnsPerHost is the number of idle connections kept open to
+	// each host
+	maxIdleConnsPerHost int
+	// idleConnTimeout is how long idle connections are kept open
+	idleConnTimeout time.Duration
+	// disableHTTP2 restricts connections to HTTP/1.1
+	disableHTTP2 bool
+}
+
+// configureTransport applies the pool settings to the given transport.
+func (p connectionPool) configureTransport(tr *http.Transport) {
+	if p.maxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = p.maxIdleConnsPerHost
+		if tr.MaxIdleConns != 0 && tr.MaxIdleConns < p.maxIdleConnsPerHost {
+			tr.MaxIdleConns = p.maxIdleConnsPerHost
+		}
+	}
+	if p.idleConnTimeout > 0 {
+		tr.IdleConnTimeout = p.idleConnTimeout
+	}
+	if p.disableHTTP2 {
+		// a non-nil empty map keeps the transport from upgrading TLS
+		// connections to HTTP/2
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		if tr.TLSClientConfig != nil {
+			tr.TLSClientConfig = tr.TLSClientConfig.Clone()
+			tr.TLSClientConfig.NextProtos = slices.DeleteFunc(tr.TLSClientConfig.NextProtos, func(proto string) bool {
+				return proto == "h2"
+			})
+		}
+	}
+}
+
+// prometheusConnection is how connections to Prometheus are established and
+// kept when they need tuning, e.g. when Prometheus is only reachable through
+// a local sidecar or an SSH tunnel.
+type prometheusConnection struct {
+	// proxy is the HTTP, HTTPS or SOCKS5 proxy through which Prometheus is
+	// reached, if any
+	proxy *url.URL
+	// unixSocket is the path of the Unix domain socket on which Prometheus
+	// is reached, if any, whatever the host of its URL
+	unixSocket string
+	// pool tunes how connections are kept alive and reused
+	pool connectionPool
+}
+
+// newPrometheusConnection returns the connection settings for the given proxy
+// URL, Unix domain socket and pool settings, or nil if all are empty and
+// Prometheus is reached directly with the default settings.
+func newPrometheusConnection(proxyURL, unixSocket string, pool connectionPool) (*prometheusConnection, error) {
+	if proxyURL == "" && unixSocket == "" && pool == (connectionPool{}) {
+		return nil, nil
+	}
+	if pool.maxIdleConnsPerHost < 0 || pool.idleConnTimeout < 0 {
+		return nil, fmt.Errorf("the Prometheus idle connections settings may not be negative")
+	}
+	if proxyURL != "" && unixSocket != "" {
+		return nil, fmt.Errorf("may not use both prometheus-proxy-url and prometheus-unix-socket at the same time")
+	}
+	conn := &prometheusConnection{unixSocket: unixSocket, pool: pool}
+	if proxyURL != "" {
+		proxy, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Prometheus proxy URL %q: %v", proxyURL, err)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported scheme %q for the Prometheus proxy URL, must be http, https or socks5", proxy.Scheme)
+		}
+		conn.proxy = proxy
+	}
+	return conn, nil
+}
+
+// dial connects to the Unix domain socket, whatever the given address.
+func (c *prometheusConnection) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", c.unixSocket)
+}
+
+// configureTransport makes the given transport connect to Prometheus as
+// configured.  It's a no-op on a nil connection.
+func (c *prometheusConnection) configureTransport(tr *http.Transport) {
+	if c == nil {
+		return
+	}
+	if c.proxy != nil {
+		tr.Proxy = http.ProxyURL(c.proxy)
+	}
+	if c.unixSocket != "" {
+		tr.Proxy = nil
+		tr.DialContext = c.dial
+	}
+	c.pool.configureTransport(tr)
+}
+
+// rotateClientCertificates closes the connections of the given transport when
+// the client certificate of its TLS configuration changes, checking it at the
+// given interval until stopCh is closed, so that a rotated certificate is used
+// right away rather than once the connections are dropped, as client-go does
+// for the transports it builds.
+func rotateClientCertificates(tr *http.Transport, interval time.Duration, stopCh <-chan struct{}) {
+	if tr.TLSClientConfig == nil || tr.TLSClientConfig.GetClientCertificate == nil {
+		return
+	}
+	getCert := tr.TLSClientConfig.GetClientCertificate
+	dialer := connrotation.NewDialer(tr.DialContext)
+	tr.DialContext = dialer.DialContext
+
+	current, err := getCert(nil)
+	if err != nil {
+		klog.Errorf("unable to load the client certificate for connecting to Prometheus: %v", err)
+	}
+	go wait.Until(func() {
+		cert, err := getCert(nil)
+		if err != nil {
+			klog.Errorf("unable to reload the client certificate for connecting to Prometheus: %v", err)
+			return
+		}
+		if current != nil && cert != nil && slices.EqualFunc(current.Certificate, cert.Certificate, bytes.Equal) {
+			return
+		}
+		klog.Infof("the client certificate for connecting to Prometheus changed, closing the existing connections")
+		current = cert
+		dialer.CloseAll()
+	}, interval, stopCh)
+}
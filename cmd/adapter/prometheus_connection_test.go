@@ -0,0 +1,254 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrometheusCanBeReachedOnAUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "prometheus.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Unable to listen on %s: %v", socket, err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+r.URL.Path)
+	}))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	conn, err := newPrometheusConnection("", socket, connectionPool{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client, err := makeKubeconfigHTTPClient(false, "", conn)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := get(t, client, "http://prometheus.monitoring.svc:9090/-/ready"); got != "prometheus.monitoring.svc:9090/-/ready" {
+		t.Errorf("Expected the request to be served on the socket, got %q", got)
+	}
+}
+
+func TestPrometheusCanBeReachedThroughAProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// proxies receive the absolute URL of the requests
+		io.WriteString(w, "proxied "+r.URL.String())
+	}))
+	defer proxy.Close()
+
+	conn, err := newPrometheusConnection(proxy.URL, "", connectionPool{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client, err := makeKubeconfigHTTPClient(false, "", conn)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := get(t, client, "http://prometheus.monitoring.svc:9090/-/ready"); got != "proxied http://prometheus.monitoring.svc:9090/-/ready" {
+		t.Errorf("Expected the request to go through the proxy, got %q", got)
+	}
+	if client == http.DefaultClient {
+		t.Errorf("Expected the default client not to be used")
+	}
+}
+
+func TestKubeconfigProxyIsKeptWhenTheConnectionIsTuned(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "proxied "+r.URL.String())
+	}))
+	defer proxy.Close()
+
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	err := os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: http://prometheus.monitoring.svc:9090
+    proxy-url: `+proxy.URL+`
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test-user
+current-context: test
+users:
+- name: test-user
+  user:
+    token: abcde12345
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := newPrometheusConnection("", "", connectionPool{maxIdleConnsPerHost: 200})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client, err := makeKubeconfigHTTPClient(false, kubeconfig, conn)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := get(t, client, "http://prometheus.monitoring.svc:9090/-/ready"); got != "proxied http://prometheus.monitoring.svc:9090/-/ready" {
+		t.Errorf("Expected the request to go through the proxy of the kubeconfig, got %q", got)
+	}
+}
+
+func TestConnectionsAreClosedWhenTheClientCertificateRotates(t *testing.T) {
+	var mu sync.Mutex
+	cert := &tls.Certificate{Certificate: [][]byte{[]byte("first")}}
+	var peers []net.Conn
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				return cert, nil
+			},
+		},
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			client, server := net.Pipe()
+			peers = append(peers, server)
+			return client, nil
+		},
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	rotateClientCertificates(tr, 10*time.Millisecond, stopCh)
+
+	if _, err := tr.DialContext(context.Background(), "tcp", "prometheus:9090"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	closed := func() bool {
+		peers[0].SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := peers[0].Read(make([]byte, 1))
+		return errors.Is(err, io.EOF)
+	}
+	if closed() {
+		t.Fatalf("Expected the connection to be kept while the certificate is unchanged")
+	}
+
+	mu.Lock()
+	cert = &tls.Certificate{Certificate: [][]byte{[]byte("second")}}
+	mu.Unlock()
+	rotated := false
+	for i := 0; i < 20 && !rotated; i++ {
+		rotated = closed()
+	}
+	if !rotated {
+		t.Errorf("Expected the connection to be closed once the certificate rotated")
+	}
+}
+
+func TestPrometheusConnectionPoolCanBeTuned(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	rootCAs := server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	for _, test := range []struct {
+		pool  connectionPool
+		proto string
+	}{
+		{pool: connectionPool{maxIdleConnsPerHost: 200, idleConnTimeout: time.Minute}, proto: "HTTP/2.0"},
+		{pool: connectionPool{disableHTTP2: true}, proto: "HTTP/1.1"},
+	} {
+		conn, err := newPrometheusConnection("", "", test.pool)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		client, err := makeKubeconfigHTTPClient(false, "", conn)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		tr := client.Transport.(*http.Transport)
+		if test.pool.maxIdleConnsPerHost != 0 && (tr.MaxIdleConnsPerHost != 200 || tr.MaxIdleConns < 200 || tr.IdleConnTimeout != time.Minute) {
+			t.Errorf("Expected the pool settings to be applied, got %d idle connections per host (%d in total) kept for %v",
+				tr.MaxIdleConnsPerHost, tr.MaxIdleConns, tr.IdleConnTimeout)
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}
+		if got := get(t, client, server.URL); got != test.proto {
+			t.Errorf("Expected the request to be served over %s, got %s", test.proto, got)
+		}
+	}
+}
+
+func TestInvalidPrometheusConnections(t *testing.T) {
+	if conn, err := newPrometheusConnection("", "", connectionPool{}); conn != nil || err != nil {
+		t.Errorf("Expected no connection settings by default, got %v, %v", conn, err)
+	}
+	for _, test := range []struct {
+		proxyURL, unixSocket string
+		pool                 connectionPool
+	}{
+		{proxyURL: "http://proxy:3128", unixSocket: "/run/prometheus.sock"},
+		{proxyURL: "ftp://proxy:21"},
+		{proxyURL: "http://proxy:3128/%zz"},
+		{pool: connectionPool{maxIdleConnsPerHost: -1}},
+		{pool: connectionPool{idleConnTimeout: -time.Second}},
+	} {
+		if _, err := newPrometheusConnection(test.proxyURL, test.unixSocket, test.pool); err == nil {
+			t.Errorf("Expected an error for proxy URL %q and Unix socket %q", test.proxyURL, test.unixSocket)
+		}
+	}
+
+	// other servers would be reached on the socket too
+	for _, cmd := range []*PrometheusAdapter{
+		{PrometheusBackends: []string{"thanos=http://thanos:9090"}},
+		{PrometheusFallbackURLs: []string{"http://prometheus-1:9090"}},
+	} {
+		cmd.PrometheusURL = "http://prometheus:9090"
+		cmd.PrometheusVerb = http.MethodGet
+		cmd.PrometheusUnixSocket = "/run/prometheus.sock"
+		if _, err := cmd.makePromClient(); err == nil || !strings.Contains(err.Error(), "prometheus-unix-socket") {
+			t.Errorf("Expected an error for a Unix socket along with backends %v and fallbacks %v", cmd.PrometheusBackends, cmd.PrometheusFallbackURLs)
+		}
+	}
+}
+
+func get(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Unable to get %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Unable to read the response to %s: %v", url, err)
+	}
+	return string(body)
+}
@@ -0,0 +1,295 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	// queryFailingReason is the reason of the events, and of the APIService
+	// condition, reporting that the query of a metric keeps failing.
+	queryFailingReason = "QueryFailing"
+	// queryRecoveredReason is the reason of the events reporting that the
+	// query of a metric succeeded again.
+	queryRecoveredReason = "QueryRecovered"
+	// queriesSucceedingReason is the reason of the APIService condition once
+	// all queries succeed again.
+	queriesSucceedingReason = "QueriesSucceeding"
+	// queryFailureConditionType is the type of the APIService condition set
+	// while the queries of some metrics keep failing.
+	queryFailureConditionType = "PrometheusQueriesFailing"
+	// maxFailingMetricsInCondition bounds the number of failing metrics named
+	// in the message of the APIService condition.
+	maxFailingMetricsInCondition = 10
+)
+
+var apiServiceGVR = schema.GroupVersionResource{
+	Group:    "apiregistration.k8s.io",
+	Version:  "v1",
+	Resource: "apiservices",
+}
+
+// apiServiceNames are the names of the APIService objects on which query
+// failures are reported, by API group.
+var apiServiceNames = map[string]string{
+	custom_metrics.GroupName:   "v1beta1." + custom_metrics.GroupName,
+	external_metrics.GroupName: "v1beta1." + external_metrics.GroupName,
+}
+
+// conditionSetter sets the query failure condition of the given APIService,
+// given the metrics whose queries keep failing.
+type conditionSetter func(ctx context.Context, apiService string, failing []string) error
+
+type failingMetric struct {
+	api    string
+	metric string
+}
+
+// queryFailureEvents is a queryplan.FailureReporter emitting a warning event
+// on the APIService of a metrics API each time the query of one of its metrics
+// has failed threshold more times in a row, and a normal event once it succeeds
+// again.  It can also maintain a condition on the APIService, naming the
+// metrics whose queries keep failing.
+type queryFailureEvents struct {
+	recorder  record.EventRecorder
+	threshold int
+	// setCondition, if set, maintains the condition of the APIServices
+	setCondition conditionSetter
+
+	mu sync.Mutex
+	// failures counts the consecutive failures of the query of each metric
+	failures map[failingMetric]int
+	// changed is notified whenever the set of failing metrics of an API changes
+	changed chan string
+}
+
+// newQueryFailureEvents creates a queryFailureEvents reporting failures using
+// the given recorder, once the query of a metric has failed threshold times
+// in a row.  If setCondition is not nil, it's used to maintain the condition
+// of the APIServices until the given channel is closed.
+func newQueryFailureEvents(recorder record.EventRecorder, threshold int, setCondition conditionSetter, stopCh <-chan struct{}) *queryFailureEvents {
+	e := &queryFailureEvents{
+		recorder:     recorder,
+		threshold:    threshold,
+		setCondition: setCondition,
+		failures:     make(map[failingMetric]int),
+		changed:      make(chan string, len(apiServiceNames)),
+	}
+	if setCondition != nil {
+		go e.runConditions(stopCh)
+	}
+	return e
+}
+
+func (e *queryFailureEvents) QueryFailed(api, metric, rule string, err error) {
+	key := failingMetric{api: api, metric: metric}
+
+	e.mu.Lock()
+	e.failures[key]++
+	count := e.failures[key]
+	e.mu.Unlock()
+
+	if count%e.threshold != 0 {
+		return
+	}
+	e.recorder.Eventf(apiServiceRef(api), corev1.EventTypeWarning, queryFailingReason,
+		"The query for metric %s from rule %q failed %d times in a row: %v", metric, rule, count, err)
+	if count == e.threshold {
+		e.notify(api)
+	}
+}
+
+func (e *queryFailureEvents) QuerySucceeded(api, metric string) {
+	key := failingMetric{api: api, metric: metric}
+
+	e.mu.Lock()
+	count, found := e.failures[key]
+	delete(e.failures, key)
+	e.mu.Unlock()
+
+	if !found || count < e.threshold {
+		return
+	}
+	e.recorder.Eventf(apiServiceRef(api), corev1.EventTypeNormal, queryRecoveredReason,
+		"The query for metric %s succeeded after %d failures", metric, count)
+	e.notify(api)
+}
+
+// notify schedules an update of the condition of the given API's APIService.
+func (e *queryFailureEvents) notify(api string) {
+	if e.setCondition == nil {
+		return
+	}
+	select {
+	case e.changed <- api:
+	default:
+		// an update is already pending, and covers this change
+	}
+}
+
+// failingMetrics returns the sorted metrics of the given API whose queries
+// have failed at least threshold times in a row.
+func (e *queryFailureEvents) failingMetrics(api string) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var failing []string
+	for key, count := range e.failures {
+		if key.api == api && count >= e.threshold {
+			failing = append(failing, key.metric)
+		}
+	}
+	sort.Strings(failing)
+	return failing
+}
+
+// runConditions updates the condition of the APIServices whose failing
+// metrics changed, until the given channel is closed.
+func (e *queryFailureEvents) runConditions(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case api := <-e.changed:
+			// coalesce the pending changes
+			apis := map[string]bool{api: true}
+		drain:
+			for {
+				select {
+				case api := <-e.changed:
+					apis[api] = true
+				default:
+					break drain
+				}
+			}
+			for api := range apis {
+				if err := e.setCondition(context.TODO(), apiServiceNames[api], e.failingMetrics(api)); err != nil {
+					klog.Errorf("unable to update the %s condition of APIService %s: %v", queryFailureConditionType, apiServiceNames[api], err)
+				}
+			}
+		}
+	}
+}
+
+// apiServiceRef refers to the APIService of the given metrics API.
+func apiServiceRef(api string) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: apiServiceGVR.GroupVersion().String(),
+		Kind:       "APIService",
+		Name:       apiServiceNames[api],
+	}
+}
+
+// apiServiceCondition returns the query failure condition of an APIService,
+// given the metrics whose queries keep failing.
+func apiServiceCondition(failing []string, now time.Time) map[string]interface{} {
+	condition := map[string]interface{}{
+		"type":               queryFailureConditionType,
+		"status":             string(metav1.ConditionFalse),
+		"reason":             queriesSucceedingReason,
+		"message":            "The queries of all metrics succeed",
+		"lastTransitionTime": now.UTC().Format(time.RFC3339),
+	}
+	if len(failing) > 0 {
+		named := failing
+		if len(named) > maxFailingMetricsInCondition {
+			named = named[:maxFailingMetricsInCondition]
+		}
+		message := fmt.Sprintf("The queries of %d metrics keep failing: %s", len(failing), strings.Join(named, ", "))
+		if len(named) < len(failing) {
+			message += ", ..."
+		}
+		condition["status"] = string(metav1.ConditionTrue)
+		condition["reason"] = queryFailingReason
+		condition["message"] = message
+	}
+	return condition
+}
+
+// apiServiceConditionSetter returns a conditionSetter patching the status of
+// APIServices using the given client.
+func apiServiceConditionSetter(client dynamic.Interface) conditionSetter {
+	return func(ctx context.Context, apiService string, failing []string) error {
+		patch, err := json.Marshal(map[string]interface{}{
+			"status": map[string]interface{}{
+				"conditions": []interface{}{apiServiceCondition(failing, time.Now())},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		// conditions are merged by type, leaving those of the aggregator alone
+		_, err = client.Resource(apiServiceGVR).Patch(ctx, apiService, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status")
+		return err
+	}
+}
+
+// makeQueryFailureReporter returns the reporter of query failures, if enabled.
+func (cmd *PrometheusAdapter) makeQueryFailureReporter(stopCh <-chan struct{}) (*queryFailureEvents, error) {
+	if cmd.QueryFailureEventThreshold <= 0 {
+		if cmd.QueryFailureCondition {
+			return nil, fmt.Errorf("--query-failure-condition requires --query-failure-event-threshold")
+		}
+		return nil, nil
+	}
+
+	clientConfig, err := cmd.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct Kubernetes client config: %v", err)
+	}
+	client, err := corev1client.NewForConfig(clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct Kubernetes client: %v", err)
+	}
+
+	var setCondition conditionSetter
+	if cmd.QueryFailureCondition {
+		dynClient, err := cmd.DynamicClient()
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct Kubernetes client: %v", err)
+		}
+		setCondition = apiServiceConditionSetter(dynClient)
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: client.Events("")})
+	go func() {
+		<-stopCh
+		broadcaster.Shutdown()
+	}()
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "prometheus-adapter"})
+
+	return newQueryFailureEvents(recorder, cmd.QueryFailureEventThreshold, setCondition, stopCh), nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+func TestQueryFailureEventsAfterThreshold(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	events := newQueryFailureEvents(recorder, 3, nil, nil)
+	queryErr := errors.New("connection refused")
+
+	for i := 0; i < 2; i++ {
+		events.QueryFailed(external_metrics.GroupName, "queue_depth", "queue-rule", queryErr)
+	}
+	if len(recorder.Events) != 0 {
+		t.Fatalf("expected no event before the threshold, got %q", <-recorder.Events)
+	}
+
+	events.QueryFailed(external_metrics.GroupName, "queue_depth", "queue-rule", queryErr)
+	expected := `Warning QueryFailing The query for metric queue_depth from rule "queue-rule" failed 3 times in a row: connection refused`
+	if event := <-recorder.Events; event != expected {
+		t.Errorf("expected event %q, got %q", expected, event)
+	}
+
+	// further failures are only reported every threshold failures
+	for i := 0; i < 3; i++ {
+		events.QueryFailed(external_metrics.GroupName, "queue_depth", "queue-rule", queryErr)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "failed 6 times in a row") {
+		t.Errorf("expected an event after 6 failures, got %q", event)
+	}
+
+	events.QuerySucceeded(external_metrics.GroupName, "queue_depth")
+	if event := <-recorder.Events; event != "Normal QueryRecovered The query for metric queue_depth succeeded after 6 failures" {
+		t.Errorf("expected a recovery event, got %q", event)
+	}
+
+	// successes reset the count, and aren't reported below the threshold
+	events.QueryFailed(external_metrics.GroupName, "queue_depth", "queue-rule", queryErr)
+	events.QuerySucceeded(external_metrics.GroupName, "queue_depth")
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no event below the threshold, got %q", <-recorder.Events)
+	}
+}
+
+func TestQueryFailureEventsMaintainCondition(t *testing.T) {
+	type update struct {
+		apiService string
+		failing    []string
+	}
+	updates := make(chan update, 10)
+	setCondition := func(_ context.Context, apiService string, failing []string) error {
+		updates <- update{apiService: apiService, failing: failing}
+		return nil
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	events := newQueryFailureEvents(record.NewFakeRecorder(10), 1, setCondition, stopCh)
+	events.QueryFailed(custom_metrics.GroupName, "pods/http_requests(namespaced)", "http-rule", errors.New("timeout"))
+
+	select {
+	case got := <-updates:
+		expected := update{apiService: "v1beta1.custom.metrics.k8s.io", failing: []string{"pods/http_requests(namespaced)"}}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected condition update %v, got %v", expected, got)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the condition to be updated")
+	}
+
+	events.QuerySucceeded(custom_metrics.GroupName, "pods/http_requests(namespaced)")
+	select {
+	case got := <-updates:
+		if len(got.failing) != 0 {
+			t.Errorf("expected no failing metrics, got %v", got.failing)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the condition to be updated")
+	}
+}
+
+func TestAPIServiceCondition(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	condition := apiServiceCondition(nil, now)
+	if condition["status"] != "False" || condition["reason"] != queriesSucceedingReason {
+		t.Errorf("expected a false condition without failing metrics, got %v", condition)
+	}
+
+	failing := make([]string, maxFailingMetricsInCondition+2)
+	for i := range failing {
+		failing[i] = "metric_" + string(rune('a'+i))
+	}
+	condition = apiServiceCondition(failing, now)
+	if condition["status"] != "True" || condition["reason"] != queryFailingReason {
+		t.Errorf("expected a true condition with failing metrics, got %v", condition)
+	}
+	message := condition["message"].(string)
+	if !strings.HasPrefix(message, "The queries of 12 metrics keep failing: metric_a, ") || !strings.HasSuffix(message, "metric_j, ...") {
+		t.Errorf("expected the message to name the first failing metrics, got %q", message)
+	}
+	if condition["lastTransitionTime"] != "2024-05-01T12:00:00Z" {
+		t.Errorf("unexpected transition time %v", condition["lastTransitionTime"])
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	cmprov "sigs.k8s.io/prometheus-adapter/pkg/custom-provider"
+	extprov "sigs.k8s.io/prometheus-adapter/pkg/external-provider"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+)
+
+// queryExplainPath is the path on which the query explanation handler is served.
+const queryExplainPath = "/debug/query-explain"
+
+const (
+	customMetricsGroup   = "custom.metrics.k8s.io"
+	externalMetricsGroup = "external.metrics.k8s.io"
+)
+
+// queryExplanation describes the query the adapter would run for a metrics API request.
+type queryExplanation struct {
+	// Rule identifies the discovery rule matching the request.
+	Rule string `json:"rule"`
+	// Series is the Prometheus series the metric is derived from.
+	Series string `json:"series,omitempty"`
+	// Query is the rendered query.
+	Query string `json:"query"`
+	// Backend is the Prometheus backend the query is sent to, if not the default one.
+	Backend string `json:"backend,omitempty"`
+}
+
+// queryExplainHandler shows, without running it, the query used to answer the
+// custom or external metrics API request given in its "path" query parameter,
+// e.g. /debug/query-explain?path=/apis/custom.metrics.k8s.io/v1beta2/namespaces/default/pods/*/http_requests
+type queryExplainHandler struct {
+	custom   cmprov.QueryPlanner
+	external extprov.QueryPlanner
+}
+
+func (h *queryExplainHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	plan, err := h.planFor(req.Context(), req.URL.Query().Get("path"))
+	if err != nil {
+		code := http.StatusInternalServerError
+		if status, ok := err.(apierr.APIStatus); ok {
+			code = int(status.Status().Code)
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(queryExplanation{
+		Rule:    plan.Rule,
+		Series:  plan.Series,
+		Query:   string(plan.Query),
+		Backend: plan.Backend,
+	}); err != nil {
+		klog.Errorf("unable to write response: %v", err)
+	}
+}
+
+// planFor parses the given metrics API path, and returns the plan used to answer it.
+func (h *queryExplainHandler) planFor(ctx context.Context, rawPath string) (*queryplan.Plan, error) {
+	if rawPath == "" {
+		return nil, apierr.NewBadRequest("the path of a custom or external metrics API request must be given in the path query parameter")
+	}
+	target, err := url.Parse(rawPath)
+	if err != nil {
+		return nil, apierr.NewBadRequest(fmt.Sprintf("invalid path %q: %v", rawPath, err))
+	}
+	params := target.Query()
+
+	segments := strings.Split(strings.Trim(target.Path, "/"), "/")
+	if len(segments) < 3 || segments[0] != "apis" {
+		return nil, apierr.NewBadRequest(fmt.Sprintf("%q isn't a metrics API path", target.Path))
+	}
+	group, rest := segments[1], segments[3:]
+
+	switch group {
+	case customMetricsGroup:
+		if h.custom == nil {
+			return nil, apierr.NewBadRequest("the custom metrics API isn't served by this adapter")
+		}
+		return h.planForCustom(ctx, rest, params)
+	case externalMetricsGroup:
+		if h.external == nil {
+			return nil, apierr.NewBadRequest("the external metrics API isn't served by this adapter")
+		}
+		return h.planForExternal(rest, params)
+	default:
+		return nil, apierr.NewBadRequest(fmt.Sprintf("%q isn't a custom or external metrics API path", target.Path))
+	}
+}
+
+func (h *queryExplainHandler) planForCustom(ctx context.Context, segments []string, params url.Values) (*queryplan.Plan, error) {
+	selector, err := labels.Parse(params.Get("labelSelector"))
+	if err != nil {
+		return nil, apierr.NewBadRequest(fmt.Sprintf("invalid labelSelector: %v", err))
+	}
+	metricSelector, err := labels.Parse(params.Get("metricLabelSelector"))
+	if err != nil {
+		return nil, apierr.NewBadRequest(fmt.Sprintf("invalid metricLabelSelector: %v", err))
+	}
+
+	var namespace, resource, name, metric string
+	switch {
+	case len(segments) == 4 && segments[0] == "namespaces" && segments[2] == "metrics":
+		// metrics describing a namespace itself
+		resource, name, metric = "namespaces", segments[1], segments[3]
+	case len(segments) == 5 && segments[0] == "namespaces":
+		namespace, resource, name, metric = segments[1], segments[2], segments[3], segments[4]
+	case len(segments) == 3:
+		resource, name, metric = segments[0], segments[1], segments[2]
+	default:
+		return nil, apierr.NewBadRequest("expected a path of the form [namespaces/NAMESPACE/]RESOURCE/NAME/METRIC or namespaces/NAMESPACE/metrics/METRIC")
+	}
+
+	info := provider.CustomMetricInfo{
+		GroupResource: schema.ParseGroupResource(resource),
+		Namespaced:    namespace != "",
+		Metric:        metric,
+	}
+	return h.custom.PlanForRequest(ctx, namespace, name, selector, info, metricSelector)
+}
+
+func (h *queryExplainHandler) planForExternal(segments []string, params url.Values) (*queryplan.Plan, error) {
+	metricSelector, err := labels.Parse(params.Get("labelSelector"))
+	if err != nil {
+		return nil, apierr.NewBadRequest(fmt.Sprintf("invalid labelSelector: %v", err))
+	}
+	if len(segments) != 3 || segments[0] != "namespaces" {
+		return nil, apierr.NewBadRequest("expected a path of the form namespaces/NAMESPACE/METRIC")
+	}
+
+	return h.external.PlanForRequest(segments[1], metricSelector, provider.ExternalMetricInfo{Metric: segments[2]})
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+)
+
+type fakeCustomPlanner struct{}
+
+func (fakeCustomPlanner) PlanForRequest(_ context.Context, namespace, name string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*queryplan.Plan, error) {
+	if info.Metric == "missing" {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	return &queryplan.Plan{
+		Rule:  "custom-rule",
+		Query: prom.Selector(fmt.Sprintf("%s|%s|%s|%t|%s|%s|%s", namespace, info.GroupResource.String(), name, info.Namespaced, info.Metric, selector, metricSelector)),
+	}, nil
+}
+
+type fakeExternalPlanner struct{}
+
+func (fakeExternalPlanner) PlanForRequest(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*queryplan.Plan, error) {
+	return &queryplan.Plan{
+		Rule:    "external-rule",
+		Query:   prom.Selector(fmt.Sprintf("%s|%s|%s", namespace, info.Metric, metricSelector)),
+		Backend: "thanos",
+	}, nil
+}
+
+func TestQueryExplainHandler(t *testing.T) {
+	handler := &queryExplainHandler{custom: fakeCustomPlanner{}, external: fakeExternalPlanner{}}
+
+	tests := []struct {
+		path     string
+		code     int
+		expected queryExplanation
+	}{
+		{
+			path:     "/apis/custom.metrics.k8s.io/v1beta2/namespaces/default/pods/*/http_requests?labelSelector=app%3Dweb&metricLabelSelector=verb%3DGET",
+			code:     http.StatusOK,
+			expected: queryExplanation{Rule: "custom-rule", Query: "default|pods|*|true|http_requests|app=web|verb=GET"},
+		},
+		{
+			path:     "/apis/custom.metrics.k8s.io/v1beta2/namespaces/default/metrics/queue_length",
+			code:     http.StatusOK,
+			expected: queryExplanation{Rule: "custom-rule", Query: "|namespaces|default|false|queue_length||"},
+		},
+		{
+			path:     "/apis/custom.metrics.k8s.io/v1beta1/nodes/node-1/load",
+			code:     http.StatusOK,
+			expected: queryExplanation{Rule: "custom-rule", Query: "|nodes|node-1|false|load||"},
+		},
+		{
+			path:     "/apis/external.metrics.k8s.io/v1beta1/namespaces/default/queue_depth?labelSelector=queue%3Djobs",
+			code:     http.StatusOK,
+			expected: queryExplanation{Rule: "external-rule", Query: "default|queue_depth|queue=jobs", Backend: "thanos"},
+		},
+		{path: "/apis/custom.metrics.k8s.io/v1beta2/namespaces/default/pods/web/missing", code: http.StatusNotFound},
+		{path: "/apis/custom.metrics.k8s.io/v1beta2/pods", code: http.StatusBadRequest},
+		{path: "/apis/apps/v1/deployments", code: http.StatusBadRequest},
+		{path: "", code: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, queryExplainPath+"?path="+url.QueryEscape(test.path), nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("Expected status %d for %q, got %d: %s", test.code, test.path, rec.Code, rec.Body.String())
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		var got queryExplanation
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Errorf("Unable to decode response for %q: %v", test.path, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("Expected %+v for %q, got %+v", test.expected, test.path, got)
+		}
+	}
+}
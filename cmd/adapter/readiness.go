@@ -0,0 +1,67 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/apiserver/pkg/server/healthz"
+)
+
+// prometheusReadyTimeout bounds the readiness check of Prometheus.
+const prometheusReadyTimeout = 5 * time.Second
+
+// syncChecker tells whether a provider listed the available metrics yet.
+type syncChecker interface {
+	HasSynced() bool
+}
+
+// addReadyzChecks makes the adapter only report itself ready on /readyz once
+// the providers have listed the available metrics, so that it doesn't serve
+// empty discovery documents, and, if requested, while Prometheus reports
+// itself ready.
+func (cmd *PrometheusAdapter) addReadyzChecks(server *genericapiserver.GenericAPIServer) error {
+	checks := []healthz.HealthChecker{healthz.NamedCheck("metrics-relisted", cmd.checkRelisted)}
+	if cmd.ReadinessCheckPrometheus {
+		checks = append(checks, healthz.NamedCheck("prometheus", cmd.checkPrometheus))
+	}
+	return server.AddReadyzChecks(checks...)
+}
+
+// checkRelisted fails until all the providers have listed the available metrics.
+func (cmd *PrometheusAdapter) checkRelisted(_ *http.Request) error {
+	for _, checker := range cmd.relistCheckers {
+		if !checker.HasSynced() {
+			return errors.New("the available metrics haven't been listed yet")
+		}
+	}
+	return nil
+}
+
+// checkPrometheus fails while Prometheus doesn't report itself ready.
+func (cmd *PrometheusAdapter) checkPrometheus(req *http.Request) error {
+	if cmd.prometheusReady == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), prometheusReadyTimeout)
+	defer cancel()
+	return cmd.prometheusReady(ctx)
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeSyncChecker bool
+
+func (c fakeSyncChecker) HasSynced() bool {
+	return bool(c)
+}
+
+func TestReadinessChecks(t *testing.T) {
+	req := httptest.NewRequest("GET", "/readyz", nil)
+
+	cmd := &PrometheusAdapter{relistCheckers: []syncChecker{fakeSyncChecker(true), fakeSyncChecker(false)}}
+	if err := cmd.checkRelisted(req); err == nil {
+		t.Errorf("expected the adapter not to be ready before all the providers listed the available metrics")
+	}
+	cmd.relistCheckers[1] = fakeSyncChecker(true)
+	if err := cmd.checkRelisted(req); err != nil {
+		t.Errorf("expected the adapter to be ready once all the providers listed the available metrics, got %v", err)
+	}
+
+	var prometheusErr error
+	cmd.prometheusReady = func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("expected the Prometheus readiness check to be bounded")
+		}
+		return prometheusErr
+	}
+	if err := cmd.checkPrometheus(req); err != nil {
+		t.Errorf("expected the adapter to be ready while Prometheus is, got %v", err)
+	}
+	prometheusErr = errors.New("not ready")
+	if err := cmd.checkPrometheus(req); err == nil {
+		t.Errorf("expected the adapter not to be ready while Prometheus isn't")
+	}
+}
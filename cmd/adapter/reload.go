@@ -0,0 +1,208 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"k8s.io/klog/v2"
+
+	adaptercfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+)
+
+// configReloadDelay is how long to wait after a change to the configuration
+// file before reloading it, so that a burst of events (e.g. from a ConfigMap
+// update swapping symlinks) results in a single reload.
+const configReloadDelay = time.Second
+
+// reloadConfig loads the configuration file again, and applies it to the
+// running providers.  On error, the providers keep using the previous
+// configuration.
+func (cmd *PrometheusAdapter) reloadConfig() error {
+	cmd.rulesMu.Lock()
+	defer cmd.rulesMu.Unlock()
+
+	oldConfig := cmd.metricsConfig
+	if err := cmd.loadConfig(); err != nil {
+		return err
+	}
+	newConfig := cmd.metricsConfig
+	// keep the configuration in use until the new one is fully applied
+	cmd.metricsConfig = oldConfig
+
+	if err := cmd.applyRules(newConfig, cmd.crdRules); err != nil {
+		return err
+	}
+	cmd.metricsConfig = newConfig
+	return nil
+}
+
+// applyRules applies the given configuration, along with the rules from
+// PrometheusAdapterRule objects, to the running providers.  Everything is
+// compiled, and the metrics of the new rules listed, before touching the
+// providers, so that an invalid configuration is rejected as a whole.  It must be called with rulesMu held.
+func (cmd *PrometheusAdapter) applyRules(cfg *adaptercfg.MetricsDiscoveryConfig, crdRules adaptercfg.RuleSpec) error {
+	mapper, err := cmd.RESTMapper()
+	if err != nil {
+		return fmt.Errorf("unable to construct RESTMapper: %v", err)
+	}
+
+	rules := append(append([]adaptercfg.DiscoveryRule{}, cfg.Rules...), crdRules.Rules...)
+	externalRules := append(append([]adaptercfg.DiscoveryRule{}, cfg.ExternalRules...), crdRules.ExternalRules...)
+
+	namers, err := naming.NamersFromConfig(rules, mapper, cmd.customNamerOptions()...)
+	if err != nil {
+		return fmt.Errorf("unable to construct naming scheme from metrics rules: %v", err)
+	}
+	externalNamers, err := naming.NamersFromConfig(externalRules, mapper, cmd.namerOptions()...)
+	if err != nil {
+		return fmt.Errorf("unable to construct naming scheme from external metrics rules: %v", err)
+	}
+	var applyResourceRules func()
+	if cmd.resourceProvider != nil && cfg.ResourceRules != nil {
+		applyResourceRules, err = cmd.resourceProvider.PrepareRules(cfg.ResourceRules)
+		if err != nil {
+			return fmt.Errorf("unable to construct resource metrics API provider: %v", err)
+		}
+	}
+
+	// The metrics APIs served are decided at startup, so enabling or disabling
+	// one of them still requires a restart.
+	if (cmd.customNamersPreparer == nil) != (len(rules) == 0) {
+		klog.Warningf("enabling or disabling the custom metrics API requires restarting the adapter")
+	}
+	if (cmd.externalNamersPreparer == nil) != (len(externalRules) == 0) {
+		klog.Warningf("enabling or disabling the external metrics API requires restarting the adapter")
+	}
+	if (cmd.resourceProvider == nil) != (cfg.ResourceRules == nil) {
+		klog.Warningf("enabling or disabling the resource metrics API requires restarting the adapter")
+	}
+
+	// relist the metrics of both providers before serving either of them
+	var applyCustomNamers, applyExternalNamers func() error
+	if cmd.customNamersPreparer != nil {
+		applyCustomNamers, err = cmd.customNamersPreparer.PrepareNamers(namers)
+		if err != nil {
+			return fmt.Errorf("unable to relist custom metrics: %v", err)
+		}
+	}
+	if cmd.externalNamersPreparer != nil {
+		applyExternalNamers, err = cmd.externalNamersPreparer.PrepareNamers(externalNamers)
+		if err != nil {
+			return fmt.Errorf("unable to relist external metrics: %v", err)
+		}
+	}
+
+	// Only the custom metrics may still be rejected (see
+	// --reject-metric-name-collisions, which the external provider enforces by
+	// keeping the previous metrics), so they're swapped first.
+	if applyCustomNamers != nil {
+		if err := applyCustomNamers(); err != nil {
+			return fmt.Errorf("unable to apply custom metrics rules: %v", err)
+		}
+	}
+	if applyExternalNamers != nil {
+		if err := applyExternalNamers(); err != nil {
+			return fmt.Errorf("unable to apply external metrics rules: %v", err)
+		}
+	}
+	if applyResourceRules != nil {
+		applyResourceRules()
+	}
+
+	return nil
+}
+
+// watchConfig reloads the configuration whenever the configuration file, or
+// one of the rule files it references, changes, until the given channel is
+// closed.  The directories containing the files are watched rather than the
+// files themselves, so that ConfigMap updates (which atomically swap a
+// symlink) are noticed as well.
+func (cmd *PrometheusAdapter) watchConfig(stopCh <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("unable to create configuration file watcher: %v", err)
+	}
+	if err := watcher.Add(filepath.Dir(cmd.AdapterConfigFile)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("unable to watch configuration file: %v", err)
+	}
+
+	lastConfig, err := adaptercfg.FromFile(cmd.AdapterConfigFile)
+	if err != nil {
+		watcher.Close()
+		return fmt.Errorf("unable to read configuration file: %v", err)
+	}
+	watchRuleFiles(watcher, cmd.AdapterConfigFile, lastConfig)
+
+	go func() {
+		defer watcher.Close()
+
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-stopCh:
+				return
+			case err := <-watcher.Errors:
+				klog.Errorf("error watching configuration file: %v", err)
+			case <-watcher.Events:
+				// wait for things to settle down before reloading
+				reload = time.After(configReloadDelay)
+			case <-reload:
+				reload = nil
+
+				newConfig, err := adaptercfg.FromFile(cmd.AdapterConfigFile)
+				if err != nil {
+					klog.Errorf("unable to read configuration file: %v", err)
+					continue
+				}
+				if reflect.DeepEqual(newConfig, lastConfig) {
+					continue
+				}
+				lastConfig = newConfig
+				watchRuleFiles(watcher, cmd.AdapterConfigFile, newConfig)
+
+				klog.Infof("configuration file %s changed, reloading", cmd.AdapterConfigFile)
+				if err := cmd.reloadConfig(); err != nil {
+					klog.Errorf("unable to reload configuration, keeping the previous one: %v", err)
+					continue
+				}
+				klog.Infof("configuration reloaded")
+			}
+		}
+	}()
+
+	return nil
+}
+
+// watchRuleFiles adds the directories of the rule files referenced by the
+// given configuration to the watcher.  Directories which can't be watched
+// (e.g. because they don't exist yet) are logged and skipped.
+func watchRuleFiles(watcher *fsnotify.Watcher, configFile string, cfg *adaptercfg.MetricsDiscoveryConfig) {
+	for _, pattern := range adaptercfg.ResolveRuleFiles(configFile, cfg.RuleFiles) {
+		dir := filepath.Dir(pattern)
+		if err := watcher.Add(dir); err != nil {
+			klog.Warningf("unable to watch rule files directory %s, changes to its rule files won't be reloaded: %v", dir, err)
+		}
+	}
+}
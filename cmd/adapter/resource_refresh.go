@@ -0,0 +1,110 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	adaptercfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+)
+
+// regeneratingMapper is a RESTMapper whose discovery information can be
+// refreshed on demand, such as the one of the custom-metrics-apiserver.
+type regeneratingMapper interface {
+	RegenerateMappings() error
+}
+
+// refreshUnresolvedResources periodically checks whether the resources
+// referenced by the rules in use, which the API server didn't know about
+// when they were compiled, have been installed since, and applies the rules
+// again if so, until the given channel is closed.
+func (cmd *PrometheusAdapter) refreshUnresolvedResources(interval time.Duration, stopCh <-chan struct{}) error {
+	mapper, err := cmd.RESTMapper()
+	if err != nil {
+		return err
+	}
+
+	go wait.Until(func() {
+		cmd.rulesMu.Lock()
+		rules := cmd.allRules()
+		cmd.rulesMu.Unlock()
+
+		resolved, err := refreshMappings(mapper, rules)
+		if err != nil {
+			klog.Errorf("unable to refresh API discovery information: %v", err)
+			return
+		}
+		if len(resolved) == 0 {
+			return
+		}
+
+		klog.Infof("resources %v are now known to the API server, applying the rules again", resolved)
+		cmd.rulesMu.Lock()
+		defer cmd.rulesMu.Unlock()
+		if err := cmd.applyRules(cmd.metricsConfig, cmd.crdRules); err != nil {
+			klog.Errorf("unable to apply rules: %v", err)
+		}
+	}, interval, stopCh)
+
+	return nil
+}
+
+// allRules returns the custom and external rules of the configuration and of
+// PrometheusAdapterRule objects.  It must be called with rulesMu held.
+func (cmd *PrometheusAdapter) allRules() []adaptercfg.DiscoveryRule {
+	var rules []adaptercfg.DiscoveryRule
+	rules = append(rules, cmd.metricsConfig.Rules...)
+	rules = append(rules, cmd.metricsConfig.ExternalRules...)
+	rules = append(rules, cmd.crdRules.Rules...)
+	return append(rules, cmd.crdRules.ExternalRules...)
+}
+
+// refreshMappings refreshes the discovery information of the given mapper if
+// some resources referenced by the given rules are unknown to it, and returns
+// those which are known after the refresh.
+func refreshMappings(mapper apimeta.RESTMapper, rules []adaptercfg.DiscoveryRule) ([]string, error) {
+	unresolved := naming.UnresolvedResources(rules, mapper)
+	if len(unresolved) == 0 {
+		return nil, nil
+	}
+
+	switch m := mapper.(type) {
+	case regeneratingMapper:
+		if err := m.RegenerateMappings(); err != nil {
+			return nil, err
+		}
+	case apimeta.ResettableRESTMapper:
+		m.Reset()
+	}
+
+	stillUnresolved := make(map[string]struct{})
+	for _, gr := range naming.UnresolvedResources(rules, mapper) {
+		stillUnresolved[gr.String()] = struct{}{}
+	}
+	var resolved []string
+	for _, gr := range unresolved {
+		if _, found := stillUnresolved[gr.String()]; !found {
+			resolved = append(resolved, gr.String())
+		}
+	}
+	return resolved, nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	adaptercfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+// installingMapper is a RESTMapper which learns about the queues of volcano
+// when its mappings are regenerated.
+type installingMapper struct {
+	*apimeta.DefaultRESTMapper
+	regenerated int
+}
+
+func (m *installingMapper) RegenerateMappings() error {
+	m.regenerated++
+	m.Add(schema.GroupVersionKind{Group: "scheduling.volcano.sh", Version: "v1beta1", Kind: "Queue"}, apimeta.RESTScopeRoot)
+	return nil
+}
+
+func TestRefreshMappings(t *testing.T) {
+	mapper := &installingMapper{DefaultRESTMapper: apimeta.NewDefaultRESTMapper(nil)}
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+
+	podRules := []adaptercfg.DiscoveryRule{{
+		SeriesQuery: `{pod!=""}`,
+		Resources:   adaptercfg.ResourceMapping{Overrides: map[string]adaptercfg.GroupResource{"pod": {Resource: "pod"}}},
+	}}
+	resolved, err := refreshMappings(mapper, podRules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resolved) != 0 || mapper.regenerated != 0 {
+		t.Errorf("expected the mappings to be left alone when all resources are known, got %v resolved after %d regenerations", resolved, mapper.regenerated)
+	}
+
+	queueRules := append(podRules, adaptercfg.DiscoveryRule{
+		SeriesQuery: `{queue_name!=""}`,
+		Resources: adaptercfg.ResourceMapping{Overrides: map[string]adaptercfg.GroupResource{
+			"queue_name": {Group: "scheduling.volcano.sh", Resource: "queues"},
+		}},
+	})
+	resolved, err = refreshMappings(mapper, queueRules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resolved) != 1 || resolved[0] != "queues.scheduling.volcano.sh" {
+		t.Errorf("expected queues.scheduling.volcano.sh to be resolved, got %v", resolved)
+	}
+
+	resolved, err = refreshMappings(mapper, queueRules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resolved) != 0 || mapper.regenerated != 1 {
+		t.Errorf("expected nothing to be resolved again, got %v resolved after %d regenerations", resolved, mapper.regenerated)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	adaptercfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+)
+
+var ruleGVR = schema.GroupVersionResource{
+	Group:    adaptercfg.RuleGroup,
+	Version:  adaptercfg.RuleVersion,
+	Resource: adaptercfg.RuleResource,
+}
+
+// watchRuleCRDs watches PrometheusAdapterRule objects in all namespaces, and
+// applies their rules, on top of the ones from the configuration file, to the
+// running providers whenever they change.
+func (cmd *PrometheusAdapter) watchRuleCRDs(stopCh <-chan struct{}) error {
+	client, err := cmd.DynamicClient()
+	if err != nil {
+		return fmt.Errorf("unable to construct Kubernetes client: %v", err)
+	}
+	mapper, err := cmd.RESTMapper()
+	if err != nil {
+		return fmt.Errorf("unable to construct RESTMapper: %v", err)
+	}
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	informer := factory.ForResource(ruleGVR).Informer()
+
+	// coalesce bursts of changes into a single update
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	_, err = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { notify() },
+		UpdateFunc: func(interface{}, interface{}) { notify() },
+		DeleteFunc: func(interface{}) { notify() },
+	})
+	if err != nil {
+		return fmt.Errorf("unable to watch %s objects: %v", adaptercfg.RuleKind, err)
+	}
+
+	factory.Start(stopCh)
+	go func() {
+		if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+			return
+		}
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-changed:
+				crdRules := rulesFromObjects(informer.GetStore().List(), mapper)
+				cmd.rulesMu.Lock()
+				if err := cmd.applyRules(cmd.metricsConfig, crdRules); err != nil {
+					klog.Errorf("unable to apply rules from %s objects: %v", adaptercfg.RuleKind, err)
+				} else {
+					cmd.crdRules = crdRules
+				}
+				cmd.rulesMu.Unlock()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// rulesFromObjects collects the rules from the given PrometheusAdapterRule
+// objects, ordered by namespace and name.  Objects with invalid rules are
+// logged and skipped, so that they don't prevent others from being applied.
+func rulesFromObjects(objs []interface{}, mapper apimeta.RESTMapper) adaptercfg.RuleSpec {
+	rules := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		if rule, ok := obj.(*unstructured.Unstructured); ok {
+			rules = append(rules, rule)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].GetNamespace() != rules[j].GetNamespace() {
+			return rules[i].GetNamespace() < rules[j].GetNamespace()
+		}
+		return rules[i].GetName() < rules[j].GetName()
+	})
+
+	var res adaptercfg.RuleSpec
+	for _, rule := range rules {
+		spec, err := ruleSpecFromObject(rule, mapper)
+		if err != nil {
+			klog.Errorf("ignoring %s %s/%s: %v", adaptercfg.RuleKind, rule.GetNamespace(), rule.GetName(), err)
+			continue
+		}
+		res.Rules = append(res.Rules, spec.Rules...)
+		res.ExternalRules = append(res.ExternalRules, spec.ExternalRules...)
+	}
+	return res
+}
+
+// ruleSpecFromObject extracts and validates the spec of a PrometheusAdapterRule
+// object, whose rules are restricted to its namespace (see restrictObjectRules).
+func ruleSpecFromObject(rule *unstructured.Unstructured, mapper apimeta.RESTMapper) (*adaptercfg.RuleSpec, error) {
+	rawSpec, _, err := unstructured.NestedMap(rule.Object, "spec")
+	if err != nil {
+		return nil, err
+	}
+	spec, err := adaptercfg.RuleSpecFromUnstructured(rawSpec)
+	if err != nil {
+		return nil, err
+	}
+	if err := restrictObjectRules(spec.Rules, rule.GetNamespace()); err != nil {
+		return nil, err
+	}
+	if err := restrictObjectRules(spec.ExternalRules, rule.GetNamespace()); err != nil {
+		return nil, err
+	}
+	if _, err := naming.NamersFromConfig(spec.Rules, mapper, naming.ForCustomMetrics()); err != nil {
+		return nil, fmt.Errorf("invalid rules: %v", err)
+	}
+	if _, err := naming.NamersFromConfig(spec.ExternalRules, mapper); err != nil {
+		return nil, fmt.Errorf("invalid external rules: %v", err)
+	}
+	return spec, nil
+}
+
+// restrictObjectRules restricts the given rules of a PrometheusAdapterRule
+// object, which anyone allowed to create the object in its namespace controls,
+// to the metrics of that namespace: their namespaces are forced to it, and
+// they can't set the fields reserved to the configuration file, which select
+// the Prometheus backend and tenant, or restrict access and limits.
+func restrictObjectRules(rules []adaptercfg.DiscoveryRule, namespace string) error {
+	for i := range rules {
+		rule := &rules[i]
+		switch {
+		case rule.PrometheusRef != "":
+			return fmt.Errorf("rules from %s objects can't set prometheusRef", adaptercfg.RuleKind)
+		case len(rule.PrometheusHeaders) > 0:
+			return fmt.Errorf("rules from %s objects can't set prometheusHeaders", adaptercfg.RuleKind)
+		case rule.Access != nil:
+			return fmt.Errorf("rules from %s objects can't set access", adaptercfg.RuleKind)
+		case rule.Limits != nil:
+			return fmt.Errorf("rules from %s objects can't set limits", adaptercfg.RuleKind)
+		}
+		for _, ns := range rule.Namespaces {
+			if ns != namespace {
+				return fmt.Errorf("rules from %s objects can only serve metrics in the namespace of the object, not %q", adaptercfg.RuleKind, ns)
+			}
+		}
+		rule.Namespaces = []string{namespace}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// namespaceMapper returns a RESTMapper knowing namespaces, to which the rules
+// of PrometheusAdapterRule objects are restricted.
+func namespaceMapper() apimeta.RESTMapper {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+	return mapper
+}
+
+func makeRuleObject(namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "metrics.sigs.k8s.io/v1alpha1",
+		"kind":       "PrometheusAdapterRule",
+		"metadata": map[string]interface{}{
+			"namespace": namespace,
+			"name":      name,
+		},
+		"spec": spec,
+	}}
+}
+
+func makeRule(seriesQuery, matches string) map[string]interface{} {
+	return map[string]interface{}{
+		"seriesQuery": seriesQuery,
+		"resources":   map[string]interface{}{"template": "<<.Resource>>"},
+		"name":        map[string]interface{}{"matches": matches},
+	}
+}
+
+func TestRulesFromObjects(t *testing.T) {
+	objs := []interface{}{
+		makeRuleObject("team-b", "queue", map[string]interface{}{
+			"externalRules": []interface{}{makeRule(`{queue!=""}`, "^queue_(.*)$")},
+		}),
+		makeRuleObject("team-a", "http", map[string]interface{}{
+			"rules": []interface{}{makeRule(`{__name__=~"^http_.*"}`, "^http_(.*)$")},
+		}),
+		makeRuleObject("team-a", "invalid", map[string]interface{}{
+			"rules": []interface{}{makeRule(`{__name__=~"^broken_.*"}`, "^broken_(.*$")},
+		}),
+		makeRuleObject("team-a", "unknown-field", map[string]interface{}{
+			"rules":   []interface{}{makeRule(`{__name__=~"^other_.*"}`, "^other_(.*)$")},
+			"unknown": true,
+		}),
+		makeRuleObject("team-a", "grpc", map[string]interface{}{
+			"rules": []interface{}{makeRule(`{__name__=~"^grpc_.*"}`, "^grpc_(.*)$")},
+		}),
+	}
+
+	spec := rulesFromObjects(objs, namespaceMapper())
+
+	var seriesQueries []string
+	for _, rule := range spec.Rules {
+		seriesQueries = append(seriesQueries, rule.SeriesQuery)
+	}
+	expected := []string{`{__name__=~"^grpc_.*"}`, `{__name__=~"^http_.*"}`}
+	if len(seriesQueries) != len(expected) {
+		t.Fatalf("expected rules %v, got %v", expected, seriesQueries)
+	}
+	for i := range expected {
+		if seriesQueries[i] != expected[i] {
+			t.Errorf("expected rules %v, got %v", expected, seriesQueries)
+			break
+		}
+	}
+
+	if len(spec.ExternalRules) != 1 || spec.ExternalRules[0].SeriesQuery != `{queue!=""}` {
+		t.Errorf("expected a single external rule for queues, got %v", spec.ExternalRules)
+	}
+	for _, rule := range append(spec.Rules, spec.ExternalRules...) {
+		if len(rule.Namespaces) != 1 {
+			t.Errorf("expected rule %q to be restricted to the namespace of its object, got %v", rule.SeriesQuery, rule.Namespaces)
+		}
+	}
+	if ns := spec.ExternalRules[0].Namespaces; len(ns) != 1 || ns[0] != "team-b" {
+		t.Errorf("expected the external rule to be restricted to team-b, got %v", ns)
+	}
+}
+
+func TestRulesFromObjectsCantEscapeTheirNamespace(t *testing.T) {
+	for field, value := range map[string]interface{}{
+		"prometheusRef":     "other",
+		"prometheusHeaders": map[string]interface{}{"X-Scope-OrgID": "team-b"},
+		"access":            map[string]interface{}{"users": []interface{}{"alice"}},
+		"limits":            map[string]interface{}{"maxSeries": int64(-1)},
+		"namespaces":        []interface{}{"team-b"},
+	} {
+		rule := makeRule(`{__name__=~"^http_.*"}`, "^http_(.*)$")
+		rule[field] = value
+		objs := []interface{}{makeRuleObject("team-a", "http", map[string]interface{}{
+			"rules": []interface{}{rule},
+		})}
+		if spec := rulesFromObjects(objs, namespaceMapper()); len(spec.Rules) != 0 {
+			t.Errorf("expected a rule setting %s to be ignored, got %v", field, spec.Rules)
+		}
+	}
+}
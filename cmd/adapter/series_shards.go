@@ -0,0 +1,223 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	cmprov "sigs.k8s.io/prometheus-adapter/pkg/custom-provider"
+)
+
+const (
+	// seriesShardConfigMapPrefix prefixes the names of the ConfigMaps holding
+	// the series discovered by each shard, which are suffixed with its index.
+	seriesShardConfigMapPrefix = "prometheus-adapter-series-"
+	// seriesShardKey is the ConfigMap key holding the gzipped series.
+	seriesShardKey = "series.json.gz"
+	// seriesShardPublishedAnnotation holds when the series of a shard were
+	// last published, in RFC 3339 format.
+	seriesShardPublishedAnnotation = "prometheus-adapter.sigs.k8s.io/published"
+	// seriesShardTooLargeAnnotation is set instead of the series of a shard
+	// when they're too large to fit in its ConfigMap.
+	seriesShardTooLargeAnnotation = "prometheus-adapter.sigs.k8s.io/too-large"
+	// maxSeriesShardSize is the maximum size of the gzipped series of a shard:
+	// ConfigMaps are limited to 1 MiB, which leaves room for their metadata.
+	maxSeriesShardSize = 1000 * 1024
+
+	// seriesShardStaleRelists is the number of relist intervals after which
+	// the series published by a shard are stale, and listed by each replica.
+	seriesShardStaleRelists = 3
+
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// configMapSeriesStore is a SeriesStore keeping the series discovered by each
+// shard in a ConfigMap, as gzipped JSON.
+type configMapSeriesStore struct {
+	client    corev1client.ConfigMapsGetter
+	namespace string
+	total     int
+}
+
+func (s *configMapSeriesStore) configMapName(shard int) string {
+	return fmt.Sprintf("%s%d", seriesShardConfigMapPrefix, shard)
+}
+
+func (s *configMapSeriesStore) Publish(ctx context.Context, shard int, series []cmprov.SharedSeries) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(series); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	annotations := map[string]string{seriesShardPublishedAnnotation: time.Now().UTC().Format(time.RFC3339)}
+	data := map[string][]byte{seriesShardKey: buf.Bytes()}
+	tooLarge := buf.Len() > maxSeriesShardSize
+	if tooLarge {
+		annotations[seriesShardTooLargeAnnotation] = "true"
+		data = nil
+	}
+
+	configMaps := s.client.ConfigMaps(s.namespace)
+	name := s.configMapName(shard)
+	existing, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+	if apierr.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: s.namespace, Annotations: annotations},
+			BinaryData: data,
+		}, metav1.CreateOptions{})
+	} else if err == nil {
+		existing.Annotations = annotations
+		existing.BinaryData = data
+		_, err = configMaps.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	if tooLarge {
+		return fmt.Errorf("%w: %d bytes once compressed, more than the %d a ConfigMap can hold", cmprov.ErrSeriesTooLarge, buf.Len(), maxSeriesShardSize)
+	}
+	return nil
+}
+
+func (s *configMapSeriesStore) Load(ctx context.Context) (map[int]cmprov.PublishedSeries, error) {
+	res := make(map[int]cmprov.PublishedSeries, s.total)
+	for shard := 0; shard < s.total; shard++ {
+		configMap, err := s.client.ConfigMaps(s.namespace).Get(ctx, s.configMapName(shard), metav1.GetOptions{})
+		if apierr.IsNotFound(err) {
+			// the shard hasn't published anything yet
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// series published without a timestamp, by older versions, are stale
+		published, _ := time.Parse(time.RFC3339, configMap.Annotations[seriesShardPublishedAnnotation])
+		if configMap.Annotations[seriesShardTooLargeAnnotation] == "true" {
+			res[shard] = cmprov.PublishedSeries{Published: published, TooLarge: true}
+			continue
+		}
+		series, err := decodeSharedSeries(configMap.BinaryData[seriesShardKey])
+		if err != nil {
+			return nil, fmt.Errorf("invalid series in ConfigMap %s/%s: %v", s.namespace, configMap.Name, err)
+		}
+		res[shard] = cmprov.PublishedSeries{Published: published, Series: series}
+	}
+	return res, nil
+}
+
+func decodeSharedSeries(data []byte) ([]cmprov.SharedSeries, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	var series []cmprov.SharedSeries
+	if err := json.Unmarshal(raw, &series); err != nil {
+		return nil, err
+	}
+	return series, nil
+}
+
+// makeRelistShard returns the shard of series discovery this replica is
+// responsible for, or nil if discovery isn't sharded.
+func (cmd *PrometheusAdapter) makeRelistShard() (*cmprov.RelistShard, error) {
+	if cmd.ShardTotal <= 1 {
+		return nil, nil
+	}
+
+	namespace := cmd.ShardNamespace
+	if namespace == "" {
+		data, err := os.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine the namespace of the shard ConfigMaps, set --shard-namespace: %v", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	clientConfig, err := cmd.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct Kubernetes client config: %v", err)
+	}
+	client, err := corev1client.NewForConfig(clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct Kubernetes client: %v", err)
+	}
+
+	index := cmd.ShardIndex
+	if index < 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine the shard index from the hostname: %v", err)
+		}
+		index, err = ordinalFromHostname(hostname)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	shard := &cmprov.RelistShard{
+		Index: index,
+		Total: cmd.ShardTotal,
+		// shards publish their series after each relist
+		StaleAfter: seriesShardStaleRelists * cmd.MetricsRelistInterval,
+		Store: &configMapSeriesStore{
+			client:    client,
+			namespace: namespace,
+			total:     cmd.ShardTotal,
+		},
+	}
+	if err := shard.Validate(); err != nil {
+		return nil, err
+	}
+	return shard, nil
+}
+
+// ordinalFromHostname returns the ordinal of a StatefulSet pod from its
+// hostname, e.g. 2 for prometheus-adapter-2.
+func ordinalFromHostname(hostname string) (int, error) {
+	idx := strings.LastIndex(hostname, "-")
+	ordinal, err := strconv.Atoi(hostname[idx+1:])
+	if idx < 0 || err != nil || ordinal < 0 {
+		return 0, fmt.Errorf("unable to determine the shard index from hostname %q, which doesn't end with a StatefulSet ordinal", hostname)
+	}
+	return ordinal, nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/kubernetes/fake"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	cmprov "sigs.k8s.io/prometheus-adapter/pkg/custom-provider"
+)
+
+func TestConfigMapSeriesStore(t *testing.T) {
+	store := &configMapSeriesStore{
+		client:    fake.NewSimpleClientset().CoreV1(),
+		namespace: "monitoring",
+		total:     3,
+	}
+	ctx := context.Background()
+
+	shard0 := []cmprov.SharedSeries{{
+		Selector: `{namespace!=""}`,
+		Series:   []prom.Series{{Name: "http_requests_total", Labels: pmodel.LabelSet{"namespace": "default", "pod": "web-0"}}},
+	}}
+	shard2 := []cmprov.SharedSeries{{
+		Backend:  "thanos",
+		Selector: `{queue!=""}`,
+		Series:   []prom.Series{{Name: "queue_depth", Labels: pmodel.LabelSet{"queue": "orders"}}},
+	}}
+
+	if err := store.Publish(ctx, 0, []cmprov.SharedSeries{{Selector: `{job!=""}`}}); err != nil {
+		t.Fatalf("unable to publish: %v", err)
+	}
+	// publishing again replaces the previous series
+	if err := store.Publish(ctx, 0, shard0); err != nil {
+		t.Fatalf("unable to publish: %v", err)
+	}
+	if err := store.Publish(ctx, 2, shard2); err != nil {
+		t.Fatalf("unable to publish: %v", err)
+	}
+
+	loaded, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+	if len(loaded) != 2 || !reflect.DeepEqual(loaded[0].Series, shard0) || !reflect.DeepEqual(loaded[2].Series, shard2) {
+		t.Errorf("expected to load %v for shard 0 and %v for shard 2, got %v", shard0, shard2, loaded)
+	}
+	if published := loaded[0].Published; time.Since(published) > time.Minute {
+		t.Errorf("expected the series to have just been published, got %v", published)
+	}
+
+	// series too large for a ConfigMap aren't published
+	var tooLarge []cmprov.SharedSeries
+	for i := 0; i < 60000; i++ {
+		tooLarge = append(tooLarge, cmprov.SharedSeries{Selector: prom.Selector(fmt.Sprintf(`{job=%q}`, rand.String(32)))})
+	}
+	if err := store.Publish(ctx, 2, tooLarge); !errors.Is(err, cmprov.ErrSeriesTooLarge) {
+		t.Fatalf("expected the series to be too large, got %v", err)
+	}
+	loaded, err = store.Load(ctx)
+	if err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+	if !loaded[2].TooLarge || loaded[2].Series != nil {
+		t.Errorf("expected the series of shard 2 to be flagged as too large, got %v", loaded[2])
+	}
+}
+
+func TestOrdinalFromHostname(t *testing.T) {
+	ordinal, err := ordinalFromHostname("prometheus-adapter-2")
+	if err != nil || ordinal != 2 {
+		t.Errorf("expected ordinal 2, got %d (error: %v)", ordinal, err)
+	}
+
+	for _, hostname := range []string{"prometheus-adapter-7d9f8b6c5-x2x4z", "adapter"} {
+		if _, err := ordinalFromHostname(hostname); err == nil {
+			t.Errorf("expected an error for hostname %q", hostname)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/klog/v2"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// configureShutdown applies the graceful shutdown settings to the given
+// server.  On SIGTERM, its readiness check fails right away, it keeps serving
+// requests for the shutdown delay, so that clients such as the HPA controller
+// stop sending it requests before it stops listening, and in-flight requests,
+// and thus the Prometheus queries they run, are then given the grace period to
+// complete, after which they're cancelled.
+func (cmd *PrometheusAdapter) configureShutdown(server *genericapiserver.GenericAPIServer) {
+	server.ShutdownDelayDuration = cmd.ShutdownDelayDuration
+	if cmd.ShutdownGracePeriod > 0 {
+		server.ShutdownTimeout = cmd.ShutdownGracePeriod
+	}
+}
+
+// addShutdownHooks stops the relists of the providers, by closing the given
+// channel, as soon as the server starts shutting down, so that no new series
+// queries are sent to Prometheus while requests are drained.
+func addShutdownHooks(server *genericapiserver.GenericAPIServer, relistStopCh chan<- struct{}) error {
+	return server.AddPreShutdownHook("stop-metrics-relists", func() error {
+		close(relistStopCh)
+		return nil
+	})
+}
+
+// drainQueries waits, for at most the given grace period, for the Prometheus
+// queries still in flight once the server stopped, such as those of relists
+// which were running when shutdown started.
+func drainQueries(queries *inFlightQueries, gracePeriod time.Duration) {
+	if !queries.wait(gracePeriod) {
+		klog.Warningf("%d Prometheus queries still in flight after the shutdown grace period of %v, cancelling them", queries.count(), gracePeriod)
+	}
+}
+
+// inFlightQueries tracks the Prometheus queries in flight, so that they can
+// be drained on shutdown.
+type inFlightQueries struct {
+	mu       sync.Mutex
+	inFlight int
+	// drained is closed once no queries are in flight anymore
+	drained chan struct{}
+}
+
+// client returns a client tracking the queries made through the given one.
+func (q *inFlightQueries) client(client prom.Client) prom.Client {
+	return &trackingClient{client: client, queries: q}
+}
+
+func (q *inFlightQueries) start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.inFlight == 0 {
+		q.drained = make(chan struct{})
+	}
+	q.inFlight++
+}
+
+func (q *inFlightQueries) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inFlight--
+	if q.inFlight == 0 {
+		close(q.drained)
+	}
+}
+
+func (q *inFlightQueries) count() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.inFlight
+}
+
+// wait waits for the queries in flight to complete, for at most the given
+// duration, and returns whether they did.
+func (q *inFlightQueries) wait(timeout time.Duration) bool {
+	q.mu.Lock()
+	if q.inFlight == 0 {
+		q.mu.Unlock()
+		return true
+	}
+	drained := q.drained
+	q.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// trackingClient is a prom.Client registering its queries as in flight.
+type trackingClient struct {
+	client  prom.Client
+	queries *inFlightQueries
+}
+
+func (c *trackingClient) Series(ctx context.Context, interval pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	c.queries.start()
+	defer c.queries.done()
+	return c.client.Series(ctx, interval, selectors...)
+}
+
+func (c *trackingClient) Query(ctx context.Context, t pmodel.Time, query prom.Selector) (prom.QueryResult, error) {
+	c.queries.start()
+	defer c.queries.done()
+	return c.client.Query(ctx, t, query)
+}
+
+func (c *trackingClient) QueryRange(ctx context.Context, r prom.Range, query prom.Selector) (prom.QueryResult, error) {
+	c.queries.start()
+	defer c.queries.done()
+	return c.client.QueryRange(ctx, r, query)
+}
+
+func (c *trackingClient) LabelValues(ctx context.Context, label string, interval pmodel.Interval, selectors ...prom.Selector) ([]string, error) {
+	c.queries.start()
+	defer c.queries.done()
+	return c.client.LabelValues(ctx, label, interval, selectors...)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+
+	genericapiserver "k8s.io/apiserver/pkg/server"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+func TestConfigureShutdown(t *testing.T) {
+	server := &genericapiserver.GenericAPIServer{ShutdownTimeout: time.Minute}
+	cmd := &PrometheusAdapter{}
+	cmd.configureShutdown(server)
+	if server.ShutdownDelayDuration != 0 || server.ShutdownTimeout != time.Minute {
+		t.Errorf("expected the server defaults to be kept, got a delay of %v and a grace period of %v", server.ShutdownDelayDuration, server.ShutdownTimeout)
+	}
+
+	cmd = &PrometheusAdapter{ShutdownDelayDuration: 15 * time.Second, ShutdownGracePeriod: 30 * time.Second}
+	cmd.configureShutdown(server)
+	if server.ShutdownDelayDuration != 15*time.Second {
+		t.Errorf("expected a shutdown delay of 15s, got %v", server.ShutdownDelayDuration)
+	}
+	if server.ShutdownTimeout != 30*time.Second {
+		t.Errorf("expected a grace period of 30s, got %v", server.ShutdownTimeout)
+	}
+}
+
+// blockingClient is a prom.Client whose queries block until released.
+type blockingClient struct {
+	prom.Client
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingClient) Query(context.Context, pmodel.Time, prom.Selector) (prom.QueryResult, error) {
+	c.started <- struct{}{}
+	<-c.release
+	return prom.QueryResult{}, nil
+}
+
+func TestInFlightQueriesAreDrained(t *testing.T) {
+	queries := &inFlightQueries{}
+	if !queries.wait(time.Millisecond) {
+		t.Errorf("expected no queries to be waited for while none are in flight")
+	}
+
+	backend := &blockingClient{started: make(chan struct{}), release: make(chan struct{})}
+	client := queries.client(backend)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = client.Query(context.Background(), 0, "up")
+	}()
+	<-backend.started
+
+	if queries.wait(10 * time.Millisecond) {
+		t.Errorf("expected the in-flight query not to be drained before it completed")
+	}
+	if count := queries.count(); count != 1 {
+		t.Errorf("expected 1 query in flight, got %d", count)
+	}
+
+	close(backend.release)
+	if !queries.wait(time.Minute) {
+		t.Errorf("expected the in-flight query to be drained once it completed")
+	}
+	<-done
+}
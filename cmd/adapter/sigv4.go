@@ -0,0 +1,105 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// sigV4Service is the service name requests to Amazon Managed Service for
+// Prometheus are signed for.
+const sigV4Service = "aps"
+
+// sigV4RoundTripper signs requests with AWS Signature Version 4 before
+// passing them on to the next round tripper.
+type sigV4RoundTripper struct {
+	next        http.RoundTripper
+	signer      *v4.Signer
+	credentials aws.CredentialsProvider
+	region      string
+	now         func() time.Time
+}
+
+// makeSigV4Transport returns a transport signing requests for Amazon Managed
+// Service for Prometheus in the given region, using the default AWS
+// credentials chain (environment, shared configuration, IRSA or instance
+// role).  If a role ARN is given, that role is assumed using those credentials.
+func makeSigV4Transport(region, roleARN string, next http.RoundTripper) (http.RoundTripper, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS configuration for signing Prometheus requests: %v", err)
+	}
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("the AWS region must be set with prometheus-sigv4-region or AWS_REGION when using prometheus-auth-sigv4")
+	}
+	credentials := cfg.Credentials
+	if roleARN != "" {
+		credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleARN))
+	}
+	return newSigV4RoundTripper(cfg.Region, credentials, next), nil
+}
+
+func newSigV4RoundTripper(region string, credentials aws.CredentialsProvider, next http.RoundTripper) *sigV4RoundTripper {
+	return &sigV4RoundTripper{
+		next:        next,
+		signer:      v4.NewSigner(),
+		credentials: credentials,
+		region:      region,
+		now:         time.Now,
+	}
+}
+
+func (rt *sigV4RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the payload is part of the signature, so it needs to be read up front
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the body of the request to sign: %v", err)
+		}
+	}
+	payloadHash := sha256.Sum256(body)
+
+	signed := req.Clone(req.Context())
+	if req.Body != nil {
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	creds, err := rt.credentials.Retrieve(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve AWS credentials for signing Prometheus requests: %v", err)
+	}
+	if err := rt.signer.SignHTTP(req.Context(), creds, signed, hex.EncodeToString(payloadHash[:]), sigV4Service, rt.region, rt.now()); err != nil {
+		return nil, fmt.Errorf("unable to sign Prometheus request: %v", err)
+	}
+	return rt.next.RoundTrip(signed)
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestSigV4RoundTripper(t *testing.T) {
+	var received *http.Request
+	var receivedBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = req
+		body, _ := io.ReadAll(req.Body)
+		receivedBody = string(body)
+	}))
+	defer server.Close()
+
+	rt := newSigV4RoundTripper("eu-west-1", credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", ""), http.DefaultTransport)
+	rt.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+
+	form := url.Values{"query": []string{"up"}}.Encode()
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/api/v1/query", strings.NewReader(form))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		t.Fatalf("Error is %v, expected nil", err)
+	}
+	res.Body.Close()
+
+	authorization := received.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240501/eu-west-1/aps/aws4_request") {
+		t.Errorf("Unexpected Authorization header %q", authorization)
+	}
+	if received.Header.Get("X-Amz-Date") != "20240501T120000Z" {
+		t.Errorf("Unexpected X-Amz-Date header %q", received.Header.Get("X-Amz-Date"))
+	}
+	if receivedBody != form {
+		t.Errorf("Expected the body %q to be passed on, got %q", form, receivedBody)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Error("The original request should be left untouched")
+	}
+}
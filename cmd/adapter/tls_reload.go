@@ -0,0 +1,90 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// keyPairReloader serves a client TLS certificate loaded from files, and
+// reloads it whenever the files are modified, so that rotated certificates
+// (e.g. by cert-manager) are used without restarting the adapter.
+type keyPairReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// newKeyPairReloader loads the given certificate and key, failing if they
+// can't be loaded.
+func newKeyPairReloader(certFile, keyFile string) (*keyPairReloader, error) {
+	r := &keyPairReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.maybeReload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// maybeReload loads the certificate and key again if either file was
+// modified since they were last loaded.  It must be called with mu held,
+// or before the reloader is shared.
+func (r *keyPairReloader) maybeReload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS key pair: %v", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS key pair: %v", err)
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS key pair: %v", err)
+	}
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.  If the
+// files were modified but can't be loaded (e.g. while they're being
+// rewritten), the previous certificate keeps being used.
+func (r *keyPairReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.maybeReload(); err != nil {
+		klog.Errorf("unable to reload the Prometheus client TLS certificate, using the previous one: %v", err)
+	} else {
+		klog.V(4).Infof("using Prometheus client TLS certificate from %s", r.certFile)
+	}
+	return r.cert, nil
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyPairReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	copyFile := func(src, dst string, mod time.Time) {
+		data, err := os.ReadFile(filepath.Join(certsDir, src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dst, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	copyFile("tlscert.crt", certFile, start)
+	copyFile("tlskey.key", keyFile, start)
+
+	reloader, err := newKeyPairReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Error is %v, expected nil", err)
+	}
+	first, err := reloader.GetClientCertificate(nil)
+	if err != nil || first == nil {
+		t.Fatalf("Expected a certificate, got %v (error %v)", first, err)
+	}
+	if again, _ := reloader.GetClientCertificate(nil); again != first {
+		t.Error("Expected the certificate not to be reloaded when the files are unchanged")
+	}
+
+	// a certificate being rewritten keeps the previous one in use
+	copyFile("tlscert-error.crt", certFile, start.Add(time.Minute))
+	if cert, err := reloader.GetClientCertificate(nil); err != nil || cert != first {
+		t.Errorf("Expected the previous certificate to be kept, got %v (error %v)", cert, err)
+	}
+
+	copyFile("tlscert.crt", certFile, start.Add(2*time.Minute))
+	if cert, err := reloader.GetClientCertificate(nil); err != nil || cert == first || cert == nil {
+		t.Errorf("Expected the certificate to be reloaded, got %v (error %v)", cert, err)
+	}
+
+	if _, err := newKeyPairReloader(filepath.Join(certsDir, "tlscert-error.crt"), keyFile); err == nil {
+		t.Error("Expected an error for an invalid certificate")
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"k8s.io/component-base/tracing"
+	tracingapi "k8s.io/component-base/tracing/api/v1"
+	"k8s.io/klog/v2"
+)
+
+// tracingServiceName is the name under which the adapter reports its spans.
+const tracingServiceName = "prometheus-adapter"
+
+// setupTracing makes the global tracer provider export the spans of sampled
+// requests to the configured OTLP endpoint, until the given channel is
+// closed.  It returns nil if tracing is disabled.
+func (cmd *PrometheusAdapter) setupTracing(stopCh <-chan struct{}) (oteltrace.TracerProvider, error) {
+	if cmd.TracingEndpoint == "" {
+		return nil, nil
+	}
+	if cmd.TracingSamplingRatePerMillion < 0 || cmd.TracingSamplingRatePerMillion > 1000000 {
+		return nil, fmt.Errorf("the tracing sampling rate must be between 0 and 1000000 per million, got %d", cmd.TracingSamplingRatePerMillion)
+	}
+
+	ctx := context.Background()
+	tp, err := tracing.NewProvider(ctx, &tracingapi.TracingConfiguration{
+		Endpoint:               &cmd.TracingEndpoint,
+		SamplingRatePerMillion: &cmd.TracingSamplingRatePerMillion,
+	}, nil, []resource.Option{
+		resource.WithAttributes(semconv.ServiceName(tracingServiceName)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct tracer provider: %v", err)
+	}
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(tracing.Propagators())
+
+	go func() {
+		<-stopCh
+		// flush the pending spans
+		if err := tp.Shutdown(ctx); err != nil {
+			klog.Errorf("unable to shut down tracer provider: %v", err)
+		}
+	}()
+	return tp, nil
+}
+
+// withTracing traces the requests made by the given client using the given
+// tracer provider, propagating their trace context to the server.  It
+// returns a copy of the client, leaving the original one alone.
+func withTracing(client *http.Client, tp oteltrace.TracerProvider) *http.Client {
+	rt := http.DefaultTransport
+	if client.Transport != nil {
+		rt = client.Transport
+	}
+	traced := *client
+	traced.Transport = tracing.WrapperFor(tp)(rt)
+	return &traced
+}
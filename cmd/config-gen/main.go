@@ -9,11 +9,15 @@ import (
 	yaml "gopkg.in/yaml.v2"
 
 	"sigs.k8s.io/prometheus-adapter/cmd/config-gen/utils"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/keda"
 )
 
 func main() {
 	var labelPrefix string
 	var rateInterval time.Duration
+	var namespaceRateSeries []string
+	var kedaScaledObjects string
 
 	cmd := &cobra.Command{
 		Short: "Generate a config matching the legacy discovery rules",
@@ -23,6 +27,16 @@ resources according to the Kubernetes instrumention conventions and the cAdvisor
 conventions, and auto-converting cumulative metrics into rate metrics.`,
 		RunE: func(c *cobra.Command, args []string) error {
 			cfg := utils.DefaultConfig(rateInterval, labelPrefix)
+			for _, series := range namespaceRateSeries {
+				cfg.Rules = append(cfg.Rules, utils.NamespaceRateRule(series, rateInterval, labelPrefix))
+			}
+			if kedaScaledObjects != "" {
+				rules, err := kedaExternalRules(kedaScaledObjects)
+				if err != nil {
+					return err
+				}
+				cfg.ExternalRules = append(cfg.ExternalRules, rules...)
+			}
 			enc := yaml.NewEncoder(os.Stdout)
 			if err := enc.Encode(cfg); err != nil {
 				return err
@@ -36,9 +50,30 @@ conventions, and auto-converting cumulative metrics into rate metrics.`,
 			"'kube_', any series with the 'kube_pod' label would be considered a pod metric")
 	cmd.Flags().DurationVar(&rateInterval, "rate-interval", 5*time.Minute,
 		"Period of time used to calculate rate metrics from cumulative metrics")
+	cmd.Flags().StringSliceVar(&namespaceRateSeries, "namespace-rate-series", nil,
+		"Name of a counter series whose rate, summed over each namespace, is exposed as a metric of namespaces "+
+			"named <series>_per_second (without any _total suffix). May be repeated")
+	cmd.Flags().StringVar(&kedaScaledObjects, "keda-scaled-objects", "",
+		"YAML file holding KEDA ScaledObjects, e.g. the output of 'kubectl get scaledobjects -A -o yaml', whose "+
+			"Prometheus triggers are served by generated external rules")
 
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to generate config: %v\n", err)
 		os.Exit(1)
 	}
 }
+
+// kedaExternalRules returns the external rules serving the metrics of the
+// ScaledObjects in the given file.
+func kedaExternalRules(path string) ([]config.DiscoveryRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	objects, err := keda.ParseScaledObjects(file)
+	if err != nil {
+		return nil, err
+	}
+	return keda.ExternalRules(objects)
+}
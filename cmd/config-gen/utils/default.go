@@ -2,6 +2,8 @@ package utils
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	pmodel "github.com/prometheus/common/model"
@@ -20,6 +22,7 @@ func DefaultConfig(rateInterval time.Duration, labelPrefix string) *config.Metri
 		Rules: []config.DiscoveryRule{
 			// container seconds rate metrics
 			{
+				ID:          "container-seconds-rate",
 				SeriesQuery: string(prom.MatchSeries("", prom.NameMatches("^container_.*"), prom.LabelNeq("container", "POD"), prom.LabelNeq("namespace", ""), prom.LabelNeq("pod", ""))),
 				Resources: config.ResourceMapping{
 					Overrides: map[string]config.GroupResource{
@@ -33,6 +36,7 @@ func DefaultConfig(rateInterval time.Duration, labelPrefix string) *config.Metri
 
 			// container rate metrics
 			{
+				ID:            "container-rate",
 				SeriesQuery:   string(prom.MatchSeries("", prom.NameMatches("^container_.*"), prom.LabelNeq("container", "POD"), prom.LabelNeq("namespace", ""), prom.LabelNeq("pod", ""))),
 				SeriesFilters: []config.RegexFilter{{IsNot: "^container_.*_seconds_total$"}},
 				Resources: config.ResourceMapping{
@@ -47,6 +51,7 @@ func DefaultConfig(rateInterval time.Duration, labelPrefix string) *config.Metri
 
 			// container non-cumulative metrics
 			{
+				ID:            "container-gauge",
 				SeriesQuery:   string(prom.MatchSeries("", prom.NameMatches("^container_.*"), prom.LabelNeq("container", "POD"), prom.LabelNeq("namespace", ""), prom.LabelNeq("pod", ""))),
 				SeriesFilters: []config.RegexFilter{{IsNot: "^container_.*_total$"}},
 				Resources: config.ResourceMapping{
@@ -61,6 +66,7 @@ func DefaultConfig(rateInterval time.Duration, labelPrefix string) *config.Metri
 
 			// normal non-cumulative metrics
 			{
+				ID:            "gauge",
 				SeriesQuery:   string(prom.MatchSeries("", prom.LabelNeq(fmt.Sprintf("%snamespace", labelPrefix), ""), prom.NameNotMatches("^container_.*"))),
 				SeriesFilters: []config.RegexFilter{{IsNot: ".*_total$"}},
 				Resources: config.ResourceMapping{
@@ -71,6 +77,7 @@ func DefaultConfig(rateInterval time.Duration, labelPrefix string) *config.Metri
 
 			// normal rate metrics
 			{
+				ID:            "rate",
 				SeriesQuery:   string(prom.MatchSeries("", prom.LabelNeq(fmt.Sprintf("%snamespace", labelPrefix), ""), prom.NameNotMatches("^container_.*"))),
 				SeriesFilters: []config.RegexFilter{{IsNot: ".*_seconds_total"}},
 				Name:          config.NameMapping{Matches: "^(.*)_total$"},
@@ -82,6 +89,7 @@ func DefaultConfig(rateInterval time.Duration, labelPrefix string) *config.Metri
 
 			// seconds rate metrics
 			{
+				ID:          "seconds-rate",
 				SeriesQuery: string(prom.MatchSeries("", prom.LabelNeq(fmt.Sprintf("%snamespace", labelPrefix), ""), prom.NameNotMatches("^container_.*"))),
 				Name:        config.NameMapping{Matches: "^(.*)_seconds_total$"},
 				Resources: config.ResourceMapping{
@@ -120,3 +128,27 @@ func DefaultConfig(rateInterval time.Duration, labelPrefix string) *config.Metri
 		},
 	}
 }
+
+// NamespaceRateRule returns a rule exposing the rate of the given counter
+// series, summed over each namespace, as a metric of namespaces named after
+// the series (without any `_total` suffix) with a `_per_second` suffix, e.g.
+// `nginx_ingress_controller_requests_per_second`.  Namespaces are expected to
+// be held by the `<prefix>namespace` label.
+func NamespaceRateRule(series string, rateInterval time.Duration, labelPrefix string) config.DiscoveryRule {
+	nsLabel := fmt.Sprintf("%snamespace", labelPrefix)
+	return config.DiscoveryRule{
+		ID:          fmt.Sprintf("namespace-rate-%s", series),
+		SeriesQuery: string(prom.MatchSeries(series, prom.LabelNeq(nsLabel, ""))),
+		Target:      config.NamespaceTarget,
+		Resources: config.ResourceMapping{
+			Overrides: map[string]config.GroupResource{
+				nsLabel: {Resource: "namespace"},
+			},
+		},
+		Name: config.NameMapping{
+			Matches: fmt.Sprintf("^%s$", regexp.QuoteMeta(series)),
+			As:      fmt.Sprintf("%s_per_second", strings.TrimSuffix(series, "_total")),
+		},
+		MetricsQuery: fmt.Sprintf("sum(rate(<<.Series>>{<<.LabelMatchers>>}[%s])) by (<<.GroupBy>>)", pmodel.Duration(rateInterval).String()),
+	}
+}
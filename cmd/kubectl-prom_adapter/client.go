@@ -0,0 +1,171 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/discovery"
+	cmv1beta2 "k8s.io/metrics/pkg/apis/custom_metrics/v1beta2"
+	emv1beta1 "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+)
+
+const (
+	customMetricsGroupVersion   = "custom.metrics.k8s.io/v1beta2"
+	externalMetricsGroupVersion = "external.metrics.k8s.io/v1beta1"
+)
+
+// metricInfo describes a metric listed by the discovery API of the custom or
+// external metrics API.
+type metricInfo struct {
+	// Resource is the group-resource the metric describes, or empty for
+	// external metrics.
+	Resource   string
+	Metric     string
+	Namespaced bool
+}
+
+// metricsClient queries the custom and external metrics APIs served by the
+// adapter, as users would with kubectl get --raw.
+type metricsClient struct {
+	client discovery.DiscoveryInterface
+}
+
+// listMetrics lists the metrics of the given metrics API group version, sorted
+// by resource and name.  Nothing is returned if the API isn't served.
+func (c *metricsClient) listMetrics(groupVersion string) ([]metricInfo, error) {
+	list, err := c.client.ServerResourcesForGroupVersion(groupVersion)
+	if apierr.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the metrics of %s: %v", groupVersion, err)
+	}
+
+	res := make([]metricInfo, 0, len(list.APIResources))
+	for _, resource := range list.APIResources {
+		info := metricInfo{Metric: resource.Name, Namespaced: resource.Namespaced}
+		if groupVersion == customMetricsGroupVersion {
+			// custom metrics are listed as <group-resource>/<metric>
+			info.Resource, info.Metric, _ = strings.Cut(resource.Name, "/")
+		}
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Resource != res[j].Resource {
+			return res[i].Resource < res[j].Resource
+		}
+		return res[i].Metric < res[j].Metric
+	})
+	return res, nil
+}
+
+// customMetricRequest identifies the custom metric values to fetch.
+type customMetricRequest struct {
+	Resource  string
+	Metric    string
+	Namespace string
+	// Name is the name of the object, or empty for all the objects matching
+	// the label selector.
+	Name           string
+	LabelSelector  string
+	MetricSelector string
+}
+
+// path returns the path of the custom metrics API serving the request.  The
+// namespace is ignored for resources which aren't namespaced.
+func (r customMetricRequest) path(namespaced bool) string {
+	name := r.Name
+	if name == "" {
+		name = "*"
+	}
+	base := "/apis/" + customMetricsGroupVersion
+	switch {
+	case r.Resource == "namespaces" || r.Resource == "namespace":
+		// metrics describing namespaces themselves
+		return fmt.Sprintf("%s/namespaces/%s/metrics/%s", base, name, r.Metric)
+	case namespaced:
+		return fmt.Sprintf("%s/namespaces/%s/%s/%s/%s", base, r.Namespace, r.Resource, name, r.Metric)
+	default:
+		return fmt.Sprintf("%s/%s/%s/%s", base, r.Resource, name, r.Metric)
+	}
+}
+
+// getCustomMetric fetches the values of a custom metric.
+func (c *metricsClient) getCustomMetric(ctx context.Context, req customMetricRequest) (*cmv1beta2.MetricValueList, error) {
+	namespaced, err := c.isNamespaced(req.Resource, req.Metric)
+	if err != nil {
+		return nil, err
+	}
+
+	r := c.client.RESTClient().Get().AbsPath(req.path(namespaced))
+	if req.LabelSelector != "" {
+		r = r.Param("labelSelector", req.LabelSelector)
+	}
+	if req.MetricSelector != "" {
+		r = r.Param("metricLabelSelector", req.MetricSelector)
+	}
+	raw, err := r.DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var res cmv1beta2.MetricValueList
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, fmt.Errorf("unable to decode custom metric values: %v", err)
+	}
+	return &res, nil
+}
+
+// isNamespaced checks whether the given custom metric describes namespaced
+// objects, according to the discovery API.  Unknown metrics are assumed to
+// be namespaced, so that the adapter returns a meaningful error for them.
+func (c *metricsClient) isNamespaced(resource, metric string) (bool, error) {
+	metrics, err := c.listMetrics(customMetricsGroupVersion)
+	if err != nil {
+		return false, err
+	}
+	for _, info := range metrics {
+		if info.Resource == resource && info.Metric == metric {
+			return info.Namespaced, nil
+		}
+	}
+	return true, nil
+}
+
+// getExternalMetric fetches the values of an external metric.
+func (c *metricsClient) getExternalMetric(ctx context.Context, namespace, metric, metricSelector string) (*emv1beta1.ExternalMetricValueList, error) {
+	r := c.client.RESTClient().Get().AbsPath("/apis", externalMetricsGroupVersion, "namespaces", namespace, metric)
+	if metricSelector != "" {
+		r = r.Param("labelSelector", metricSelector)
+	}
+	raw, err := r.DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var res emv1beta1.ExternalMetricValueList
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, fmt.Errorf("unable to decode external metric values: %v", err)
+	}
+	return &res, nil
+}
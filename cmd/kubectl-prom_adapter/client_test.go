@@ -0,0 +1,183 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	cmv1beta2 "k8s.io/metrics/pkg/apis/custom_metrics/v1beta2"
+	emv1beta1 "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+)
+
+// fakeAdapter serves the discovery API of the custom metrics API, and
+// records the other requests it gets, answering them with the given values.
+func fakeAdapter(t *testing.T, requests *[]string, values interface{}) *metricsClient {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var res interface{}
+		switch r.URL.Path {
+		case "/apis/" + customMetricsGroupVersion:
+			res = &metav1.APIResourceList{
+				GroupVersion: customMetricsGroupVersion,
+				APIResources: []metav1.APIResource{
+					{Name: "pods/http_requests", Namespaced: true},
+					{Name: "nodes/node_load", Namespaced: false},
+					{Name: "deployments.apps/http_requests", Namespaced: true},
+				},
+			}
+		case "/apis/" + externalMetricsGroupVersion:
+			http.NotFound(w, r)
+			return
+		default:
+			// leave out the timeout set by the discovery client
+			u, query := *r.URL, r.URL.Query()
+			query.Del("timeout")
+			u.RawQuery = query.Encode()
+			*requests = append(*requests, u.String())
+			res = values
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			t.Errorf("unable to write response: %v", err)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := discovery.NewDiscoveryClientForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &metricsClient{client: client}
+}
+
+func TestListMetrics(t *testing.T) {
+	client := fakeAdapter(t, nil, nil)
+
+	var out bytes.Buffer
+	if err := runList(&out, client, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `RESOURCE           METRIC          NAMESPACED
+deployments.apps   http_requests   true
+nodes              node_load       false
+pods               http_requests   true
+`
+	if out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	if err := runList(&out, client, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != "METRIC\n" {
+		t.Errorf("expected no external metrics when the API isn't served, got\n%s", out.String())
+	}
+}
+
+func TestGetCustomMetric(t *testing.T) {
+	var requests []string
+	client := fakeAdapter(t, &requests, &cmv1beta2.MetricValueList{})
+
+	for _, req := range []customMetricRequest{
+		{Resource: "pods", Metric: "http_requests", Namespace: "default", LabelSelector: "app=frontend", MetricSelector: "code=500"},
+		{Resource: "deployments.apps", Metric: "http_requests", Namespace: "web", Name: "frontend"},
+		{Resource: "nodes", Metric: "node_load", Namespace: "default", Name: "node-1"},
+		{Resource: "namespaces", Metric: "queue_depth", Name: "default"},
+	} {
+		if _, err := client.getCustomMetric(context.Background(), req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	expected := []string{
+		"/apis/custom.metrics.k8s.io/v1beta2/namespaces/default/pods/%2A/http_requests?labelSelector=app%3Dfrontend&metricLabelSelector=code%3D500",
+		"/apis/custom.metrics.k8s.io/v1beta2/namespaces/web/deployments.apps/frontend/http_requests",
+		"/apis/custom.metrics.k8s.io/v1beta2/nodes/node-1/node_load",
+		"/apis/custom.metrics.k8s.io/v1beta2/namespaces/default/metrics/queue_depth",
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected requests\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(requests, "\n"))
+	}
+}
+
+func TestGetExternalMetric(t *testing.T) {
+	var requests []string
+	client := fakeAdapter(t, &requests, &emv1beta1.ExternalMetricValueList{})
+
+	if _, err := client.getExternalMetric(context.Background(), "default", "queue_depth", "queue=jobs"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "/apis/external.metrics.k8s.io/v1beta1/namespaces/default/queue_depth?labelSelector=queue%3Djobs"
+	if len(requests) != 1 || requests[0] != expected {
+		t.Errorf("expected request %s, got %v", expected, requests)
+	}
+}
+
+func TestPrintValues(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	var out bytes.Buffer
+	err := printCustomValues(&out, &cmv1beta2.MetricValueList{Items: []cmv1beta2.MetricValue{
+		{
+			DescribedObject: corev1.ObjectReference{Namespace: "default", Kind: "Pod", Name: "frontend-1"},
+			Metric:          cmv1beta2.MetricIdentifier{Name: "http_requests", Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"code": "500"}}},
+			Timestamp:       metav1.NewTime(now.Add(-30 * time.Second)),
+			Value:           resource.MustParse("250m"),
+		},
+	}}, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `NAMESPACE   KIND   NAME         VALUE   SELECTOR   AGE
+default     Pod    frontend-1   250m    code=500   30s
+`
+	if out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	err = printExternalValues(&out, &emv1beta1.ExternalMetricValueList{Items: []emv1beta1.ExternalMetricValue{
+		{
+			MetricName:   "queue_depth",
+			MetricLabels: map[string]string{"queue": "jobs", "env": "prod"},
+			Timestamp:    metav1.NewTime(now.Add(-2 * time.Minute)),
+			Value:        resource.MustParse("12"),
+		},
+	}}, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = `METRIC        LABELS                VALUE   AGE
+queue_depth   env=prod,queue=jobs   12      2m
+`
+	if out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
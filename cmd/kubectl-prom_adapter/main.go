@@ -0,0 +1,222 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-prom_adapter is a kubectl plugin, run as kubectl prom-adapter,
+// listing the custom and external metrics served by prometheus-adapter and
+// fetching their values, like kubectl top does for resource metrics.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/tools/clientcmd"
+	cmv1beta2 "k8s.io/metrics/pkg/apis/custom_metrics/v1beta2"
+	emv1beta1 "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+)
+
+type options struct {
+	kubeConfig     string
+	kubeContext    string
+	namespace      string
+	selector       string
+	metricSelector string
+	external       bool
+}
+
+func main() {
+	opts := &options{}
+	cmd := &cobra.Command{
+		Use:   "kubectl prom-adapter",
+		Short: "Query the custom and external metrics served by prometheus-adapter",
+		Long: `List the custom and external metrics served by prometheus-adapter, and fetch
+their values, rather than crafting kubectl get --raw requests by hand.`,
+		SilenceUsage: true,
+	}
+	cmd.PersistentFlags().StringVar(&opts.kubeConfig, "kubeconfig", "", "Path to the kubeconfig file to use")
+	cmd.PersistentFlags().StringVar(&opts.kubeContext, "context", "", "The kubeconfig context to use")
+	cmd.PersistentFlags().StringVarP(&opts.namespace, "namespace", "n", "", "The namespace of the objects, or of the requester of external metrics")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the custom (or external) metrics",
+		Args:  cobra.NoArgs,
+		RunE: func(c *cobra.Command, _ []string) error {
+			client, _, err := opts.client()
+			if err != nil {
+				return err
+			}
+			return runList(c.OutOrStdout(), client, opts.external)
+		},
+	}
+	listCmd.Flags().BoolVar(&opts.external, "external", false, "List external metrics rather than custom metrics")
+
+	getCmd := &cobra.Command{
+		Use:   "get RESOURCE METRIC [NAME]",
+		Short: "Fetch the values of a custom metric",
+		Example: `  # the http_requests metric of all the pods of the current namespace
+  kubectl prom-adapter get pods http_requests
+
+  # the http_requests metric of a deployment, restricted to some series
+  kubectl prom-adapter get deployments.apps http_requests frontend -n web --metric-selector code=500`,
+		Args: cobra.RangeArgs(2, 3),
+		RunE: func(c *cobra.Command, args []string) error {
+			client, namespace, err := opts.client()
+			if err != nil {
+				return err
+			}
+			req := customMetricRequest{
+				Resource:       args[0],
+				Metric:         args[1],
+				Namespace:      namespace,
+				LabelSelector:  opts.selector,
+				MetricSelector: opts.metricSelector,
+			}
+			if len(args) == 3 {
+				req.Name = args[2]
+			}
+			values, err := client.getCustomMetric(c.Context(), req)
+			if err != nil {
+				return err
+			}
+			return printCustomValues(c.OutOrStdout(), values, time.Now())
+		},
+	}
+	getCmd.Flags().StringVarP(&opts.selector, "selector", "l", "", "Label selector of the objects, when no name is given")
+	getCmd.Flags().StringVar(&opts.metricSelector, "metric-selector", "", "Label selector of the series of the metric")
+
+	externalCmd := &cobra.Command{
+		Use:   "external METRIC",
+		Short: "Fetch the values of an external metric",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			client, namespace, err := opts.client()
+			if err != nil {
+				return err
+			}
+			values, err := client.getExternalMetric(c.Context(), namespace, args[0], opts.metricSelector)
+			if err != nil {
+				return err
+			}
+			return printExternalValues(c.OutOrStdout(), values, time.Now())
+		},
+	}
+	externalCmd.Flags().StringVarP(&opts.metricSelector, "selector", "l", "", "Label selector of the series of the metric")
+
+	cmd.AddCommand(listCmd, getCmd, externalCmd)
+	if err := cmd.ExecuteContext(context.Background()); err != nil {
+		os.Exit(1)
+	}
+}
+
+// client returns a metrics client for the configured cluster, and the
+// namespace to use, which defaults to the one of the kubeconfig context.
+func (o *options) client() (*metricsClient, string, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = o.kubeConfig
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{CurrentContext: o.kubeContext})
+
+	config, err := loader.ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to load the kubeconfig: %v", err)
+	}
+	namespace := o.namespace
+	if namespace == "" {
+		if namespace, _, err = loader.Namespace(); err != nil {
+			return nil, "", fmt.Errorf("unable to determine the namespace: %v", err)
+		}
+	}
+	client, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to construct the Kubernetes client: %v", err)
+	}
+	return &metricsClient{client: client}, namespace, nil
+}
+
+func runList(out io.Writer, client *metricsClient, external bool) error {
+	groupVersion := customMetricsGroupVersion
+	if external {
+		groupVersion = externalMetricsGroupVersion
+	}
+	metrics, err := client.listMetrics(groupVersion)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 3, ' ', 0)
+	if external {
+		fmt.Fprintln(w, "METRIC")
+		for _, info := range metrics {
+			fmt.Fprintln(w, info.Metric)
+		}
+	} else {
+		fmt.Fprintln(w, "RESOURCE\tMETRIC\tNAMESPACED")
+		for _, info := range metrics {
+			fmt.Fprintf(w, "%s\t%s\t%t\n", info.Resource, info.Metric, info.Namespaced)
+		}
+	}
+	return w.Flush()
+}
+
+func printCustomValues(out io.Writer, values *cmv1beta2.MetricValueList, now time.Time) error {
+	w := tabwriter.NewWriter(out, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tKIND\tNAME\tVALUE\tSELECTOR\tAGE")
+	for _, value := range values.Items {
+		obj := value.DescribedObject
+		namespace := obj.Namespace
+		if namespace == "" {
+			namespace = "<none>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", namespace, obj.Kind, obj.Name, value.Value.String(), metav1.FormatLabelSelector(value.Metric.Selector), age(value.Timestamp.Time, now))
+	}
+	return w.Flush()
+}
+
+func printExternalValues(out io.Writer, values *emv1beta1.ExternalMetricValueList, now time.Time) error {
+	w := tabwriter.NewWriter(out, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "METRIC\tLABELS\tVALUE\tAGE")
+	for _, value := range values.Items {
+		labels := make([]string, 0, len(value.MetricLabels))
+		for name, val := range value.MetricLabels {
+			labels = append(labels, name+"="+val)
+		}
+		sort.Strings(labels)
+		labelString := strings.Join(labels, ",")
+		if labelString == "" {
+			labelString = "<none>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", value.MetricName, labelString, value.Value.String(), age(value.Timestamp.Time, now))
+	}
+	return w.Flush()
+}
+
+// age formats the age of a value like kubectl does for objects.
+func age(timestamp, now time.Time) string {
+	if timestamp.IsZero() {
+		return "<unknown>"
+	}
+	return duration.HumanDuration(now.Sub(timestamp))
+}
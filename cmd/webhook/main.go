@@ -0,0 +1,134 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The webhook command serves a validating admission webhook which checks that
+// the custom and external metrics referenced by HorizontalPodAutoscalers are
+// exposed by prometheus-adapter, catching typos in metric names before they
+// show up as "unable to fetch metrics" conditions.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+)
+
+// validatePath is the path on which HPA admission reviews are served.
+const validatePath = "/validate"
+
+type options struct {
+	kubeConfig     string
+	certFile       string
+	keyFile        string
+	securePort     int
+	rejectUnknown  bool
+	metricsTimeout time.Duration
+	metricsTTL     time.Duration
+}
+
+func main() {
+	opts := options{}
+	cmd := &cobra.Command{
+		Use:   "prometheus-adapter-webhook",
+		Short: "Validate the metrics referenced by HorizontalPodAutoscalers",
+		Long: `Serve a validating admission webhook checking that the custom and external
+metrics referenced by HorizontalPodAutoscalers are exposed by prometheus-adapter.
+References to unknown metrics are returned as warnings, or rejected.`,
+		RunE: func(c *cobra.Command, args []string) error {
+			return run(opts)
+		},
+	}
+
+	klogFlags := flag.NewFlagSet("klog", flag.ExitOnError)
+	klog.InitFlags(klogFlags)
+	cmd.Flags().AddGoFlagSet(klogFlags)
+
+	cmd.Flags().StringVar(&opts.kubeConfig, "kubeconfig", "",
+		"Kubeconfig file used to connect to the cluster, in-cluster configuration is used if unset")
+	cmd.Flags().StringVar(&opts.certFile, "tls-cert-file", "",
+		"File containing the serving certificate")
+	cmd.Flags().StringVar(&opts.keyFile, "tls-private-key-file", "",
+		"File containing the private key of the serving certificate")
+	cmd.Flags().IntVar(&opts.securePort, "secure-port", 8443,
+		"Port on which the webhook is served")
+	cmd.Flags().BoolVar(&opts.rejectUnknown, "reject-unknown-metrics", false,
+		"Reject HorizontalPodAutoscalers referencing metrics which aren't exposed, rather than returning a warning")
+	cmd.Flags().DurationVar(&opts.metricsTimeout, "metrics-timeout", 5*time.Second,
+		"Timeout for listing the metrics exposed by the adapter")
+	cmd.Flags().DurationVar(&opts.metricsTTL, "metrics-cache-ttl", 30*time.Second,
+		"How long the list of metrics exposed by the adapter is cached")
+
+	if err := cmd.Execute(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to run the webhook: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(opts options) error {
+	if opts.certFile == "" || opts.keyFile == "" {
+		return fmt.Errorf("--tls-cert-file and --tls-private-key-file must be set")
+	}
+
+	var (
+		clientConfig *rest.Config
+		err          error
+	)
+	if opts.kubeConfig != "" {
+		loadingRules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: opts.kubeConfig}
+		loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{})
+		clientConfig, err = loader.ClientConfig()
+	} else {
+		clientConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to construct Kubernetes client configuration: %v", err)
+	}
+	clientConfig.Timeout = opts.metricsTimeout
+
+	client, err := discovery.NewDiscoveryClientForConfig(clientConfig)
+	if err != nil {
+		return fmt.Errorf("unable to construct discovery client: %v", err)
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(client))
+
+	mux := http.NewServeMux()
+	mux.Handle(validatePath, &hpaValidator{
+		metrics: newDiscoveryMetricSource(client, opts.metricsTTL),
+		mapper:  mapper,
+		reject:  opts.rejectUnknown,
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", opts.securePort),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	klog.Infof("serving HorizontalPodAutoscaler validation on %s%s", server.Addr, validatePath)
+	return server.ListenAndServeTLS(opts.certFile, opts.keyFile)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/discovery"
+)
+
+const (
+	customMetricsGroupVersion   = "custom.metrics.k8s.io/v1beta2"
+	externalMetricsGroupVersion = "external.metrics.k8s.io/v1beta1"
+)
+
+// metricSource lists the metrics exposed by the adapter.
+type metricSource interface {
+	// metrics returns the custom metrics, as <group-resource>/<metric> (e.g.
+	// pods/http_requests or deployments.apps/http_requests), and the external
+	// metrics exposed by the adapter.
+	metrics() (custom, external sets.Set[string], err error)
+}
+
+// discoveryMetricSource lists the metrics exposed by the adapter using the
+// discovery API of the custom and external metrics APIs, which is served from
+// the adapter's metric registry.  Results are cached for the given TTL, so
+// that bursts of admission requests don't each hit the adapter.
+type discoveryMetricSource struct {
+	client discovery.DiscoveryInterface
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu       sync.Mutex
+	expires  time.Time
+	custom   sets.Set[string]
+	external sets.Set[string]
+}
+
+func newDiscoveryMetricSource(client discovery.DiscoveryInterface, ttl time.Duration) *discoveryMetricSource {
+	return &discoveryMetricSource{
+		client: client,
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+func (s *discoveryMetricSource) metrics() (sets.Set[string], sets.Set[string], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.custom != nil && now.Before(s.expires) {
+		return s.custom, s.external, nil
+	}
+
+	custom, err := s.resourcesFor(customMetricsGroupVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	external, err := s.resourcesFor(externalMetricsGroupVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.custom, s.external, s.expires = custom, external, now.Add(s.ttl)
+	return custom, external, nil
+}
+
+// resourcesFor returns the names of the resources of the given group version,
+// or none if it isn't served.
+func (s *discoveryMetricSource) resourcesFor(groupVersion string) (sets.Set[string], error) {
+	list, err := s.client.ServerResourcesForGroupVersion(groupVersion)
+	if apierr.IsNotFound(err) {
+		return sets.New[string](), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the metrics of %s: %v", groupVersion, err)
+	}
+	res := sets.New[string]()
+	for _, resource := range list.APIResources {
+		res.Insert(resource.Name)
+	}
+	return res, nil
+}
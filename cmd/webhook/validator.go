@@ -0,0 +1,172 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+)
+
+// hpaValidator is a validating admission webhook checking that the custom and
+// external metrics referenced by HorizontalPodAutoscalers are exposed by the
+// adapter.  References to unknown metrics are returned as warnings, or make
+// the HPA rejected if reject is set.  HPAs are always admitted when the
+// exposed metrics can't be listed, so that the webhook doesn't block them
+// while the adapter is unavailable.
+type hpaValidator struct {
+	metrics metricSource
+	mapper  apimeta.RESTMapper
+	reject  bool
+}
+
+func (v *hpaValidator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(req.Body).Decode(&review); err != nil {
+		http.Error(w, fmt.Sprintf("invalid admission review: %v", err), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(w, "the admission review has no request", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = v.review(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&review); err != nil {
+		klog.Errorf("unable to write admission response: %v", err)
+	}
+}
+
+// review checks the HPA of the given admission request.
+func (v *hpaValidator) review(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if req.Operation == admissionv1.Delete || len(req.Object.Raw) == 0 {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	var hpa autoscalingv2.HorizontalPodAutoscaler
+	if err := json.Unmarshal(req.Object.Raw, &hpa); err != nil {
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Message: fmt.Sprintf("unable to decode %s as an autoscaling/v2 HorizontalPodAutoscaler: %v", req.Kind.Kind, err),
+				Reason:  metav1.StatusReasonBadRequest,
+				Code:    http.StatusBadRequest,
+			},
+		}
+	}
+
+	problems, err := v.problems(&hpa)
+	if err != nil {
+		klog.Errorf("unable to check the metrics of HorizontalPodAutoscaler %s/%s: %v", req.Namespace, req.Name, err)
+		return &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{"unable to check that the metrics of the HorizontalPodAutoscaler are exposed by prometheus-adapter"},
+		}
+	}
+	if len(problems) == 0 {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	klog.V(2).Infof("HorizontalPodAutoscaler %s/%s references unknown metrics: %s", req.Namespace, req.Name, strings.Join(problems, "; "))
+	if !v.reject {
+		return &admissionv1.AdmissionResponse{Allowed: true, Warnings: problems}
+	}
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: strings.Join(problems, "; "),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
+
+// problems returns a description of each reference of the given HPA to a
+// custom or external metric which isn't exposed by the adapter.
+func (v *hpaValidator) problems(hpa *autoscalingv2.HorizontalPodAutoscaler) ([]string, error) {
+	custom, external, err := v.metrics.metrics()
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for i, metric := range hpa.Spec.Metrics {
+		field := fmt.Sprintf("spec.metrics[%d]", i)
+		switch metric.Type {
+		case autoscalingv2.PodsMetricSourceType:
+			if metric.Pods == nil {
+				continue
+			}
+			if !custom.Has("pods/" + metric.Pods.Metric.Name) {
+				problems = append(problems, fmt.Sprintf("%s.pods.metric.name: custom metric %q of pods isn't exposed by prometheus-adapter", field, metric.Pods.Metric.Name))
+			}
+		case autoscalingv2.ObjectMetricSourceType:
+			if metric.Object == nil {
+				continue
+			}
+			resource, err := v.resourceFor(metric.Object.DescribedObject)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s.object.describedObject: %v", field, err))
+				continue
+			}
+			if !custom.Has(resource.String() + "/" + metric.Object.Metric.Name) {
+				problems = append(problems, fmt.Sprintf("%s.object.metric.name: custom metric %q of %s isn't exposed by prometheus-adapter", field, metric.Object.Metric.Name, resource.String()))
+			}
+		case autoscalingv2.ExternalMetricSourceType:
+			if metric.External == nil {
+				continue
+			}
+			if !external.Has(metric.External.Metric.Name) {
+				problems = append(problems, fmt.Sprintf("%s.external.metric.name: external metric %q isn't exposed by prometheus-adapter", field, metric.External.Metric.Name))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// resourceFor returns the group-resource of the given object reference.
+func (v *hpaValidator) resourceFor(ref autoscalingv2.CrossVersionObjectReference) (schema.GroupResource, error) {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return schema.GroupResource{}, fmt.Errorf("invalid API version %q: %v", ref.APIVersion, err)
+	}
+	mapping, err := v.mapper.RESTMapping(gv.WithKind(ref.Kind).GroupKind(), gv.Version)
+	if err != nil {
+		return schema.GroupResource{}, fmt.Errorf("unknown kind %s in %s", ref.Kind, ref.APIVersion)
+	}
+	return mapping.Resource.GroupResource(), nil
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+type fakeMetricSource struct {
+	err error
+}
+
+func (s fakeMetricSource) metrics() (sets.Set[string], sets.Set[string], error) {
+	if s.err != nil {
+		return nil, nil, s.err
+	}
+	return sets.New("pods/http_requests", "deployments.apps/http_requests"), sets.New("queue_depth"), nil
+}
+
+func testMapper() apimeta.RESTMapper {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, apimeta.RESTScopeNamespace)
+	return mapper
+}
+
+func testHPA(metrics ...autoscalingv2.MetricSpec) *autoscalingv2.HorizontalPodAutoscaler {
+	return &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+		Spec:       autoscalingv2.HorizontalPodAutoscalerSpec{Metrics: metrics},
+	}
+}
+
+func podsMetric(name string) autoscalingv2.MetricSpec {
+	return autoscalingv2.MetricSpec{
+		Type: autoscalingv2.PodsMetricSourceType,
+		Pods: &autoscalingv2.PodsMetricSource{Metric: autoscalingv2.MetricIdentifier{Name: name}},
+	}
+}
+
+func objectMetric(apiVersion, kind, name string) autoscalingv2.MetricSpec {
+	return autoscalingv2.MetricSpec{
+		Type: autoscalingv2.ObjectMetricSourceType,
+		Object: &autoscalingv2.ObjectMetricSource{
+			DescribedObject: autoscalingv2.CrossVersionObjectReference{APIVersion: apiVersion, Kind: kind, Name: "app"},
+			Metric:          autoscalingv2.MetricIdentifier{Name: name},
+		},
+	}
+}
+
+func externalMetric(name string) autoscalingv2.MetricSpec {
+	return autoscalingv2.MetricSpec{
+		Type:     autoscalingv2.ExternalMetricSourceType,
+		External: &autoscalingv2.ExternalMetricSource{Metric: autoscalingv2.MetricIdentifier{Name: name}},
+	}
+}
+
+func TestProblems(t *testing.T) {
+	v := &hpaValidator{metrics: fakeMetricSource{}, mapper: testMapper()}
+
+	tests := []struct {
+		name     string
+		hpa      *autoscalingv2.HorizontalPodAutoscaler
+		expected []string
+	}{
+		{
+			name: "known metrics",
+			hpa: testHPA(
+				podsMetric("http_requests"),
+				objectMetric("apps/v1", "Deployment", "http_requests"),
+				externalMetric("queue_depth"),
+				autoscalingv2.MetricSpec{Type: autoscalingv2.ResourceMetricSourceType, Resource: &autoscalingv2.ResourceMetricSource{Name: "cpu"}},
+			),
+		},
+		{
+			name: "unknown metrics",
+			hpa: testHPA(
+				podsMetric("http_request"),
+				objectMetric("apps/v1", "Deployment", "http_request"),
+				externalMetric("queue_dpeth"),
+			),
+			expected: []string{
+				`spec.metrics[0].pods.metric.name: custom metric "http_request" of pods`,
+				`spec.metrics[1].object.metric.name: custom metric "http_request" of deployments.apps`,
+				`spec.metrics[2].external.metric.name: external metric "queue_dpeth"`,
+			},
+		},
+		{
+			name:     "unknown kind",
+			hpa:      testHPA(objectMetric("example.com/v1", "Widget", "http_requests")),
+			expected: []string{"spec.metrics[0].object.describedObject: unknown kind Widget"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			problems, err := v.problems(tc.hpa)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(problems) != len(tc.expected) {
+				t.Fatalf("expected %d problems, got %q", len(tc.expected), problems)
+			}
+			for i, problem := range problems {
+				if !strings.HasPrefix(problem, tc.expected[i]) {
+					t.Errorf("expected problem %d to start with %q, got %q", i, tc.expected[i], problem)
+				}
+			}
+		})
+	}
+}
+
+func review(t *testing.T, handler http.Handler, op admissionv1.Operation, hpa *autoscalingv2.HorizontalPodAutoscaler) *admissionv1.AdmissionResponse {
+	t.Helper()
+	raw, err := json.Marshal(hpa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(&admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("some-uid"),
+			Operation: op,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, validatePath, bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var res admissionv1.AdmissionReview
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Response == nil || res.Response.UID != "some-uid" {
+		t.Fatalf("expected a response for request some-uid, got %+v", res.Response)
+	}
+	return res.Response
+}
+
+func TestValidatorWarnsAboutUnknownMetrics(t *testing.T) {
+	v := &hpaValidator{metrics: fakeMetricSource{}, mapper: testMapper()}
+
+	res := review(t, v, admissionv1.Create, testHPA(podsMetric("http_requests")))
+	if !res.Allowed || len(res.Warnings) != 0 {
+		t.Errorf("expected an HPA with known metrics to be allowed without warnings, got %+v", res)
+	}
+
+	res = review(t, v, admissionv1.Update, testHPA(podsMetric("http_request")))
+	if !res.Allowed || len(res.Warnings) != 1 {
+		t.Errorf("expected an HPA with an unknown metric to be allowed with a warning, got %+v", res)
+	}
+}
+
+func TestValidatorRejectsUnknownMetrics(t *testing.T) {
+	v := &hpaValidator{metrics: fakeMetricSource{}, mapper: testMapper(), reject: true}
+
+	res := review(t, v, admissionv1.Create, testHPA(podsMetric("http_request")))
+	if res.Allowed || res.Result == nil || !strings.Contains(res.Result.Message, "http_request") {
+		t.Errorf("expected an HPA with an unknown metric to be rejected, got %+v", res)
+	}
+
+	res = review(t, v, admissionv1.Delete, nil)
+	if !res.Allowed {
+		t.Errorf("expected deletions to be allowed, got %+v", res)
+	}
+}
+
+func TestValidatorAllowsWhenMetricsAreUnavailable(t *testing.T) {
+	v := &hpaValidator{metrics: fakeMetricSource{err: fmt.Errorf("adapter unavailable")}, mapper: testMapper(), reject: true}
+
+	res := review(t, v, admissionv1.Create, testHPA(podsMetric("http_request")))
+	if !res.Allowed || len(res.Warnings) != 1 {
+		t.Errorf("expected the HPA to be allowed with a warning, got %+v", res)
+	}
+}
+
+func TestDiscoveryMetricSource(t *testing.T) {
+	client := &fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{}}
+	client.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: customMetricsGroupVersion,
+			APIResources: []metav1.APIResource{{Name: "pods/http_requests"}, {Name: "namespaces/queue_depth"}},
+		},
+	}
+
+	now := time.Now()
+	source := newDiscoveryMetricSource(client, time.Minute)
+	source.now = func() time.Time { return now }
+
+	custom, external, err := source.metrics()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !custom.Equal(sets.New("pods/http_requests", "namespaces/queue_depth")) {
+		t.Errorf("unexpected custom metrics %v", sets.List(custom))
+	}
+	if external.Len() != 0 {
+		t.Errorf("expected no external metrics when the API isn't served, got %v", sets.List(external))
+	}
+
+	client.Resources[0].APIResources = nil
+	if custom, _, _ := source.metrics(); custom.Len() != 2 {
+		t.Errorf("expected the metrics to be cached, got %v", sets.List(custom))
+	}
+	now = now.Add(time.Minute)
+	if custom, _, _ := source.metrics(); custom.Len() != 0 {
+		t.Errorf("expected the metrics to be listed again once expired, got %v", sets.List(custom))
+	}
+}
@@ -17,6 +17,7 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -48,14 +49,16 @@ type httpAPIClient struct {
 	client  *http.Client
 	baseURL *url.URL
 	headers http.Header
+	// compress asks for gzip-compressed responses, which are much smaller for
+	// the large series lists fetched when relisting
+	compress bool
 }
 
 func (c *httpAPIClient) Do(ctx context.Context, verb, endpoint string, query url.Values) (APIResponse, error) {
-	u := *c.baseURL
-	u.Path = path.Join(c.baseURL.Path, endpoint)
+	u := c.endpointURL(endpoint)
 	var reqBody io.Reader
 	if verb == http.MethodGet {
-		u.RawQuery = query.Encode()
+		u.RawQuery = mergeQuery(u.Query(), query).Encode()
 	} else if verb == http.MethodPost {
 		reqBody = strings.NewReader(query.Encode())
 	}
@@ -69,9 +72,21 @@ func (c *httpAPIClient) Do(ctx context.Context, verb, endpoint string, query url
 			req.Header.Add(key, value)
 		}
 	}
+	for key, values := range HeadersFrom(ctx) {
+		req.Header.Del(key)
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
 	if verb == http.MethodPost {
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	}
+	// the transport only decompresses responses transparently when it asks
+	// for compression itself, which custom transports may not do, so we ask
+	// for it explicitly, and handle compressed responses ourselves
+	if c.compress && req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
 
 	resp, err := c.client.Do(req)
 	defer func() {
@@ -93,12 +108,25 @@ func (c *httpAPIClient) Do(ctx context.Context, verb, endpoint string, query url
 	// codes that aren't 2xx, 400, 422, or 503 won't return JSON objects
 	if code/100 != 2 && code != 400 && code != 422 && code != 503 {
 		return APIResponse{}, &Error{
-			Type: ErrBadResponse,
-			Msg:  fmt.Sprintf("unknown response code %d", code),
+			Type:       ErrBadResponse,
+			Msg:        fmt.Sprintf("unknown response code %d", code),
+			StatusCode: code,
 		}
 	}
 
 	var body io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") && !resp.Uncompressed {
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			return APIResponse{}, &Error{
+				Type:       ErrBadResponse,
+				Msg:        fmt.Sprintf("unable to decompress response: %v", err),
+				StatusCode: code,
+			}
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+	}
 	if klog.V(8).Enabled() {
 		data, err := io.ReadAll(body)
 		if err != nil {
@@ -108,30 +136,70 @@ func (c *httpAPIClient) Do(ctx context.Context, verb, endpoint string, query url
 		body = bytes.NewReader(data)
 	}
 
-	var res APIResponse
-	if err = json.NewDecoder(body).Decode(&res); err != nil {
+	// series lists are filtered as they're read (see WithSeriesFilter)
+	var filter SeriesFilter
+	if endpoint == seriesURL {
+		filter = SeriesFilterFrom(ctx)
+	}
+	res, err := decodeResponse(body, filter)
+	if err != nil {
 		return APIResponse{}, &Error{
-			Type: ErrBadResponse,
-			Msg:  err.Error(),
+			Type:       ErrBadResponse,
+			Msg:        err.Error(),
+			StatusCode: code,
 		}
 	}
 
 	if res.Status == ResponseError {
 		return res, &Error{
-			Type: res.ErrorType,
-			Msg:  res.Error,
+			Type:       res.ErrorType,
+			Msg:        res.Error,
+			StatusCode: code,
 		}
 	}
 
 	return res, nil
 }
 
+// endpointURL returns the URL of the given API endpoint, below the path of the
+// base URL (e.g. /select/0/prometheus for a VictoriaMetrics cluster), and
+// keeping the base URL's query parameters.
+func (c *httpAPIClient) endpointURL(endpoint string) *url.URL {
+	u := *c.baseURL
+	u.Path = path.Join("/", c.baseURL.Path, endpoint)
+	if c.baseURL.RawPath != "" {
+		u.RawPath = path.Join("/", c.baseURL.RawPath, endpoint)
+	}
+	return &u
+}
+
+// mergeQuery returns the base query parameters, overridden by the ones of the
+// request.  Neither argument is modified.
+func mergeQuery(base, query url.Values) url.Values {
+	res := make(url.Values, len(base)+len(query))
+	for key, values := range base {
+		res[key] = values
+	}
+	for key, values := range query {
+		res[key] = values
+	}
+	return res
+}
+
 // NewGenericAPIClient builds a new generic Prometheus API client for the given base URL and HTTP Client.
+// Responses are requested gzip-compressed.
 func NewGenericAPIClient(client *http.Client, baseURL *url.URL, headers http.Header) GenericAPIClient {
+	return NewGenericAPIClientWithCompression(client, baseURL, headers, true)
+}
+
+// NewGenericAPIClientWithCompression builds a new generic Prometheus API client for the given base URL
+// and HTTP Client.  If compress is set, responses are requested gzip-compressed.
+func NewGenericAPIClientWithCompression(client *http.Client, baseURL *url.URL, headers http.Header, compress bool) GenericAPIClient {
 	return &httpAPIClient{
-		client:  client,
-		baseURL: baseURL,
-		headers: headers,
+		client:   client,
+		baseURL:  baseURL,
+		headers:  headers,
+		compress: compress,
 	}
 }
 
@@ -139,22 +207,38 @@ const (
 	queryURL      = "/api/v1/query"
 	queryRangeURL = "/api/v1/query_range"
 	seriesURL     = "/api/v1/series"
+	// labelValuesURL is formatted with the label name
+	labelValuesURL = "/api/v1/label/%s/values"
 )
 
 // queryClient is a Client that connects to the Prometheus HTTP API.
 type queryClient struct {
-	api  GenericAPIClient
-	verb string
+	api      GenericAPIClient
+	verbs    Verbs
+	fallback verbFallback
 }
 
-// NewClientForAPI creates a Client for the given generic Prometheus API client.
+// NewClientForAPI creates a Client for the given generic Prometheus API client,
+// sending its requests with the given verb.
 func NewClientForAPI(client GenericAPIClient, verb string) Client {
+	return NewClientForAPIWithVerbs(client, Verbs{Default: verb})
+}
+
+// NewClientForAPIWithVerbs creates a Client for the given generic Prometheus API
+// client, sending the requests to each endpoint with the given verbs.  Endpoints
+// rejecting POST requests are sent GET requests instead.
+func NewClientForAPIWithVerbs(client GenericAPIClient, verbs Verbs) Client {
 	return &queryClient{
-		api:  client,
-		verb: verb,
+		api:   client,
+		verbs: verbs,
 	}
 }
 
+// do sends a request to the given endpoint, at the given path.
+func (h *queryClient) do(ctx context.Context, endpoint, path string, query url.Values) (APIResponse, error) {
+	return h.fallback.do(ctx, h.api, h.verbs.For(endpoint), endpoint, path, query)
+}
+
 // NewClient creates a Client for the given HTTP client and base URL (the location of the Prometheus server).
 func NewClient(client *http.Client, baseURL *url.URL, headers http.Header, verb string) Client {
 	genericClient := NewGenericAPIClient(client, baseURL, headers)
@@ -174,14 +258,35 @@ func (h *queryClient) Series(ctx context.Context, interval model.Interval, selec
 		vals.Add("match[]", string(selector))
 	}
 
-	res, err := h.api.Do(ctx, h.verb, seriesURL, vals)
+	res, err := h.do(ctx, SeriesEndpoint, seriesURL, vals)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeSeries(res.Data, SeriesFilterFrom(ctx))
+}
+
+func (h *queryClient) LabelValues(ctx context.Context, label string, interval model.Interval, selectors ...Selector) ([]string, error) {
+	vals := url.Values{}
+	if interval.Start != 0 {
+		vals.Set("start", interval.Start.String())
+	}
+	if interval.End != 0 {
+		vals.Set("end", interval.End.String())
+	}
+
+	for _, selector := range selectors {
+		vals.Add("match[]", string(selector))
+	}
+
+	res, err := h.do(ctx, LabelValuesEndpoint, fmt.Sprintf(labelValuesURL, url.PathEscape(label)), vals)
 	if err != nil {
 		return nil, err
 	}
 
-	var seriesRes []Series
-	err = json.Unmarshal(res.Data, &seriesRes)
-	return seriesRes, err
+	var values []string
+	err = json.Unmarshal(res.Data, &values)
+	return values, err
 }
 
 func (h *queryClient) Query(ctx context.Context, t model.Time, query Selector) (QueryResult, error) {
@@ -194,7 +299,7 @@ func (h *queryClient) Query(ctx context.Context, t model.Time, query Selector) (
 		vals.Set("timeout", model.Duration(timeout).String())
 	}
 
-	res, err := h.api.Do(ctx, h.verb, queryURL, vals)
+	res, err := h.do(ctx, QueryEndpoint, queryURL, vals)
 	if err != nil {
 		return QueryResult{}, err
 	}
@@ -221,7 +326,7 @@ func (h *queryClient) QueryRange(ctx context.Context, r Range, query Selector) (
 		vals.Set("timeout", model.Duration(timeout).String())
 	}
 
-	res, err := h.api.Do(ctx, h.verb, queryRangeURL, vals)
+	res, err := h.do(ctx, QueryRangeEndpoint, queryRangeURL, vals)
 	if err != nil {
 		return QueryResult{}, err
 	}
@@ -235,7 +340,7 @@ func (h *queryClient) QueryRange(ctx context.Context, r Range, query Selector) (
 // when present
 func timeoutFromContext(ctx context.Context) (time.Duration, bool) {
 	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
-		return time.Since(deadline), true
+		return time.Until(deadline), true
 	}
 
 	return time.Duration(0), false
@@ -0,0 +1,185 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenericAPIClientEndpointURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		baseURL  string
+		expected string
+	}{
+		{name: "no path", baseURL: "http://prometheus:9090", expected: "http://prometheus:9090/api/v1/query"},
+		{name: "root path", baseURL: "http://prometheus:9090/", expected: "http://prometheus:9090/api/v1/query"},
+		{name: "path prefix", baseURL: "http://vmselect:8481/select/0/prometheus", expected: "http://vmselect:8481/select/0/prometheus/api/v1/query"},
+		{name: "path prefix with trailing slash", baseURL: "http://vmselect:8481/select/0/prometheus/", expected: "http://vmselect:8481/select/0/prometheus/api/v1/query"},
+		{name: "escaped path prefix", baseURL: "http://proxy/tenants/a%2Fb/", expected: "http://proxy/tenants/a%2Fb/api/v1/query"},
+		{name: "query parameters", baseURL: "http://thanos/prefix?dedup=true", expected: "http://thanos/prefix/api/v1/query?dedup=true"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			baseURL, err := url.Parse(test.baseURL)
+			require.NoError(t, err)
+			client := NewGenericAPIClient(http.DefaultClient, baseURL, nil).(*httpAPIClient)
+			require.Equal(t, test.expected, client.endpointURL(queryURL).String())
+		})
+	}
+}
+
+func TestGenericAPIClientSendsURLQueryParameters(t *testing.T) {
+	var receivedPath string
+	var receivedURLQuery, receivedForm url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		receivedPath = req.URL.Path
+		receivedURLQuery = req.URL.Query()
+		body, _ := io.ReadAll(req.Body)
+		receivedForm, _ = url.ParseQuery(string(body))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer server.Close()
+
+	baseURL, err := url.Parse(server.URL + "/select/0/prometheus?dedup=true&query=ignored")
+	require.NoError(t, err)
+	client := NewGenericAPIClient(server.Client(), baseURL, nil)
+	query := url.Values{"query": []string{"up"}}
+
+	_, err = client.Do(context.Background(), http.MethodGet, queryURL, query)
+	require.NoError(t, err)
+	require.Equal(t, "/select/0/prometheus/api/v1/query", receivedPath)
+	require.Equal(t, url.Values{"dedup": []string{"true"}, "query": []string{"up"}}, receivedURLQuery,
+		"the request's parameters should take precedence over the URL's")
+	require.Equal(t, url.Values{"query": []string{"up"}}, query, "the caller's query parameters should be left untouched")
+
+	_, err = client.Do(context.Background(), http.MethodPost, queryURL, query)
+	require.NoError(t, err)
+	require.Equal(t, "/select/0/prometheus/api/v1/query", receivedPath)
+	require.Equal(t, "true", receivedURLQuery.Get("dedup"))
+	require.Equal(t, url.Values{"query": []string{"up"}}, receivedForm)
+}
+
+func TestGenericAPIClientCompression(t *testing.T) {
+	var acceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		acceptEncoding = req.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Type", "application/json")
+		body := `{"status":"success","data":[{"__name__":"up","job":"prometheus"}]}`
+		if acceptEncoding != "gzip" {
+			_, _ = w.Write([]byte(body))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gzipWriter := gzip.NewWriter(w)
+		_, _ = gzipWriter.Write([]byte(body))
+		_ = gzipWriter.Close()
+	}))
+	defer server.Close()
+
+	baseURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	// a transport which doesn't handle compression transparently
+	httpClient := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	for _, compress := range []bool{true, false} {
+		client := NewClientForAPI(NewGenericAPIClientWithCompression(httpClient, baseURL, nil, compress), http.MethodGet)
+		series, err := client.Series(context.Background(), model.Interval{}, "up")
+		require.NoError(t, err)
+		require.Equal(t, []Series{{Name: "up", Labels: model.LabelSet{"job": "prometheus"}}}, series)
+		if compress {
+			require.Equal(t, "gzip", acceptEncoding)
+		} else {
+			require.Empty(t, acceptEncoding)
+		}
+	}
+}
+
+func TestSeriesAreFilteredAsTheyAreDecoded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":[{"__name__":"up","job":"a"},{"__name__":"up","job":"b"},{"__name__":"up","job":"c"}],"warnings":["partial"]}`))
+	}))
+	defer server.Close()
+
+	baseURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	api := NewGenericAPIClient(server.Client(), baseURL, nil)
+	client := NewClientForAPI(api, http.MethodGet)
+
+	series, err := client.Series(context.Background(), model.Interval{}, "up")
+	require.NoError(t, err)
+	require.Len(t, series, 3)
+
+	ctx := WithSeriesFilter(context.Background(), func(series Series) bool {
+		return series.Labels["job"] != "b"
+	})
+	series, err = client.Series(ctx, model.Interval{}, "up")
+	require.NoError(t, err)
+	require.Equal(t, []Series{
+		{Name: "up", Labels: model.LabelSet{"job": "a"}},
+		{Name: "up", Labels: model.LabelSet{"job": "c"}},
+	}, series)
+
+	// the series filtered out are dropped while reading the response body
+	res, err := api.Do(ctx, http.MethodGet, seriesURL, nil)
+	require.NoError(t, err)
+	require.Equal(t, ResponseStatus("success"), res.Status)
+	require.Equal(t, []string{"partial"}, res.Warnings)
+	require.JSONEq(t, `[{"__name__":"up","job":"a"},{"__name__":"up","job":"c"}]`, string(res.Data))
+
+	_, err = decodeSeries([]byte(`{"__name__":"up"}`), nil)
+	require.ErrorContains(t, err, "expected a list of series")
+}
+
+func TestCheckReady(t *testing.T) {
+	ready := false
+	var receivedPath, receivedTenant string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		receivedPath = req.URL.Path
+		receivedTenant = req.Header.Get("X-Scope-OrgID")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("Prometheus Server is Ready.\n"))
+	}))
+	defer server.Close()
+
+	baseURL, err := url.Parse(server.URL + "/prometheus")
+	require.NoError(t, err)
+	headers := http.Header{"X-Scope-OrgID": []string{"team-a"}}
+
+	err = CheckReady(context.Background(), server.Client(), baseURL, headers)
+	require.ErrorContains(t, err, "503")
+	require.Equal(t, "/prometheus/-/ready", receivedPath)
+	require.Equal(t, "team-a", receivedTenant)
+
+	ready = true
+	require.NoError(t, CheckReady(context.Background(), server.Client(), baseURL, headers))
+}
@@ -14,20 +14,33 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+// Package fake provides an in-memory implementation of the Prometheus client
+// used by the adapter, so that the providers (and projects embedding them) can
+// be tested without a running Prometheus.
+//
+// Responses are registered either by exact selector, using the maps of
+// FakePrometheusClient, or by regular expression, using its On* methods.
+// Exact selectors take precedence over regular expressions, which are tried in
+// the order they were registered.
 package fake
 
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"sort"
+	"sync"
 
 	pmodel "github.com/prometheus/common/model"
 
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
 )
 
-// FakePrometheusClient is a fake instance of prom.Client
+// FakePrometheusClient is a fake instance of prom.Client.  Its zero value is
+// ready to use, and answers every query with an empty result.
 type FakePrometheusClient struct {
-	// AcceptableInterval is the interval in which to return queries
+	// AcceptableInterval is the interval in which to return queries.  When
+	// it's zero, queries are accepted at any time.
 	AcceptableInterval pmodel.Interval
 	// ErrQueries are queries that result in an error (whether from Query or Series)
 	ErrQueries map[prom.Selector]error
@@ -35,35 +48,177 @@ type FakePrometheusClient struct {
 	SeriesResults map[prom.Selector][]prom.Series
 	// QueryResults are non-error responses to Query
 	QueryResults map[prom.Selector]prom.QueryResult
+	// RangeQueryResults are non-error responses to QueryRange
+	RangeQueryResults map[prom.Selector]prom.QueryResult
+
+	mu             sync.RWMutex
+	errMatchers    []matcher[error]
+	seriesMatchers []matcher[[]prom.Series]
+	queryMatchers  []matcher[prom.QueryResult]
+	rangeMatchers  []matcher[prom.QueryResult]
+}
+
+// matcher associates a response with the selectors matching a regular expression.
+type matcher[T any] struct {
+	regex    *regexp.Regexp
+	response T
+}
+
+// compileSelectorPattern compiles the given pattern, which has to match whole
+// selectors.  It panics if the pattern is invalid, as it's a programming error.
+func compileSelectorPattern(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^(?:" + pattern + ")$")
+}
+
+// matchFirst returns the response of the first of the given matchers matching
+// the given selector.
+func matchFirst[T any](matchers []matcher[T], selector prom.Selector) (T, bool) {
+	for _, m := range matchers {
+		if m.regex.MatchString(string(selector)) {
+			return m.response, true
+		}
+	}
+	var none T
+	return none, false
+}
+
+// OnSeries makes the series selectors matching the given regular expression
+// return the given series.  The expression has to match whole selectors.
+func (c *FakePrometheusClient) OnSeries(pattern string, series ...prom.Series) *FakePrometheusClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seriesMatchers = append(c.seriesMatchers, matcher[[]prom.Series]{regex: compileSelectorPattern(pattern), response: series})
+	return c
+}
+
+// OnQuery makes the queries matching the given regular expression return the
+// given result.  The expression has to match whole queries.
+func (c *FakePrometheusClient) OnQuery(pattern string, result prom.QueryResult) *FakePrometheusClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queryMatchers = append(c.queryMatchers, matcher[prom.QueryResult]{regex: compileSelectorPattern(pattern), response: result})
+	return c
+}
+
+// OnRangeQuery makes the range queries matching the given regular expression
+// return the given result.  The expression has to match whole queries.
+func (c *FakePrometheusClient) OnRangeQuery(pattern string, result prom.QueryResult) *FakePrometheusClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rangeMatchers = append(c.rangeMatchers, matcher[prom.QueryResult]{regex: compileSelectorPattern(pattern), response: result})
+	return c
+}
+
+// FailOn makes the queries and series selectors matching the given regular
+// expression fail with the given error.  The expression has to match whole
+// queries.  Errors take precedence over the results registered with the
+// other On* methods.
+func (c *FakePrometheusClient) FailOn(pattern string, err error) *FakePrometheusClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errMatchers = append(c.errMatchers, matcher[error]{regex: compileSelectorPattern(pattern), response: err})
+	return c
+}
+
+// errFor returns the error registered for the given query or selector, if any.
+func (c *FakePrometheusClient) errFor(query prom.Selector) (error, bool) {
+	if err, found := c.ErrQueries[query]; found {
+		return err, true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return matchFirst(c.errMatchers, query)
 }
 
-func (c *FakePrometheusClient) Series(_ context.Context, interval pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
-	if (interval.Start != 0 && interval.Start < c.AcceptableInterval.Start) || (interval.End != 0 && interval.End > c.AcceptableInterval.End) {
+// resultFor returns the result registered for the given query, if any, either
+// exactly or through a matcher.
+func (c *FakePrometheusClient) resultFor(exact map[prom.Selector]prom.QueryResult, matchers *[]matcher[prom.QueryResult], query prom.Selector) (prom.QueryResult, bool) {
+	if res, found := exact[query]; found {
+		return res, true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return matchFirst(*matchers, query)
+}
+
+// Series lists the series of the given selectors, applying the series filter
+// of the context, if any.
+func (c *FakePrometheusClient) Series(ctx context.Context, interval pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	series, err := c.series(interval, selectors...)
+	if err != nil {
+		return nil, err
+	}
+	filter := prom.SeriesFilterFrom(ctx)
+	if filter == nil {
+		return series, nil
+	}
+	res := []prom.Series{}
+	for _, s := range series {
+		if filter(s) {
+			res = append(res, s)
+		}
+	}
+	return res, nil
+}
+
+func (c *FakePrometheusClient) series(interval pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	if c.AcceptableInterval != (pmodel.Interval{}) && ((interval.Start != 0 && interval.Start < c.AcceptableInterval.Start) || (interval.End != 0 && interval.End > c.AcceptableInterval.End)) {
 		return nil, fmt.Errorf("interval [%v, %v] for query is outside range [%v, %v]", interval.Start, interval.End, c.AcceptableInterval.Start, c.AcceptableInterval.End)
 	}
 	res := []prom.Series{}
 	for _, sel := range selectors {
-		if err, found := c.ErrQueries[sel]; found {
+		if err, found := c.errFor(sel); found {
 			return nil, err
 		}
 		if series, found := c.SeriesResults[sel]; found {
 			res = append(res, series...)
+			continue
 		}
+		c.mu.RLock()
+		series, _ := matchFirst(c.seriesMatchers, sel)
+		c.mu.RUnlock()
+		res = append(res, series...)
+	}
+
+	return res, nil
+}
+
+// LabelValues lists the values of the given label among the series which Series
+// returns for the given selectors.
+func (c *FakePrometheusClient) LabelValues(_ context.Context, label string, interval pmodel.Interval, selectors ...prom.Selector) ([]string, error) {
+	series, err := c.series(interval, selectors...)
+	if err != nil {
+		return nil, err
 	}
 
+	found := make(map[string]struct{})
+	for _, s := range series {
+		value := string(s.Labels[pmodel.LabelName(label)])
+		if label == pmodel.MetricNameLabel {
+			value = s.Name
+		}
+		if value != "" {
+			found[value] = struct{}{}
+		}
+	}
+	res := make([]string, 0, len(found))
+	for value := range found {
+		res = append(res, value)
+	}
+	sort.Strings(res)
 	return res, nil
 }
 
 func (c *FakePrometheusClient) Query(_ context.Context, t pmodel.Time, query prom.Selector) (prom.QueryResult, error) {
-	if t < c.AcceptableInterval.Start || t > c.AcceptableInterval.End {
+	if c.AcceptableInterval != (pmodel.Interval{}) && (t < c.AcceptableInterval.Start || t > c.AcceptableInterval.End) {
 		return prom.QueryResult{}, fmt.Errorf("time %v for query is outside range [%v, %v]", t, c.AcceptableInterval.Start, c.AcceptableInterval.End)
 	}
 
-	if err, found := c.ErrQueries[query]; found {
+	if err, found := c.errFor(query); found {
 		return prom.QueryResult{}, err
 	}
 
-	if res, found := c.QueryResults[query]; found {
+	if res, found := c.resultFor(c.QueryResults, &c.queryMatchers, query); found {
 		return res, nil
 	}
 
@@ -74,5 +229,25 @@ func (c *FakePrometheusClient) Query(_ context.Context, t pmodel.Time, query pro
 }
 
 func (c *FakePrometheusClient) QueryRange(_ context.Context, r prom.Range, query prom.Selector) (prom.QueryResult, error) {
-	return prom.QueryResult{}, nil
+	if err, found := c.errFor(query); found {
+		return prom.QueryResult{}, err
+	}
+
+	if res, found := c.resultFor(c.RangeQueryResults, &c.rangeMatchers, query); found {
+		return res, nil
+	}
+
+	return prom.QueryResult{
+		Type:   pmodel.ValMatrix,
+		Matrix: &pmodel.Matrix{},
+	}, nil
+}
+
+// VectorResult returns an instant vector query result made of the given samples.
+func VectorResult(samples ...*pmodel.Sample) prom.QueryResult {
+	vector := pmodel.Vector(samples)
+	return prom.QueryResult{
+		Type:   pmodel.ValVector,
+		Vector: &vector,
+	}
 }
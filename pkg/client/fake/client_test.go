@@ -0,0 +1,61 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+func TestFakeClientMatchesSelectorsByRegex(t *testing.T) {
+	sample := &pmodel.Sample{Metric: pmodel.Metric{"pod": "web-0"}, Value: 42}
+	client := (&FakePrometheusClient{
+		QueryResults: map[prom.Selector]prom.QueryResult{
+			`sum(http_requests_total{namespace="kube-system"})`: VectorResult(),
+		},
+	}).
+		OnSeries(`\{namespace!="",pod!=""\}`, prom.Series{Name: "http_requests_total", Labels: pmodel.LabelSet{"namespace": "default", "pod": "web-0"}}).
+		OnQuery(`sum\(http_requests_total\{.*\}\)`, VectorResult(sample)).
+		FailOn(`.*broken.*`, errors.New("broken"))
+	ctx := context.Background()
+
+	series, err := client.Series(ctx, pmodel.Interval{}, `{namespace!="",pod!=""}`)
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	series, err = client.Series(ctx, pmodel.Interval{}, `{namespace!="",pod!="",job="x"}`)
+	require.NoError(t, err)
+	require.Empty(t, series, "patterns should match whole selectors")
+
+	res, err := client.Query(ctx, pmodel.Now(), `sum(http_requests_total{namespace="default"})`)
+	require.NoError(t, err)
+	require.Equal(t, pmodel.Vector{sample}, *res.Vector)
+
+	res, err = client.Query(ctx, pmodel.Now(), `sum(http_requests_total{namespace="kube-system"})`)
+	require.NoError(t, err)
+	require.Empty(t, *res.Vector, "exact selectors should take precedence over patterns")
+
+	_, err = client.Query(ctx, pmodel.Now(), `sum(broken_metric)`)
+	require.EqualError(t, err, "broken")
+	_, err = client.Series(ctx, pmodel.Interval{}, `{__name__="broken_metric"}`)
+	require.EqualError(t, err, "broken")
+}
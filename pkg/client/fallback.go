@@ -0,0 +1,70 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"net/url"
+
+	"k8s.io/klog/v2"
+)
+
+// fallbackClient is a GenericAPIClient sending requests to fallback clients
+// when the primary one fails.
+type fallbackClient struct {
+	clients []GenericAPIClient
+	codes   []int
+}
+
+// WithFallbacks returns a GenericAPIClient sending requests to the primary
+// client, and, if they fail with a transient error (see RetryPolicy) or time
+// out, to each of the fallback clients in turn, e.g. the replicas of a highly
+// available Prometheus.  Errors caused by the query itself aren't retried.
+func WithFallbacks(primary GenericAPIClient, fallbacks []GenericAPIClient, codes []int) GenericAPIClient {
+	if len(fallbacks) == 0 {
+		return primary
+	}
+	return &fallbackClient{
+		clients: append([]GenericAPIClient{primary}, fallbacks...),
+		codes:   codes,
+	}
+}
+
+func (c *fallbackClient) Do(ctx context.Context, verb, endpoint string, query url.Values) (APIResponse, error) {
+	var res APIResponse
+	var err error
+	for i, client := range c.clients {
+		if i > 0 {
+			klog.V(2).Infof("sending Prometheus request to %s to fallback %d after error: %v", endpoint, i, err)
+		}
+		res, err = client.Do(ctx, verb, endpoint, query)
+		if !c.shouldFallBack(ctx, err) {
+			return res, err
+		}
+	}
+	return res, err
+}
+
+// shouldFallBack checks whether a request failing with the given error
+// should be sent to the next client.  Timeouts are only worth it while the
+// request's own context hasn't expired.
+func (c *fallbackClient) shouldFallBack(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return isTransient(err, c.codes) || IsTimeout(err)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithFallbacks(t *testing.T) {
+	codes := []int{http.StatusBadGateway}
+
+	primary := &scriptedClient{errs: []error{errors.New("connection refused")}}
+	fallback1 := &scriptedClient{errs: []error{errUnavailable}}
+	fallback2 := &scriptedClient{}
+	client := WithFallbacks(primary, []GenericAPIClient{fallback1, fallback2}, codes)
+	_, err := client.Do(context.Background(), http.MethodGet, queryURL, nil)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 1, 1}, []int{primary.calls, fallback1.calls, fallback2.calls})
+
+	primary = &scriptedClient{}
+	fallback1 = &scriptedClient{}
+	client = WithFallbacks(primary, []GenericAPIClient{fallback1}, codes)
+	_, err = client.Do(context.Background(), http.MethodGet, queryURL, nil)
+	require.NoError(t, err)
+	require.Equal(t, 0, fallback1.calls, "fallbacks shouldn't be used while the primary works")
+
+	primary = &scriptedClient{errs: []error{errBadQuery}}
+	fallback1 = &scriptedClient{}
+	client = WithFallbacks(primary, []GenericAPIClient{fallback1}, codes)
+	_, err = client.Do(context.Background(), http.MethodGet, queryURL, nil)
+	require.Equal(t, errBadQuery, err)
+	require.Equal(t, 0, fallback1.calls, "errors caused by the query shouldn't be sent to fallbacks")
+
+	primary = &scriptedClient{errs: []error{&Error{Type: ErrTimeout, Msg: "query timed out"}}}
+	fallback1 = &scriptedClient{}
+	client = WithFallbacks(primary, []GenericAPIClient{fallback1}, codes)
+	_, err = client.Do(context.Background(), http.MethodGet, queryURL, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, fallback1.calls, "queries timing out should be sent to fallbacks")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	primary = &scriptedClient{errs: []error{context.Canceled}}
+	fallback1 = &scriptedClient{}
+	client = WithFallbacks(primary, []GenericAPIClient{fallback1}, codes)
+	_, err = client.Do(ctx, http.MethodGet, queryURL, nil)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 0, fallback1.calls, "cancelled requests shouldn't be sent to fallbacks")
+
+	primary = &scriptedClient{errs: []error{errUnavailable}}
+	fallback1 = &scriptedClient{errs: []error{errUnavailable}}
+	client = WithFallbacks(primary, []GenericAPIClient{fallback1}, codes)
+	_, err = client.Do(context.Background(), http.MethodGet, queryURL, nil)
+	require.Equal(t, errUnavailable, err, "the last error should be returned when all clients fail")
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+// fanOutClient is a Client sending each request to all the replicas of a
+// highly available Prometheus, and merging their results.
+type fanOutClient struct {
+	replicas []Client
+}
+
+// NewFanOutClient returns a Client sending each request to all the given
+// replicas concurrently, and merging their results, so that gaps in the data
+// of a replica (e.g. while it restarts) are filled in by the others.  Series
+// and label values are deduplicated, and for each series of query results,
+// the freshest sample is kept.  Requests only fail if they fail on all the
+// replicas.
+func NewFanOutClient(replicas ...Client) Client {
+	if len(replicas) == 1 {
+		return replicas[0]
+	}
+	return &fanOutClient{replicas: replicas}
+}
+
+// fanOut runs the given request against all the replicas, returning the
+// results of the ones which succeeded, or the first error if none did.
+func fanOut[T any](replicas []Client, do func(Client) (T, error)) ([]T, error) {
+	results := make([]T, len(replicas))
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	wg.Add(len(replicas))
+	for i, replica := range replicas {
+		go func(i int, replica Client) {
+			defer wg.Done()
+			results[i], errs[i] = do(replica)
+		}(i, replica)
+	}
+	wg.Wait()
+
+	succeeded := make([]T, 0, len(replicas))
+	for i, err := range errs {
+		if err == nil {
+			succeeded = append(succeeded, results[i])
+		}
+	}
+	if len(succeeded) == 0 {
+		return nil, errs[0]
+	}
+	return succeeded, nil
+}
+
+func (c *fanOutClient) Series(ctx context.Context, interval model.Interval, selectors ...Selector) ([]Series, error) {
+	results, err := fanOut(c.replicas, func(replica Client) ([]Series, error) {
+		return replica.Series(ctx, interval, selectors...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type seriesKey struct {
+		name        string
+		fingerprint model.Fingerprint
+	}
+	seen := make(map[seriesKey]struct{})
+	var merged []Series
+	for _, series := range results {
+		for _, s := range series {
+			key := seriesKey{name: s.Name, fingerprint: s.Labels.Fingerprint()}
+			if _, found := seen[key]; found {
+				continue
+			}
+			seen[key] = struct{}{}
+			merged = append(merged, s)
+		}
+	}
+	return merged, nil
+}
+
+func (c *fanOutClient) LabelValues(ctx context.Context, label string, interval model.Interval, selectors ...Selector) ([]string, error) {
+	results, err := fanOut(c.replicas, func(replica Client) ([]string, error) {
+		return replica.LabelValues(ctx, label, interval, selectors...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	var merged []string
+	for _, values := range results {
+		for _, value := range values {
+			if _, found := seen[value]; found {
+				continue
+			}
+			seen[value] = struct{}{}
+			merged = append(merged, value)
+		}
+	}
+	return merged, nil
+}
+
+func (c *fanOutClient) Query(ctx context.Context, t model.Time, query Selector) (QueryResult, error) {
+	results, err := fanOut(c.replicas, func(replica Client) (QueryResult, error) {
+		return replica.Query(ctx, t, query)
+	})
+	if err != nil {
+		return QueryResult{}, err
+	}
+	return mergeQueryResults(results)
+}
+
+func (c *fanOutClient) QueryRange(ctx context.Context, r Range, query Selector) (QueryResult, error) {
+	results, err := fanOut(c.replicas, func(replica Client) (QueryResult, error) {
+		return replica.QueryRange(ctx, r, query)
+	})
+	if err != nil {
+		return QueryResult{}, err
+	}
+	return mergeQueryResults(results)
+}
+
+// mergeQueryResults merges the results of the same query from several
+// replicas, keeping the freshest sample of each series for vectors and
+// scalars, and the union of the samples of each series for matrices.
+func mergeQueryResults(results []QueryResult) (QueryResult, error) {
+	merged := results[0]
+	for _, res := range results[1:] {
+		if res.Type != merged.Type {
+			return QueryResult{}, fmt.Errorf("replicas returned results of different types (%s and %s)", merged.Type, res.Type)
+		}
+	}
+
+	switch merged.Type {
+	case model.ValScalar:
+		for _, res := range results[1:] {
+			if res.Scalar != nil && (merged.Scalar == nil || res.Scalar.Timestamp.After(merged.Scalar.Timestamp)) {
+				merged.Scalar = res.Scalar
+			}
+		}
+	case model.ValVector:
+		byFingerprint := make(map[model.Fingerprint]int)
+		var vec model.Vector
+		for _, res := range results {
+			if res.Vector == nil {
+				continue
+			}
+			for _, sample := range *res.Vector {
+				fingerprint := sample.Metric.Fingerprint()
+				i, found := byFingerprint[fingerprint]
+				if !found {
+					byFingerprint[fingerprint] = len(vec)
+					vec = append(vec, sample)
+				} else if sample.Timestamp.After(vec[i].Timestamp) {
+					vec[i] = sample
+				}
+			}
+		}
+		merged.Vector = &vec
+	case model.ValMatrix:
+		byFingerprint := make(map[model.Fingerprint]*model.SampleStream)
+		var matrix model.Matrix
+		for _, res := range results {
+			if res.Matrix == nil {
+				continue
+			}
+			for _, stream := range *res.Matrix {
+				fingerprint := stream.Metric.Fingerprint()
+				existing, found := byFingerprint[fingerprint]
+				if !found {
+					stream := &model.SampleStream{Metric: stream.Metric, Values: append([]model.SamplePair(nil), stream.Values...)}
+					byFingerprint[fingerprint] = stream
+					matrix = append(matrix, stream)
+					continue
+				}
+				existing.Values = mergeSamplePairs(existing.Values, stream.Values)
+			}
+		}
+		merged.Matrix = &matrix
+	}
+	return merged, nil
+}
+
+// mergeSamplePairs returns the union of the given samples, ordered by
+// timestamp, keeping the first sample found for each timestamp.
+func mergeSamplePairs(a, b []model.SamplePair) []model.SamplePair {
+	seen := make(map[model.Time]struct{}, len(a))
+	for _, pair := range a {
+		seen[pair.Timestamp] = struct{}{}
+	}
+	for _, pair := range b {
+		if _, found := seen[pair.Timestamp]; !found {
+			a = append(a, pair)
+		}
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].Timestamp.Before(a[j].Timestamp) })
+	return a
+}
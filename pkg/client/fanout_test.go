@@ -0,0 +1,116 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+// replicaClient is a Client returning fixed results.
+type replicaClient struct {
+	series []Series
+	values []string
+	result QueryResult
+	err    error
+}
+
+func (c *replicaClient) Series(context.Context, model.Interval, ...Selector) ([]Series, error) {
+	return c.series, c.err
+}
+
+func (c *replicaClient) LabelValues(context.Context, string, model.Interval, ...Selector) ([]string, error) {
+	return c.values, c.err
+}
+
+func (c *replicaClient) Query(context.Context, model.Time, Selector) (QueryResult, error) {
+	return c.result, c.err
+}
+
+func (c *replicaClient) QueryRange(context.Context, Range, Selector) (QueryResult, error) {
+	return c.result, c.err
+}
+
+func vectorResult(samples ...*model.Sample) QueryResult {
+	vec := model.Vector(samples)
+	return QueryResult{Type: model.ValVector, Vector: &vec}
+}
+
+func TestFanOutClientMergesSeriesAndLabelValues(t *testing.T) {
+	podA := Series{Name: "http_requests_total", Labels: model.LabelSet{"pod": "a"}}
+	podB := Series{Name: "http_requests_total", Labels: model.LabelSet{"pod": "b"}}
+	client := NewFanOutClient(
+		&replicaClient{series: []Series{podA}, values: []string{"a"}},
+		&replicaClient{series: []Series{podA, podB}, values: []string{"a", "b"}},
+		&replicaClient{err: errors.New("connection refused")},
+	)
+
+	series, err := client.Series(context.Background(), model.Interval{})
+	require.NoError(t, err)
+	require.Equal(t, []Series{podA, podB}, series)
+
+	values, err := client.LabelValues(context.Background(), "pod", model.Interval{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, values)
+}
+
+func TestFanOutClientKeepsTheFreshestSamples(t *testing.T) {
+	client := NewFanOutClient(
+		&replicaClient{result: vectorResult(
+			&model.Sample{Metric: model.Metric{"pod": "a"}, Value: 1, Timestamp: 10},
+			&model.Sample{Metric: model.Metric{"pod": "b"}, Value: 2, Timestamp: 20},
+		)},
+		&replicaClient{result: vectorResult(
+			&model.Sample{Metric: model.Metric{"pod": "a"}, Value: 3, Timestamp: 30},
+		)},
+	)
+
+	res, err := client.Query(context.Background(), 0, "up")
+	require.NoError(t, err)
+	require.Equal(t, model.Vector{
+		{Metric: model.Metric{"pod": "a"}, Value: 3, Timestamp: 30},
+		{Metric: model.Metric{"pod": "b"}, Value: 2, Timestamp: 20},
+	}, *res.Vector)
+}
+
+func TestFanOutClientMergesRangeQueryResults(t *testing.T) {
+	matrixResult := func(values ...model.SamplePair) QueryResult {
+		matrix := model.Matrix{{Metric: model.Metric{"pod": "a"}, Values: values}}
+		return QueryResult{Type: model.ValMatrix, Matrix: &matrix}
+	}
+	client := NewFanOutClient(
+		&replicaClient{result: matrixResult(model.SamplePair{Timestamp: 10, Value: 1}, model.SamplePair{Timestamp: 30, Value: 3})},
+		&replicaClient{result: matrixResult(model.SamplePair{Timestamp: 20, Value: 2}, model.SamplePair{Timestamp: 30, Value: 3})},
+	)
+
+	res, err := client.QueryRange(context.Background(), Range{}, "up")
+	require.NoError(t, err)
+	require.Len(t, *res.Matrix, 1)
+	require.Equal(t, []model.SamplePair{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 2}, {Timestamp: 30, Value: 3}}, (*res.Matrix)[0].Values)
+}
+
+func TestFanOutClientFailsOnlyIfAllReplicasFail(t *testing.T) {
+	errRefused := errors.New("connection refused")
+	client := NewFanOutClient(&replicaClient{err: errRefused}, &replicaClient{err: errors.New("no route to host")})
+
+	_, err := client.Query(context.Background(), 0, "up")
+	require.Equal(t, errRefused, err)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+)
+
+type headersKey struct{}
+
+// WithHeaders returns a context adding the given headers to the requests made
+// through a generic API client (see NewGenericAPIClient), replacing the headers
+// of the same name set on the client itself.
+func WithHeaders(ctx context.Context, headers http.Header) context.Context {
+	if len(headers) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
+// HeadersFrom returns the headers added to requests made with the given context.
+func HeadersFrom(ctx context.Context) http.Header {
+	headers, _ := ctx.Value(headersKey{}).(http.Header)
+	return headers
+}
+
+// HeadersKey returns a digest of the given headers, identifying them in map
+// keys and shared state without revealing their values.  It's empty when there
+// are no headers.
+func HeadersKey(headers http.Header) string {
+	if len(headers) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name))
+		for _, value := range headers[name] {
+			h.Write([]byte{0})
+			h.Write([]byte(value))
+		}
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
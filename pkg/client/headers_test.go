@@ -0,0 +1,65 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithHeaders(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = req.Header
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer server.Close()
+
+	baseURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	client := NewGenericAPIClient(server.Client(), baseURL, http.Header{
+		"X-Scope-Orgid": []string{"default"},
+		"X-Team":        []string{"platform"},
+	})
+
+	query := url.Values{"query": []string{"up"}}
+	_, err = client.Do(context.Background(), http.MethodGet, queryURL, query)
+	require.NoError(t, err)
+	require.Equal(t, "default", received.Get("X-Scope-OrgID"))
+
+	ctx := WithHeaders(context.Background(), http.Header{"X-Scope-Orgid": []string{"tenant-a"}})
+	_, err = client.Do(ctx, http.MethodGet, queryURL, query)
+	require.NoError(t, err)
+	require.Equal(t, []string{"tenant-a"}, received.Values("X-Scope-OrgID"), "the rule's headers should replace the global ones")
+	require.Equal(t, "platform", received.Get("X-Team"))
+}
+
+func TestHeadersKey(t *testing.T) {
+	require.Empty(t, HeadersKey(nil))
+
+	a := http.Header{"X-Scope-Orgid": []string{"tenant-a"}, "X-Team": []string{"platform"}}
+	b := http.Header{"X-Team": []string{"platform"}, "X-Scope-Orgid": []string{"tenant-a"}}
+	require.Equal(t, HeadersKey(a), HeadersKey(b))
+	require.NotEqual(t, HeadersKey(a), HeadersKey(http.Header{"X-Scope-Orgid": []string{"tenant-b"}}))
+	require.NotContains(t, HeadersKey(a), "tenant-a")
+}
@@ -19,31 +19,44 @@ package client
 import (
 	"fmt"
 	"strings"
+
+	pmodel "github.com/prometheus/common/model"
 )
 
+// matcherLabel returns the given label as it appears in a label matcher:
+// verbatim if it's a valid Prometheus label name, and double-quoted otherwise,
+// e.g. selector keys like `app.kubernetes.io/name`, so that it can't change
+// the rest of the query.
+func matcherLabel(label string) string {
+	if pmodel.LabelName(label).IsValid() {
+		return label
+	}
+	return fmt.Sprintf("%q", label)
+}
+
 // LabelNeq produces a not-equal label selector expression.
-// Label is passed verbatim, and value is double-quote escaped
+// Label is escaped as per matcherLabel, and value is double-quote escaped
 // using Go's escaping (as per the PromQL rules).
 func LabelNeq(label string, value string) string {
-	return fmt.Sprintf("%s!=%q", label, value)
+	return fmt.Sprintf("%s!=%q", matcherLabel(label), value)
 }
 
 // LabelEq produces a equal label selector expression.
-// Label is passed verbatim, and value is double-quote escaped
+// Label is escaped as per matcherLabel, and value is double-quote escaped
 // using Go's escaping (as per the PromQL rules).
 func LabelEq(label string, value string) string {
-	return fmt.Sprintf("%s=%q", label, value)
+	return fmt.Sprintf("%s=%q", matcherLabel(label), value)
 }
 
 // LabelMatches produces a regexp-matching label selector expression.
 // It has similar constraints to LabelNeq.
 func LabelMatches(label string, expr string) string {
-	return fmt.Sprintf("%s=~%q", label, expr)
+	return fmt.Sprintf("%s=~%q", matcherLabel(label), expr)
 }
 
 // LabelNotMatches produces a inverse regexp-matching label selector expression (the opposite of LabelMatches).
 func LabelNotMatches(label string, expr string) string {
-	return fmt.Sprintf("%s!~%q", label, expr)
+	return fmt.Sprintf("%s!~%q", matcherLabel(label), expr)
 }
 
 // NameMatches produces a label selector expression that checks that the series name matches the given expression.
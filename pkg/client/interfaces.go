@@ -46,12 +46,17 @@ type Range struct {
 // The "timeout" parameter for the HTTP API is set based on the context's deadline,
 // when present and applicable.
 type Client interface {
-	// Series lists the time series matching the given series selectors
+	// Series lists the time series matching the given series selectors, and
+	// the series filter of the context, if any (see WithSeriesFilter).
 	Series(ctx context.Context, interval model.Interval, selectors ...Selector) ([]Series, error)
 	// Query runs a non-range query at the given time.
 	Query(ctx context.Context, t model.Time, query Selector) (QueryResult, error)
 	// QueryRange runs a range query at the given time.
 	QueryRange(ctx context.Context, r Range, query Selector) (QueryResult, error)
+	// LabelValues lists the values of the given label among the time series
+	// matching the given series selectors.  This is much cheaper than listing
+	// the series themselves.
+	LabelValues(ctx context.Context, label string, interval model.Interval, selectors ...Selector) ([]string, error)
 }
 
 // QueryResult is the result of a query.
@@ -124,6 +129,19 @@ func (s *Series) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// MarshalJSON encodes the series in the same form as the Prometheus API, with
+// its name as the __name__ label.
+func (s Series) MarshalJSON() ([]byte, error) {
+	rawMetric := make(model.Metric, len(s.Labels)+1)
+	for name, value := range s.Labels {
+		rawMetric[name] = value
+	}
+	if s.Name != "" {
+		rawMetric[model.MetricNameLabel] = model.LabelValue(s.Name)
+	}
+	return json.Marshal(rawMetric)
+}
+
 func (s *Series) String() string {
 	lblStrings := make([]string, 0, len(s.Labels))
 	for k, v := range s.Labels {
@@ -18,8 +18,11 @@ package metrics
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -27,6 +30,7 @@ import (
 	apimetrics "k8s.io/apiserver/pkg/endpoints/metrics"
 	"k8s.io/component-base/metrics"
 	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
 
 	"sigs.k8s.io/prometheus-adapter/pkg/client"
 )
@@ -45,14 +49,121 @@ var (
 		},
 		[]string{"path", "server"},
 	)
+
+	// queryDuration is the latency of the requests to each endpoint of the
+	// Prometheus API (see endpointName) on behalf of each rule, by response
+	// code, so that slow or failing rules can be pinned down.
+	queryDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "prometheus_client",
+			Name:      "query_duration_seconds",
+			Help:      "Prometheus client query latency in seconds.  Broken down by Prometheus API endpoint, rule the query was made for (empty if none) and response code (none if no response was received)",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"endpoint", "rule", "code"},
+	)
+
+	// partialResponses is the number of successful responses carrying warnings,
+	// which is how Thanos Query reports serving partial data.
+	partialResponses = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "prometheus_client",
+			Name:      "partial_responses_total",
+			Help:      "Number of Prometheus responses carrying warnings, e.g. because Thanos Query served partial data.  Broken down by target prometheus endpoint and target server",
+		},
+		[]string{"path", "server"},
+	)
+
+	// responseWarnings is the number of warnings carried by successful
+	// responses, by type (see warningType).
+	responseWarnings = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "prometheus_client",
+			Name:      "response_warnings_total",
+			Help:      "Number of warnings carried by Prometheus responses, which may explain missing or empty results.  Broken down by target prometheus endpoint, target server and type of warning",
+		},
+		[]string{"path", "server", "type"},
+	)
 )
 
+// warningTypes classifies warnings by the substrings found in them.  The
+// first matching type wins.
+var warningTypes = []struct {
+	name       string
+	substrings []string
+}{
+	{name: "many_to_many", substrings: []string{"many-to-many", "many-to-one", "one-to-many"}},
+	{name: "timeout", substrings: []string{"timeout", "timed out", "deadline exceeded", "deadlineexceeded"}},
+	{name: "partial_response", substrings: []string{"no storeapis matched", "receive series from", "partial response"}},
+	{name: "promql_warning", substrings: []string{"promql warning"}},
+	{name: "promql_info", substrings: []string{"promql info"}},
+}
+
+// warningType returns the type of the given warning, as reported in metrics.
+// Warnings are free-form text, so they're classified into a few known types,
+// to keep the cardinality of the metrics bounded.
+func warningType(warning string) string {
+	warning = strings.ToLower(warning)
+	for _, typ := range warningTypes {
+		for _, substring := range typ.substrings {
+			if strings.Contains(warning, substring) {
+				return typ.name
+			}
+		}
+	}
+	return "other"
+}
+
+// endpointName returns the name of the Prometheus API endpoint at the given
+// path, as reported in metrics.
+func endpointName(path string) string {
+	switch {
+	case strings.HasSuffix(path, "/api/v1/query"):
+		return client.QueryEndpoint
+	case strings.HasSuffix(path, "/api/v1/query_range"):
+		return client.QueryRangeEndpoint
+	case strings.HasSuffix(path, "/api/v1/series"):
+		return client.SeriesEndpoint
+	case strings.Contains(path, "/api/v1/label/") && strings.HasSuffix(path, "/values"):
+		return client.LabelValuesEndpoint
+	}
+	return "other"
+}
+
+// responseCode returns the code of the response to a request failing with
+// the given error, as reported in metrics.
+func responseCode(err error) string {
+	if err == nil {
+		return strconv.Itoa(http.StatusOK)
+	}
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode != 0 {
+		return strconv.Itoa(apiErr.StatusCode)
+	}
+	return "none"
+}
+
 func MetricsHandler() (http.HandlerFunc, error) {
 	registry := metrics.NewKubeRegistry()
 	err := registry.Register(queryLatency)
 	if err != nil {
 		return nil, err
 	}
+	err = registry.Register(queryDuration)
+	if err != nil {
+		return nil, err
+	}
+	err = registry.Register(partialResponses)
+	if err != nil {
+		return nil, err
+	}
+	err = registry.Register(responseWarnings)
+	if err != nil {
+		return nil, err
+	}
 	apimetrics.Register()
 	return func(w http.ResponseWriter, req *http.Request) {
 		legacyregistry.Handler().ServeHTTP(w, req)
@@ -61,7 +172,7 @@ func MetricsHandler() (http.HandlerFunc, error) {
 }
 
 // instrumentedClient is a client.GenericAPIClient which instruments calls to Do,
-// capturing request latency.
+// capturing request latency, partial responses and the warnings they carry.
 type instrumentedGenericClient struct {
 	serverName string
 	client     client.GenericAPIClient
@@ -72,6 +183,11 @@ func (c *instrumentedGenericClient) Do(ctx context.Context, verb, endpoint strin
 	var err error
 	defer func() {
 		endTime := time.Now()
+		queryDuration.With(prometheus.Labels{
+			"endpoint": endpointName(endpoint),
+			"rule":     client.RuleFrom(ctx),
+			"code":     responseCode(err),
+		}).Observe(endTime.Sub(startTime).Seconds())
 		// skip calls where we don't make the actual request
 		if err != nil {
 			if _, wasAPIErr := err.(*client.Error); !wasAPIErr {
@@ -84,6 +200,14 @@ func (c *instrumentedGenericClient) Do(ctx context.Context, verb, endpoint strin
 
 	var resp client.APIResponse
 	resp, err = c.client.Do(ctx, verb, endpoint, query)
+	if err == nil && len(resp.Warnings) > 0 {
+		partialResponses.With(prometheus.Labels{"path": endpoint, "server": c.serverName}).Inc()
+		for _, warning := range resp.Warnings {
+			typ := warningType(warning)
+			responseWarnings.With(prometheus.Labels{"path": endpoint, "server": c.serverName, "type": typ}).Inc()
+			klog.V(1).Infof("Prometheus response from %s for %s carried a %s warning: %s", c.serverName, endpoint, typ, warning)
+		}
+	}
 	return resp, err
 }
 
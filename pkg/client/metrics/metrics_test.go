@@ -0,0 +1,59 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+func TestWarningType(t *testing.T) {
+	for warning, expected := range map[string]string{
+		"PromQL warning: encountered a mix of histograms and floats for metric name \"foo\"": "promql_warning",
+		"PromQL info: metric might not be a counter, name does not end in _total":            "promql_info",
+		"No StoreAPIs matched for this query":                                                "partial_response",
+		"receive series from Addr: 10.0.0.1:10901: rpc error: code = DeadlineExceeded":       "timeout",
+		"found duplicate series for the match group, many-to-many matching not allowed":      "many_to_many",
+		"something unexpected": "other",
+	} {
+		require.Equal(t, expected, warningType(warning), warning)
+	}
+}
+
+func TestEndpointName(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/api/v1/query":                 "query",
+		"/api/v1/query_range":           "query_range",
+		"/api/v1/series":                "series",
+		"/api/v1/label/__name__/values": "label_values",
+		"/api/v1/metadata":              "other",
+	} {
+		require.Equal(t, expected, endpointName(path), path)
+	}
+}
+
+func TestResponseCode(t *testing.T) {
+	require.Equal(t, "200", responseCode(nil))
+	require.Equal(t, "503", responseCode(fmt.Errorf("unable to query: %w", &client.Error{Type: client.ErrBadResponse, StatusCode: http.StatusServiceUnavailable})))
+	require.Equal(t, "none", responseCode(context.DeadlineExceeded))
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+)
+
+// partialResponseParam is the query parameter with which Thanos Query decides
+// whether to serve partial data when some of its stores are unavailable.
+const partialResponseParam = "partial_response"
+
+// partialResponseClient is a GenericAPIClient setting the Thanos partial
+// response parameter on every request.
+type partialResponseClient struct {
+	client GenericAPIClient
+	allow  bool
+}
+
+// WithPartialResponse wraps the given client, asking the server (usually Thanos
+// Query) to allow or deny partial responses on every request.  Partial responses
+// carry warnings describing the missing data.
+func WithPartialResponse(client GenericAPIClient, allow bool) GenericAPIClient {
+	return &partialResponseClient{
+		client: client,
+		allow:  allow,
+	}
+}
+
+func (c *partialResponseClient) Do(ctx context.Context, verb, endpoint string, query url.Values) (APIResponse, error) {
+	vals := make(url.Values, len(query)+1)
+	for key, values := range query {
+		vals[key] = values
+	}
+	vals.Set(partialResponseParam, strconv.FormatBool(c.allow))
+	return c.client.Do(ctx, verb, endpoint, vals)
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithPartialResponse(t *testing.T) {
+	var received url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = req.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]},"warnings":["store unavailable"]}`))
+	}))
+	defer server.Close()
+
+	baseURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	client := WithPartialResponse(NewGenericAPIClient(server.Client(), baseURL, nil), false)
+
+	query := url.Values{"query": []string{"up"}}
+	res, err := client.Do(context.Background(), http.MethodGet, queryURL, query)
+	require.NoError(t, err)
+	require.Equal(t, "false", received.Get("partial_response"))
+	require.Equal(t, "up", received.Get("query"))
+	require.Equal(t, []string{"store unavailable"}, res.Warnings)
+	require.Empty(t, query.Get("partial_response"), "the caller's query parameters should be left untouched")
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// readyURL is the endpoint on which Prometheus reports whether it's ready to
+// serve queries.
+const readyURL = "/-/ready"
+
+// CheckReady checks whether the Prometheus server at the given base URL is
+// ready to serve queries, using its /-/ready endpoint.  The headers, like the
+// path prefix and query parameters of the base URL, are the ones used for
+// queries (see NewGenericAPIClient).
+func CheckReady(ctx context.Context, client *http.Client, baseURL *url.URL, headers http.Header) error {
+	c := &httpAPIClient{client: client, baseURL: baseURL, headers: headers}
+	u := c.endpointURL(readyURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("error constructing HTTP request to Prometheus: %v", err)
+	}
+	for key, values := range headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the Prometheus server at %s isn't ready: %s", baseURL.Redacted(), resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// RequestLimiter bounds the number of concurrent requests, and the rate at
+// which they're started.  It's used to keep the relists of the series of many
+// rules from flooding Prometheus with simultaneous series requests.
+type RequestLimiter struct {
+	// slots is a semaphore of the concurrent requests, if limited
+	slots chan struct{}
+	// rateLimiter throttles requests, if limited
+	rateLimiter flowcontrol.RateLimiter
+}
+
+// NewRequestLimiter creates a RequestLimiter allowing at most maxConcurrent
+// concurrent requests, started at most at qps requests per second, with bursts
+// of up to burst requests.  A non-positive maxConcurrent or qps disables the
+// corresponding limit, and if both are disabled, nil is returned.  A nil
+// RequestLimiter never limits requests.
+func NewRequestLimiter(maxConcurrent int, qps float32, burst int) *RequestLimiter {
+	if maxConcurrent <= 0 && qps <= 0 {
+		return nil
+	}
+	l := &RequestLimiter{}
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+	if qps > 0 {
+		if burst < 1 {
+			burst = 1
+		}
+		l.rateLimiter = flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+	}
+	return l
+}
+
+// Acquire blocks until a request may be started, or the context is done.  On
+// success, the returned function must be called once the request completed.
+func (l *RequestLimiter) Acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	release := func() {}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+			release = func() { <-l.slots }
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if l.rateLimiter != nil {
+		if err := l.rateLimiter.Wait(ctx); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLimiterBoundsConcurrency(t *testing.T) {
+	limiter := NewRequestLimiter(2, 0, 0)
+
+	var running, maxRunning atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := limiter.Acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+
+			current := running.Add(1)
+			for {
+				seen := maxRunning.Load()
+				if current <= seen || maxRunning.CompareAndSwap(seen, current) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			running.Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(2), maxRunning.Load())
+}
+
+func TestRequestLimiterGivesUpWhenTheContextIsDone(t *testing.T) {
+	limiter := NewRequestLimiter(1, 0, 0)
+	release, err := limiter.Acquire(context.Background())
+	require.NoError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = limiter.Acquire(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRequestLimiterDisabled(t *testing.T) {
+	require.Nil(t, NewRequestLimiter(0, 0, 0))
+
+	var limiter *RequestLimiter
+	release, err := limiter.Acquire(context.Background())
+	require.NoError(t, err)
+	release()
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// RetryPolicy describes how requests failing with a transient error are retried.
+type RetryPolicy struct {
+	// MaxRetries is the number of times a failed request is retried.
+	MaxRetries int
+	// Backoff is the delay before the first retry, doubled (with some jitter)
+	// for each following one.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries, if set.
+	MaxBackoff time.Duration
+	// RetryOnCodes are the HTTP status codes of the responses which are retried.
+	// Errors connecting to Prometheus are always retried.
+	RetryOnCodes []int
+}
+
+// isTransient checks whether the given error is worth retrying, and counts
+// as a failure of Prometheus: connection errors and responses with one of
+// the given status codes.  Errors caused by the query itself, timeouts, and
+// cancelled requests aren't.
+func isTransient(err error, codes []int) bool {
+	if err == nil || errors.Is(err, context.Canceled) || IsTimeout(err) {
+		return false
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		// the request didn't reach Prometheus, or the connection was lost
+		return true
+	}
+	for _, code := range codes {
+		if apiErr.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// retryingClient is a GenericAPIClient retrying requests which fail with a
+// transient error.
+type retryingClient struct {
+	client GenericAPIClient
+	policy RetryPolicy
+}
+
+// WithRetries wraps the given client, retrying requests failing with a
+// transient error according to the given policy, so that short Prometheus
+// blips don't surface as metrics API failures.
+func WithRetries(client GenericAPIClient, policy RetryPolicy) GenericAPIClient {
+	if policy.MaxRetries <= 0 {
+		return client
+	}
+	return &retryingClient{
+		client: client,
+		policy: policy,
+	}
+}
+
+func (c *retryingClient) Do(ctx context.Context, verb, endpoint string, query url.Values) (APIResponse, error) {
+	backoff := wait.Backoff{
+		Duration: c.policy.Backoff,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    c.policy.MaxRetries,
+		Cap:      c.policy.MaxBackoff,
+	}
+	for attempt := 0; ; attempt++ {
+		res, err := c.client.Do(ctx, verb, endpoint, query)
+		if attempt >= c.policy.MaxRetries || !isTransient(err, c.policy.RetryOnCodes) {
+			return res, err
+		}
+
+		delay := backoff.Step()
+		klog.V(4).Infof("retrying Prometheus request to %s in %s after error: %v", endpoint, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return res, err
+		case <-timer.C:
+		}
+	}
+}
+
+// ErrCircuitOpen is returned, wrapped, for requests which weren't sent
+// because the circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreakerPolicy describes when requests to an unavailable Prometheus stop being sent.
+type CircuitBreakerPolicy struct {
+	// FailureThreshold is the number of consecutive transiently failing requests
+	// after which the breaker opens.
+	FailureThreshold int
+	// OpenDuration is the period for which requests fail immediately once the
+	// breaker has opened.  A single request is then let through, closing the
+	// breaker if it succeeds, or opening it again otherwise.
+	OpenDuration time.Duration
+	// FailureCodes are the HTTP status codes of the responses counted as
+	// failures.  Errors connecting to Prometheus are always counted.
+	FailureCodes []int
+}
+
+// circuitBreakerClient is a GenericAPIClient failing requests immediately
+// while Prometheus is considered unavailable.
+type circuitBreakerClient struct {
+	client GenericAPIClient
+	policy CircuitBreakerPolicy
+	now    func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	// openUntil is set while the breaker is open
+	openUntil time.Time
+	// probing is set while the single request let through after the breaker
+	// was open is in flight
+	probing bool
+}
+
+// WithCircuitBreaker wraps the given client, failing requests immediately with
+// ErrCircuitOpen for a while once Prometheus has failed repeatedly, so that a
+// struggling Prometheus isn't kept under load.
+func WithCircuitBreaker(client GenericAPIClient, policy CircuitBreakerPolicy) GenericAPIClient {
+	if policy.FailureThreshold <= 0 {
+		return client
+	}
+	return &circuitBreakerClient{
+		client: client,
+		policy: policy,
+		now:    time.Now,
+	}
+}
+
+// allow checks whether a request may be sent, and whether it probes the
+// state of Prometheus after the breaker was open.
+func (c *circuitBreakerClient) allow() (allowed bool, probe bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.openUntil.IsZero() {
+		return true, false
+	}
+	if c.probing || c.now().Before(c.openUntil) {
+		return false, false
+	}
+	c.probing = true
+	return true, true
+}
+
+// record updates the state of the breaker with the outcome of a request.
+func (c *circuitBreakerClient) record(err error, probe bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if probe {
+		c.probing = false
+	}
+	if !isTransient(err, c.policy.FailureCodes) {
+		if !c.openUntil.IsZero() {
+			klog.Info("Prometheus is available again, closing the circuit breaker")
+		}
+		c.failures = 0
+		c.openUntil = time.Time{}
+		return
+	}
+
+	c.failures++
+	if probe || c.failures >= c.policy.FailureThreshold {
+		if c.openUntil.IsZero() {
+			klog.Errorf("Prometheus failed %d consecutive requests, opening the circuit breaker for %s: %v", c.failures, c.policy.OpenDuration, err)
+		}
+		c.openUntil = c.now().Add(c.policy.OpenDuration)
+	}
+}
+
+func (c *circuitBreakerClient) Do(ctx context.Context, verb, endpoint string, query url.Values) (APIResponse, error) {
+	allowed, probe := c.allow()
+	if !allowed {
+		return APIResponse{}, fmt.Errorf("not sending request to Prometheus: %w", ErrCircuitOpen)
+	}
+	res, err := c.client.Do(ctx, verb, endpoint, query)
+	c.record(err, probe)
+	return res, err
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedClient is a GenericAPIClient returning the given errors in turn,
+// and succeeding once they're exhausted.
+type scriptedClient struct {
+	errs  []error
+	calls int
+}
+
+func (c *scriptedClient) Do(context.Context, string, string, url.Values) (APIResponse, error) {
+	c.calls++
+	if len(c.errs) == 0 {
+		return APIResponse{Status: ResponseSucceeded}, nil
+	}
+	err := c.errs[0]
+	c.errs = c.errs[1:]
+	return APIResponse{}, err
+}
+
+var (
+	errUnavailable = &Error{Type: ErrBadResponse, Msg: "unknown response code 502", StatusCode: http.StatusBadGateway}
+	errBadQuery    = &Error{Type: ErrBadData, Msg: "parse error", StatusCode: http.StatusBadRequest}
+)
+
+func TestWithRetries(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond, RetryOnCodes: []int{http.StatusBadGateway}}
+
+	inner := &scriptedClient{errs: []error{errUnavailable, errors.New("connection refused")}}
+	_, err := WithRetries(inner, policy).Do(context.Background(), http.MethodGet, queryURL, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, inner.calls)
+
+	inner = &scriptedClient{errs: []error{errUnavailable, errUnavailable, errUnavailable, errUnavailable}}
+	_, err = WithRetries(inner, policy).Do(context.Background(), http.MethodGet, queryURL, nil)
+	require.Equal(t, errUnavailable, err)
+	require.Equal(t, 3, inner.calls, "requests should be retried at most MaxRetries times")
+
+	inner = &scriptedClient{errs: []error{errBadQuery}}
+	_, err = WithRetries(inner, policy).Do(context.Background(), http.MethodGet, queryURL, nil)
+	require.Equal(t, errBadQuery, err)
+	require.Equal(t, 1, inner.calls, "errors caused by the query shouldn't be retried")
+
+	inner = &scriptedClient{errs: []error{context.DeadlineExceeded}}
+	_, err = WithRetries(inner, policy).Do(context.Background(), http.MethodGet, queryURL, nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 1, inner.calls, "timeouts shouldn't be retried")
+}
+
+func TestWithCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	inner := &scriptedClient{errs: []error{errUnavailable, errUnavailable}}
+	client := WithCircuitBreaker(inner, CircuitBreakerPolicy{
+		FailureThreshold: 2,
+		OpenDuration:     time.Minute,
+		FailureCodes:     []int{http.StatusBadGateway},
+	})
+	client.(*circuitBreakerClient).now = func() time.Time { return now }
+	do := func() error {
+		_, err := client.Do(context.Background(), http.MethodGet, queryURL, nil)
+		return err
+	}
+
+	// two consecutive failures open the breaker
+	require.Equal(t, errUnavailable, do())
+	require.Equal(t, errUnavailable, do())
+	require.ErrorIs(t, do(), ErrCircuitOpen)
+	require.Equal(t, 2, inner.calls, "requests shouldn't be sent while the breaker is open")
+
+	// a failing probe opens it again
+	now = now.Add(time.Minute)
+	inner.errs = []error{errUnavailable}
+	require.Equal(t, errUnavailable, do())
+	require.ErrorIs(t, do(), ErrCircuitOpen)
+	require.Equal(t, 3, inner.calls)
+
+	// a successful probe closes it
+	now = now.Add(time.Minute)
+	require.NoError(t, do())
+	require.NoError(t, do())
+	require.Equal(t, 5, inner.calls)
+
+	// errors caused by the queries don't open it
+	inner.errs = []error{errBadQuery, errBadQuery, errBadQuery}
+	for i := 0; i < 3; i++ {
+		require.Equal(t, errBadQuery, do())
+	}
+	require.NoError(t, do())
+}
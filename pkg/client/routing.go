@@ -0,0 +1,104 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/common/model"
+)
+
+type backendKey struct{}
+
+// WithBackend returns a context directing requests made through a routing
+// client (see NewRoutingClient) to the named backend.  An empty name refers to
+// the default backend.
+func WithBackend(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, backendKey{}, name)
+}
+
+// BackendFrom returns the name of the backend requests made with the given
+// context are directed to, or the empty string for the default backend.
+func BackendFrom(ctx context.Context) string {
+	name, _ := ctx.Value(backendKey{}).(string)
+	return name
+}
+
+// routingClient is a Client which directs each request to one of several
+// clients, based on the backend named in the request's context.
+type routingClient struct {
+	defaultClient Client
+	backends      map[string]Client
+}
+
+// NewRoutingClient returns a Client sending requests to the backend named in
+// their context (see WithBackend), or to the default client if none is named.
+// Requests naming an unknown backend fail.
+func NewRoutingClient(defaultClient Client, backends map[string]Client) Client {
+	if len(backends) == 0 {
+		return defaultClient
+	}
+	return &routingClient{
+		defaultClient: defaultClient,
+		backends:      backends,
+	}
+}
+
+func (c *routingClient) clientFor(ctx context.Context) (Client, error) {
+	name := BackendFrom(ctx)
+	if name == "" {
+		return c.defaultClient, nil
+	}
+	client, ok := c.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown Prometheus backend %q", name)
+	}
+	return client, nil
+}
+
+func (c *routingClient) Series(ctx context.Context, interval model.Interval, selectors ...Selector) ([]Series, error) {
+	client, err := c.clientFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.Series(ctx, interval, selectors...)
+}
+
+func (c *routingClient) LabelValues(ctx context.Context, label string, interval model.Interval, selectors ...Selector) ([]string, error) {
+	client, err := c.clientFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.LabelValues(ctx, label, interval, selectors...)
+}
+
+func (c *routingClient) Query(ctx context.Context, t model.Time, query Selector) (QueryResult, error) {
+	client, err := c.clientFor(ctx)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	return client.Query(ctx, t, query)
+}
+
+func (c *routingClient) QueryRange(ctx context.Context, r Range, query Selector) (QueryResult, error) {
+	client, err := c.clientFor(ctx)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	return client.QueryRange(ctx, r, query)
+}
@@ -0,0 +1,34 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import "context"
+
+type ruleKey struct{}
+
+// WithRule returns a context attributing the requests made with it to the
+// named rule, e.g. in metrics, so that slow rules can be pinned down.
+func WithRule(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, ruleKey{}, name)
+}
+
+// RuleFrom returns the name of the rule requests made with the given context
+// are attributed to, or the empty string if they aren't made for a rule.
+func RuleFrom(ctx context.Context) string {
+	name, _ := ctx.Value(ruleKey{}).(string)
+	return name
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+type seriesFilterKey struct{}
+
+// SeriesFilter decides whether a listed series is kept.
+type SeriesFilter func(series Series) bool
+
+// WithSeriesFilter returns a context in which the series listed through a
+// Client (see Client.Series) are only kept if accepted by the given filter.
+// The filter is applied as each series is decoded, so that the series which
+// are filtered out are never all held in memory at once.
+func WithSeriesFilter(ctx context.Context, filter SeriesFilter) context.Context {
+	if filter == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, seriesFilterKey{}, filter)
+}
+
+// SeriesFilterFrom returns the filter applied to the series listed with the
+// given context, or nil if all series are kept.
+func SeriesFilterFrom(ctx context.Context) SeriesFilter {
+	filter, _ := ctx.Value(seriesFilterKey{}).(SeriesFilter)
+	return filter
+}
+
+// decodeSeries decodes the given JSON array of series one series at a time,
+// only keeping the ones accepted by the given filter, if any.
+func decodeSeries(data []byte, filter SeriesFilter) ([]Series, error) {
+	return decodeSeriesFrom(json.NewDecoder(bytes.NewReader(data)), filter)
+}
+
+// decodeSeriesFrom decodes the next value of the given decoder, a JSON array
+// of series, one series at a time, only keeping the ones accepted by the
+// given filter, if any.
+func decodeSeriesFrom(decoder *json.Decoder, filter SeriesFilter) ([]Series, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		// a null list of series
+		return nil, nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("expected a list of series, got %v", token)
+	}
+
+	res := []Series{}
+	for decoder.More() {
+		var series Series
+		if err := decoder.Decode(&series); err != nil {
+			return nil, err
+		}
+		if filter == nil || filter(series) {
+			res = append(res, series)
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// decodeResponse decodes an API response from the given body.  If a filter
+// is given, the data of the response, a list of series, is decoded straight
+// from the body one series at a time, so that only the series accepted by the
+// filter are ever held in memory, rather than the whole response.
+func decodeResponse(body io.Reader, filter SeriesFilter) (APIResponse, error) {
+	var res APIResponse
+	if filter == nil {
+		err := json.NewDecoder(body).Decode(&res)
+		return res, err
+	}
+
+	decoder := json.NewDecoder(body)
+	if token, err := decoder.Token(); err != nil {
+		return res, err
+	} else if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return res, fmt.Errorf("expected a response object, got %v", token)
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return res, err
+		}
+		key, _ := token.(string)
+		switch key {
+		case "data":
+			series, err := decodeSeriesFrom(decoder, filter)
+			if err != nil {
+				return res, err
+			}
+			if res.Data, err = json.Marshal(series); err != nil {
+				return res, err
+			}
+		case "status":
+			err = decoder.Decode(&res.Status)
+		case "errorType":
+			err = decoder.Decode(&res.ErrorType)
+		case "error":
+			err = decoder.Decode(&res.Error)
+		case "warnings":
+			err = decoder.Decode(&res.Warnings)
+		default:
+			var ignored json.RawMessage
+			err = decoder.Decode(&ignored)
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+	_, err := decoder.Token()
+	return res, err
+}
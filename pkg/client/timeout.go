@@ -0,0 +1,64 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// timeoutClient is a Client cancelling queries which take longer than a timeout.
+type timeoutClient struct {
+	Client
+	timeout time.Duration
+}
+
+// WithQueryTimeout returns a Client cancelling instant and range queries
+// which take longer than the given timeout.  Prometheus is also asked to give
+// up on them past the timeout.  A non-positive timeout leaves queries
+// unbounded, except by the context they're made with.
+func WithQueryTimeout(client Client, timeout time.Duration) Client {
+	if timeout <= 0 {
+		return client
+	}
+	return &timeoutClient{Client: client, timeout: timeout}
+}
+
+func (c *timeoutClient) Query(ctx context.Context, t model.Time, query Selector) (QueryResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.Client.Query(ctx, t, query)
+}
+
+func (c *timeoutClient) QueryRange(ctx context.Context, r Range, query Selector) (QueryResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.Client.QueryRange(ctx, r, query)
+}
+
+// IsTimeout checks whether the given error comes from a query which timed
+// out, either in the adapter or in Prometheus.
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Type == ErrTimeout
+}
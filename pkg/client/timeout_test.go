@@ -0,0 +1,55 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithQueryTimeout(t *testing.T) {
+	var timeoutParam string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		timeoutParam = req.URL.Query().Get("timeout")
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	baseURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	client := WithQueryTimeout(NewClient(server.Client(), baseURL, nil, http.MethodGet), 100*time.Millisecond)
+
+	start := time.Now()
+	_, err = client.Query(context.Background(), 0, "up")
+	require.Error(t, err)
+	require.True(t, IsTimeout(err), "expected a timeout, got %v", err)
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.NotEmpty(t, timeoutParam)
+	require.NotContains(t, timeoutParam, "-", "Prometheus should be given the remaining time")
+
+	require.True(t, IsTimeout(&Error{Type: ErrTimeout, Msg: "query timed out in expression evaluation"}))
+	require.False(t, IsTimeout(&Error{Type: ErrBadData, Msg: "parse error"}))
+}
@@ -35,6 +35,8 @@ const (
 type Error struct {
 	Type ErrorType
 	Msg  string
+	// StatusCode is the HTTP status code of the response, if any.
+	StatusCode int
 }
 
 func (e *Error) Error() string {
@@ -60,4 +62,7 @@ type APIResponse struct {
 	ErrorType ErrorType `json:"errorType"`
 	// Error is the error message, if this is an error response.
 	Error string `json:"error"`
+	// Warnings are set when the request succeeded, but the results may be
+	// incomplete, e.g. when Thanos Query serves partial data.
+	Warnings []string `json:"warnings,omitempty"`
 }
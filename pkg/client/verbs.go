@@ -0,0 +1,118 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// Names of the endpoints of the Prometheus API whose verb can be overridden.
+const (
+	QueryEndpoint       = "query"
+	QueryRangeEndpoint  = "query_range"
+	SeriesEndpoint      = "series"
+	LabelValuesEndpoint = "label_values"
+)
+
+// endpoints are the names of the endpoints whose verb can be overridden.
+var endpoints = []string{QueryEndpoint, QueryRangeEndpoint, SeriesEndpoint, LabelValuesEndpoint}
+
+// Verbs are the HTTP verbs of the requests to each endpoint of the Prometheus
+// API.
+type Verbs struct {
+	// Default is the verb of the requests to endpoints without an override.
+	Default string
+	// Endpoints are the verbs of the requests to some endpoints, by name.
+	Endpoints map[string]string
+}
+
+// ParseVerbs returns the given default verb and per-endpoint overrides,
+// checking that they're supported.
+func ParseVerbs(defaultVerb string, overrides map[string]string) (Verbs, error) {
+	if err := checkVerb(defaultVerb); err != nil {
+		return Verbs{}, err
+	}
+	verbs := Verbs{Default: defaultVerb, Endpoints: make(map[string]string, len(overrides))}
+	for endpoint, verb := range overrides {
+		if !slices.Contains(endpoints, endpoint) {
+			return Verbs{}, fmt.Errorf("unknown Prometheus endpoint %q; supported endpoints: %s", endpoint, strings.Join(endpoints, ", "))
+		}
+		verb = strings.ToUpper(verb)
+		if err := checkVerb(verb); err != nil {
+			return Verbs{}, fmt.Errorf("%v for endpoint %q", err, endpoint)
+		}
+		verbs.Endpoints[endpoint] = verb
+	}
+	return verbs, nil
+}
+
+func checkVerb(verb string) error {
+	if verb != http.MethodGet && verb != http.MethodPost {
+		return fmt.Errorf("unsupported Prometheus HTTP verb %q; supported verbs: \"GET\" and \"POST\"", verb)
+	}
+	return nil
+}
+
+// For returns the verb of the requests to the given endpoint.
+func (v Verbs) For(endpoint string) string {
+	if verb, ok := v.Endpoints[endpoint]; ok {
+		return verb
+	}
+	return v.Default
+}
+
+// verbFallback sends the requests to the endpoints which rejected POST
+// requests, e.g. behind gateways only allowing GET requests, with GET.
+type verbFallback struct {
+	// rejectedPost holds the names of the endpoints which rejected a POST
+	// request
+	rejectedPost sync.Map
+}
+
+// do sends the given request to the given endpoint with the given verb,
+// falling back to GET if the endpoint rejects POST requests.
+func (f *verbFallback) do(ctx context.Context, api GenericAPIClient, verb, endpoint, path string, query url.Values) (APIResponse, error) {
+	if verb == http.MethodPost {
+		if _, rejected := f.rejectedPost.Load(endpoint); rejected {
+			verb = http.MethodGet
+		}
+	}
+	res, err := api.Do(ctx, verb, path, query)
+	if verb != http.MethodPost || !rejectsMethod(err) {
+		return res, err
+	}
+	if _, loaded := f.rejectedPost.LoadOrStore(endpoint, true); !loaded {
+		klog.Warningf("Prometheus rejected a POST request to %s (%v), sending the requests to the %s endpoint with GET from now on", path, err, endpoint)
+	}
+	return api.Do(ctx, http.MethodGet, path, query)
+}
+
+// rejectsMethod checks whether the given error comes from a response
+// rejecting the verb of the request.
+func rejectsMethod(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusMethodNotAllowed || apiErr.StatusCode == http.StatusNotImplemented)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVerbs(t *testing.T) {
+	verbs, err := ParseVerbs(http.MethodGet, map[string]string{SeriesEndpoint: "post"})
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPost, verbs.For(SeriesEndpoint))
+	require.Equal(t, http.MethodGet, verbs.For(QueryEndpoint))
+
+	_, err = ParseVerbs("PUT", nil)
+	require.ErrorContains(t, err, `unsupported Prometheus HTTP verb "PUT"`)
+	_, err = ParseVerbs(http.MethodGet, map[string]string{"labels": http.MethodPost})
+	require.ErrorContains(t, err, `unknown Prometheus endpoint "labels"`)
+	_, err = ParseVerbs(http.MethodGet, map[string]string{QueryEndpoint: "DELETE"})
+	require.ErrorContains(t, err, `for endpoint "query"`)
+}
+
+func TestRequestsFallBackToGetWhenPostIsRejected(t *testing.T) {
+	var mu sync.Mutex
+	methods := map[string][]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		methods[req.URL.Path] = append(methods[req.URL.Path], req.Method)
+		mu.Unlock()
+		if req.Method == http.MethodPost && req.URL.Path == "/api/v1/series" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Path == "/api/v1/series" {
+			_, _ = w.Write([]byte(`{"status":"success","data":[{"__name__":"up"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer server.Close()
+
+	baseURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	verbs, err := ParseVerbs(http.MethodGet, map[string]string{SeriesEndpoint: http.MethodPost, QueryEndpoint: http.MethodPost})
+	require.NoError(t, err)
+	client := NewClientForAPIWithVerbs(NewGenericAPIClient(server.Client(), baseURL, nil), verbs)
+
+	for i := 0; i < 2; i++ {
+		series, err := client.Series(context.Background(), model.Interval{}, "up")
+		require.NoError(t, err)
+		require.Len(t, series, 1)
+		_, err = client.Query(context.Background(), 0, "up")
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []string{http.MethodPost, http.MethodGet, http.MethodGet}, methods["/api/v1/series"])
+	require.Equal(t, []string{http.MethodPost, http.MethodPost}, methods["/api/v1/query"])
+}
@@ -5,6 +5,14 @@ import (
 )
 
 type MetricsDiscoveryConfig struct {
+	// Defaults holds the settings inherited by the rules and external rules
+	// which don't set them.  They're applied when the configuration is loaded.
+	Defaults *RuleDefaults `json:"defaults,omitempty" yaml:"defaults,omitempty"`
+	// RuleFiles are glob patterns of additional files holding rules and
+	// external rules, e.g. /etc/adapter/rules.d/*.yaml.  Relative patterns
+	// are relative to the directory of the configuration file.  Their rules
+	// are appended to those of the configuration file, in file name order.
+	RuleFiles []string `json:"ruleFiles,omitempty" yaml:"ruleFiles,omitempty"`
 	// Rules specifies how to discover and map Prometheus metrics to
 	// custom metrics API resources.  The rules are applied independently,
 	// and thus must be mutually exclusive.  Rules with the same SeriesQuery
@@ -17,9 +25,95 @@ type MetricsDiscoveryConfig struct {
 // DiscoveryRule describes a set of rules for transforming Prometheus metrics to/from
 // custom metrics API resources.
 type DiscoveryRule struct {
+	// ID optionally identifies the rule, so that it can be referred to elsewhere,
+	// e.g. to replace one of the default rules when merging configurations.
+	ID string `json:"id,omitempty" yaml:"id,omitempty"`
+	// PrometheusRef names the Prometheus backend (as configured with
+	// --prometheus-backend) on which series are discovered and queries are run.
+	// If empty, the default backend (--prometheus-url) is used.
+	PrometheusRef string `json:"prometheusRef,omitempty" yaml:"prometheusRef,omitempty"`
+	// PrometheusHeaders are extra HTTP headers sent with the series and metrics
+	// queries of this rule, e.g. X-Scope-OrgID to select a Cortex or Mimir tenant.
+	// They replace the headers of the same name set with --prometheus-header.
+	PrometheusHeaders map[string]string `json:"prometheusHeaders,omitempty" yaml:"prometheusHeaders,omitempty"`
+	// Namespaces optionally restricts the namespaces in which the metrics of
+	// this rule are served.  Series in other namespaces aren't discovered, and
+	// requests from other namespaces, or for root-scoped objects other than the
+	// allowed namespaces themselves, are answered as if the metric didn't exist.
+	Namespaces []string `json:"namespaces,omitempty" yaml:"namespaces,omitempty"`
+	// Access optionally restricts which users may read the metrics of this
+	// rule.  It's only enforced for external rules, and custom rules may not
+	// set it.
+	Access *AccessRule `json:"access,omitempty" yaml:"access,omitempty"`
 	// SeriesQuery specifies which metrics this rule should consider via a Prometheus query
-	// series selector query.
+	// series selector query.  It's ignored for static rules.
 	SeriesQuery string `json:"seriesQuery" yaml:"seriesQuery"`
+	// Static declares the series this rule exposes, instead of discovering them
+	// using SeriesQuery.  Static rules expose their metrics immediately, and don't
+	// add to the cost of relisting.
+	Static *StaticSeries `json:"static,omitempty" yaml:"static,omitempty"`
+	// Query, if set, makes an external rule query-only: it serves a single
+	// metric, named by Name.As, whose values are the results of the query,
+	// without relying on any series, e.g. to expose a PromQL expression which
+	// has no single underlying series.  It's a template like MetricsQuery,
+	// which it replaces, and it can't be combined with SeriesQuery, Static or
+	// Name.Matches.
+	Query string `json:"query,omitempty" yaml:"query,omitempty"`
+	// QueryLabels are the labels of the results of Query, listed along with
+	// the metric.  They default to the labels mapped in the resource overrides.
+	QueryLabels []string `json:"queryLabels,omitempty" yaml:"queryLabels,omitempty"`
+	// QueryParameters are the parameters of Query, referenced as `$<name>`,
+	// whose values are taken from the label of the same name of the metric
+	// selector of each request.  Unlike `.LabelValuesByName`, their values
+	// are checked before being substituted, so that requests can't change the
+	// expression itself.
+	QueryParameters []QueryParameter `json:"queryParameters,omitempty" yaml:"queryParameters,omitempty"`
+	// Discovery is how the series matching SeriesQuery are discovered: "series"
+	// (the default) lists them using the series API, and "labelValues" only lists
+	// their names using the label values API, which is much cheaper for rules
+	// matching a few metrics with many series each.
+	Discovery string `json:"discovery,omitempty" yaml:"discovery,omitempty"`
+	// DiscoveryLabels are the names of the labels carried by the series
+	// discovered using the label values API, from which the resources they
+	// describe are derived.  They default to the labels mapped in the rule's
+	// resource overrides.
+	DiscoveryLabels []string `json:"discoveryLabels,omitempty" yaml:"discoveryLabels,omitempty"`
+	// RelistInterval is the minimum interval between two discoveries of the
+	// series of this rule.  It defaults to --metrics-relist-interval, and is
+	// rounded up to a multiple of it.
+	RelistInterval pmodel.Duration `json:"relistInterval,omitempty" yaml:"relistInterval,omitempty"`
+	// MaxAge is how far back series are discovered.  It defaults to
+	// --metrics-max-age.
+	MaxAge pmodel.Duration `json:"maxAge,omitempty" yaml:"maxAge,omitempty"`
+	// LabelDrops are labels removed from the discovered series before they're
+	// associated with resources and named, e.g. the `id` and `name` labels
+	// cAdvisor adds to container metrics.  Series which only differ by those
+	// labels are merged.
+	LabelDrops []string `json:"labelDrops,omitempty" yaml:"labelDrops,omitempty"`
+	// SelectorLabels are the labels of the query results which are attached
+	// to the selector of the custom metric values returned for them, so that
+	// consumers can see which series each value comes from.  Only labels kept
+	// by the metrics query are available.
+	SelectorLabels []string `json:"selectorLabels,omitempty" yaml:"selectorLabels,omitempty"`
+	// DuplicateSamples is how several samples returned by the metrics query
+	// for the same object, e.g. because it isn't aggregated by the resource
+	// label, are handled: `last` (the default) keeps the last one, `sum`,
+	// `max` and `min` combine them, and `error` fails the request.  Duplicates
+	// are logged and counted in all cases.  It only applies to custom metrics.
+	DuplicateSamples DuplicateSamplesPolicy `json:"duplicateSamples,omitempty" yaml:"duplicateSamples,omitempty"`
+	// MissingDataPolicy is how external metrics whose query returns no
+	// samples, e.g. a rate over a window without any, are served: by default
+	// with no values, with `zero` as a single value of 0, so that HPAs scale
+	// on it rather than failing, and with `notfound` as a not found error.
+	// It only applies to external metrics.
+	MissingDataPolicy MissingDataPolicy `json:"missingDataPolicy,omitempty" yaml:"missingDataPolicy,omitempty"`
+	// Limits, if set, override the limits on the cost of the series listed
+	// and the queries run for the rule set by the adapter flags.
+	Limits *QueryLimits `json:"limits,omitempty" yaml:"limits,omitempty"`
+	// ValueFilter, if set, only registers the discovered metrics for which a
+	// test query returns samples, so that metrics whose series still exist
+	// but no longer receive samples aren't advertised.
+	ValueFilter *ValueFilter `json:"valueFilter,omitempty" yaml:"valueFilter,omitempty"`
 	// SeriesFilters specifies additional regular expressions to be applied on
 	// the series names returned from the query.  This is useful for constraints
 	// that can't be represented in the SeriesQuery (e.g. series matching `container_.+`
@@ -29,6 +123,13 @@ type DiscoveryRule struct {
 	// Resources specifies how associated Kubernetes resources should be discovered for
 	// the given metrics.
 	Resources ResourceMapping `json:"resources" yaml:"resources"`
+	// Target, if set to `namespace`, only exposes the metrics of the rule on
+	// namespaces (i.e. /namespaces/<namespace>/metrics/<metric>), whatever
+	// other resources their series are associated with, e.g. for queries
+	// aggregating the series of a whole namespace.  The metrics query must
+	// match the label mapped to namespaces, and the rule can't have identity
+	// labels.  It only applies to custom metrics.
+	Target RuleTarget `json:"target,omitempty" yaml:"target,omitempty"`
 	// Name specifies how the metric name should be transformed between custom metric
 	// API resources, and Prometheus metric names.
 	Name NameMapping `json:"name" yaml:"name"`
@@ -38,6 +139,70 @@ type DiscoveryRule struct {
 	// `.GroupBy` is the comma-separated expected group-by label names. The delimeters
 	// are `<<` and `>>`.
 	MetricsQuery string `json:"metricsQuery,omitempty" yaml:"metricsQuery,omitempty"`
+	// Window is made available to the metrics query as `.Window`, e.g. for use as
+	// the range of a rate.  It defaults to 5m.
+	Window pmodel.Duration `json:"window,omitempty" yaml:"window,omitempty"`
+	// QueryType is the kind of query run to fetch the metric's values: "instant"
+	// (the default), or "range" for a range query covering the rule's window.
+	// Range queries avoid empty results when instant queries fall in gaps
+	// between infrequent scrapes.
+	QueryType string `json:"queryType,omitempty" yaml:"queryType,omitempty"`
+	// Step is the resolution of range queries.  It defaults to 1m.
+	Step pmodel.Duration `json:"step,omitempty" yaml:"step,omitempty"`
+	// RangeAggregation is how the samples of each series returned by a range
+	// query are reduced to a single value: "last" (the default, i.e. the most
+	// recent one), "avg", "max" or "min".
+	RangeAggregation string `json:"rangeAggregation,omitempty" yaml:"rangeAggregation,omitempty"`
+	// HistogramQuantile, if set, turns the histogram `_bucket` series matched
+	// by the rule into metrics holding the given quantile, between 0 and 1.
+	// The name and metrics query default to `<histogram>_p<percentile>` (e.g.
+	// `http_request_duration_seconds_p95`) and a `histogram_quantile` of the
+	// rate of the buckets over the rule's window.
+	HistogramQuantile *float64 `json:"histogramQuantile,omitempty" yaml:"histogramQuantile,omitempty"`
+	// Unit is the unit of the values of the series, which are converted into
+	// its base unit before being served: durations (e.g. "milliseconds") into
+	// seconds, sizes (e.g. "kibibytes") into bytes, served with binary
+	// suffixes (e.g. 128Mi), and "percent" into ratios.
+	Unit string `json:"unit,omitempty" yaml:"unit,omitempty"`
+	// Scale multiplies the values of the metrics, after converting their
+	// unit, e.g. 0.001 to serve a value in thousands.
+	Scale float64 `json:"scale,omitempty" yaml:"scale,omitempty"`
+}
+
+const (
+	// SeriesDiscovery discovers series using the series API.
+	SeriesDiscovery = "series"
+	// LabelValuesDiscovery discovers series names using the label values API.
+	LabelValuesDiscovery = "labelValues"
+)
+
+const (
+	// InstantQueryType runs instant queries.
+	InstantQueryType = "instant"
+	// RangeQueryType runs range queries.
+	RangeQueryType = "range"
+)
+
+// StaticSeries declares the series exposed by a static rule.
+type StaticSeries struct {
+	// Names are the names of the Prometheus series.  They're filtered and
+	// named like discovered series.
+	Names []string `json:"names" yaml:"names"`
+	// Labels are the names of the labels carried by the series, from which the
+	// resources they describe are derived, like for discovered series.  They
+	// default to the labels mapped in the rule's resource overrides.
+	Labels []string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// QueryParameter is a parameter of the query of a query-only rule.
+type QueryParameter struct {
+	// Name is the name of the parameter, referenced as `$<name>` in the
+	// query, and the label of the metric selector setting its value.
+	Name string `json:"name" yaml:"name"`
+	// Pattern is the regular expression values of the parameter must fully
+	// match.  It defaults to `[a-zA-Z0-9_.:-]+`.  Values containing quotes,
+	// backslashes or line breaks are always rejected.
+	Pattern string `json:"pattern,omitempty" yaml:"pattern,omitempty"`
 }
 
 // RegexFilter is a filter that matches positively or negatively against a regex.
@@ -47,6 +212,17 @@ type RegexFilter struct {
 	IsNot string `json:"isNot,omitempty" yaml:"isNot,omitempty"`
 }
 
+// AccessRule lists the users allowed to read the metrics of a rule.  A user is
+// allowed if they're listed in Users, or are a member of one of Groups.
+type AccessRule struct {
+	// Users lists the names of the users allowed, e.g.
+	// system:serviceaccount:kube-system:horizontal-pod-autoscaler.
+	Users []string `json:"users,omitempty" yaml:"users,omitempty"`
+	// Groups lists the groups whose members are allowed, e.g.
+	// system:serviceaccounts:team-a.
+	Groups []string `json:"groups,omitempty" yaml:"groups,omitempty"`
+}
+
 // ResourceMapping specifies how to map Kubernetes resources to Prometheus labels
 type ResourceMapping struct {
 	// Template specifies a golang string template for converting a Kubernetes
@@ -58,16 +234,81 @@ type ResourceMapping struct {
 	// Overrides specifies exceptions to the above template, mapping label names
 	// to group-resources
 	Overrides map[string]GroupResource `json:"overrides,omitempty" yaml:"overrides,omitempty"`
+	// ObjectLabels maps the labels of Kubernetes objects to the series labels
+	// holding their values, e.g. `app: label_app` for series joined with
+	// kube_pod_labels.  When selector pushdown is enabled, requests for the
+	// objects matching a label selector on these labels are answered with a
+	// single query on the series labels, without listing the objects.
+	ObjectLabels map[string]string `json:"objectLabels,omitempty" yaml:"objectLabels,omitempty"`
+	// IdentityLabels are series labels which, along with the resource labels,
+	// identify what each value describes, e.g. `container` for per-container
+	// pod metrics.  They're added to the group-by clause of the metrics query,
+	// and attached to the selector of the custom metric values, so that each
+	// object may have a value per combination of their values, which can be
+	// selected using a metric label selector.
+	IdentityLabels []string `json:"identityLabels,omitempty" yaml:"identityLabels,omitempty"`
 	// Namespaced ignores the source namespace of the requester and requires one in the query
 	Namespaced *bool `json:"namespaced,omitempty" yaml:"namespaced,omitempty"`
+	// NamespaceLabelName is the label matched against the namespace of the
+	// requester by the queries of external rules, e.g. `kubernetes_namespace`.
+	// It defaults to the label mapped to namespaces.
+	NamespaceLabelName string `json:"namespaceLabelName,omitempty" yaml:"namespaceLabelName,omitempty"`
+	// Association joins series lacking the labels which identify their resources
+	// with another query providing them, such as kube_pod_info.
+	Association *Association `json:"association,omitempty" yaml:"association,omitempty"`
+}
+
+// ValueFilter describes the test query run, on every relist, for each
+// series name discovered by a rule.
+type ValueFilter struct {
+	// Query is a golang string template producing the test query, where
+	// `.Series` is the selector of the series of that name matching the series
+	// query, and `.Window` the window of the rule.  The metric is only
+	// registered if the query returns at least one sample.  It must return an
+	// instant vector.  It
+	// defaults to `count(count_over_time(<<.Series>>[<<.Window>>]))`, i.e.
+	// the series must have received samples within the window.  The
+	// delimiters are `<<` and `>>`.
+	Query string `json:"query,omitempty" yaml:"query,omitempty"`
+}
+
+// Association describes how to join series with a query providing the labels
+// which identify their resources.  The metrics query of the rule is grouped by
+// the On labels, and then joined with the association query using group_left.
+type Association struct {
+	// Query is a golang string template producing the query to join with.  It
+	// may use the same fields as the metrics query, except that LabelMatchers
+	// only contains the matchers on the associated labels.  The delimiters are
+	// `<<` and `>>`.
+	Query string `json:"query" yaml:"query"`
+	// On lists the labels shared by the series and the association query,
+	// on which they're joined.
+	On []string `json:"on" yaml:"on"`
+	// Labels lists the labels added to the series by the association query,
+	// which are used to identify resources, like any series label.
+	Labels []string `json:"labels" yaml:"labels"`
 }
 
 // GroupResource represents a Kubernetes group-resource.
 type GroupResource struct {
 	Group    string `json:"group,omitempty" yaml:"group,omitempty"`
 	Resource string `json:"resource" yaml:"resource"`
+	// Scope is the scope of the resource, either `Namespaced` or `Cluster`.
+	// It defaults to the scope known to the API server, so it only needs
+	// to be set for custom resources the adapter can't discover properly.
+	Scope ResourceScope `json:"scope,omitempty" yaml:"scope,omitempty"`
 }
 
+// ResourceScope is the scope of a Kubernetes resource.
+type ResourceScope string
+
+const (
+	// NamespaceScoped resources are found in namespaces.
+	NamespaceScoped ResourceScope = "Namespaced"
+	// ClusterScoped resources don't belong to any namespace.
+	ClusterScoped ResourceScope = "Cluster"
+)
+
 // NameMapping specifies how to convert Prometheus metrics
 // to/from custom metrics API resources.
 type NameMapping struct {
@@ -88,9 +329,86 @@ type NameMapping struct {
 type ResourceRules struct {
 	CPU    ResourceRule `json:"cpu" yaml:"cpu"`
 	Memory ResourceRule `json:"memory" yaml:"memory"`
-	// Window is the window size reported by the resource metrics API.  It should match the value used
-	// in your containerQuery and nodeQuery if you use a `rate` function.
+	// Window is the window size reported by the resource metrics API, unless overridden for CPU or
+	// memory.  It's made available to containerQuery and nodeQuery as `.Window`, and should match the
+	// value used in them if you use a `rate` function.  If unset, it's taken from the range used in the
+	// queries, if any.
 	Window pmodel.Duration `json:"window" yaml:"window"`
+	// Variants are alternative rules for the nodes matching their node selector, e.g. Windows nodes,
+	// whose metrics come from windows_exporter rather than cAdvisor.
+	Variants []ResourceRulesVariant `json:"variants,omitempty" yaml:"variants,omitempty"`
+	// ExtraResources are the rules for resources other than CPU and memory, keyed by resource name
+	// (e.g. `ephemeral-storage` or `nvidia.com/gpu`).  Their usage is reported alongside CPU and
+	// memory usage for the pods and nodes the queries return values for.
+	ExtraResources map[string]ResourceRule `json:"extraResources,omitempty" yaml:"extraResources,omitempty"`
+	// NodeIdentifier is what the values of the node label of node queries identify nodes by: their
+	// name (the default), their `InternalIP` address, optionally followed by a port (as in the
+	// `instance` label of node_exporter), or their `ProviderID`.
+	NodeIdentifier NodeIdentifier `json:"nodeIdentifier,omitempty" yaml:"nodeIdentifier,omitempty"`
+}
+
+// RuleTarget is the kind of objects the metrics of a rule are exposed on.
+type RuleTarget string
+
+// NamespaceTarget exposes metrics on namespaces only.
+const NamespaceTarget RuleTarget = "namespace"
+
+// QueryLimits bound the cost of the series listed and the queries run for a
+// rule.  Unset limits are inherited from the adapter flags, and negative
+// ones disable them.
+type QueryLimits struct {
+	// MaxSeries is the maximum number of series the series query may match.
+	// Relists fail when it matches more, and the series discovered by the
+	// previous relist keep being served.
+	MaxSeries int `json:"maxSeries,omitempty" yaml:"maxSeries,omitempty"`
+	// MaxSamples is the maximum number of samples the metrics query may
+	// return.  Requests for which it returns more fail.
+	MaxSamples int `json:"maxSamples,omitempty" yaml:"maxSamples,omitempty"`
+	// MaxRegexLength is the maximum length of the regular expressions of
+	// the label matchers of the metrics query, e.g. the one matching the
+	// names of the requested objects.  Requests exceeding it fail without
+	// running the query.
+	MaxRegexLength int `json:"maxRegexLength,omitempty" yaml:"maxRegexLength,omitempty"`
+}
+
+// MissingDataPolicy is how external metrics without any samples are served.
+type MissingDataPolicy string
+
+const (
+	MissingDataZero     MissingDataPolicy = "zero"
+	MissingDataNotFound MissingDataPolicy = "notfound"
+)
+
+// DuplicateSamplesPolicy is how several samples for the same object are handled.
+type DuplicateSamplesPolicy string
+
+const (
+	DuplicateSamplesLast  DuplicateSamplesPolicy = "last"
+	DuplicateSamplesSum   DuplicateSamplesPolicy = "sum"
+	DuplicateSamplesMax   DuplicateSamplesPolicy = "max"
+	DuplicateSamplesMin   DuplicateSamplesPolicy = "min"
+	DuplicateSamplesError DuplicateSamplesPolicy = "error"
+)
+
+// NodeIdentifier is a property of nodes identifying them in node queries.
+type NodeIdentifier string
+
+const (
+	NodeIdentifierName       NodeIdentifier = "Name"
+	NodeIdentifierInternalIP NodeIdentifier = "InternalIP"
+	NodeIdentifierProviderID NodeIdentifier = "ProviderID"
+)
+
+// ResourceRulesVariant describes how to query resource metrics for the nodes matching a node
+// selector, and the pods running on them.
+type ResourceRulesVariant struct {
+	// NodeSelector selects the nodes the variant applies to by their labels,
+	// e.g. `kubernetes.io/os: windows`.
+	NodeSelector map[string]string `json:"nodeSelector" yaml:"nodeSelector"`
+	CPU          ResourceRule      `json:"cpu" yaml:"cpu"`
+	Memory       ResourceRule      `json:"memory" yaml:"memory"`
+	// Window defaults to the window of the resource rules.
+	Window pmodel.Duration `json:"window,omitempty" yaml:"window,omitempty"`
 }
 
 // ResourceRule describes how to query metrics for some particular
@@ -108,4 +426,6 @@ type ResourceRule struct {
 	// ContainerLabel indicates the name of the Prometheus label containing the container name
 	// (since "container" is not a resource, this can't go in the `resources` block, but is similar).
 	ContainerLabel string `json:"containerLabel" yaml:"containerLabel"`
+	// Window, if set, overrides the window of the resource rules for this resource.
+	Window pmodel.Duration `json:"window,omitempty" yaml:"window,omitempty"`
 }
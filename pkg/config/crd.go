@@ -0,0 +1,44 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// The PrometheusAdapterRule custom resource lets discovery rules be shipped
+// alongside applications, instead of being added to the central configuration
+// file.  See deploy/manifests/custom-resource-definition-rules.yaml.
+const (
+	RuleGroup    = "metrics.sigs.k8s.io"
+	RuleVersion  = "v1alpha1"
+	RuleResource = "prometheusadapterrules"
+	RuleKind     = "PrometheusAdapterRule"
+)
+
+// RuleSpec is the spec of a PrometheusAdapterRule object.  The rules have the
+// same format as in the configuration file.
+type RuleSpec struct {
+	// Rules are added to the rules of the custom metrics API.
+	Rules []DiscoveryRule `json:"rules,omitempty"`
+	// ExternalRules are added to the rules of the external metrics API.
+	ExternalRules []DiscoveryRule `json:"externalRules,omitempty"`
+}
+
+// RuleSpecFromUnstructured converts the spec of a PrometheusAdapterRule object,
+// as found in its unstructured content, to a RuleSpec.  Unknown fields are
+// rejected, like in the configuration file.
+func RuleSpecFromUnstructured(spec map[string]interface{}) (*RuleSpec, error) {
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse rule spec: %v", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	var res RuleSpec
+	if err := decoder.Decode(&res); err != nil {
+		return nil, fmt.Errorf("unable to parse rule spec: %v", err)
+	}
+	return &res, nil
+}
@@ -0,0 +1,61 @@
+package config
+
+// RuleDefaults holds the settings inherited by the rules of a configuration
+// file which don't set them themselves.
+type RuleDefaults struct {
+	// Resources is inherited field by field: the template, namespacing and
+	// association are used by rules which don't set theirs, and the overrides
+	// are added to those of each rule, which take precedence for the same label.
+	Resources ResourceMapping `json:"resources,omitempty" yaml:"resources,omitempty"`
+	// MetricsQuery is used by rules which don't set theirs.
+	MetricsQuery string `json:"metricsQuery,omitempty" yaml:"metricsQuery,omitempty"`
+	// SeriesFilters are used by rules which don't set any.  Rules can opt out
+	// by setting an empty list.
+	SeriesFilters []RegexFilter `json:"seriesFilters,omitempty" yaml:"seriesFilters,omitempty"`
+}
+
+// applyDefaults fills in the settings of the rules and external rules of the
+// configuration from its defaults, if any.
+func (c *MetricsDiscoveryConfig) applyDefaults() {
+	if c.Defaults == nil {
+		return
+	}
+	for i := range c.Rules {
+		c.Rules[i] = c.Defaults.apply(c.Rules[i])
+	}
+	for i := range c.ExternalRules {
+		c.ExternalRules[i] = c.Defaults.apply(c.ExternalRules[i])
+	}
+}
+
+// apply returns the given rule, with the settings it doesn't set taken from
+// the defaults.
+func (d *RuleDefaults) apply(rule DiscoveryRule) DiscoveryRule {
+	if rule.MetricsQuery == "" {
+		rule.MetricsQuery = d.MetricsQuery
+	}
+	if rule.SeriesFilters == nil && d.SeriesFilters != nil {
+		rule.SeriesFilters = append([]RegexFilter(nil), d.SeriesFilters...)
+	}
+
+	if rule.Resources.Template == "" {
+		rule.Resources.Template = d.Resources.Template
+	}
+	if rule.Resources.Namespaced == nil {
+		rule.Resources.Namespaced = d.Resources.Namespaced
+	}
+	if rule.Resources.Association == nil {
+		rule.Resources.Association = d.Resources.Association
+	}
+	if len(d.Resources.Overrides) > 0 {
+		overrides := make(map[string]GroupResource, len(d.Resources.Overrides)+len(rule.Resources.Overrides))
+		for label, resource := range d.Resources.Overrides {
+			overrides[label] = resource
+		}
+		for label, resource := range rule.Resources.Overrides {
+			overrides[label] = resource
+		}
+		rule.Resources.Overrides = overrides
+	}
+	return rule
+}
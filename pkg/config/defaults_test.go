@@ -0,0 +1,56 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRulesInheritDefaults(t *testing.T) {
+	cfg, err := FromYAML([]byte(`
+defaults:
+  resources:
+    overrides:
+      namespace: {resource: namespace}
+      pod: {resource: pod}
+  metricsQuery: sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)
+  seriesFilters:
+  - isNot: ^go_.*
+rules:
+- seriesQuery: '{namespace!="",pod!=""}'
+- seriesQuery: '{namespace!="",service!=""}'
+  resources:
+    overrides:
+      service: {resource: service}
+      pod: {group: apps, resource: deployment}
+  metricsQuery: sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)
+  seriesFilters: []
+externalRules:
+- seriesQuery: '{queue!=""}'
+`))
+	require.NoError(t, err)
+
+	require.Equal(t, DiscoveryRule{
+		SeriesQuery: `{namespace!="",pod!=""}`,
+		Resources: ResourceMapping{Overrides: map[string]GroupResource{
+			"namespace": {Resource: "namespace"},
+			"pod":       {Resource: "pod"},
+		}},
+		MetricsQuery:  `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+		SeriesFilters: []RegexFilter{{IsNot: "^go_.*"}},
+	}, cfg.Rules[0])
+
+	require.Equal(t, DiscoveryRule{
+		SeriesQuery: `{namespace!="",service!=""}`,
+		Resources: ResourceMapping{Overrides: map[string]GroupResource{
+			"namespace": {Resource: "namespace"},
+			"pod":       {Group: "apps", Resource: "deployment"},
+			"service":   {Resource: "service"},
+		}},
+		MetricsQuery:  `sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)`,
+		SeriesFilters: []RegexFilter{},
+	}, cfg.Rules[1])
+
+	require.Equal(t, `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`, cfg.ExternalRules[0].MetricsQuery)
+	require.Len(t, cfg.ExternalRules[0].Resources.Overrides, 2)
+}
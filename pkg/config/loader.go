@@ -4,12 +4,64 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
-// FromFile loads the configuration from a particular file.
+// FromFile loads the configuration from a particular file, along with the
+// rules of the rule files it references.
 func FromFile(filename string) (*MetricsDiscoveryConfig, error) {
+	cfg, err := fromFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.RuleFiles) == 0 {
+		return cfg, nil
+	}
+
+	var paths []string
+	for _, pattern := range ResolveRuleFiles(filename, cfg.RuleFiles) {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule files pattern %q: %v", pattern, err)
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+	for _, path := range paths {
+		ruleFile, err := fromFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load rule file %s: %v", path, err)
+		}
+		if ruleFile.ResourceRules != nil || len(ruleFile.RuleFiles) > 0 {
+			return nil, fmt.Errorf("rule file %s may only contain rules, externalRules and defaults", path)
+		}
+		// the defaults of the configuration file apply on top of those of the rule file
+		ruleFile.Defaults = cfg.Defaults
+		ruleFile.applyDefaults()
+		cfg.Rules = append(cfg.Rules, ruleFile.Rules...)
+		cfg.ExternalRules = append(cfg.ExternalRules, ruleFile.ExternalRules...)
+	}
+	return cfg, nil
+}
+
+// ResolveRuleFiles returns the given rule file patterns, with the relative
+// ones resolved against the directory of the given configuration file.
+func ResolveRuleFiles(filename string, patterns []string) []string {
+	res := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		if filepath.IsAbs(pattern) {
+			res[i] = pattern
+		} else {
+			res[i] = filepath.Join(filepath.Dir(filename), pattern)
+		}
+	}
+	return res
+}
+
+func fromFile(filename string) (*MetricsDiscoveryConfig, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("unable to load metrics discovery config file: %v", err)
@@ -28,5 +80,6 @@ func FromYAML(contents []byte) (*MetricsDiscoveryConfig, error) {
 	if err := yaml.UnmarshalStrict(contents, &cfg); err != nil {
 		return nil, fmt.Errorf("unable to parse metrics discovery config: %v", err)
 	}
+	cfg.applyDefaults()
 	return &cfg, nil
 }
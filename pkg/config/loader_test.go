@@ -0,0 +1,60 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromFileIncludesRuleFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "rules.d"), 0o700))
+	writeFile := func(name, contents string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o600))
+	}
+	writeFile("config.yaml", `
+ruleFiles:
+- rules.d/*.yaml
+defaults:
+  metricsQuery: sum(<<.Series>>{<<.LabelMatchers>>})
+rules:
+- seriesQuery: '{namespace!=""}'
+`)
+	writeFile("rules.d/b.yaml", `
+externalRules:
+- seriesQuery: '{queue!=""}'
+`)
+	writeFile("rules.d/a.yaml", `
+defaults:
+  metricsQuery: max(<<.Series>>{<<.LabelMatchers>>})
+rules:
+- seriesQuery: '{pod!=""}'
+- seriesQuery: '{service!=""}'
+  metricsQuery: min(<<.Series>>{<<.LabelMatchers>>})
+`)
+	writeFile("rules.d/ignored.txt", `not: yaml`)
+
+	cfg, err := FromFile(filepath.Join(dir, "config.yaml"))
+	require.NoError(t, err)
+
+	var queries []string
+	for _, rule := range cfg.Rules {
+		queries = append(queries, rule.SeriesQuery+" "+rule.MetricsQuery)
+	}
+	require.Equal(t, []string{
+		`{namespace!=""} sum(<<.Series>>{<<.LabelMatchers>>})`,
+		`{pod!=""} max(<<.Series>>{<<.LabelMatchers>>})`,
+		`{service!=""} min(<<.Series>>{<<.LabelMatchers>>})`,
+	}, queries)
+	require.Len(t, cfg.ExternalRules, 1)
+	require.Equal(t, `sum(<<.Series>>{<<.LabelMatchers>>})`, cfg.ExternalRules[0].MetricsQuery)
+
+	writeFile("rules.d/c.yaml", `
+ruleFiles:
+- other/*.yaml
+`)
+	_, err = FromFile(filepath.Join(dir, "config.yaml"))
+	require.ErrorContains(t, err, "may only contain rules, externalRules and defaults")
+}
@@ -0,0 +1,45 @@
+package config
+
+// Merge layers the overrides configuration on top of the base configuration,
+// returning the result.  Rules in the overrides which share an ID with a rule
+// in the base replace that rule in place, while all other rules are appended.
+// Resource rules from the overrides, if present, replace those from the base.
+// Neither argument is modified.
+func Merge(base, overrides *MetricsDiscoveryConfig) *MetricsDiscoveryConfig {
+	res := &MetricsDiscoveryConfig{
+		Rules:         mergeRules(base.Rules, overrides.Rules),
+		ResourceRules: base.ResourceRules,
+		ExternalRules: mergeRules(base.ExternalRules, overrides.ExternalRules),
+	}
+	if overrides.ResourceRules != nil {
+		res.ResourceRules = overrides.ResourceRules
+	}
+	return res
+}
+
+// mergeRules replaces rules in base with the rules from overrides having the
+// same ID, and appends the remaining rules from overrides.
+func mergeRules(base, overrides []DiscoveryRule) []DiscoveryRule {
+	if len(base) == 0 && len(overrides) == 0 {
+		return nil
+	}
+
+	res := make([]DiscoveryRule, len(base), len(base)+len(overrides))
+	copy(res, base)
+
+	indexByID := make(map[string]int, len(base))
+	for i, rule := range base {
+		if rule.ID != "" {
+			indexByID[rule.ID] = i
+		}
+	}
+
+	for _, rule := range overrides {
+		if i, ok := indexByID[rule.ID]; ok && rule.ID != "" {
+			res[i] = rule
+			continue
+		}
+		res = append(res, rule)
+	}
+	return res
+}
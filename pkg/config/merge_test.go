@@ -0,0 +1,50 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeOverridesRulesByID(t *testing.T) {
+	base := &MetricsDiscoveryConfig{
+		Rules: []DiscoveryRule{
+			{ID: "gauge", SeriesQuery: `{namespace!=""}`},
+			{ID: "rate", SeriesQuery: `{namespace!="",__name__=~".*_total"}`},
+			{SeriesQuery: `{pod!=""}`},
+		},
+		ResourceRules: &ResourceRules{Window: 60},
+	}
+	overrides := &MetricsDiscoveryConfig{
+		Rules: []DiscoveryRule{
+			{ID: "rate", SeriesQuery: `{namespace!="",__name__=~".*_count"}`},
+			{ID: "custom", SeriesQuery: `{service!=""}`},
+			{SeriesQuery: `{node!=""}`},
+		},
+		ExternalRules: []DiscoveryRule{
+			{SeriesQuery: `{queue!=""}`},
+		},
+	}
+
+	merged := Merge(base, overrides)
+
+	require.Equal(t, []DiscoveryRule{
+		{ID: "gauge", SeriesQuery: `{namespace!=""}`},
+		{ID: "rate", SeriesQuery: `{namespace!="",__name__=~".*_count"}`},
+		{SeriesQuery: `{pod!=""}`},
+		{ID: "custom", SeriesQuery: `{service!=""}`},
+		{SeriesQuery: `{node!=""}`},
+	}, merged.Rules)
+	require.Equal(t, overrides.ExternalRules, merged.ExternalRules)
+	require.Equal(t, base.ResourceRules, merged.ResourceRules)
+
+	// the base config should be left untouched
+	require.Equal(t, `{namespace!="",__name__=~".*_total"}`, base.Rules[1].SeriesQuery)
+}
+
+func TestMergeReplacesResourceRules(t *testing.T) {
+	base := &MetricsDiscoveryConfig{ResourceRules: &ResourceRules{Window: 60}}
+	overrides := &MetricsDiscoveryConfig{ResourceRules: &ResourceRules{Window: 120}}
+
+	require.Equal(t, overrides.ResourceRules, Merge(base, overrides).ResourceRules)
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	config "sigs.k8s.io/prometheus-adapter/cmd/config-gen/utils"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	adaptercfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+)
+
+func BenchmarkPlanForMetric(b *testing.B) {
+	names := make([]string, 100)
+	for i := range names {
+		names[i] = fmt.Sprintf("pod-%d", i)
+	}
+	info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_usage"}
+
+	for _, cacheSize := range []int{0, 1024} {
+		b.Run(fmt.Sprintf("cache=%d", cacheSize), func(b *testing.B) {
+			registry := &basicSeriesRegistry{mapper: restMapper(), plans: newPlanCache(cacheSize)}
+			if err := registry.SetSeries(seriesRegistryTestSeries, setupBenchmarkNamers(b)); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, found := registry.PlanForMetric(info, "somens", labels.Everything(), names...); !found {
+					b.Fatal("metric not found")
+				}
+			}
+		})
+	}
+}
+
+func setupBenchmarkNamers(b *testing.B) []naming.MetricNamer {
+	namers, err := naming.NamersFromConfig(config.DefaultConfig(time.Minute, "kube_").Rules, restMapper())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return namers
+}
+
+func BenchmarkSetSeries(b *testing.B) {
+	namers, err := naming.NamersFromConfig([]adaptercfg.DiscoveryRule{
+		{
+			SeriesQuery:  `{__name__=~"^container_.*",namespace!="",pod!=""}`,
+			Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+			Name:         adaptercfg.NameMapping{Matches: "^container_(.*)_total$", As: "${1}_per_second"},
+			MetricsQuery: `sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)`,
+		},
+	}, restMapper())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// 100k series of 1000 metrics, spread over 100 namespaces
+	series := make([]prom.Series, 100000)
+	for i := range series {
+		series[i] = prom.Series{
+			Name: fmt.Sprintf("container_metric_%d_total", i%1000),
+			Labels: pmodel.LabelSet{
+				"namespace": pmodel.LabelValue(fmt.Sprintf("namespace-%d", i%100)),
+				"pod":       pmodel.LabelValue(fmt.Sprintf("pod-%d", i/10)),
+			},
+		}
+	}
+	newSeries := [][]prom.Series{series}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		registry := &basicSeriesRegistry{mapper: restMapper()}
+		if err := registry.SetSeries(newSeries, namers); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	// queryCacheRequests is the number of custom metrics queries looked up
+	// in the query cache, by result (hit or miss).
+	queryCacheRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "custom_metrics",
+			Name:      "query_cache_requests_total",
+			Help:      "Number of custom metrics queries looked up in the query cache, by result (hit or miss)",
+		},
+		[]string{"result"},
+	)
+	// queryPlanCacheRequests is the number of custom metrics query plans
+	// looked up in the plan cache, by result (hit or miss).
+	queryPlanCacheRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "custom_metrics",
+			Name:      "query_plan_cache_requests_total",
+			Help:      "Number of custom metrics query plans looked up in the plan cache, by result (hit or miss)",
+		},
+		[]string{"result"},
+	)
+	// ruleSeries is the number of series discovered by each discovery rule,
+	// after filtering, as of the last relist.
+	ruleSeries = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "custom_metrics",
+			Name:      "rule_series",
+			Help:      "Number of series discovered by each custom metrics rule as of the last relist, by rule",
+		},
+		[]string{"rule"},
+	)
+	// exposedMetrics is the number of metrics currently exposed in the API.
+	exposedMetrics = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "custom_metrics",
+			Name:      "exposed_metrics",
+			Help:      "Number of metrics currently exposed in the custom metrics API",
+		},
+	)
+	// metricNameCollisions is the number of metrics produced by several rules,
+	// as of the last relist.
+	metricNameCollisions = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "custom_metrics",
+			Name:      "metric_name_collisions",
+			Help:      "Number of custom metrics produced by several rules as of the last relist",
+		},
+	)
+	// relistDuration is the time taken to relist the available series.
+	relistDuration = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "custom_metrics",
+			Name:      "relist_duration_seconds",
+			Help:      "Time taken to relist the series available for custom metrics",
+			Buckets:   metrics.ExponentialBuckets(0.01, 2, 14),
+		},
+	)
+	// relistErrors is the number of failed series queries, by selector.
+	relistErrors = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "custom_metrics",
+			Name:      "relist_errors_total",
+			Help:      "Number of series queries which failed while relisting custom metrics, by series selector",
+		},
+		[]string{"selector"},
+	)
+	// queryBuildFailures is the number of metric queries which couldn't be
+	// built from their rule, by rule.
+	queryBuildFailures = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "custom_metrics",
+			Name:      "query_build_failures_total",
+			Help:      "Number of custom metrics queries which couldn't be built from their rule, by rule",
+		},
+		[]string{"rule"},
+	)
+	// duplicateSamples is the number of extra samples returned by queries for
+	// objects which already had one, by rule.
+	duplicateSamples = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "custom_metrics",
+			Name:      "duplicate_samples_total",
+			Help:      "Number of extra samples returned by custom metrics queries for objects which already had one, by rule",
+		},
+		[]string{"rule"},
+	)
+	// missingOverrideLabels flags the labels mapped to resources in the
+	// overrides of a rule which none of the series it discovered carry, as of
+	// the last relist.
+	missingOverrideLabels = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "custom_metrics",
+			Name:      "missing_override_labels",
+			Help:      "Labels mapped to resources in the overrides of a custom metrics rule which none of the series it discovered carry, as of the last relist, by rule and label",
+		},
+		[]string{"rule", "label"},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers the custom provider metrics with the legacy registry,
+// which is served on the adapter's /metrics endpoint.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(queryCacheRequests, queryPlanCacheRequests, ruleSeries, exposedMetrics, metricNameCollisions, relistDuration, relistErrors, queryBuildFailures, duplicateSamples, missingOverrideLabels)
+	})
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/utils/clock"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+)
+
+// DefaultUpdateInterval is the interval between two relists of the series
+// of the rules, when none is given in the options.
+const DefaultUpdateInterval = 10 * time.Minute
+
+// DefaultQueryChunkConcurrency is the number of chunks of a query which are
+// run concurrently, unless set otherwise (see Options.QueryChunkConcurrency).
+const DefaultQueryChunkConcurrency = 4
+
+// Options configures a custom metrics provider (see NewPrometheusProvider).
+// Mapper, Client and Namers are required.  The zero value of the other fields
+// disables the feature they configure, unless documented otherwise.
+//
+// The providers log through klog, which can be redirected with klog.SetLogger.
+type Options struct {
+	// Mapper maps the resources the series are associated with to Kubernetes kinds.
+	Mapper apimeta.RESTMapper
+	// KubeClient lists the objects matching the label selectors of requests.
+	KubeClient dynamic.Interface
+	// Client is the Prometheus client the series are listed and queried with.
+	Client prom.Client
+	// Namers are the rules the metrics are discovered and queried with.
+	Namers []naming.MetricNamer
+
+	// UpdateInterval is the interval between two relists of the series of
+	// the rules.  It defaults to DefaultUpdateInterval.
+	UpdateInterval time.Duration
+	// MaxAge is how far back series are listed.  It defaults to UpdateInterval.
+	MaxAge time.Duration
+	// QueryTimeout, if positive, bounds the duration of each query.
+	QueryTimeout time.Duration
+	// RelistLimiter, if set, bounds the concurrency and rate of the series
+	// queries run by relists.  It may be shared with other providers.
+	RelistLimiter *prom.RequestLimiter
+
+	// ExposeQueryInErrors attaches the rendered query to NotFound errors.
+	ExposeQueryInErrors bool
+	// ExposeRuleInErrors names the rule a metric comes from in errors about it.
+	ExposeRuleInErrors bool
+	// QueryCacheTTL, if positive, shares the results of identical queries run
+	// within that period.
+	QueryCacheTTL time.Duration
+	// QueryBatchWindow, if positive, answers the requests for the same metric
+	// arriving within that period with a single query.
+	QueryBatchWindow time.Duration
+	// StaleSampleCutoff, if positive, is the age beyond which samples are
+	// treated as missing.
+	StaleSampleCutoff time.Duration
+	// QueryChunkSize, if positive, splits requests for more objects than
+	// that into several queries.
+	QueryChunkSize int
+	// QueryChunkConcurrency is the number of chunks of a single request run
+	// concurrently.  It defaults to DefaultQueryChunkConcurrency.
+	QueryChunkConcurrency int
+	// UnknownMetricCacheTTL, if positive, answers requests for metrics found
+	// to be unknown within that period with NotFound, without looking them up.
+	UnknownMetricCacheTTL time.Duration
+	// QueryPlanCacheSize, if positive, keeps that many of the most recently
+	// rendered query plans, so that polling the same metric of the same
+	// objects doesn't render the query templates again.
+	QueryPlanCacheSize int
+	// RejectCollisions fails relists in which several rules produce the same
+	// metric, rather than serving it from the last rule.
+	RejectCollisions bool
+	// SelectorPushdown answers requests for the objects matching a label
+	// selector with a single query matching the selector on series labels,
+	// without listing the objects, for the rules mapping the labels of the
+	// selector (see config.ResourceMapping.ObjectLabels).
+	SelectorPushdown bool
+
+	// Shard, if set, splits series discovery between the adapter replicas.
+	Shard *RelistShard
+	// SeriesCache, if set, saves the series discovered by each relist, and
+	// serves the metrics produced by the saved ones on startup, until the
+	// first relist completes.
+	SeriesCache SeriesCache
+	// Failures, if set, is told about the outcome of each query.
+	Failures queryplan.FailureReporter
+	// OnUpdate, if set, is called after the available metrics were updated,
+	// be it by a relist or from the series cache.
+	OnUpdate func()
+	// Clock is used to expire cached results and detect stale samples.  It
+	// defaults to the real clock.
+	Clock clock.PassiveClock
+}
+
+// complete fills in the defaults of unset options.
+func (o *Options) complete() {
+	if o.UpdateInterval <= 0 {
+		o.UpdateInterval = DefaultUpdateInterval
+	}
+	if o.MaxAge <= 0 {
+		o.MaxAge = o.UpdateInterval
+	}
+	if o.QueryChunkConcurrency <= 0 {
+		o.QueryChunkConcurrency = DefaultQueryChunkConcurrency
+	}
+	if o.Clock == nil {
+		o.Clock = clock.RealClock{}
+	}
+}
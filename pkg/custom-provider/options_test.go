@@ -0,0 +1,58 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	pmodel "github.com/prometheus/common/model"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+)
+
+var _ = Describe("Custom Metrics Provider Options", func() {
+	It("should default the relist interval and the max age", func() {
+		opts := Options{}
+		opts.complete()
+		Expect(opts.UpdateInterval).To(Equal(DefaultUpdateInterval))
+		Expect(opts.MaxAge).To(Equal(DefaultUpdateInterval))
+		Expect(opts.Clock).NotTo(BeNil())
+
+		opts = Options{UpdateInterval: time.Minute}
+		opts.complete()
+		Expect(opts.MaxAge).To(Equal(time.Minute))
+	})
+
+	It("should tell stale samples apart using the given clock", func() {
+		clock := clocktesting.NewFakePassiveClock(time.Unix(1000, 0))
+		prov, _ := NewPrometheusProvider(Options{
+			Mapper:            restMapper(),
+			Client:            &fakeprom.FakePrometheusClient{},
+			StaleSampleCutoff: time.Minute,
+			Clock:             clock,
+		})
+		sample := &pmodel.Sample{Timestamp: pmodel.TimeFromUnixNano(time.Unix(970, 0).UnixNano())}
+		Expect(prov.(*prometheusProvider).isStale(sample)).To(BeFalse())
+
+		clock.SetTime(time.Unix(1060, 0))
+		Expect(prov.(*prometheusProvider).isStale(sample)).To(BeTrue())
+	})
+})
@@ -0,0 +1,121 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+)
+
+// customMetricsPathPrefix is the prefix of the paths of custom metrics API requests.
+const customMetricsPathPrefix = "/apis/custom.metrics.k8s.io/"
+
+// ListPage is the page of objects requested by a custom metrics LIST request,
+// using its limit and continue parameters.
+type ListPage struct {
+	// Limit is the maximum number of objects to return, or zero for all of them.
+	Limit int64
+	// Continue is the continue token returned with the previous page, if any.
+	Continue string
+}
+
+type listPageKey struct{}
+
+// WithListPage returns a context requesting the given page of objects from
+// GetMetricBySelector.
+func WithListPage(ctx context.Context, page ListPage) context.Context {
+	return context.WithValue(ctx, listPageKey{}, page)
+}
+
+// ListPageFrom returns the page of objects requested with the given context, if any.
+func ListPageFrom(ctx context.Context) (ListPage, bool) {
+	page, ok := ctx.Value(listPageKey{}).(ListPage)
+	return page, ok && (page.Limit > 0 || page.Continue != "")
+}
+
+// WithListPagination wraps the given API handler, passing the limit and
+// continue parameters of custom metrics requests to the provider through the
+// request context (see WithListPage).  The custom metrics API server doesn't
+// pass them on itself.
+func WithListPagination(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, customMetricsPathPrefix) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		query := req.URL.Query()
+		page := ListPage{Continue: query.Get("continue")}
+		if rawLimit := query.Get("limit"); rawLimit != "" {
+			limit, err := strconv.ParseInt(rawLimit, 10, 64)
+			if err != nil || limit < 0 {
+				status := apierr.NewBadRequest(fmt.Sprintf("invalid limit %q", rawLimit)).ErrStatus
+				status.Kind, status.APIVersion = "Status", "v1"
+				responsewriters.WriteRawJSON(http.StatusBadRequest, status, w)
+				return
+			}
+			page.Limit = limit
+		}
+		handler.ServeHTTP(w, req.WithContext(WithListPage(req.Context(), page)))
+	})
+}
+
+// continueToken is the decoded form of the continue token of a custom metrics
+// LIST request.  Objects are listed in name order, so it only needs to
+// remember the last name returned.
+type continueToken struct {
+	After string `json:"after"`
+}
+
+// paginateNames returns the requested page of the given names, in name order,
+// and the continue token for the next page, if any, along with the number of
+// names remaining after it.
+func paginateNames(names []string, page ListPage) ([]string, string, int64, error) {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+
+	if page.Continue != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(page.Continue)
+		if err != nil {
+			return nil, "", 0, apierr.NewBadRequest("invalid continue token")
+		}
+		var token continueToken
+		if err := json.Unmarshal(raw, &token); err != nil {
+			return nil, "", 0, apierr.NewBadRequest("invalid continue token")
+		}
+		start := sort.Search(len(sorted), func(i int) bool { return sorted[i] > token.After })
+		sorted = sorted[start:]
+	}
+
+	if page.Limit <= 0 || int64(len(sorted)) <= page.Limit {
+		return sorted, "", 0, nil
+	}
+	pageNames := sorted[:page.Limit]
+	raw, err := json.Marshal(continueToken{After: pageNames[len(pageNames)-1]})
+	if err != nil {
+		return nil, "", 0, apierr.NewInternalError(err)
+	}
+	return pageNames, base64.RawURLEncoding.EncodeToString(raw), int64(len(sorted)) - page.Limit, nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var _ = Describe("List pagination", func() {
+	It("should page through names in name order", func() {
+		names := []string{"pod-d", "pod-b", "pod-e", "pod-a", "pod-c"}
+
+		By("fetching the first page")
+		page, next, remaining, err := paginateNames(names, ListPage{Limit: 2})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(page).To(Equal([]string{"pod-a", "pod-b"}))
+		Expect(next).NotTo(BeEmpty())
+		Expect(remaining).To(Equal(int64(3)))
+
+		By("fetching the following pages")
+		page, next, remaining, err = paginateNames(names, ListPage{Limit: 2, Continue: next})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(page).To(Equal([]string{"pod-c", "pod-d"}))
+		Expect(remaining).To(Equal(int64(1)))
+
+		page, next, _, err = paginateNames(names, ListPage{Limit: 2, Continue: next})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(page).To(Equal([]string{"pod-e"}))
+		Expect(next).To(BeEmpty())
+
+		By("checking that the given names are left untouched")
+		Expect(names).To(Equal([]string{"pod-d", "pod-b", "pod-e", "pod-a", "pod-c"}))
+	})
+
+	It("should reject invalid continue tokens", func() {
+		_, _, _, err := paginateNames([]string{"pod-a"}, ListPage{Limit: 1, Continue: "not a token!"})
+		Expect(apierr.IsBadRequest(err)).To(BeTrue())
+	})
+
+	It("should pass the page of custom metrics requests through the context", func() {
+		var page ListPage
+		var paginated bool
+		handler := WithListPagination(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			page, paginated = ListPageFrom(req.Context())
+		}))
+
+		By("requesting a page")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/apis/custom.metrics.k8s.io/v1beta2/namespaces/default/pods/*/http_requests?limit=100&continue=abc", nil))
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(paginated).To(BeTrue())
+		Expect(page).To(Equal(ListPage{Limit: 100, Continue: "abc"}))
+
+		By("not requesting a page")
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/apis/custom.metrics.k8s.io/v1beta2/namespaces/default/pods/*/http_requests", nil))
+		Expect(paginated).To(BeFalse())
+
+		By("requesting an invalid limit")
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/apis/custom.metrics.k8s.io/v1beta2/namespaces/default/pods/*/http_requests?limit=many", nil))
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+	})
+})
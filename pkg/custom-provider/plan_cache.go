@@ -0,0 +1,103 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"hash/fnv"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/lru"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+)
+
+type planCacheKey struct {
+	info           provider.CustomMetricInfo
+	namespace      string
+	metricSelector string
+	// names is a hash of the names of the objects, whose full list is kept
+	// in the entry to rule out collisions
+	names uint64
+}
+
+type planCacheEntry struct {
+	names []string
+	plan  *queryplan.Plan
+}
+
+// planCache keeps the most recently used query plans for custom metrics,
+// so that the query templates aren't rendered again on each poll of the
+// same metric of the same objects (e.g. by HPAs).  Plans only depend on the
+// rules and discovered series, so the cache has to be cleared whenever they
+// change.
+type planCache struct {
+	cache *lru.Cache
+}
+
+// newPlanCache creates a planCache keeping up to the given number of plans.
+// A non-positive size disables caching, and returns nil.
+func newPlanCache(size int) *planCache {
+	if size <= 0 {
+		return nil
+	}
+	return &planCache{cache: lru.New(size)}
+}
+
+func newPlanCacheKey(info provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, names []string) planCacheKey {
+	hash := fnv.New64a()
+	for _, name := range names {
+		hash.Write([]byte(name))
+		hash.Write([]byte{0})
+	}
+	return planCacheKey{info: info, namespace: namespace, metricSelector: metricSelector.String(), names: hash.Sum64()}
+}
+
+// get returns a copy of the cached plan for the given key and object names,
+// if any.  It's safe to call on a nil cache, which never has any.
+func (c *planCache) get(key planCacheKey, names []string) (*queryplan.Plan, bool) {
+	if c == nil {
+		return nil, false
+	}
+	value, found := c.cache.Get(key)
+	if !found || !slices.Equal(value.(planCacheEntry).names, names) {
+		queryPlanCacheRequests.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	queryPlanCacheRequests.WithLabelValues("hit").Inc()
+	plan := *value.(planCacheEntry).plan
+	return &plan, true
+}
+
+// add caches a copy of the given plan.  It's safe to call on a nil cache.
+func (c *planCache) add(key planCacheKey, names []string, plan *queryplan.Plan) {
+	if c == nil {
+		return
+	}
+	cached := *plan
+	c.cache.Add(key, planCacheEntry{names: slices.Clone(names), plan: &cached})
+}
+
+// clear removes all the cached plans.  It's safe to call on a nil cache.
+func (c *planCache) clear() {
+	if c == nil {
+		return
+	}
+	c.cache.Clear()
+}
@@ -18,31 +18,45 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	pmodel "github.com/prometheus/common/model"
+	"golang.org/x/sync/errgroup"
 
 	apierr "k8s.io/apimachinery/pkg/api/errors"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/klog/v2"
 	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/utils/clock"
 
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider/helpers"
 
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
 	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+	"sigs.k8s.io/prometheus-adapter/pkg/staleness"
 )
 
+// QueryCauseType is the StatusCause type used to carry the rendered Prometheus
+// query in the details of errors returned to the user.
+const QueryCauseType metav1.CauseType = "PrometheusQuery"
+
 // Runnable represents something that can be run until told to stop.
 type Runnable interface {
 	// Run runs the runnable forever.
@@ -54,52 +68,116 @@ type Runnable interface {
 type prometheusProvider struct {
 	mapper     apimeta.RESTMapper
 	kubeClient dynamic.Interface
-	promClient prom.Client
+	executor   *queryplan.Executor
+	clock      clock.PassiveClock
+
+	// exposeQueryInErrors indicates that the rendered query should be
+	// attached to NotFound errors returned to the user.
+	exposeQueryInErrors bool
+	// exposeRuleInErrors indicates that the rule a metric comes from should
+	// be attached to errors about it.
+	exposeRuleInErrors bool
+	// queryCache shares the results of identical queries, if enabled
+	queryCache *queryCache
+	// queryBatcher coalesces requests for the same metric, if enabled
+	queryBatcher *queryBatcher
+	// staleSampleCutoff is the age beyond which samples are treated as
+	// missing, if set
+	staleSampleCutoff time.Duration
+	// queryChunkSize is the maximum number of objects matched by a single
+	// query, if set
+	queryChunkSize int
+	// queryChunkConcurrency is the maximum number of chunks of a single
+	// request queried at once
+	queryChunkConcurrency int
+	// failures is told about the outcome of queries, if set
+	failures queryplan.FailureReporter
+	// unknownMetrics remembers the metrics recently found to be unknown, if enabled
+	unknownMetrics *unknownMetricCache
+	// selectorPushdown translates label selectors into matchers, rather than
+	// listing the matching objects, when the rule of the metric allows it
+	selectorPushdown bool
 
 	SeriesRegistry
 }
 
-func NewPrometheusProvider(mapper apimeta.RESTMapper, kubeClient dynamic.Interface, promClient prom.Client, namers []naming.MetricNamer, updateInterval time.Duration, maxAge time.Duration) (provider.CustomMetricsProvider, Runnable) {
+// NewPrometheusProvider creates a CustomMetricsProvider answering requests using
+// Prometheus, configured by the given options, and the Runnable relisting the
+// series of its rules, which has to be run for it to serve metrics.
+func NewPrometheusProvider(opts Options) (provider.CustomMetricsProvider, Runnable) {
+	registerMetrics()
+	opts.complete()
+	promClient := prom.WithQueryTimeout(opts.Client, opts.QueryTimeout)
+
+	unknownMetrics := newUnknownMetricCache(opts.UnknownMetricCacheTTL)
+	if unknownMetrics != nil {
+		unknownMetrics.now = opts.Clock.Now
+	}
+
 	lister := &cachingMetricsLister{
-		updateInterval: updateInterval,
-		maxAge:         maxAge,
+		updateInterval: opts.UpdateInterval,
+		maxAge:         opts.MaxAge,
 		promClient:     promClient,
-		namers:         namers,
+		namers:         opts.Namers,
+		shard:          opts.Shard,
+		seriesCache:    opts.SeriesCache,
+		limiter:        opts.RelistLimiter,
+		onUpdate:       opts.OnUpdate,
 
 		SeriesRegistry: &basicSeriesRegistry{
-			mapper: mapper,
+			mapper:           opts.Mapper,
+			rejectCollisions: opts.RejectCollisions,
+			plans:            newPlanCache(opts.QueryPlanCacheSize),
+			unknownMetrics:   unknownMetrics,
+			failures:         opts.Failures,
 		},
 	}
 
+	queryCache := newQueryCache(opts.QueryCacheTTL)
+	if queryCache != nil {
+		queryCache.now = opts.Clock.Now
+	}
 	return &prometheusProvider{
-		mapper:     mapper,
-		kubeClient: kubeClient,
-		promClient: promClient,
+		mapper:     opts.Mapper,
+		kubeClient: opts.KubeClient,
+		executor:   queryplan.NewExecutor(promClient),
+		clock:      opts.Clock,
+
+		exposeQueryInErrors:   opts.ExposeQueryInErrors,
+		exposeRuleInErrors:    opts.ExposeRuleInErrors,
+		queryCache:            queryCache,
+		queryBatcher:          newQueryBatcher(opts.QueryBatchWindow),
+		staleSampleCutoff:     opts.StaleSampleCutoff,
+		queryChunkSize:        opts.QueryChunkSize,
+		queryChunkConcurrency: opts.QueryChunkConcurrency,
+		failures:              opts.Failures,
+		unknownMetrics:        unknownMetrics,
+		selectorPushdown:      opts.SelectorPushdown,
 
 		SeriesRegistry: lister,
 	}, lister
 }
 
-func (p *prometheusProvider) metricFor(value pmodel.SampleValue, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+// isStale checks whether the given sample is too old to be served, according
+// to the configured cutoff.
+func (p *prometheusProvider) isStale(sample *pmodel.Sample) bool {
+	return p.staleSampleCutoff > 0 && p.clock.Since(sample.Timestamp.Time()) > p.staleSampleCutoff
+}
+
+func (p *prometheusProvider) metricFor(sample *pmodel.Sample, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector, selectorLabels []string, values queryplan.ValueConversion) (*custom_metrics.MetricValue, error) {
 	ref, err := helpers.ReferenceFor(p.mapper, name, info)
 	if err != nil {
 		return nil, err
 	}
 
-	var q *resource.Quantity
-	if math.IsNaN(float64(value)) {
-		q = resource.NewQuantity(0, resource.DecimalSI)
-	} else {
-		q = resource.NewMilliQuantity(int64(value*1000.0), resource.DecimalSI)
-	}
+	q := values.Quantity(sample.Value)
 
 	metric := &custom_metrics.MetricValue{
 		DescribedObject: ref,
 		Metric: custom_metrics.MetricIdentifier{
 			Name: info.Metric,
 		},
-		// TODO(directxman12): use the right timestamp
-		Timestamp: metav1.Time{Time: time.Now()},
+		Timestamp: metav1.Time{Time: sample.Timestamp.Time()},
 		Value:     *q,
 	}
 
@@ -110,27 +188,99 @@ func (p *prometheusProvider) metricFor(value pmodel.SampleValue, name types.Name
 		}
 		metric.Metric.Selector = sel
 	}
+	withSampleLabels(&metric.Metric, sample, selectorLabels)
 
 	return metric, nil
 }
 
-func (p *prometheusProvider) metricsFor(valueSet pmodel.Vector, namespace string, names []string, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
-	values, found := p.MatchValuesToNames(info, valueSet)
+// withSampleLabels adds the given labels of the sample, if it has them, to the
+// match labels of the selector of the given metric.  Labels already matched by
+// the requested metric selector are left alone, as are labels which aren't
+// valid Kubernetes labels, so that consumers can parse the selector.
+func withSampleLabels(metric *custom_metrics.MetricIdentifier, sample *pmodel.Sample, selectorLabels []string) {
+	for _, name := range selectorLabels {
+		value, found := sample.Metric[pmodel.LabelName(name)]
+		if !found {
+			continue
+		}
+		if len(validation.IsQualifiedName(name)) > 0 || len(validation.IsValidLabelValue(string(value))) > 0 {
+			klog.V(4).Infof("not attaching label %s=%q of metric %s to its selector, it isn't a valid Kubernetes label", name, value, metric.Name)
+			continue
+		}
+		if metric.Selector == nil {
+			metric.Selector = &metav1.LabelSelector{}
+		}
+		if metric.Selector.MatchLabels == nil {
+			metric.Selector.MatchLabels = make(map[string]string)
+		}
+		if _, matched := metric.Selector.MatchLabels[name]; !matched {
+			metric.Selector.MatchLabels[name] = string(value)
+		}
+	}
+}
+
+// withQueryDetails attaches the rendered query to the given NotFound error, so that
+// users can see exactly what was sent to Prometheus.  It's a no-op unless exposing
+// queries in errors has been enabled.
+func (p *prometheusProvider) withQueryDetails(err *apierr.StatusError, query prom.Selector) *apierr.StatusError {
+	if !p.exposeQueryInErrors || query == "" {
+		return err
+	}
+
+	err.ErrStatus.Message = fmt.Sprintf("%s (query: %s)", err.ErrStatus.Message, query)
+	if err.ErrStatus.Details == nil {
+		err.ErrStatus.Details = &metav1.StatusDetails{}
+	}
+	err.ErrStatus.Details.Causes = append(err.ErrStatus.Details.Causes, metav1.StatusCause{
+		Type:    QueryCauseType,
+		Message: string(query),
+	})
+	return err
+}
+
+// withRuleDetails attaches the rule the metric comes from to the given error, so
+// that users can see which rule to fix.  It's a no-op unless exposing rules in errors
+// has been enabled.
+func (p *prometheusProvider) withRuleDetails(err *apierr.StatusError, rule string) *apierr.StatusError {
+	if !p.exposeRuleInErrors || rule == "" {
+		return err
+	}
+	return naming.WithRuleDetails(err, rule)
+}
+
+// matchError converts an error matching the results of the given query to
+// objects (see SeriesRegistry.MatchValuesToNames) into an API error.
+func (p *prometheusProvider) matchError(info provider.CustomMetricInfo, query prom.Selector, err error) error {
+	klog.Errorf("unable to match the results of the query for metric %s to objects: %v", info.String(), err)
+	rule, _ := p.RuleForMetric(info)
+	return p.withQueryDetails(p.withRuleDetails(apierr.NewInternalError(err), rule), query)
+}
+
+func (p *prometheusProvider) metricsFor(valueSet pmodel.Vector, query prom.Selector, namespace string, names []string, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	values, found, err := p.MatchValuesToNames(info, valueSet)
+	if err != nil {
+		return nil, p.matchError(info, query, err)
+	}
 	if !found {
-		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+		return nil, p.withQueryDetails(provider.NewMetricNotFoundError(info.GroupResource, info.Metric), query)
 	}
 	res := []custom_metrics.MetricValue{}
+	selectorLabels := p.SelectorLabelsForMetric(info)
+	conversion := p.ValueConversionForMetric(info)
 
 	for _, name := range names {
-		if _, found := values[name]; !found {
-			continue
-		}
+		for _, sample := range values[name] {
+			if p.isStale(sample) {
+				klog.V(2).Infof("ignoring stale sample from %s for metric %s for %s/%s", sample.Timestamp.Time(), info.String(), namespace, name)
+				continue
+			}
 
-		value, err := p.metricFor(values[name], types.NamespacedName{Namespace: namespace, Name: name}, info, metricSelector)
-		if err != nil {
-			return nil, err
+			value, err := p.metricFor(sample, types.NamespacedName{Namespace: namespace, Name: name}, info, metricSelector, selectorLabels, conversion)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, *value)
 		}
-		res = append(res, *value)
 	}
 
 	return &custom_metrics.MetricValueList{
@@ -138,60 +288,208 @@ func (p *prometheusProvider) metricsFor(valueSet pmodel.Vector, namespace string
 	}, nil
 }
 
-func (p *prometheusProvider) buildQuery(ctx context.Context, info provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, names ...string) (pmodel.Vector, error) {
-	query, found := p.QueryForMetric(info, namespace, metricSelector, names...)
+// buildQuery constructs and runs the query plan for the given metric, returning both
+// the results and the query that produced them.  When batching is enabled, the results
+// may also cover objects other than the named ones.
+func (p *prometheusProvider) buildQuery(ctx context.Context, info provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, names ...string) (pmodel.Vector, prom.Selector, error) {
+	key := queryBatchKey{info: info, namespace: namespace, metricSelector: metricSelector.String()}
+	return p.queryBatcher.execute(ctx, key, names, func(ctx context.Context, names []string) (pmodel.Vector, prom.Selector, error) {
+		return p.runChunkedQuery(ctx, info, namespace, metricSelector, names)
+	})
+}
+
+// runChunkedQuery runs the query for the given metric and objects, splitting
+// it into several queries, whose results are merged, when there are more
+// objects than the chunk size.  This keeps the regular expression matching
+// the objects' names within the limits of Prometheus.  At most
+// queryChunkConcurrency chunks are queried at once, and the remaining ones
+// are cancelled as soon as one fails.  The returned query is the one for the
+// first chunk.
+func (p *prometheusProvider) runChunkedQuery(ctx context.Context, info provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, names []string) (pmodel.Vector, prom.Selector, error) {
+	if p.queryChunkSize <= 0 || len(names) <= p.queryChunkSize {
+		return p.runQuery(ctx, info, namespace, metricSelector, names...)
+	}
+
+	type chunkResult struct {
+		values pmodel.Vector
+		query  prom.Selector
+		err    error
+	}
+	results := make([]chunkResult, (len(names)+p.queryChunkSize-1)/p.queryChunkSize)
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(p.queryChunkConcurrency)
+	for i := range results {
+		chunk := names[i*p.queryChunkSize : min((i+1)*p.queryChunkSize, len(names))]
+		res := &results[i]
+		group.Go(func() error {
+			// don't start the chunks left once one failed
+			if err := groupCtx.Err(); err != nil {
+				res.err = err
+				return err
+			}
+			res.values, res.query, res.err = p.runQuery(groupCtx, info, namespace, metricSelector, chunk...)
+			return res.err
+		})
+	}
+	if err := group.Wait(); err != nil {
+		// report the error of the chunk which failed first, rather than
+		// those of the chunks it cancelled
+		for _, res := range results {
+			if res.err == err {
+				return nil, res.query, res.err
+			}
+		}
+		return nil, "", err
+	}
+
+	var merged pmodel.Vector
+	for _, res := range results {
+		merged = append(merged, res.values...)
+	}
+	return merged, results[0].query, nil
+}
+
+// runQuery constructs and runs the query plan for the given metric and objects.
+func (p *prometheusProvider) runQuery(ctx context.Context, info provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, names ...string) (pmodel.Vector, prom.Selector, error) {
+	plan, found := p.PlanForMetric(info, namespace, metricSelector, names...)
+	return p.runPlan(ctx, info, plan, found)
+}
+
+// runPlan runs the given query plan for the given metric, if found.
+func (p *prometheusProvider) runPlan(ctx context.Context, info provider.CustomMetricInfo, plan *queryplan.Plan, found bool) (pmodel.Vector, prom.Selector, error) {
 	if !found {
-		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+		// the metric may be known, but not served in the requested namespace,
+		// or its query couldn't be built, which the registry reports
+		rule, known := p.RuleForMetric(info)
+		if !known {
+			p.unknownMetrics.add(info)
+		}
+		return nil, "", p.withRuleDetails(provider.NewMetricNotFoundError(info.GroupResource, info.Metric), rule)
 	}
 
-	// TODO: use an actual context
-	queryResults, err := p.promClient.Query(ctx, pmodel.Now(), query)
+	queryResults, err := p.queryCache.execute(ctx, plan, p.executor.Execute)
+	if prom.IsTimeout(err) {
+		klog.Errorf("timed out fetching metrics from prometheus for rule %q: %v", plan.Rule, err)
+		p.reportFailure(info, plan.Rule, err)
+		return nil, plan.Query, p.withRuleDetails(apierr.NewTimeoutError("timed out fetching metrics", 0), plan.Rule)
+	}
+	if errors.Is(err, queryplan.ErrLimitExceeded) {
+		klog.Errorf("refused to fetch metrics from prometheus for rule %q: %v", plan.Rule, err)
+		p.reportFailure(info, plan.Rule, err)
+		return nil, plan.Query, p.withRuleDetails(apierr.NewInternalError(err), plan.Rule)
+	}
 	if err != nil {
-		klog.Errorf("unable to fetch metrics from prometheus: %v", err)
+		klog.Errorf("unable to fetch metrics from prometheus for rule %q: %v", plan.Rule, err)
+		p.reportFailure(info, plan.Rule, err)
 		// don't leak implementation details to the user
-		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+		return nil, plan.Query, p.withRuleDetails(apierr.NewInternalError(fmt.Errorf("unable to fetch metrics")), plan.Rule)
 	}
 
 	if queryResults.Type != pmodel.ValVector {
 		klog.Errorf("unexpected results from prometheus: expected %s, got %s on results %v", pmodel.ValVector, queryResults.Type, queryResults)
-		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+		p.reportFailure(info, plan.Rule, fmt.Errorf("expected %s results, got %s", pmodel.ValVector, queryResults.Type))
+		return nil, plan.Query, p.withRuleDetails(apierr.NewInternalError(fmt.Errorf("unable to fetch metrics")), plan.Rule)
+	}
+
+	if p.failures != nil {
+		p.failures.QuerySucceeded(custom_metrics.GroupName, info.String())
 	}
+	staleness.ObserveVector(staleness.CustomAPI, *queryResults.Vector)
 
-	return *queryResults.Vector, nil
+	return *queryResults.Vector, plan.Query, nil
+}
+
+// reportFailure tells the failure reporter, if any, that the query for the
+// given metric failed.
+func (p *prometheusProvider) reportFailure(info provider.CustomMetricInfo, rule string, err error) {
+	if p.failures != nil {
+		p.failures.QueryFailed(custom_metrics.GroupName, info.String(), rule, err)
+	}
 }
 
 func (p *prometheusProvider) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	if p.unknownMetrics.contains(info) {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+
 	// construct a query
-	queryResults, err := p.buildQuery(ctx, info, name.Namespace, metricSelector, name.Name)
+	queryResults, query, err := p.buildQuery(ctx, info, name.Namespace, metricSelector, name.Name)
 	if err != nil {
 		return nil, err
 	}
 
 	// associate the metrics
 	if len(queryResults) < 1 {
-		return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+		return nil, p.withQueryDetails(provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name), query)
 	}
 
-	namedValues, found := p.MatchValuesToNames(info, queryResults)
+	namedValues, found, err := p.MatchValuesToNames(info, queryResults)
+	if err != nil {
+		return nil, p.matchError(info, query, err)
+	}
 	if !found {
-		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+		return nil, p.withQueryDetails(provider.NewMetricNotFoundError(info.GroupResource, info.Metric), query)
 	}
 
 	if len(namedValues) > 1 {
 		klog.V(2).Infof("Got more than one result (%v results) when fetching metric %s for %q, using the first one with a matching name...", len(queryResults), info.String(), name)
 	}
 
-	resultValue, nameFound := namedValues[name.Name]
+	resultValues, nameFound := namedValues[name.Name]
 	if !nameFound {
 		klog.Errorf("None of the results returned by when fetching metric %s for %q matched the resource name", info.String(), name)
-		return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+		return nil, p.withQueryDetails(provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name), query)
+	}
+	// objects with several identities (see naming.MetricNamer.IdentityLabels)
+	// only have a single value here, which the metric selector must pick
+	if len(resultValues) > 1 {
+		return nil, apierr.NewBadRequest(fmt.Sprintf("got %d values of metric %s for %s %q, one for each value of %s: narrow the metric selector down to one of them",
+			len(resultValues), info.Metric, info.GroupResource.String(), name.Name, strings.Join(distinguishingLabels(resultValues), ", ")))
+	}
+	resultValue := resultValues[0]
+	if p.isStale(resultValue) {
+		klog.V(2).Infof("ignoring stale sample from %s for metric %s for %q", resultValue.Timestamp.Time(), info.String(), name)
+		return nil, p.withQueryDetails(provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name), query)
 	}
 
 	// return the resulting metric
-	return p.metricFor(resultValue, name, info, metricSelector)
+	return p.metricFor(resultValue, name, info, metricSelector, p.SelectorLabelsForMetric(info), p.ValueConversionForMetric(info))
+}
+
+// distinguishingLabels returns the sorted names of the labels whose values
+// differ between the given samples.
+func distinguishingLabels(samples pmodel.Vector) []string {
+	var names []string
+	for name, value := range samples[0].Metric {
+		for _, sample := range samples[1:] {
+			if sample.Metric[name] != value {
+				names = append(names, string(name))
+				break
+			}
+		}
+	}
+	for _, sample := range samples[1:] {
+		for name := range sample.Metric {
+			if _, found := samples[0].Metric[name]; !found && !slices.Contains(names, string(name)) {
+				names = append(names, string(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
 }
 
 func (p *prometheusProvider) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	if p.unknownMetrics.contains(info) {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+
+	if p.selectorPushdown {
+		if plan, found := p.PlanForSelector(info, namespace, selector, metricSelector); found {
+			return p.getMetricsForPlan(ctx, namespace, info, plan, metricSelector)
+		}
+	}
+
 	// fetch a list of relevant resource names
 	resourceNames, err := helpers.ListObjectNames(p.mapper, p.kubeClient, namespace, selector, info)
 	if err != nil {
@@ -200,14 +498,128 @@ func (p *prometheusProvider) GetMetricBySelector(ctx context.Context, namespace
 		return nil, apierr.NewInternalError(fmt.Errorf("unable to list matching resources"))
 	}
 
+	// only fetch the requested page of objects, if any
+	var continueToken string
+	var remaining int64
+	if page, paginated := ListPageFrom(ctx); paginated {
+		resourceNames, continueToken, remaining, err = paginateNames(resourceNames, page)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// construct the actual query
-	queryResults, err := p.buildQuery(ctx, info, namespace, metricSelector, resourceNames...)
+	queryResults, query, err := p.buildQuery(ctx, info, namespace, metricSelector, resourceNames...)
 	if err != nil {
 		return nil, err
 	}
 
 	// return the resulting metrics
-	return p.metricsFor(queryResults, namespace, resourceNames, info, metricSelector)
+	res, err := p.metricsFor(queryResults, query, namespace, resourceNames, info, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	if continueToken != "" {
+		res.Continue = continueToken
+		res.RemainingItemCount = &remaining
+	}
+	return res, nil
+}
+
+// getMetricsForPlan runs the given plan for the objects matching a label
+// selector (see SeriesRegistry.PlanForSelector), and returns the values of
+// all the objects found in its results.
+func (p *prometheusProvider) getMetricsForPlan(ctx context.Context, namespace string, info provider.CustomMetricInfo, plan *queryplan.Plan, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	queryResults, query, err := p.runPlan(ctx, info, plan, true)
+	if err != nil {
+		return nil, err
+	}
+	values, found, err := p.MatchValuesToNames(info, queryResults)
+	if err != nil {
+		return nil, p.matchError(info, query, err)
+	}
+	if !found {
+		return nil, p.withQueryDetails(provider.NewMetricNotFoundError(info.GroupResource, info.Metric), query)
+	}
+	resourceNames := make([]string, 0, len(values))
+	for name := range values {
+		resourceNames = append(resourceNames, name)
+	}
+	sort.Strings(resourceNames)
+
+	var continueToken string
+	var remaining int64
+	if page, paginated := ListPageFrom(ctx); paginated {
+		resourceNames, continueToken, remaining, err = paginateNames(resourceNames, page)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := p.metricsFor(queryResults, query, namespace, resourceNames, info, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	if continueToken != "" {
+		res.Continue = continueToken
+		res.RemainingItemCount = &remaining
+	}
+	return res, nil
+}
+
+// QueryPlanner is implemented by the provider returned from NewPrometheusProvider,
+// exposing the query plans used to answer requests without running them.
+type QueryPlanner interface {
+	// PlanForRequest returns the plan used to fetch the given metric for the named
+	// object, or for the objects matching the selector if the name is "*".
+	PlanForRequest(ctx context.Context, namespace, name string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*queryplan.Plan, error)
+}
+
+func (p *prometheusProvider) PlanForRequest(ctx context.Context, namespace, name string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*queryplan.Plan, error) {
+	resourceNames := []string{name}
+	if name == "*" {
+		if p.selectorPushdown {
+			if plan, found := p.PlanForSelector(info, namespace, selector, metricSelector); found {
+				return plan, nil
+			}
+		}
+		var err error
+		resourceNames, err = helpers.ListObjectNames(p.mapper, p.kubeClient, namespace, selector, info)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list matching resource names: %v", err)
+		}
+	}
+
+	plan, found := p.PlanForMetric(info, namespace, metricSelector, resourceNames...)
+	if !found {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	return plan, nil
+}
+
+// NamersSetter is implemented by the Runnable returned from NewPrometheusProvider,
+// allowing the namers used to discover metrics to be replaced while running.
+type NamersSetter interface {
+	// SetNamers replaces the namers, and immediately relists the available metrics.
+	SetNamers(namers []naming.MetricNamer) error
+}
+
+// NamersPreparer is implemented by the Runnable returned from
+// NewPrometheusProvider, allowing the namers used to discover metrics to be
+// replaced along with other configuration.
+type NamersPreparer interface {
+	// PrepareNamers lists the metrics of the given namers without serving
+	// them yet: the returned function replaces the namers, and serves these
+	// metrics.
+	PrepareNamers(namers []naming.MetricNamer) (func() error, error)
+}
+
+// SyncChecker is implemented by the Runnable returned from NewPrometheusProvider,
+// telling whether the available metrics were listed yet.
+type SyncChecker interface {
+	// HasSynced checks whether the available metrics were successfully
+	// listed at least once.
+	HasSynced() bool
 }
 
 type cachingMetricsLister struct {
@@ -216,7 +628,60 @@ type cachingMetricsLister struct {
 	promClient     prom.Client
 	updateInterval time.Duration
 	maxAge         time.Duration
-	namers         []naming.MetricNamer
+	// shard, if set, restricts the series queries run by this replica
+	shard *RelistShard
+
+	// updateMu serializes the updates of the series, and of the namers
+	// along with them
+	updateMu sync.Mutex
+	// namersMu guards namers, which may be replaced when the configuration is reloaded
+	namersMu sync.RWMutex
+	namers   []naming.MetricNamer
+
+	// relisted keeps the series of rules relisted less often than every
+	// updateInterval
+	relisted naming.RelistCache[seriesQuery]
+	// synced is set once the metrics were successfully listed
+	synced atomic.Bool
+	// seriesCache saves the series of each relist, if set
+	seriesCache SeriesCache
+	// limiter bounds the concurrency and rate of the series queries, if set
+	limiter *prom.RequestLimiter
+	// onUpdate is called after the series were set, if set
+	onUpdate func()
+}
+
+func (l *cachingMetricsLister) SetNamers(namers []naming.MetricNamer) error {
+	apply, err := l.PrepareNamers(namers)
+	if err != nil {
+		return err
+	}
+	return apply()
+}
+
+// PrepareNamers lists the series of the given namers, without serving them
+// yet: the returned function replaces the namers and serves their metrics.
+// It fails, leaving the current namers in place, if these metrics are
+// rejected (see Options.RejectCollisions).
+func (l *cachingMetricsLister) PrepareNamers(namers []naming.MetricNamer) (func() error, error) {
+	ctx := context.Background()
+	// the series cached by the relists were filtered by the current rules
+	seriesCacheByQuery, err := l.listSeries(ctx, namers, &naming.RelistCache[seriesQuery]{}, l.shard.owns)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		l.updateMu.Lock()
+		defer l.updateMu.Unlock()
+		if err := l.applySeries(ctx, namers, seriesCacheByQuery); err != nil {
+			return err
+		}
+		l.namersMu.Lock()
+		l.namers = namers
+		l.namersMu.Unlock()
+		l.relisted.Reset()
+		return nil
+	}, nil
 }
 
 func (l *cachingMetricsLister) Run() {
@@ -224,72 +689,311 @@ func (l *cachingMetricsLister) Run() {
 }
 
 func (l *cachingMetricsLister) RunUntil(stopChan <-chan struct{}) {
-	go wait.Until(func() {
+	if l.seriesCache != nil {
+		l.loadCachedSeries()
+	}
+	go naming.RelistUntil(func() {
 		if err := l.updateMetrics(); err != nil {
 			utilruntime.HandleError(err)
 		}
-	}, l.updateInterval, stopChan)
+	}, l.relistPeriod, stopChan)
 }
 
-type selectorSeries struct {
+// relistPeriod returns the period between two relists, which is shorter than
+// updateInterval if some rules have to be relisted more often.
+func (l *cachingMetricsLister) relistPeriod() time.Duration {
+	l.namersMu.RLock()
+	defer l.namersMu.RUnlock()
+	return naming.RelistPeriod(l.namers, l.updateInterval)
+}
+
+// seriesQuery identifies a series query made against a particular backend,
+// with particular headers.
+type seriesQuery struct {
+	backend string
+	// headers identifies the extra headers sent with the query (see prom.HeadersKey)
+	headers  string
 	selector prom.Selector
-	series   []prom.Series
+	// discoveryLabels are the labels of the series discovered using the
+	// label values API, if it's used
+	discoveryLabels string
+	// maxAge is how far back series are listed, if the rule overrides the
+	// lister's default
+	maxAge time.Duration
+}
+
+// seriesQueryFor returns the series query made to discover the series of the given rule.
+func seriesQueryFor(namer naming.MetricNamer) seriesQuery {
+	return seriesQuery{
+		backend:         namer.PrometheusRef(),
+		headers:         prom.HeadersKey(namer.PrometheusHeaders()),
+		selector:        namer.Selector(),
+		discoveryLabels: strings.Join(namer.DiscoveryLabels(), ","),
+		maxAge:          namer.MaxAge(),
+	}
+}
+
+// relistIntervals returns, for each series query, the minimum interval
+// between two runs of it, which is the given default interval unless the
+// rule overrides it.  Rules sharing a query relist it as often as the most
+// frequent of them requires.
+func relistIntervals(namers []naming.MetricNamer, defaultInterval time.Duration) map[seriesQuery]time.Duration {
+	intervals := make(map[seriesQuery]time.Duration, len(namers))
+	for _, namer := range namers {
+		query := seriesQueryFor(namer)
+		interval := namer.RelistInterval()
+		if interval <= 0 {
+			interval = defaultInterval
+		}
+		if current, found := intervals[query]; !found || interval < current {
+			intervals[query] = interval
+		}
+	}
+	return intervals
+}
+
+// namersByQuery groups the namers which discover series by sharing each series query.
+func namersByQuery(namers []naming.MetricNamer) map[seriesQuery][]naming.MetricNamer {
+	res := make(map[seriesQuery][]naming.MetricNamer, len(namers))
+	for _, namer := range namers {
+		if namer.StaticSeries() != nil {
+			continue
+		}
+		query := seriesQueryFor(namer)
+		res[query] = append(res[query], namer)
+	}
+	return res
+}
+
+type selectorSeries struct {
+	query  seriesQuery
+	series []prom.Series
 }
 
 func (l *cachingMetricsLister) updateMetrics() error {
-	startTime := pmodel.Now().Add(-1 * l.maxAge)
+	l.updateMu.Lock()
+	defer l.updateMu.Unlock()
+
+	l.namersMu.RLock()
+	namers := l.namers
+	l.namersMu.RUnlock()
+
+	defer func(start time.Time) {
+		relistDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	// the queries of the relist, including the value filters, share its context
+	relistCtx := context.Background()
+	seriesCacheByQuery, err := l.listSeries(relistCtx, namers, &l.relisted, l.shard.owns)
+	if err != nil {
+		return err
+	}
+	return l.applySeries(relistCtx, namers, seriesCacheByQuery)
+}
+
+// listSeries runs the series queries of the given namers for which run is
+// true, except those whose series, listed by a previous relist, are still
+// fresh in the given cache.
+func (l *cachingMetricsLister) listSeries(ctx context.Context, namers []naming.MetricNamer, relisted *naming.RelistCache[seriesQuery], run func(seriesQuery) bool) (map[seriesQuery][]prom.Series, error) {
+	now := time.Now()
+	intervals := relistIntervals(namers, l.updateInterval)
+	sharing := namersByQuery(namers)
 
 	// don't do duplicate queries when it's just the matchers that change
-	seriesCacheByQuery := make(map[prom.Selector][]prom.Series)
+	seriesCacheByQuery := make(map[seriesQuery][]prom.Series)
 
 	// these can take a while on large clusters, so launch in parallel
 	// and don't duplicate
-	selectors := make(map[prom.Selector]struct{})
-	selectorSeriesChan := make(chan selectorSeries, len(l.namers))
-	errs := make(chan error, len(l.namers))
-	for _, namer := range l.namers {
-		sel := namer.Selector()
-		if _, ok := selectors[sel]; ok {
+	queries := make(map[seriesQuery]struct{})
+	selectorSeriesChan := make(chan selectorSeries, len(namers))
+	errs := make(chan error, len(namers))
+	for _, namer := range namers {
+		query := seriesQueryFor(namer)
+		if _, ok := queries[query]; ok || namer.StaticSeries() != nil {
+			errs <- nil
+			selectorSeriesChan <- selectorSeries{}
+			continue
+		}
+		queries[query] = struct{}{}
+		if !run(query) {
 			errs <- nil
 			selectorSeriesChan <- selectorSeries{}
 			continue
 		}
-		selectors[sel] = struct{}{}
+		if series, fresh := relisted.Fresh(query, intervals[query], now); fresh {
+			errs <- nil
+			selectorSeriesChan <- selectorSeries{query: query, series: series}
+			continue
+		}
+		maxAge := l.maxAge
+		if query.maxAge > 0 {
+			maxAge = query.maxAge
+		}
+		startTime := pmodel.TimeFromUnixNano(now.UnixNano()).Add(-1 * maxAge)
+		headers := namer.PrometheusHeaders()
+		filter := naming.SeriesFilterFor(sharing[query])
 		go func() {
-			series, err := l.promClient.Series(context.TODO(), pmodel.Interval{Start: startTime, End: 0}, sel)
+			ctx := prom.WithHeaders(prom.WithBackend(ctx, query.backend), headers)
+			// only keep the series of the rules sharing the query as they're listed
+			ctx = prom.WithSeriesFilter(ctx, filter)
+			release, err := l.limiter.Acquire(ctx)
+			if err != nil {
+				errs <- fmt.Errorf("unable to fetch metrics for query %q: %v", query.selector, err)
+				return
+			}
+			series, err := naming.ListSeries(ctx, l.promClient, namer, pmodel.Interval{Start: startTime, End: 0})
+			release()
 			if err != nil {
-				errs <- fmt.Errorf("unable to fetch metrics for query %q: %v", sel, err)
+				relistErrors.WithLabelValues(string(query.selector)).Inc()
+				errs <- fmt.Errorf("unable to fetch metrics for query %q: %v", query.selector, err)
 				return
 			}
+			relisted.Store(query, series, now)
 			errs <- nil
 			selectorSeriesChan <- selectorSeries{
-				selector: sel,
-				series:   series,
+				query:  query,
+				series: series,
 			}
 		}()
 	}
 
 	// iterate through, blocking until we've got all results
-	for range l.namers {
+	for range namers {
 		if err := <-errs; err != nil {
-			return fmt.Errorf("unable to update list of all metrics: %v", err)
+			return nil, fmt.Errorf("unable to update list of all metrics: %v", err)
 		}
 		if ss := <-selectorSeriesChan; ss.series != nil {
-			seriesCacheByQuery[ss.selector] = ss.series
+			seriesCacheByQuery[ss.query] = ss.series
 		}
 	}
 	close(errs)
+	relisted.Retain(queries)
+	return seriesCacheByQuery, nil
+}
+
+// applySeries serves the metrics of the given namers, produced by the series
+// returned by each of their queries, along with those shared by the other
+// replicas, if series discovery is sharded.
+func (l *cachingMetricsLister) applySeries(ctx context.Context, namers []naming.MetricNamer, seriesCacheByQuery map[seriesQuery][]prom.Series) error {
+	if l.shard != nil {
+		unavailable, err := l.shard.share(ctx, seriesCacheByQuery)
+		if err != nil {
+			return fmt.Errorf("unable to update list of all metrics: %v", err)
+		}
+		if len(unavailable) > 0 {
+			// run the queries of the shards whose series aren't available ourselves
+			unshared, err := l.listSeries(ctx, namers, &naming.RelistCache[seriesQuery]{}, func(query seriesQuery) bool {
+				return unavailable[l.shard.shardOf(query)]
+			})
+			if err != nil {
+				return err
+			}
+			maps.Copy(seriesCacheByQuery, unshared)
+		}
+	}
+
+	if err := l.setSeriesFrom(ctx, namers, seriesCacheByQuery, l.shard != nil); err != nil {
+		return err
+	}
+	l.synced.Store(true)
 
-	newSeries := make([][]prom.Series, len(l.namers))
-	for i, namer := range l.namers {
-		series, cached := seriesCacheByQuery[namer.Selector()]
+	if l.seriesCache != nil {
+		if err := l.seriesCache.Save(sharedSeriesFrom(seriesCacheByQuery)); err != nil {
+			klog.Errorf("unable to save the discovered series: %v", err)
+		}
+	}
+	return nil
+}
+
+// loadCachedSeries serves the metrics produced by the series saved in the
+// series cache by a previous run, if any, until they're first relisted.  The
+// queries of the rules which weren't saved are skipped.
+func (l *cachingMetricsLister) loadCachedSeries() {
+	shared, err := l.seriesCache.Load()
+	if err != nil {
+		klog.Errorf("unable to load the cached series: %v", err)
+		return
+	}
+	if shared == nil {
+		return
+	}
+
+	l.updateMu.Lock()
+	defer l.updateMu.Unlock()
+	l.namersMu.RLock()
+	namers := l.namers
+	l.namersMu.RUnlock()
+
+	seriesCacheByQuery := make(map[seriesQuery][]prom.Series, len(shared))
+	for _, entry := range shared {
+		seriesCacheByQuery[entry.query()] = entry.Series
+	}
+	if err := l.setSeriesFrom(context.Background(), namers, seriesCacheByQuery, true); err != nil {
+		klog.Errorf("unable to serve the cached series: %v", err)
+		return
+	}
+	klog.Infof("serving the series of %d queries from the series cache until the first relist", len(shared))
+	l.synced.Store(true)
+}
+
+// setSeriesFrom sets the series of the given namers from the series returned
+// by each query.  If partial is set, the namers whose query has no results are
+// skipped, instead of failing.  The value filters of the namers are run with
+// the given context.
+func (l *cachingMetricsLister) setSeriesFrom(ctx context.Context, namers []naming.MetricNamer, seriesCacheByQuery map[seriesQuery][]prom.Series, partial bool) error {
+	newSeries := make([][]prom.Series, len(namers))
+	seriesPerRule := make(map[string]int, len(namers))
+	missing := make(map[string][]pmodel.LabelName, len(namers))
+	for i, namer := range namers {
+		if static := namer.StaticSeries(); static != nil {
+			newSeries[i] = naming.FilterSeriesByValue(ctx, l.promClient, l.limiter, namer, namer.FilterSeries(static))
+			seriesPerRule[namer.RuleName()] += len(newSeries[i])
+			continue
+		}
+		series, cached := seriesCacheByQuery[seriesQueryFor(namer)]
+		if !cached && partial {
+			// e.g. the shard running this query hasn't published its results yet
+			klog.V(2).Infof("no series available yet for query %q, skipping it until the next relist", namer.Selector())
+			continue
+		}
 		if !cached {
 			return fmt.Errorf("unable to update list of all metrics: no metrics retrieved for query %q", namer.Selector())
 		}
-		newSeries[i] = namer.FilterSeries(series)
+		matched := namer.FilterSeries(series)
+		missing[namer.RuleName()] = append(missing[namer.RuleName()], naming.MissingOverrideLabels(namer, matched)...)
+		newSeries[i] = naming.FilterSeriesByValue(ctx, l.promClient, l.limiter, namer, matched)
+		seriesPerRule[namer.RuleName()] += len(newSeries[i])
 	}
 
 	klog.V(10).Infof("Set available metric list from Prometheus to: %v", newSeries)
 
-	return l.SetSeries(newSeries, l.namers)
+	ruleSeries.Reset()
+	for rule, count := range seriesPerRule {
+		ruleSeries.WithLabelValues(rule).Set(float64(count))
+	}
+	reportMissingOverrideLabels(missing)
+
+	if err := l.SetSeries(newSeries, namers); err != nil {
+		return err
+	}
+	if l.onUpdate != nil {
+		l.onUpdate()
+	}
+	return nil
+}
+
+// reportMissingOverrideLabels flags and warns about the labels mapped to
+// resources in the overrides of each rule which none of its series carry.
+func reportMissingOverrideLabels(missingPerRule map[string][]pmodel.LabelName) {
+	missingOverrideLabels.Reset()
+	for rule, missing := range missingPerRule {
+		for _, label := range missing {
+			missingOverrideLabels.WithLabelValues(rule, string(label)).Set(1)
+			klog.Warningf("rule %q maps label %q to a resource in resources.overrides, but none of the series it discovered carry it", rule, label)
+		}
+	}
+}
+
+func (l *cachingMetricsLister) HasSynced() bool {
+	return l.synced.Load()
 }
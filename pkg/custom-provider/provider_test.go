@@ -17,13 +17,20 @@ limitations under the License.
 package provider
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	pmodel "github.com/prometheus/common/model"
 
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	fakedyn "k8s.io/client-go/dynamic/fake"
 
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
@@ -32,12 +39,45 @@ import (
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
 	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
 	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
 )
 
+// concurrencyCountingClient records the number of queries run through it, and
+// the maximum number of them in flight at once.
+type concurrencyCountingClient struct {
+	prom.Client
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	queries     int
+}
+
+func (c *concurrencyCountingClient) Query(ctx context.Context, t pmodel.Time, query prom.Selector) (prom.QueryResult, error) {
+	c.mu.Lock()
+	c.queries++
+	c.inFlight++
+	c.maxInFlight = max(c.maxInFlight, c.inFlight)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.inFlight--
+		c.mu.Unlock()
+	}()
+
+	// give the other chunks a chance to run concurrently
+	time.Sleep(10 * time.Millisecond)
+	return c.Client.Query(ctx, t, query)
+}
+
 const fakeProviderUpdateInterval = 2 * time.Second
 const fakeProviderStartDuration = 2 * time.Second
 
 func setupPrometheusProvider() (provider.CustomMetricsProvider, *fakeprom.FakePrometheusClient) {
+	return setupPrometheusProviderWithQueryInErrors(false)
+}
+
+func setupPrometheusProviderWithQueryInErrors(exposeQueryInErrors bool) (provider.CustomMetricsProvider, *fakeprom.FakePrometheusClient) {
 	fakeProm := &fakeprom.FakePrometheusClient{}
 	fakeKubeClient := &fakedyn.FakeDynamicClient{}
 
@@ -45,7 +85,15 @@ func setupPrometheusProvider() (provider.CustomMetricsProvider, *fakeprom.FakePr
 	namers, err := naming.NamersFromConfig(cfg.Rules, restMapper())
 	Expect(err).NotTo(HaveOccurred())
 
-	prov, _ := NewPrometheusProvider(restMapper(), fakeKubeClient, fakeProm, namers, fakeProviderUpdateInterval, fakeProviderStartDuration)
+	prov, _ := NewPrometheusProvider(Options{
+		Mapper:              restMapper(),
+		KubeClient:          fakeKubeClient,
+		Client:              fakeProm,
+		Namers:              namers,
+		UpdateInterval:      fakeProviderUpdateInterval,
+		MaxAge:              fakeProviderStartDuration,
+		ExposeQueryInErrors: exposeQueryInErrors,
+	})
 
 	containerSel := prom.MatchSeries("", prom.NameMatches("^container_.*"), prom.LabelNeq("container", "POD"), prom.LabelNeq("namespace", ""), prom.LabelNeq("pod", ""))
 	namespacedSel := prom.MatchSeries("", prom.LabelNeq("namespace", ""), prom.NameNotMatches("^container_.*"))
@@ -80,6 +128,96 @@ func setupPrometheusProvider() (provider.CustomMetricsProvider, *fakeprom.FakePr
 }
 
 var _ = Describe("Custom Metrics Provider", func() {
+	It("should relist as often as the most frequent rule requires", func() {
+		prov, _ := setupPrometheusProvider()
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		Expect(lister.relistPeriod()).To(Equal(fakeProviderUpdateInterval))
+
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		rules := cfg.Rules[:1]
+		rules[0].RelistInterval = pmodel.Duration(fakeProviderUpdateInterval / 10)
+		namers, err := naming.NamersFromConfig(rules, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		lister.namers = namers
+		Expect(lister.relistPeriod()).To(Equal(fakeProviderUpdateInterval / 10))
+	})
+
+	It("should relist metrics when the namers are replaced", func() {
+		By("setting up the provider")
+		prov, fakeProm := setupPrometheusProvider()
+		startTime := pmodel.Now().Add(-1*fakeProviderUpdateInterval - fakeProviderUpdateInterval/10)
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: startTime, End: 0}
+
+		By("replacing the namers with only the container rules")
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		namers, err := naming.NamersFromConfig(cfg.Rules[:3], restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		Expect(lister.SetNamers(namers)).To(Succeed())
+
+		By("checking that only the container metrics are listed")
+		Expect(prov.ListAllMetrics()).To(ConsistOf(
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "some_usage"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_usage"},
+		))
+	})
+
+	It("should only serve the metrics of prepared namers once they're applied", func() {
+		By("setting up the provider")
+		prov, fakeProm := setupPrometheusProvider()
+		startTime := pmodel.Now().Add(-1*fakeProviderUpdateInterval - fakeProviderUpdateInterval/10)
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: startTime, End: 0}
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		namers, err := naming.NamersFromConfig(cfg.Rules, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lister.SetNamers(namers)).To(Succeed())
+		allMetrics := prov.ListAllMetrics()
+
+		By("preparing only the container rules")
+		containerNamers, err := naming.NamersFromConfig(cfg.Rules[:3], restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		apply, err := lister.PrepareNamers(containerNamers)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("checking that the metrics of the current rules are still served, until applied")
+		Expect(lister.updateMetrics()).To(Succeed())
+		Expect(prov.ListAllMetrics()).To(ConsistOf(allMetrics))
+		Expect(apply()).To(Succeed())
+		Expect(prov.ListAllMetrics()).To(HaveLen(2))
+
+		By("checking that namers whose series can't be listed are rejected")
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: pmodel.Now(), End: 0}
+		_, err = lister.PrepareNamers(namers)
+		Expect(err).To(MatchError(ContainSubstring("outside range")))
+		Expect(prov.ListAllMetrics()).To(HaveLen(2))
+	})
+
+	It("should list the series of rules overriding the max age that far back", func() {
+		By("setting up the provider")
+		prov, fakeProm := setupPrometheusProvider()
+		startTime := pmodel.Now().Add(-1*fakeProviderStartDuration - fakeProviderStartDuration/10)
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: startTime, End: 0}
+
+		By("overriding the max age of the container rules")
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		rules := cfg.Rules[:3]
+		for i := range rules {
+			rules[i].MaxAge = pmodel.Duration(time.Hour)
+		}
+		namers, err := naming.NamersFromConfig(rules, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+
+		By("checking that the series are listed an hour back")
+		Expect(lister.SetNamers(namers)).To(MatchError(ContainSubstring("outside range")))
+		fakeProm.AcceptableInterval.Start = pmodel.Now().Add(-1*time.Hour - time.Minute)
+		Expect(lister.SetNamers(namers)).To(Succeed())
+		Expect(prov.ListAllMetrics()).To(ContainElement(
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_usage"},
+		))
+	})
+
 	It("should be able to list all metrics", func() {
 		By("setting up the provider")
 		prov, fakeProm := setupPrometheusProvider()
@@ -110,4 +248,276 @@ var _ = Describe("Custom Metrics Provider", func() {
 			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_usage"},
 		))
 	})
+
+	It("should include the rendered query in NotFound errors when requested", func() {
+		By("setting up the provider")
+		prov, fakeProm := setupPrometheusProviderWithQueryInErrors(true)
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+
+		By("updating the list of available metrics")
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		By("fetching a metric for which Prometheus returns no data")
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "service_proxy_packets"}
+		_, err := prov.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "somens", Name: "somesvc"}, info, labels.Everything())
+		Expect(apierr.IsNotFound(err)).To(BeTrue())
+
+		By("checking that the error carries the query")
+		expectedQuery := `sum(service_proxy_packets{namespace="somens",service="somesvc"}) by (service)`
+		status := err.(apierr.APIStatus).Status()
+		Expect(status.Message).To(ContainSubstring(expectedQuery))
+		Expect(status.Details).NotTo(BeNil())
+		Expect(status.Details.Causes).To(ContainElement(metav1.StatusCause{Type: QueryCauseType, Message: expectedQuery}))
+	})
+
+	It("should name the rule of a metric in errors when requested", func() {
+		By("setting up the provider")
+		prov, fakeProm := setupPrometheusProvider()
+		prov.(*prometheusProvider).exposeRuleInErrors = true
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+
+		By("updating the list of available metrics")
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		By("fetching a metric for which the query fails")
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "service_proxy_packets"}
+		fakeProm.ErrQueries = map[prom.Selector]error{
+			`sum(service_proxy_packets{namespace="somens",service="somesvc"}) by (service)`: fmt.Errorf("query timed out"),
+		}
+		_, err := prov.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "somens", Name: "somesvc"}, info, labels.Everything())
+		Expect(apierr.IsInternalError(err)).To(BeTrue())
+
+		By("checking that the error names the rule")
+		rule, found := lister.RuleForMetric(info)
+		Expect(found).To(BeTrue())
+		Expect(rule).To(Equal("gauge"))
+		status := err.(apierr.APIStatus).Status()
+		Expect(status.Message).To(ContainSubstring(rule))
+		Expect(status.Details).NotTo(BeNil())
+		Expect(status.Details.Causes).To(ContainElement(metav1.StatusCause{Type: naming.RuleCauseType, Message: rule}))
+	})
+
+	It("should serve sample timestamps, and treat samples past the cutoff as missing", func() {
+		By("setting up the provider with a cutoff")
+		prov, fakeProm := setupPrometheusProvider()
+		prov.(*prometheusProvider).staleSampleCutoff = time.Minute
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+
+		By("updating the list of available metrics")
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "service_proxy_packets"}
+		name := types.NamespacedName{Namespace: "somens", Name: "somesvc"}
+		query := prom.Selector(`sum(service_proxy_packets{namespace="somens",service="somesvc"}) by (service)`)
+		setSampleTime := func(ts pmodel.Time) {
+			fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+				query: {
+					Type: pmodel.ValVector,
+					Vector: &pmodel.Vector{
+						&pmodel.Sample{Metric: pmodel.Metric{"service": "somesvc"}, Value: 2.0, Timestamp: ts},
+					},
+				},
+			}
+		}
+
+		By("fetching a fresh sample")
+		sampleTime := pmodel.Now().Add(-30 * time.Second)
+		setSampleTime(sampleTime)
+		value, err := prov.GetMetricByName(context.Background(), name, info, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.Timestamp.Time).To(Equal(sampleTime.Time()))
+
+		By("fetching a stale sample")
+		setSampleTime(pmodel.Now().Add(-2 * time.Minute))
+		_, err = prov.GetMetricByName(context.Background(), name, info, labels.Everything())
+		Expect(apierr.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should attach the selector labels of the rule to the selectors of metric values", func() {
+		By("setting up the provider with rules attaching the protocol and path labels")
+		prov, fakeProm := setupPrometheusProvider()
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		for i := range cfg.Rules {
+			cfg.Rules[i].SelectorLabels = []string{"protocol", "path"}
+		}
+		namers, err := naming.NamersFromConfig(cfg.Rules, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		Expect(lister.SetNamers(namers)).To(Succeed())
+
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "service_proxy_packets"}
+		name := types.NamespacedName{Namespace: "somens", Name: "somesvc"}
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			`sum(service_proxy_packets{namespace="somens",service="somesvc"}) by (service)`: {
+				Type: pmodel.ValVector,
+				Vector: &pmodel.Vector{
+					// paths aren't valid label values, so they're left out
+					&pmodel.Sample{Metric: pmodel.Metric{"service": "somesvc", "protocol": "tcp", "path": "/api/v1"}, Value: 2.0},
+				},
+			},
+		}
+
+		By("fetching the metric")
+		value, err := prov.GetMetricByName(context.Background(), name, info, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.Metric.Selector).To(Equal(&metav1.LabelSelector{MatchLabels: map[string]string{"protocol": "tcp"}}))
+	})
+
+	It("should fail requests for one object with several identities unless the metric selector picks one", func() {
+		By("setting up the provider with rules identifying values by protocol")
+		prov, fakeProm := setupPrometheusProvider()
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		for i := range cfg.Rules {
+			cfg.Rules[i].Resources.IdentityLabels = []string{"protocol"}
+		}
+		namers, err := naming.NamersFromConfig(cfg.Rules, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		Expect(lister.SetNamers(namers)).To(Succeed())
+
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "service_proxy_packets"}
+		name := types.NamespacedName{Namespace: "somens", Name: "somesvc"}
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			`sum(service_proxy_packets{namespace="somens",service="somesvc"}) by (service,protocol)`: {
+				Type: pmodel.ValVector,
+				Vector: &pmodel.Vector{
+					&pmodel.Sample{Metric: pmodel.Metric{"service": "somesvc", "protocol": "tcp"}, Value: 2.0},
+					&pmodel.Sample{Metric: pmodel.Metric{"service": "somesvc", "protocol": "udp"}, Value: 3.0},
+				},
+			},
+			`sum(service_proxy_packets{protocol="udp",namespace="somens",service="somesvc"}) by (service,protocol)`: {
+				Type: pmodel.ValVector,
+				Vector: &pmodel.Vector{
+					&pmodel.Sample{Metric: pmodel.Metric{"service": "somesvc", "protocol": "udp"}, Value: 3.0},
+				},
+			},
+		}
+
+		By("fetching the metric without picking a protocol")
+		_, err = prov.GetMetricByName(context.Background(), name, info, labels.Everything())
+		Expect(apierr.IsBadRequest(err)).To(BeTrue(), "expected a BadRequest error, got %v", err)
+		Expect(err.Error()).To(ContainSubstring("one for each value of protocol"))
+
+		By("fetching the metric for one protocol")
+		value, err := prov.GetMetricByName(context.Background(), name, info, labels.SelectorFromSet(labels.Set{"protocol": "udp"}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.Value.Value()).To(Equal(int64(3)))
+	})
+
+	It("should split queries for many objects into chunks, and merge their results", func() {
+		By("setting up the provider with a chunk size of 2")
+		prov, fakeProm := setupPrometheusProvider()
+		prov.(*prometheusProvider).queryChunkSize = 2
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+
+		By("updating the list of available metrics")
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		By("fetching the metric for three services")
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "service_proxy_packets"}
+		sample := func(svc string, value pmodel.SampleValue) prom.QueryResult {
+			return prom.QueryResult{
+				Type:   pmodel.ValVector,
+				Vector: &pmodel.Vector{&pmodel.Sample{Metric: pmodel.Metric{"service": pmodel.LabelValue(svc)}, Value: value}},
+			}
+		}
+		firstQuery := prom.Selector(`sum(service_proxy_packets{namespace="somens",service=~"svc-a|svc-b"}) by (service)`)
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			firstQuery: sample("svc-a", 1),
+			`sum(service_proxy_packets{namespace="somens",service="svc-c"}) by (service)`: sample("svc-c", 3),
+		}
+		values, query, err := prov.(*prometheusProvider).buildQuery(context.Background(), info, "somens", labels.Everything(), "svc-a", "svc-b", "svc-c")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(query).To(Equal(firstQuery))
+		Expect(values).To(HaveLen(2))
+		Expect(values[0].Metric["service"]).To(Equal(pmodel.LabelValue("svc-a")))
+		Expect(values[1].Metric["service"]).To(Equal(pmodel.LabelValue("svc-c")))
+
+		By("failing when any chunk fails")
+		fakeProm.ErrQueries = map[prom.Selector]error{
+			`sum(service_proxy_packets{namespace="somens",service="svc-c"}) by (service)`: fmt.Errorf("query timed out"),
+		}
+		_, _, err = prov.(*prometheusProvider).buildQuery(context.Background(), info, "somens", labels.Everything(), "svc-a", "svc-b", "svc-c")
+		Expect(apierr.IsInternalError(err)).To(BeTrue())
+	})
+
+	It("should bound the number of chunks queried at once, and stop after the first failure", func() {
+		By("setting up the provider with a chunk size of 1 and a chunk concurrency of 2")
+		prov, fakeProm := setupPrometheusProvider()
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+		counting := &concurrencyCountingClient{Client: fakeProm}
+		prov.(*prometheusProvider).executor = queryplan.NewExecutor(counting)
+		prov.(*prometheusProvider).queryChunkSize = 1
+		prov.(*prometheusProvider).queryChunkConcurrency = 2
+
+		By("updating the list of available metrics")
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		By("fetching the metric for five services")
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "service_proxy_packets"}
+		services := []string{"svc-a", "svc-b", "svc-c", "svc-d", "svc-e"}
+		_, _, err := prov.(*prometheusProvider).buildQuery(context.Background(), info, "somens", labels.Everything(), services...)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counting.queries).To(Equal(5))
+		Expect(counting.maxInFlight).To(Equal(2))
+
+		By("not querying the remaining chunks once the first one failed")
+		counting.queries = 0
+		prov.(*prometheusProvider).queryChunkConcurrency = 1
+		fakeProm.ErrQueries = map[prom.Selector]error{
+			`sum(service_proxy_packets{namespace="somens",service="svc-a"}) by (service)`: fmt.Errorf("query timed out"),
+		}
+		_, query, err := prov.(*prometheusProvider).buildQuery(context.Background(), info, "somens", labels.Everything(), services...)
+		Expect(apierr.IsInternalError(err)).To(BeTrue())
+		Expect(query).To(Equal(prom.Selector(`sum(service_proxy_packets{namespace="somens",service="svc-a"}) by (service)`)))
+		Expect(counting.queries).To(Equal(1))
+	})
+
+	It("should push label selectors down to the query when the rule maps their labels", func() {
+		By("setting up the provider with rules mapping the app label")
+		prov, fakeProm := setupPrometheusProvider()
+		prov.(*prometheusProvider).selectorPushdown = true
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		for i := range cfg.Rules {
+			cfg.Rules[i].Resources.ObjectLabels = map[string]string{"app": "label_app"}
+		}
+		namers, err := naming.NamersFromConfig(cfg.Rules, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		Expect(lister.SetNamers(namers)).To(Succeed())
+
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "service_proxy_packets"}
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			`sum(service_proxy_packets{label_app="web",namespace="somens",service!=""}) by (service)`: {
+				Type: pmodel.ValVector,
+				Vector: &pmodel.Vector{
+					&pmodel.Sample{Metric: pmodel.Metric{"service": "web-b"}, Value: 2.0},
+					&pmodel.Sample{Metric: pmodel.Metric{"service": "web-a"}, Value: 1.0},
+				},
+			},
+		}
+
+		By("fetching the metric for the services matching the selector, without listing them")
+		selector, err := labels.Parse("app=web")
+		Expect(err).NotTo(HaveOccurred())
+		values, err := prov.GetMetricBySelector(context.Background(), "somens", selector, info, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(values.Items).To(HaveLen(2))
+		Expect(values.Items[0].DescribedObject.Name).To(Equal("web-a"))
+		Expect(values.Items[1].DescribedObject.Name).To(Equal("web-b"))
+
+		By("falling back to listing the objects for selectors on other labels")
+		selector, err = labels.Parse("tier=frontend")
+		Expect(err).NotTo(HaveOccurred())
+		_, found := prov.(*prometheusProvider).PlanForSelector(info, "somens", selector, labels.Everything())
+		Expect(found).To(BeFalse())
+	})
 })
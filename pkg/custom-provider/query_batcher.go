@@ -0,0 +1,127 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// queryBatchKey identifies the requests which may be answered by a single query,
+// i.e. those for the same metric in the same namespace, differing only in the
+// objects they're about.
+type queryBatchKey struct {
+	info           provider.CustomMetricInfo
+	namespace      string
+	metricSelector string
+}
+
+// queryBatch collects the names of the objects requested for a given key,
+// until its query is run.
+type queryBatch struct {
+	names map[string]struct{}
+
+	// done is closed once the query has run, and the fields below are set
+	done   chan struct{}
+	values pmodel.Vector
+	query  prom.Selector
+	err    error
+}
+
+// batchRunner runs a query for the given object names.
+type batchRunner func(ctx context.Context, names []string) (pmodel.Vector, prom.Selector, error)
+
+// queryBatcher coalesces requests for the same metric arriving within a short
+// window into a single query, matching all of the objects they're about.  This
+// saves issuing one query per object when many HPAs target the same metric.
+type queryBatcher struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[queryBatchKey]*queryBatch
+}
+
+// newQueryBatcher creates a queryBatcher collecting requests over the given
+// window.  A non-positive window disables batching, and returns nil.
+func newQueryBatcher(window time.Duration) *queryBatcher {
+	if window <= 0 {
+		return nil
+	}
+	return &queryBatcher{
+		window:  window,
+		pending: make(map[queryBatchKey]*queryBatch),
+	}
+}
+
+// execute adds the given names to the pending batch for the key, starting a new
+// one if needed, and waits for its query to run.  The results cover every object
+// in the batch, so callers must pick out the ones they asked for.  It's safe to
+// call on a nil batcher, which runs a query for just the given names.
+func (b *queryBatcher) execute(ctx context.Context, key queryBatchKey, names []string, run batchRunner) (pmodel.Vector, prom.Selector, error) {
+	if b == nil {
+		return run(ctx, names)
+	}
+
+	b.mu.Lock()
+	batch, found := b.pending[key]
+	if !found {
+		batch = &queryBatch{
+			names: make(map[string]struct{}, len(names)),
+			done:  make(chan struct{}),
+		}
+		b.pending[key] = batch
+		// the batch outlives the request starting it, so it mustn't be
+		// cancelled along with it
+		go b.runAfterWindow(context.WithoutCancel(ctx), key, batch, run)
+	}
+	for _, name := range names {
+		batch.names[name] = struct{}{}
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-batch.done:
+		return batch.values, batch.query, batch.err
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
+}
+
+func (b *queryBatcher) runAfterWindow(ctx context.Context, key queryBatchKey, batch *queryBatch, run batchRunner) {
+	time.Sleep(b.window)
+
+	b.mu.Lock()
+	delete(b.pending, key)
+	names := make([]string, 0, len(batch.names))
+	for name := range batch.names {
+		names = append(names, name)
+	}
+	b.mu.Unlock()
+
+	// keep the query stable for a given set of objects
+	sort.Strings(names)
+	batch.values, batch.query, batch.err = run(ctx, names)
+	close(batch.done)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+var _ = Describe("Query Batcher", func() {
+	var (
+		mu      sync.Mutex
+		queries [][]string
+	)
+
+	run := func(ctx context.Context, names []string) (pmodel.Vector, prom.Selector, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		queries = append(queries, names)
+		var values pmodel.Vector
+		for _, name := range names {
+			values = append(values, &pmodel.Sample{Metric: pmodel.Metric{"pod": pmodel.LabelValue(name)}, Value: 1.0})
+		}
+		return values, prom.Selector("some_metric{pod=~\"" + strings.Join(names, "|") + "\"}"), nil
+	}
+	keyFor := func(metric string) queryBatchKey {
+		return queryBatchKey{
+			info: provider.CustomMetricInfo{
+				GroupResource: schema.GroupResource{Resource: "pods"},
+				Namespaced:    true,
+				Metric:        metric,
+			},
+			namespace: "somens",
+		}
+	}
+
+	BeforeEach(func() {
+		queries = nil
+	})
+
+	It("should run a query per request when disabled", func() {
+		batcher := newQueryBatcher(0)
+		Expect(batcher).To(BeNil())
+
+		for _, name := range []string{"pod1", "pod2"} {
+			_, _, err := batcher.execute(context.Background(), keyFor("some_metric"), []string{name}, run)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(queries).To(Equal([][]string{{"pod1"}, {"pod2"}}))
+	})
+
+	It("should answer concurrent requests for the same metric with a single query", func() {
+		batcher := newQueryBatcher(200 * time.Millisecond)
+
+		var wg sync.WaitGroup
+		results := make([]prom.Selector, 3)
+		for i, names := range [][]string{{"pod3"}, {"pod1", "pod2"}, {"pod2"}} {
+			wg.Add(1)
+			go func(i int, names []string) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				values, query, err := batcher.execute(context.Background(), keyFor("some_metric"), names, run)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(values).To(HaveLen(3))
+				results[i] = query
+			}(i, names)
+		}
+		wg.Wait()
+
+		Expect(queries).To(Equal([][]string{{"pod1", "pod2", "pod3"}}))
+		Expect(results).To(ConsistOf(
+			prom.Selector(`some_metric{pod=~"pod1|pod2|pod3"}`),
+			prom.Selector(`some_metric{pod=~"pod1|pod2|pod3"}`),
+			prom.Selector(`some_metric{pod=~"pod1|pod2|pod3"}`),
+		))
+	})
+
+	It("should not batch requests for different metrics", func() {
+		batcher := newQueryBatcher(10 * time.Millisecond)
+
+		var wg sync.WaitGroup
+		for _, metric := range []string{"some_metric", "other_metric"} {
+			wg.Add(1)
+			go func(metric string) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				_, _, err := batcher.execute(context.Background(), keyFor(metric), []string{"pod1"}, run)
+				Expect(err).NotTo(HaveOccurred())
+			}(metric)
+		}
+		wg.Wait()
+
+		Expect(queries).To(HaveLen(2))
+	})
+
+	It("should stop waiting when the request is cancelled", func() {
+		batcher := newQueryBatcher(time.Hour)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err := batcher.execute(ctx, keyFor("some_metric"), []string{"pod1"}, run)
+		Expect(err).To(MatchError(context.Canceled))
+	})
+})
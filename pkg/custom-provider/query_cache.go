@@ -0,0 +1,138 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+)
+
+type queryCacheKey struct {
+	backend    string
+	headers    string
+	query      prom.Selector
+	queryRange queryplan.Range
+}
+
+type queryCacheEntry struct {
+	// done is closed once the query has completed, and result and err are set
+	done    chan struct{}
+	result  prom.QueryResult
+	err     error
+	expires time.Time
+}
+
+func (e *queryCacheEntry) completed() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// queryCache shares the results of identical queries run within a short
+// period of time, so that a burst of requests for the same metric (e.g. from
+// many HPAs) results in a single query to Prometheus.  Concurrent identical
+// queries wait for the first one to complete.  Failed queries aren't cached.
+type queryCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[queryCacheKey]*queryCacheEntry
+	nextSweep time.Time
+}
+
+// newQueryCache creates a queryCache keeping results for the given TTL.  A
+// non-positive TTL disables caching, and returns nil.
+func newQueryCache(ttl time.Duration) *queryCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &queryCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[queryCacheKey]*queryCacheEntry),
+	}
+}
+
+// execute returns the cached result of the given plan, if any, and otherwise
+// runs it using the given function.  It's safe to call on a nil cache, which
+// always runs the plan.
+func (c *queryCache) execute(ctx context.Context, plan *queryplan.Plan, run func(context.Context, *queryplan.Plan) (prom.QueryResult, error)) (prom.QueryResult, error) {
+	if c == nil {
+		return run(ctx, plan)
+	}
+	key := queryCacheKey{backend: plan.Backend, headers: prom.HeadersKey(plan.Headers), query: plan.Query, queryRange: plan.Range}
+
+	c.mu.Lock()
+	now := c.now()
+	entry, found := c.entries[key]
+	if found && entry.completed() && !now.Before(entry.expires) {
+		found = false
+	}
+	if found {
+		c.mu.Unlock()
+		queryCacheRequests.WithLabelValues("hit").Inc()
+		select {
+		case <-entry.done:
+			return entry.result, entry.err
+		case <-ctx.Done():
+			return prom.QueryResult{}, ctx.Err()
+		}
+	}
+
+	entry = &queryCacheEntry{done: make(chan struct{})}
+	c.entries[key] = entry
+	c.sweepLocked(now)
+	c.mu.Unlock()
+	queryCacheRequests.WithLabelValues("miss").Inc()
+
+	entry.result, entry.err = run(ctx, plan)
+
+	c.mu.Lock()
+	if entry.err != nil {
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+	} else {
+		entry.expires = c.now().Add(c.ttl)
+	}
+	c.mu.Unlock()
+	close(entry.done)
+
+	return entry.result, entry.err
+}
+
+// sweepLocked removes expired entries, at most once per TTL.  It must be
+// called with mu held.
+func (c *queryCache) sweepLocked(now time.Time) {
+	if now.Before(c.nextSweep) {
+		return
+	}
+	for key, entry := range c.entries {
+		if entry.completed() && !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.nextSweep = now.Add(c.ttl)
+}
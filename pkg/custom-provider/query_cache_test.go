@@ -0,0 +1,155 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+)
+
+var _ = Describe("Query Cache", func() {
+	var (
+		cache *queryCache
+		now   time.Time
+		calls int
+		mu    sync.Mutex
+		plan  *queryplan.Plan
+	)
+
+	result := prom.QueryResult{
+		Type: pmodel.ValVector,
+		Vector: &pmodel.Vector{
+			&pmodel.Sample{Metric: pmodel.Metric{"pod": "somepod"}, Value: 1.0},
+		},
+	}
+	run := func(ctx context.Context, plan *queryplan.Plan) (prom.QueryResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return result, nil
+	}
+
+	BeforeEach(func() {
+		now = time.Unix(1000, 0)
+		calls = 0
+		cache = newQueryCache(time.Minute)
+		cache.now = func() time.Time { return now }
+		plan = &queryplan.Plan{Query: prom.Selector("sum(some_metric)")}
+	})
+
+	It("should be disabled by a zero TTL", func() {
+		cache = newQueryCache(0)
+		Expect(cache).To(BeNil())
+
+		By("running every query")
+		for i := 0; i < 2; i++ {
+			res, err := cache.execute(context.Background(), plan, run)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(result))
+		}
+		Expect(calls).To(Equal(2))
+	})
+
+	It("should share the results of identical queries until they expire", func() {
+		By("running the query the first time")
+		_, err := cache.execute(context.Background(), plan, run)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("reusing the result within the TTL")
+		now = now.Add(59 * time.Second)
+		res, err := cache.execute(context.Background(), plan, run)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(result))
+		Expect(calls).To(Equal(1))
+
+		By("running a different query")
+		_, err = cache.execute(context.Background(), &queryplan.Plan{Query: prom.Selector("sum(other_metric)")}, run)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(calls).To(Equal(2))
+
+		By("running the same query against a different backend")
+		_, err = cache.execute(context.Background(), &queryplan.Plan{Query: plan.Query, Backend: "other"}, run)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(calls).To(Equal(3))
+
+		By("running the query again once the result expires")
+		now = now.Add(time.Second)
+		_, err = cache.execute(context.Background(), plan, run)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(calls).To(Equal(4))
+	})
+
+	It("should not cache failed queries", func() {
+		failing := func(ctx context.Context, plan *queryplan.Plan) (prom.QueryResult, error) {
+			calls++
+			return prom.QueryResult{}, fmt.Errorf("connection refused")
+		}
+		for i := 0; i < 2; i++ {
+			_, err := cache.execute(context.Background(), plan, failing)
+			Expect(err).To(HaveOccurred())
+		}
+		Expect(calls).To(Equal(2))
+
+		_, err := cache.execute(context.Background(), plan, run)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(calls).To(Equal(3))
+	})
+
+	It("should make concurrent identical queries wait for the first one", func() {
+		release := make(chan struct{})
+		started := make(chan struct{})
+		blocking := func(ctx context.Context, plan *queryplan.Plan) (prom.QueryResult, error) {
+			close(started)
+			<-release
+			return run(ctx, plan)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			_, err := cache.execute(context.Background(), plan, blocking)
+			Expect(err).NotTo(HaveOccurred())
+		}()
+		<-started
+
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				res, err := cache.execute(context.Background(), plan, run)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(res).To(Equal(result))
+			}()
+		}
+		close(release)
+		wg.Wait()
+
+		Expect(calls).To(Equal(1))
+	})
+})
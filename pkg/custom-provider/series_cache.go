@@ -0,0 +1,87 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SeriesCache persists the series discovered by the last relist, so that a
+// restarted adapter can serve the metrics they produce right away, instead of
+// serving no metrics until its first relist completes.
+type SeriesCache interface {
+	// Save replaces the saved series.
+	Save(series []SharedSeries) error
+	// Load returns the saved series, or nil if there are none.
+	Load() ([]SharedSeries, error)
+}
+
+// fileSeriesCache is a SeriesCache keeping the series in a local file, encoded
+// as JSON.
+type fileSeriesCache struct {
+	filename string
+}
+
+// NewFileSeriesCache returns a SeriesCache keeping the series in the given file.
+func NewFileSeriesCache(filename string) SeriesCache {
+	return &fileSeriesCache{filename: filename}
+}
+
+// Save atomically replaces the contents of the file, so that a restart while
+// saving never leaves a partially-written file behind.
+func (c *fileSeriesCache) Save(series []SharedSeries) error {
+	data, err := json.Marshal(series)
+	if err != nil {
+		return fmt.Errorf("unable to encode series: %v", err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(c.filename), filepath.Base(c.filename)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary series cache file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("unable to write series cache: %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("unable to write series cache: %v", err)
+	}
+	if err := os.Rename(tmpFile.Name(), c.filename); err != nil {
+		return fmt.Errorf("unable to replace series cache file %q: %v", c.filename, err)
+	}
+	return nil
+}
+
+func (c *fileSeriesCache) Load() ([]SharedSeries, error) {
+	data, err := os.ReadFile(c.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read series cache file %q: %v", c.filename, err)
+	}
+	var series []SharedSeries
+	if err := json.Unmarshal(data, &series); err != nil {
+		return nil, fmt.Errorf("unable to decode series cache file %q: %v", c.filename, err)
+	}
+	return series, nil
+}
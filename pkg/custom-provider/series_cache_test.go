@@ -0,0 +1,74 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+)
+
+var _ = Describe("Series cache", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "series-cache")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should load nothing if the file doesn't exist yet", func() {
+		cache := NewFileSeriesCache(filepath.Join(dir, "series.json"))
+		Expect(cache.Load()).To(BeNil())
+	})
+
+	It("should fail to load a corrupted file", func() {
+		filename := filepath.Join(dir, "series.json")
+		Expect(os.WriteFile(filename, []byte("{not json"), 0644)).To(Succeed())
+		_, err := NewFileSeriesCache(filename).Load()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should serve the metrics of the saved series before the first relist", func() {
+		cache := NewFileSeriesCache(filepath.Join(dir, "series.json"))
+
+		By("relisting and saving the series")
+		prov, fakeProm := setupPrometheusProvider()
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		lister.seriesCache = cache
+		Expect(lister.updateMetrics()).To(Succeed())
+		Expect(prov.ListAllMetrics()).NotTo(BeEmpty())
+
+		By("loading the saved series in a provider which hasn't relisted yet")
+		restarted, _ := setupPrometheusProvider()
+		restartedLister := restarted.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		restartedLister.seriesCache = cache
+		Expect(restartedLister.HasSynced()).To(BeFalse())
+		restartedLister.loadCachedSeries()
+
+		Expect(restartedLister.HasSynced()).To(BeTrue())
+		Expect(restarted.ListAllMetrics()).To(ConsistOf(prov.ListAllMetrics()))
+	})
+})
@@ -18,18 +18,24 @@ package provider
 
 import (
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
 
 	pmodel "github.com/prometheus/common/model"
 
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
 
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
 	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
 )
 
 // NB: container metrics sourced from cAdvisor don't consistently follow naming conventions,
@@ -55,14 +61,41 @@ type SeriesRegistry interface {
 	// SeriesForMetric looks up the minimum required series information to make a query for the given metric
 	// against the given resource (namespace may be empty for non-namespaced resources)
 	QueryForMetric(info provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, resourceNames ...string) (query prom.Selector, found bool)
-	// MatchValuesToNames matches result values to resource names for the given metric and value set
-	MatchValuesToNames(metricInfo provider.CustomMetricInfo, values pmodel.Vector) (matchedValues map[string]pmodel.SampleValue, found bool)
+	// PlanForMetric is like QueryForMetric, but returns the full query plan.
+	PlanForMetric(info provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, resourceNames ...string) (plan *queryplan.Plan, found bool)
+	// PlanForSelector returns the plan of a query for the given metric of all
+	// the objects matching the given label selector, translated into matchers
+	// on series labels (see naming.MetricNamer.ObjectSelectorRequirements).
+	// It returns false if the metric is unknown, or the selector can't be
+	// translated, in which case the matching objects have to be listed.
+	PlanForSelector(info provider.CustomMetricInfo, namespace string, selector labels.Selector, metricSelector labels.Selector) (plan *queryplan.Plan, found bool)
+	// RuleForMetric returns the name of the rule (see naming.MetricNamer.RuleName)
+	// the given metric comes from.
+	RuleForMetric(info provider.CustomMetricInfo) (rule string, found bool)
+	// SelectorLabelsForMetric returns the labels of the query results attached
+	// to the selectors of the values of the given metric (see
+	// naming.MetricNamer.SelectorLabels).
+	SelectorLabelsForMetric(info provider.CustomMetricInfo) []string
+	// ValueConversionForMetric returns how the values of the given metric are
+	// converted into quantities (see naming.MetricNamer.ValueConversion).
+	ValueConversionForMetric(info provider.CustomMetricInfo) queryplan.ValueConversion
+	// MatchValuesToNames matches result samples to resource names for the given metric and value set.
+	// Each resource has a sample per combination of the values of the rule's
+	// identity labels (see naming.MetricNamer.IdentityLabels), and so a single
+	// one unless the rule has some.  Several samples for the same resource and
+	// identity are combined according to the rule's duplicate samples policy
+	// (see naming.MetricNamer.DuplicateSamples), which makes it fail if they
+	// aren't allowed.
+	MatchValuesToNames(metricInfo provider.CustomMetricInfo, values pmodel.Vector) (matchedValues map[string]pmodel.Vector, found bool, err error)
 }
 
 type seriesInfo struct {
 	// seriesName is the name of the corresponding Prometheus series
 	seriesName string
 
+	// nameLabels are the values of the series labels used in the metric name
+	nameLabels map[string]string
+
 	// namer is the MetricNamer used to name this series
 	namer naming.MetricNamer
 }
@@ -75,6 +108,19 @@ type basicSeriesRegistry struct {
 	info map[provider.CustomMetricInfo]seriesInfo
 	// metrics is the list of all known metrics
 	metrics []provider.CustomMetricInfo
+	// collisions are the metrics produced by several rules as of the last
+	// update, so that each collision is only logged once
+	collisions sets.Set[string]
+	// rejectCollisions makes updates producing colliding metrics fail,
+	// rather than serving each of these metrics from the last rule producing it
+	rejectCollisions bool
+	// plans caches the plans of the queries for the metrics, if enabled
+	plans *planCache
+	// unknownMetrics remembers the metrics recently found to be unknown, if
+	// enabled.  It's cleared along with plans.
+	unknownMetrics *unknownMetricCache
+	// failures is told about the queries which couldn't be built, if set
+	failures queryplan.FailureReporter
 
 	mapper apimeta.RESTMapper
 }
@@ -85,6 +131,8 @@ func (r *basicSeriesRegistry) SetSeries(newSeriesSlices [][]prom.Series, namers
 	}
 
 	newInfo := make(map[provider.CustomMetricInfo]seriesInfo)
+	// collidingRules are the rules producing each metric produced by several rules
+	collidingRules := make(map[string]sets.Set[string])
 	for i, newSeries := range newSeriesSlices {
 		namer := namers[i]
 		for _, series := range newSeries {
@@ -102,14 +150,24 @@ func (r *basicSeriesRegistry) SetSeries(newSeriesSlices [][]prom.Series, namers
 					Metric:        name,
 				}
 
-				// some metrics aren't counted as namespaced
-				if resource == naming.NsGroupResource || resource == naming.NodeGroupResource || resource == naming.PVGroupResource {
+				// metrics of cluster-scoped resources aren't counted as namespaced,
+				// even if their series have a namespace
+				if namer.ClusterScoped(resource) {
 					info.Namespaced = false
 				}
 
+				if existing, found := newInfo[info]; found && existing.namer != namer {
+					key := info.String()
+					if collidingRules[key] == nil {
+						collidingRules[key] = sets.New(existing.namer.RuleName())
+					}
+					collidingRules[key].Insert(namer.RuleName())
+				}
+
 				// we don't need to re-normalize, because the metric namer should have already normalized for us
 				newInfo[info] = seriesInfo{
 					seriesName: series.Name,
+					nameLabels: namer.NameLabelsForSeries(series),
 					namer:      namer,
 				}
 			}
@@ -125,8 +183,22 @@ func (r *basicSeriesRegistry) SetSeries(newSeriesSlices [][]prom.Series, namers
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	metricNameCollisions.Set(float64(len(collidingRules)))
+	collisions := sets.KeySet(collidingRules)
+	if len(collidingRules) > 0 && r.rejectCollisions {
+		r.collisions = collisions
+		return fmt.Errorf("several rules produce the same metrics, keeping the previous ones: %s", describeCollisions(collidingRules))
+	}
+	for _, key := range sets.List(collisions.Difference(r.collisions)) {
+		klog.Warningf("metric %s is produced by several rules (%s), serving it from the last one", key, strings.Join(sets.List(collidingRules[key]), ", "))
+	}
+	r.collisions = collisions
+
 	r.info = newInfo
 	r.metrics = newMetrics
+	r.plans.clear()
+	r.unknownMetrics.clear()
+	exposedMetrics.Set(float64(len(newMetrics)))
 
 	return nil
 }
@@ -139,64 +211,256 @@ func (r *basicSeriesRegistry) ListAllMetrics() []provider.CustomMetricInfo {
 }
 
 func (r *basicSeriesRegistry) QueryForMetric(metricInfo provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, resourceNames ...string) (prom.Selector, bool) {
+	plan, found := r.PlanForMetric(metricInfo, namespace, metricSelector, resourceNames...)
+	if !found {
+		return "", false
+	}
+	return plan.Query, true
+}
+
+func (r *basicSeriesRegistry) PlanForMetric(metricInfo provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, resourceNames ...string) (*queryplan.Plan, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	requested := metricInfo
 
 	if len(resourceNames) == 0 {
 		klog.Errorf("no resource names requested while producing a query for metric %s", metricInfo.String())
-		return "", false
+		return nil, false
 	}
 
 	metricInfo, _, err := metricInfo.Normalized(r.mapper)
 	if err != nil {
 		klog.Errorf("unable to normalize group resource while producing a query: %v", err)
-		return "", false
+		return nil, false
 	}
 
 	info, infoFound := r.info[metricInfo]
 	if !infoFound {
 		klog.V(10).Infof("metric %v not registered", metricInfo)
-		return "", false
+		return nil, false
+	}
+	if !namespacesAllowed(info.namer, metricInfo, namespace, resourceNames) {
+		klog.V(4).Infof("metric %v isn't served in namespace %q", metricInfo, namespace)
+		return nil, false
+	}
+
+	cacheKey := newPlanCacheKey(metricInfo, namespace, metricSelector, resourceNames)
+	if plan, found := r.plans.get(cacheKey, resourceNames); found {
+		return plan, true
+	}
+
+	metricSelector = naming.SelectorWithLabels(metricSelector, info.nameLabels)
+	plan, err := info.namer.PlanForSeries(info.seriesName, metricInfo.GroupResource, namespace, metricSelector, resourceNames...)
+	if err != nil {
+		r.reportBuildFailure(requested, info.namer.RuleName(), err)
+		return nil, false
+	}
+	r.plans.add(cacheKey, resourceNames, plan)
+
+	return plan, true
+}
+
+func (r *basicSeriesRegistry) PlanForSelector(metricInfo provider.CustomMetricInfo, namespace string, selector labels.Selector, metricSelector labels.Selector) (*queryplan.Plan, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	requested := metricInfo
+
+	metricInfo, _, err := metricInfo.Normalized(r.mapper)
+	if err != nil {
+		return nil, false
+	}
+	info, infoFound := r.info[metricInfo]
+	if !infoFound {
+		return nil, false
+	}
+	// namespaces are only filtered by name, so they always have to be listed
+	if metricInfo.GroupResource == naming.NsGroupResource || !info.namer.AllowsNamespace(namespace) {
+		return nil, false
 	}
 
-	query, err := info.namer.QueryForSeries(info.seriesName, metricInfo.GroupResource, namespace, metricSelector, resourceNames...)
+	requirements, translated := info.namer.ObjectSelectorRequirements(selector)
+	if !translated {
+		return nil, false
+	}
+	metricSelector = naming.SelectorWithLabels(metricSelector, info.nameLabels).Add(requirements...)
+	plan, err := info.namer.PlanForSeries(info.seriesName, metricInfo.GroupResource, namespace, metricSelector)
+	if err != nil {
+		r.reportBuildFailure(requested, info.namer.RuleName(), err)
+		return nil, false
+	}
+	return plan, true
+}
+
+// reportBuildFailure counts and reports that the query for the given metric,
+// from the given rule, couldn't be built.  Lookups of unknown metrics, or of
+// metrics which aren't served in the requested namespace, aren't failures.
+func (r *basicSeriesRegistry) reportBuildFailure(metricInfo provider.CustomMetricInfo, rule string, err error) {
+	queryBuildFailures.WithLabelValues(rule).Inc()
+	klog.Errorf("unable to construct query for metric %s: %v", metricInfo.String(), err)
+	if r.failures != nil {
+		r.failures.QueryFailed(custom_metrics.GroupName, metricInfo.String(), rule, err)
+	}
+}
+
+// describeCollisions lists the given colliding metrics, along with the rules
+// producing each of them.
+func describeCollisions(collidingRules map[string]sets.Set[string]) string {
+	descs := make([]string, 0, len(collidingRules))
+	for _, key := range sets.List(sets.KeySet(collidingRules)) {
+		descs = append(descs, fmt.Sprintf("%s (from %s)", key, strings.Join(sets.List(collidingRules[key]), ", ")))
+	}
+	return strings.Join(descs, "; ")
+}
+
+// namespacesAllowed checks whether the rule of the given metric allows serving it
+// for the given objects.  Metrics describing namespaces themselves are checked
+// against the namespaces they describe.
+func namespacesAllowed(namer naming.MetricNamer, info provider.CustomMetricInfo, namespace string, names []string) bool {
+	if namespace == "" && info.GroupResource == naming.NsGroupResource {
+		for _, name := range names {
+			if !namer.AllowsNamespace(name) {
+				return false
+			}
+		}
+		return true
+	}
+	return namer.AllowsNamespace(namespace)
+}
+
+func (r *basicSeriesRegistry) RuleForMetric(metricInfo provider.CustomMetricInfo) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	metricInfo, _, err := metricInfo.Normalized(r.mapper)
 	if err != nil {
-		klog.Errorf("unable to construct query for metric %s: %v", metricInfo.String(), err)
 		return "", false
 	}
 
-	return query, true
+	info, infoFound := r.info[metricInfo]
+	if !infoFound {
+		return "", false
+	}
+	return info.namer.RuleName(), true
 }
 
-func (r *basicSeriesRegistry) MatchValuesToNames(metricInfo provider.CustomMetricInfo, values pmodel.Vector) (matchedValues map[string]pmodel.SampleValue, found bool) {
+func (r *basicSeriesRegistry) SelectorLabelsForMetric(metricInfo provider.CustomMetricInfo) []string {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
 	metricInfo, _, err := metricInfo.Normalized(r.mapper)
+	if err != nil {
+		return nil
+	}
+
+	info, infoFound := r.info[metricInfo]
+	if !infoFound {
+		return nil
+	}
+	return info.namer.SelectorLabels()
+}
+
+func (r *basicSeriesRegistry) ValueConversionForMetric(metricInfo provider.CustomMetricInfo) queryplan.ValueConversion {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	metricInfo, _, err := metricInfo.Normalized(r.mapper)
+	if err != nil {
+		return queryplan.ValueConversion{}
+	}
+
+	info, infoFound := r.info[metricInfo]
+	if !infoFound {
+		return queryplan.ValueConversion{}
+	}
+	return info.namer.ValueConversion()
+}
+
+func (r *basicSeriesRegistry) MatchValuesToNames(metricInfo provider.CustomMetricInfo, values pmodel.Vector) (matchedValues map[string]pmodel.Vector, found bool, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	metricInfo, _, err = metricInfo.Normalized(r.mapper)
 	if err != nil {
 		klog.Errorf("unable to normalize group resource while matching values to names: %v", err)
-		return nil, false
+		return nil, false, nil
 	}
 
 	info, infoFound := r.info[metricInfo]
 	if !infoFound {
-		return nil, false
+		return nil, false, nil
 	}
 
 	resourceLbl, err := info.namer.LabelForResource(metricInfo.GroupResource)
 	if err != nil {
 		klog.Errorf("unable to construct resource label for metric %s: %v", metricInfo.String(), err)
-		return nil, false
+		return nil, false, nil
 	}
 
-	res := make(map[string]pmodel.SampleValue, len(values))
+	policy := info.namer.DuplicateSamples()
+	identityLabels := info.namer.IdentityLabels()
+	res := make(map[string]pmodel.Vector, len(values))
+	duplicates := 0
 	for _, val := range values {
 		if val == nil {
 			// skip empty values
 			continue
 		}
-		res[string(val.Metric[resourceLbl])] = val.Value
+		name := string(val.Metric[resourceLbl])
+		idx := slices.IndexFunc(res[name], func(prev *pmodel.Sample) bool {
+			return sameIdentity(prev, val, identityLabels)
+		})
+		if idx < 0 {
+			res[name] = append(res[name], val)
+			continue
+		}
+
+		duplicates++
+		if policy == config.DuplicateSamplesError {
+			duplicateSamples.WithLabelValues(info.namer.RuleName()).Add(float64(duplicates))
+			return nil, true, fmt.Errorf("got several samples for %s %q of metric %s", metricInfo.GroupResource.String(), name, metricInfo.Metric)
+		}
+		res[name][idx] = combineSamples(policy, res[name][idx], val)
+	}
+
+	if duplicates > 0 {
+		duplicateSamples.WithLabelValues(info.namer.RuleName()).Add(float64(duplicates))
+		klog.Warningf("got %d extra samples for the same objects when fetching metric %s, combined them using the %q policy of rule %s", duplicates, metricInfo.String(), policy, info.namer.RuleName())
 	}
 
-	return res, true
+	return res, true, nil
+}
+
+// sameIdentity checks whether the given samples for the same object have the
+// same values for the given identity labels (see naming.MetricNamer.IdentityLabels).
+func sameIdentity(a, b *pmodel.Sample, identityLabels []string) bool {
+	for _, label := range identityLabels {
+		if a.Metric[pmodel.LabelName(label)] != b.Metric[pmodel.LabelName(label)] {
+			return false
+		}
+	}
+	return true
+}
+
+// combineSamples returns the sample to keep for an object when a query
+// returns both of the given samples for it, according to the given duplicate
+// samples policy.
+func combineSamples(policy config.DuplicateSamplesPolicy, prev, cur *pmodel.Sample) *pmodel.Sample {
+	switch policy {
+	case config.DuplicateSamplesSum:
+		sum := *prev
+		sum.Value = prev.Value + cur.Value
+		return &sum
+	case config.DuplicateSamplesMax:
+		if cur.Value > prev.Value {
+			return cur
+		}
+		return prev
+	case config.DuplicateSamplesMin:
+		if cur.Value < prev.Value {
+			return cur
+		}
+		return prev
+	default:
+		return cur
+	}
 }
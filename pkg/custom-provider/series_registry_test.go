@@ -36,6 +36,7 @@ import (
 
 	config "sigs.k8s.io/prometheus-adapter/cmd/config-gen/utils"
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	adaptercfg "sigs.k8s.io/prometheus-adapter/pkg/config"
 	"sigs.k8s.io/prometheus-adapter/pkg/naming"
 )
 
@@ -140,6 +141,17 @@ func mustNewLabelRequirement(key string, op selection.Operator, vals []string) *
 	return req
 }
 
+// recordingFailureReporter records the metrics whose queries failed.
+type recordingFailureReporter struct {
+	failed []string
+}
+
+func (r *recordingFailureReporter) QueryFailed(_, metric, _ string, _ error) {
+	r.failed = append(r.failed, metric)
+}
+
+func (r *recordingFailureReporter) QuerySucceeded(_, _ string) {}
+
 var _ = Describe("Series Registry", func() {
 	var (
 		registry *basicSeriesRegistry
@@ -301,4 +313,298 @@ var _ = Describe("Series Registry", func() {
 			))
 		})
 	})
+
+	Context("with rules producing the same metric", func() {
+		var (
+			namers []naming.MetricNamer
+			series [][]prom.Series
+			info   provider.CustomMetricInfo
+		)
+
+		BeforeEach(func() {
+			overrides := map[string]adaptercfg.GroupResource{"namespace": {Resource: "namespace"}, "pod": {Resource: "pod"}}
+			var err error
+			namers, err = naming.NamersFromConfig([]adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:  `{__name__="http_requests_total",namespace!="",pod!=""}`,
+					Resources:    adaptercfg.ResourceMapping{Overrides: overrides},
+					Name:         adaptercfg.NameMapping{Matches: "^(.*)_total$"},
+					MetricsQuery: `sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)`,
+				},
+				{
+					SeriesQuery:  `{__name__="http_requests",namespace!="",pod!=""}`,
+					Resources:    adaptercfg.ResourceMapping{Overrides: overrides},
+					MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+				},
+			}, restMapper())
+			Expect(err).NotTo(HaveOccurred())
+			lbls := pmodel.LabelSet{"pod": "somepod", "namespace": "somens"}
+			series = [][]prom.Series{
+				{{Name: "http_requests_total", Labels: lbls}},
+				{{Name: "http_requests", Labels: lbls}},
+			}
+			info = provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"}
+		})
+
+		It("should serve the metric from the last rule", func() {
+			Expect(registry.SetSeries(series, namers)).To(Succeed())
+			rule, found := registry.RuleForMetric(info)
+			Expect(found).To(BeTrue())
+			Expect(rule).To(Equal(`{__name__="http_requests",namespace!="",pod!=""}`))
+		})
+
+		It("should reject the series if collisions are rejected", func() {
+			registry.rejectCollisions = true
+			err := registry.SetSeries(series, namers)
+			Expect(err).To(MatchError(ContainSubstring("http_requests")))
+			_, found := registry.RuleForMetric(info)
+			Expect(found).To(BeFalse())
+			Expect(registry.ListAllMetrics()).To(HaveLen(17))
+		})
+	})
+
+	Context("with queries returning several samples per object", func() {
+		var (
+			info   provider.CustomMetricInfo
+			values pmodel.Vector
+		)
+
+		setPolicy := func(policy adaptercfg.DuplicateSamplesPolicy) {
+			namers, err := naming.NamersFromConfig([]adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:      `{__name__="http_requests_total",namespace!="",pod!=""}`,
+					Resources:        adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					DuplicateSamples: policy,
+					MetricsQuery:     `sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>, version)`,
+				},
+			}, restMapper())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(registry.SetSeries([][]prom.Series{{
+				{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "somepod", "namespace": "somens"}},
+			}}, namers)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			info = provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests_total"}
+			values = pmodel.Vector{
+				{Metric: pmodel.Metric{"pod": "somepod", "version": "v1"}, Value: 2},
+				{Metric: pmodel.Metric{"pod": "somepod", "version": "v2"}, Value: 5},
+				{Metric: pmodel.Metric{"pod": "somepod", "version": "v3"}, Value: 1},
+				{Metric: pmodel.Metric{"pod": "otherpod", "version": "v1"}, Value: 3},
+			}
+		})
+
+		for _, tc := range []struct {
+			policy   adaptercfg.DuplicateSamplesPolicy
+			expected pmodel.SampleValue
+		}{
+			{"", 1},
+			{adaptercfg.DuplicateSamplesLast, 1},
+			{adaptercfg.DuplicateSamplesSum, 8},
+			{adaptercfg.DuplicateSamplesMax, 5},
+			{adaptercfg.DuplicateSamplesMin, 1},
+		} {
+			policy, expected := tc.policy, tc.expected
+			It(fmt.Sprintf("should combine them according to the %q policy", policy), func() {
+				setPolicy(policy)
+				matched, found, err := registry.MatchValuesToNames(info, values)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).To(BeTrue())
+				Expect(matched).To(HaveLen(2))
+				Expect(matched["somepod"]).To(HaveLen(1))
+				Expect(matched["somepod"][0].Value).To(Equal(expected))
+				Expect(matched["otherpod"][0].Value).To(Equal(pmodel.SampleValue(3)))
+			})
+		}
+
+		It("should not modify the query results when summing them", func() {
+			setPolicy(adaptercfg.DuplicateSamplesSum)
+			_, _, err := registry.MatchValuesToNames(info, values)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(values[0].Value).To(Equal(pmodel.SampleValue(2)))
+		})
+
+		It("should fail if the rule doesn't allow them", func() {
+			setPolicy(adaptercfg.DuplicateSamplesError)
+			_, _, err := registry.MatchValuesToNames(info, values)
+			Expect(err).To(MatchError(ContainSubstring(`"somepod"`)))
+		})
+
+		It("should reject unknown policies", func() {
+			_, err := naming.NamersFromConfig([]adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:      `{__name__="http_requests_total",namespace!="",pod!=""}`,
+					Resources:        adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					DuplicateSamples: "avg",
+					MetricsQuery:     `sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)`,
+				},
+			}, restMapper())
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("with a query plan cache", func() {
+		var info provider.CustomMetricInfo
+
+		BeforeEach(func() {
+			registry.plans = newPlanCache(10)
+			info = provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_usage"}
+		})
+
+		It("should reuse the plans of identical requests", func() {
+			first, found := registry.PlanForMetric(info, "somens", labels.Everything(), "somepod1", "somepod2")
+			Expect(found).To(BeTrue())
+			second, found := registry.PlanForMetric(info, "somens", labels.Everything(), "somepod1", "somepod2")
+			Expect(found).To(BeTrue())
+			Expect(second).To(Equal(first))
+			Expect(second).NotTo(BeIdenticalTo(first))
+			Expect(registry.plans.cache.Len()).To(Equal(1))
+
+			other, found := registry.PlanForMetric(info, "somens", labels.Everything(), "somepod1")
+			Expect(found).To(BeTrue())
+			Expect(other.Query).NotTo(Equal(first.Query))
+			Expect(registry.plans.cache.Len()).To(Equal(2))
+		})
+
+		It("should be cleared when the series change", func() {
+			_, found := registry.PlanForMetric(info, "somens", labels.Everything(), "somepod1")
+			Expect(found).To(BeTrue())
+			Expect(registry.SetSeries(seriesRegistryTestSeries, setupMetricNamer())).To(Succeed())
+			Expect(registry.plans.cache.Len()).To(Equal(0))
+		})
+	})
+
+	Context("with identity labels", func() {
+		var info provider.CustomMetricInfo
+
+		BeforeEach(func() {
+			namers, err := naming.NamersFromConfig([]adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery: `{__name__="container_memory_working_set_bytes",namespace!="",pod!="",container!=""}`,
+					Resources: adaptercfg.ResourceMapping{
+						Template:       "<<.Resource>>",
+						IdentityLabels: []string{"container"},
+					},
+					MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+				},
+			}, restMapper())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(registry.SetSeries([][]prom.Series{{
+				{Name: "container_memory_working_set_bytes", Labels: pmodel.LabelSet{"pod": "somepod", "namespace": "somens", "container": "app"}},
+			}}, namers)).To(Succeed())
+			info = provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "container_memory_working_set_bytes"}
+		})
+
+		It("should group the query by them", func() {
+			query, found := registry.QueryForMetric(info, "somens", labels.Everything(), "somepod")
+			Expect(found).To(BeTrue())
+			Expect(query).To(Equal(prom.Selector(`sum(container_memory_working_set_bytes{namespace="somens",pod="somepod"}) by (pod,container)`)))
+		})
+
+		It("should attach them to the selectors of the values", func() {
+			Expect(registry.SelectorLabelsForMetric(info)).To(ConsistOf("container"))
+		})
+
+		It("should match a value per identity to each object", func() {
+			matched, found, err := registry.MatchValuesToNames(info, pmodel.Vector{
+				{Metric: pmodel.Metric{"pod": "somepod", "container": "app"}, Value: 2},
+				{Metric: pmodel.Metric{"pod": "somepod", "container": "sidecar"}, Value: 5},
+				{Metric: pmodel.Metric{"pod": "somepod", "container": "app"}, Value: 3},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(matched["somepod"]).To(HaveLen(2))
+			Expect(matched["somepod"][0].Value).To(Equal(pmodel.SampleValue(3)))
+			Expect(matched["somepod"][1].Value).To(Equal(pmodel.SampleValue(5)))
+		})
+
+		It("should reject identity labels mapped to resources", func() {
+			_, err := naming.NamersFromConfig([]adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery: `{__name__="container_memory_working_set_bytes",namespace!="",pod!=""}`,
+					Resources: adaptercfg.ResourceMapping{
+						Overrides:      map[string]adaptercfg.GroupResource{"namespace": {Resource: "namespace"}, "pod": {Resource: "pod"}},
+						IdentityLabels: []string{"pod"},
+					},
+					MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+				},
+			}, restMapper())
+			Expect(err).To(MatchError(ContainSubstring("identity label")))
+		})
+	})
+
+	Context("with cluster-scoped custom resources", func() {
+		It("should serve their metrics outside of namespaces", func() {
+			queueGV := schema.GroupVersion{Group: "scheduling.volcano.sh", Version: "v1beta1"}
+			mapper := restMapper().(*apimeta.DefaultRESTMapper)
+			mapper.Add(queueGV.WithKind("Queue"), apimeta.RESTScopeRoot)
+			mapper.Add(queueGV.WithKind("Widget"), apimeta.RESTScopeNamespace)
+
+			namers, err := naming.NamersFromConfig([]adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery: `{__name__=~"^volcano_.*",queue_name!=""}`,
+					Resources: adaptercfg.ResourceMapping{Overrides: map[string]adaptercfg.GroupResource{
+						"queue_name": {Group: queueGV.Group, Resource: "queues"},
+						"widget":     {Group: queueGV.Group, Resource: "widgets", Scope: adaptercfg.ClusterScoped},
+					}},
+					MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+				},
+			}, mapper)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(registry.SetSeries([][]prom.Series{{
+				{Name: "volcano_queue_allocated_milli_cpu", Labels: pmodel.LabelSet{"queue_name": "default"}},
+				{Name: "volcano_widget_count", Labels: pmodel.LabelSet{"widget": "w", "namespace": "somens"}},
+			}}, namers)).To(Succeed())
+			Expect(registry.ListAllMetrics()).To(ConsistOf(
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Group: queueGV.Group, Resource: "queues"}, Namespaced: false, Metric: "volcano_queue_allocated_milli_cpu"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Group: queueGV.Group, Resource: "widgets"}, Namespaced: false, Metric: "volcano_widget_count"},
+			))
+		})
+
+		It("should reject unknown scopes", func() {
+			_, err := naming.NamersFromConfig([]adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery: `{node!=""}`,
+					Resources: adaptercfg.ResourceMapping{Overrides: map[string]adaptercfg.GroupResource{
+						"node": {Resource: "nodes", Scope: "Global"},
+					}},
+					MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+				},
+			}, restMapper())
+			Expect(err).To(MatchError(ContainSubstring("invalid scope")))
+		})
+	})
+
+	Context("with a failure reporter", func() {
+		It("should only report the queries which couldn't be built", func() {
+			failures := &recordingFailureReporter{}
+			registry.failures = failures
+			namers, err := naming.NamersFromConfig([]adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:  `{__name__="queue_depth",namespace!="",pod!=""}`,
+					Namespaces:   []string{"team-a"},
+					Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+				},
+			}, restMapper())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(registry.SetSeries([][]prom.Series{{
+				{Name: "queue_depth", Labels: pmodel.LabelSet{"namespace": "team-a", "pod": "worker"}},
+			}}, namers)).To(Succeed())
+			info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "queue_depth"}
+
+			By("looking the metric up in a namespace it isn't served in")
+			_, found := registry.PlanForMetric(info, "team-b", labels.Everything(), "worker")
+			Expect(found).To(BeFalse())
+			Expect(failures.failed).To(BeEmpty())
+
+			By("looking the metric up with a selector its query can't be built for")
+			selector, err := labels.Parse("depth>5")
+			Expect(err).NotTo(HaveOccurred())
+			_, found = registry.PlanForMetric(info, "team-a", selector, "worker")
+			Expect(found).To(BeFalse())
+			Expect(failures.failed).To(Equal([]string{info.String()}))
+		})
+	})
 })
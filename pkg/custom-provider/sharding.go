@@ -0,0 +1,188 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"k8s.io/klog/v2"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// SharedSeries are the series returned by a series query against a backend,
+// as shared between adapter replicas.
+type SharedSeries struct {
+	// Backend is the Prometheus backend the query was run against, or empty
+	// for the default one.
+	Backend string `json:"backend,omitempty"`
+	// Headers identifies the extra headers sent with the query, if any, by
+	// their digest rather than their values.
+	Headers string `json:"headers,omitempty"`
+	// Selector is the series query.
+	Selector prom.Selector `json:"selector"`
+	// DiscoveryLabels are the labels of the series, if only their names were
+	// discovered using the label values API.
+	DiscoveryLabels string `json:"discoveryLabels,omitempty"`
+	// MaxAge is how far back the query looked for series, if the rule making
+	// it overrides the default.
+	MaxAge pmodel.Duration `json:"maxAge,omitempty"`
+	// Series are the series the query returned.
+	Series []prom.Series `json:"series"`
+}
+
+// query returns the series query the series were returned by.
+func (s *SharedSeries) query() seriesQuery {
+	return seriesQuery{backend: s.Backend, headers: s.Headers, selector: s.Selector, discoveryLabels: s.DiscoveryLabels, maxAge: time.Duration(s.MaxAge)}
+}
+
+// sharedSeriesFrom lists the series returned by each of the given queries.
+func sharedSeriesFrom(results map[seriesQuery][]prom.Series) []SharedSeries {
+	res := make([]SharedSeries, 0, len(results))
+	for query, series := range results {
+		res = append(res, SharedSeries{
+			Backend:         query.backend,
+			Headers:         query.headers,
+			Selector:        query.selector,
+			DiscoveryLabels: query.discoveryLabels,
+			MaxAge:          pmodel.Duration(query.maxAge),
+			Series:          series,
+		})
+	}
+	return res
+}
+
+// ErrSeriesTooLarge is returned by SeriesStore.Publish when the series of a
+// shard don't fit in the store.
+var ErrSeriesTooLarge = errors.New("the series are too large to be published")
+
+// PublishedSeries are the series published by a shard.
+type PublishedSeries struct {
+	// Published is when the shard last published its series.
+	Published time.Time
+	// TooLarge is set when the series of the shard didn't fit in the store,
+	// in which case none of them were published.
+	TooLarge bool
+	// Series are the series returned by each query of the shard.
+	Series []SharedSeries
+}
+
+// SeriesStore shares the series discovered by each shard of the adapter
+// replicas with the others.
+type SeriesStore interface {
+	// Publish replaces the series published by the given shard.  If they
+	// don't fit in the store, it publishes that they're too large instead,
+	// and returns ErrSeriesTooLarge.
+	Publish(ctx context.Context, shard int, series []SharedSeries) error
+	// Load returns the series published by each shard, by index.  The shards
+	// which haven't published anything yet are left out.
+	Load(ctx context.Context) (map[int]PublishedSeries, error)
+}
+
+// RelistShard splits series discovery between adapter replicas: each one
+// only runs the series queries hashed to its shard, and gets the results of
+// the others from the store.
+type RelistShard struct {
+	// Index is the shard of this replica, from 0 to Total-1.
+	Index int
+	// Total is the number of shards.
+	Total int
+	// Store shares the discovered series between shards.
+	Store SeriesStore
+	// StaleAfter is how long the series published by a shard are used for.
+	// Older ones, e.g. of a shard which is down, are listed by each replica
+	// instead.  Zero means they're used until the shard publishes new ones.
+	StaleAfter time.Duration
+}
+
+// Validate checks that the shard index is within the number of shards.
+func (s *RelistShard) Validate() error {
+	if s.Total < 1 {
+		return fmt.Errorf("the number of shards must be positive, got %d", s.Total)
+	}
+	if s.Index < 0 || s.Index >= s.Total {
+		return fmt.Errorf("the shard index must be between 0 and %d, got %d", s.Total-1, s.Index)
+	}
+	return nil
+}
+
+// owns checks whether the given query is run by this shard.  A nil shard owns
+// every query.
+func (s *RelistShard) owns(query seriesQuery) bool {
+	if s == nil || s.Total <= 1 {
+		return true
+	}
+	return s.shardOf(query) == s.Index
+}
+
+// shardOf returns the shard the given query is hashed to.
+func (s *RelistShard) shardOf(query seriesQuery) int {
+	h := fnv.New32a()
+	h.Write([]byte(query.backend))
+	h.Write([]byte{0})
+	h.Write([]byte(query.selector))
+	if query.headers != "" {
+		h.Write([]byte{0})
+		h.Write([]byte(query.headers))
+	}
+	if query.discoveryLabels != "" {
+		h.Write([]byte{0})
+		h.Write([]byte(query.discoveryLabels))
+	}
+	return int(h.Sum32() % uint32(s.Total))
+}
+
+// share publishes the series discovered by this shard, and adds those
+// published by the other shards to the given results.  It returns the shards
+// whose series are unavailable, as they're stale or were too large to be
+// published, so that their queries are run by this replica instead.
+func (s *RelistShard) share(ctx context.Context, results map[seriesQuery][]prom.Series) (map[int]bool, error) {
+	err := s.Store.Publish(ctx, s.Index, sharedSeriesFrom(results))
+	if errors.Is(err, ErrSeriesTooLarge) {
+		klog.Warningf("the series of shard %d are too large to be shared, the other replicas list them themselves", s.Index)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to publish the series of shard %d: %v", s.Index, err)
+	}
+
+	shards, err := s.Store.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the series of other shards: %v", err)
+	}
+	unavailable := make(map[int]bool)
+	for index, shard := range shards {
+		if index == s.Index {
+			continue
+		}
+		if shard.TooLarge || (s.StaleAfter > 0 && time.Since(shard.Published) > s.StaleAfter) {
+			klog.V(2).Infof("the series of shard %d are unavailable or stale (published at %v), listing them locally", index, shard.Published)
+			unavailable[index] = true
+			continue
+		}
+		for _, entry := range shard.Series {
+			// our own results are the freshest
+			if _, found := results[entry.query()]; !found {
+				results[entry.query()] = entry.Series
+			}
+		}
+	}
+	return unavailable, nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// memorySeriesStore is a SeriesStore shared by replicas running in the same process.
+type memorySeriesStore struct {
+	mu     sync.Mutex
+	shards map[int]PublishedSeries
+	// tooLarge makes the series of every shard too large to be published
+	tooLarge bool
+}
+
+func (s *memorySeriesStore) Publish(_ context.Context, shard int, series []SharedSeries) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tooLarge {
+		s.shards[shard] = PublishedSeries{Published: time.Now(), TooLarge: true}
+		return ErrSeriesTooLarge
+	}
+	s.shards[shard] = PublishedSeries{Published: time.Now(), Series: series}
+	return nil
+}
+
+func (s *memorySeriesStore) Load(_ context.Context) (map[int]PublishedSeries, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.shards), nil
+}
+
+// setupShards returns the listers of the providers of each of the given number
+// of shards, sharing the given store.
+func setupShards(total int, store SeriesStore) ([]*cachingMetricsLister, []*prometheusProvider) {
+	var listers []*cachingMetricsLister
+	var providers []*prometheusProvider
+	for i := 0; i < total; i++ {
+		prov, fakeProm := setupPrometheusProvider()
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		lister.shard = &RelistShard{Index: i, Total: total, Store: store, StaleAfter: time.Minute}
+		listers = append(listers, lister)
+		providers = append(providers, prov.(*prometheusProvider))
+	}
+	return listers, providers
+}
+
+// unshardedMetrics returns the metrics listed by a provider which isn't sharded.
+func unshardedMetrics() []provider.CustomMetricInfo {
+	unsharded, fakeProm := setupPrometheusProvider()
+	fakeProm.AcceptableInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+	Expect(unsharded.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister).updateMetrics()).To(Succeed())
+	return unsharded.ListAllMetrics()
+}
+
+var _ = Describe("Sharded relisting", func() {
+	It("should only run the queries of its shard, and share the results with other shards", func() {
+		store := &memorySeriesStore{shards: make(map[int]PublishedSeries)}
+
+		By("setting up one provider per shard")
+		listers, providers := setupShards(2, store)
+
+		By("relisting on every shard")
+		for _, lister := range listers {
+			Expect(lister.updateMetrics()).To(Succeed())
+		}
+		Expect(listers[0].updateMetrics()).To(Succeed())
+
+		By("checking that each shard only published its own queries")
+		Expect(store.shards).To(HaveLen(2))
+		for shard, published := range store.shards {
+			Expect(published.Series).NotTo(BeEmpty())
+			for _, entry := range published.Series {
+				Expect(listers[shard].shard.owns(seriesQuery{backend: entry.Backend, selector: entry.Selector})).To(BeTrue())
+			}
+		}
+
+		By("checking that every shard lists all metrics")
+		expected := unshardedMetrics()
+		for _, prov := range providers {
+			Expect(prov.ListAllMetrics()).To(ConsistOf(expected))
+		}
+	})
+
+	It("should list the series of the shards which published them too long ago itself", func() {
+		store := &memorySeriesStore{shards: make(map[int]PublishedSeries)}
+		listers, providers := setupShards(2, store)
+		Expect(listers[1].updateMetrics()).To(Succeed())
+
+		By("making the series of the second shard stale")
+		stale := store.shards[1]
+		stale.Published = time.Now().Add(-time.Hour)
+		store.shards[1] = stale
+
+		Expect(listers[0].updateMetrics()).To(Succeed())
+		Expect(providers[0].ListAllMetrics()).To(ConsistOf(unshardedMetrics()))
+	})
+
+	It("should list the series of the shards which were too large to be published itself", func() {
+		store := &memorySeriesStore{shards: make(map[int]PublishedSeries), tooLarge: true}
+		listers, providers := setupShards(2, store)
+
+		By("relisting on every shard, whose series are too large")
+		for _, lister := range listers {
+			Expect(lister.updateMetrics()).To(Succeed())
+		}
+		Expect(listers[0].updateMetrics()).To(Succeed())
+		Expect(store.shards[0].TooLarge).To(BeTrue())
+		Expect(store.shards[1].TooLarge).To(BeTrue())
+
+		expected := unshardedMetrics()
+		for _, prov := range providers {
+			Expect(prov.ListAllMetrics()).To(ConsistOf(expected))
+		}
+	})
+})
@@ -0,0 +1,99 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// unknownMetricCache remembers the metrics which weren't known to the
+// registry for a short period of time, so that repeated requests for them
+// (e.g. from HPAs referencing a nonexistent metric) are answered without
+// looking them up again, and are only logged once per period.
+type unknownMetricCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	expires   map[provider.CustomMetricInfo]time.Time
+	nextSweep time.Time
+}
+
+// newUnknownMetricCache creates an unknownMetricCache remembering metrics for
+// the given TTL.  A non-positive TTL disables caching, and returns nil.
+func newUnknownMetricCache(ttl time.Duration) *unknownMetricCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &unknownMetricCache{
+		ttl:     ttl,
+		now:     time.Now,
+		expires: make(map[provider.CustomMetricInfo]time.Time),
+	}
+}
+
+// contains checks whether the given metric was recently found to be unknown.
+// It's safe to call on a nil cache, which never contains anything.
+func (c *unknownMetricCache) contains(info provider.CustomMetricInfo) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, found := c.expires[info]
+	return found && c.now().Before(expires)
+}
+
+// clear forgets all the unknown metrics, e.g. because the series or rules
+// changed.  It's safe to call on a nil cache, which does nothing.
+func (c *unknownMetricCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.expires)
+}
+
+// add remembers that the given metric is unknown.  It's safe to call on a nil
+// cache, which does nothing.
+func (c *unknownMetricCache) add(info provider.CustomMetricInfo) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.expires[info] = now.Add(c.ttl)
+	klog.V(2).Infof("metric %s isn't known, answering requests for it with NotFound for %s", info.String(), c.ttl)
+
+	// sweep expired entries, at most once per TTL
+	if now.Before(c.nextSweep) {
+		return
+	}
+	for info, expires := range c.expires {
+		if !now.Before(expires) {
+			delete(c.expires, info)
+		}
+	}
+	c.nextSweep = now.Add(c.ttl)
+}
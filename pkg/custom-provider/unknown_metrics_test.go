@@ -0,0 +1,93 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+var _ = Describe("Unknown Metric Cache", func() {
+	info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "missing"}
+
+	It("should be disabled with a non-positive TTL", func() {
+		cache := newUnknownMetricCache(0)
+		Expect(cache).To(BeNil())
+		cache.add(info)
+		Expect(cache.contains(info)).To(BeFalse())
+	})
+
+	It("should forget unknown metrics after the TTL", func() {
+		now := time.Unix(1000, 0)
+		cache := newUnknownMetricCache(time.Minute)
+		cache.now = func() time.Time { return now }
+
+		cache.add(info)
+		Expect(cache.contains(info)).To(BeTrue())
+
+		now = now.Add(time.Minute)
+		Expect(cache.contains(info)).To(BeFalse())
+
+		By("sweeping expired entries when adding others")
+		cache.add(provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "other"})
+		Expect(cache.expires).NotTo(HaveKey(info))
+	})
+
+	It("should remember the unknown metrics requested from the provider", func() {
+		prov, _ := setupPrometheusProvider()
+		prov.(*prometheusProvider).unknownMetrics = newUnknownMetricCache(time.Minute)
+
+		_, err := prov.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "somens", Name: "somepod"}, info, labels.Everything())
+		Expect(apierr.IsNotFound(err)).To(BeTrue())
+		Expect(prov.(*prometheusProvider).unknownMetrics.contains(info)).To(BeTrue())
+
+		_, err = prov.GetMetricBySelector(context.Background(), "somens", labels.Everything(), info, labels.Everything())
+		Expect(apierr.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should forget the unknown metrics when the series are updated", func() {
+		prov, fakeProm := setupPrometheusProvider()
+		startTime := pmodel.Now().Add(-1*fakeProviderUpdateInterval - fakeProviderUpdateInterval/10)
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: startTime, End: 0}
+		unknownMetrics := newUnknownMetricCache(time.Minute)
+		prov.(*prometheusProvider).unknownMetrics = unknownMetrics
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		lister.SeriesRegistry.(*basicSeriesRegistry).unknownMetrics = unknownMetrics
+
+		By("requesting a metric before its series are listed")
+		usage := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_usage"}
+		_, err := prov.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "somens", Name: "somepod"}, usage, labels.Everything())
+		Expect(apierr.IsNotFound(err)).To(BeTrue())
+		Expect(unknownMetrics.contains(usage)).To(BeTrue())
+
+		By("listing the series, and checking that the metric is found")
+		Expect(lister.updateMetrics()).To(Succeed())
+		Expect(unknownMetrics.contains(usage)).To(BeFalse())
+		Expect(prov.ListAllMetrics()).To(ContainElement(usage))
+	})
+})
@@ -19,6 +19,8 @@ package provider
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"k8s.io/klog/v2"
@@ -56,10 +58,51 @@ type MetricListerWithNotification interface {
 	UpdateNow()
 }
 
+// NamersSetter is implemented by the Runnable returned from NewExternalPrometheusProvider,
+// allowing the namers used to discover metrics to be replaced while running.
+type NamersSetter interface {
+	// SetNamers replaces the namers, and immediately relists the available metrics.
+	SetNamers(namers []naming.MetricNamer) error
+}
+
+// NamersPreparer is implemented by the Runnable returned from
+// NewExternalPrometheusProvider, allowing the namers used to discover metrics
+// to be replaced along with other configuration.
+type NamersPreparer interface {
+	// PrepareNamers lists the metrics of the given namers without serving
+	// them yet: the returned function replaces the namers, and serves these
+	// metrics.
+	PrepareNamers(namers []naming.MetricNamer) (func() error, error)
+}
+
+// namersLister is implemented by the MetricListers whose namers can be
+// replaced, and which can list the metrics of other namers beforehand.
+type namersLister interface {
+	NamersSetter
+	listMetricsOf(namers []naming.MetricNamer) (MetricUpdateResult, error)
+}
+
 type basicMetricLister struct {
 	promClient prom.Client
-	namers     []naming.MetricNamer
 	lookback   time.Duration
+	// relistInterval is the interval at which the series of rules which
+	// don't override it are relisted, if set.  Otherwise, they're relisted
+	// on every call to ListAllMetrics.
+	relistInterval time.Duration
+	// namesOnly discovers metric names through the label values API, instead
+	// of listing every series
+	namesOnly bool
+
+	// namersMu guards namers, which may be replaced when the configuration is reloaded
+	namersMu sync.RWMutex
+	namers   []naming.MetricNamer
+
+	// relisted keeps the series of rules relisted less often than every
+	// relist
+	relisted naming.RelistCache[seriesQuery]
+
+	// limiter bounds the concurrency and rate of the series queries, if set
+	limiter *prom.RequestLimiter
 }
 
 // NewBasicMetricLister creates a MetricLister that is capable of interactly directly with Prometheus to list metrics.
@@ -73,54 +116,192 @@ func NewBasicMetricLister(promClient prom.Client, namers []naming.MetricNamer, l
 	return &lister
 }
 
-type selectorSeries struct {
+// NewNameMetricLister creates a MetricLister which only discovers the names of the
+// metrics matching each rule, using the Prometheus label values API instead of listing
+// all of their series.  This is much cheaper on large Prometheus installations, and
+// enough for external metrics, which are identified by name alone.
+func NewNameMetricLister(promClient prom.Client, namers []naming.MetricNamer, lookback time.Duration) MetricLister {
+	return &basicMetricLister{
+		promClient: promClient,
+		namers:     namers,
+		lookback:   lookback,
+		namesOnly:  true,
+	}
+}
+
+// SetNamers replaces the namers used to list metrics.  The new namers are
+// used starting from the next call to ListAllMetrics.
+func (l *basicMetricLister) SetNamers(namers []naming.MetricNamer) error {
+	l.namersMu.Lock()
+	defer l.namersMu.Unlock()
+	l.namers = namers
+	// the cached series were filtered by the previous rules
+	l.relisted.Reset()
+	return nil
+}
+
+// relistPeriod returns the period between two relists, which is shorter than
+// the given default interval if some rules have to be relisted more often.
+func (l *basicMetricLister) relistPeriod(defaultInterval time.Duration) time.Duration {
+	l.namersMu.RLock()
+	defer l.namersMu.RUnlock()
+	return naming.RelistPeriod(l.namers, defaultInterval)
+}
+
+// seriesQuery identifies a series query made against a particular backend,
+// with particular headers.
+type seriesQuery struct {
+	backend string
+	// headers identifies the extra headers sent with the query (see prom.HeadersKey)
+	headers  string
 	selector prom.Selector
-	series   []prom.Series
+	// discoveryLabels are the labels of the series discovered using the
+	// label values API, if it's used
+	discoveryLabels string
+	// maxAge is how far back series are listed, if the rule overrides the
+	// lister's default
+	maxAge time.Duration
+}
+
+// seriesQueryFor returns the series query made to discover the series of the given rule.
+func seriesQueryFor(namer naming.MetricNamer) seriesQuery {
+	return seriesQuery{
+		backend:         namer.PrometheusRef(),
+		headers:         prom.HeadersKey(namer.PrometheusHeaders()),
+		selector:        namer.Selector(),
+		discoveryLabels: strings.Join(namer.DiscoveryLabels(), ","),
+		maxAge:          namer.MaxAge(),
+	}
+}
+
+// namersByQuery groups the namers which discover series by sharing each series query.
+func namersByQuery(namers []naming.MetricNamer) map[seriesQuery][]naming.MetricNamer {
+	res := make(map[seriesQuery][]naming.MetricNamer, len(namers))
+	for _, namer := range namers {
+		if namer.StaticSeries() != nil {
+			continue
+		}
+		query := seriesQueryFor(namer)
+		res[query] = append(res[query], namer)
+	}
+	return res
+}
+
+// relistIntervals returns, for each series query, the minimum interval
+// between two runs of it, which is the given default interval unless the
+// rule overrides it.  Rules sharing a query relist it as often as the most
+// frequent of them requires.
+func relistIntervals(namers []naming.MetricNamer, defaultInterval time.Duration) map[seriesQuery]time.Duration {
+	intervals := make(map[seriesQuery]time.Duration, len(namers))
+	for _, namer := range namers {
+		query := seriesQueryFor(namer)
+		interval := namer.RelistInterval()
+		if interval <= 0 {
+			interval = defaultInterval
+		}
+		if current, found := intervals[query]; !found || interval < current {
+			intervals[query] = interval
+		}
+	}
+	return intervals
+}
+
+type selectorSeries struct {
+	query  seriesQuery
+	series []prom.Series
 }
 
 func (l *basicMetricLister) ListAllMetrics() (MetricUpdateResult, error) {
+	l.namersMu.RLock()
+	namers := l.namers
+	l.namersMu.RUnlock()
+
+	return l.listMetrics(namers, &l.relisted)
+}
+
+// listMetricsOf lists the metrics of the given namers, which may not be the
+// lister's, without reusing the series of the previous relists.
+func (l *basicMetricLister) listMetricsOf(namers []naming.MetricNamer) (MetricUpdateResult, error) {
+	return l.listMetrics(namers, &naming.RelistCache[seriesQuery]{})
+}
+
+// listMetrics lists the metrics of the given namers, except for the series
+// queries whose series, listed by a previous relist, are still fresh in the
+// given cache.
+func (l *basicMetricLister) listMetrics(namers []naming.MetricNamer, relisted *naming.RelistCache[seriesQuery]) (MetricUpdateResult, error) {
 	result := MetricUpdateResult{
 		series: make([][]prom.Series, 0),
 		namers: make([]naming.MetricNamer, 0),
 	}
 
-	startTime := pmodel.Now().Add(-1 * l.lookback)
+	defer func(start time.Time) {
+		relistDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	now := time.Now()
+	intervals := relistIntervals(namers, l.relistInterval)
+	sharing := namersByQuery(namers)
+	// the queries of the relist, including the value filters, share its context
+	relistCtx := context.Background()
 
 	// these can take a while on large clusters, so launch in parallel
 	// and don't duplicate
-	selectors := make(map[prom.Selector]struct{})
-	selectorSeriesChan := make(chan selectorSeries, len(l.namers))
-	errs := make(chan error, len(l.namers))
-	for _, converter := range l.namers {
-		sel := converter.Selector()
-		if _, ok := selectors[sel]; ok {
+	queries := make(map[seriesQuery]struct{})
+	selectorSeriesChan := make(chan selectorSeries, len(namers))
+	errs := make(chan error, len(namers))
+	for _, converter := range namers {
+		query := seriesQueryFor(converter)
+		if _, ok := queries[query]; ok || converter.StaticSeries() != nil {
 			errs <- nil
 			selectorSeriesChan <- selectorSeries{}
 			continue
 		}
-		selectors[sel] = struct{}{}
+		queries[query] = struct{}{}
+		if series, fresh := relisted.Fresh(query, intervals[query], now); fresh {
+			errs <- nil
+			selectorSeriesChan <- selectorSeries{query: query, series: series}
+			continue
+		}
+		lookback := l.lookback
+		if query.maxAge > 0 {
+			lookback = query.maxAge
+		}
+		startTime := pmodel.TimeFromUnixNano(now.UnixNano()).Add(-1 * lookback)
+		headers := converter.PrometheusHeaders()
+		filter := naming.SeriesFilterFor(sharing[query])
 		go func() {
-			series, err := l.promClient.Series(context.TODO(), pmodel.Interval{Start: startTime, End: 0}, sel)
+			ctx := prom.WithHeaders(prom.WithBackend(relistCtx, query.backend), headers)
+			// only keep the series of the rules sharing the query as they're listed
+			ctx = prom.WithSeriesFilter(ctx, filter)
+			release, err := l.limiter.Acquire(ctx)
+			if err != nil {
+				errs <- fmt.Errorf("unable to fetch metrics for query %q: %v", query.selector, err)
+				return
+			}
+			series, err := l.listSeries(ctx, pmodel.Interval{Start: startTime, End: 0}, converter)
+			release()
 			if err != nil {
-				errs <- fmt.Errorf("unable to fetch metrics for query %q: %v", sel, err)
+				relistErrors.WithLabelValues(string(query.selector)).Inc()
+				errs <- fmt.Errorf("unable to fetch metrics for query %q: %v", query.selector, err)
 				return
 			}
+			relisted.Store(query, series, now)
 			errs <- nil
 			// Push into the channel: "this selector produced these series"
 			selectorSeriesChan <- selectorSeries{
-				selector: sel,
-				series:   series,
+				query:  query,
+				series: series,
 			}
 		}()
 	}
 
 	// don't do duplicate queries when it's just the matchers that change
-	seriesCacheByQuery := make(map[prom.Selector][]prom.Series)
+	seriesCacheByQuery := make(map[seriesQuery][]prom.Series)
 
 	// iterate through, blocking until we've got all results
 	// We know that, from above, we should have pushed one item into the channel
 	// for each converter. So here, we'll assume that we should receive one item per converter.
-	for range l.namers {
+	for range namers {
 		if err := <-errs; err != nil {
 			return result, fmt.Errorf("unable to update list of all metrics: %v", err)
 		}
@@ -128,31 +309,81 @@ func (l *basicMetricLister) ListAllMetrics() (MetricUpdateResult, error) {
 		// We stuff that into this map so that we can collect the data as it arrives
 		// and then, once we've received it all, we can process it below.
 		if ss := <-selectorSeriesChan; ss.series != nil {
-			seriesCacheByQuery[ss.selector] = ss.series
+			seriesCacheByQuery[ss.query] = ss.series
 		}
 	}
 	close(errs)
+	relisted.Retain(queries)
 
 	// Now that we've collected all of the results into `seriesCacheByQuery`
 	// we can start processing them.
-	newSeries := make([][]prom.Series, len(l.namers))
-	for i, namer := range l.namers {
-		series, cached := seriesCacheByQuery[namer.Selector()]
+	newSeries := make([][]prom.Series, len(namers))
+	seriesPerRule := make(map[string]int, len(namers))
+	missing := make(map[string][]pmodel.LabelName, len(namers))
+	for i, namer := range namers {
+		if static := namer.StaticSeries(); static != nil {
+			newSeries[i] = naming.FilterSeriesByValue(relistCtx, l.promClient, l.limiter, namer, namer.FilterSeries(static))
+			seriesPerRule[namer.RuleName()] += len(newSeries[i])
+			continue
+		}
+		series, cached := seriesCacheByQuery[seriesQueryFor(namer)]
 		if !cached {
 			return result, fmt.Errorf("unable to update list of all metrics: no metrics retrieved for query %q", namer.Selector())
 		}
 		// Because converters provide a "post-filtering" option, it's not enough to
 		// simply take all the series that were produced. We need to further filter them.
-		newSeries[i] = namer.FilterSeries(series)
+		matched := namer.FilterSeries(series)
+		missing[namer.RuleName()] = append(missing[namer.RuleName()], naming.MissingOverrideLabels(namer, matched)...)
+		newSeries[i] = naming.FilterSeriesByValue(relistCtx, l.promClient, l.limiter, namer, matched)
+		seriesPerRule[namer.RuleName()] += len(newSeries[i])
 	}
 
 	klog.V(10).Infof("Set available metric list from Prometheus to: %v", newSeries)
 
+	ruleSeries.Reset()
+	for rule, count := range seriesPerRule {
+		ruleSeries.WithLabelValues(rule).Set(float64(count))
+	}
+	reportMissingOverrideLabels(missing)
+
 	result.series = newSeries
-	result.namers = l.namers
+	result.namers = namers
 	return result, nil
 }
 
+// reportMissingOverrideLabels flags and warns about the labels mapped to
+// resources in the overrides of each rule which none of its series carry.
+func reportMissingOverrideLabels(missingPerRule map[string][]pmodel.LabelName) {
+	missingOverrideLabels.Reset()
+	for rule, missing := range missingPerRule {
+		for _, label := range missing {
+			missingOverrideLabels.WithLabelValues(rule, string(label)).Set(1)
+			klog.Warningf("external rule %q maps label %q to a resource in resources.overrides, but none of the series it discovered carry it", rule, label)
+		}
+	}
+}
+
+// listSeries lists the series of the given rule.  When only discovering
+// names, it returns a single series, without labels, per metric name.
+func (l *basicMetricLister) listSeries(ctx context.Context, interval pmodel.Interval, namer naming.MetricNamer) ([]prom.Series, error) {
+	if !l.namesOnly {
+		return naming.ListSeries(ctx, l.promClient, namer, interval)
+	}
+
+	names, err := l.promClient.LabelValues(ctx, pmodel.MetricNameLabel, interval, namer.Selector())
+	if err != nil {
+		return nil, err
+	}
+	if err := naming.CheckSeriesLimit(namer, len(names)); err != nil {
+		return nil, err
+	}
+	series := make([]prom.Series, len(names))
+	for i, name := range names {
+		series[i] = prom.Series{Name: name}
+	}
+	return series, nil
+}
+
 // MetricUpdateResult represents the output of a periodic inspection of metrics found to be
 // available in Prometheus.
 // It includes both the series data the Prometheus exposed, as well as the configurational
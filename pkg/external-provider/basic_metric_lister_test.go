@@ -0,0 +1,224 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"k8s.io/component-base/metrics/testutil"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+)
+
+func TestListAllMetricsRoutesToRuleBackend(t *testing.T) {
+	seriesQuery := `{__name__=~"^queue_.*"}`
+	newFakeClient := func(seriesName string) *fakeprom.FakePrometheusClient {
+		return &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{Start: 0, End: 0},
+			SeriesResults: map[prom.Selector][]prom.Series{
+				prom.Selector(seriesQuery): {{Name: seriesName}},
+			},
+		}
+	}
+	client := prom.NewRoutingClient(newFakeClient("queue_default"), map[string]prom.Client{
+		"thanos": newFakeClient("queue_thanos"),
+	})
+
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: seriesQuery},
+		{SeriesQuery: seriesQuery, PrometheusRef: "thanos"},
+	}, nil)
+	require.NoError(t, err)
+
+	lister := NewBasicMetricLister(client, namers, time.Minute)
+	result, err := lister.ListAllMetrics()
+	require.NoError(t, err)
+	require.Equal(t, [][]prom.Series{
+		{{Name: "queue_default"}},
+		{{Name: "queue_thanos"}},
+	}, result.series)
+}
+
+func TestListAllMetricsFailsForUnknownBackend(t *testing.T) {
+	client := prom.NewRoutingClient(&fakeprom.FakePrometheusClient{}, map[string]prom.Client{
+		"thanos": &fakeprom.FakePrometheusClient{},
+	})
+
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{__name__=~"^queue_.*"}`, PrometheusRef: "unknown"},
+	}, nil)
+	require.NoError(t, err)
+
+	lister := NewBasicMetricLister(client, namers, time.Minute)
+	_, err = lister.ListAllMetrics()
+	require.ErrorContains(t, err, `unknown Prometheus backend "unknown"`)
+}
+
+func TestNameMetricListerListsNamesOnly(t *testing.T) {
+	seriesQuery := `{__name__=~"^queue_.*"}`
+	client := &fakeprom.FakePrometheusClient{
+		SeriesResults: map[prom.Selector][]prom.Series{
+			prom.Selector(seriesQuery): {
+				{Name: "queue_depth", Labels: pmodel.LabelSet{"queue": "orders"}},
+				{Name: "queue_depth", Labels: pmodel.LabelSet{"queue": "invoices"}},
+				{Name: "queue_age_seconds", Labels: pmodel.LabelSet{"queue": "orders"}},
+			},
+		},
+	}
+
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: seriesQuery, SeriesFilters: []config.RegexFilter{{IsNot: "_seconds$"}}},
+	}, nil)
+	require.NoError(t, err)
+
+	lister := NewNameMetricLister(client, namers, time.Minute)
+	result, err := lister.ListAllMetrics()
+	require.NoError(t, err)
+	require.Equal(t, [][]prom.Series{
+		{{Name: "queue_depth"}},
+	}, result.series)
+}
+
+func TestListAllMetricsSkipsDiscoveryForStaticRules(t *testing.T) {
+	client := &fakeprom.FakePrometheusClient{
+		ErrQueries: map[prom.Selector]error{
+			"": errors.New("static rules shouldn't be discovered"),
+		},
+	}
+
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{
+			Static:       &config.StaticSeries{Names: []string{"queue_depth"}, Labels: []string{"queue"}},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	lister := NewBasicMetricLister(client, namers, time.Minute)
+	result, err := lister.ListAllMetrics()
+	require.NoError(t, err)
+	require.Equal(t, [][]prom.Series{
+		{{Name: "queue_depth", Labels: pmodel.LabelSet{"queue": ""}}},
+	}, result.series)
+}
+
+func TestListAllMetricsHonorsPerRuleRelistInterval(t *testing.T) {
+	client := &fakeprom.FakePrometheusClient{
+		SeriesResults: map[prom.Selector][]prom.Series{
+			`{__name__=~"^queue_.*"}`: {{Name: "queue_depth"}},
+			`{__name__=~"^jobs_.*"}`:  {{Name: "jobs_pending"}},
+		},
+	}
+
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{__name__=~"^queue_.*"}`, RelistInterval: pmodel.Duration(time.Hour)},
+		{SeriesQuery: `{__name__=~"^jobs_.*"}`},
+	}, nil)
+	require.NoError(t, err)
+
+	lister := NewBasicMetricLister(client, namers, time.Minute)
+	_, err = lister.ListAllMetrics()
+	require.NoError(t, err)
+
+	client.SeriesResults[`{__name__=~"^queue_.*"}`] = []prom.Series{{Name: "queue_age_seconds"}}
+	client.SeriesResults[`{__name__=~"^jobs_.*"}`] = []prom.Series{{Name: "jobs_running"}}
+
+	result, err := lister.ListAllMetrics()
+	require.NoError(t, err)
+	require.Equal(t, [][]prom.Series{
+		{{Name: "queue_depth"}},
+		{{Name: "jobs_running"}},
+	}, result.series, "only the rule without its own relist interval should have been relisted")
+}
+
+func TestRulesCanBeRelistedMoreOftenThanTheUpdateInterval(t *testing.T) {
+	client := &fakeprom.FakePrometheusClient{
+		SeriesResults: map[prom.Selector][]prom.Series{
+			`{__name__=~"^queue_.*"}`: {{Name: "queue_depth"}},
+			`{__name__=~"^jobs_.*"}`:  {{Name: "jobs_pending"}},
+		},
+	}
+
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{__name__=~"^queue_.*"}`, RelistInterval: pmodel.Duration(10 * time.Millisecond)},
+		{SeriesQuery: `{__name__=~"^jobs_.*"}`},
+	}, nil)
+	require.NoError(t, err)
+
+	basicLister := &basicMetricLister{promClient: client, namers: namers, lookback: time.Minute, relistInterval: 10 * time.Minute}
+	periodicLister, _ := NewPeriodicMetricLister(basicLister, 10*time.Minute)
+	require.Equal(t, 10*time.Millisecond, periodicLister.(*periodicMetricLister).relistPeriod(), "updates should happen as often as the most frequent rule requires")
+
+	_, err = basicLister.ListAllMetrics()
+	require.NoError(t, err)
+
+	client.SeriesResults[`{__name__=~"^queue_.*"}`] = []prom.Series{{Name: "queue_age_seconds"}}
+	client.SeriesResults[`{__name__=~"^jobs_.*"}`] = []prom.Series{{Name: "jobs_running"}}
+	time.Sleep(10 * time.Millisecond)
+
+	result, err := basicLister.ListAllMetrics()
+	require.NoError(t, err)
+	require.Equal(t, [][]prom.Series{
+		{{Name: "queue_age_seconds"}},
+		{{Name: "jobs_pending"}},
+	}, result.series, "only the rule with a shorter relist interval should have been relisted")
+}
+
+func TestListAllMetricsRecordsRelistMetrics(t *testing.T) {
+	registerMetrics()
+
+	client := &fakeprom.FakePrometheusClient{
+		SeriesResults: map[prom.Selector][]prom.Series{
+			`{queue!=""}`: {
+				{Name: "queue_depth", Labels: pmodel.LabelSet{"queue": "orders"}},
+				{Name: "queue_age_seconds", Labels: pmodel.LabelSet{"queue": "orders"}},
+			},
+		},
+		ErrQueries: map[prom.Selector]error{
+			`{job="broken"}`: errors.New("query timed out"),
+		},
+	}
+
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{ID: "queues", SeriesQuery: `{queue!=""}`, MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`},
+	}, nil)
+	require.NoError(t, err)
+
+	lister := NewBasicMetricLister(client, namers, time.Minute)
+	_, err = lister.ListAllMetrics()
+	require.NoError(t, err)
+	value, err := testutil.GetGaugeMetricValue(ruleSeries.WithLabelValues("queues"))
+	require.NoError(t, err)
+	require.Equal(t, 2.0, value)
+
+	brokenNamers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{job="broken"}`, MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`},
+	}, nil)
+	require.NoError(t, err)
+	_, err = NewBasicMetricLister(client, brokenNamers, time.Minute).ListAllMetrics()
+	require.Error(t, err)
+	value, err = testutil.GetCounterMetricValue(relistErrors.WithLabelValues(`{job="broken"}`))
+	require.NoError(t, err)
+	require.Equal(t, 1.0, value)
+}
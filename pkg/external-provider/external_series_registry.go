@@ -14,15 +14,22 @@ limitations under the License.
 package provider
 
 import (
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/klog/v2"
 
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
 	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
 )
 
 // ExternalSeriesRegistry acts as the top-level converter for transforming Kubernetes requests
@@ -31,6 +38,21 @@ type ExternalSeriesRegistry interface {
 	// ListAllMetrics lists all metrics known to this registry
 	ListAllMetrics() []provider.ExternalMetricInfo
 	QueryForMetric(namespace string, metricName string, metricSelector labels.Selector) (prom.Selector, bool, error)
+	// PlanForMetric is like QueryForMetric, but returns the full query plan.
+	PlanForMetric(namespace string, metricName string, metricSelector labels.Selector) (*queryplan.Plan, bool, error)
+	// RuleForMetric returns the name of the rule (see naming.MetricNamer.RuleName)
+	// the given metric comes from.
+	RuleForMetric(metricName string) (rule string, found bool)
+	// MissingDataForMetric returns how the given metric is served when its
+	// query returns no samples (see naming.MetricNamer.MissingData).
+	MissingDataForMetric(metricName string) config.MissingDataPolicy
+	// AllowsUser checks whether the given user may read the given metric, according
+	// to the access restrictions of its rule.  Unknown metrics are allowed, so that
+	// they're reported as not found.
+	AllowsUser(metricName string, u user.Info) bool
+	// ListMetricLabels lists the names of the labels of the series each metric
+	// is discovered from, ordered by metric name.
+	ListMetricLabels() []MetricLabels
 }
 
 // overridableSeriesRegistry is a basic SeriesRegistry
@@ -42,21 +64,35 @@ type externalSeriesRegistry struct {
 	metrics []provider.ExternalMetricInfo
 	// metricsInfo is a lookup from a metric to SeriesConverter for the sake of generating queries
 	metricsInfo map[string]seriesInfo
+	// labels are the names of the labels of the series of each metric
+	labels map[string][]string
+	// collisions are the metrics produced by several rules as of the last
+	// update, so that each collision is only logged once
+	collisions sets.Set[string]
+	// rejectCollisions makes updates producing colliding metrics be ignored,
+	// rather than serving each of these metrics from the last rule producing it
+	rejectCollisions bool
 }
 
 type seriesInfo struct {
 	// seriesName is the name of the corresponding Prometheus series
 	seriesName string
 
+	// nameLabels are the values of the series labels used in the metric name
+	nameLabels map[string]string
+
 	// namer is the MetricNamer used to name this series
 	namer naming.MetricNamer
 }
 
 // NewExternalSeriesRegistry creates an ExternalSeriesRegistry driven by the data from the provided MetricLister.
-func NewExternalSeriesRegistry(lister MetricListerWithNotification) ExternalSeriesRegistry {
+// If rejectCollisions is set, updates in which several rules produce the same metric are ignored, rather than
+// serving it from the last rule.
+func NewExternalSeriesRegistry(lister MetricListerWithNotification, rejectCollisions bool) ExternalSeriesRegistry {
 	var registry = externalSeriesRegistry{
-		metrics:     make([]provider.ExternalMetricInfo, 0),
-		metricsInfo: map[string]seriesInfo{},
+		metrics:          make([]provider.ExternalMetricInfo, 0),
+		metricsInfo:      map[string]seriesInfo{},
+		rejectCollisions: rejectCollisions,
 	}
 
 	lister.AddNotificationReceiver(registry.filterAndStoreMetrics)
@@ -73,6 +109,9 @@ func (r *externalSeriesRegistry) filterAndStoreMetrics(result MetricUpdateResult
 	}
 	apiMetricsCache := make([]provider.ExternalMetricInfo, 0)
 	rawMetricsCache := make(map[string]seriesInfo)
+	labelNames := make(map[string]sets.Set[string])
+	// collidingRules are the rules producing each metric produced by several rules
+	collidingRules := make(map[string]sets.Set[string])
 
 	for i, newSeries := range newSeriesSlices {
 		namer := namers[i]
@@ -85,8 +124,21 @@ func (r *externalSeriesRegistry) filterAndStoreMetrics(result MetricUpdateResult
 			}
 
 			name := identity
+			if existing, found := rawMetricsCache[name]; found && existing.namer != namer {
+				if collidingRules[name] == nil {
+					collidingRules[name] = sets.New(existing.namer.RuleName())
+				}
+				collidingRules[name].Insert(namer.RuleName())
+			}
+			if labelNames[name] == nil {
+				labelNames[name] = sets.New[string]()
+			}
+			for label := range series.Labels {
+				labelNames[name].Insert(string(label))
+			}
 			rawMetricsCache[name] = seriesInfo{
 				seriesName: series.Name,
+				nameLabels: namer.NameLabelsForSeries(series),
 				namer:      namer,
 			}
 		}
@@ -101,8 +153,35 @@ func (r *externalSeriesRegistry) filterAndStoreMetrics(result MetricUpdateResult
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	metricNameCollisions.Set(float64(len(collidingRules)))
+	collisions := sets.KeySet(collidingRules)
+	if len(collidingRules) > 0 && r.rejectCollisions {
+		r.collisions = collisions
+		klog.Errorf("several rules produce the same external metrics, keeping the previous ones: %s", describeCollisions(collidingRules))
+		return
+	}
+	for _, name := range sets.List(collisions.Difference(r.collisions)) {
+		klog.Warningf("external metric %q is produced by several rules (%s), serving it from the last one", name, strings.Join(sets.List(collidingRules[name]), ", "))
+	}
+	r.collisions = collisions
+
 	r.metrics = apiMetricsCache
 	r.metricsInfo = rawMetricsCache
+	r.labels = make(map[string][]string, len(labelNames))
+	for name, labels := range labelNames {
+		r.labels[name] = sets.List(labels)
+	}
+	exposedMetrics.Set(float64(len(apiMetricsCache)))
+}
+
+// describeCollisions lists the given colliding metrics, along with the rules
+// producing each of them.
+func describeCollisions(collidingRules map[string]sets.Set[string]) string {
+	descs := make([]string, 0, len(collidingRules))
+	for _, name := range sets.List(sets.KeySet(collidingRules)) {
+		descs = append(descs, fmt.Sprintf("%s (from %s)", name, strings.Join(sets.List(collidingRules[name]), ", ")))
+	}
+	return strings.Join(descs, "; ")
 }
 
 func (r *externalSeriesRegistry) ListAllMetrics() []provider.ExternalMetricInfo {
@@ -112,7 +191,27 @@ func (r *externalSeriesRegistry) ListAllMetrics() []provider.ExternalMetricInfo
 	return r.metrics
 }
 
+func (r *externalSeriesRegistry) ListMetricLabels() []MetricLabels {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make([]MetricLabels, 0, len(r.labels))
+	for name, labels := range r.labels {
+		res = append(res, MetricLabels{Metric: name, Labels: labels})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Metric < res[j].Metric })
+	return res
+}
+
 func (r *externalSeriesRegistry) QueryForMetric(namespace string, metricName string, metricSelector labels.Selector) (prom.Selector, bool, error) {
+	plan, found, err := r.PlanForMetric(namespace, metricName, metricSelector)
+	if !found || err != nil {
+		return "", found, err
+	}
+	return plan.Query, found, nil
+}
+
+func (r *externalSeriesRegistry) PlanForMetric(namespace string, metricName string, metricSelector labels.Selector) (*queryplan.Plan, bool, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -120,9 +219,50 @@ func (r *externalSeriesRegistry) QueryForMetric(namespace string, metricName str
 
 	if !found {
 		klog.V(10).Infof("external metric %q not found", metricName)
-		return "", false, nil
+		return nil, false, nil
+	}
+	if !info.namer.AllowsNamespace(namespace) {
+		klog.V(4).Infof("external metric %q isn't served in namespace %q", metricName, namespace)
+		return nil, false, nil
+	}
+	metricSelector = naming.SelectorWithLabels(metricSelector, info.nameLabels)
+	plan, err := info.namer.PlanForExternalSeries(info.seriesName, namespace, metricSelector)
+	if err != nil {
+		queryBuildFailures.WithLabelValues(info.namer.RuleName()).Inc()
+	}
+
+	return plan, found, err
+}
+
+func (r *externalSeriesRegistry) RuleForMetric(metricName string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	info, found := r.metricsInfo[metricName]
+	if !found {
+		return "", false
 	}
-	query, err := info.namer.QueryForExternalSeries(info.seriesName, namespace, metricSelector)
+	return info.namer.RuleName(), true
+}
+
+func (r *externalSeriesRegistry) MissingDataForMetric(metricName string) config.MissingDataPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-	return query, found, err
+	info, found := r.metricsInfo[metricName]
+	if !found {
+		return ""
+	}
+	return info.namer.MissingData()
+}
+
+func (r *externalSeriesRegistry) AllowsUser(metricName string, u user.Info) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	info, found := r.metricsInfo[metricName]
+	if !found {
+		return true
+	}
+	return info.namer.AllowsUser(u)
 }
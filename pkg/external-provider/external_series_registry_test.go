@@ -0,0 +1,91 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+)
+
+func TestMetricsAreOnlyServedInAllowedNamespaces(t *testing.T) {
+	namespaced := false
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery:  `{queue!=""}`,
+			Namespaces:   []string{"team-a"},
+			Resources:    config.ResourceMapping{Namespaced: &namespaced},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	registry := &externalSeriesRegistry{}
+	registry.filterAndStoreMetrics(MetricUpdateResult{
+		series: [][]prom.Series{{{Name: "queue_depth"}}},
+		namers: namers,
+	})
+
+	_, found, err := registry.PlanForMetric("team-a", "queue_depth", labels.Everything())
+	require.NoError(t, err)
+	require.True(t, found)
+
+	_, found, err = registry.PlanForMetric("team-b", "queue_depth", labels.Everything())
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestMetricsAreOnlyServedToAllowedUsers(t *testing.T) {
+	namespaced := false
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery:  `{queue!=""}`,
+			Access:       &config.AccessRule{Users: []string{"alice"}, Groups: []string{"team-a"}},
+			Resources:    config.ResourceMapping{Namespaced: &namespaced},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	registry := &externalSeriesRegistry{}
+	registry.filterAndStoreMetrics(MetricUpdateResult{
+		series: [][]prom.Series{{{Name: "queue_depth"}}},
+		namers: namers,
+	})
+
+	require.True(t, registry.AllowsUser("queue_depth", &user.DefaultInfo{Name: "alice"}))
+	require.True(t, registry.AllowsUser("queue_depth", &user.DefaultInfo{Name: "bob", Groups: []string{"team-a"}}))
+	require.False(t, registry.AllowsUser("queue_depth", &user.DefaultInfo{Name: "bob", Groups: []string{"team-b"}}))
+	require.False(t, registry.AllowsUser("queue_depth", nil))
+	require.True(t, registry.AllowsUser("queue_age_seconds", nil))
+
+	prov := &externalPrometheusProvider{seriesRegistry: registry}
+	ctx := genericapirequest.WithUser(context.Background(), &user.DefaultInfo{Name: "bob"})
+	_, err = prov.GetExternalMetric(ctx, "default", labels.Everything(), provider.ExternalMetricInfo{Metric: "queue_depth"})
+	require.True(t, apierr.IsForbidden(err), "expected a Forbidden error, got %v", err)
+}
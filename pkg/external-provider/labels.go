@@ -0,0 +1,86 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net/http"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// LabelsPath is the path on which the handler returned by NewLabelsHandler is
+// expected to be served.
+const LabelsPath = "/debug/external-metrics/labels"
+
+// MetricLabels lists the names of the labels of the series an external
+// metric is discovered from, which can be used in its label selectors.
+type MetricLabels struct {
+	// Metric is the name of the external metric.
+	Metric string `json:"metric"`
+	// Labels are the names of the labels of the series of the metric, in order.
+	Labels []string `json:"labels"`
+}
+
+// LabelLister is implemented by the provider returned from
+// NewExternalPrometheusProvider, listing the labels known for each metric.
+type LabelLister interface {
+	// ListExternalMetricLabels lists the known labels of each external metric
+	// the given user may read, ordered by metric name.
+	ListExternalMetricLabels(u user.Info) []MetricLabels
+}
+
+func (p *externalPrometheusProvider) ListExternalMetricLabels(u user.Info) []MetricLabels {
+	var res []MetricLabels
+	for _, labels := range p.seriesRegistry.ListMetricLabels() {
+		if p.seriesRegistry.AllowsUser(labels.Metric, u) {
+			res = append(res, labels)
+		}
+	}
+	return res
+}
+
+// NewLabelsHandler returns a handler listing the known labels of each external
+// metric, or of the metric named in its "metric" query parameter.  Like the
+// external metrics API, it leaves out the metrics the requesting user isn't
+// allowed to read.
+func NewLabelsHandler(lister LabelLister) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		u, _ := genericapirequest.UserFrom(req.Context())
+		res := lister.ListExternalMetricLabels(u)
+		if metric := req.URL.Query().Get("metric"); metric != "" {
+			var filtered []MetricLabels
+			for _, labels := range res {
+				if labels.Metric == metric {
+					filtered = append(filtered, labels)
+				}
+			}
+			if len(filtered) == 0 {
+				http.Error(w, "unknown external metric "+metric, http.StatusNotFound)
+				return
+			}
+			res = filtered
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+)
+
+func TestLabelsHandlerListsTheLabelsOfEachMetric(t *testing.T) {
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{queue!=""}`, MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`},
+		{
+			SeriesQuery:  `{__name__="payroll_backlog"}`,
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+			Access:       &config.AccessRule{Users: []string{"alice"}},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	registry := &externalSeriesRegistry{}
+	registry.filterAndStoreMetrics(MetricUpdateResult{
+		series: [][]prom.Series{{
+			{Name: "queue_depth", Labels: pmodel.LabelSet{"queue": "jobs", "namespace": "default"}},
+			{Name: "queue_depth", Labels: pmodel.LabelSet{"queue": "mail", "region": "eu"}},
+			{Name: "queue_age", Labels: pmodel.LabelSet{"queue": "jobs"}},
+		}, {
+			{Name: "payroll_backlog", Labels: pmodel.LabelSet{"team": "finance"}},
+		}},
+		namers: namers,
+	})
+	handler := NewLabelsHandler(&externalPrometheusProvider{seriesRegistry: registry})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, LabelsPath, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var labels []MetricLabels
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &labels))
+	require.Equal(t, []MetricLabels{
+		{Metric: "queue_age", Labels: []string{"queue"}},
+		{Metric: "queue_depth", Labels: []string{"namespace", "queue", "region"}},
+	}, labels)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, LabelsPath+"?metric=queue_age", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &labels))
+	require.Equal(t, []MetricLabels{{Metric: "queue_age", Labels: []string{"queue"}}}, labels)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, LabelsPath+"?metric=missing", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	// the metrics of restricted rules are only listed for the users allowed to read them
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, LabelsPath+"?metric=payroll_backlog", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	req := httptest.NewRequest(http.MethodGet, LabelsPath, nil)
+	req = req.WithContext(genericapirequest.WithUser(req.Context(), &user.DefaultInfo{Name: "alice"}))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &labels))
+	require.Equal(t, []MetricLabels{
+		{Metric: "payroll_backlog", Labels: []string{"team"}},
+		{Metric: "queue_age", Labels: []string{"queue"}},
+		{Metric: "queue_depth", Labels: []string{"namespace", "queue", "region"}},
+	}, labels)
+}
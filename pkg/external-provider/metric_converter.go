@@ -19,19 +19,19 @@ import (
 
 	"github.com/prometheus/common/model"
 
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
 )
 
 // MetricConverter provides a unified interface for converting the results of
 // Prometheus queries into external metric types.
 type MetricConverter interface {
-	Convert(info provider.ExternalMetricInfo, queryResult prom.QueryResult) (*external_metrics.ExternalMetricValueList, error)
+	Convert(info provider.ExternalMetricInfo, queryResult prom.QueryResult, values queryplan.ValueConversion) (*external_metrics.ExternalMetricValueList, error)
 }
 
 type metricConverter struct {
@@ -43,19 +43,19 @@ func NewMetricConverter() MetricConverter {
 	return &metricConverter{}
 }
 
-func (c *metricConverter) Convert(info provider.ExternalMetricInfo, queryResult prom.QueryResult) (*external_metrics.ExternalMetricValueList, error) {
+func (c *metricConverter) Convert(info provider.ExternalMetricInfo, queryResult prom.QueryResult, values queryplan.ValueConversion) (*external_metrics.ExternalMetricValueList, error) {
 	if queryResult.Type == model.ValScalar {
-		return c.convertScalar(info, queryResult)
+		return c.convertScalar(info, queryResult, values)
 	}
 
 	if queryResult.Type == model.ValVector {
-		return c.convertVector(info, queryResult)
+		return c.convertVector(info, queryResult, values)
 	}
 
 	return nil, errors.New("encountered an unexpected query result type")
 }
 
-func (c *metricConverter) convertSample(info provider.ExternalMetricInfo, sample *model.Sample) (*external_metrics.ExternalMetricValue, error) {
+func (c *metricConverter) convertSample(info provider.ExternalMetricInfo, sample *model.Sample, values queryplan.ValueConversion) (*external_metrics.ExternalMetricValue, error) {
 	labels := c.convertLabels(sample.Metric)
 
 	singleMetric := external_metrics.ExternalMetricValue{
@@ -63,7 +63,7 @@ func (c *metricConverter) convertSample(info provider.ExternalMetricInfo, sample
 		Timestamp: metav1.Time{
 			Time: sample.Timestamp.Time(),
 		},
-		Value:        *resource.NewMilliQuantity(int64(sample.Value*1000.0), resource.DecimalSI),
+		Value:        *values.Quantity(sample.Value),
 		MetricLabels: labels,
 	}
 
@@ -80,7 +80,7 @@ func (c *metricConverter) convertLabels(inLabels model.Metric) map[string]string
 	return outLabels
 }
 
-func (c *metricConverter) convertVector(info provider.ExternalMetricInfo, queryResult prom.QueryResult) (*external_metrics.ExternalMetricValueList, error) {
+func (c *metricConverter) convertVector(info provider.ExternalMetricInfo, queryResult prom.QueryResult, values queryplan.ValueConversion) (*external_metrics.ExternalMetricValueList, error) {
 	if queryResult.Type != model.ValVector {
 		return nil, errors.New("incorrect query result type")
 	}
@@ -102,7 +102,7 @@ func (c *metricConverter) convertVector(info provider.ExternalMetricInfo, queryR
 	}
 
 	for _, val := range toConvert {
-		singleMetric, err := c.convertSample(info, val)
+		singleMetric, err := c.convertSample(info, val, values)
 
 		if err != nil {
 			return nil, fmt.Errorf("unable to convert vector: %v", err)
@@ -117,7 +117,7 @@ func (c *metricConverter) convertVector(info provider.ExternalMetricInfo, queryR
 	return &metricValueList, nil
 }
 
-func (c *metricConverter) convertScalar(info provider.ExternalMetricInfo, queryResult prom.QueryResult) (*external_metrics.ExternalMetricValueList, error) {
+func (c *metricConverter) convertScalar(info provider.ExternalMetricInfo, queryResult prom.QueryResult, values queryplan.ValueConversion) (*external_metrics.ExternalMetricValueList, error) {
 	if queryResult.Type != model.ValScalar {
 		return nil, errors.New("scalarConverter can only convert scalar query results")
 	}
@@ -135,7 +135,7 @@ func (c *metricConverter) convertScalar(info provider.ExternalMetricInfo, queryR
 				Timestamp: metav1.Time{
 					Time: toConvert.Timestamp.Time(),
 				},
-				Value: *resource.NewMilliQuantity(int64(toConvert.Value*1000.0), resource.DecimalSI),
+				Value: *values.Quantity(toConvert.Value),
 			},
 		},
 	}
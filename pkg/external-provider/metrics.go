@@ -0,0 +1,132 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	// queuedQueries is the number of external metric queries waiting for
+	// a free slot, broken down by metric.
+	queuedQueries = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "external_metrics",
+			Name:      "queued_queries",
+			Help:      "Number of external metric queries waiting for a free query slot, by metric",
+		},
+		[]string{"metric"},
+	)
+	// inflightQueries is the number of external metric queries currently
+	// running against Prometheus, broken down by metric.
+	inflightQueries = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "external_metrics",
+			Name:      "inflight_queries",
+			Help:      "Number of external metric queries currently being run against Prometheus, by metric",
+		},
+		[]string{"metric"},
+	)
+	// ruleSeries is the number of series discovered by each discovery rule,
+	// after filtering, as of the last relist.
+	ruleSeries = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "external_metrics",
+			Name:      "rule_series",
+			Help:      "Number of series discovered by each external metrics rule as of the last relist, by rule",
+		},
+		[]string{"rule"},
+	)
+	// exposedMetrics is the number of metrics currently exposed in the API.
+	exposedMetrics = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "external_metrics",
+			Name:      "exposed_metrics",
+			Help:      "Number of metrics currently exposed in the external metrics API",
+		},
+	)
+	// metricNameCollisions is the number of metrics produced by several rules,
+	// as of the last relist.
+	metricNameCollisions = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "external_metrics",
+			Name:      "metric_name_collisions",
+			Help:      "Number of external metrics produced by several rules as of the last relist",
+		},
+	)
+	// relistDuration is the time taken to relist the available series.
+	relistDuration = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "external_metrics",
+			Name:      "relist_duration_seconds",
+			Help:      "Time taken to relist the series available for external metrics",
+			Buckets:   metrics.ExponentialBuckets(0.01, 2, 14),
+		},
+	)
+	// relistErrors is the number of failed series queries, by selector.
+	relistErrors = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "external_metrics",
+			Name:      "relist_errors_total",
+			Help:      "Number of series queries which failed while relisting external metrics, by series selector",
+		},
+		[]string{"selector"},
+	)
+	// queryBuildFailures is the number of metric queries which couldn't be
+	// built from their rule, by rule.
+	queryBuildFailures = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "external_metrics",
+			Name:      "query_build_failures_total",
+			Help:      "Number of external metrics queries which couldn't be built from their rule, by rule",
+		},
+		[]string{"rule"},
+	)
+	// missingOverrideLabels flags the labels mapped to resources in the
+	// overrides of a rule which none of the series it discovered carry, as of
+	// the last relist.
+	missingOverrideLabels = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "external_metrics",
+			Name:      "missing_override_labels",
+			Help:      "Labels mapped to resources in the overrides of an external metrics rule which none of the series it discovered carry, as of the last relist, by rule and label",
+		},
+		[]string{"rule", "label"},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers the external provider metrics with the legacy registry,
+// which is served on the adapter's /metrics endpoint.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(queuedQueries, inflightQueries, ruleSeries, exposedMetrics, metricNameCollisions, relistDuration, relistErrors, queryBuildFailures, missingOverrideLabels)
+	})
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"time"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+)
+
+// DefaultUpdateInterval is the interval between two relists of the series
+// of the rules, when none is given in the options.
+const DefaultUpdateInterval = 10 * time.Minute
+
+// Options configures an external metrics provider (see
+// NewExternalPrometheusProvider).  Client and Namers are required.  The zero
+// value of the other fields disables the feature they configure, unless
+// documented otherwise.
+//
+// The providers log through klog, which can be redirected with klog.SetLogger.
+type Options struct {
+	// Client is the Prometheus client the series are listed and queried with.
+	Client prom.Client
+	// Namers are the rules the metrics are discovered and queried with.
+	Namers []naming.MetricNamer
+
+	// UpdateInterval is the interval between two relists of the series of
+	// the rules.  It defaults to DefaultUpdateInterval.
+	UpdateInterval time.Duration
+	// MaxAge is how far back series are listed.  It defaults to UpdateInterval.
+	MaxAge time.Duration
+	// QueryTimeout, if positive, bounds the duration of each query.
+	QueryTimeout time.Duration
+	// MaxConcurrentQueriesPerMetric, if positive, bounds the number of
+	// simultaneous queries for any single metric.
+	MaxConcurrentQueriesPerMetric int
+	// RelistLimiter, if set, bounds the concurrency and rate of the series
+	// queries run by relists.  It may be shared with other providers.
+	RelistLimiter *prom.RequestLimiter
+
+	// Overrides, if set, holds values served instead of querying Prometheus.
+	Overrides *OverrideStore
+	// DiscoverNames discovers metrics through the label values API (see
+	// NewNameMetricLister).
+	DiscoverNames bool
+	// ExposeRuleInErrors names the rule a metric comes from in errors about it.
+	ExposeRuleInErrors bool
+	// RejectCollisions ignores relists in which several rules produce the
+	// same metric (see NewExternalSeriesRegistry).
+	RejectCollisions bool
+	// AllNamespaces, if set, is a namespace in which metrics are queried
+	// across all namespaces, without matching the namespace label, so that
+	// cluster-level autoscalers can get totals.
+	AllNamespaces string
+	// Failures, if set, is told about the outcome of each query.
+	Failures queryplan.FailureReporter
+	// OnUpdate, if set, is called after the available metrics were updated
+	// by a relist.
+	OnUpdate func()
+}
+
+// complete fills in the defaults of unset options.
+func (o *Options) complete() {
+	if o.UpdateInterval <= 0 {
+		o.UpdateInterval = DefaultUpdateInterval
+	}
+	if o.MaxAge <= 0 {
+		o.MaxAge = o.UpdateInterval
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// OverridesPath is the path on which the override store's handler is expected to be served.
+const OverridesPath = "/debug/external-metrics/overrides"
+
+// Override is a temporary, operator-supplied value for an external metric, served
+// in place of the value from Prometheus until it expires.
+type Override struct {
+	// Metric is the name of the overridden external metric.
+	Metric string `json:"metric"`
+	// Namespace restricts the override to requests in a single namespace.
+	// If empty, the override applies to all namespaces.
+	Namespace string `json:"namespace,omitempty"`
+	// Value is the value served for the metric.
+	Value resource.Quantity `json:"value"`
+	// Expires is the time at which the override stops being served.
+	Expires time.Time `json:"expires"`
+	// SetBy is the user that set the override.
+	SetBy string `json:"setBy,omitempty"`
+}
+
+type overrideKey struct {
+	metric    string
+	namespace string
+}
+
+// OverrideStore holds temporary values for external metrics, which are served
+// instead of querying Prometheus.  It's meant for game days, allowing operators
+// to exercise autoscaling behavior without manipulating Prometheus data.  All
+// changes are audit-logged, and overrides always expire after at most maxTTL.
+type OverrideStore struct {
+	maxTTL time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	overrides map[overrideKey]Override
+}
+
+// NewOverrideStore creates an empty OverrideStore, which rejects overrides
+// lasting longer than maxTTL.
+func NewOverrideStore(maxTTL time.Duration) *OverrideStore {
+	return &OverrideStore{
+		maxTTL:    maxTTL,
+		now:       time.Now,
+		overrides: make(map[overrideKey]Override),
+	}
+}
+
+// Set overrides the given metric (in the given namespace, or all namespaces if
+// empty) with the given value, for the duration of the TTL.
+func (s *OverrideStore) Set(metric, namespace string, value resource.Quantity, ttl time.Duration, user string) (Override, error) {
+	if metric == "" {
+		return Override{}, fmt.Errorf("a metric name must be specified")
+	}
+	if ttl <= 0 || ttl > s.maxTTL {
+		return Override{}, fmt.Errorf("the TTL must be positive and at most %s", s.maxTTL)
+	}
+
+	override := Override{
+		Metric:    metric,
+		Namespace: namespace,
+		Value:     value,
+		Expires:   s.now().Add(ttl),
+		SetBy:     user,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides[overrideKey{metric: metric, namespace: namespace}] = override
+
+	klog.Infof("external metric override set by %q: metric %q in namespace %q set to %s until %s",
+		user, metric, namespace, value.String(), override.Expires.Format(time.RFC3339))
+	return override, nil
+}
+
+// Delete removes the override for the given metric and namespace, returning
+// whether there was one.
+func (s *OverrideStore) Delete(metric, namespace string, user string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := overrideKey{metric: metric, namespace: namespace}
+	if _, ok := s.overrides[key]; !ok {
+		return false
+	}
+	delete(s.overrides, key)
+
+	klog.Infof("external metric override removed by %q: metric %q in namespace %q", user, metric, namespace)
+	return true
+}
+
+// Get returns the active override for the given metric in the given namespace,
+// preferring an override specific to the namespace over one for all namespaces.
+// It's safe to call on a nil store.
+func (s *OverrideStore) Get(metric, namespace string) (Override, bool) {
+	if s == nil {
+		return Override{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range []overrideKey{{metric: metric, namespace: namespace}, {metric: metric}} {
+		override, ok := s.overrides[key]
+		if !ok {
+			continue
+		}
+		if !s.now().Before(override.Expires) {
+			delete(s.overrides, key)
+			klog.Infof("external metric override expired: metric %q in namespace %q", key.metric, key.namespace)
+			continue
+		}
+		return override, true
+	}
+	return Override{}, false
+}
+
+// List returns all active overrides, sorted by metric and namespace.
+func (s *OverrideStore) List() []Override {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	res := make([]Override, 0, len(s.overrides))
+	for key, override := range s.overrides {
+		if !now.Before(override.Expires) {
+			delete(s.overrides, key)
+			continue
+		}
+		res = append(res, override)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Metric != res[j].Metric {
+			return res[i].Metric < res[j].Metric
+		}
+		return res[i].Namespace < res[j].Namespace
+	})
+	return res
+}
+
+// valueList converts an override to the value list served by the external metrics API.
+func (o Override) valueList() *external_metrics.ExternalMetricValueList {
+	return &external_metrics.ExternalMetricValueList{
+		Items: []external_metrics.ExternalMetricValue{
+			{
+				MetricName:   o.Metric,
+				MetricLabels: map[string]string{},
+				Timestamp:    metav1.Now(),
+				Value:        o.Value,
+			},
+		},
+	}
+}
+
+// ServeHTTP lists (GET), sets (PUT or POST) and removes (DELETE) overrides.
+// The metric, namespace, value and ttl are passed as query parameters.  It's
+// up to the server to make sure that only administrators can reach it.
+func (s *OverrideStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	user := "unknown"
+	if u, ok := genericapirequest.UserFrom(req.Context()); ok {
+		user = u.GetName()
+	}
+	params := req.URL.Query()
+	metric, namespace := params.Get("metric"), params.Get("namespace")
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.List())
+	case http.MethodPut, http.MethodPost:
+		value, err := resource.ParseQuantity(params.Get("value"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid value %q: %v", params.Get("value"), err), http.StatusBadRequest)
+			return
+		}
+		ttl, err := time.ParseDuration(params.Get("ttl"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid ttl %q: %v", params.Get("ttl"), err), http.StatusBadRequest)
+			return
+		}
+		override, err := s.Set(metric, namespace, value, ttl, user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, override)
+	case http.MethodDelete:
+		if !s.Delete(metric, namespace, user) {
+			http.Error(w, fmt.Sprintf("no override for metric %q in namespace %q", metric, namespace), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		klog.Errorf("unable to write response: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestOverrideStoreExpiresOverrides(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	store := NewOverrideStore(time.Hour)
+	store.now = func() time.Time { return now }
+
+	_, err := store.Set("queue_length", "", resource.MustParse("100"), 10*time.Minute, "admin")
+	require.NoError(t, err)
+
+	override, found := store.Get("queue_length", "somens")
+	require.True(t, found)
+	require.Equal(t, "100", override.Value.String())
+
+	now = now.Add(10 * time.Minute)
+	_, found = store.Get("queue_length", "somens")
+	require.False(t, found)
+	require.Empty(t, store.List())
+}
+
+func TestOverrideStorePrefersNamespacedOverrides(t *testing.T) {
+	store := NewOverrideStore(time.Hour)
+
+	_, err := store.Set("queue_length", "", resource.MustParse("1"), time.Minute, "admin")
+	require.NoError(t, err)
+	_, err = store.Set("queue_length", "somens", resource.MustParse("2"), time.Minute, "admin")
+	require.NoError(t, err)
+
+	override, found := store.Get("queue_length", "somens")
+	require.True(t, found)
+	require.Equal(t, "2", override.Value.String())
+
+	override, found = store.Get("queue_length", "otherns")
+	require.True(t, found)
+	require.Equal(t, "1", override.Value.String())
+
+	require.True(t, store.Delete("queue_length", "somens", "admin"))
+	override, found = store.Get("queue_length", "somens")
+	require.True(t, found)
+	require.Equal(t, "1", override.Value.String())
+}
+
+func TestOverrideStoreRejectsLongTTLs(t *testing.T) {
+	store := NewOverrideStore(time.Hour)
+
+	_, err := store.Set("queue_length", "", resource.MustParse("1"), 2*time.Hour, "admin")
+	require.Error(t, err)
+	_, found := store.Get("queue_length", "")
+	require.False(t, found)
+}
+
+func TestOverrideStoreHandler(t *testing.T) {
+	store := NewOverrideStore(time.Hour)
+
+	rec := httptest.NewRecorder()
+	store.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, OverridesPath+"?metric=queue_length&namespace=somens&value=42&ttl=5m", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	store.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, OverridesPath, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var overrides []Override
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &overrides))
+	require.Len(t, overrides, 1)
+	require.Equal(t, "queue_length", overrides[0].Metric)
+	require.Equal(t, "somens", overrides[0].Namespace)
+	require.Equal(t, "42", overrides[0].Value.String())
+
+	rec = httptest.NewRecorder()
+	store.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, OverridesPath+"?metric=queue_length&value=42&ttl=5h", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	store.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, OverridesPath+"?metric=queue_length&namespace=somens", nil))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Empty(t, store.List())
+}
@@ -17,17 +17,37 @@ limitations under the License.
 package provider
 
 import (
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
 )
 
 type periodicMetricLister struct {
-	realLister       MetricLister
-	updateInterval   time.Duration
+	realLister     MetricLister
+	updateInterval time.Duration
+	callbacks      []MetricUpdateCallback
+
+	// updateMu serializes updates, which may be triggered both periodically
+	// and when the namers are replaced
+	updateMu         sync.Mutex
 	mostRecentResult MetricUpdateResult
-	callbacks        []MetricUpdateCallback
+	// synced is set once the metrics were successfully listed
+	synced atomic.Bool
+}
+
+// SyncChecker is implemented by the Runnable returned from
+// NewExternalPrometheusProvider, telling whether the available metrics were
+// listed yet.
+type SyncChecker interface {
+	// HasSynced checks whether the available metrics were successfully
+	// listed at least once.
+	HasSynced() bool
 }
 
 // NewPeriodicMetricLister creates a MetricLister that periodically pulls the list of available metrics
@@ -55,14 +75,67 @@ func (l *periodicMetricLister) Run() {
 }
 
 func (l *periodicMetricLister) RunUntil(stopChan <-chan struct{}) {
-	go wait.Until(func() {
+	go naming.RelistUntil(func() {
 		if err := l.updateMetrics(); err != nil {
 			utilruntime.HandleError(err)
 		}
-	}, l.updateInterval, stopChan)
+	}, l.relistPeriod, stopChan)
+}
+
+// relistPeriodLister is implemented by the MetricListers whose rules may have
+// to be relisted more often than the update interval.
+type relistPeriodLister interface {
+	relistPeriod(defaultInterval time.Duration) time.Duration
+}
+
+// relistPeriod returns the period between two updates, which is shorter than
+// updateInterval if the underlying lister has rules to relist more often.
+func (l *periodicMetricLister) relistPeriod() time.Duration {
+	if lister, ok := l.realLister.(relistPeriodLister); ok {
+		return lister.relistPeriod(l.updateInterval)
+	}
+	return l.updateInterval
+}
+
+// SetNamers replaces the namers of the underlying lister, if it supports it,
+// and immediately relists the available metrics.
+func (l *periodicMetricLister) SetNamers(namers []naming.MetricNamer) error {
+	apply, err := l.PrepareNamers(namers)
+	if err != nil {
+		return err
+	}
+	return apply()
+}
+
+// PrepareNamers lists the metrics of the given namers with the underlying
+// lister, if it supports it, without serving them yet: the returned function
+// replaces the namers of the underlying lister, and serves these metrics.
+func (l *periodicMetricLister) PrepareNamers(namers []naming.MetricNamer) (func() error, error) {
+	lister, ok := l.realLister.(namersLister)
+	if !ok {
+		return nil, fmt.Errorf("metric lister does not support replacing namers")
+	}
+	result, err := lister.listMetricsOf(namers)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		l.updateMu.Lock()
+		defer l.updateMu.Unlock()
+		if err := lister.SetNamers(namers); err != nil {
+			return err
+		}
+		l.mostRecentResult = result
+		l.notifyListeners()
+		l.synced.Store(true)
+		return nil
+	}, nil
 }
 
 func (l *periodicMetricLister) updateMetrics() error {
+	l.updateMu.Lock()
+	defer l.updateMu.Unlock()
+
 	result, err := l.realLister.ListAllMetrics()
 
 	if err != nil {
@@ -73,9 +146,14 @@ func (l *periodicMetricLister) updateMetrics() error {
 	l.mostRecentResult = result
 	// Let our listeners know we've got new data ready for them.
 	l.notifyListeners()
+	l.synced.Store(true)
 	return nil
 }
 
+func (l *periodicMetricLister) HasSynced() bool {
+	return l.synced.Load()
+}
+
 func (l *periodicMetricLister) notifyListeners() {
 	for _, listener := range l.callbacks {
 		if listener != nil {
@@ -81,3 +81,12 @@ func TestWhenListingMetricsReturnsCachedValues(t *testing.T) {
 	require.NotEqual(t, 0, len(resultAfterUpdate.series))
 	require.Equal(t, 1, fakeLister.callCount)
 }
+
+func TestListerHasSyncedOnceMetricsWereListed(t *testing.T) {
+	_, runner := NewPeriodicMetricLister(&fakeLister{}, time.Duration(1000))
+	checker := runner.(SyncChecker)
+	require.False(t, checker.HasSynced())
+
+	runner.(*periodicMetricLister).UpdateNow()
+	require.True(t, checker.HasSynced())
+}
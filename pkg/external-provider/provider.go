@@ -15,50 +15,183 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
-	pmodel "github.com/prometheus/common/model"
-
 	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/klog/v2"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
 	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+	"sigs.k8s.io/prometheus-adapter/pkg/staleness"
 )
 
 type externalPrometheusProvider struct {
-	promClient      prom.Client
+	executor        *queryplan.Executor
 	metricConverter MetricConverter
+	queryLimiter    *queryLimiter
+	overrides       *OverrideStore
+	// exposeRuleInErrors indicates that the rule a metric comes from should
+	// be attached to errors about it.
+	exposeRuleInErrors bool
+	// failures is told about the outcome of queries, if set
+	failures queryplan.FailureReporter
+	// allNamespaces is the namespace in which metrics are queried across all
+	// namespaces, if any
+	allNamespaces string
 
 	seriesRegistry ExternalSeriesRegistry
 }
 
 func (p *externalPrometheusProvider) GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
-	selector, found, err := p.seriesRegistry.QueryForMetric(namespace, info.Metric, metricSelector)
+	u, _ := genericapirequest.UserFrom(ctx)
+	if !p.seriesRegistry.AllowsUser(info.Metric, u) {
+		userName := "unknown"
+		if u != nil {
+			userName = u.GetName()
+		}
+		klog.V(2).Infof("denying access to external metric %q to user %q", info.Metric, userName)
+		return nil, apierr.NewForbidden(schema.GroupResource{Group: external_metrics.GroupName, Resource: info.Metric}, "", fmt.Errorf("access to the metric is restricted"))
+	}
+
+	if override, ok := p.overrides.Get(info.Metric, namespace); ok {
+		klog.V(2).Infof("serving overridden value %s for external metric %q in namespace %q", override.Value.String(), info.Metric, namespace)
+		return override.valueList(), nil
+	}
+
+	plan, found, err := p.seriesRegistry.PlanForMetric(p.queryNamespace(namespace), info.Metric, metricSelector)
 
+	if errors.Is(err, naming.ErrInvalidQueryParameter) {
+		rule, _ := p.seriesRegistry.RuleForMetric(info.Metric)
+		klog.V(2).Infof("invalid selector for external metric %q: %v", info.Metric, err)
+		return nil, p.withRuleDetails(apierr.NewBadRequest(err.Error()), rule)
+	}
 	if err != nil {
-		klog.Errorf("unable to generate a query for the metric: %v", err)
-		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+		rule, _ := p.seriesRegistry.RuleForMetric(info.Metric)
+		klog.Errorf("unable to generate a query for the metric using rule %q: %v", rule, err)
+		p.reportFailure(info, rule, err)
+		return nil, p.withRuleDetails(apierr.NewInternalError(fmt.Errorf("unable to fetch metrics")), rule)
 	}
 
 	if !found {
 		return nil, provider.NewMetricNotFoundError(p.selectGroupResource(namespace), info.Metric)
 	}
-	// Here is where we're making the query, need to be before here xD
-	queryResults, err := p.promClient.Query(ctx, pmodel.Now(), selector)
 
+	release, err := p.queryLimiter.acquire(ctx, info.Metric)
+	if err != nil {
+		klog.Errorf("gave up waiting to query external metric %q: %v", info.Metric, err)
+		return nil, apierr.NewTooManyRequests(fmt.Sprintf("too many concurrent queries for external metric %s", info.Metric), 1)
+	}
+	defer release()
+
+	queryResults, err := p.executor.Execute(ctx, plan)
+	if prom.IsTimeout(err) {
+		klog.Errorf("timed out fetching metrics from prometheus for rule %q: %v", plan.Rule, err)
+		p.reportFailure(info, plan.Rule, err)
+		return nil, p.withRuleDetails(apierr.NewTimeoutError("timed out fetching metrics", 0), plan.Rule)
+	}
+	if errors.Is(err, queryplan.ErrLimitExceeded) {
+		klog.Errorf("refused to fetch metrics from prometheus for rule %q: %v", plan.Rule, err)
+		p.reportFailure(info, plan.Rule, err)
+		return nil, p.withRuleDetails(apierr.NewInternalError(err), plan.Rule)
+	}
 	if err != nil {
-		klog.Errorf("unable to fetch metrics from prometheus: %v", err)
+		klog.Errorf("unable to fetch metrics from prometheus for rule %q: %v", plan.Rule, err)
+		p.reportFailure(info, plan.Rule, err)
 		// don't leak implementation details to the user
-		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+		return nil, p.withRuleDetails(apierr.NewInternalError(fmt.Errorf("unable to fetch metrics")), plan.Rule)
+	}
+
+	res, err := p.metricConverter.Convert(info, queryResults, plan.Values)
+	if err != nil {
+		p.reportFailure(info, plan.Rule, err)
+		return nil, err
+	}
+	if p.failures != nil {
+		p.failures.QuerySucceeded(external_metrics.GroupName, info.Metric)
+	}
+	if len(res.Items) == 0 {
+		switch p.seriesRegistry.MissingDataForMetric(info.Metric) {
+		case config.MissingDataZero:
+			klog.V(4).Infof("no samples for external metric %q in namespace %q, serving zero", info.Metric, namespace)
+			res.Items = []external_metrics.ExternalMetricValue{{
+				MetricName: info.Metric,
+				Timestamp:  metav1.Time{Time: evaluationTime(plan)},
+				Value:      *plan.Values.Quantity(0),
+			}}
+		case config.MissingDataNotFound:
+			return nil, provider.NewMetricNotFoundError(p.selectGroupResource(namespace), info.Metric)
+		}
+	}
+	for _, item := range res.Items {
+		staleness.Observe(staleness.ExternalAPI, item.Timestamp.Time)
+	}
+	return res, nil
+}
+
+// evaluationTime returns the time the query of the given plan was evaluated at.
+func evaluationTime(plan *queryplan.Plan) time.Time {
+	if plan.Time != 0 {
+		return plan.Time.Time()
+	}
+	return time.Now()
+}
+
+// queryNamespace returns the namespace the queries for requests in the given
+// namespace are restricted to, which is none for requests in the namespace
+// reserved for querying all namespaces.  Metrics of rules restricted to some
+// namespaces aren't served in that namespace.
+func (p *externalPrometheusProvider) queryNamespace(namespace string) string {
+	if p.allNamespaces != "" && namespace == p.allNamespaces {
+		return ""
+	}
+	return namespace
+}
+
+// reportFailure tells the failure reporter, if any, that the query for the
+// given metric failed.
+func (p *externalPrometheusProvider) reportFailure(info provider.ExternalMetricInfo, rule string, err error) {
+	if p.failures != nil {
+		p.failures.QueryFailed(external_metrics.GroupName, info.Metric, rule, err)
 	}
-	return p.metricConverter.Convert(info, queryResults)
+}
+
+// withRuleDetails attaches the rule the metric comes from to the given error, so
+// that users can see which rule to fix.  It's a no-op unless exposing rules in errors
+// has been enabled.
+func (p *externalPrometheusProvider) withRuleDetails(err *apierr.StatusError, rule string) *apierr.StatusError {
+	if !p.exposeRuleInErrors || rule == "" {
+		return err
+	}
+	return naming.WithRuleDetails(err, rule)
+}
+
+// QueryPlanner is implemented by the provider returned from NewExternalPrometheusProvider,
+// exposing the query plans used to answer requests without running them.
+type QueryPlanner interface {
+	// PlanForRequest returns the plan used to fetch the given metric.
+	PlanForRequest(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*queryplan.Plan, error)
+}
+
+func (p *externalPrometheusProvider) PlanForRequest(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*queryplan.Plan, error) {
+	plan, found, err := p.seriesRegistry.PlanForMetric(p.queryNamespace(namespace), info.Metric, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, provider.NewMetricNotFoundError(p.selectGroupResource(namespace), info.Metric)
+	}
+	return plan, nil
 }
 
 func (p *externalPrometheusProvider) ListAllExternalMetrics() []provider.ExternalMetricInfo {
@@ -76,15 +209,39 @@ func (p *externalPrometheusProvider) selectGroupResource(namespace string) schem
 	}
 }
 
-// NewExternalPrometheusProvider creates an ExternalMetricsProvider capable of responding to Kubernetes requests for external metric data
-func NewExternalPrometheusProvider(promClient prom.Client, namers []naming.MetricNamer, updateInterval time.Duration, maxAge time.Duration) (provider.ExternalMetricsProvider, Runnable) {
+// NewExternalPrometheusProvider creates an ExternalMetricsProvider capable of
+// responding to Kubernetes requests for external metric data, configured by the
+// given options, and the Runnable relisting the series of its rules, which has
+// to be run for it to serve metrics.
+func NewExternalPrometheusProvider(opts Options) (provider.ExternalMetricsProvider, Runnable) {
+	registerMetrics()
+	opts.complete()
+	promClient := prom.WithQueryTimeout(opts.Client, opts.QueryTimeout)
+
 	metricConverter := NewMetricConverter()
-	basicLister := NewBasicMetricLister(promClient, namers, maxAge)
-	periodicLister, _ := NewPeriodicMetricLister(basicLister, updateInterval)
-	seriesRegistry := NewExternalSeriesRegistry(periodicLister)
+	basicLister := &basicMetricLister{
+		promClient:     promClient,
+		namers:         opts.Namers,
+		lookback:       opts.MaxAge,
+		relistInterval: opts.UpdateInterval,
+		namesOnly:      opts.DiscoverNames,
+		limiter:        opts.RelistLimiter,
+	}
+	periodicLister, _ := NewPeriodicMetricLister(basicLister, opts.UpdateInterval)
+	seriesRegistry := NewExternalSeriesRegistry(periodicLister, opts.RejectCollisions)
+	if opts.OnUpdate != nil {
+		// registered after the registry, so that it sees the new metrics
+		periodicLister.AddNotificationReceiver(func(MetricUpdateResult) { opts.OnUpdate() })
+	}
 	return &externalPrometheusProvider{
-		promClient:      promClient,
+		executor:        queryplan.NewExecutor(promClient),
 		seriesRegistry:  seriesRegistry,
 		metricConverter: metricConverter,
+		queryLimiter:    newQueryLimiter(opts.MaxConcurrentQueriesPerMetric),
+		overrides:       opts.Overrides,
+
+		exposeRuleInErrors: opts.ExposeRuleInErrors,
+		failures:           opts.Failures,
+		allNamespaces:      opts.AllNamespaces,
 	}, periodicLister
 }
@@ -0,0 +1,232 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+)
+
+func TestQueryOnlyRulesRunTheirQueryWithoutAnySeries(t *testing.T) {
+	namespaced := false
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{
+			Name:        config.NameMapping{As: "kafka_lag_ratio"},
+			Query:       `sum(kafka_consumergroup_lag{<<.LabelMatchers>>}) / sum(kafka_topic_partitions{<<.LabelMatchers>>})`,
+			QueryLabels: []string{"topic"},
+			Resources:   config.ResourceMapping{Namespaced: &namespaced},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	// no series are registered, so listing any would fail
+	client := (&fakeprom.FakePrometheusClient{}).
+		OnQuery(`sum\(kafka_consumergroup_lag\{topic="orders"\}\) / .*`, fakeprom.VectorResult(&pmodel.Sample{Value: 0.5}))
+	prov, runner := NewExternalPrometheusProvider(Options{Client: client, Namers: namers})
+	runner.(*periodicMetricLister).UpdateNow()
+	require.True(t, runner.(SyncChecker).HasSynced())
+
+	require.Equal(t, []provider.ExternalMetricInfo{{Metric: "kafka_lag_ratio"}}, prov.ListAllExternalMetrics())
+
+	selector, err := labels.Parse("topic=orders")
+	require.NoError(t, err)
+	res, err := prov.GetExternalMetric(context.Background(), "default", selector, provider.ExternalMetricInfo{Metric: "kafka_lag_ratio"})
+	require.NoError(t, err)
+	require.Len(t, res.Items, 1)
+	require.Equal(t, "500m", res.Items[0].Value.String())
+}
+
+func TestOnUpdateIsCalledWithTheNewMetricsAvailable(t *testing.T) {
+	namespaced := false
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{
+			Name:      config.NameMapping{As: "kafka_lag"},
+			Query:     `sum(kafka_consumergroup_lag)`,
+			Resources: config.ResourceMapping{Namespaced: &namespaced},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	var listed []provider.ExternalMetricInfo
+	var prov provider.ExternalMetricsProvider
+	prov, runner := NewExternalPrometheusProvider(Options{
+		Client:   &fakeprom.FakePrometheusClient{},
+		Namers:   namers,
+		OnUpdate: func() { listed = prov.ListAllExternalMetrics() },
+	})
+	runner.(*periodicMetricLister).UpdateNow()
+
+	require.Equal(t, []provider.ExternalMetricInfo{{Metric: "kafka_lag"}}, listed)
+}
+
+func TestPreparedNamersAreOnlyServedOnceApplied(t *testing.T) {
+	namespaced := false
+	queryOnlyRule := func(name string) config.DiscoveryRule {
+		return config.DiscoveryRule{
+			Name:      config.NameMapping{As: name},
+			Query:     `sum(` + name + `)`,
+			Resources: config.ResourceMapping{Namespaced: &namespaced},
+		}
+	}
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{queryOnlyRule("kafka_lag")}, nil)
+	require.NoError(t, err)
+	client := &fakeprom.FakePrometheusClient{}
+	prov, runner := NewExternalPrometheusProvider(Options{Client: client, Namers: namers})
+	runner.(*periodicMetricLister).UpdateNow()
+
+	newNamers, err := naming.NamersFromConfig([]config.DiscoveryRule{queryOnlyRule("queue_depth")}, nil)
+	require.NoError(t, err)
+	apply, err := runner.(NamersPreparer).PrepareNamers(newNamers)
+	require.NoError(t, err)
+	runner.(*periodicMetricLister).UpdateNow()
+	require.Equal(t, []provider.ExternalMetricInfo{{Metric: "kafka_lag"}}, prov.ListAllExternalMetrics())
+	require.NoError(t, apply())
+	require.Equal(t, []provider.ExternalMetricInfo{{Metric: "queue_depth"}}, prov.ListAllExternalMetrics())
+
+	// namers whose series can't be listed are rejected
+	failingNamers, err := naming.NamersFromConfig([]config.DiscoveryRule{{SeriesQuery: `{__name__="jobs"}`, Resources: config.ResourceMapping{Namespaced: &namespaced}}}, nil)
+	require.NoError(t, err)
+	client.FailOn(`.*jobs.*`, errors.New("prometheus is down"))
+	_, err = runner.(NamersPreparer).PrepareNamers(failingNamers)
+	require.ErrorContains(t, err, "prometheus is down")
+	runner.(*periodicMetricLister).UpdateNow()
+	require.Equal(t, []provider.ExternalMetricInfo{{Metric: "queue_depth"}}, prov.ListAllExternalMetrics())
+}
+
+func TestQueryParametersAreTakenFromTheSelector(t *testing.T) {
+	namespaced := false
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{
+			Name:            config.NameMapping{As: "queue_backlog"},
+			Query:           `sum(rabbitmq_queue_messages{queue="$queue"})`,
+			QueryParameters: []config.QueryParameter{{Name: "queue", Pattern: "[a-z]+"}},
+			Resources:       config.ResourceMapping{Namespaced: &namespaced},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	client := (&fakeprom.FakePrometheusClient{}).
+		OnQuery(`sum\(rabbitmq_queue_messages\{queue="orders"\}\)`, fakeprom.VectorResult(&pmodel.Sample{Value: 42}))
+	prov, runner := NewExternalPrometheusProvider(Options{Client: client, Namers: namers})
+	runner.(*periodicMetricLister).UpdateNow()
+
+	selector, err := labels.Parse("queue=orders")
+	require.NoError(t, err)
+	res, err := prov.GetExternalMetric(context.Background(), "default", selector, provider.ExternalMetricInfo{Metric: "queue_backlog"})
+	require.NoError(t, err)
+	require.Len(t, res.Items, 1)
+	require.Equal(t, "42", res.Items[0].Value.String())
+
+	selector, err = labels.Parse("queue=orders-2")
+	require.NoError(t, err)
+	_, err = prov.GetExternalMetric(context.Background(), "default", selector, provider.ExternalMetricInfo{Metric: "queue_backlog"})
+	require.True(t, apierr.IsBadRequest(err), "expected a BadRequest error, got %v", err)
+}
+
+func TestMetricsCanBeQueriedAcrossAllNamespaces(t *testing.T) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery:  `{__name__="queue_depth",namespace!=""}`,
+			Resources:    config.ResourceMapping{Template: "<<.Resource>>"},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+		{
+			SeriesQuery:  `{__name__="team_queue_depth",namespace!=""}`,
+			Resources:    config.ResourceMapping{Template: "<<.Resource>>"},
+			Namespaces:   []string{"team-a"},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+	}, mapper)
+	require.NoError(t, err)
+
+	client := (&fakeprom.FakePrometheusClient{}).
+		OnSeries(`.*"queue_depth".*`, prom.Series{Name: "queue_depth", Labels: pmodel.LabelSet{"namespace": "team-a"}}).
+		OnSeries(`.*"team_queue_depth".*`, prom.Series{Name: "team_queue_depth", Labels: pmodel.LabelSet{"namespace": "team-a"}}).
+		OnQuery(`sum\(queue_depth\{namespace="team-a"\}\)`, fakeprom.VectorResult(&pmodel.Sample{Value: 2})).
+		OnQuery(`sum\(queue_depth\{\}\)`, fakeprom.VectorResult(&pmodel.Sample{Value: 5}))
+	prov, runner := NewExternalPrometheusProvider(Options{Client: client, Namers: namers, AllNamespaces: "all-namespaces"})
+	runner.(*periodicMetricLister).UpdateNow()
+
+	res, err := prov.GetExternalMetric(context.Background(), "team-a", labels.Everything(), provider.ExternalMetricInfo{Metric: "queue_depth"})
+	require.NoError(t, err)
+	require.Equal(t, "2", res.Items[0].Value.String())
+
+	res, err = prov.GetExternalMetric(context.Background(), "all-namespaces", labels.Everything(), provider.ExternalMetricInfo{Metric: "queue_depth"})
+	require.NoError(t, err)
+	require.Equal(t, "5", res.Items[0].Value.String())
+
+	// rules restricted to some namespaces aren't served across all of them
+	_, err = prov.GetExternalMetric(context.Background(), "all-namespaces", labels.Everything(), provider.ExternalMetricInfo{Metric: "team_queue_depth"})
+	require.Error(t, err)
+}
+
+func TestMetricsWithoutSamplesFollowTheirMissingDataPolicy(t *testing.T) {
+	namespaced := false
+	rule := func(name string, policy config.MissingDataPolicy) config.DiscoveryRule {
+		return config.DiscoveryRule{
+			Name:              config.NameMapping{As: name},
+			Query:             `sum(rate(http_requests_total[2m]))`,
+			Resources:         config.ResourceMapping{Namespaced: &namespaced},
+			MissingDataPolicy: policy,
+		}
+	}
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{
+		rule("requests_empty", ""),
+		rule("requests_zero", config.MissingDataZero),
+		rule("requests_notfound", config.MissingDataNotFound),
+	}, nil)
+	require.NoError(t, err)
+
+	client := (&fakeprom.FakePrometheusClient{}).
+		OnQuery(`sum\(rate\(http_requests_total\[2m\]\)\)`, fakeprom.VectorResult([]*pmodel.Sample{}...))
+	prov, runner := NewExternalPrometheusProvider(Options{Client: client, Namers: namers})
+	runner.(*periodicMetricLister).UpdateNow()
+
+	res, err := prov.GetExternalMetric(context.Background(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: "requests_empty"})
+	require.NoError(t, err)
+	require.Empty(t, res.Items)
+
+	res, err = prov.GetExternalMetric(context.Background(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: "requests_zero"})
+	require.NoError(t, err)
+	require.Len(t, res.Items, 1)
+	require.Equal(t, "requests_zero", res.Items[0].MetricName)
+	require.Equal(t, "0", res.Items[0].Value.String())
+	require.False(t, res.Items[0].Timestamp.IsZero())
+
+	_, err = prov.GetExternalMetric(context.Background(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: "requests_notfound"})
+	require.True(t, apierr.IsNotFound(err), "expected a NotFound error, got %v", err)
+
+	_, err = naming.NamersFromConfig([]config.DiscoveryRule{rule("requests", "nan")}, nil)
+	require.Error(t, err)
+}
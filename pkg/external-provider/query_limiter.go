@@ -0,0 +1,82 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"sync"
+)
+
+// queryLimiter bounds the number of concurrent queries run for any single
+// external metric, so that a burst of requests for one metric (e.g. many HPAs
+// using different selectors) can't monopolize the connections to Prometheus.
+// Waiters for a given metric are served roughly in arrival order.
+type queryLimiter struct {
+	maxPerMetric int
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// newQueryLimiter creates a queryLimiter allowing at most maxPerMetric concurrent
+// queries per metric.  A non-positive limit disables limiting.
+func newQueryLimiter(maxPerMetric int) *queryLimiter {
+	return &queryLimiter{
+		maxPerMetric: maxPerMetric,
+		slots:        make(map[string]chan struct{}),
+	}
+}
+
+// slotsFor returns the semaphore for the given metric, creating it if necessary.
+func (l *queryLimiter) slotsFor(metric string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	slots, ok := l.slots[metric]
+	if !ok {
+		slots = make(chan struct{}, l.maxPerMetric)
+		l.slots[metric] = slots
+	}
+	return slots
+}
+
+// acquire blocks until a query slot is available for the given metric, or the context
+// is done.  On success, the returned function must be called to release the slot.
+func (l *queryLimiter) acquire(ctx context.Context, metric string) (func(), error) {
+	if l == nil || l.maxPerMetric <= 0 {
+		return func() {}, nil
+	}
+
+	slots := l.slotsFor(metric)
+
+	queued := queuedQueries.WithLabelValues(metric)
+	queued.Inc()
+	select {
+	case slots <- struct{}{}:
+		queued.Dec()
+	case <-ctx.Done():
+		queued.Dec()
+		return nil, ctx.Err()
+	}
+
+	inflight := inflightQueries.WithLabelValues(metric)
+	inflight.Inc()
+	return func() {
+		inflight.Dec()
+		<-slots
+	}, nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLimiterBoundsConcurrencyPerMetric(t *testing.T) {
+	limiter := newQueryLimiter(1)
+
+	release, err := limiter.acquire(context.Background(), "busy_metric")
+	require.NoError(t, err)
+
+	// a different metric shouldn't be affected by the busy one
+	otherRelease, err := limiter.acquire(context.Background(), "other_metric")
+	require.NoError(t, err)
+	otherRelease()
+
+	// the busy metric should make further callers wait until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = limiter.acquire(ctx, "busy_metric")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// once released, the slot is available again
+	release()
+	release, err = limiter.acquire(context.Background(), "busy_metric")
+	require.NoError(t, err)
+	release()
+}
+
+func TestQueryLimiterUnlimited(t *testing.T) {
+	limiter := newQueryLimiter(0)
+
+	for i := 0; i < 10; i++ {
+		_, err := limiter.acquire(context.Background(), "some_metric")
+		require.NoError(t, err)
+	}
+}
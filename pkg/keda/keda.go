@@ -0,0 +1,206 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package keda generates the external metrics rules serving the metrics of
+// KEDA ScaledObjects, so that the HPAs KEDA creates for them can be served by
+// the adapter, in place of the KEDA metrics server.
+package keda
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+// ScaledObjectLabel is the label KEDA selects the external metrics of a
+// ScaledObject with, in the HPA it creates for it.
+const ScaledObjectLabel = "scaledobject.keda.sh/name"
+
+// PrometheusTrigger is the type of the triggers of KEDA's Prometheus scaler.
+const PrometheusTrigger = "prometheus"
+
+// ScaledObject is the part of a KEDA ScaledObject describing its external
+// metrics.
+type ScaledObject struct {
+	Kind     string           `json:"kind" yaml:"kind"`
+	Metadata ObjectMeta       `json:"metadata" yaml:"metadata"`
+	Spec     ScaledObjectSpec `json:"spec" yaml:"spec"`
+}
+
+// ObjectMeta identifies a ScaledObject.
+type ObjectMeta struct {
+	Name      string `json:"name" yaml:"name"`
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+}
+
+// ScaledObjectSpec holds the triggers of a ScaledObject.
+type ScaledObjectSpec struct {
+	Triggers []Trigger `json:"triggers" yaml:"triggers"`
+}
+
+// Trigger is a trigger of a ScaledObject.
+type Trigger struct {
+	// Type is the type of scaler, e.g. prometheus.
+	Type string `json:"type" yaml:"type"`
+	// Metadata are the settings of the scaler, e.g. the query of the
+	// Prometheus scaler.
+	Metadata map[string]string `json:"metadata" yaml:"metadata"`
+}
+
+// MetricName returns the name KEDA gives to the external metric of the
+// trigger of a ScaledObject at the given index, e.g. s0-prometheus.
+func MetricName(index int, trigger Trigger) string {
+	return fmt.Sprintf("s%d-%s", index, trigger.Type)
+}
+
+// document is a document of a YAML stream of manifests: an object, or a list
+// of objects.
+type document struct {
+	ScaledObject `yaml:",inline"`
+	Items        []ScaledObject `yaml:"items"`
+}
+
+// ParseScaledObjects reads the ScaledObjects of the given YAML stream, e.g. a
+// set of manifests, or the output of `kubectl get scaledobjects -A -o yaml`.
+// Other kinds of objects are skipped.
+func ParseScaledObjects(r io.Reader) ([]ScaledObject, error) {
+	var res []ScaledObject
+	dec := yaml.NewDecoder(r)
+	for {
+		var doc document
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return res, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse ScaledObjects: %v", err)
+		}
+		for _, obj := range append([]ScaledObject{doc.ScaledObject}, doc.Items...) {
+			if obj.Kind == "ScaledObject" {
+				res = append(res, obj)
+			}
+		}
+	}
+}
+
+// scaledObjectQuery is the query of the trigger of a ScaledObject.
+type scaledObjectQuery struct {
+	namespace string
+	name      string
+	query     string
+}
+
+// ExternalRules returns the external metrics rules serving the metrics of the
+// Prometheus triggers of the given ScaledObjects, as KEDA's HPAs request
+// them: one query-only rule per metric name, whose query is the one of the
+// trigger of the ScaledObject selected by ScaledObjectLabel in the requested
+// namespace.  Like with KEDA, the metric is 0 when the query returns no
+// samples, unless the trigger sets ignoreNullValues to false, and the metrics
+// of unknown ScaledObjects aren't found.  The Prometheus server of the triggers is ignored, their queries
+// are run against the adapter's.  The triggers of the cpu and memory scalers
+// are served by the resource metrics API, and skipped, while the triggers of
+// other scalers can't be served by the adapter.
+func ExternalRules(objects []ScaledObject) ([]config.DiscoveryRule, error) {
+	queriesByMetric := make(map[string][]scaledObjectQuery)
+	for _, obj := range objects {
+		namespace := obj.Metadata.Namespace
+		if namespace == "" {
+			namespace = "default"
+		}
+		for i, trigger := range obj.Spec.Triggers {
+			switch trigger.Type {
+			case "cpu", "memory":
+				continue
+			case PrometheusTrigger:
+			default:
+				return nil, fmt.Errorf("unsupported trigger type %q in ScaledObject %s/%s, only %q triggers are supported", trigger.Type, namespace, obj.Metadata.Name, PrometheusTrigger)
+			}
+			query := trigger.Metadata["query"]
+			if query == "" {
+				return nil, fmt.Errorf("missing query in trigger %d of ScaledObject %s/%s", i, namespace, obj.Metadata.Name)
+			}
+			ignoreNullValues := true
+			if value, ok := trigger.Metadata["ignoreNullValues"]; ok {
+				var err error
+				if ignoreNullValues, err = strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("invalid ignoreNullValues %q in trigger %d of ScaledObject %s/%s", value, i, namespace, obj.Metadata.Name)
+				}
+			}
+			if ignoreNullValues {
+				query = "(" + query + ") or vector(0)"
+			}
+			name := MetricName(i, trigger)
+			queriesByMetric[name] = append(queriesByMetric[name], scaledObjectQuery{
+				namespace: namespace,
+				name:      obj.Metadata.Name,
+				query:     query,
+			})
+		}
+	}
+
+	names := make([]string, 0, len(queriesByMetric))
+	for name := range queriesByMetric {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rules := make([]config.DiscoveryRule, 0, len(names))
+	for _, name := range names {
+		rules = append(rules, ruleFor(name, queriesByMetric[name]))
+	}
+	return rules, nil
+}
+
+// ruleFor returns the query-only rule serving the given metric, with the
+// queries of the given ScaledObjects.
+func ruleFor(name string, queries []scaledObjectQuery) config.DiscoveryRule {
+	var tmpl strings.Builder
+	fmt.Fprintf(&tmpl, "<<- $scaledObject := index .LabelValuesByName %q ->>\n", ScaledObjectLabel)
+	namespaces := make(map[string]struct{})
+	for i, q := range queries {
+		namespaces[q.namespace] = struct{}{}
+		keyword := "if"
+		if i > 0 {
+			keyword = "else if"
+		}
+		// the query is a string constant, so that it's never interpreted as
+		// a template
+		fmt.Fprintf(&tmpl, "<<- %s and (eq .Namespace %q) (eq $scaledObject %q) >><< %s >>\n",
+			keyword, q.namespace, q.name, strconv.Quote(q.query))
+	}
+	// the metrics of other ScaledObjects have no samples, and aren't found
+	tmpl.WriteString("<<- else >>vector(0) < 0<< end >>")
+
+	rule := config.DiscoveryRule{
+		ID:                "keda-" + name,
+		Query:             tmpl.String(),
+		Name:              config.NameMapping{As: name},
+		Resources:         config.ResourceMapping{Template: "<<.Resource>>"},
+		MissingDataPolicy: config.MissingDataNotFound,
+	}
+	for namespace := range namespaces {
+		rule.Namespaces = append(rule.Namespaces, namespace)
+	}
+	sort.Strings(rule.Namespaces)
+	return rule
+}
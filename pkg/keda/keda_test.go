@@ -0,0 +1,137 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keda
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+)
+
+const scaledObjects = `apiVersion: keda.sh/v1alpha1
+kind: ScaledObject
+metadata:
+  name: web
+  namespace: shop
+spec:
+  scaleTargetRef:
+    name: web
+  triggers:
+  - type: cpu
+    metricType: Utilization
+    metadata:
+      value: "60"
+  - type: prometheus
+    metadata:
+      serverAddress: http://prometheus.monitoring.svc:9090
+      query: sum(rate(http_requests_total{namespace="shop",service="web"}[2m]))
+      threshold: "100"
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+apiVersion: keda.sh/v1alpha1
+kind: ScaledObject
+metadata:
+  name: worker
+  namespace: shop
+spec:
+  triggers:
+  - type: prometheus
+    metadata:
+      query: sum(queue_depth{queue="jobs"})
+      threshold: "10"
+      ignoreNullValues: "false"
+`
+
+func TestExternalRulesServeTheMetricsOfScaledObjects(t *testing.T) {
+	objects, err := ParseScaledObjects(strings.NewReader(scaledObjects))
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+
+	list, err := ParseScaledObjects(strings.NewReader("apiVersion: v1\nkind: List\nitems:\n" + indent(scaledObjects)))
+	require.NoError(t, err)
+	require.Equal(t, objects, list)
+
+	rules, err := ExternalRules(objects)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	require.Equal(t, "s0-prometheus", rules[0].Name.As)
+	require.Equal(t, "s1-prometheus", rules[1].Name.As)
+	require.Equal(t, []string{"shop"}, rules[0].Namespaces)
+	require.Equal(t, config.MissingDataNotFound, rules[0].MissingDataPolicy)
+
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+	namers, err := naming.NamersFromConfig(rules, mapper)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		namer         naming.MetricNamer
+		metric        string
+		scaledObject  string
+		expectedQuery string
+	}{
+		{namer: namers[0], metric: "s0-prometheus", scaledObject: "worker", expectedQuery: `sum(queue_depth{queue="jobs"})`},
+		{namer: namers[1], metric: "s1-prometheus", scaledObject: "web", expectedQuery: `(sum(rate(http_requests_total{namespace="shop",service="web"}[2m]))) or vector(0)`},
+		// the metrics of other ScaledObjects have no samples
+		{namer: namers[0], metric: "s0-prometheus", scaledObject: "web", expectedQuery: "vector(0) < 0"},
+	} {
+		selector := labels.SelectorFromSet(labels.Set{ScaledObjectLabel: test.scaledObject})
+		plan, err := test.namer.PlanForExternalSeries(test.metric, "shop", selector)
+		require.NoError(t, err)
+		require.Equal(t, test.expectedQuery, string(plan.Query))
+	}
+}
+
+// indent turns the given YAML stream into a YAML list.
+func indent(stream string) string {
+	var res strings.Builder
+	for _, doc := range strings.Split(stream, "---\n") {
+		for i, line := range strings.Split(strings.TrimSuffix(doc, "\n"), "\n") {
+			if i == 0 {
+				res.WriteString("- " + line + "\n")
+			} else {
+				res.WriteString("  " + line + "\n")
+			}
+		}
+	}
+	return res.String()
+}
+
+func TestExternalRulesRejectUnsupportedTriggers(t *testing.T) {
+	_, err := ExternalRules([]ScaledObject{{
+		Metadata: ObjectMeta{Name: "consumer"},
+		Spec:     ScaledObjectSpec{Triggers: []Trigger{{Type: "kafka"}}},
+	}})
+	require.ErrorContains(t, err, `unsupported trigger type "kafka" in ScaledObject default/consumer`)
+
+	_, err = ExternalRules([]ScaledObject{{
+		Metadata: ObjectMeta{Name: "consumer"},
+		Spec:     ScaledObjectSpec{Triggers: []Trigger{{Type: "prometheus", Metadata: map[string]string{"query": "vector(1)", "ignoreNullValues": "maybe"}}}},
+	}})
+	require.ErrorContains(t, err, `invalid ignoreNullValues "maybe"`)
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	pmodel "github.com/prometheus/common/model"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+)
+
+// association joins the series of a rule with a query providing the labels
+// which identify their resources (see config.Association).
+type association struct {
+	template *template.Template
+	on       []string
+	labels   []string
+}
+
+// newAssociation compiles the given association config.
+func newAssociation(cfg *config.Association) (*association, error) {
+	if cfg.Query == "" || len(cfg.On) == 0 || len(cfg.Labels) == 0 {
+		return nil, fmt.Errorf("associations must specify a query, and the labels they join on and provide")
+	}
+	templ, err := template.New("association-query").Delims("<<", ">>").Parse(cfg.Query)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse association query template %q: %v", cfg.Query, err)
+	}
+	return &association{
+		template: templ,
+		on:       cfg.On,
+		labels:   cfg.Labels,
+	}, nil
+}
+
+// withAssociation joins the query with the given association.
+func withAssociation(assoc *association) MetricsQueryOption {
+	return func(q *metricsQuery) {
+		q.association = assoc
+	}
+}
+
+// provides checks whether the given label comes from the association query.
+func (a *association) provides(label string) bool {
+	for _, lbl := range a.labels {
+		if lbl == label {
+			return true
+		}
+	}
+	return false
+}
+
+// addLabels returns a copy of the given series, with the labels provided by
+// the association added, so that resources can be derived from them.
+func (a *association) addLabels(series prom.Series) prom.Series {
+	lbls := make(pmodel.LabelSet, len(series.Labels)+len(a.labels))
+	for name, value := range series.Labels {
+		lbls[name] = value
+	}
+	for _, lbl := range a.labels {
+		if _, found := lbls[pmodel.LabelName(lbl)]; !found {
+			lbls[pmodel.LabelName(lbl)] = ""
+		}
+	}
+	return prom.Series{Name: series.Name, Labels: lbls}
+}
+
+// planAssociated is like Plan, for queries with an association.  Matchers on
+// the labels provided by the association, which may include the resource label,
+// are applied to the association query, and the others to the metrics query.
+// The metrics query is grouped by the labels the two are joined on, and the
+// joined result is summed by resource.
+func (q *metricsQuery) planAssociated(series string, queryParts []queryPart, resource schema.GroupResource, namespace string, extraGroupBy []string, names []string) (*queryplan.Plan, error) {
+	resourceLbl, err := q.resConverter.LabelForResource(resource)
+	if err != nil {
+		return nil, err
+	}
+	operator := selection.Equals
+	if len(names) > 1 || q.namePatterns {
+		operator = selection.In
+	}
+	if len(names) == 0 {
+		operator = selection.Exists
+	}
+	queryParts = append(queryParts, queryPart{
+		labelName: string(resourceLbl),
+		values:    names,
+		operator:  operator,
+		patterns:  q.namePatterns,
+	})
+
+	var seriesParts, assocParts []queryPart
+	for _, part := range queryParts {
+		if q.association.provides(part.labelName) {
+			assocParts = append(assocParts, part)
+		} else {
+			seriesParts = append(seriesParts, part)
+		}
+	}
+	// both sides of the join must come from the same cluster
+	if q.cluster != nil && !q.association.provides(q.cluster.labelName) {
+		assocParts = append(assocParts, *q.cluster)
+	}
+	seriesExprs, seriesValues, valueFilters, err := q.processQueryParts(seriesParts)
+	if err != nil {
+		return nil, err
+	}
+	assocExprs, assocValues, _, err := q.processQueryParts(assocParts)
+	if err != nil {
+		return nil, err
+	}
+
+	groupBy := append([]string{string(resourceLbl)}, extraGroupBy...)
+	joinGroupBy := append(append([]string{}, q.association.on...), extraGroupBy...)
+	assocGroupBy := append(append([]string{}, q.association.on...), q.association.labels...)
+
+	seriesQuery, err := q.execute(q.template, "metrics query", queryTemplateArgs{
+		Series:            series,
+		LabelMatchers:     strings.Join(seriesExprs, ","),
+		LabelValuesByName: seriesValues,
+		GroupBy:           strings.Join(joinGroupBy, ","),
+		GroupBySlice:      joinGroupBy,
+		Window:            pmodel.Duration(q.window).String(),
+		Namespace:         namespace,
+		ResourceNames:     names,
+		GroupResource:     resource,
+	})
+	if err != nil {
+		return nil, err
+	}
+	assocQuery, err := q.execute(q.association.template, "association query", queryTemplateArgs{
+		Series:            series,
+		LabelMatchers:     strings.Join(assocExprs, ","),
+		LabelValuesByName: assocValues,
+		GroupBy:           strings.Join(assocGroupBy, ","),
+		GroupBySlice:      assocGroupBy,
+		Window:            pmodel.Duration(q.window).String(),
+		Namespace:         namespace,
+		ResourceNames:     names,
+		GroupResource:     resource,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the association query only contributes labels, so its values are zeroed
+	query := fmt.Sprintf("sum by (%s) ((%s) + on(%s) group_left(%s) (0 * max by (%s) (%s)))",
+		strings.Join(groupBy, ","), seriesQuery,
+		strings.Join(q.association.on, ","), strings.Join(q.association.labels, ","),
+		strings.Join(assocGroupBy, ","), assocQuery)
+
+	return &queryplan.Plan{
+		Series:        series,
+		LabelMatchers: append(seriesExprs, assocExprs...),
+		GroupBy:       groupBy,
+		Query:         prom.Selector(withValueFilters(query, valueFilters)),
+	}, nil
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"fmt"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+// benchmarkSeriesCount is the number of series of the synthetic datasets
+// used by the benchmarks.
+const benchmarkSeriesCount = 100000
+
+// syntheticSeries returns count container series, spread over 100 metrics
+// and 100 namespaces, with a pod per 10 series.
+func syntheticSeries(count int) []prom.Series {
+	series := make([]prom.Series, count)
+	for i := range series {
+		series[i] = prom.Series{
+			Name: fmt.Sprintf("container_metric_%d_total", i%100),
+			Labels: pmodel.LabelSet{
+				"namespace": pmodel.LabelValue(fmt.Sprintf("namespace-%d", i%100)),
+				"pod":       pmodel.LabelValue(fmt.Sprintf("pod-%d", i/10)),
+				"container": pmodel.LabelValue(fmt.Sprintf("container-%d", i%10)),
+			},
+		}
+	}
+	return series
+}
+
+func benchmarkMapper() apimeta.RESTMapper {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+	return mapper
+}
+
+func BenchmarkMetricsQueryBuild(b *testing.B) {
+	converter, err := NewResourceConverter("<<.Resource>>", nil, benchmarkMapper())
+	if err != nil {
+		b.Fatal(err)
+	}
+	query, err := NewMetricsQuery(`sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)`, converter)
+	if err != nil {
+		b.Fatal(err)
+	}
+	metricSelector, err := labels.Parse("container!=POD")
+	if err != nil {
+		b.Fatal(err)
+	}
+	pods := schema.GroupResource{Resource: "pods"}
+
+	for _, count := range []int{1, 100, 10000} {
+		names := make([]string, count)
+		for i := range names {
+			names[i] = fmt.Sprintf("pod-%d", i)
+		}
+		b.Run(fmt.Sprintf("names=%d", count), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := query.Build("container_metric_0_total", pods, "namespace-0", nil, metricSelector, names...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkResourcesForSeries(b *testing.B) {
+	series := syntheticSeries(benchmarkSeriesCount)
+
+	b.Run("template", func(b *testing.B) {
+		converter, err := NewResourceConverter("<<.Resource>>", nil, benchmarkMapper())
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchmarkResourcesForSeries(b, converter, series)
+	})
+	b.Run("overrides", func(b *testing.B) {
+		converter, err := NewResourceConverter("", map[string]config.GroupResource{
+			"namespace": {Resource: "namespace"},
+			"pod":       {Resource: "pod"},
+		}, benchmarkMapper())
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchmarkResourcesForSeries(b, converter, series)
+	})
+}
+
+func benchmarkResourcesForSeries(b *testing.B, converter ResourceConverter, series []prom.Series) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if resources, _ := converter.ResourcesForSeries(series[i%len(series)]); len(resources) != 2 {
+			b.Fatalf("expected series to be associated with namespaces and pods, got %v", resources)
+		}
+	}
+}
+
+func BenchmarkFilterSeries(b *testing.B) {
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery:   `{__name__=~"^container_.*",namespace!="",pod!=""}`,
+			SeriesFilters: []config.RegexFilter{{IsNot: "^container_metric_1.*"}},
+			Resources:     config.ResourceMapping{Template: "<<.Resource>>"},
+			MetricsQuery:  `sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)`,
+		},
+	}, benchmarkMapper())
+	if err != nil {
+		b.Fatal(err)
+	}
+	series := syntheticSeries(benchmarkSeriesCount)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		namers[0].FilterSeries(series)
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"fmt"
+	"strings"
+
+	pmodel "github.com/prometheus/common/model"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// Cluster identifies the cluster whose metrics an adapter serves, when its
+// Prometheus (e.g. Thanos or Mimir) holds the series of several clusters.
+type Cluster struct {
+	// Label is the label holding the name of the cluster of each series.
+	Label pmodel.LabelName
+	// Name is the name of the cluster.
+	Name string
+}
+
+// Validate checks that the cluster label is a valid label name.
+func (c Cluster) Validate() error {
+	if !c.Label.IsValid() {
+		return fmt.Errorf("invalid cluster label name %q", c.Label)
+	}
+	if c.Name == "" {
+		return fmt.Errorf("the name of the cluster must not be empty")
+	}
+	return nil
+}
+
+// restrictSelector adds a matcher on the cluster label to the given series
+// selector, e.g. turning `{__name__=~"^container_.*",pod!=""}` into
+// `{__name__=~"^container_.*",pod!="",cluster="prod"}`.
+func (c Cluster) restrictSelector(selector string) prom.Selector {
+	matcher := prom.LabelEq(string(c.Label), c.Name)
+	selector = strings.TrimSpace(selector)
+	if !strings.HasSuffix(selector, "}") {
+		return prom.Selector(selector + "{" + matcher + "}")
+	}
+	inner := strings.TrimSpace(selector[strings.LastIndex(selector, "{")+1 : len(selector)-1])
+	if inner == "" {
+		return prom.Selector(selector[:len(selector)-1] + matcher + "}")
+	}
+	return prom.Selector(strings.TrimSuffix(selector[:len(selector)-1], ",") + "," + matcher + "}")
+}
@@ -13,7 +13,17 @@ limitations under the License.
 
 package naming
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RuleCauseType is the StatusCause type used to carry the rule a metric comes
+// from in the details of errors returned to the user.
+const RuleCauseType metav1.CauseType = "PrometheusAdapterRule"
 
 var (
 	// ErrUnsupportedOperator creates an error that represents the fact that we were requested to service a query that
@@ -32,3 +42,18 @@ var (
 	// that was malformed in its label specification.
 	ErrLabelNotSpecified = errors.New("label not specified")
 )
+
+// WithRuleDetails attaches the name of the rule (see MetricNamer.RuleName) a
+// metric comes from to the given error, both in its message and as a
+// RuleCauseType cause in its status details.
+func WithRuleDetails(err *apierr.StatusError, rule string) *apierr.StatusError {
+	err.ErrStatus.Message = fmt.Sprintf("%s (rule: %s)", err.ErrStatus.Message, rule)
+	if err.ErrStatus.Details == nil {
+		err.ErrStatus.Details = &metav1.StatusDetails{}
+	}
+	err.ErrStatus.Details.Causes = append(err.ErrStatus.Details.Causes, metav1.StatusCause{
+		Type:    RuleCauseType,
+		Message: rule,
+	})
+	return err
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+const (
+	// histogramBucketsPattern matches the bucket series of histograms,
+	// capturing the name of the histogram.
+	histogramBucketsPattern = "^(.*)_bucket$"
+	// histogramQuantileQuery is the default metrics query of histogram
+	// quantile rules, taking the quantile as its only argument.
+	histogramQuantileQuery = "histogram_quantile(%s, sum(rate(<<.Series>>{<<.LabelMatchers>>}[<<.Window>>])) by (le<<if .GroupBy>>, <<.GroupBy>><<end>>))"
+)
+
+// histogramQuantileRule fills in the defaults of rules converting histogram
+// buckets into quantile metrics: only the `_bucket` series are matched, the
+// metrics are named after the histogram and the percentile, and their query
+// computes the quantile.  Names and queries set on the rule are kept.  Other
+// rules are returned unchanged.
+func histogramQuantileRule(rule config.DiscoveryRule) (config.DiscoveryRule, error) {
+	if rule.HistogramQuantile == nil {
+		return rule, nil
+	}
+	quantile := *rule.HistogramQuantile
+	if quantile <= 0 || quantile >= 1 {
+		return rule, fmt.Errorf("histogram quantile for series query %q must be between 0 and 1, got %v", rule.SeriesQuery, quantile)
+	}
+	if rule.Static != nil {
+		return rule, fmt.Errorf("static rule for series %v can't set a histogram quantile", rule.Static.Names)
+	}
+
+	// only look at the buckets, which carry the le label the quantile needs
+	rule.SeriesFilters = append(append([]config.RegexFilter(nil), rule.SeriesFilters...), config.RegexFilter{Is: histogramBucketsPattern})
+	if rule.Name.Matches == "" && rule.Name.As == "" {
+		rule.Name = config.NameMapping{
+			Matches: histogramBucketsPattern,
+			As:      "${1}_" + percentileSuffix(quantile),
+		}
+	}
+	if rule.MetricsQuery == "" {
+		rule.MetricsQuery = fmt.Sprintf(histogramQuantileQuery, strconv.FormatFloat(quantile, 'f', -1, 64))
+	}
+	return rule, nil
+}
+
+// percentileSuffix names the percentile matching the given quantile, e.g.
+// p95 for 0.95, or p99_9 for 0.999.
+func percentileSuffix(quantile float64) string {
+	// round away floating point noise, e.g. 0.07*100 = 7.000000000000001
+	percentile := strconv.FormatFloat(math.Round(quantile*1e10)/1e8, 'f', -1, 64)
+	return "p" + strings.ReplaceAll(percentile, ".", "_")
+}
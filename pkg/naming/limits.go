@@ -0,0 +1,79 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+)
+
+// Limits bound the cost of the series listed and the queries run for the
+// rules, protecting shared Prometheus servers from accidental
+// high-cardinality rules.  Zero means unlimited.
+type Limits struct {
+	// MaxSeries is the maximum number of series a rule may match when its
+	// series are listed (see ListSeries).
+	MaxSeries int
+	// Query are the limits of the queries of the rules.
+	Query queryplan.Limits
+}
+
+// WithLimits sets the limits of the rules which don't set their own, and the
+// maximum of those they set.
+func WithLimits(limits Limits) NamerOption {
+	return func(o *namersOptions) {
+		o.limits = limits
+	}
+}
+
+// limitsForRule returns the limits of the given rule: the ones it sets,
+// and otherwise the given defaults.  Rules may only lower the limits set by
+// the defaults, and negative limits disable the others.
+func limitsForRule(defaults Limits, rule config.DiscoveryRule) Limits {
+	limits := defaults
+	if rule.Limits != nil {
+		limits.MaxSeries = overrideLimit(limits.MaxSeries, rule.Limits.MaxSeries)
+		limits.Query.MaxSamples = overrideLimit(limits.Query.MaxSamples, rule.Limits.MaxSamples)
+		limits.Query.MaxRegexLength = overrideLimit(limits.Query.MaxRegexLength, rule.Limits.MaxRegexLength)
+	}
+	return limits
+}
+
+// overrideLimit returns the limit of a rule, given the default one, which
+// caps it unless unlimited.
+func overrideLimit(def, limit int) int {
+	switch {
+	case limit > 0 && def > 0:
+		return min(def, limit)
+	case limit > 0:
+		return limit
+	case limit < 0 && def == 0:
+		return 0
+	}
+	return def
+}
+
+// CheckSeriesLimit checks that the number of series listed for the rule of
+// the given namer is within its limit.
+func CheckSeriesLimit(namer MetricNamer, series int) error {
+	if max := namer.Limits().MaxSeries; max > 0 && series > max {
+		return fmt.Errorf("%w: rule %q matched %d series, more than the limit of %d", queryplan.ErrLimitExceeded, namer.RuleName(), series, max)
+	}
+	return nil
+}
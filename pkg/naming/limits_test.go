@@ -0,0 +1,70 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"context"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/labels"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+)
+
+func TestRulesInheritOrOverrideTheLimits(t *testing.T) {
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{job!=""}`, Resources: config.ResourceMapping{Namespaced: new(bool)}, MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`},
+		{SeriesQuery: `{job!=""}`, Resources: config.ResourceMapping{Namespaced: new(bool)}, Limits: &config.QueryLimits{MaxSeries: 5, MaxSamples: -1}},
+		{SeriesQuery: `{job!=""}`, Resources: config.ResourceMapping{Namespaced: new(bool)}, Limits: &config.QueryLimits{MaxSeries: 50, MaxRegexLength: -1}},
+	}, nil, WithLimits(Limits{MaxSeries: 10, Query: queryplan.Limits{MaxSamples: 100}}))
+	require.NoError(t, err)
+
+	require.Equal(t, Limits{MaxSeries: 10, Query: queryplan.Limits{MaxSamples: 100}}, namers[0].Limits())
+	// rules may lower the limits, and set the unlimited ones
+	require.Equal(t, Limits{MaxSeries: 5, Query: queryplan.Limits{MaxSamples: 100}}, namers[1].Limits())
+	// but not lift them
+	require.Equal(t, Limits{MaxSeries: 10, Query: queryplan.Limits{MaxSamples: 100}}, namers[2].Limits())
+
+	plan, err := namers[0].PlanForExternalSeries("queue_depth", "", labels.Everything())
+	require.NoError(t, err)
+	require.Equal(t, namers[0].Limits().Query, plan.Limits)
+}
+
+func TestListingTooManySeriesFails(t *testing.T) {
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{job!=""}`, Resources: config.ResourceMapping{Namespaced: new(bool)}},
+	}, nil, WithLimits(Limits{MaxSeries: 2}))
+	require.NoError(t, err)
+
+	series := []prom.Series{
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"job": "web"}},
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"job": "api"}},
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"job": "batch"}},
+	}
+	listed, err := ListSeries(context.Background(), (&fakeprom.FakePrometheusClient{}).OnSeries(`.*`, series[:2]...), namers[0], pmodel.Interval{})
+	require.NoError(t, err)
+	require.Equal(t, series[:2], listed)
+
+	_, err = ListSeries(context.Background(), (&fakeprom.FakePrometheusClient{}).OnSeries(`.*`, series...), namers[0], pmodel.Interval{})
+	require.ErrorIs(t, err, queryplan.ErrLimitExceeded)
+	require.ErrorContains(t, err, `rule "{job!=\"\"}" matched 3 series, more than the limit of 2`)
+}
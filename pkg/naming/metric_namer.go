@@ -17,15 +17,25 @@ limitations under the License.
 package naming
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 
+	pmodel "github.com/prometheus/common/model"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apiserver/pkg/authentication/user"
 
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
 	"sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
 )
 
 // MetricNamer knows how to convert Prometheus series names and label names to
@@ -37,26 +47,221 @@ type MetricNamer interface {
 	// Selector produces the appropriate Prometheus series selector to match all
 	// series handable by this namer.
 	Selector() prom.Selector
+	// PrometheusRef is the name of the Prometheus backend that series are
+	// discovered on and queries are sent to, or empty for the default backend.
+	PrometheusRef() string
+	// PrometheusHeaders are the extra HTTP headers sent with the series and
+	// metrics queries of the rule, if any.
+	PrometheusHeaders() http.Header
+	// AllowsNamespace checks whether the metrics of the rule may be served in
+	// the given namespace.  The empty namespace stands for root-scoped objects.
+	AllowsNamespace(namespace string) bool
+	// AllowsUser checks whether the given user may read the metrics of the rule.
+	// A nil user is only allowed if the rule doesn't restrict access.
+	AllowsUser(u user.Info) bool
+	// RuleName identifies the rule the namer was built from, by its ID if
+	// it has one, and otherwise by its series query.
+	RuleName() string
+	// StaticSeries returns the series declared by static rules, which aren't
+	// discovered using the selector, or nil for other rules.
+	StaticSeries() []prom.Series
+	// DiscoveryLabels returns the labels of the series discovered using the
+	// label values API, or nil if the series API is used.
+	DiscoveryLabels() []string
+	// RelistInterval returns the minimum interval between two discoveries of
+	// the series of the rule, or zero if they're discovered on every relist.
+	RelistInterval() time.Duration
+	// MaxAge returns how far back the series of the rule are discovered, or
+	// zero to use the lister's default.
+	MaxAge() time.Duration
+	// ValueConversion returns how the values of the metrics are converted
+	// into the quantities served for them.
+	ValueConversion() queryplan.ValueConversion
+	// SelectorLabels returns the labels of the query results attached to the
+	// selectors of the returned metric values, if any.
+	SelectorLabels() []string
+	// IdentityLabels returns the series labels which, along with the resource
+	// label, identify the values of the metrics, if any.
+	IdentityLabels() []string
+	// DuplicateSamples returns how several samples for the same object (and
+	// identity labels) are handled.
+	DuplicateSamples() config.DuplicateSamplesPolicy
+	// MissingData returns how external metrics whose query returns no
+	// samples are served, empty if they're served with no values.
+	MissingData() config.MissingDataPolicy
+	// Limits returns the limits on the cost of the series listed and the
+	// queries run for the rule.
+	Limits() Limits
 	// FilterSeries checks to see which of the given series match any additional
 	// constraints beyond the series query.  It's assumed that the series given
 	// already match the series query.
 	FilterSeries(series []prom.Series) []prom.Series
+	// ValueFilterQuery returns the test query which the series of the given
+	// name matching the series query must return samples for to be registered
+	// (see FilterSeriesByValue), or false if the rule has no value filter.
+	ValueFilterQuery(series string) (prom.Selector, bool, error)
+	// KeepsSeries checks whether the given series, assumed to match the series
+	// query, is kept by FilterSeries (before any of its labels are dropped).
+	KeepsSeries(series prom.Series) bool
 	// MetricNameForSeries returns the name (as presented in the API) for a given series.
 	MetricNameForSeries(series prom.Series) (string, error)
+	// NameLabelsForSeries returns the values of the series labels used in the
+	// metric name of the given series, if any.  Queries for the metric only
+	// select series with these values.
+	NameLabelsForSeries(series prom.Series) map[string]string
 	// QueryForSeries returns the query for a given series (not API metric name), with
 	// the given namespace name (if relevant), resource, and resource names.
 	QueryForSeries(series string, resource schema.GroupResource, namespace string, metricSelector labels.Selector, names ...string) (prom.Selector, error)
 	// QueryForExternalSeries returns the query for a given series (not API metric name), with
 	// the given namespace name (if relevant), resource, and resource names.
 	QueryForExternalSeries(series string, namespace string, targetLabels labels.Selector) (prom.Selector, error)
+	// PlanForSeries is like QueryForSeries, but returns the full query plan.
+	PlanForSeries(series string, resource schema.GroupResource, namespace string, metricSelector labels.Selector, names ...string) (*queryplan.Plan, error)
+	// PlanForExternalSeries is like QueryForExternalSeries, but returns the full query plan.
+	PlanForExternalSeries(series string, namespace string, targetLabels labels.Selector) (*queryplan.Plan, error)
+	// ObjectSelectorRequirements translates the given label selector on
+	// Kubernetes objects into requirements on the series labels holding the
+	// labels of the objects (see config.ResourceMapping.ObjectLabels), to be
+	// added to the metric selector of a query for all objects.  It returns
+	// false if the rule doesn't map all the labels of the selector.
+	ObjectSelectorRequirements(selector labels.Selector) ([]labels.Requirement, bool)
 
 	ResourceConverter
 }
 
+func (n *metricNamer) ValueFilterQuery(series string) (prom.Selector, bool, error) {
+	if n.valueFilter == nil {
+		return "", false, nil
+	}
+	query, err := n.valueFilter.query(series)
+	return query, true, err
+}
+
 func (n *metricNamer) Selector() prom.Selector {
 	return n.seriesQuery
 }
 
+func (n *metricNamer) PrometheusRef() string {
+	return n.prometheusRef
+}
+
+func (n *metricNamer) AllowsNamespace(namespace string) bool {
+	if n.namespaces == nil {
+		return true
+	}
+	_, allowed := n.namespaces[namespace]
+	return allowed
+}
+
+func (n *metricNamer) AllowsUser(u user.Info) bool {
+	if n.access == nil {
+		return true
+	}
+	if u == nil {
+		return false
+	}
+	if _, allowed := n.access.users[u.GetName()]; allowed {
+		return true
+	}
+	for _, group := range u.GetGroups() {
+		if _, allowed := n.access.groups[group]; allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *metricNamer) RuleName() string {
+	return n.ruleName
+}
+
+// ResourcesForSeries derives resources from the labels of the given series,
+// along with the labels provided by the rule's association, if any.  Rules
+// targeting namespaces only associate series with their namespace.
+func (n *metricNamer) ResourcesForSeries(series prom.Series) ([]schema.GroupResource, bool) {
+	if n.association != nil {
+		series = n.association.addLabels(series)
+	}
+	if n.namespaceTarget {
+		return n.namespaceResources(series)
+	}
+	return n.ResourceConverter.ResourcesForSeries(series)
+}
+
+func (n *metricNamer) PrometheusHeaders() http.Header {
+	return n.prometheusHeaders
+}
+
+func (n *metricNamer) StaticSeries() []prom.Series {
+	return n.staticSeries
+}
+
+func (n *metricNamer) DiscoveryLabels() []string {
+	return n.discoveryLabels
+}
+
+func (n *metricNamer) RelistInterval() time.Duration {
+	return n.relistInterval
+}
+
+func (n *metricNamer) MaxAge() time.Duration {
+	return n.maxAge
+}
+
+func (n *metricNamer) SelectorLabels() []string {
+	return n.selectorLabels
+}
+
+func (n *metricNamer) IdentityLabels() []string {
+	return n.identityLabels
+}
+
+func (n *metricNamer) DuplicateSamples() config.DuplicateSamplesPolicy {
+	return n.duplicateSamples
+}
+
+func (n *metricNamer) MissingData() config.MissingDataPolicy {
+	return n.missingData
+}
+
+func (n *metricNamer) Limits() Limits {
+	return n.limits
+}
+
+func (n *metricNamer) ValueConversion() queryplan.ValueConversion {
+	return n.values
+}
+
+// ListSeries lists the series handled by the given namer: the ones it declares
+// if it's static, and otherwise the ones matching its selector on its backend.
+// When discovering series using the label values API, only the names of the
+// series are listed, and they're assumed to carry the namer's discovery labels.
+// Listing fails if the selector matches more series than the namer's limit.
+func ListSeries(ctx context.Context, client prom.Client, namer MetricNamer, interval pmodel.Interval) ([]prom.Series, error) {
+	if static := namer.StaticSeries(); static != nil {
+		return static, nil
+	}
+	ctx = prom.WithRule(prom.WithBackend(ctx, namer.PrometheusRef()), namer.RuleName())
+	if discoveryLabels := namer.DiscoveryLabels(); discoveryLabels != nil {
+		names, err := client.LabelValues(ctx, pmodel.MetricNameLabel, interval, namer.Selector())
+		if err != nil {
+			return nil, err
+		}
+		if err := CheckSeriesLimit(namer, len(names)); err != nil {
+			return nil, err
+		}
+		return seriesWithLabels(names, discoveryLabels), nil
+	}
+	series, err := client.Series(ctx, interval, namer.Selector())
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckSeriesLimit(namer, len(series)); err != nil {
+		return nil, err
+	}
+	return series, nil
+}
+
 // ReMatcher either positively or negatively matches a regex
 type ReMatcher struct {
 	regex    *regexp.Regexp
@@ -96,58 +301,291 @@ func (m *ReMatcher) Matches(val string) bool {
 	return m.regex.MatchString(val) == m.positive
 }
 
+// accessList lists the users and groups allowed to read the metrics of a rule.
+type accessList struct {
+	users  map[string]struct{}
+	groups map[string]struct{}
+}
+
+// toSet converts the given list into a set.
+func toSet(list []string) map[string]struct{} {
+	res := make(map[string]struct{}, len(list))
+	for _, item := range list {
+		res[item] = struct{}{}
+	}
+	return res
+}
+
 type metricNamer struct {
-	seriesQuery    prom.Selector
-	metricsQuery   MetricsQuery
-	nameMatches    *regexp.Regexp
-	nameAs         string
+	seriesQuery  prom.Selector
+	metricsQuery MetricsQuery
+	nameMatches  *regexp.Regexp
+	nameAs       string
+	// nameLabels are the series labels referenced by nameAs
+	nameLabels     []pmodel.LabelName
 	seriesMatchers []*ReMatcher
+	prometheusRef  string
+	// prometheusHeaders are sent with the queries of the rule
+	prometheusHeaders http.Header
+	// ruleName identifies the rule the namer was built from, for plans
+	ruleName string
+	// queryRange is set on plans for rules running range queries
+	queryRange queryplan.Range
+	// values is set on plans, and converts the values of the metrics
+	values queryplan.ValueConversion
+	// staticSeries are the series declared by static rules
+	staticSeries []prom.Series
+	// discoveryLabels are the labels of the series discovered using the label values API
+	discoveryLabels []string
+	// relistInterval and maxAge override the defaults of the lister, if set
+	relistInterval time.Duration
+	maxAge         time.Duration
+	// duplicateSamples is how several samples for the same object are handled
+	duplicateSamples config.DuplicateSamplesPolicy
+	// missingData is how external metrics without any samples are served
+	missingData config.MissingDataPolicy
+	// limits bound the cost of the series listed and queries run for the rule
+	limits Limits
+	// objectLabels maps labels of Kubernetes objects to the series labels holding them
+	objectLabels map[string]string
+	// selectorLabels are attached to the selectors of returned metric values
+	selectorLabels []string
+	// identityLabels are grouped by in queries, along with the resource label
+	identityLabels []string
+	// labelDrops are removed from the discovered series
+	labelDrops []pmodel.LabelName
+	// association, if set, provides resource labels missing from the series
+	association *association
+	// valueFilter, if set, is the test query discovered series must return samples for
+	valueFilter *valueFilter
+	// namespaceTarget only exposes the metrics on namespaces
+	namespaceTarget bool
+	// namespaces, if set, are the only namespaces the metrics are served in
+	namespaces map[string]struct{}
+	// namespaceLabel is the label holding the namespace of series, used to
+	// filter out series from other namespaces, if namespaces are set
+	namespaceLabel pmodel.LabelName
+	// access, if set, lists the users allowed to read the metrics
+	access *accessList
 
 	ResourceConverter
 }
 
 // queryTemplateArgs are the arguments for the metrics query template.
 func (n *metricNamer) FilterSeries(initialSeries []prom.Series) []prom.Series {
-	if len(n.seriesMatchers) == 0 {
-		return initialSeries
+	if len(n.seriesMatchers) == 0 && n.namespaceLabel == "" {
+		return n.dropLabels(initialSeries)
 	}
 
 	finalSeries := make([]prom.Series, 0, len(initialSeries))
-SeriesLoop:
 	for _, series := range initialSeries {
-		for _, matcher := range n.seriesMatchers {
-			if !matcher.Matches(series.Name) {
-				continue SeriesLoop
+		if n.KeepsSeries(series) {
+			finalSeries = append(finalSeries, series)
+		}
+	}
+
+	return n.dropLabels(finalSeries)
+}
+
+func (n *metricNamer) KeepsSeries(series prom.Series) bool {
+	for _, matcher := range n.seriesMatchers {
+		if !matcher.Matches(series.Name) {
+			return false
+		}
+	}
+	// series without a namespace (e.g. from static rules) are checked on request
+	if ns := series.Labels[n.namespaceLabel]; n.namespaceLabel != "" && ns != "" && !n.AllowsNamespace(string(ns)) {
+		return false
+	}
+	return true
+}
+
+// SeriesFilterFor returns a filter keeping the series kept by any of the given
+// namers, which share a series query, to be applied as the series of the query
+// are listed (see prom.WithSeriesFilter).  It's nil if all series are kept.
+func SeriesFilterFor(namers []MetricNamer) prom.SeriesFilter {
+	for _, namer := range namers {
+		if n, ok := namer.(*metricNamer); ok && len(n.seriesMatchers) == 0 && n.namespaceLabel == "" {
+			return nil
+		}
+	}
+	return func(series prom.Series) bool {
+		for _, namer := range namers {
+			if namer.KeepsSeries(series) {
+				return true
 			}
 		}
-		finalSeries = append(finalSeries, series)
+		return false
+	}
+}
+
+// dropLabels removes the dropped labels of the rule from the given series,
+// merging the series which only differed by them.
+func (n *metricNamer) dropLabels(series []prom.Series) []prom.Series {
+	if len(n.labelDrops) == 0 {
+		return series
 	}
 
-	return finalSeries
+	type seriesKey struct {
+		name        string
+		fingerprint pmodel.Fingerprint
+	}
+	seen := make(map[seriesKey]struct{}, len(series))
+	res := make([]prom.Series, 0, len(series))
+	for _, s := range series {
+		lbls := s.Labels.Clone()
+		for _, name := range n.labelDrops {
+			delete(lbls, name)
+		}
+		key := seriesKey{name: s.Name, fingerprint: lbls.Fingerprint()}
+		if _, dup := seen[key]; dup {
+			continue
+		}
+		seen[key] = struct{}{}
+		res = append(res, prom.Series{Name: s.Name, Labels: lbls})
+	}
+	return res
 }
 
 func (n *metricNamer) QueryForSeries(series string, resource schema.GroupResource, namespace string, metricSelector labels.Selector, names ...string) (prom.Selector, error) {
-	return n.metricsQuery.Build(series, resource, namespace, nil, metricSelector, names...)
+	return n.metricsQuery.Build(series, resource, namespace, n.identityLabels, metricSelector, names...)
 }
 
 func (n *metricNamer) QueryForExternalSeries(series string, namespace string, metricSelector labels.Selector) (prom.Selector, error) {
 	return n.metricsQuery.BuildExternal(series, namespace, "", []string{}, metricSelector)
 }
 
+func (n *metricNamer) PlanForSeries(series string, resource schema.GroupResource, namespace string, metricSelector labels.Selector, names ...string) (*queryplan.Plan, error) {
+	plan, err := n.metricsQuery.Plan(series, resource, namespace, n.identityLabels, metricSelector, names...)
+	if err != nil {
+		return nil, err
+	}
+	plan.Rule = n.ruleName
+	plan.Backend = n.prometheusRef
+	plan.Headers = n.prometheusHeaders
+	plan.Range = n.queryRange
+	plan.Values = n.values
+	plan.Limits = n.limits.Query
+	return plan, nil
+}
+
+func (n *metricNamer) ObjectSelectorRequirements(selector labels.Selector) ([]labels.Requirement, bool) {
+	if len(n.objectLabels) == 0 {
+		return nil, false
+	}
+	requirements, selectable := selector.Requirements()
+	if !selectable {
+		return nil, false
+	}
+
+	res := make([]labels.Requirement, 0, len(requirements))
+	for _, req := range requirements {
+		seriesLabel, found := n.objectLabels[req.Key()]
+		if !found {
+			return nil, false
+		}
+		translated, err := labels.NewRequirement(seriesLabel, req.Operator(), req.Values().List())
+		if err != nil {
+			return nil, false
+		}
+		res = append(res, *translated)
+	}
+	return res, true
+}
+
+func (n *metricNamer) PlanForExternalSeries(series string, namespace string, metricSelector labels.Selector) (*queryplan.Plan, error) {
+	plan, err := n.metricsQuery.PlanExternal(series, namespace, "", []string{}, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	plan.Rule = n.ruleName
+	plan.Backend = n.prometheusRef
+	plan.Headers = n.prometheusHeaders
+	plan.Range = n.queryRange
+	plan.Values = n.values
+	plan.Limits = n.limits.Query
+	return plan, nil
+}
+
 func (n *metricNamer) MetricNameForSeries(series prom.Series) (string, error) {
 	matches := n.nameMatches.FindStringSubmatchIndex(series.Name)
 	if matches == nil {
 		return "", fmt.Errorf("series name %q did not match expected pattern %q", series.Name, n.nameMatches.String())
 	}
 	outNameBytes := n.nameMatches.ExpandString(nil, n.nameAs, series.Name, matches)
-	return string(outNameBytes), nil
+	if len(n.nameLabels) == 0 {
+		return string(outNameBytes), nil
+	}
+	return expandNameLabels(string(outNameBytes), series)
+}
+
+func (n *metricNamer) NameLabelsForSeries(series prom.Series) map[string]string {
+	if len(n.nameLabels) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(n.nameLabels))
+	for _, label := range n.nameLabels {
+		res[string(label)] = string(series.Labels[label])
+	}
+	return res
+}
+
+// namersOptions are the settings shared by all the namers produced by NamersFromConfig.
+type namersOptions struct {
+	cluster *Cluster
+	limits  Limits
+	custom  bool
+}
+
+// NamerOption configures all the namers produced by NamersFromConfig.
+type NamerOption func(*namersOptions)
+
+// WithCluster restricts the series discovered and queried by the namers to
+// those of the given cluster (see WithClusterMatcher).
+func WithCluster(cluster Cluster) NamerOption {
+	return func(o *namersOptions) {
+		o.cluster = &cluster
+	}
+}
+
+// ForCustomMetrics rejects the settings which are only supported by the rules
+// of external metrics.
+func ForCustomMetrics() NamerOption {
+	return func(o *namersOptions) {
+		o.custom = true
+	}
 }
 
 // NamersFromConfig produces a MetricNamer for each rule in the given config.
-func NamersFromConfig(cfg []config.DiscoveryRule, mapper apimeta.RESTMapper) ([]MetricNamer, error) {
+func NamersFromConfig(cfg []config.DiscoveryRule, mapper apimeta.RESTMapper, namerOpts ...NamerOption) ([]MetricNamer, error) {
+	var options namersOptions
+	for _, opt := range namerOpts {
+		opt(&options)
+	}
+	if options.cluster != nil {
+		if err := options.cluster.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	namers := make([]MetricNamer, len(cfg))
 
 	for i, rule := range cfg {
+		if options.custom && len(rule.QueryParameters) > 0 {
+			return nil, fmt.Errorf("queryParameters are only supported by external rules, not by the rule for metric %q", rule.Name.As)
+		}
+		if options.custom && rule.Access != nil {
+			return nil, fmt.Errorf("access is only enforced for external rules, not for the custom rule for series query %q", rule.SeriesQuery)
+		}
+		rule, err := histogramQuantileRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		rule, err = queryOnlyRule(rule)
+		if err != nil {
+			return nil, err
+		}
+
 		resConv, err := NewResourceConverter(rule.Resources.Template, rule.Resources.Overrides, mapper)
 		if err != nil {
 			return nil, err
@@ -159,10 +597,140 @@ func NamersFromConfig(cfg []config.DiscoveryRule, mapper apimeta.RESTMapper) ([]
 			namespaced = *rule.Resources.Namespaced
 		}
 
-		metricsQuery, err := NewExternalMetricsQuery(rule.MetricsQuery, resConv, namespaced)
+		opts := []MetricsQueryOption{WithWindow(time.Duration(rule.Window))}
+		nsLabelOverride := pmodel.LabelName(rule.Resources.NamespaceLabelName)
+		if nsLabelOverride != "" {
+			if !nsLabelOverride.IsValid() {
+				return nil, fmt.Errorf("invalid namespace label name %q for series query %q", nsLabelOverride, rule.SeriesQuery)
+			}
+			if !namespaced {
+				return nil, fmt.Errorf("a namespace label name can't be set for series query %q, which isn't namespaced", rule.SeriesQuery)
+			}
+			opts = append(opts, WithNamespaceLabel(nsLabelOverride))
+		}
+		var assoc *association
+		if rule.Resources.Association != nil {
+			assoc, err = newAssociation(rule.Resources.Association)
+			if err != nil {
+				return nil, fmt.Errorf("invalid association for series query %q: %v", rule.SeriesQuery, err)
+			}
+			opts = append(opts, withAssociation(assoc))
+		}
+		if options.cluster != nil {
+			opts = append(opts, WithClusterMatcher(*options.cluster))
+		}
+		if len(rule.QueryParameters) > 0 {
+			params, err := queryParametersForRule(rule)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, withQueryParameters(params))
+		}
+
+		metricsQuery, err := NewExternalMetricsQuery(rule.MetricsQuery, resConv, namespaced, opts...)
 		if err != nil {
 			return nil, fmt.Errorf("unable to construct metrics query associated with series query %q: %v", rule.SeriesQuery, err)
 		}
+		if rule.MetricsQuery != "" {
+			if err := checkQuerySyntax(metricsQuery); err != nil {
+				return nil, fmt.Errorf("invalid metrics query associated with series query %q: %v", rule.SeriesQuery, err)
+			}
+		}
+
+		switch rule.Target {
+		case "":
+		case config.NamespaceTarget:
+			if err := checkNamespaceTarget(rule, resConv, metricsQuery); err != nil {
+				return nil, fmt.Errorf("invalid rule targeting namespaces for series query %q: %v", rule.SeriesQuery, err)
+			}
+		default:
+			return nil, fmt.Errorf("invalid target %q for series query %q, must be %s", rule.Target, rule.SeriesQuery, config.NamespaceTarget)
+		}
+
+		queryRange, err := queryRangeForRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query type for series query %q: %v", rule.SeriesQuery, err)
+		}
+
+		values, err := queryplan.NewValueConversion(rule.Scale, rule.Unit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value conversion for series query %q: %v", rule.SeriesQuery, err)
+		}
+
+		staticSeries, err := staticSeriesForRule(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		discoveryLabels, err := discoveryLabelsForRule(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		labelDrops, err := labelDropsForRule(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		duplicateSamples := rule.DuplicateSamples
+		switch duplicateSamples {
+		case "":
+			duplicateSamples = config.DuplicateSamplesLast
+		case config.DuplicateSamplesLast, config.DuplicateSamplesSum, config.DuplicateSamplesMax, config.DuplicateSamplesMin, config.DuplicateSamplesError:
+		default:
+			return nil, fmt.Errorf("invalid duplicate samples policy %q for series query %q, must be one of %s, %s, %s, %s or %s", duplicateSamples, rule.SeriesQuery,
+				config.DuplicateSamplesLast, config.DuplicateSamplesSum, config.DuplicateSamplesMax, config.DuplicateSamplesMin, config.DuplicateSamplesError)
+		}
+
+		switch rule.MissingDataPolicy {
+		case "", config.MissingDataZero, config.MissingDataNotFound:
+		default:
+			return nil, fmt.Errorf("invalid missing data policy %q for series query %q, must be %s or %s", rule.MissingDataPolicy, rule.SeriesQuery,
+				config.MissingDataZero, config.MissingDataNotFound)
+		}
+
+		for objectLabel, seriesLabel := range rule.Resources.ObjectLabels {
+			if errs := validation.IsQualifiedName(objectLabel); len(errs) > 0 {
+				return nil, fmt.Errorf("invalid object label %q for series query %q: %s", objectLabel, rule.SeriesQuery, strings.Join(errs, ", "))
+			}
+			if !pmodel.LabelName(seriesLabel).IsValid() {
+				return nil, fmt.Errorf("invalid series label %q for object label %q of series query %q", seriesLabel, objectLabel, rule.SeriesQuery)
+			}
+		}
+
+		for _, label := range rule.SelectorLabels {
+			if !pmodel.LabelName(label).IsValid() {
+				return nil, fmt.Errorf("invalid selector label %q for series query %q", label, rule.SeriesQuery)
+			}
+		}
+
+		// identity labels are attached to the selectors of the values too,
+		// so that the values of an object can be told apart
+		selectorLabels := rule.SelectorLabels
+		for _, label := range rule.Resources.IdentityLabels {
+			if !pmodel.LabelName(label).IsValid() {
+				return nil, fmt.Errorf("invalid identity label %q for series query %q", label, rule.SeriesQuery)
+			}
+			if _, mapped := rule.Resources.Overrides[label]; mapped {
+				return nil, fmt.Errorf("label %q of series query %q is mapped to a resource, and can't be an identity label", label, rule.SeriesQuery)
+			}
+			if !slices.Contains(selectorLabels, label) {
+				selectorLabels = append(slices.Clip(selectorLabels), label)
+			}
+		}
+
+		seriesQuery := prom.Selector(rule.SeriesQuery)
+		if options.cluster != nil && rule.SeriesQuery != "" {
+			seriesQuery = options.cluster.restrictSelector(rule.SeriesQuery)
+		}
+
+		var valFilter *valueFilter
+		if rule.ValueFilter != nil {
+			valFilter, err = newValueFilter(rule.ValueFilter, time.Duration(rule.Window), seriesQuery)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value filter for series query %q: %v", rule.SeriesQuery, err)
+			}
+		}
 
 		seriesMatchers := make([]*ReMatcher, len(rule.SeriesFilters))
 		for i, filterRaw := range rule.SeriesFilters {
@@ -205,18 +773,181 @@ func NamersFromConfig(cfg []config.DiscoveryRule, mapper apimeta.RESTMapper) ([]
 				return nil, fmt.Errorf("must specify an 'as' value for name matcher %q associated with series query %q", rule.Name.Matches, rule.SeriesQuery)
 			}
 		}
+		nameLabels, err := nameLabelsFor(nameAs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse name rules associated with series query %q: %v", rule.SeriesQuery, err)
+		}
 
 		namer := &metricNamer{
-			seriesQuery:       prom.Selector(rule.SeriesQuery),
+			seriesQuery:       seriesQuery,
 			metricsQuery:      metricsQuery,
 			nameMatches:       nameMatches,
 			nameAs:            nameAs,
+			nameLabels:        nameLabels,
 			seriesMatchers:    seriesMatchers,
+			prometheusRef:     rule.PrometheusRef,
+			ruleName:          rule.SeriesQuery,
+			queryRange:        queryRange,
+			values:            values,
+			staticSeries:      staticSeries,
+			discoveryLabels:   discoveryLabels,
+			relistInterval:    time.Duration(rule.RelistInterval),
+			maxAge:            time.Duration(rule.MaxAge),
+			objectLabels:      rule.Resources.ObjectLabels,
+			duplicateSamples:  duplicateSamples,
+			missingData:       rule.MissingDataPolicy,
+			limits:            limitsForRule(options.limits, rule),
+			selectorLabels:    selectorLabels,
+			identityLabels:    rule.Resources.IdentityLabels,
+			labelDrops:        labelDrops,
+			association:       assoc,
+			valueFilter:       valFilter,
+			namespaceTarget:   rule.Target == config.NamespaceTarget,
 			ResourceConverter: resConv,
 		}
+		if len(rule.PrometheusHeaders) > 0 {
+			namer.prometheusHeaders = make(http.Header, len(rule.PrometheusHeaders))
+			for name, value := range rule.PrometheusHeaders {
+				namer.prometheusHeaders.Set(name, value)
+			}
+		}
+
+		if rule.Access != nil {
+			namer.access = &accessList{
+				users:  toSet(rule.Access.Users),
+				groups: toSet(rule.Access.Groups),
+			}
+		}
+
+		if len(rule.Namespaces) > 0 {
+			namer.namespaces = toSet(rule.Namespaces)
+			// rules without a namespace label can only be restricted on request
+			if nsLabelOverride != "" {
+				namer.namespaceLabel = nsLabelOverride
+			} else if nsLabel, err := resConv.LabelForResource(NsGroupResource); err == nil {
+				namer.namespaceLabel = nsLabel
+			}
+		}
+
+		if rule.ID != "" {
+			namer.ruleName = rule.ID
+		} else if rule.Query != "" {
+			namer.ruleName = "query:" + rule.Name.As
+		} else if rule.Static != nil {
+			namer.ruleName = "static:" + strings.Join(rule.Static.Names, ",")
+		}
 
 		namers[i] = namer
 	}
 
 	return namers, nil
 }
+
+// queryRangeForRule returns the range of the queries run for the given rule,
+// whose window is zero for instant queries.
+func queryRangeForRule(rule config.DiscoveryRule) (queryplan.Range, error) {
+	switch rule.QueryType {
+	case "", config.InstantQueryType:
+		if rule.Step != 0 || rule.RangeAggregation != "" {
+			return queryplan.Range{}, fmt.Errorf("step and rangeAggregation only apply to %q queries", config.RangeQueryType)
+		}
+		return queryplan.Range{}, nil
+	case config.RangeQueryType:
+		agg, err := queryplan.ParseRangeAggregation(rule.RangeAggregation)
+		if err != nil {
+			return queryplan.Range{}, err
+		}
+		window := time.Duration(rule.Window)
+		if window == 0 {
+			window = DefaultWindow
+		}
+		step := time.Duration(rule.Step)
+		if step == 0 {
+			step = queryplan.DefaultRangeStep
+		}
+		return queryplan.Range{Window: window, Step: step, Aggregation: agg}, nil
+	default:
+		return queryplan.Range{}, fmt.Errorf("unknown query type %q, must be %q or %q", rule.QueryType, config.InstantQueryType, config.RangeQueryType)
+	}
+}
+
+// staticSeriesForRule returns the series declared by the given rule, if it's
+// static.  The series carry the declared labels, with empty values.
+func staticSeriesForRule(rule config.DiscoveryRule) ([]prom.Series, error) {
+	if rule.Static == nil {
+		return nil, nil
+	}
+	if len(rule.Static.Names) == 0 {
+		return nil, fmt.Errorf("static rules must declare the names of their series")
+	}
+
+	labelNames := labelsOrOverrides(rule.Static.Labels, rule)
+	if len(labelNames) == 0 && rule.Query == "" {
+		return nil, fmt.Errorf("static rule for series %v must declare the labels of its series, or map them in resources.overrides", rule.Static.Names)
+	}
+	return seriesWithLabels(rule.Static.Names, labelNames), nil
+}
+
+// discoveryLabelsForRule returns the labels of the series of the given rule,
+// if they're discovered using the label values API, and nil otherwise.
+func discoveryLabelsForRule(rule config.DiscoveryRule) ([]string, error) {
+	switch rule.Discovery {
+	case "", config.SeriesDiscovery:
+		return nil, nil
+	case config.LabelValuesDiscovery:
+	default:
+		return nil, fmt.Errorf("unknown discovery %q for series query %q, must be %q or %q", rule.Discovery, rule.SeriesQuery, config.SeriesDiscovery, config.LabelValuesDiscovery)
+	}
+	if rule.Static != nil {
+		return nil, fmt.Errorf("static rule for series %v can't use %q discovery", rule.Static.Names, rule.Discovery)
+	}
+
+	labelNames := labelsOrOverrides(rule.DiscoveryLabels, rule)
+	if len(labelNames) == 0 {
+		return nil, fmt.Errorf("rule for series query %q must declare the labels of its series in discoveryLabels, or map them in resources.overrides", rule.SeriesQuery)
+	}
+	return labelNames, nil
+}
+
+// labelDropsForRule checks the labels dropped from the series of the given
+// rule, which mustn't be needed to associate them with resources.
+func labelDropsForRule(rule config.DiscoveryRule) ([]pmodel.LabelName, error) {
+	labelDrops := make([]pmodel.LabelName, 0, len(rule.LabelDrops))
+	for _, label := range rule.LabelDrops {
+		if !pmodel.LabelName(label).IsValid() {
+			return nil, fmt.Errorf("invalid dropped label %q for series query %q", label, rule.SeriesQuery)
+		}
+		if _, mapped := rule.Resources.Overrides[label]; mapped {
+			return nil, fmt.Errorf("label %q of series query %q is mapped to a resource, and can't be dropped", label, rule.SeriesQuery)
+		}
+		labelDrops = append(labelDrops, pmodel.LabelName(label))
+	}
+	return labelDrops, nil
+}
+
+// labelsOrOverrides returns the given label names, or, if there are none, the
+// labels mapped in the resource overrides of the given rule, sorted.
+func labelsOrOverrides(labelNames []string, rule config.DiscoveryRule) []string {
+	if len(labelNames) > 0 {
+		return labelNames
+	}
+	for lbl := range rule.Resources.Overrides {
+		labelNames = append(labelNames, lbl)
+	}
+	sort.Strings(labelNames)
+	return labelNames
+}
+
+// seriesWithLabels returns series with the given names, carrying the given
+// labels with empty values.
+func seriesWithLabels(names []string, labelNames []string) []prom.Series {
+	series := make([]prom.Series, len(names))
+	for i, name := range names {
+		lbls := make(pmodel.LabelSet, len(labelNames))
+		for _, lbl := range labelNames {
+			lbls[pmodel.LabelName(lbl)] = ""
+		}
+		series[i] = prom.Series{Name: name, Labels: lbls}
+	}
+	return series
+}
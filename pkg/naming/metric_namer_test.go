@@ -0,0 +1,711 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+)
+
+func TestPlansIdentifyTheirRule(t *testing.T) {
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{ID: "queues", SeriesQuery: `{queue!=""}`, PrometheusRef: "thanos", MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`},
+		{SeriesQuery: `{job!=""}`, MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`},
+	}, nil)
+	require.NoError(t, err)
+
+	plan, err := namers[0].PlanForExternalSeries("queue_depth", "", labels.Everything())
+	require.NoError(t, err)
+	require.Equal(t, "queues", plan.Rule)
+	require.Equal(t, "thanos", plan.Backend)
+
+	plan, err = namers[1].PlanForExternalSeries("up", "", labels.Everything())
+	require.NoError(t, err)
+	require.Equal(t, `{job!=""}`, plan.Rule)
+	require.Equal(t, "", plan.Backend)
+}
+
+func TestPlansCarryTheirQueryRange(t *testing.T) {
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{queue!=""}`, QueryType: "range", Window: pmodel.Duration(15 * time.Minute), RangeAggregation: "avg", MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`},
+		{SeriesQuery: `{job!=""}`, MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`},
+	}, nil)
+	require.NoError(t, err)
+
+	plan, err := namers[0].PlanForExternalSeries("queue_depth", "", labels.Everything())
+	require.NoError(t, err)
+	require.Equal(t, queryplan.Range{Window: 15 * time.Minute, Step: time.Minute, Aggregation: queryplan.RangeAvg}, plan.Range)
+
+	plan, err = namers[1].PlanForExternalSeries("up", "", labels.Everything())
+	require.NoError(t, err)
+	require.Zero(t, plan.Range)
+
+	for _, rule := range []config.DiscoveryRule{
+		{SeriesQuery: `{queue!=""}`, QueryType: "ranged"},
+		{SeriesQuery: `{queue!=""}`, QueryType: "range", RangeAggregation: "median"},
+		{SeriesQuery: `{queue!=""}`, RangeAggregation: "avg"},
+	} {
+		_, err := NamersFromConfig([]config.DiscoveryRule{rule}, nil)
+		require.Error(t, err)
+	}
+}
+
+func TestPlansCarryTheirValueConversion(t *testing.T) {
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{queue!=""}`, Unit: "milliseconds", Scale: 2, MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`},
+	}, nil)
+	require.NoError(t, err)
+
+	plan, err := namers[0].PlanForExternalSeries("queue_latency", "", labels.Everything())
+	require.NoError(t, err)
+	require.Equal(t, namers[0].ValueConversion(), plan.Values)
+	require.Equal(t, "500m", plan.Values.Quantity(250).String())
+
+	_, err = NamersFromConfig([]config.DiscoveryRule{{SeriesQuery: `{queue!=""}`, Unit: "parsecs"}}, nil)
+	require.Error(t, err)
+}
+
+func TestStaticRulesDeclareTheirSeries(t *testing.T) {
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			Static:       &config.StaticSeries{Names: []string{"queue_depth", "queue_age_seconds"}, Labels: []string{"queue"}},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+		{SeriesQuery: `{job!=""}`, MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`},
+	}, nil)
+	require.NoError(t, err)
+
+	require.Equal(t, []prom.Series{
+		{Name: "queue_depth", Labels: pmodel.LabelSet{"queue": ""}},
+		{Name: "queue_age_seconds", Labels: pmodel.LabelSet{"queue": ""}},
+	}, namers[0].StaticSeries())
+	require.Nil(t, namers[1].StaticSeries())
+
+	for _, rule := range []config.DiscoveryRule{
+		{Static: &config.StaticSeries{Labels: []string{"queue"}}},
+		{Static: &config.StaticSeries{Names: []string{"queue_depth"}}},
+	} {
+		_, err := NamersFromConfig([]config.DiscoveryRule{rule}, nil)
+		require.Error(t, err)
+	}
+}
+
+func TestRulesCanDiscoverSeriesUsingLabelValues(t *testing.T) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery: `{__name__=~"http_requests_.*"}`,
+			Discovery:   config.LabelValuesDiscovery,
+			Resources: config.ResourceMapping{Overrides: map[string]config.GroupResource{
+				"pod":       {Resource: "pod"},
+				"namespace": {Resource: "namespace"},
+			}},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+	}, mapper)
+	require.NoError(t, err)
+	require.Equal(t, []string{"namespace", "pod"}, namers[0].DiscoveryLabels())
+
+	client := &fakeprom.FakePrometheusClient{
+		AcceptableInterval: pmodel.Interval{End: pmodel.Latest},
+		SeriesResults: map[prom.Selector][]prom.Series{
+			`{__name__=~"http_requests_.*"}`: {
+				{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "a", "namespace": "ns"}},
+				{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "b", "namespace": "ns"}},
+				{Name: "http_requests_failed", Labels: pmodel.LabelSet{"pod": "a", "namespace": "ns"}},
+			},
+		},
+	}
+	series, err := ListSeries(context.Background(), client, namers[0], pmodel.Interval{})
+	require.NoError(t, err)
+	require.Equal(t, []prom.Series{
+		{Name: "http_requests_failed", Labels: pmodel.LabelSet{"namespace": "", "pod": ""}},
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"namespace": "", "pod": ""}},
+	}, series)
+
+	for _, rule := range []config.DiscoveryRule{
+		{SeriesQuery: `{job!=""}`, Discovery: "metadata"},
+		{SeriesQuery: `{job!=""}`, Discovery: config.LabelValuesDiscovery},
+		{Static: &config.StaticSeries{Names: []string{"up"}, Labels: []string{"job"}}, Discovery: config.LabelValuesDiscovery},
+	} {
+		_, err := NamersFromConfig([]config.DiscoveryRule{rule}, nil)
+		require.Error(t, err)
+	}
+}
+
+func TestHistogramQuantileRules(t *testing.T) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+
+	quantile := 0.95
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery: `{__name__=~"http_request_duration_seconds.*",namespace!="",pod!=""}`,
+			Resources: config.ResourceMapping{Overrides: map[string]config.GroupResource{
+				"pod":       {Resource: "pod"},
+				"namespace": {Resource: "namespace"},
+			}},
+			Window:            pmodel.Duration(2 * time.Minute),
+			HistogramQuantile: &quantile,
+		},
+	}, mapper)
+	require.NoError(t, err)
+	namer := namers[0]
+
+	series := namer.FilterSeries([]prom.Series{
+		{Name: "http_request_duration_seconds_bucket"},
+		{Name: "http_request_duration_seconds_sum"},
+		{Name: "http_request_duration_seconds_count"},
+	})
+	require.Equal(t, []prom.Series{{Name: "http_request_duration_seconds_bucket"}}, series)
+
+	name, err := namer.MetricNameForSeries(series[0])
+	require.NoError(t, err)
+	require.Equal(t, "http_request_duration_seconds_p95", name)
+
+	query, err := namer.QueryForSeries("http_request_duration_seconds_bucket", schema.GroupResource{Resource: "pods"}, "default", labels.Everything(), "web-0")
+	require.NoError(t, err)
+	require.Equal(t, prom.Selector(`histogram_quantile(0.95, sum(rate(http_request_duration_seconds_bucket{namespace="default",pod="web-0"}[2m])) by (le, pod))`), query)
+
+	for quantile, suffix := range map[float64]string{0.07: "p7", 0.5: "p50", 0.99: "p99", 0.999: "p99_9"} {
+		require.Equal(t, suffix, percentileSuffix(quantile))
+	}
+
+	for _, quantile := range []float64{0, 1, 1.5} {
+		_, err := NamersFromConfig([]config.DiscoveryRule{{SeriesQuery: `{job!=""}`, HistogramQuantile: &quantile}}, nil)
+		require.Error(t, err, "quantile %v should be rejected", quantile)
+	}
+}
+
+func TestRulesCanDropLabelsFromSeries(t *testing.T) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery: `{__name__=~"^container_.*",container!="POD"}`,
+			Resources: config.ResourceMapping{Overrides: map[string]config.GroupResource{
+				"pod":       {Resource: "pod"},
+				"namespace": {Resource: "namespace"},
+			}},
+			LabelDrops:   []string{"id", "name"},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+		},
+	}, mapper)
+	require.NoError(t, err)
+
+	series := namers[0].FilterSeries([]prom.Series{
+		{Name: "container_cpu_usage_seconds_total", Labels: pmodel.LabelSet{"pod": "web-0", "namespace": "default", "id": "/kubepods/a", "name": "k8s_web"}},
+		{Name: "container_cpu_usage_seconds_total", Labels: pmodel.LabelSet{"pod": "web-0", "namespace": "default", "id": "/kubepods/b", "name": "k8s_web_1"}},
+		{Name: "container_cpu_usage_seconds_total", Labels: pmodel.LabelSet{"pod": "web-1", "namespace": "default", "id": "/kubepods/c"}},
+	})
+	require.Equal(t, []prom.Series{
+		{Name: "container_cpu_usage_seconds_total", Labels: pmodel.LabelSet{"pod": "web-0", "namespace": "default"}},
+		{Name: "container_cpu_usage_seconds_total", Labels: pmodel.LabelSet{"pod": "web-1", "namespace": "default"}},
+	}, series)
+
+	_, err = NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery: `{pod!=""}`,
+			Resources:   config.ResourceMapping{Overrides: map[string]config.GroupResource{"pod": {Resource: "pod"}}},
+			LabelDrops:  []string{"pod"},
+		},
+	}, mapper)
+	require.ErrorContains(t, err, `label "pod" of series query "{pod!=\"\"}" is mapped to a resource`)
+}
+
+func TestMetricNamesCanReferenceSeriesLabels(t *testing.T) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery: `{__name__="request_duration_seconds",namespace!="",pod!=""}`,
+			Resources: config.ResourceMapping{Overrides: map[string]config.GroupResource{
+				"pod":       {Resource: "pod"},
+				"namespace": {Resource: "namespace"},
+			}},
+			Name:         config.NameMapping{Matches: "^(.*)_seconds$", As: "${1}_<<.Labels.quantile>>_seconds"},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+		},
+	}, mapper)
+	require.NoError(t, err)
+	namer := namers[0]
+
+	series := prom.Series{Name: "request_duration_seconds", Labels: pmodel.LabelSet{"pod": "web-0", "namespace": "default", "quantile": "0.99"}}
+	name, err := namer.MetricNameForSeries(series)
+	require.NoError(t, err)
+	require.Equal(t, "request_duration_0_99_seconds", name)
+	require.Equal(t, map[string]string{"quantile": "0.99"}, namer.NameLabelsForSeries(series))
+
+	selector := SelectorWithLabels(labels.Everything(), namer.NameLabelsForSeries(series))
+	query, err := namer.QueryForSeries(series.Name, schema.GroupResource{Resource: "pods"}, "default", selector, "web-0")
+	require.NoError(t, err)
+	require.Equal(t, prom.Selector(`sum(request_duration_seconds{quantile="0.99",namespace="default",pod="web-0"}) by (pod)`), query)
+
+	_, err = namer.MetricNameForSeries(prom.Series{Name: "request_duration_seconds", Labels: pmodel.LabelSet{"pod": "web-0", "namespace": "default"}})
+	require.ErrorContains(t, err, `no value for label "quantile"`)
+
+	_, err = NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{job!=""}`, Name: config.NameMapping{As: "${0}_<<.Series>>"}},
+	}, nil)
+	require.ErrorContains(t, err, "only series labels may be referenced")
+}
+
+func TestRulesCanBeRestrictedToNamespaces(t *testing.T) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery:  `{namespace!="",pod!=""}`,
+			Namespaces:   []string{"team-a"},
+			Resources:    config.ResourceMapping{Overrides: map[string]config.GroupResource{"namespace": {Resource: "namespace"}, "pod": {Resource: "pod"}}},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+		{SeriesQuery: `{job!=""}`, MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`},
+	}, mapper)
+	require.NoError(t, err)
+
+	require.True(t, namers[0].AllowsNamespace("team-a"))
+	require.False(t, namers[0].AllowsNamespace("team-b"))
+	require.False(t, namers[0].AllowsNamespace(""))
+	require.True(t, namers[1].AllowsNamespace("team-b"))
+
+	series := []prom.Series{
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"namespace": "team-a", "pod": "web-0"}},
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"namespace": "team-b", "pod": "web-0"}},
+	}
+	require.Equal(t, series[:1], namers[0].FilterSeries(series))
+	require.Equal(t, series, namers[1].FilterSeries(series))
+}
+
+func TestRulesCanTargetNamespaces(t *testing.T) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+	overrides := map[string]config.GroupResource{"namespace": {Resource: "namespace"}, "pod": {Resource: "pod"}}
+
+	rule := config.DiscoveryRule{
+		SeriesQuery:  `nginx_ingress_controller_requests{namespace!=""}`,
+		Resources:    config.ResourceMapping{Overrides: overrides},
+		Target:       config.NamespaceTarget,
+		MetricsQuery: `sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)`,
+	}
+	namers, err := NamersFromConfig([]config.DiscoveryRule{rule}, mapper)
+	require.NoError(t, err)
+
+	resources, _ := namers[0].ResourcesForSeries(prom.Series{
+		Name:   "nginx_ingress_controller_requests",
+		Labels: pmodel.LabelSet{"namespace": "web", "pod": "ingress-0"},
+	})
+	require.Equal(t, []schema.GroupResource{NsGroupResource}, resources)
+	resources, _ = namers[0].ResourcesForSeries(prom.Series{Name: "nginx_ingress_controller_requests", Labels: pmodel.LabelSet{"pod": "ingress-0"}})
+	require.Empty(t, resources)
+
+	query, err := namers[0].QueryForSeries("nginx_ingress_controller_requests", NsGroupResource, "", labels.Everything(), "web")
+	require.NoError(t, err)
+	require.Equal(t, prom.Selector(`sum(rate(nginx_ingress_controller_requests{namespace="web"}[2m])) by (namespace)`), query)
+
+	for _, invalid := range []func(*config.DiscoveryRule){
+		func(r *config.DiscoveryRule) { r.MetricsQuery = `sum(rate(<<.Series>>[2m]))` },
+		func(r *config.DiscoveryRule) { r.Resources.IdentityLabels = []string{"host"} },
+		func(r *config.DiscoveryRule) {
+			r.Resources.Overrides = map[string]config.GroupResource{"pod": {Resource: "pod"}}
+		},
+		func(r *config.DiscoveryRule) { r.Target = "pod" },
+	} {
+		invalidRule := rule
+		invalid(&invalidRule)
+		_, err := NamersFromConfig([]config.DiscoveryRule{invalidRule}, mapper)
+		require.Error(t, err)
+	}
+}
+
+func TestPlansCarryTheRulesPrometheusHeaders(t *testing.T) {
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery:       `{__name__="queue_depth"}`,
+			Resources:         config.ResourceMapping{Namespaced: new(bool)},
+			MetricsQuery:      `sum(<<.Series>>{<<.LabelMatchers>>})`,
+			PrometheusHeaders: map[string]string{"x-scope-orgid": "tenant-a"},
+		},
+	}, apimeta.NewDefaultRESTMapper(nil))
+	require.NoError(t, err)
+
+	require.Equal(t, "tenant-a", namers[0].PrometheusHeaders().Get("X-Scope-OrgID"))
+	plan, err := namers[0].PlanForExternalSeries("queue_depth", "", labels.Everything())
+	require.NoError(t, err)
+	require.Equal(t, namers[0].PrometheusHeaders(), plan.Headers)
+}
+
+func TestSeriesAreFilteredAsTheyAreListed(t *testing.T) {
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery:   `{job!=""}`,
+			SeriesFilters: []config.RegexFilter{{Is: "^http_"}},
+			MetricsQuery:  `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+		{
+			SeriesQuery:   `{job!=""}`,
+			SeriesFilters: []config.RegexFilter{{Is: "_bytes$"}},
+			MetricsQuery:  `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	client := &fakeprom.FakePrometheusClient{
+		SeriesResults: map[prom.Selector][]prom.Series{
+			`{job!=""}`: {
+				{Name: "http_requests_total", Labels: pmodel.LabelSet{"job": "web"}},
+				{Name: "process_resident_memory_bytes", Labels: pmodel.LabelSet{"job": "web"}},
+				{Name: "go_goroutines", Labels: pmodel.LabelSet{"job": "web"}},
+			},
+		},
+	}
+	ctx := prom.WithSeriesFilter(context.Background(), SeriesFilterFor(namers))
+	series, err := ListSeries(ctx, client, namers[0], pmodel.Interval{})
+	require.NoError(t, err)
+	require.Equal(t, []prom.Series{
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"job": "web"}},
+		{Name: "process_resident_memory_bytes", Labels: pmodel.LabelSet{"job": "web"}},
+	}, series)
+	require.Len(t, namers[0].FilterSeries(series), 1)
+	require.Len(t, namers[1].FilterSeries(series), 1)
+
+	unfiltered, err := NamersFromConfig([]config.DiscoveryRule{{SeriesQuery: `{job!=""}`}}, nil)
+	require.NoError(t, err)
+	require.Nil(t, SeriesFilterFor(append(namers, unfiltered...)), "no series should be filtered out when a rule keeps them all")
+}
+
+func TestQueryOnlyRulesDeclareASingleMetric(t *testing.T) {
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{Name: config.NameMapping{As: "error_budget_burn"}, Query: `sum(rate(errors_total[1h])) / sum(rate(requests_total[1h]))`, QueryLabels: []string{"service"}},
+	}, nil)
+	require.NoError(t, err)
+
+	series := namers[0].StaticSeries()
+	require.Equal(t, []prom.Series{{Name: "error_budget_burn", Labels: pmodel.LabelSet{"service": ""}}}, series)
+	name, err := namers[0].MetricNameForSeries(series[0])
+	require.NoError(t, err)
+	require.Equal(t, "error_budget_burn", name)
+	require.Equal(t, "query:error_budget_burn", namers[0].RuleName())
+
+	query, err := namers[0].QueryForExternalSeries(series[0].Name, "", labels.Everything())
+	require.NoError(t, err)
+	require.Equal(t, prom.Selector(`sum(rate(errors_total[1h])) / sum(rate(requests_total[1h]))`), query)
+
+	for _, rule := range []config.DiscoveryRule{
+		{Query: `vector(1)`},
+		{Query: `vector(1)`, Name: config.NameMapping{As: "not a metric"}},
+		{Query: `vector(1)`, Name: config.NameMapping{As: "one"}, SeriesQuery: `{job!=""}`},
+		{Query: `vector(1)`, Name: config.NameMapping{As: "one"}, MetricsQuery: `vector(2)`},
+		{Query: `vector(1)`, Name: config.NameMapping{As: "one"}, QueryLabels: []string{"not-a-label"}},
+		{SeriesQuery: `{job!=""}`, QueryLabels: []string{"job"}},
+	} {
+		_, err := NamersFromConfig([]config.DiscoveryRule{rule}, nil)
+		require.Error(t, err)
+	}
+}
+
+func TestQueryOnlyRulesSubstituteTheirParameters(t *testing.T) {
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			Name:  config.NameMapping{As: "queue_backlog"},
+			Query: `sum(rabbitmq_queue_messages{queue="$queue",vhost="$vhost",<<.LabelMatchers>>}) > $min`,
+			QueryParameters: []config.QueryParameter{
+				{Name: "queue"},
+				{Name: "vhost", Pattern: `[a-z]+`},
+				{Name: "min", Pattern: `[0-9]+`},
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	selector, err := labels.Parse("queue=orders,vhost=prod,min=10,cluster=eu")
+	require.NoError(t, err)
+	query, err := namers[0].QueryForExternalSeries("queue_backlog", "", selector)
+	require.NoError(t, err)
+	require.Equal(t, prom.Selector(`sum(rabbitmq_queue_messages{queue="orders",vhost="prod",cluster="eu"}) > 10`), query)
+
+	for _, sel := range []string{
+		"vhost=prod,min=10",
+		"queue!=orders,vhost=prod,min=10",
+		"queue in (orders,payments),vhost=prod,min=10",
+		"queue=orders,vhost=prod,min=1e3",
+	} {
+		selector, err := labels.Parse(sel)
+		require.NoError(t, err)
+		_, err = namers[0].QueryForExternalSeries("queue_backlog", "", selector)
+		require.ErrorIs(t, err, ErrInvalidQueryParameter, sel)
+	}
+
+	// values can't end the string literal they're substituted in, whatever their pattern
+	params, err := queryParametersForRule(config.DiscoveryRule{QueryParameters: []config.QueryParameter{{Name: "queue", Pattern: ".*"}}})
+	require.NoError(t, err)
+	q := &metricsQuery{parameters: params}
+	_, _, err = q.extractParameters([]queryPart{{labelName: "queue", values: []string{`"}) or vector(1e9`}, operator: selection.Equals}})
+	require.ErrorIs(t, err, ErrInvalidQueryParameter)
+
+	// values used outside string literals must be numbers, whatever their pattern
+	params, err = queryParametersForRule(config.DiscoveryRule{
+		Query:           `sum(queue_messages{queue="$queue"}) > $min # $comment`,
+		QueryParameters: []config.QueryParameter{{Name: "queue"}, {Name: "min", Pattern: ".*"}, {Name: "comment"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, true, false}, []bool{params[0].numeric, params[1].numeric, params[2].numeric})
+	q = &metricsQuery{parameters: params[1:2]}
+	_, _, err = q.extractParameters([]queryPart{{labelName: "min", values: []string{`0 or vector(1e9)`}, operator: selection.Equals}})
+	require.ErrorIs(t, err, ErrInvalidQueryParameter)
+	values, _, err := q.extractParameters([]queryPart{{labelName: "min", values: []string{`2.5`}, operator: selection.Equals}})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"min": "2.5"}, values)
+
+	// custom metrics can't be parameterized
+	_, err = NamersFromConfig([]config.DiscoveryRule{{
+		Query:           `vector($a)`,
+		Name:            config.NameMapping{As: "one"},
+		QueryParameters: []config.QueryParameter{{Name: "a"}},
+	}}, nil, ForCustomMetrics())
+	require.Error(t, err)
+
+	for _, rule := range []config.DiscoveryRule{
+		{Query: `vector(1)`, Name: config.NameMapping{As: "one"}, QueryParameters: []config.QueryParameter{{Name: "unused"}}},
+		{Query: `vector($a)`, Name: config.NameMapping{As: "one"}, QueryParameters: []config.QueryParameter{{Name: "a"}, {Name: "a"}}},
+		{Query: `vector($a)`, Name: config.NameMapping{As: "one"}, QueryParameters: []config.QueryParameter{{Name: "a", Pattern: "("}}},
+		{Query: `vector($value)`, Name: config.NameMapping{As: "one"}, QueryParameters: []config.QueryParameter{{Name: "value"}}},
+		{SeriesQuery: `{job!=""}`, QueryParameters: []config.QueryParameter{{Name: "job"}}},
+	} {
+		_, err := NamersFromConfig([]config.DiscoveryRule{rule}, nil)
+		require.Error(t, err)
+	}
+}
+
+func TestAccessIsOnlyAcceptedForExternalRules(t *testing.T) {
+	rules := []config.DiscoveryRule{{
+		SeriesQuery: `{__name__="queue_depth"}`,
+		Access:      &config.AccessRule{Users: []string{"alice"}},
+	}}
+	_, err := NamersFromConfig(rules, nil)
+	require.NoError(t, err)
+	_, err = NamersFromConfig(rules, nil, ForCustomMetrics())
+	require.Error(t, err)
+}
+
+func TestExternalRulesCanOverrideTheNamespaceLabel(t *testing.T) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery: `{__name__="queue_depth"}`,
+			Namespaces:  []string{"team-a"},
+			Resources: config.ResourceMapping{
+				Overrides:          map[string]config.GroupResource{"namespace": {Resource: "namespace"}},
+				NamespaceLabelName: "kubernetes_namespace",
+			},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+	}, mapper)
+	require.NoError(t, err)
+
+	query, err := namers[0].QueryForExternalSeries("queue_depth", "team-a", labels.Everything())
+	require.NoError(t, err)
+	require.Equal(t, prom.Selector(`sum(queue_depth{kubernetes_namespace="team-a"})`), query)
+
+	series := []prom.Series{
+		{Name: "queue_depth", Labels: pmodel.LabelSet{"kubernetes_namespace": "team-a"}},
+		{Name: "queue_depth", Labels: pmodel.LabelSet{"kubernetes_namespace": "team-b"}},
+	}
+	require.Equal(t, series[:1], namers[0].FilterSeries(series))
+
+	for _, resources := range []config.ResourceMapping{
+		{NamespaceLabelName: "not-a-label"},
+		{NamespaceLabelName: "kubernetes_namespace", Namespaced: new(bool)},
+	} {
+		_, err := NamersFromConfig([]config.DiscoveryRule{{SeriesQuery: `{__name__="queue_depth"}`, Resources: resources}}, mapper)
+		require.Error(t, err)
+	}
+}
+
+func TestOverridesOfUnknownResourcesAreIgnored(t *testing.T) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+
+	rules := []config.DiscoveryRule{
+		{
+			SeriesQuery: `{pod!="",queue_name!=""}`,
+			Resources: config.ResourceMapping{Overrides: map[string]config.GroupResource{
+				"pod":        {Resource: "pod"},
+				"queue_name": {Group: "scheduling.volcano.sh", Resource: "queues"},
+			}},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+	}
+	namers, err := NamersFromConfig(rules, mapper)
+	require.NoError(t, err)
+	require.Equal(t, []schema.GroupResource{{Group: "scheduling.volcano.sh", Resource: "queues"}}, UnresolvedResources(rules, mapper))
+
+	resources, _ := namers[0].ResourcesForSeries(prom.Series{Name: "volcano_queue_pods", Labels: pmodel.LabelSet{"pod": "p", "queue_name": "q"}})
+	require.Equal(t, []schema.GroupResource{{Resource: "pods"}}, resources)
+
+	mapper.Add(schema.GroupVersionKind{Group: "scheduling.volcano.sh", Version: "v1beta1", Kind: "Queue"}, apimeta.RESTScopeRoot)
+	require.Empty(t, UnresolvedResources(rules, mapper))
+}
+
+func TestNamersCanBeRestrictedToACluster(t *testing.T) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+	overrides := map[string]config.GroupResource{"namespace": {Resource: "namespace"}, "pod": {Resource: "pod"}}
+
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery:  `{__name__=~"^http_.*",pod!=""}`,
+			Resources:    config.ResourceMapping{Overrides: overrides},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+		},
+		{
+			SeriesQuery:  `queue_depth`,
+			Resources:    config.ResourceMapping{Overrides: overrides},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+	}, mapper, WithCluster(Cluster{Label: "cluster", Name: "prod"}))
+	require.NoError(t, err)
+
+	require.Equal(t, prom.Selector(`{__name__=~"^http_.*",pod!="",cluster="prod"}`), namers[0].Selector())
+	require.Equal(t, prom.Selector(`queue_depth{cluster="prod"}`), namers[1].Selector())
+	require.Equal(t, `{__name__=~"^http_.*",pod!=""}`, namers[0].RuleName())
+
+	query, err := namers[0].QueryForSeries("http_requests", schema.GroupResource{Resource: "pods"}, "default", labels.Everything(), "web-0")
+	require.NoError(t, err)
+	require.Equal(t, prom.Selector(`sum(http_requests{cluster="prod",namespace="default",pod="web-0"}) by (pod)`), query)
+
+	query, err = namers[1].QueryForExternalSeries("queue_depth", "default", labels.Everything())
+	require.NoError(t, err)
+	require.Equal(t, prom.Selector(`sum(queue_depth{cluster="prod",namespace="default"})`), query)
+
+	_, err = NamersFromConfig(nil, mapper, WithCluster(Cluster{Label: "not-a-label", Name: "prod"}))
+	require.Error(t, err)
+}
+
+func TestClusterRestrictsSelectors(t *testing.T) {
+	cluster := Cluster{Label: "cluster", Name: "prod"}
+	for selector, expected := range map[string]prom.Selector{
+		`up`:                          `up{cluster="prod"}`,
+		`up{}`:                        `up{cluster="prod"}`,
+		`{__name__="up"}`:             `{__name__="up",cluster="prod"}`,
+		`up{job="a",}`:                `up{job="a",cluster="prod"}`,
+		` {job=~"a|b", pod!=""} `:     `{job=~"a|b", pod!="",cluster="prod"}`,
+		`{__name__=~"^container_.*"}`: `{__name__=~"^container_.*",cluster="prod"}`,
+	} {
+		require.Equal(t, expected, cluster.restrictSelector(selector), selector)
+	}
+}
+
+func TestOverridesOfUnknownBuiltinResourcesAreRejected(t *testing.T) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, apimeta.RESTScopeNamespace)
+
+	for _, override := range []config.GroupResource{
+		{Resource: "podz"},
+		{Group: "apps", Resource: "deploymnets"},
+	} {
+		rules := []config.DiscoveryRule{
+			{
+				SeriesQuery: `{pod!=""}`,
+				Resources: config.ResourceMapping{Overrides: map[string]config.GroupResource{
+					"pod": override,
+				}},
+				MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+			},
+		}
+		_, err := NamersFromConfig(rules, mapper)
+		require.Error(t, err, override)
+		require.Empty(t, UnresolvedResources(rules, mapper))
+	}
+}
+
+// countingMapper is a RESTMapper counting the kind lookups made through it.
+type countingMapper struct {
+	apimeta.RESTMapper
+	kindLookups int
+}
+
+func (m *countingMapper) KindFor(resource schema.GroupVersionResource) (schema.GroupVersionKind, error) {
+	m.kindLookups++
+	return m.RESTMapper.KindFor(resource)
+}
+
+func TestScopesOfUnknownResourcesAreCached(t *testing.T) {
+	defaultMapper := apimeta.NewDefaultRESTMapper(nil)
+	defaultMapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+	mapper := &countingMapper{RESTMapper: defaultMapper}
+
+	converter, err := NewResourceConverter("<<.Resource>>", nil, mapper)
+	require.NoError(t, err)
+
+	queues := schema.GroupResource{Group: "scheduling.volcano.sh", Resource: "queues"}
+	for i := 0; i < 3; i++ {
+		require.False(t, converter.ClusterScoped(queues))
+	}
+	require.Equal(t, 1, mapper.kindLookups)
+
+	// once the retry interval elapsed, unknown resources are looked up again
+	defaultMapper.Add(schema.GroupVersionKind{Group: "scheduling.volcano.sh", Version: "v1beta1", Kind: "Queue"}, apimeta.RESTScopeRoot)
+	converter.(*resourceConverter).unknownScopes[queues] = time.Now().Add(-unknownScopeRetryInterval)
+	require.True(t, converter.ClusterScoped(queues))
+	require.True(t, converter.ClusterScoped(queues))
+	require.Equal(t, 2, mapper.kindLookups)
+}
+
+func TestRelistPeriodIsTheShortestRelistInterval(t *testing.T) {
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{__name__=~"^node_hwmon_.*"}`, RelistInterval: pmodel.Duration(time.Hour)},
+		{SeriesQuery: `{__name__=~"^http_.*"}`},
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, 10*time.Minute, RelistPeriod(namers, 10*time.Minute))
+
+	namers, err = NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{__name__=~"^node_hwmon_.*"}`, RelistInterval: pmodel.Duration(time.Hour)},
+		{SeriesQuery: `{__name__=~"^autoscaling_.*"}`, RelistInterval: pmodel.Duration(time.Minute)},
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, RelistPeriod(namers, 10*time.Minute))
+}
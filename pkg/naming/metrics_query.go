@@ -20,14 +20,20 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
 
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/selection"
 
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
 )
 
 // MetricsQuery represents a compiled metrics query for some set of
@@ -41,6 +47,69 @@ type MetricsQuery interface {
 	// (e.g. container metrics).
 	Build(series string, groupRes schema.GroupResource, namespace string, extraGroupBy []string, metricSelector labels.Selector, resourceNames ...string) (prom.Selector, error)
 	BuildExternal(seriesName string, namespace string, groupBy string, groupBySlice []string, metricSelector labels.Selector) (prom.Selector, error)
+
+	// Plan is like Build, but returns the full query plan instead of just the rendered query.
+	Plan(series string, groupRes schema.GroupResource, namespace string, extraGroupBy []string, metricSelector labels.Selector, resourceNames ...string) (*queryplan.Plan, error)
+	// PlanExternal is like BuildExternal, but returns the full query plan instead of just the rendered query.
+	PlanExternal(seriesName string, namespace string, groupBy string, groupBySlice []string, metricSelector labels.Selector) (*queryplan.Plan, error)
+}
+
+// ValueSelectorKey is the key of label selector requirements comparing the
+// value of metrics, rather than a label, to a number, e.g. `value>10`.  Only
+// the GreaterThan and LessThan operators apply to it.
+const ValueSelectorKey = "value"
+
+// DefaultWindow is the value of the Window template field for rules which
+// don't specify one, matching the default rate interval of config-gen.
+const DefaultWindow = 5 * time.Minute
+
+// MetricsQueryOption configures optional aspects of a MetricsQuery.
+type MetricsQueryOption func(*metricsQuery)
+
+// WithWindow sets the value of the Window template field.  Zero means DefaultWindow.
+func WithWindow(window time.Duration) MetricsQueryOption {
+	return func(q *metricsQuery) {
+		if window > 0 {
+			q.window = window
+		}
+	}
+}
+
+// WithNamePatterns makes the queries treat the resource names they're given
+// as regular expressions, always matched using `=~`.
+func WithNamePatterns() MetricsQueryOption {
+	return func(q *metricsQuery) {
+		q.namePatterns = true
+	}
+}
+
+// WithNamespaceLabel sets the label matched against the requested namespace
+// by external queries, instead of the label the resource converter maps to
+// namespaces.  An empty label leaves the resource converter's one.
+func WithNamespaceLabel(label pmodel.LabelName) MetricsQueryOption {
+	return func(q *metricsQuery) {
+		q.namespaceLabel = label
+	}
+}
+
+// WithClusterMatcher restricts queries to the series of the given cluster, by
+// adding a matcher on its label to the label matchers of every query.
+func WithClusterMatcher(cluster Cluster) MetricsQueryOption {
+	return func(q *metricsQuery) {
+		q.cluster = &queryPart{
+			labelName: string(cluster.Label),
+			values:    []string{cluster.Name},
+			operator:  selection.Equals,
+		}
+	}
+}
+
+// withQueryParameters takes the values of the given parameters from the
+// metric selector of the queries.
+func withQueryParameters(params []queryParameter) MetricsQueryOption {
+	return func(q *metricsQuery) {
+		q.parameters = params
+	}
 }
 
 // NewMetricsQuery constructs a new MetricsQuery by compiling the given Go template.
@@ -50,17 +119,12 @@ type MetricsQuery interface {
 // - LabelMatchersByName: the raw map-form of the above matchers
 // - GroupBy: the group-by clause to use for the resources in the query (stringified)
 // - GroupBySlice: the raw slice form of the above group-by clause
-func NewMetricsQuery(queryTemplate string, resourceConverter ResourceConverter) (MetricsQuery, error) {
-	templ, err := template.New("metrics-query").Delims("<<", ">>").Parse(queryTemplate)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse metrics query template %q: %v", queryTemplate, err)
-	}
-
-	return &metricsQuery{
-		resConverter: resourceConverter,
-		template:     templ,
-		namespaced:   true,
-	}, nil
+// - Window: the window of the rule, as a Prometheus duration (e.g. `5m`)
+// - Namespace: the namespace of the requested objects, if any
+// - ResourceNames: the names of the requested objects
+// - GroupResource: the group-resource of the requested objects
+func NewMetricsQuery(queryTemplate string, resourceConverter ResourceConverter, opts ...MetricsQueryOption) (MetricsQuery, error) {
+	return NewExternalMetricsQuery(queryTemplate, resourceConverter, true, opts...)
 }
 
 // NewExternalMetricsQuery constructs a new MetricsQuery by compiling the given Go template.
@@ -70,17 +134,25 @@ func NewMetricsQuery(queryTemplate string, resourceConverter ResourceConverter)
 // - LabelMatchersByName: the raw map-form of the above matchers
 // - GroupBy: the group-by clause to use for the resources in the query (stringified)
 // - GroupBySlice: the raw slice form of the above group-by clause
-func NewExternalMetricsQuery(queryTemplate string, resourceConverter ResourceConverter, namespaced bool) (MetricsQuery, error) {
+// - Window: the window of the rule, as a Prometheus duration (e.g. `5m`)
+// - Namespace: the namespace of the request, if the query is namespaced
+// - Parameters: the values of the parameters of query-only rules, by name
+func NewExternalMetricsQuery(queryTemplate string, resourceConverter ResourceConverter, namespaced bool, opts ...MetricsQueryOption) (MetricsQuery, error) {
 	templ, err := template.New("metrics-query").Delims("<<", ">>").Parse(queryTemplate)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse metrics query template %q: %v", queryTemplate, err)
 	}
 
-	return &metricsQuery{
+	q := &metricsQuery{
 		resConverter: resourceConverter,
 		template:     templ,
 		namespaced:   namespaced,
-	}, nil
+		window:       DefaultWindow,
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q, nil
 }
 
 // metricsQuery is a MetricsQuery based on a compiled Go text template.
@@ -90,6 +162,17 @@ type metricsQuery struct {
 	resConverter ResourceConverter
 	template     *template.Template
 	namespaced   bool
+	window       time.Duration
+	// namePatterns is set if resource names are regular expressions
+	namePatterns bool
+	// association, if set, is joined with the query (see planAssociated)
+	association *association
+	// namespaceLabel, if set, overrides the namespace label of external queries
+	namespaceLabel pmodel.LabelName
+	// cluster, if set, is added to the label matchers of every query
+	cluster *queryPart
+	// parameters are set by the metric selector (see extractParameters)
+	parameters []queryParameter
 }
 
 // queryTemplateArgs contains the arguments for the template used in metricsQuery.
@@ -99,21 +182,46 @@ type queryTemplateArgs struct {
 	LabelValuesByName map[string]string
 	GroupBy           string
 	GroupBySlice      []string
+	Window            string
+	// Namespace is the namespace the query is scoped to, if any.
+	Namespace string
+	// ResourceNames are the names of the requested objects, for custom metrics.
+	ResourceNames []string
+	// GroupResource is the group-resource of the requested objects, for custom metrics.
+	GroupResource schema.GroupResource
+	// Parameters are the values of the parameters of query-only rules, by name.
+	Parameters map[string]string
 }
 
 type queryPart struct {
 	labelName string
 	values    []string
 	operator  selection.Operator
+	// patterns is set if values are regular expressions, matched as-is
+	patterns bool
 }
 
 func (q *metricsQuery) Build(series string, resource schema.GroupResource, namespace string, extraGroupBy []string, metricSelector labels.Selector, names ...string) (prom.Selector, error) {
-	queryParts := q.createQueryPartsFromSelector(metricSelector)
+	plan, err := q.Plan(series, resource, namespace, extraGroupBy, metricSelector, names...)
+	if err != nil {
+		return "", err
+	}
+	return plan.Query, nil
+}
+
+func (q *metricsQuery) Plan(series string, resource schema.GroupResource, namespace string, extraGroupBy []string, metricSelector labels.Selector, names ...string) (*queryplan.Plan, error) {
+	parameters, queryParts, err := q.extractParameters(q.createQueryPartsFromSelector(metricSelector))
+	if err != nil {
+		return nil, err
+	}
+	if q.cluster != nil {
+		queryParts = append(queryParts, *q.cluster)
+	}
 
 	if namespace != "" {
 		namespaceLbl, err := q.resConverter.LabelForResource(NsGroupResource)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
 		queryParts = append(queryParts, queryPart{
@@ -123,25 +231,34 @@ func (q *metricsQuery) Build(series string, resource schema.GroupResource, names
 		})
 	}
 
-	exprs, valuesByName, err := q.processQueryParts(queryParts)
+	if q.association != nil {
+		return q.planAssociated(series, queryParts, resource, namespace, extraGroupBy, names)
+	}
+
+	exprs, valuesByName, valueFilters, err := q.processQueryParts(queryParts)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	resourceLbl, err := q.resConverter.LabelForResource(resource)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	matcher := prom.LabelEq
 	targetValue := strings.Join(names, "|")
 
-	if len(names) > 1 {
+	if len(names) > 1 || q.namePatterns {
 		matcher = prom.LabelMatches
+		targetValue = regexAlternation(names, q.namePatterns)
+	}
+	if len(names) == 0 {
+		// no names select all the objects (see MetricNamer.ObjectSelectorRequirements)
+		matcher = prom.LabelNeq
 	}
 
 	exprs = append(exprs, matcher(string(resourceLbl), targetValue))
-	valuesByName[string(resourceLbl)] = targetValue
+	valuesByName[string(resourceLbl)] = templateAlternation(names, q.namePatterns)
 
 	groupBy := make([]string, 0, len(extraGroupBy)+1)
 	groupBy = append(groupBy, string(resourceLbl))
@@ -153,29 +270,104 @@ func (q *metricsQuery) Build(series string, resource schema.GroupResource, names
 		LabelValuesByName: valuesByName,
 		GroupBy:           strings.Join(groupBy, ","),
 		GroupBySlice:      groupBy,
+		Window:            pmodel.Duration(q.window).String(),
+		Namespace:         namespace,
+		ResourceNames:     names,
+		GroupResource:     resource,
+		Parameters:        parameters,
+	}
+	query, err := q.execute(q.template, "metrics query", args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &queryplan.Plan{
+		Series:        series,
+		LabelMatchers: exprs,
+		GroupBy:       groupBy,
+		Query:         prom.Selector(withValueFilters(query, valueFilters)),
+	}, nil
+}
+
+// checkQuerySyntax checks the syntax of the given query, if it's based on a
+// template (see checkSyntax).
+func checkQuerySyntax(q MetricsQuery) error {
+	if templated, ok := q.(*metricsQuery); ok {
+		return templated.checkSyntax()
+	}
+	return nil
+}
+
+// checkSyntax renders the query template with placeholder arguments, and
+// checks the syntax of the resulting query (see checkPromQL), so that broken
+// templates are caught when loading the configuration rather than when
+// serving requests.
+func (q *metricsQuery) checkSyntax() error {
+	args := queryTemplateArgs{
+		Series:            "placeholder_series",
+		LabelMatchers:     `namespace="placeholder",pod=~"placeholder-1|placeholder-2"`,
+		LabelValuesByName: map[string]string{"namespace": "placeholder", "pod": "placeholder-1|placeholder-2"},
+		GroupBy:           "pod",
+		GroupBySlice:      []string{"pod"},
+		Window:            pmodel.Duration(q.window).String(),
+		Namespace:         "placeholder",
+		ResourceNames:     []string{"placeholder-1", "placeholder-2"},
+		GroupResource:     schema.GroupResource{Resource: "pods"},
+		Parameters:        make(map[string]string, len(q.parameters)),
 	}
+	for _, param := range q.parameters {
+		args.Parameters[param.name] = queryParameterPlaceholder
+	}
+	query, err := q.execute(q.template, "metrics query", args)
+	if err != nil {
+		return err
+	}
+	if err := checkPromQL(query); err != nil {
+		return fmt.Errorf("invalid PromQL in rendered query %q: %v", query, err)
+	}
+	return nil
+}
+
+// execute renders the given query template, which must not produce an empty query.
+// The kind of query is used in errors.
+func (q *metricsQuery) execute(templ *template.Template, kind string, args queryTemplateArgs) (string, error) {
 	queryBuff := new(bytes.Buffer)
-	if err := q.template.Execute(queryBuff, args); err != nil {
+	if err := templ.Execute(queryBuff, args); err != nil {
 		return "", err
 	}
 
 	if queryBuff.Len() == 0 {
-		return "", fmt.Errorf("empty query produced by metrics query template")
+		return "", fmt.Errorf("empty query produced by %s template", kind)
 	}
-
-	return prom.Selector(queryBuff.String()), nil
+	return queryBuff.String(), nil
 }
 
 func (q *metricsQuery) BuildExternal(seriesName string, namespace string, groupBy string, groupBySlice []string, metricSelector labels.Selector) (prom.Selector, error) {
-	queryParts := []queryPart{}
+	plan, err := q.PlanExternal(seriesName, namespace, groupBy, groupBySlice, metricSelector)
+	if err != nil {
+		return "", err
+	}
+	return plan.Query, nil
+}
 
-	// Build up the query parts from the selector.
-	queryParts = append(queryParts, q.createQueryPartsFromSelector(metricSelector)...)
+func (q *metricsQuery) PlanExternal(seriesName string, namespace string, groupBy string, groupBySlice []string, metricSelector labels.Selector) (*queryplan.Plan, error) {
+	// Build up the query parts from the selector, taking the parameters out.
+	parameters, queryParts, err := q.extractParameters(q.createQueryPartsFromSelector(metricSelector))
+	if err != nil {
+		return nil, err
+	}
+	if q.cluster != nil {
+		queryParts = append(queryParts, *q.cluster)
+	}
 
 	if q.namespaced && namespace != "" {
-		namespaceLbl, err := q.resConverter.LabelForResource(NsGroupResource)
-		if err != nil {
-			return "", err
+		namespaceLbl := q.namespaceLabel
+		if namespaceLbl == "" {
+			var err error
+			namespaceLbl, err = q.resConverter.LabelForResource(NsGroupResource)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		queryParts = append(queryParts, queryPart{
@@ -186,10 +378,10 @@ func (q *metricsQuery) BuildExternal(seriesName string, namespace string, groupB
 	}
 
 	// Convert our query parts into the types we need for our template.
-	exprs, valuesByName, err := q.processQueryParts(queryParts)
+	exprs, valuesByName, valueFilters, err := q.processQueryParts(queryParts)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	args := queryTemplateArgs{
@@ -198,18 +390,28 @@ func (q *metricsQuery) BuildExternal(seriesName string, namespace string, groupB
 		LabelValuesByName: valuesByName,
 		GroupBy:           groupBy,
 		GroupBySlice:      groupBySlice,
+		Window:            pmodel.Duration(q.window).String(),
+		Parameters:        parameters,
+	}
+	if q.namespaced {
+		args.Namespace = namespace
 	}
 
 	queryBuff := new(bytes.Buffer)
 	if err := q.template.Execute(queryBuff, args); err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if queryBuff.Len() == 0 {
-		return "", fmt.Errorf("empty query produced by metrics query template")
+		return nil, fmt.Errorf("empty query produced by metrics query template")
 	}
 
-	return prom.Selector(queryBuff.String()), nil
+	return &queryplan.Plan{
+		Series:        seriesName,
+		LabelMatchers: exprs,
+		GroupBy:       groupBySlice,
+		Query:         prom.Selector(withValueFilters(queryBuff.String(), valueFilters)),
+	}, nil
 }
 
 func (q *metricsQuery) createQueryPartsFromSelector(metricSelector labels.Selector) []queryPart {
@@ -236,7 +438,9 @@ func (q *metricsQuery) convertRequirement(requirement labels.Requirement) queryP
 	}
 }
 
-func (q *metricsQuery) processQueryParts(queryParts []queryPart) ([]string, map[string]string, error) {
+// processQueryParts converts the given query parts into label matchers, along
+// with comparisons to apply to the value of the query (see ValueSelectorKey).
+func (q *metricsQuery) processQueryParts(queryParts []queryPart) ([]string, map[string]string, []string, error) {
 	// We've take the approach here that if we can't perfectly map their query into a Prometheus
 	// query that we should abandon the effort completely.
 	// The concern is that if we don't get a perfect match on their query parameters, the query result
@@ -251,35 +455,82 @@ func (q *metricsQuery) processQueryParts(queryParts []queryPart) ([]string, map[
 	// e.g. "some_label" => "value-one|value-two"
 	valuesByName := map[string]string{}
 
+	// Contains the comparisons to apply to the value of the query.
+	// e.g. "> 10"
+	var valueFilters []string
+
 	// Convert our query parts into template arguments.
 	for _, qPart := range queryParts {
 		// Be resilient against bad inputs.
 		// We obviously can't generate label filters for these cases.
 		if qPart.labelName == "" {
-			return nil, nil, ErrLabelNotSpecified
+			return nil, nil, nil, ErrLabelNotSpecified
 		}
 
-		if !q.operatorIsSupported(qPart.operator) {
-			return nil, nil, ErrUnsupportedOperator
+		if qPart.operator == selection.GreaterThan || qPart.operator == selection.LessThan {
+			// Label values can't be compared to numbers in PromQL, but the value
+			// of the query can.
+			if qPart.labelName != ValueSelectorKey || len(qPart.values) != 1 {
+				return nil, nil, nil, ErrUnsupportedOperator
+			}
+			comparison := ">"
+			if qPart.operator == selection.LessThan {
+				comparison = "<"
+			}
+			valueFilters = append(valueFilters, fmt.Sprintf("%s %s", comparison, qPart.values[0]))
+			continue
 		}
 
 		matcher, err := q.selectMatcher(qPart.operator, qPart.values)
 
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 
-		targetValue, err := q.selectTargetValue(qPart.operator, qPart.values)
+		targetValue, err := q.selectTargetValue(qPart.operator, qPart.values, qPart.patterns)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 
 		expression := matcher(qPart.labelName, targetValue)
 		exprs = append(exprs, expression)
-		valuesByName[qPart.labelName] = strings.Join(qPart.values, "|")
+		valuesByName[qPart.labelName] = templateAlternation(qPart.values, qPart.patterns)
 	}
 
-	return exprs, valuesByName, nil
+	return exprs, valuesByName, valueFilters, nil
+}
+
+// regexAlternation returns a regular expression matching any of the given
+// values, e.g. `web\.1|web\.2`.  Unless they're patterns, the values are
+// escaped, so that e.g. an object named `foo.*` only matches itself.
+func regexAlternation(values []string, patterns bool) string {
+	if patterns {
+		return strings.Join(values, "|")
+	}
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = regexp.QuoteMeta(value)
+	}
+	return strings.Join(quoted, "|")
+}
+
+// templateAlternation returns the alternation of the given values (see
+// regexAlternation) as given in LabelValuesByName, which is meant for
+// double-quoted regular expression matchers such as
+// `pod=~"<<index .LabelValuesByName "pod">>"`: even a single value is escaped,
+// and so are the backslashes of the escapes, as they're in a PromQL string.
+func templateAlternation(values []string, patterns bool) string {
+	quoted := strconv.Quote(regexAlternation(values, patterns))
+	return quoted[1 : len(quoted)-1]
+}
+
+// withValueFilters applies the given comparisons (e.g. "> 10") to the value of
+// the given query, dropping the series which don't satisfy them.
+func withValueFilters(query string, valueFilters []string) string {
+	for _, filter := range valueFilters {
+		query = fmt.Sprintf("(%s) %s", query, filter)
+	}
+	return query
 }
 
 func (q *metricsQuery) selectMatcher(operator selection.Operator, values []string) (func(string, string) string, error) {
@@ -319,7 +570,11 @@ func (q *metricsQuery) selectMatcher(operator selection.Operator, values []strin
 	return nil, errors.New("operator not supported by query builder")
 }
 
-func (q *metricsQuery) selectTargetValue(operator selection.Operator, values []string) (string, error) {
+// selectTargetValue returns the value matched by the matcher selectMatcher
+// returns for the given operator and values: the value itself for equality
+// matchers, and a regular expression matching exactly the values (see
+// regexAlternation) for regular expression matchers.
+func (q *metricsQuery) selectTargetValue(operator selection.Operator, values []string, patterns bool) (string, error) {
 	switch len(values) {
 	case 0:
 		switch operator {
@@ -335,27 +590,19 @@ func (q *metricsQuery) selectTargetValue(operator selection.Operator, values []s
 		}
 	case 1:
 		switch operator {
-		case selection.Equals, selection.DoubleEquals, selection.NotEquals, selection.In, selection.NotIn:
-			// Pass the value through as-is.
-			// It's somewhat strange to do this for both the regex and equality
-			// operators, but if we do it this way it gives the user a little more control.
-			// They might choose to send an "IN" request and give a list of static values
-			// or they could send a single value that's a regex, giving them a passthrough
-			// for their label selector.
+		case selection.Equals, selection.DoubleEquals, selection.NotEquals:
 			return values[0], nil
+		case selection.In, selection.NotIn:
+			return regexAlternation(values, patterns), nil
 		case selection.Exists, selection.DoesNotExist:
 			return "", ErrQueryUnsupportedValues
 		}
 	default:
 		switch operator {
 		case selection.Equals, selection.DoubleEquals, selection.NotEquals, selection.In, selection.NotIn:
-			// Pass the value through as-is.
-			// It's somewhat strange to do this for both the regex and equality
-			// operators, but if we do it this way it gives the user a little more control.
-			// They might choose to send an "IN" request and give a list of static values
-			// or they could send a single value that's a regex, giving them a passthrough
-			// for their label selector.
-			return strings.Join(values, "|"), nil
+			// labels only have one value, so several values are matched
+			// with a regular expression (see selectMatcher)
+			return regexAlternation(values, patterns), nil
 		case selection.Exists, selection.DoesNotExist:
 			return "", ErrQueryUnsupportedValues
 		}
@@ -363,7 +610,3 @@ func (q *metricsQuery) selectTargetValue(operator selection.Operator, values []s
 
 	return "", errors.New("operator not supported by query builder")
 }
-
-func (q *metricsQuery) operatorIsSupported(operator selection.Operator) bool {
-	return operator != selection.GreaterThan && operator != selection.LessThan
-}
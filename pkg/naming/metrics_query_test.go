@@ -18,13 +18,16 @@ package naming
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
 	labels "k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/selection"
 
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
 
 	pmodel "github.com/prometheus/common/model"
 )
@@ -45,6 +48,16 @@ func (rcm *resourceConverterMock) LabelForResource(gr schema.GroupResource) (pmo
 	return pmodel.LabelName(gr.Resource), nil
 }
 
+// ClusterScoped is a mock that considers all resources to be namespaced.
+func (rcm *resourceConverterMock) ClusterScoped(schema.GroupResource) bool {
+	return false
+}
+
+// OverrideLabels is a mock that maps no labels in overrides.
+func (rcm *resourceConverterMock) OverrideLabels() []pmodel.LabelName {
+	return nil
+}
+
 type checkFunc func(prom.Selector, error) error
 
 func hasError(want error) checkFunc {
@@ -177,6 +190,20 @@ func TestBuildSelector(t *testing.T) {
 			),
 		},
 
+		{
+			name: "single hostile LabelValuesByName value",
+
+			mq:             mustNewQuery(`<<.Series>>{resource=~"<<index .LabelValuesByName "resource">>"}`, false),
+			metricSelector: labels.NewSelector(),
+			resource:       schema.GroupResource{Group: "group", Resource: "resource"},
+			names:          []string{"foo.*"},
+
+			check: checks(
+				hasError(nil),
+				hasSelector(`{resource=~"foo\\.\\*"}`),
+			),
+		},
+
 		{
 			name: "multiple LabelValuesByName values",
 
@@ -259,6 +286,21 @@ func TestBuildSelector(t *testing.T) {
 				hasSelector("[resource extra groups]"),
 			),
 		},
+
+		{
+			name: "request fields",
+
+			mq:             mustNewQuery(`<<.Namespace>> <<.GroupResource>> <<.GroupResource.Resource>> <<range .ResourceNames>><<.>>;<<end>>`, true),
+			metricSelector: labels.NewSelector(),
+			resource:       schema.GroupResource{Group: "apps", Resource: "deployments"},
+			namespace:      "default",
+			names:          []string{"bar", "baz"},
+
+			check: checks(
+				hasError(nil),
+				hasSelector("default deployments.apps deployments bar;baz;"),
+			),
+		},
 	}
 
 	for _, tc := range tests {
@@ -371,6 +413,30 @@ func TestBuildExternalSelector(t *testing.T) {
 				hasSelector(" [foo bar]"),
 			),
 		},
+		{
+			name: "namespace",
+
+			mq:             mustNewQuery(`<<.Namespace>>`),
+			namespace:      "default",
+			metricSelector: labels.NewSelector(),
+
+			check: checks(
+				hasError(nil),
+				hasSelector("default"),
+			),
+		},
+		{
+			name: "namespace disabled",
+
+			mq:             mustNewNonNamespacedQuery(`[<<.Namespace>>]`),
+			namespace:      "default",
+			metricSelector: labels.NewSelector(),
+
+			check: checks(
+				hasError(nil),
+				hasSelector("[]"),
+			),
+		},
 		{
 			name: "single LabelMatchers value",
 
@@ -438,6 +504,35 @@ func TestBuildExternalSelector(t *testing.T) {
 				hasSelector("map[foo:bar|baz]"),
 			),
 		},
+		{
+			name: "value comparisons",
+
+			mq: mustNewQuery(`sum(<<.Series>>{<<.LabelMatchers>>})`),
+			metricSelector: labels.NewSelector().Add(
+				*mustNewLabelRequirement("foo", selection.Equals, []string{"bar"}),
+				*mustNewLabelRequirement("value", selection.GreaterThan, []string{"10"}),
+				*mustNewLabelRequirement("value", selection.LessThan, []string{"100"}),
+			),
+			series: "queue_depth",
+
+			check: checks(
+				hasError(nil),
+				hasSelector(`((sum(queue_depth{foo="bar"})) > 10) < 100`),
+			),
+		},
+		{
+			name: "label comparison",
+
+			mq: mustNewQuery(`sum(<<.Series>>{<<.LabelMatchers>>})`),
+			metricSelector: labels.NewSelector().Add(
+				*mustNewLabelRequirement("foo", selection.GreaterThan, []string{"10"}),
+			),
+			series: "queue_depth",
+
+			check: checks(
+				hasError(ErrUnsupportedOperator),
+			),
+		},
 	}
 
 	for _, tc := range tests {
@@ -451,3 +546,198 @@ func TestBuildExternalSelector(t *testing.T) {
 		})
 	}
 }
+
+func TestPlanKeepsQueryStructure(t *testing.T) {
+	mq, err := NewMetricsQuery(`sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`, &resourceConverterMock{true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := mq.Plan("http_requests_total", schema.GroupResource{Resource: "pods"}, "somens", []string{"container"}, labels.Everything(), "pod1", "pod2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plan.Series != "http_requests_total" {
+		t.Errorf("got series %q, want %q", plan.Series, "http_requests_total")
+	}
+	wantMatchers := []string{`namespaces="somens"`, `pods=~"pod1|pod2"`}
+	if !reflect.DeepEqual(plan.LabelMatchers, wantMatchers) {
+		t.Errorf("got label matchers %v, want %v", plan.LabelMatchers, wantMatchers)
+	}
+	wantGroupBy := []string{"pods", "container"}
+	if !reflect.DeepEqual(plan.GroupBy, wantGroupBy) {
+		t.Errorf("got group by %v, want %v", plan.GroupBy, wantGroupBy)
+	}
+
+	// the plan's query must match what Build renders
+	query, err := mq.Build("http_requests_total", schema.GroupResource{Resource: "pods"}, "somens", []string{"container"}, labels.Everything(), "pod1", "pod2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Query != query {
+		t.Errorf("got query %q, want %q", plan.Query, query)
+	}
+}
+
+func TestWindowIsAvailableToTemplates(t *testing.T) {
+	queryTemplate := `sum(rate(<<.Series>>{<<.LabelMatchers>>}[<<.Window>>])) by (<<.GroupBy>>)`
+
+	tests := []struct {
+		name     string
+		opts     []MetricsQueryOption
+		expected prom.Selector
+	}{
+		{
+			name:     "default window",
+			expected: `sum(rate(http_requests_total{namespaces="somens"}[5m])) by (namespaces)`,
+		},
+		{
+			name:     "explicit window",
+			opts:     []MetricsQueryOption{WithWindow(90 * time.Second)},
+			expected: `sum(rate(http_requests_total{namespaces="somens"}[1m30s])) by (namespaces)`,
+		},
+		{
+			name:     "zero window",
+			opts:     []MetricsQueryOption{WithWindow(0)},
+			expected: `sum(rate(http_requests_total{namespaces="somens"}[5m])) by (namespaces)`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mq, err := NewMetricsQuery(queryTemplate, &resourceConverterMock{true}, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query, err := mq.BuildExternal("http_requests_total", "somens", "namespaces", []string{"namespaces"}, labels.Everything())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query != tc.expected {
+				t.Errorf("got query %q, want %q", query, tc.expected)
+			}
+		})
+	}
+}
+
+func TestNamePatternsAreAlwaysMatchedAsRegexps(t *testing.T) {
+	mq, err := NewMetricsQuery(`sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`, &resourceConverterMock{false}, WithNamePatterns())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := mq.Build("node_load1", schema.GroupResource{Resource: "nodes"}, "", nil, labels.Everything(), `10\.0\.0\.1(:[0-9]+)?`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := prom.Selector(`sum(node_load1{nodes=~"10\\.0\\.0\\.1(:[0-9]+)?"}) by (nodes)`)
+	if query != expected {
+		t.Errorf("got query %q, want %q", query, expected)
+	}
+}
+
+func TestHostileNamesAndValuesAreEscaped(t *testing.T) {
+	mq, err := NewMetricsQuery(`sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`, &resourceConverterMock{false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustParse := func(selector string) labels.Selector {
+		sel, err := labels.Parse(selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sel
+	}
+
+	tests := []struct {
+		name     string
+		names    []string
+		selector labels.Selector
+		expected prom.Selector
+	}{
+		{
+			name:     "regexp metacharacters in resource names",
+			names:    []string{"foo.*", "bar"},
+			selector: labels.Everything(),
+			expected: `sum(requests{pods=~"foo\\.\\*|bar"}) by (pods)`,
+		},
+		{
+			name:     "single value set",
+			names:    []string{"bar"},
+			selector: mustParse("app in (web.1)"),
+			expected: `sum(requests{app=~"web\\.1",pods="bar"}) by (pods)`,
+		},
+		{
+			name:     "several values set",
+			names:    []string{"bar"},
+			selector: mustParse("app notin (web.1,web.2)"),
+			expected: `sum(requests{app!~"web\\.1|web\\.2",pods="bar"}) by (pods)`,
+		},
+		{
+			name:     "label key which isn't a label name",
+			names:    []string{"bar"},
+			selector: mustParse("app.kubernetes.io/name=web"),
+			expected: `sum(requests{"app.kubernetes.io/name"="web",pods="bar"}) by (pods)`,
+		},
+		{
+			name:     "quotes in values",
+			names:    []string{`bar"} or vector(1) #`},
+			selector: labels.SelectorFromValidatedSet(labels.Set{"app": `web"}) or vector(1) #`}),
+			expected: `sum(requests{app="web\"}) or vector(1) #",pods="bar\"} or vector(1) #"}) by (pods)`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := mq.Build("requests", schema.GroupResource{Resource: "pods"}, "", nil, tc.selector, tc.names...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query != tc.expected {
+				t.Errorf("got query %q, want %q", query, tc.expected)
+			}
+		})
+	}
+}
+
+func TestAssociationIsJoinedWithQuery(t *testing.T) {
+	assoc, err := newAssociation(&config.Association{
+		Query:  `kube_pod_info{<<.LabelMatchers>>}`,
+		On:     []string{"instance"},
+		Labels: []string{"namespaces", "pods"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq, err := NewMetricsQuery(`sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`, &resourceConverterMock{true}, withAssociation(assoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selector, err := labels.Parse("queue=orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := mq.Build("queue_depth", schema.GroupResource{Resource: "pods"}, "somens", nil, selector, "pod1", "pod2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := prom.Selector(`sum by (pods) ((sum(queue_depth{queue="orders"}) by (instance)) + on(instance) group_left(namespaces,pods) ` +
+		`(0 * max by (instance,namespaces,pods) (kube_pod_info{namespaces="somens",pods=~"pod1|pod2"})))`)
+	if query != expected {
+		t.Errorf("got query %q, want %q", query, expected)
+	}
+
+	for _, cfg := range []config.Association{
+		{On: []string{"instance"}, Labels: []string{"pod"}},
+		{Query: "kube_pod_info", Labels: []string{"pod"}},
+		{Query: "kube_pod_info", On: []string{"instance"}},
+		{Query: "kube_pod_info{<<.LabelMatchers}", On: []string{"instance"}, Labels: []string{"pod"}},
+	} {
+		if _, err := newAssociation(&cfg); err == nil {
+			t.Errorf("expected an error for association %+v", cfg)
+		}
+	}
+}
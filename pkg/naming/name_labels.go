@@ -0,0 +1,86 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	pmodel "github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/labels"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// nameLabelRef matches references to series labels in the `as` value of
+// name rules, e.g. <<.Labels.mode>>.
+var nameLabelRef = regexp.MustCompile(`<<\s*\.Labels\.([a-zA-Z_][a-zA-Z0-9_]*)\s*>>`)
+
+// invalidNameChars matches the characters of label values which are replaced
+// when they're used in metric names.
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// nameLabelsFor returns the series labels referenced by the given `as` value,
+// in order of appearance.
+func nameLabelsFor(nameAs string) ([]pmodel.LabelName, error) {
+	if rest := nameLabelRef.ReplaceAllString(nameAs, ""); strings.Contains(rest, "<<") || strings.Contains(rest, ">>") {
+		return nil, fmt.Errorf("invalid 'as' value %q: only series labels may be referenced, as <<.Labels.name>>", nameAs)
+	}
+
+	var res []pmodel.LabelName
+	seen := make(map[pmodel.LabelName]struct{})
+	for _, match := range nameLabelRef.FindAllStringSubmatch(nameAs, -1) {
+		name := pmodel.LabelName(match[1])
+		if _, dup := seen[name]; dup {
+			continue
+		}
+		seen[name] = struct{}{}
+		res = append(res, name)
+	}
+	return res, nil
+}
+
+// expandNameLabels replaces the label references of the given metric name
+// with the values of these labels in the given series.  Characters which
+// aren't valid in metric names are replaced with underscores.
+func expandNameLabels(name string, series prom.Series) (string, error) {
+	var err error
+	res := nameLabelRef.ReplaceAllStringFunc(name, func(ref string) string {
+		label := pmodel.LabelName(nameLabelRef.FindStringSubmatch(ref)[1])
+		value := series.Labels[label]
+		if value == "" && err == nil {
+			err = fmt.Errorf("series %q has no value for label %q used in its metric name", series.String(), label)
+		}
+		return invalidNameChars.ReplaceAllString(string(value), "_")
+	})
+	if err != nil {
+		return "", err
+	}
+	return res, nil
+}
+
+// SelectorWithLabels returns the given selector, additionally requiring the
+// given labels to have the given values.  The values aren't validated, since
+// Prometheus label values needn't be valid Kubernetes ones.
+func SelectorWithLabels(selector labels.Selector, lbls map[string]string) labels.Selector {
+	if len(lbls) == 0 {
+		return selector
+	}
+	reqs, _ := labels.SelectorFromValidatedSet(lbls).Requirements()
+	return selector.Add(reqs...)
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+// checkNamespaceTarget checks that a rule targeting namespaces can expose its
+// metrics on them: a label must be mapped to namespaces, and the metrics
+// query, rendered for a namespace, must match it.
+func checkNamespaceTarget(rule config.DiscoveryRule, resConv ResourceConverter, query MetricsQuery) error {
+	if len(rule.Resources.IdentityLabels) > 0 {
+		return fmt.Errorf("rules targeting namespaces can't have identity labels")
+	}
+	nsLabel, err := resConv.LabelForResource(NsGroupResource)
+	if err != nil {
+		return fmt.Errorf("rules targeting namespaces must map a label to namespaces: %v", err)
+	}
+	plan, err := query.Plan("placeholder_series", NsGroupResource, "", nil, labels.Everything(), "placeholder")
+	if err != nil {
+		return err
+	}
+	matcher := prom.LabelEq(string(nsLabel), "placeholder")
+	if !strings.Contains(string(plan.Query), matcher) {
+		return fmt.Errorf("the metrics query %q, rendered for a namespace, doesn't match the %s label, e.g. using <<.LabelMatchers>>", plan.Query, nsLabel)
+	}
+	return nil
+}
+
+// namespaceResources returns the resources the given series of a rule
+// targeting namespaces is associated with: the namespace, if the series has
+// the label mapped to namespaces.
+func (n *metricNamer) namespaceResources(series prom.Series) ([]schema.GroupResource, bool) {
+	nsLabel, err := n.ResourceConverter.LabelForResource(NsGroupResource)
+	if err != nil {
+		return nil, false
+	}
+	if _, found := series.Labels[nsLabel]; !found {
+		return nil, false
+	}
+	return []schema.GroupResource{NsGroupResource}, false
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	pmodel "github.com/prometheus/common/model"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// MissingOverrideLabels returns the labels mapped to resources in the
+// resources.overrides of the namer's rule which none of the given series,
+// discovered by the rule, carry, e.g. because of a typo, or because the label
+// is named differently by the relabeling of the scrape configuration.  Nothing
+// is reported when no series were discovered, or when only their names were
+// (see DiscoveryLabels), as the labels can't be checked then.
+func MissingOverrideLabels(namer MetricNamer, series []prom.Series) []pmodel.LabelName {
+	if len(series) == 0 || namer.DiscoveryLabels() != nil {
+		return nil
+	}
+	var missing []pmodel.LabelName
+	for _, label := range namer.OverrideLabels() {
+		found := false
+		for _, s := range series {
+			if _, ok := s.Labels[label]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, label)
+		}
+	}
+	return missing
+}
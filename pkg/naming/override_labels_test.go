@@ -0,0 +1,60 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+func TestMissingOverrideLabels(t *testing.T) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, apimeta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery: `{__name__=~"http_requests_.*"}`,
+			Resources: config.ResourceMapping{Overrides: map[string]config.GroupResource{
+				"pod":                  {Resource: "pod"},
+				"kubernetes_namespace": {Resource: "namespace"},
+			}},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+	}, mapper)
+	require.NoError(t, err)
+	require.Equal(t, []pmodel.LabelName{"kubernetes_namespace", "pod"}, namers[0].OverrideLabels())
+
+	series := []prom.Series{
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"namespace": "default", "pod": "web-0"}},
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"namespace": "default"}},
+	}
+	require.Equal(t, []pmodel.LabelName{"kubernetes_namespace"}, MissingOverrideLabels(namers[0], series))
+
+	series[1].Labels["kubernetes_namespace"] = "default"
+	require.Empty(t, MissingOverrideLabels(namers[0], series))
+
+	// the labels can't be checked without series
+	require.Empty(t, MissingOverrideLabels(namers[0], nil))
+}
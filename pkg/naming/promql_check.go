@@ -0,0 +1,29 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// checkPromQL checks the syntax of the given PromQL expression using the
+// Prometheus parser, so that e.g. misquoted label values or a missing brace
+// are caught before the query is sent to Prometheus.
+func checkPromQL(query string) error {
+	_, err := parser.ParseExpr(query)
+	return err
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+func TestCheckPromQL(t *testing.T) {
+	valid := []string{
+		`sum(rate(http_requests_total{namespace="default",pod=~"a|b"}[5m])) by (pod)`,
+		`sum(rate(container_cpu_usage_seconds_total{container!="",pod!=''}[2m:30s])) by (pod) * 1e3`,
+		`histogram_quantile(0.9, sum(rate(http_request_duration_seconds_bucket{path=~"/api/.*",}[1m])) by (le))`,
+		`max_over_time(queue_depth[1h:] offset 5m)`,
+		`{__name__="my:metric", job="x"} # a comment`,
+		"label_replace(up, \"node\", \"$1\", `instance`, \"(.*):.*\")",
+	}
+	for _, query := range valid {
+		require.NoError(t, checkPromQL(query), query)
+	}
+
+	invalid := []string{
+		`sum(rate(http_requests_total{namespace="default"}[5m]) by (pod)`,
+		`sum(rate(http_requests_total{namespace="default"}[5m])))`,
+		`http_requests_total{namespace=default}`,
+		`http_requests_total{namespace="default}`,
+		`http_requests_total{namespace=="default"}`,
+		`http_requests_total{namespace="default" pod="a"}`,
+		`http_requests_total{namespace="default"`,
+		`rate(http_requests_total[5 minutes])`,
+		`rate(http_requests_total[5m)`,
+		`sum(http_requests_total) by (pod]`,
+		`sum(http_requests_total) $ 2`,
+	}
+	for _, query := range invalid {
+		require.Error(t, checkPromQL(query), query)
+	}
+}
+
+func TestRulesWithInvalidQueriesAreRejected(t *testing.T) {
+	_, err := NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{job!=""}`, MetricsQuery: `sum(rate(<<.Series>>{<<.LabelMatchers>>}[<<.Window>>]) by (<<.GroupBy>>)`},
+	}, nil)
+	require.ErrorContains(t, err, "invalid metrics query")
+
+	_, err = NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{job!=""}`, MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>,status="5xx}) by (<<.GroupBy>>)`},
+	}, nil)
+	require.ErrorContains(t, err, "invalid metrics query")
+
+	_, err = NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{job!=""}`, MetricsQuery: `sum(rate(<<.Series>>{<<.LabelMatchers>>}[<<.Window>>])) by (<<.GroupBy>>)`},
+	}, nil)
+	require.NoError(t, err)
+}
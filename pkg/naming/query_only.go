@@ -0,0 +1,72 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"fmt"
+	"regexp"
+
+	pmodel "github.com/prometheus/common/model"
+
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+// queryOnlyMetricNameRE matches the names of the metrics of query-only rules:
+// Prometheus metric names, which may also contain hyphens, as they aren't the
+// names of actual series, e.g. like the names KEDA gives to the external
+// metrics of its scaled objects (s0-prometheus).
+var queryOnlyMetricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:-]*$`)
+
+// queryOnlyRule turns query-only rules into static rules declaring a single
+// series, named after the metric and carrying the declared labels, whose
+// metrics query is the rule's query.  Other rules are returned unchanged.
+func queryOnlyRule(rule config.DiscoveryRule) (config.DiscoveryRule, error) {
+	if rule.Query == "" {
+		if len(rule.QueryLabels) > 0 || len(rule.QueryParameters) > 0 {
+			return rule, fmt.Errorf("queryLabels and queryParameters only apply to query-only rules, for series query %q", rule.SeriesQuery)
+		}
+		return rule, nil
+	}
+
+	name := rule.Name.As
+	switch {
+	case name == "":
+		return rule, fmt.Errorf("query-only rule for query %q must name its metric with name.as", rule.Query)
+	case !queryOnlyMetricNameRE.MatchString(name):
+		return rule, fmt.Errorf("invalid metric name %q for query-only rule", name)
+	case rule.SeriesQuery != "" || rule.Static != nil || rule.Name.Matches != "" || rule.MetricsQuery != "" || rule.HistogramQuantile != nil:
+		return rule, fmt.Errorf("query-only rule for metric %q can't set seriesQuery, static, name.matches, metricsQuery or histogramQuantile", name)
+	}
+	for _, label := range rule.QueryLabels {
+		if !pmodel.LabelName(label).IsValid() {
+			return rule, fmt.Errorf("invalid query label %q for query-only rule for metric %q", label, name)
+		}
+	}
+
+	if _, err := queryParametersForRule(rule); err != nil {
+		return rule, err
+	}
+	query, err := withParameterReferences(rule.Query, rule.QueryParameters)
+	if err != nil {
+		return rule, fmt.Errorf("invalid query-only rule for metric %q: %v", name, err)
+	}
+
+	rule.Static = &config.StaticSeries{Names: []string{name}, Labels: rule.QueryLabels}
+	rule.Name = config.NameMapping{Matches: "^" + regexp.QuoteMeta(name) + "$", As: name}
+	rule.MetricsQuery = query
+	return rule, nil
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	pmodel "github.com/prometheus/common/model"
+
+	"k8s.io/apimachinery/pkg/selection"
+
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+// ErrInvalidQueryParameter is returned when the metric selector of a request
+// doesn't set a valid value for a parameter of a query-only rule.
+var ErrInvalidQueryParameter = errors.New("invalid query parameter")
+
+// DefaultQueryParameterPattern is the pattern the values of query parameters
+// must match when their rule doesn't set one.
+const DefaultQueryParameterPattern = `[a-zA-Z0-9_.:-]+`
+
+// numericQueryParameterRE matches the only values allowed for the parameters
+// the query references outside string literals.
+var numericQueryParameterRE = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// queryParameterPlaceholder is the value of the parameters used to check the
+// syntax of the queries (see metricsQuery.checkSyntax), valid both in string
+// literals and as a number.
+const queryParameterPlaceholder = "1"
+
+// unsafeParameterChars are the characters query parameter values can never
+// contain, whatever their pattern, so that they can't end the string literal
+// they're substituted in.
+const unsafeParameterChars = "\"'`\\\n\r"
+
+// queryParameter is a parameter of the query of a query-only rule, whose value
+// is taken from the metric selector.
+type queryParameter struct {
+	name    string
+	pattern *regexp.Regexp
+	// numeric is set when the query references the parameter outside string
+	// literals, where only numbers can be safely substituted.
+	numeric bool
+}
+
+// queryParametersForRule returns the parameters of the given query-only rule.
+func queryParametersForRule(rule config.DiscoveryRule) ([]queryParameter, error) {
+	params := make([]queryParameter, 0, len(rule.QueryParameters))
+	unquoted := withoutStringLiterals(rule.Query)
+	seen := make(map[string]bool, len(rule.QueryParameters))
+	for _, param := range rule.QueryParameters {
+		if !pmodel.LabelName(param.Name).IsValid() || param.Name == ValueSelectorKey {
+			return nil, fmt.Errorf("invalid query parameter name %q for query-only rule for metric %q", param.Name, rule.Name.As)
+		}
+		if seen[param.Name] {
+			return nil, fmt.Errorf("duplicate query parameter %q for query-only rule for metric %q", param.Name, rule.Name.As)
+		}
+		seen[param.Name] = true
+
+		pattern := param.Pattern
+		if pattern == "" {
+			pattern = DefaultQueryParameterPattern
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for query parameter %q of query-only rule for metric %q: %v", param.Name, rule.Name.As, err)
+		}
+		params = append(params, queryParameter{
+			name:    param.Name,
+			pattern: re,
+			numeric: parameterReference(param.Name).MatchString(unquoted),
+		})
+	}
+	return params, nil
+}
+
+// withParameterReferences replaces the references to the given parameters in
+// the given query, e.g. `$queue`, by the template field holding their value.
+// The parameters must have valid names (see queryParametersForRule).
+func withParameterReferences(query string, params []config.QueryParameter) (string, error) {
+	for _, param := range params {
+		ref := parameterReference(param.Name)
+		if !ref.MatchString(query) {
+			return "", fmt.Errorf("query parameter %q isn't used by query %q", param.Name, query)
+		}
+		query = ref.ReplaceAllLiteralString(query, fmt.Sprintf("<< index .Parameters %q >>", param.Name))
+	}
+	return query, nil
+}
+
+// parameterReference matches the references to the parameter with the given
+// name.
+func parameterReference(name string) *regexp.Regexp {
+	return regexp.MustCompile(`\$` + name + `\b`)
+}
+
+// withoutStringLiterals blanks out the contents of the string literals and
+// comments of the given query, leaving the parts where substituted values
+// would be evaluated as PromQL.
+func withoutStringLiterals(query string) string {
+	out := []byte(query)
+	var quote byte
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		switch {
+		case quote == 0 && c == '#':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case quote == 0:
+			if c == '"' || c == '\'' || c == '`' {
+				quote = c
+			}
+		case c == '\\' && quote != '`' && i+1 < len(out):
+			out[i], out[i+1] = ' ', ' '
+			i++
+		case c == quote:
+			quote = 0
+		default:
+			out[i] = ' '
+		}
+	}
+	return string(out)
+}
+
+// extractParameters takes the values of the parameters of the query out of the
+// given query parts, which must set each of them to a single valid value.
+func (q *metricsQuery) extractParameters(queryParts []queryPart) (map[string]string, []queryPart, error) {
+	if len(q.parameters) == 0 {
+		return nil, queryParts, nil
+	}
+
+	values := make(map[string]string, len(q.parameters))
+	remaining := make([]queryPart, 0, len(queryParts))
+	for _, qPart := range queryParts {
+		param := q.parameter(qPart.labelName)
+		if param == nil {
+			remaining = append(remaining, qPart)
+			continue
+		}
+		switch qPart.operator {
+		case selection.Equals, selection.DoubleEquals, selection.In:
+		default:
+			return nil, nil, fmt.Errorf("%w %q: it must be set with an equality", ErrInvalidQueryParameter, param.name)
+		}
+		if len(qPart.values) != 1 {
+			return nil, nil, fmt.Errorf("%w %q: it must be set to a single value", ErrInvalidQueryParameter, param.name)
+		}
+		value := qPart.values[0]
+		if strings.ContainsAny(value, unsafeParameterChars) || !param.pattern.MatchString(value) {
+			return nil, nil, fmt.Errorf("%w %q: value %q doesn't match %s", ErrInvalidQueryParameter, param.name, value, param.pattern)
+		}
+		if param.numeric && !numericQueryParameterRE.MatchString(value) {
+			return nil, nil, fmt.Errorf("%w %q: value %q isn't a number, which it must be as the query uses it outside string literals", ErrInvalidQueryParameter, param.name, value)
+		}
+		values[param.name] = value
+	}
+	for _, param := range q.parameters {
+		if _, found := values[param.name]; !found {
+			return nil, nil, fmt.Errorf("%w %q: it must be set by the metric selector", ErrInvalidQueryParameter, param.name)
+		}
+	}
+	return values, remaining, nil
+}
+
+// parameter returns the parameter of the query with the given name, if any.
+func (q *metricsQuery) parameter(name string) *queryParameter {
+	for i := range q.parameters {
+		if q.parameters[i].name == name {
+			return &q.parameters[i]
+		}
+	}
+	return nil
+}
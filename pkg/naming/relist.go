@@ -0,0 +1,119 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"sync"
+	"time"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+type relistEntry struct {
+	listedAt time.Time
+	series   []prom.Series
+}
+
+// RelistCache keeps the series last listed by each series query, so that the
+// queries of rules with their own relist interval aren't run on every relist.
+// The zero value is ready to use.
+type RelistCache[K comparable] struct {
+	mu      sync.Mutex
+	entries map[K]relistEntry
+}
+
+// Fresh returns the series last listed by the given query, if they were
+// listed less than the given interval before now.  A zero interval means the
+// query is run on every relist.
+func (c *RelistCache[K]) Fresh(query K, interval time.Duration, now time.Time) ([]prom.Series, bool) {
+	if interval <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.entries[query]
+	if !found || now.Sub(entry.listedAt) >= interval {
+		return nil, false
+	}
+	return entry.series, true
+}
+
+// Store records the series listed by the given query at the given time.
+func (c *RelistCache[K]) Store(query K, series []prom.Series, listedAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[K]relistEntry)
+	}
+	c.entries[query] = relistEntry{listedAt: listedAt, series: series}
+}
+
+// Reset forgets the series of all queries, e.g. because the rules filtering
+// them changed.
+func (c *RelistCache[K]) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// Retain forgets the series of the queries which aren't in the given set,
+// e.g. because the rules making them were removed.
+func (c *RelistCache[K]) Retain(queries map[K]struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for query := range c.entries {
+		if _, found := queries[query]; !found {
+			delete(c.entries, query)
+		}
+	}
+}
+
+// RelistPeriod returns the period at which the series of the given namers
+// have to be relisted: the given default interval, unless some rules
+// override it with a shorter relist interval.
+func RelistPeriod(namers []MetricNamer, defaultInterval time.Duration) time.Duration {
+	period := defaultInterval
+	for _, namer := range namers {
+		if interval := namer.RelistInterval(); interval > 0 && (period <= 0 || interval < period) {
+			period = interval
+		}
+	}
+	return period
+}
+
+// RelistUntil calls relist, then waits for the period returned by period
+// before calling it again, until the given channel is closed.  Unlike with
+// wait.Until, the period may change from one relist to the next, e.g. when
+// the rules are replaced.
+func RelistUntil(relist func(), period func() time.Duration, stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+		relist()
+
+		timer := time.NewTimer(period())
+		select {
+		case <-stopCh:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
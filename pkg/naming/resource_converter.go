@@ -19,14 +19,17 @@ package naming
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 
 	pmodel "github.com/prometheus/common/model"
 
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/klog/v2"
 
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
@@ -42,6 +45,10 @@ var (
 	PVGroupResource    = schema.GroupResource{Resource: "persistentvolumes"}
 )
 
+// unknownScopeRetryInterval is how long resources the RESTMapper doesn't know
+// about are assumed to be namespaced before they're looked up again.
+const unknownScopeRetryInterval = time.Minute
+
 // ResourceConverter knows the relationship between Kubernetes group-resources and Prometheus labels,
 // and can convert between the two for any given label or series.
 type ResourceConverter interface {
@@ -50,23 +57,42 @@ type ResourceConverter interface {
 	ResourcesForSeries(series prom.Series) (res []schema.GroupResource, namespaced bool)
 	// LabelForResource returns the appropriate label for the given resource.
 	LabelForResource(resource schema.GroupResource) (pmodel.LabelName, error)
+	// ClusterScoped checks whether the given resource is cluster-scoped, and
+	// so has its metrics served outside of any namespace.
+	ClusterScoped(resource schema.GroupResource) bool
+	// OverrideLabels returns the labels mapped to resources by the overrides,
+	// sorted.
+	OverrideLabels() []pmodel.LabelName
 }
 
 type resourceConverter struct {
-	labelResourceMu   sync.RWMutex
-	labelToResource   map[pmodel.LabelName]schema.GroupResource
-	resourceToLabel   map[schema.GroupResource]pmodel.LabelName
+	labelResourceMu sync.RWMutex
+	labelToResource map[pmodel.LabelName]schema.GroupResource
+	resourceToLabel map[schema.GroupResource]pmodel.LabelName
+	// clusterScoped caches the scope of resources, either overridden or
+	// looked up in the RESTMapper
+	clusterScoped map[schema.GroupResource]bool
+	// unknownScopes records when the resources unknown to the RESTMapper were
+	// last looked up, so that they're not looked up again for every series
+	unknownScopes map[schema.GroupResource]time.Time
+	// overrideLabels are the labels mapped to known resources by the
+	// overrides, sorted
+	overrideLabels    []pmodel.LabelName
 	labelResExtractor *labelGroupResExtractor
 	mapper            apimeta.RESTMapper
 	labelTemplate     *template.Template
 }
 
 // NewResourceConverter creates a ResourceConverter based on a generic template plus any overrides.
-// Either overrides or the template may be empty, but not both.
+// Either overrides or the template may be empty, but not both.  Overrides of resources the
+// RESTMapper doesn't know about are rejected, unless they may be installed later, in which
+// case they're ignored until then, see UnresolvedResources.
 func NewResourceConverter(resourceTemplate string, overrides map[string]config.GroupResource, mapper apimeta.RESTMapper) (ResourceConverter, error) {
 	converter := &resourceConverter{
 		labelToResource: make(map[pmodel.LabelName]schema.GroupResource),
 		resourceToLabel: make(map[schema.GroupResource]pmodel.LabelName),
+		clusterScoped:   make(map[schema.GroupResource]bool),
+		unknownScopes:   make(map[schema.GroupResource]time.Time),
 		mapper:          mapper,
 	}
 
@@ -93,17 +119,116 @@ func NewResourceConverter(resourceTemplate string, overrides map[string]config.G
 			},
 		}
 		info, _, err := infoRaw.Normalized(converter.mapper)
+		if apimeta.IsNoMatchError(err) && pendingResource(infoRaw.GroupResource) {
+			klog.Warningf("ignoring label %q until group-resource %s is known to the API server: %v", lbl, infoRaw.GroupResource.String(), err)
+			continue
+		}
 		if err != nil {
 			return nil, fmt.Errorf("unable to normalize group-resource %v: %v", groupRes, err)
 		}
 
 		converter.labelToResource[pmodel.LabelName(lbl)] = info.GroupResource
 		converter.resourceToLabel[info.GroupResource] = pmodel.LabelName(lbl)
+		converter.overrideLabels = append(converter.overrideLabels, pmodel.LabelName(lbl))
+
+		switch groupRes.Scope {
+		case "":
+		case config.ClusterScoped:
+			converter.clusterScoped[info.GroupResource] = true
+		case config.NamespaceScoped:
+			converter.clusterScoped[info.GroupResource] = false
+		default:
+			return nil, fmt.Errorf("invalid scope %q for group-resource %v, must be %q or %q", groupRes.Scope, groupRes, config.NamespaceScoped, config.ClusterScoped)
+		}
 	}
 
+	sort.Slice(converter.overrideLabels, func(i, j int) bool { return converter.overrideLabels[i] < converter.overrideLabels[j] })
+
 	return converter, nil
 }
 
+// pendingResource checks whether the given group-resource, unknown to the
+// RESTMapper, may be served later, once its CustomResourceDefinition is
+// installed.  The resources of built-in groups can't, so overrides mapping
+// unknown ones are most likely typos.
+func pendingResource(gr schema.GroupResource) bool {
+	return !scheme.Scheme.IsGroupRegistered(gr.Group)
+}
+
+// UnresolvedResources lists the group-resources of the overrides of the given
+// rules which the RESTMapper doesn't know about yet, because their
+// CustomResourceDefinitions haven't been installed.  The labels mapped to
+// these resources are ignored until the rules are compiled again.
+func UnresolvedResources(rules []config.DiscoveryRule, mapper apimeta.RESTMapper) []schema.GroupResource {
+	seen := make(map[schema.GroupResource]struct{})
+	var res []schema.GroupResource
+	for _, rule := range rules {
+		for _, groupRes := range rule.Resources.Overrides {
+			gr := schema.GroupResource{Group: groupRes.Group, Resource: groupRes.Resource}
+			if _, found := seen[gr]; found {
+				continue
+			}
+			seen[gr] = struct{}{}
+			if _, _, err := (provider.CustomMetricInfo{GroupResource: gr}).Normalized(mapper); apimeta.IsNoMatchError(err) && pendingResource(gr) {
+				res = append(res, gr)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].String() < res[j].String() })
+	return res
+}
+
+func (r *resourceConverter) OverrideLabels() []pmodel.LabelName {
+	return r.overrideLabels
+}
+
+func (r *resourceConverter) ClusterScoped(resource schema.GroupResource) bool {
+	if resource == NsGroupResource || resource == NodeGroupResource || resource == PVGroupResource {
+		return true
+	}
+
+	r.labelResourceMu.RLock()
+	clusterScoped, ok := r.clusterScoped[resource]
+	lookedUp, unknown := r.unknownScopes[resource]
+	r.labelResourceMu.RUnlock()
+	if ok {
+		return clusterScoped
+	}
+
+	// resources the RESTMapper doesn't know about are assumed to be namespaced,
+	// and looked up again after a while, in case they have been discovered since
+	if r.mapper == nil || (unknown && time.Since(lookedUp) < unknownScopeRetryInterval) {
+		return false
+	}
+	clusterScoped, err := r.lookupScope(resource)
+	if err != nil {
+		r.labelResourceMu.Lock()
+		defer r.labelResourceMu.Unlock()
+		r.unknownScopes[resource] = time.Now()
+		return false
+	}
+
+	r.labelResourceMu.Lock()
+	defer r.labelResourceMu.Unlock()
+	r.clusterScoped[resource] = clusterScoped
+	delete(r.unknownScopes, resource)
+	return clusterScoped
+}
+
+// lookupScope checks whether the given resource is cluster-scoped according
+// to the RESTMapper.
+func (r *resourceConverter) lookupScope(resource schema.GroupResource) (bool, error) {
+	gvk, err := r.mapper.KindFor(resource.WithVersion(""))
+	if err != nil {
+		return false, err
+	}
+	mapping, err := r.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return false, err
+	}
+	return mapping.Scope.Name() == apimeta.RESTScopeNameRoot, nil
+}
+
 func (r *resourceConverter) LabelForResource(resource schema.GroupResource) (pmodel.LabelName, error) {
 	r.labelResourceMu.RLock()
 	// check if we have a cached copy or override
@@ -0,0 +1,237 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"k8s.io/klog/v2"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+// DefaultValueFilterQuery is the test query of value filters which don't
+// specify one: series must have received samples within the rule's window.
+const DefaultValueFilterQuery = `count(count_over_time(<<.Series>>[<<.Window>>]))`
+
+// valueFilterBatchSize is the number of series names whose test queries are
+// run together, as a single query.
+const valueFilterBatchSize = 20
+
+// valueFilterSeriesLabel is the label the results of the test queries run
+// together are told apart with.
+const valueFilterSeriesLabel = "__adapter_value_filter_series__"
+
+// valueFilter renders the test query run for each series name discovered by
+// a rule (see config.ValueFilter).
+type valueFilter struct {
+	template *template.Template
+	window   time.Duration
+	// matchers are the label matchers of the series query of the rule, which
+	// the test query is restricted to
+	matchers []string
+}
+
+// newValueFilter compiles the given value filter config, of the rule with
+// the given series query.
+func newValueFilter(cfg *config.ValueFilter, window time.Duration, seriesQuery prom.Selector) (*valueFilter, error) {
+	query := cfg.Query
+	if query == "" {
+		query = DefaultValueFilterQuery
+	}
+	templ, err := template.New("value-filter-query").Delims("<<", ">>").Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse value filter query template %q: %v", query, err)
+	}
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	filter := &valueFilter{template: templ, window: window}
+	if seriesQuery != "" {
+		matchers, err := parser.ParseMetricSelector(string(seriesQuery))
+		if err != nil {
+			return nil, fmt.Errorf("invalid series query: %v", err)
+		}
+		for _, matcher := range matchers {
+			// the name is matched by the test query of each series name
+			if matcher.Name != pmodel.MetricNameLabel {
+				filter.matchers = append(filter.matchers, matcher.String())
+			}
+		}
+	}
+	// check the syntax, and that the query returns a vector, with a
+	// placeholder series name
+	rendered, err := filter.query("series")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPromQL(string(batchValueFilterQueries(map[string]prom.Selector{"series": rendered}))); err != nil {
+		return nil, fmt.Errorf("invalid value filter query %q: %v", rendered, err)
+	}
+	return filter, nil
+}
+
+// query renders the test query of the given series name.
+func (f *valueFilter) query(series string) (prom.Selector, error) {
+	buff := new(bytes.Buffer)
+	if err := f.template.Execute(buff, queryTemplateArgs{
+		Series: f.selector(series),
+		Window: pmodel.Duration(f.window).String(),
+	}); err != nil {
+		return "", err
+	}
+	if buff.Len() == 0 {
+		return "", fmt.Errorf("empty query produced by value filter query template")
+	}
+	return prom.Selector(buff.String()), nil
+}
+
+// selector returns the selector of the series of the given name matching the
+// series query of the rule.
+func (f *valueFilter) selector(series string) string {
+	if len(f.matchers) == 0 {
+		return series
+	}
+	return series + "{" + strings.Join(f.matchers, ",") + "}"
+}
+
+// batchValueFilterQueries returns a query running the given test queries, by
+// series name, at once.  The samples returned by each of them carry the
+// valueFilterSeriesLabel label, set to its series name.
+func batchValueFilterQueries(queries map[string]prom.Selector) prom.Selector {
+	names := make([]string, 0, len(queries))
+	for name := range queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	labelled := make([]string, len(names))
+	for i, name := range names {
+		labelled[i] = fmt.Sprintf("label_replace(%s, %q, %q, \"\", \"\")", queries[name], valueFilterSeriesLabel, name)
+	}
+	return prom.Selector(strings.Join(labelled, " or "))
+}
+
+// FilterSeriesByValue returns the given series of the rule whose names pass
+// its value filter, if it has one.  The test queries of several series names
+// are run at once, under the given limiter.  Names whose test query fails are
+// kept, so that errors querying Prometheus don't hide metrics.
+func FilterSeriesByValue(ctx context.Context, client prom.Client, limiter *prom.RequestLimiter, namer MetricNamer, series []prom.Series) []prom.Series {
+	if len(series) == 0 {
+		return series
+	}
+	if _, ok, _ := namer.ValueFilterQuery(series[0].Name); !ok {
+		return series
+	}
+	ctx = prom.WithHeaders(prom.WithBackend(ctx, namer.PrometheusRef()), namer.PrometheusHeaders())
+	ctx = prom.WithRule(ctx, namer.RuleName())
+
+	var names []string
+	seen := make(map[string]struct{})
+	for _, s := range series {
+		if _, found := seen[s.Name]; !found {
+			seen[s.Name] = struct{}{}
+			names = append(names, s.Name)
+		}
+	}
+
+	now := pmodel.Now()
+	passes := make(map[string]bool, len(names))
+	for start := 0; start < len(names); start += valueFilterBatchSize {
+		batch := names[start:min(start+valueFilterBatchSize, len(names))]
+		for name, pass := range passValueFilters(ctx, client, limiter, namer, batch, now) {
+			passes[name] = pass
+		}
+	}
+
+	res := make([]prom.Series, 0, len(series))
+	for _, s := range series {
+		if passes[s.Name] {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// passValueFilters runs the test queries of the given series names at once,
+// and checks which of them return any sample.
+func passValueFilters(ctx context.Context, client prom.Client, limiter *prom.RequestLimiter, namer MetricNamer, names []string, now pmodel.Time) map[string]bool {
+	passes := make(map[string]bool, len(names))
+	queries := make(map[string]prom.Selector, len(names))
+	for _, name := range names {
+		query, _, err := namer.ValueFilterQuery(name)
+		if err != nil {
+			klog.Errorf("unable to render the value filter query of series %q for rule %q, keeping it: %v", name, namer.RuleName(), err)
+			passes[name] = true
+			continue
+		}
+		queries[name] = query
+	}
+	if len(queries) == 0 {
+		return passes
+	}
+
+	query := batchValueFilterQueries(queries)
+	result, err := runValueFilterQuery(ctx, client, limiter, query, now)
+	if err != nil {
+		klog.Errorf("unable to run the value filter query %q for rule %q, keeping its series: %v", query, namer.RuleName(), err)
+		for name := range queries {
+			passes[name] = true
+		}
+		return passes
+	}
+	for name := range queries {
+		passes[name] = false
+	}
+	for _, sample := range result {
+		passes[string(sample.Metric[valueFilterSeriesLabel])] = true
+	}
+	for name := range queries {
+		if !passes[name] {
+			klog.V(4).Infof("ignoring series %q of rule %q, whose value filter query %q returned no samples", name, namer.RuleName(), queries[name])
+		}
+	}
+	return passes
+}
+
+// runValueFilterQuery runs the given batch of test queries under the given
+// limiter.
+func runValueFilterQuery(ctx context.Context, client prom.Client, limiter *prom.RequestLimiter, query prom.Selector, now pmodel.Time) (pmodel.Vector, error) {
+	release, err := limiter.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	result, err := client.Query(ctx, now, query)
+	if err != nil {
+		return nil, err
+	}
+	if result.Type != pmodel.ValVector || result.Vector == nil {
+		return nil, fmt.Errorf("expected a vector, got a %s", result.Type)
+	}
+	return *result.Vector, nil
+}
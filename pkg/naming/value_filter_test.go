@@ -0,0 +1,88 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+func TestSeriesAreFilteredByValue(t *testing.T) {
+	namers, err := NamersFromConfig([]config.DiscoveryRule{
+		{
+			SeriesQuery:  `{__name__=~".*_requests_total",job!=""}`,
+			Window:       pmodel.Duration(2 * time.Minute),
+			ValueFilter:  &config.ValueFilter{},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+		{
+			SeriesQuery:  `{job!=""}`,
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>})`,
+		},
+	}, nil, WithCluster(Cluster{Label: "cluster", Name: "eu-1"}))
+	require.NoError(t, err)
+
+	// the test query is restricted to the series of the rule, in the cluster
+	query, ok, err := namers[0].ValueFilterQuery("http_requests_total")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, prom.Selector(`count(count_over_time(http_requests_total{job!="",cluster="eu-1"}[2m]))`), query)
+	_, ok, err = namers[1].ValueFilterQuery("http_requests_total")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	series := []prom.Series{
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"job": "web"}},
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"job": "api"}},
+		{Name: "stale_requests_total", Labels: pmodel.LabelSet{"job": "web"}},
+	}
+	// the test queries of all the names are run at once
+	client := (&fakeprom.FakePrometheusClient{}).
+		OnQuery(`^label_replace\(count\(count_over_time\(http_requests_total\{.*\}\[2m\]\)\), "__adapter_value_filter_series__", "http_requests_total", "", ""\) or label_replace\(count\(count_over_time\(stale_requests_total\{.*\}\[2m\]\)\), .*\)$`,
+			fakeprom.VectorResult(&pmodel.Sample{Metric: pmodel.Metric{valueFilterSeriesLabel: "http_requests_total"}, Value: 2}))
+	require.Equal(t, series[:2], FilterSeriesByValue(context.Background(), client, nil, namers[0], series), "series without recent samples should be filtered out")
+	require.Equal(t, series, FilterSeriesByValue(context.Background(), client, nil, namers[1], series), "rules without a value filter should keep all series")
+
+	failing := (&fakeprom.FakePrometheusClient{}).FailOn(`.*`, errors.New("prometheus is down"))
+	require.Equal(t, series, FilterSeriesByValue(context.Background(), failing, nil, namers[0], series), "series whose test query fails should be kept")
+}
+
+func TestRulesWithInvalidValueFiltersAreRejected(t *testing.T) {
+	_, err := NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{job!=""}`, ValueFilter: &config.ValueFilter{Query: `count(<<.Series>>`}},
+	}, nil)
+	require.ErrorContains(t, err, "invalid value filter")
+
+	_, err = NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{job!=""}`, ValueFilter: &config.ValueFilter{Query: `sum(<<.Serie>>) > 0`}},
+	}, nil)
+	require.ErrorContains(t, err, "invalid value filter")
+
+	_, err = NamersFromConfig([]config.DiscoveryRule{
+		{SeriesQuery: `{job!=""}`, ValueFilter: &config.ValueFilter{Query: `sum(<<.Series>>) > 0`}},
+	}, nil)
+	require.NoError(t, err)
+}
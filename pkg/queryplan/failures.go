@@ -0,0 +1,28 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queryplan
+
+// FailureReporter is told about the outcome of the queries answering metrics
+// API requests, so that repeated failures can be surfaced outside of the
+// adapter's logs, e.g. as Kubernetes events.
+type FailureReporter interface {
+	// QueryFailed reports that the query for the given metric, served through
+	// the given API group, couldn't be built or run.
+	QueryFailed(api, metric, rule string, err error)
+	// QuerySucceeded reports that the query for the given metric succeeded.
+	QuerySucceeded(api, metric string)
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queryplan
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	pmodel "github.com/prometheus/common/model"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// ErrLimitExceeded is wrapped by the errors of plans refused because they
+// exceed their limits.
+var ErrLimitExceeded = errors.New("query limit exceeded")
+
+// Limits bound the cost of the queries of a plan, protecting shared
+// Prometheus servers from accidentally expensive queries.  Zero means
+// unlimited.
+type Limits struct {
+	// MaxSamples is the maximum number of samples (or, for range queries,
+	// series) a query may return.
+	MaxSamples int
+	// MaxRegexLength is the maximum length of the regular expression of
+	// any label matcher of a query, e.g. the one matching the names of the
+	// requested objects.
+	MaxRegexLength int
+}
+
+// checkMatchers checks that the regular expressions of the given label
+// matchers are within the limits, so that the query isn't run otherwise.
+func (l Limits) checkMatchers(matchers []string) error {
+	if l.MaxRegexLength <= 0 {
+		return nil
+	}
+	for _, matcher := range matchers {
+		if length := regexLength(matcher); length > l.MaxRegexLength {
+			name, _, _ := strings.Cut(matcher, "~")
+			return fmt.Errorf("%w: the regular expression matching label %s is %d characters long, more than the limit of %d",
+				ErrLimitExceeded, strings.TrimRight(name, "=!"), length, l.MaxRegexLength)
+		}
+	}
+	return nil
+}
+
+// checkResults checks that the given number of returned samples is within
+// the limits.
+func (l Limits) checkResults(samples int) error {
+	if l.MaxSamples > 0 && samples > l.MaxSamples {
+		return fmt.Errorf("%w: the query returned %d samples, more than the limit of %d", ErrLimitExceeded, samples, l.MaxSamples)
+	}
+	return nil
+}
+
+// resultSize returns the number of samples of a vector result, or of series
+// of a matrix result.
+func resultSize(res prom.QueryResult) int {
+	switch {
+	case res.Type == pmodel.ValVector && res.Vector != nil:
+		return len(*res.Vector)
+	case res.Type == pmodel.ValMatrix && res.Matrix != nil:
+		return len(*res.Matrix)
+	}
+	return 0
+}
+
+// regexLength returns the length of the regular expression of the given
+// label matcher, e.g. `pod=~"web-0|web-1"`, which is zero for matchers
+// which aren't regular expression ones.
+func regexLength(matcher string) int {
+	// only look for the operator before the value
+	name, _, _ := strings.Cut(matcher, `"`)
+	i := strings.Index(name, "=~")
+	if i < 0 {
+		i = strings.Index(name, "!~")
+	}
+	if i < 0 {
+		return 0
+	}
+	value := strings.TrimSpace(matcher[i+2:])
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		return len(unquoted)
+	}
+	return len(value)
+}
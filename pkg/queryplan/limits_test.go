@@ -0,0 +1,74 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queryplan
+
+import (
+	"context"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+)
+
+func TestExecuteEnforcesThePlanLimits(t *testing.T) {
+	client := (&fakeprom.FakePrometheusClient{}).
+		OnQuery(`sum\(http_requests\{pod=~"web-0\|web-1"\}\) by \(pod\)`, fakeprom.VectorResult(
+			&pmodel.Sample{Metric: pmodel.Metric{"pod": "web-0"}, Value: 1},
+			&pmodel.Sample{Metric: pmodel.Metric{"pod": "web-1"}, Value: 2},
+		))
+	executor := NewExecutor(client)
+	plan := func(limits Limits) *Plan {
+		return &Plan{
+			LabelMatchers: []string{`namespace="default"`, `pod=~"web-0|web-1"`},
+			Query:         `sum(http_requests{pod=~"web-0|web-1"}) by (pod)`,
+			Limits:        limits,
+		}
+	}
+
+	_, err := executor.Execute(context.Background(), plan(Limits{}))
+	require.NoError(t, err)
+	_, err = executor.Execute(context.Background(), plan(Limits{MaxSamples: 2, MaxRegexLength: 11}))
+	require.NoError(t, err)
+
+	_, err = executor.Execute(context.Background(), plan(Limits{MaxSamples: 1}))
+	require.ErrorIs(t, err, ErrLimitExceeded)
+	require.ErrorContains(t, err, "returned 2 samples, more than the limit of 1")
+
+	// the query isn't run at all
+	_, err = executor.Execute(context.Background(), &Plan{
+		LabelMatchers: []string{`pod=~"web-0|web-1"`},
+		Query:         `sum(unknown_series)`,
+		Limits:        Limits{MaxRegexLength: 10},
+	})
+	require.ErrorIs(t, err, ErrLimitExceeded)
+	require.ErrorContains(t, err, "matching label pod is 11 characters long, more than the limit of 10")
+}
+
+func TestRegexLength(t *testing.T) {
+	for matcher, length := range map[string]int{
+		`pod=~"web-0|web-1"`: 11,
+		`pod!~"web-.*"`:      6,
+		`pod="web-0|web-1"`:  0,
+		`pod!="web-~"`:       0,
+		`pod="a=~b"`:         0,
+		`pod=~"a\\.b"`:       4,
+	} {
+		require.Equal(t, length, regexLength(matcher), matcher)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package queryplan contains the structured description of how the adapter
+// fetches the values for a single metrics API request, along with the shared
+// executor which runs them against Prometheus.  Keeping the pieces of a query
+// around, instead of just its rendered form, leaves room for plan-level
+// caching, cost estimation and tracing.
+package queryplan
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	pmodel "github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"k8s.io/klog/v2"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// Plan describes the Prometheus query used to answer a metrics API request.
+type Plan struct {
+	// Rule identifies the discovery rule the plan was built from: its ID if
+	// it has one, and its series query otherwise.
+	Rule string
+	// Series is the name of the Prometheus series the metric is derived from.
+	// It may be empty, if the query template doesn't rely on it.
+	Series string
+	// LabelMatchers are the label matchers restricting the series to the
+	// requested objects and metric selector.
+	LabelMatchers []string
+	// GroupBy are the labels by which the results are expected to be aggregated.
+	GroupBy []string
+	// Query is the rendered query.
+	Query prom.Selector
+	// Time is the evaluation time of the query.  If zero, the query is
+	// evaluated at the time it's executed.
+	Time pmodel.Time
+	// Backend is the name of the Prometheus backend the query is sent to.
+	// If empty, the default backend is used.
+	Backend string
+	// Headers are extra HTTP headers sent with the query.
+	Headers http.Header
+	// Range, if its window is set, makes the query a range query ending at
+	// the evaluation time, instead of an instant one.
+	Range Range
+	// Values is how the returned values are converted into the quantities
+	// served for the metric.  It's applied by the providers, not the executor,
+	// so that results may be shared by plans converting values differently.
+	Values ValueConversion
+	// Limits bound the cost of the query, which isn't run if its label
+	// matchers exceed them, and whose results are refused if they do.
+	Limits Limits
+}
+
+// String returns a human-readable description of the plan, for logging.
+func (p *Plan) String() string {
+	desc := fmt.Sprintf("rule=%q series=%q matchers=[%s] groupBy=[%s] query=%q backend=%q",
+		p.Rule, p.Series, strings.Join(p.LabelMatchers, ","), strings.Join(p.GroupBy, ","), p.Query, p.Backend)
+	if p.Range.Window > 0 {
+		desc += fmt.Sprintf(" range=%s step=%s aggregation=%s", p.Range.Window, p.Range.Step, p.Range.Aggregation)
+	}
+	return desc
+}
+
+// tracer traces the execution of plans, using the global tracer provider.
+var tracer = otel.Tracer("sigs.k8s.io/prometheus-adapter/pkg/queryplan")
+
+// Executor runs query plans against Prometheus.
+type Executor struct {
+	client prom.Client
+}
+
+// NewExecutor creates an Executor running plans using the given client.
+func NewExecutor(client prom.Client) *Executor {
+	return &Executor{client: client}
+}
+
+// Execute runs the given plan, returning the raw query results.  The results of
+// range queries are reduced to a vector, holding one sample per series.
+func (e *Executor) Execute(ctx context.Context, plan *Plan) (prom.QueryResult, error) {
+	ctx, span := tracer.Start(ctx, "Execute query plan", trace.WithAttributes(
+		attribute.String("rule", plan.Rule),
+		attribute.String("series", plan.Series),
+		attribute.String("query", string(plan.Query)),
+		attribute.String("backend", plan.Backend),
+	))
+	defer span.End()
+
+	res, err := e.execute(ctx, plan)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return res, err
+}
+
+func (e *Executor) execute(ctx context.Context, plan *Plan) (prom.QueryResult, error) {
+	ts := plan.Time
+	if ts == 0 {
+		ts = pmodel.Now()
+	}
+
+	if plan.Backend != "" {
+		ctx = prom.WithBackend(ctx, plan.Backend)
+	}
+	ctx = prom.WithHeaders(prom.WithRule(ctx, plan.Rule), plan.Headers)
+
+	if err := plan.Limits.checkMatchers(plan.LabelMatchers); err != nil {
+		return prom.QueryResult{}, err
+	}
+
+	klog.V(6).Infof("executing query plan %s", plan)
+	if plan.Range.Window <= 0 {
+		res, err := e.client.Query(ctx, ts, plan.Query)
+		if err == nil {
+			err = plan.Limits.checkResults(resultSize(res))
+		}
+		if err != nil {
+			return prom.QueryResult{}, err
+		}
+		return res, nil
+	}
+
+	step := plan.Range.Step
+	if step <= 0 {
+		step = DefaultRangeStep
+	}
+	res, err := e.client.QueryRange(ctx, prom.Range{Start: ts.Add(-plan.Range.Window), End: ts, Step: step}, plan.Query)
+	if err != nil {
+		return prom.QueryResult{}, err
+	}
+	if err := plan.Limits.checkResults(resultSize(res)); err != nil {
+		return prom.QueryResult{}, err
+	}
+	return reduceMatrix(res, plan.Range.Aggregation)
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queryplan
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+)
+
+func TestExecuteTracesPlans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	client := &fakeprom.FakePrometheusClient{
+		AcceptableInterval: pmodel.Interval{Start: 0, End: pmodel.Latest},
+		QueryResults: map[prom.Selector]prom.QueryResult{
+			"sum(queue_depth)": {Type: pmodel.ValVector, Vector: &pmodel.Vector{}},
+		},
+		ErrQueries: map[prom.Selector]error{
+			"sum(jobs_pending)": errors.New("query timed out"),
+		},
+	}
+	executor := NewExecutor(client)
+
+	_, err := executor.Execute(context.Background(), &Plan{Rule: "queues", Query: "sum(queue_depth)", Backend: "thanos"})
+	require.NoError(t, err)
+	_, err = executor.Execute(context.Background(), &Plan{Rule: "jobs", Query: "sum(jobs_pending)"})
+	require.Error(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	require.Equal(t, "Execute query plan", spans[0].Name())
+	require.Contains(t, spans[0].Attributes(), attribute.String("rule", "queues"))
+	require.Contains(t, spans[0].Attributes(), attribute.String("query", "sum(queue_depth)"))
+	require.Contains(t, spans[0].Attributes(), attribute.String("backend", "thanos"))
+	require.Equal(t, codes.Unset, spans[0].Status().Code)
+	require.Equal(t, codes.Error, spans[1].Status().Code)
+	require.Equal(t, "query timed out", spans[1].Status().Description)
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queryplan
+
+import (
+	"fmt"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// RangeAggregation is how the samples of each series returned by a range
+// query are reduced to a single value.
+type RangeAggregation string
+
+const (
+	// RangeLast keeps the most recent sample.
+	RangeLast RangeAggregation = "last"
+	// RangeAvg averages the samples.
+	RangeAvg RangeAggregation = "avg"
+	// RangeMax keeps the largest sample.
+	RangeMax RangeAggregation = "max"
+	// RangeMin keeps the smallest sample.
+	RangeMin RangeAggregation = "min"
+)
+
+// DefaultRangeStep is the resolution of range queries which don't specify one.
+const DefaultRangeStep = time.Minute
+
+// ParseRangeAggregation checks the given aggregation name, defaulting to RangeLast.
+func ParseRangeAggregation(name string) (RangeAggregation, error) {
+	switch agg := RangeAggregation(name); agg {
+	case "":
+		return RangeLast, nil
+	case RangeLast, RangeAvg, RangeMax, RangeMin:
+		return agg, nil
+	default:
+		return "", fmt.Errorf("unknown range aggregation %q, must be one of %q, %q, %q or %q", name, RangeLast, RangeAvg, RangeMax, RangeMin)
+	}
+}
+
+// Range describes a range query, ending at the evaluation time of the plan.
+// The samples of each series it returns are reduced to a single one, so that
+// its results can be handled like those of an instant query.
+type Range struct {
+	// Window is how far back the query goes.  If zero, an instant query
+	// is run instead.
+	Window time.Duration
+	// Step is the resolution of the query.
+	Step time.Duration
+	// Aggregation is how the samples of each series are reduced.
+	Aggregation RangeAggregation
+}
+
+// reduceMatrix reduces each series of the given range query results to a
+// single sample, timestamped with its most recent one.  Series without any
+// samples are dropped.
+func reduceMatrix(res prom.QueryResult, agg RangeAggregation) (prom.QueryResult, error) {
+	if res.Type != pmodel.ValMatrix || res.Matrix == nil {
+		return prom.QueryResult{}, fmt.Errorf("unexpected results from range query: expected %s, got %s", pmodel.ValMatrix, res.Type)
+	}
+
+	vector := make(pmodel.Vector, 0, len(*res.Matrix))
+	for _, stream := range *res.Matrix {
+		if len(stream.Values) == 0 {
+			continue
+		}
+
+		last := stream.Values[len(stream.Values)-1]
+		value := last.Value
+		for _, pair := range stream.Values[:len(stream.Values)-1] {
+			switch agg {
+			case RangeAvg:
+				value += pair.Value
+			case RangeMax:
+				if pair.Value > value {
+					value = pair.Value
+				}
+			case RangeMin:
+				if pair.Value < value {
+					value = pair.Value
+				}
+			}
+		}
+		if agg == RangeAvg {
+			value /= pmodel.SampleValue(len(stream.Values))
+		}
+
+		vector = append(vector, &pmodel.Sample{
+			Metric:    stream.Metric,
+			Value:     value,
+			Timestamp: last.Timestamp,
+		})
+	}
+
+	return prom.QueryResult{Type: pmodel.ValVector, Vector: &vector}, nil
+}
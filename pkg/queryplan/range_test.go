@@ -0,0 +1,88 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queryplan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+)
+
+func TestExecuteReducesRangeQueries(t *testing.T) {
+	query := prom.Selector(`sum(queue_depth) by (queue)`)
+	client := &fakeprom.FakePrometheusClient{
+		RangeQueryResults: map[prom.Selector]prom.QueryResult{
+			query: {
+				Type: pmodel.ValMatrix,
+				Matrix: &pmodel.Matrix{
+					{
+						Metric: pmodel.Metric{"queue": "orders"},
+						Values: []pmodel.SamplePair{
+							{Timestamp: 1000, Value: 4},
+							{Timestamp: 2000, Value: 8},
+							{Timestamp: 3000, Value: 3},
+						},
+					},
+					{
+						Metric: pmodel.Metric{"queue": "empty"},
+					},
+				},
+			},
+		},
+	}
+	executor := NewExecutor(client)
+
+	tests := map[RangeAggregation]pmodel.SampleValue{
+		RangeLast: 3,
+		RangeAvg:  5,
+		RangeMax:  8,
+		RangeMin:  3,
+	}
+	for agg, expected := range tests {
+		t.Run(string(agg), func(t *testing.T) {
+			res, err := executor.Execute(context.Background(), &Plan{
+				Query: query,
+				Time:  3000,
+				Range: Range{Window: 15 * time.Minute, Aggregation: agg},
+			})
+			require.NoError(t, err)
+			require.Equal(t, pmodel.ValVector, res.Type)
+			require.Equal(t, pmodel.Vector{
+				{Metric: pmodel.Metric{"queue": "orders"}, Value: expected, Timestamp: 3000},
+			}, *res.Vector)
+		})
+	}
+}
+
+func TestParseRangeAggregation(t *testing.T) {
+	agg, err := ParseRangeAggregation("")
+	require.NoError(t, err)
+	require.Equal(t, RangeLast, agg)
+
+	agg, err = ParseRangeAggregation("max")
+	require.NoError(t, err)
+	require.Equal(t, RangeMax, agg)
+
+	_, err = ParseRangeAggregation("median")
+	require.Error(t, err)
+}
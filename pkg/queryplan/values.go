@@ -0,0 +1,171 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queryplan
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	pmodel "github.com/prometheus/common/model"
+	"gopkg.in/inf.v0"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// unit is a unit of the values of Prometheus series, which are converted
+// into its base unit before being served.
+type unit struct {
+	// factor converts values into the base unit
+	factor float64
+	// format is the format of the quantities holding values of the base unit
+	format resource.Format
+}
+
+// units are the units known to NewValueConversion, by name.  Durations are
+// converted to seconds, sizes to bytes, and percentages to ratios.
+var units = map[string]unit{
+	"nanoseconds":  {factor: 1e-9, format: resource.DecimalSI},
+	"microseconds": {factor: 1e-6, format: resource.DecimalSI},
+	"milliseconds": {factor: 1e-3, format: resource.DecimalSI},
+	"seconds":      {factor: 1, format: resource.DecimalSI},
+	"minutes":      {factor: 60, format: resource.DecimalSI},
+	"hours":        {factor: 3600, format: resource.DecimalSI},
+	"bytes":        {factor: 1, format: resource.BinarySI},
+	"kilobytes":    {factor: 1e3, format: resource.BinarySI},
+	"megabytes":    {factor: 1e6, format: resource.BinarySI},
+	"gigabytes":    {factor: 1e9, format: resource.BinarySI},
+	"kibibytes":    {factor: 1 << 10, format: resource.BinarySI},
+	"mebibytes":    {factor: 1 << 20, format: resource.BinarySI},
+	"gibibytes":    {factor: 1 << 30, format: resource.BinarySI},
+	"percent":      {factor: 1e-2, format: resource.DecimalSI},
+}
+
+// ValueConversion converts the values returned by Prometheus into the
+// quantities served for a metric.  The zero value serves values as they are.
+type ValueConversion struct {
+	// Scale multiplies the values.  Zero leaves them unchanged.
+	Scale float64
+	// Format is the format of the quantities.  It defaults to DecimalSI.
+	Format resource.Format
+}
+
+// NewValueConversion returns the conversion scaling values by the given
+// factor, after converting them from the given unit into its base unit
+// (seconds, bytes, or ratios for percentages).  A zero scale and an empty unit
+// leave values unchanged.
+func NewValueConversion(scale float64, unitName string) (ValueConversion, error) {
+	if scale < 0 || math.IsInf(scale, 0) || math.IsNaN(scale) {
+		return ValueConversion{}, fmt.Errorf("invalid scale %v, must be positive", scale)
+	}
+	conv := ValueConversion{Scale: scale}
+	if unitName == "" {
+		return conv, nil
+	}
+
+	u, known := units[strings.ToLower(unitName)]
+	if !known {
+		names := make([]string, 0, len(units))
+		for name := range units {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return ValueConversion{}, fmt.Errorf("unknown unit %q, must be one of %s", unitName, strings.Join(names, ", "))
+	}
+	if conv.Scale == 0 {
+		conv.Scale = 1
+	}
+	conv.Scale *= u.factor
+	conv.Format = u.format
+	return conv, nil
+}
+
+// Quantity converts the given value (see NewQuantity).
+func (c ValueConversion) Quantity(value pmodel.SampleValue) *resource.Quantity {
+	format := c.Format
+	if format == "" {
+		format = resource.DecimalSI
+	}
+	if c.Scale != 0 {
+		value *= pmodel.SampleValue(c.Scale)
+	}
+	return NewQuantity(value, format)
+}
+
+// unscaledAt returns the unscaled value of dec at the given scale, if it's
+// exactly representable at that scale in an int64.
+func unscaledAt(dec *inf.Dec, scale inf.Scale) (int64, bool) {
+	if dec.Scale() > scale {
+		rounded := new(inf.Dec).Round(dec, scale, inf.RoundDown)
+		if rounded.Cmp(dec) != 0 {
+			return 0, false
+		}
+		dec = rounded
+	}
+	unscaled := new(big.Int).Mul(dec.UnscaledBig(), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale-dec.Scale())), nil))
+	if !unscaled.IsInt64() {
+		return 0, false
+	}
+	return unscaled.Int64(), true
+}
+
+// maxSuffixedValue is the magnitude from which values are formatted using
+// exponents, instead of SI suffixes.
+const maxSuffixedValue = 1e21
+
+// NewQuantity converts the given value into a quantity of the given format,
+// with nano precision, the finest precision quantities support.  Unlike
+// millis stored in an int64, it neither overflows with huge values, nor
+// rounds small ones (e.g. rates of rare events, or CPU usage below a
+// millicore) to zero.  Values below 0.5n are rounded to zero, and NaN and
+// infinite values, which quantities can't hold, are served as zero.
+func NewQuantity(value pmodel.SampleValue, format resource.Format) *resource.Quantity {
+	v := float64(value)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return resource.NewQuantity(0, format)
+	}
+
+	// the shortest decimal representation of the value doesn't carry the
+	// noise of its binary representation, e.g. 0.1 isn't 0.1000000000000000055
+	dec, ok := new(inf.Dec).SetString(strconv.FormatFloat(v, 'f', -1, 64))
+	if !ok {
+		// the representation of a finite value is always valid
+		return resource.NewQuantity(0, format)
+	}
+	dec.Round(dec, 9, inf.RoundHalfUp)
+
+	// keep the int64 representation of quantities which fit in it, preferring
+	// millis, like most quantities
+	if millis, exact := unscaledAt(dec, 3); exact {
+		return resource.NewMilliQuantity(millis, format)
+	}
+	if nanos, exact := unscaledAt(dec, 9); exact {
+		q := resource.NewScaledQuantity(nanos, resource.Nano)
+		q.Format = format
+		return q
+	}
+
+	if math.Abs(v) >= maxSuffixedValue {
+		// SI suffixes stop at E, and larger powers of 10 lose their exponent
+		// when formatted with them, so 1e21 would be served as 1
+		format = resource.DecimalExponent
+	}
+	return resource.NewDecimalQuantity(*dec, format)
+}
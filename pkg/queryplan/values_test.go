@@ -0,0 +1,92 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queryplan
+
+import (
+	"math"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestValueConversion(t *testing.T) {
+	tests := []struct {
+		name     string
+		scale    float64
+		unit     string
+		value    pmodel.SampleValue
+		expected string
+	}{
+		{name: "unchanged", value: 1.5, expected: "1500m"},
+		{name: "milliseconds to seconds", unit: "milliseconds", value: 250, expected: "250m"},
+		{name: "mebibytes to bytes", unit: "MebiBytes", value: 128, expected: "128Mi"},
+		{name: "bytes", unit: "bytes", value: 1024, expected: "1Ki"},
+		{name: "percent to ratio", unit: "percent", value: 75, expected: "750m"},
+		{name: "scale", scale: 0.001, value: 2000, expected: "2"},
+		{name: "scale after unit", scale: 2, unit: "kibibytes", value: 1, expected: "2Ki"},
+		{name: "NaN", unit: "milliseconds", value: pmodel.SampleValue(math.NaN()), expected: "0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conv, err := NewValueConversion(test.scale, test.unit)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, conv.Quantity(test.value).String())
+		})
+	}
+}
+
+func TestValueConversionRejectsInvalidSettings(t *testing.T) {
+	_, err := NewValueConversion(0, "furlongs")
+	require.ErrorContains(t, err, `unknown unit "furlongs"`)
+
+	_, err = NewValueConversion(-1, "")
+	require.Error(t, err)
+}
+
+func TestNewQuantity(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    pmodel.SampleValue
+		format   resource.Format
+		expected string
+	}{
+		{name: "integer", value: 42, format: resource.DecimalSI, expected: "42"},
+		{name: "millis", value: 1.5, format: resource.DecimalSI, expected: "1500m"},
+		{name: "negative", value: -0.25, format: resource.DecimalSI, expected: "-250m"},
+		{name: "below a milli", value: 0.0000025, format: resource.DecimalSI, expected: "2500n"},
+		{name: "nano", value: 1e-9, format: resource.DecimalSI, expected: "1n"},
+		{name: "rounded up to a nano", value: 5e-10, format: resource.DecimalSI, expected: "1n"},
+		{name: "below half a nano", value: 4e-10, format: resource.DecimalSI, expected: "0"},
+		{name: "no binary noise", value: 0.1, format: resource.DecimalSI, expected: "100m"},
+		{name: "above int64 millis", value: 1e17, format: resource.DecimalSI, expected: "100P"},
+		{name: "above int64", value: 1e22, format: resource.DecimalSI, expected: "10e21"},
+		{name: "above int64 in binary", value: 1e21, format: resource.BinarySI, expected: "1e21"},
+		{name: "largest int64", value: math.MaxInt64, format: resource.DecimalSI, expected: "9223372036854776k"},
+		{name: "binary", value: 128 * 1024 * 1024, format: resource.BinarySI, expected: "128Mi"},
+		{name: "fractional binary", value: 1.5, format: resource.BinarySI, expected: "1500m"},
+		{name: "NaN", value: pmodel.SampleValue(math.NaN()), format: resource.DecimalSI, expected: "0"},
+		{name: "infinity", value: pmodel.SampleValue(math.Inf(1)), format: resource.DecimalSI, expected: "0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, NewQuantity(test.value, test.format).String())
+		})
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resourceprovider
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	// partialPods is the number of pods whose usage was reported
+	// although the usage of one of their resources was missing, by resource.
+	partialPods = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: "prometheus_adapter",
+			Subsystem: "resource_metrics",
+			Name:      "partial_pod_metrics_total",
+			Help:      "Number of pods whose usage was reported although the usage of one of their resources was missing, by missing resource",
+		},
+		[]string{"resource"},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers the resource provider metrics with the legacy
+// registry, which is served on the adapter's /metrics endpoint.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(partialPods)
+	})
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resourceprovider
+
+import (
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/utils/clock"
+
+	"sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+)
+
+// Options configures a resource metrics provider (see NewProvider).  Client,
+// Mapper and Rules are required.  The zero value of the other fields disables
+// the feature they configure, unless documented otherwise.
+//
+// The provider logs through klog, which can be redirected with klog.SetLogger.
+type Options struct {
+	// Client is the Prometheus client the resource metrics are queried with.
+	Client client.Client
+	// Mapper maps the resources the series are associated with to Kubernetes kinds.
+	Mapper apimeta.RESTMapper
+	// Rules are the rules the resource metrics are queried with.
+	Rules *config.ResourceRules
+	// Cluster, if set, restricts the queries to the series of the given
+	// cluster, for Prometheus servers holding the series of several clusters.
+	Cluster *naming.Cluster
+
+	// QueryTimeout, if positive, bounds the duration of each query.
+	QueryTimeout time.Duration
+	// Clock gives the time at which the resource metrics are queried.  It
+	// defaults to the real clock.
+	Clock clock.PassiveClock
+	// TerminatingPods is how the usage of pods being deleted is reported.  It
+	// defaults to TerminatingPodsServe.
+	TerminatingPods TerminatingPodsPolicy
+	// PartialPodMetrics reports the usage of pods for which only one of CPU
+	// and memory usage is known, without the other, instead of leaving them
+	// out.  Their metrics are annotated with
+	// MissingUsageAnnotation.
+	PartialPodMetrics bool
+}
+
+// TerminatingPodsPolicy is how the usage of pods being deleted is reported.
+// Their samples may linger in Prometheus after their containers were killed,
+// until they're marked stale.  Pods in terminal phases aren't listed by the
+// resource metrics API, and so never reach the provider.
+type TerminatingPodsPolicy string
+
+const (
+	// TerminatingPodsServe reports their usage like for any other pod.
+	TerminatingPodsServe TerminatingPodsPolicy = "serve"
+	// TerminatingPodsSkip leaves them out of the results.
+	TerminatingPodsSkip TerminatingPodsPolicy = "skip"
+	// TerminatingPodsZero reports zero usage for their containers.
+	TerminatingPodsZero TerminatingPodsPolicy = "zero"
+)
+
+const (
+	// TerminatingAnnotation is set, to "true", on the metrics reported for
+	// pods being deleted, whatever the TerminatingPodsPolicy.
+	TerminatingAnnotation = "metrics.sigs.k8s.io/pod-terminating"
+	// MissingUsageAnnotation names the resource whose usage is missing from
+	// the metrics reported for a pod, and left out of the usage of its
+	// containers (see Options.PartialPodMetrics).
+	MissingUsageAnnotation = "metrics.sigs.k8s.io/missing-usage"
+)
@@ -20,6 +20,10 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"net"
+	"regexp"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
@@ -31,12 +35,15 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/klog/v2"
 	metrics "k8s.io/metrics/pkg/apis/metrics"
+	"k8s.io/utils/clock"
 
 	"sigs.k8s.io/metrics-server/pkg/api"
 
 	"sigs.k8s.io/prometheus-adapter/pkg/client"
 	"sigs.k8s.io/prometheus-adapter/pkg/config"
 	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+	"sigs.k8s.io/prometheus-adapter/pkg/queryplan"
+	"sigs.k8s.io/prometheus-adapter/pkg/staleness"
 
 	pmodel "github.com/prometheus/common/model"
 )
@@ -46,21 +53,34 @@ var (
 	podResource  = schema.GroupResource{Resource: "pods"}
 )
 
-// TODO(directxman12): consider support for nanocore values -- adjust scale if less than 1 millicore, or greater than max int64
+// sandboxContainerName is the name cAdvisor gives to the pause container of pods.
+const sandboxContainerName = "POD"
 
 // newResourceQuery instantiates query information from the give configuration rule for querying
 // resource metrics for some resource.
-func newResourceQuery(cfg config.ResourceRule, mapper apimeta.RESTMapper) (resourceQuery, error) {
+// The given query options apply to both queries, and the node options only to the node query.
+func newResourceQuery(cfg config.ResourceRule, defaultWindow pmodel.Duration, mapper apimeta.RESTMapper, queryOpts []naming.MetricsQueryOption, nodeOpts ...naming.MetricsQueryOption) (resourceQuery, error) {
 	converter, err := naming.NewResourceConverter(cfg.Resources.Template, cfg.Resources.Overrides, mapper)
 	if err != nil {
 		return resourceQuery{}, fmt.Errorf("unable to construct label-resource converter: %v", err)
 	}
 
-	contQuery, err := naming.NewMetricsQuery(cfg.ContainerQuery, converter)
+	window := time.Duration(cfg.Window)
+	if window == 0 {
+		window = time.Duration(defaultWindow)
+	}
+	contWindow, nodeWindow := window, window
+	if window == 0 {
+		contWindow, nodeWindow = queryRange(cfg.ContainerQuery), queryRange(cfg.NodeQuery)
+	}
+
+	contOpts := append([]naming.MetricsQueryOption{naming.WithWindow(contWindow)}, queryOpts...)
+	contQuery, err := naming.NewMetricsQuery(cfg.ContainerQuery, converter, contOpts...)
 	if err != nil {
 		return resourceQuery{}, fmt.Errorf("unable to construct container metrics query: %v", err)
 	}
-	nodeQuery, err := naming.NewMetricsQuery(cfg.NodeQuery, converter)
+	nodeOpts = append(append([]naming.MetricsQueryOption{naming.WithWindow(nodeWindow)}, queryOpts...), nodeOpts...)
+	nodeQuery, err := naming.NewMetricsQuery(cfg.NodeQuery, converter, nodeOpts...)
 	if err != nil {
 		return resourceQuery{}, fmt.Errorf("unable to construct node metrics query: %v", err)
 	}
@@ -70,9 +90,30 @@ func newResourceQuery(cfg config.ResourceRule, mapper apimeta.RESTMapper) (resou
 		contQuery:      contQuery,
 		nodeQuery:      nodeQuery,
 		containerLabel: cfg.ContainerLabel,
+		contWindow:     contWindow,
+		nodeWindow:     nodeWindow,
 	}, nil
 }
 
+// rangeSelectorRegexp matches the range of a range vector selector or subquery,
+// e.g. `[5m]` or `[1h:1m]`.
+var rangeSelectorRegexp = regexp.MustCompile(`\[((?:[0-9]+(?:ms|[smhdwy]))+)(?::[^\]]*)?\]`)
+
+// queryRange returns the range of the first range selector of the given
+// query template (e.g. 2m for `rate(cpu_seconds_total[2m])`), or zero if
+// there's none.
+func queryRange(queryTemplate string) time.Duration {
+	match := rangeSelectorRegexp.FindStringSubmatch(queryTemplate)
+	if match == nil {
+		return 0
+	}
+	window, err := pmodel.ParseDuration(match[1])
+	if err != nil {
+		return 0
+	}
+	return time.Duration(window)
+}
+
 // resourceQuery represents query information for querying resource metrics for some resource,
 // like CPU or memory.
 type resourceQuery struct {
@@ -80,35 +121,199 @@ type resourceQuery struct {
 	contQuery      naming.MetricsQuery
 	nodeQuery      naming.MetricsQuery
 	containerLabel string
+	// contWindow and nodeWindow are the windows over which the container
+	// and node queries compute their values, or zero for instant values
+	contWindow time.Duration
+	nodeWindow time.Duration
 }
 
-// NewProvider constructs a new MetricsProvider to provide resource metrics from Prometheus using the given rules.
-func NewProvider(prom client.Client, mapper apimeta.RESTMapper, cfg *config.ResourceRules) (api.MetricsGetter, error) {
-	cpuQuery, err := newResourceQuery(cfg.CPU, mapper)
+// NewProvider constructs a new MetricsProvider to provide resource metrics from
+// Prometheus, configured by the given options.
+func NewProvider(opts Options) (api.MetricsGetter, error) {
+	cfg, mapper := opts.Rules, opts.Mapper
+	if cfg == nil {
+		return nil, fmt.Errorf("no resource rules given")
+	}
+	registerMetrics()
+	clk := opts.Clock
+	if clk == nil {
+		clk = clock.RealClock{}
+	}
+
+	var queryOpts []naming.MetricsQueryOption
+	if opts.Cluster != nil {
+		if err := opts.Cluster.Validate(); err != nil {
+			return nil, err
+		}
+		queryOpts = append(queryOpts, naming.WithClusterMatcher(*opts.Cluster))
+	}
+
+	terminatingPods := opts.TerminatingPods
+	switch terminatingPods {
+	case "":
+		terminatingPods = TerminatingPodsServe
+	case TerminatingPodsServe, TerminatingPodsSkip, TerminatingPodsZero:
+	default:
+		return nil, fmt.Errorf("unknown terminating pods policy %q, must be one of %s, %s or %s", terminatingPods,
+			TerminatingPodsServe, TerminatingPodsSkip, TerminatingPodsZero)
+	}
+
+	var nodeOpts []naming.MetricsQueryOption
+	switch cfg.NodeIdentifier {
+	case "", config.NodeIdentifierName, config.NodeIdentifierProviderID:
+	case config.NodeIdentifierInternalIP:
+		// addresses may be followed by a port, so they're matched with regular expressions
+		nodeOpts = append(nodeOpts, naming.WithNamePatterns())
+	default:
+		return nil, fmt.Errorf("unknown node identifier %q, must be one of %s, %s or %s", cfg.NodeIdentifier,
+			config.NodeIdentifierName, config.NodeIdentifierInternalIP, config.NodeIdentifierProviderID)
+	}
+
+	cpuQuery, err := newResourceQuery(cfg.CPU, cfg.Window, mapper, queryOpts, nodeOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct querier for CPU metrics: %v", err)
 	}
-	memQuery, err := newResourceQuery(cfg.Memory, mapper)
+	memQuery, err := newResourceQuery(cfg.Memory, cfg.Window, mapper, queryOpts, nodeOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct querier for memory metrics: %v", err)
 	}
 
+	extra := make(map[corev1.ResourceName]resourceQuery, len(cfg.ExtraResources))
+	for name, rule := range cfg.ExtraResources {
+		resourceName := corev1.ResourceName(name)
+		if resourceName == corev1.ResourceCPU || resourceName == corev1.ResourceMemory {
+			return nil, fmt.Errorf("the rules for %s metrics must be given in the %s field, not in extraResources", name, name)
+		}
+		extra[resourceName], err = newResourceQuery(rule, cfg.Window, mapper, queryOpts, nodeOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct querier for %s metrics: %v", name, err)
+		}
+	}
+
+	variants := make([]resourceVariant, 0, len(cfg.Variants))
+	for i, variantCfg := range cfg.Variants {
+		if len(variantCfg.NodeSelector) == 0 {
+			return nil, fmt.Errorf("resource rules variant %d must have a node selector", i)
+		}
+		window := variantCfg.Window
+		if window == 0 {
+			window = cfg.Window
+		}
+		variant := resourceVariant{nodeSelector: labels.SelectorFromSet(variantCfg.NodeSelector)}
+		variant.cpu, err = newResourceQuery(variantCfg.CPU, window, mapper, queryOpts, nodeOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct querier for CPU metrics of variant %s: %v", variant.nodeSelector, err)
+		}
+		variant.mem, err = newResourceQuery(variantCfg.Memory, window, mapper, queryOpts, nodeOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct querier for memory metrics of variant %s: %v", variant.nodeSelector, err)
+		}
+		variants = append(variants, variant)
+	}
+
 	return &resourceProvider{
-		prom:   prom,
-		cpu:    cpuQuery,
-		mem:    memQuery,
-		window: time.Duration(cfg.Window),
+		executor:       queryplan.NewExecutor(client.WithQueryTimeout(opts.Client, opts.QueryTimeout)),
+		clock:          clk,
+		cpu:            cpuQuery,
+		mem:            memQuery,
+		extra:          extra,
+		variants:       variants,
+		nodeIdentifier: cfg.NodeIdentifier,
+
+		terminatingPods:   terminatingPods,
+		partialPodMetrics: opts.PartialPodMetrics,
 	}, nil
 }
 
 // resourceProvider is a MetricsProvider that contacts Prometheus to provide
 // the resource metrics.
 type resourceProvider struct {
-	prom client.Client
+	executor *queryplan.Executor
+	clock    clock.PassiveClock
 
 	cpu, mem resourceQuery
 
-	window time.Duration
+	// extra holds the queries for resources other than CPU and memory, if any
+	extra map[corev1.ResourceName]resourceQuery
+
+	// variants are the alternative queries for some nodes, if any
+	variants []resourceVariant
+
+	// nodeIdentifier is what node queries identify nodes by
+	nodeIdentifier config.NodeIdentifier
+
+	// terminatingPods is how the usage of pods being deleted is reported
+	terminatingPods TerminatingPodsPolicy
+	// partialPodMetrics reports pods missing either CPU or memory usage
+	partialPodMetrics bool
+}
+
+// nodeID returns the value identifying the given node in the results of node queries.
+func (p *resourceProvider) nodeID(node *corev1.Node) (string, error) {
+	switch p.nodeIdentifier {
+	case config.NodeIdentifierInternalIP:
+		for _, addr := range node.Status.Addresses {
+			if addr.Type == corev1.NodeInternalIP {
+				return addr.Address, nil
+			}
+		}
+		return "", fmt.Errorf("node has no internal IP address")
+	case config.NodeIdentifierProviderID:
+		if node.Spec.ProviderID == "" {
+			return "", fmt.Errorf("node has no provider ID")
+		}
+		return node.Spec.ProviderID, nil
+	default:
+		return node.Name, nil
+	}
+}
+
+// nodeQueryName returns the value to query for to find the results of the
+// node with the given ID.
+func (p *resourceProvider) nodeQueryName(id string) string {
+	if p.nodeIdentifier == config.NodeIdentifierInternalIP {
+		return regexp.QuoteMeta(id) + "(:[0-9]+)?"
+	}
+	return id
+}
+
+// nodeIDForLabel returns the ID of the node the given value of the node
+// label of node queries refers to.
+func (p *resourceProvider) nodeIDForLabel(value string) string {
+	if p.nodeIdentifier == config.NodeIdentifierInternalIP {
+		if host, _, err := net.SplitHostPort(value); err == nil {
+			return host
+		}
+	}
+	return value
+}
+
+// resourceVariant holds the queries used for the nodes matching a selector,
+// instead of the default ones.
+type resourceVariant struct {
+	nodeSelector labels.Selector
+	cpu, mem     resourceQuery
+}
+
+// variantFor returns the variant of the queries applying to the given node,
+// or nil if the default queries apply.
+func (p *resourceProvider) variantFor(node *corev1.Node) *resourceVariant {
+	for i := range p.variants {
+		if p.variants[i].nodeSelector.Matches(labels.Set(node.Labels)) {
+			return &p.variants[i]
+		}
+	}
+	return nil
+}
+
+// reportedWindow returns the window reported for metrics computed using
+// the given CPU and memory windows.  Like metrics-server, this is the CPU
+// window, since memory usage is usually an instant value.
+func reportedWindow(cpuWindow, memWindow time.Duration) time.Duration {
+	if cpuWindow > 0 {
+		return cpuWindow
+	}
+	return memWindow
 }
 
 // nsQueryResults holds the results of one set
@@ -117,13 +322,20 @@ type resourceProvider struct {
 type nsQueryResults struct {
 	namespace string
 	cpu, mem  queryResults
-	err       error
+	// extra holds the results of the queries for other resources
+	extra map[corev1.ResourceName]queryResults
+	err   error
 }
 
 // GetPodMetrics implements the api.MetricsProvider interface.
 func (p *resourceProvider) GetPodMetrics(pods ...*metav1.PartialObjectMetadata) ([]metrics.PodMetrics, error) {
 	resMetrics := make([]metrics.PodMetrics, 0, len(pods))
 
+	if p.terminatingPods == TerminatingPodsSkip {
+		pods = slices.DeleteFunc(slices.Clone(pods), func(pod *metav1.PartialObjectMetadata) bool {
+			return pod.DeletionTimestamp != nil
+		})
+	}
 	if len(pods) == 0 {
 		return resMetrics, nil
 	}
@@ -138,7 +350,7 @@ func (p *resourceProvider) GetPodMetrics(pods ...*metav1.PartialObjectMetadata)
 	}
 
 	// actually fetch the results for each namespace
-	now := pmodel.Now()
+	now := pmodel.TimeFromUnixNano(p.clock.Now().UnixNano())
 	resChan := make(chan nsQueryResults, len(podsByNs))
 	var wg sync.WaitGroup
 	wg.Add(len(podsByNs))
@@ -146,7 +358,7 @@ func (p *resourceProvider) GetPodMetrics(pods ...*metav1.PartialObjectMetadata)
 	for ns, podNames := range podsByNs {
 		go func(ns string, podNames []string) {
 			defer wg.Done()
-			resChan <- p.queryBoth(now, podResource, ns, podNames...)
+			resChan <- p.queryPods(now, ns, podNames...)
 		}(ns, podNames)
 	}
 
@@ -167,9 +379,13 @@ func (p *resourceProvider) GetPodMetrics(pods ...*metav1.PartialObjectMetadata)
 	// together by namespace, pod, and container
 	for _, pod := range pods {
 		podMetric := p.assignForPod(pod, resultsByNs)
-		if podMetric != nil {
-			resMetrics = append(resMetrics, *podMetric)
+		if podMetric == nil {
+			continue
+		}
+		if pod.DeletionTimestamp != nil {
+			p.markTerminating(podMetric)
 		}
+		resMetrics = append(resMetrics, *podMetric)
 	}
 
 	return resMetrics, nil
@@ -178,7 +394,9 @@ func (p *resourceProvider) GetPodMetrics(pods ...*metav1.PartialObjectMetadata)
 // assignForPod takes the resource metrics for all containers in the given pod
 // from resultsByNs, and places them in MetricsProvider response format in resMetrics,
 // also recording the earliest time in resTime.  It will return without operating if
-// any data is missing.
+// any data is missing, unless partial pod metrics are enabled and only one of CPU
+// and memory usage is, in which case that resource is left out of the usage of
+// the containers.
 func (p *resourceProvider) assignForPod(pod *metav1.PartialObjectMetadata, resultsByNs map[string]nsQueryResults) *metrics.PodMetrics {
 	// check to make sure everything is present
 	nsRes, nsResPresent := resultsByNs[pod.Namespace]
@@ -186,15 +404,25 @@ func (p *resourceProvider) assignForPod(pod *metav1.PartialObjectMetadata, resul
 		klog.Errorf("unable to fetch metrics for pods in namespace %q, skipping pod %s", pod.Namespace, pod.String())
 		return nil
 	}
-	cpuRes, hasResult := nsRes.cpu[pod.Name]
-	if !hasResult {
+	cpuRes, hasCPU := nsRes.cpu[pod.Name]
+	memRes, hasMemory := nsRes.mem[pod.Name]
+	// the resource missing from the results, if any, is left out of the usage
+	var missing corev1.ResourceName
+	switch {
+	case !hasCPU && (!hasMemory || !p.partialPodMetrics):
 		klog.Errorf("unable to fetch CPU metrics for pod %s, skipping", pod.String())
 		return nil
-	}
-	memRes, hasResult := nsRes.mem[pod.Name]
-	if !hasResult {
+	case !hasMemory && !p.partialPodMetrics:
 		klog.Errorf("unable to fetch memory metrics for pod %s, skipping", pod.String())
 		return nil
+	case !hasCPU:
+		missing = corev1.ResourceCPU
+	case !hasMemory:
+		missing = corev1.ResourceMemory
+	}
+	if missing != "" {
+		klog.V(2).Infof("unable to fetch %s metrics for pod %s/%s, reporting its other usage only", missing, pod.Namespace, pod.Name)
+		partialPods.WithLabelValues(string(missing)).Inc()
 	}
 
 	containerMetrics := make(map[string]metrics.ContainerMetrics)
@@ -209,7 +437,7 @@ func (p *resourceProvider) assignForPod(pod *metav1.PartialObjectMetadata, resul
 				Usage: corev1.ResourceList{},
 			}
 		}
-		containerMetrics[containerName].Usage[corev1.ResourceCPU] = *resource.NewMilliQuantity(int64(cpu.Value*1000.0), resource.DecimalSI)
+		containerMetrics[containerName].Usage[corev1.ResourceCPU] = usageQuantity(corev1.ResourceCPU, cpu.Value)
 		if cpu.Timestamp.Before(earliestTS) {
 			earliestTS = cpu.Timestamp
 		}
@@ -224,20 +452,50 @@ func (p *resourceProvider) assignForPod(pod *metav1.PartialObjectMetadata, resul
 				Usage: corev1.ResourceList{},
 			}
 		}
-		containerMetrics[containerName].Usage[corev1.ResourceMemory] = *resource.NewMilliQuantity(int64(mem.Value*1000.0), resource.BinarySI)
+		containerMetrics[containerName].Usage[corev1.ResourceMemory] = usageQuantity(corev1.ResourceMemory, mem.Value)
 		if mem.Timestamp.Before(earliestTS) {
 			earliestTS = mem.Timestamp
 		}
 	}
 
-	// check for any containers that have either memory usage or CPU usage, but not both
+	// organize the results for other resources, if any
+	for resourceName, extraRes := range nsRes.extra {
+		containerLabel := pmodel.LabelName(p.extra[resourceName].containerLabel)
+		for _, sample := range extraRes[pod.Name] {
+			containerName := string(sample.Metric[containerLabel])
+			if _, present := containerMetrics[containerName]; !present {
+				containerMetrics[containerName] = metrics.ContainerMetrics{
+					Name:  containerName,
+					Usage: corev1.ResourceList{},
+				}
+			}
+			containerMetrics[containerName].Usage[resourceName] = usageQuantity(resourceName, sample.Value)
+			if sample.Timestamp.Before(earliestTS) {
+				earliestTS = sample.Timestamp
+			}
+		}
+	}
+
+	// like metrics-server, only report the containers of the pod, so that
+	// ContainerResource metrics find them by name, and Resource metrics,
+	// which sum them, don't count anything twice: the pause container isn't
+	// one of them, and series without a container name hold the totals of the
+	// pod, unless the queries don't tell containers apart at all
+	delete(containerMetrics, sandboxContainerName)
+	if len(containerMetrics) > 1 {
+		delete(containerMetrics, "")
+	}
+
+	// check for any containers that are missing memory usage or CPU usage (e.g. containers
+	// only found in the results for other resources).  The resource missing for
+	// the whole pod stays missing, rather than reported as a zero usage, so that
+	// the HPA treats the pod as having no metrics for it instead of as idle.
 	for _, containerMetric := range containerMetrics {
-		_, hasMemory := containerMetric.Usage[corev1.ResourceMemory]
-		_, hasCPU := containerMetric.Usage[corev1.ResourceCPU]
-		if hasMemory && !hasCPU {
-			containerMetric.Usage[corev1.ResourceCPU] = *resource.NewMilliQuantity(int64(0), resource.BinarySI)
-		} else if hasCPU && !hasMemory {
-			containerMetric.Usage[corev1.ResourceMemory] = *resource.NewMilliQuantity(int64(0), resource.BinarySI)
+		if _, hasCPU := containerMetric.Usage[corev1.ResourceCPU]; !hasCPU && missing != corev1.ResourceCPU {
+			containerMetric.Usage[corev1.ResourceCPU] = usageQuantity(corev1.ResourceCPU, 0)
+		}
+		if _, hasMemory := containerMetric.Usage[corev1.ResourceMemory]; !hasMemory && missing != corev1.ResourceMemory {
+			containerMetric.Usage[corev1.ResourceMemory] = usageQuantity(corev1.ResourceMemory, 0)
 		}
 	}
 
@@ -250,7 +508,15 @@ func (p *resourceProvider) assignForPod(pod *metav1.PartialObjectMetadata, resul
 		},
 		// store the time in the final format
 		Timestamp: metav1.NewTime(earliestTS.Time()),
-		Window:    metav1.Duration{Duration: p.window},
+		Window:    metav1.Duration{Duration: reportedWindow(p.cpu.contWindow, p.mem.contWindow)},
+	}
+
+	if missing != "" {
+		annotate(podMetric, MissingUsageAnnotation, string(missing))
+	}
+
+	if earliestTS != pmodel.Latest {
+		staleness.Observe(staleness.ResourceAPI, earliestTS.Time())
 	}
 
 	// store the container metrics in the final format
@@ -258,10 +524,35 @@ func (p *resourceProvider) assignForPod(pod *metav1.PartialObjectMetadata, resul
 	for _, containerMetric := range containerMetrics {
 		podMetric.Containers = append(podMetric.Containers, containerMetric)
 	}
+	sort.Slice(podMetric.Containers, func(i, j int) bool {
+		return podMetric.Containers[i].Name < podMetric.Containers[j].Name
+	})
 
 	return podMetric
 }
 
+// markTerminating annotates the metrics of a pod being deleted, and zeroes its
+// usage if requested, since its samples may outlive its containers.
+func (p *resourceProvider) markTerminating(podMetric *metrics.PodMetrics) {
+	annotate(podMetric, TerminatingAnnotation, "true")
+	if p.terminatingPods != TerminatingPodsZero {
+		return
+	}
+	for _, container := range podMetric.Containers {
+		for resourceName := range container.Usage {
+			container.Usage[resourceName] = usageQuantity(resourceName, 0)
+		}
+	}
+}
+
+// annotate sets the given annotation on the metrics of a pod.
+func annotate(podMetric *metrics.PodMetrics, key, value string) {
+	if podMetric.Annotations == nil {
+		podMetric.Annotations = make(map[string]string, 1)
+	}
+	podMetric.Annotations[key] = value
+}
+
 // GetNodeMetrics implements the api.MetricsProvider interface.
 func (p *resourceProvider) GetNodeMetrics(nodes ...*corev1.Node) ([]metrics.NodeMetrics, error) {
 	resMetrics := make([]metrics.NodeMetrics, 0, len(nodes))
@@ -270,30 +561,70 @@ func (p *resourceProvider) GetNodeMetrics(nodes ...*corev1.Node) ([]metrics.Node
 		return resMetrics, nil
 	}
 
-	now := pmodel.Now()
-	nodeNames := make([]string, 0, len(nodes))
-	for _, node := range nodes {
-		nodeNames = append(nodeNames, node.Name)
+	now := pmodel.TimeFromUnixNano(p.clock.Now().UnixNano())
+
+	// find out how the nodes are identified in the queries, and group them
+	// by the variant of the queries applying to them
+	nodeIDs := make([]string, len(nodes))
+	nodeVariants := make([]*resourceVariant, len(nodes))
+	var queryNames, defaultNames []string
+	namesByVariant := make(map[*resourceVariant][]string)
+	for i, node := range nodes {
+		id, err := p.nodeID(node)
+		if err != nil {
+			klog.V(1).Infof("unable to identify node %q in queries, skipping: %v", node.Name, err)
+			continue
+		}
+		nodeIDs[i] = id
+		name := p.nodeQueryName(id)
+		queryNames = append(queryNames, name)
+		if variant := p.variantFor(node); variant != nil {
+			nodeVariants[i] = variant
+			namesByVariant[variant] = append(namesByVariant[variant], name)
+		} else {
+			defaultNames = append(defaultNames, name)
+		}
 	}
-
-	// run the actual query
-	qRes := p.queryBoth(now, nodeResource, "", nodeNames...)
-	if qRes.err != nil {
-		klog.Errorf("failed querying node metrics: %v", qRes.err)
+	if len(queryNames) == 0 {
 		return resMetrics, nil
 	}
 
+	// run the actual queries
+	qRes := nsQueryResults{cpu: queryResults{}, mem: queryResults{}}
+	if len(defaultNames) > 0 {
+		res := p.queryBoth(now, p.cpu, p.mem, nodeResource, "", defaultNames...)
+		if res.err != nil {
+			klog.Errorf("failed querying node metrics: %v", res.err)
+			return resMetrics, nil
+		}
+		qRes.merge(res)
+	}
+	for variant, names := range namesByVariant {
+		res := p.queryBoth(now, variant.cpu, variant.mem, nodeResource, "", names...)
+		if res.err != nil {
+			klog.Errorf("failed querying metrics of nodes matching %s: %v", variant.nodeSelector, res.err)
+			continue
+		}
+		qRes.merge(res)
+	}
+
+	qRes.extra = p.queryExtra(now, nodeResource, "", queryNames...)
+
 	// organize the results
-	for i, nodeName := range nodeNames {
+	for i, node := range nodes {
+		nodeID := nodeIDs[i]
+		if nodeID == "" {
+			continue
+		}
 		// skip if any data is missing
-		rawCPUs, gotResult := qRes.cpu[nodeName]
+		rawCPUs, gotResult := qRes.cpu[nodeID]
 		if !gotResult {
-			klog.V(1).Infof("missing CPU for node %q, skipping", nodeName)
+			klog.V(1).Infof("missing CPU for node %q, skipping", node.Name)
 			continue
 		}
-		rawMems, gotResult := qRes.mem[nodeName]
+		rawMems, gotResult := qRes.mem[nodeID]
 		if !gotResult {
-			klog.V(1).Infof("missing memory for node %q, skipping", nodeName)
+			klog.V(1).Infof("missing memory for node %q, skipping", node.Name)
 			continue
 		}
 
@@ -306,30 +637,98 @@ func (p *resourceProvider) GetNodeMetrics(nodes ...*corev1.Node) ([]metrics.Node
 		if ts.After(rawMem.Timestamp.Time()) {
 			ts = rawMem.Timestamp.Time()
 		}
+		usage := corev1.ResourceList{
+			corev1.ResourceCPU:    usageQuantity(corev1.ResourceCPU, rawCPU.Value),
+			corev1.ResourceMemory: usageQuantity(corev1.ResourceMemory, rawMem.Value),
+		}
+		for resourceName, extraRes := range qRes.extra {
+			if rawExtras, gotResult := extraRes[nodeID]; gotResult {
+				usage[resourceName] = usageQuantity(resourceName, rawExtras[0].Value)
+				if ts.After(rawExtras[0].Timestamp.Time()) {
+					ts = rawExtras[0].Timestamp.Time()
+				}
+			}
+		}
+		staleness.Observe(staleness.ResourceAPI, ts)
+
+		window := reportedWindow(p.cpu.nodeWindow, p.mem.nodeWindow)
+		if variant := nodeVariants[i]; variant != nil {
+			window = reportedWindow(variant.cpu.nodeWindow, variant.mem.nodeWindow)
+		}
 
 		// store the results
 		resMetrics = append(resMetrics, metrics.NodeMetrics{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:              nodes[i].Name,
-				Labels:            nodes[i].Labels,
+				Name:              node.Name,
+				Labels:            node.Labels,
 				CreationTimestamp: metav1.Now(),
 			},
-			Usage: corev1.ResourceList{
-				corev1.ResourceCPU:    *resource.NewMilliQuantity(int64(rawCPU.Value*1000.0), resource.DecimalSI),
-				corev1.ResourceMemory: *resource.NewMilliQuantity(int64(rawMem.Value*1000.0), resource.BinarySI),
-			},
+			Usage:     usage,
 			Timestamp: metav1.NewTime(ts),
-			Window:    metav1.Duration{Duration: p.window},
+			Window:    metav1.Duration{Duration: window},
 		})
 	}
 
 	return resMetrics, nil
 }
 
+// queryPods queries for both CPU and memory metrics of the given pods.
+// Since the node a pod runs on isn't known, the queries of all variants are
+// run, and the results of the variants fill in the pods missing from the
+// results of the default queries.
+func (p *resourceProvider) queryPods(now pmodel.Time, namespace string, names ...string) nsQueryResults {
+	res := p.queryBoth(now, p.cpu, p.mem, podResource, namespace, names...)
+	if res.err != nil {
+		return res
+	}
+	res.extra = p.queryExtra(now, podResource, namespace, names...)
+	if len(p.variants) == 0 {
+		return res
+	}
+
+	variantResults := make([]nsQueryResults, len(p.variants))
+	var wg sync.WaitGroup
+	wg.Add(len(p.variants))
+	for i := range p.variants {
+		go func(i int) {
+			defer wg.Done()
+			variantResults[i] = p.queryBoth(now, p.variants[i].cpu, p.variants[i].mem, podResource, namespace, names...)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, variantRes := range variantResults {
+		variant := &p.variants[i]
+		if variantRes.err != nil {
+			klog.Errorf("failed querying metrics of pods in namespace %q for nodes matching %s: %v", namespace, variant.nodeSelector, variantRes.err)
+			continue
+		}
+		// the container metrics are organized using the default container labels
+		variantRes.cpu.relabelContainers(variant.cpu.containerLabel, p.cpu.containerLabel)
+		variantRes.mem.relabelContainers(variant.mem.containerLabel, p.mem.containerLabel)
+		res.merge(variantRes)
+	}
+	return res
+}
+
+// merge adds the results of the objects missing from these results from the given ones.
+func (r *nsQueryResults) merge(other nsQueryResults) {
+	for name, samples := range other.cpu {
+		if _, found := r.cpu[name]; !found {
+			r.cpu[name] = samples
+		}
+	}
+	for name, samples := range other.mem {
+		if _, found := r.mem[name]; !found {
+			r.mem[name] = samples
+		}
+	}
+}
+
 // queryBoth queries for both CPU and memory metrics on the given
-// Kubernetes API resource (pods or nodes), and errors out if
-// either query fails.
-func (p *resourceProvider) queryBoth(now pmodel.Time, resource schema.GroupResource, namespace string, names ...string) nsQueryResults {
+// Kubernetes API resource (pods or nodes) using the given queries, and
+// errors out if either query fails.
+func (p *resourceProvider) queryBoth(now pmodel.Time, cpu, mem resourceQuery, resource schema.GroupResource, namespace string, names ...string) nsQueryResults {
 	var cpuRes, memRes queryResults
 	var cpuErr, memErr error
 
@@ -337,11 +736,11 @@ func (p *resourceProvider) queryBoth(now pmodel.Time, resource schema.GroupResou
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		cpuRes, cpuErr = p.runQuery(now, p.cpu, resource, namespace, names...)
+		cpuRes, cpuErr = p.runQuery(now, cpu, resource, namespace, names...)
 	}()
 	go func() {
 		defer wg.Done()
-		memRes, memErr = p.runQuery(now, p.mem, resource, namespace, names...)
+		memRes, memErr = p.runQuery(now, mem, resource, namespace, names...)
 	}()
 	wg.Wait()
 
@@ -365,28 +764,84 @@ func (p *resourceProvider) queryBoth(now pmodel.Time, resource schema.GroupResou
 	}
 }
 
+// queryExtra queries for the metrics of the resources other than CPU and
+// memory on the given Kubernetes API resource (pods or nodes).  Since these
+// are optional, failed queries are logged and skipped.
+func (p *resourceProvider) queryExtra(now pmodel.Time, resource schema.GroupResource, namespace string, names ...string) map[corev1.ResourceName]queryResults {
+	if len(p.extra) == 0 {
+		return nil
+	}
+
+	var mu sync.Mutex
+	res := make(map[corev1.ResourceName]queryResults, len(p.extra))
+	var wg sync.WaitGroup
+	wg.Add(len(p.extra))
+	for resourceName, queryInfo := range p.extra {
+		go func(resourceName corev1.ResourceName, queryInfo resourceQuery) {
+			defer wg.Done()
+			extraRes, err := p.runQuery(now, queryInfo, resource, namespace, names...)
+			if err != nil {
+				klog.Errorf("unable to fetch %s metrics for %s in namespace %q, skipping: %v", resourceName, resource.String(), namespace, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			res[resourceName] = extraRes
+		}(resourceName, queryInfo)
+	}
+	wg.Wait()
+
+	return res
+}
+
+// usageQuantity converts a value of the given resource to a quantity, using
+// the binary format for amounts of bytes, like memory and storage.  Values
+// are kept with nano precision, e.g. CPU usage below a millicore.
+func usageQuantity(resourceName corev1.ResourceName, value pmodel.SampleValue) resource.Quantity {
+	format := resource.DecimalSI
+	switch resourceName {
+	case corev1.ResourceMemory, corev1.ResourceStorage, corev1.ResourceEphemeralStorage:
+		format = resource.BinarySI
+	}
+	return *queryplan.NewQuantity(value, format)
+}
+
 // queryResults maps an object name to all the results matching that object
 type queryResults map[string][]*pmodel.Sample
 
+// relabelContainers moves the container names of the results from one label
+// to another.
+func (r queryResults) relabelContainers(from, to string) {
+	if from == to {
+		return
+	}
+	for _, samples := range r {
+		for _, sample := range samples {
+			sample.Metric[pmodel.LabelName(to)] = sample.Metric[pmodel.LabelName(from)]
+		}
+	}
+}
+
 // runQuery actually queries Prometheus for the metric represented by the given query information, on
 // the given Kubernetes API resource (pods or nodes).
 func (p *resourceProvider) runQuery(now pmodel.Time, queryInfo resourceQuery, resource schema.GroupResource, namespace string, names ...string) (queryResults, error) {
-	var query client.Selector
+	var plan *queryplan.Plan
 	var err error
 
 	// build the query, which needs the special "container" group by if this is for pod metrics
 	if resource == nodeResource {
-		query, err = queryInfo.nodeQuery.Build("", resource, namespace, nil, labels.Everything(), names...)
+		plan, err = queryInfo.nodeQuery.Plan("", resource, namespace, nil, labels.Everything(), names...)
 	} else {
 		extraGroupBy := []string{queryInfo.containerLabel}
-		query, err = queryInfo.contQuery.Build("", resource, namespace, extraGroupBy, labels.Everything(), names...)
+		plan, err = queryInfo.contQuery.Plan("", resource, namespace, extraGroupBy, labels.Everything(), names...)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct query: %v", err)
 	}
+	plan.Time = now
 
 	// run the query
-	rawRes, err := p.prom.Query(context.Background(), now, query)
+	rawRes, err := p.executor.Execute(context.Background(), plan)
 	if err != nil {
 		return nil, fmt.Errorf("unable to execute query: %v", err)
 	}
@@ -413,6 +868,9 @@ func (p *resourceProvider) runQuery(now pmodel.Time, queryInfo resourceQuery, re
 			sample.Value = 0
 		}
 		resKey := string(sample.Metric[resourceLbl])
+		if resource == nodeResource {
+			resKey = p.nodeIDForLabel(resKey)
+		}
 		res[resKey] = append(res[resKey], sample)
 	}
 
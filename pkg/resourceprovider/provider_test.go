@@ -33,6 +33,8 @@ import (
 	config "sigs.k8s.io/prometheus-adapter/cmd/config-gen/utils"
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
 	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+	adaptercfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -109,18 +111,42 @@ var _ = Describe("Resource Metrics Provider", func() {
 		cfg := config.DefaultConfig(1*time.Minute, "")
 
 		var err error
-		cpuQueries, err = newResourceQuery(cfg.ResourceRules.CPU, mapper)
+		cpuQueries, err = newResourceQuery(cfg.ResourceRules.CPU, cfg.ResourceRules.Window, mapper, nil)
 		Expect(err).NotTo(HaveOccurred())
-		memQueries, err = newResourceQuery(cfg.ResourceRules.Memory, mapper)
+		memQueries, err = newResourceQuery(cfg.ResourceRules.Memory, cfg.ResourceRules.Window, mapper, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		fakeProm = &fakeprom.FakePrometheusClient{}
 		fakeProm.AcceptableInterval = pmodel.Interval{End: pmodel.Latest}
 
-		prov, err = NewProvider(fakeProm, restMapper(), cfg.ResourceRules)
+		prov, err = NewProvider(Options{Client: fakeProm, Mapper: restMapper(), Rules: cfg.ResourceRules})
 		Expect(err).NotTo(HaveOccurred())
 	})
 
+	It("should make the window available to queries, and report it", func() {
+		By("overriding the window for CPU, and using it in the container query")
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		cfg.ResourceRules.CPU.Window = pmodel.Duration(2 * time.Minute)
+		cfg.ResourceRules.CPU.ContainerQuery = "sum(rate(container_cpu_usage_seconds_total{<<.LabelMatchers>>}[<<.Window>>])) by (<<.GroupBy>>)"
+		cpuQuery, err := newResourceQuery(cfg.ResourceRules.CPU, cfg.ResourceRules.Window, restMapper(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cpuQuery.contWindow).To(Equal(2 * time.Minute))
+		query, err := cpuQuery.contQuery.Build("", podResource, "some-ns", nil, labels.Everything(), "pod1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(query)).To(ContainSubstring("[2m]"))
+
+		By("deriving the window from the queries when none is set")
+		cfg.ResourceRules.Window = 0
+		cfg.ResourceRules.CPU.Window = 0
+		cpuQuery, err = newResourceQuery(cfg.ResourceRules.CPU, cfg.ResourceRules.Window, restMapper(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cpuQuery.nodeWindow).To(Equal(time.Minute))
+		memQuery, err := newResourceQuery(cfg.ResourceRules.Memory, cfg.ResourceRules.Window, restMapper(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(memQuery.nodeWindow).To(BeZero())
+		Expect(reportedWindow(cpuQuery.nodeWindow, memQuery.nodeWindow)).To(Equal(time.Minute))
+	})
+
 	It("should be able to list metrics pods across different namespaces", func() {
 		pods := []*metav1.PartialObjectMetadata{
 			{ObjectMeta: metav1.ObjectMeta{Namespace: "some-ns", Name: "pod1"}},
@@ -212,6 +238,148 @@ var _ = Describe("Resource Metrics Provider", func() {
 		))
 	})
 
+	It("should only report the containers of pods, by name, like metrics-server", func() {
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			mustBuild(cpuQueries.contQuery.Build("", podResource, "some-ns", []string{cpuQueries.containerLabel}, labels.Everything(), "pod1", "pod3")): buildQueryRes("container_cpu_usage_seconds_total",
+				buildPodSample("some-ns", "pod1", "sidecar", 1110.0, 10),
+				buildPodSample("some-ns", "pod1", "app", 1100.0, 10),
+				buildPodSample("some-ns", "pod1", "POD", 1.0, 10),
+				buildPodSample("some-ns", "pod1", "", 2211.0, 10),
+				buildPodSample("some-ns", "pod3", "", 1300.0, 10),
+			),
+			mustBuild(memQueries.contQuery.Build("", podResource, "some-ns", []string{cpuQueries.containerLabel}, labels.Everything(), "pod1", "pod3")): buildQueryRes("container_memory_working_set_bytes",
+				buildPodSample("some-ns", "pod1", "sidecar", 3110.0, 11),
+				buildPodSample("some-ns", "pod1", "app", 3100.0, 11),
+				buildPodSample("some-ns", "pod1", "POD", 1.0, 11),
+				buildPodSample("some-ns", "pod1", "", 6211.0, 11),
+				buildPodSample("some-ns", "pod3", "", 3300.0, 11),
+			),
+		}
+
+		By("querying for metrics for some pods")
+		podMetrics, err := prov.GetPodMetrics(
+			&metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: "some-ns", Name: "pod1"}},
+			&metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: "some-ns", Name: "pod3"}},
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(podMetrics).To(HaveLen(2))
+
+		By("verifying that the pause container and the pod totals are left out, and containers sorted by name")
+		Expect(podMetrics[0].Containers).To(Equal([]metrics.ContainerMetrics{
+			{Name: "app", Usage: buildResList(1100.0, 3100.0)},
+			{Name: "sidecar", Usage: buildResList(1110.0, 3110.0)},
+		}))
+
+		By("verifying that values without a container name are kept when no container is named")
+		Expect(podMetrics[1].Containers).To(Equal([]metrics.ContainerMetrics{
+			{Name: "", Usage: buildResList(1300.0, 3300.0)},
+		}))
+	})
+
+	It("should report pods missing either CPU or memory usage when partial pod metrics are enabled", func() {
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			mustBuild(cpuQueries.contQuery.Build("", podResource, "some-ns", []string{cpuQueries.containerLabel}, labels.Everything(), "pod1", "pod3", "pod5")): buildQueryRes("container_cpu_usage_seconds_total",
+				buildPodSample("some-ns", "pod1", "cont1", 1100.0, 10),
+				buildPodSample("some-ns", "pod1", "cont2", 1110.0, 10),
+			),
+			mustBuild(memQueries.contQuery.Build("", podResource, "some-ns", []string{cpuQueries.containerLabel}, labels.Everything(), "pod1", "pod3", "pod5")): buildQueryRes("container_memory_working_set_bytes",
+				buildPodSample("some-ns", "pod3", "cont1", 3300.0, 11),
+			),
+		}
+		pods := []*metav1.PartialObjectMetadata{
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "some-ns", Name: "pod1"}},
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "some-ns", Name: "pod3"}},
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "some-ns", Name: "pod5"}},
+		}
+
+		By("leaving them out by default")
+		podMetrics, err := prov.GetPodMetrics(pods...)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(podMetrics).To(BeEmpty())
+
+		By("reporting the known usage only, without the missing resource, when enabled")
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		partialProv, err := NewProvider(Options{Client: fakeProm, Mapper: restMapper(), Rules: cfg.ResourceRules, PartialPodMetrics: true})
+		Expect(err).NotTo(HaveOccurred())
+		podMetrics, err = partialProv.GetPodMetrics(pods...)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(podMetrics).To(HaveLen(2), "pods missing both CPU and memory usage should still be left out")
+
+		Expect(podMetrics[0].Name).To(Equal("pod1"))
+		Expect(podMetrics[0].Annotations).To(HaveKeyWithValue(MissingUsageAnnotation, "memory"))
+		Expect(podMetrics[0].Containers).To(Equal([]metrics.ContainerMetrics{
+			{Name: "cont1", Usage: corev1.ResourceList{corev1.ResourceCPU: *resource.NewMilliQuantity(1100000, resource.DecimalSI)}},
+			{Name: "cont2", Usage: corev1.ResourceList{corev1.ResourceCPU: *resource.NewMilliQuantity(1110000, resource.DecimalSI)}},
+		}))
+
+		Expect(podMetrics[1].Name).To(Equal("pod3"))
+		Expect(podMetrics[1].Annotations).To(HaveKeyWithValue(MissingUsageAnnotation, "cpu"))
+		Expect(podMetrics[1].Containers).To(Equal([]metrics.ContainerMetrics{
+			{Name: "cont1", Usage: corev1.ResourceList{corev1.ResourceMemory: *resource.NewMilliQuantity(3300000, resource.BinarySI)}},
+		}))
+	})
+
+	It("should report the usage of terminating pods according to the policy", func() {
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			mustBuild(cpuQueries.contQuery.Build("", podResource, "some-ns", []string{cpuQueries.containerLabel}, labels.Everything(), "pod1", "pod3")): buildQueryRes("container_cpu_usage_seconds_total",
+				buildPodSample("some-ns", "pod1", "cont1", 1100.0, 10),
+				buildPodSample("some-ns", "pod3", "cont1", 1300.0, 10),
+			),
+			mustBuild(memQueries.contQuery.Build("", podResource, "some-ns", []string{cpuQueries.containerLabel}, labels.Everything(), "pod1", "pod3")): buildQueryRes("container_memory_working_set_bytes",
+				buildPodSample("some-ns", "pod1", "cont1", 3100.0, 11),
+				buildPodSample("some-ns", "pod3", "cont1", 3300.0, 11),
+			),
+		}
+		deleted := metav1.Now()
+		pods := []*metav1.PartialObjectMetadata{
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "some-ns", Name: "pod1"}},
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "some-ns", Name: "pod3", DeletionTimestamp: &deleted}},
+		}
+		cfg := config.DefaultConfig(1*time.Minute, "")
+
+		By("serving the usage of terminating pods by default, annotated")
+		podMetrics, err := prov.GetPodMetrics(pods...)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(podMetrics).To(HaveLen(2))
+		Expect(podMetrics[0].Annotations).To(BeEmpty())
+		Expect(podMetrics[1].Annotations).To(HaveKeyWithValue(TerminatingAnnotation, "true"))
+		Expect(podMetrics[1].Containers).To(ConsistOf(
+			metrics.ContainerMetrics{Name: "cont1", Usage: buildResList(1300.0, 3300.0)},
+		))
+
+		By("leaving terminating pods out when skipping them, without querying their usage")
+		fakeProm.QueryResults[mustBuild(cpuQueries.contQuery.Build("", podResource, "some-ns", []string{cpuQueries.containerLabel}, labels.Everything(), "pod1"))] = buildQueryRes("container_cpu_usage_seconds_total",
+			buildPodSample("some-ns", "pod1", "cont1", 1100.0, 10),
+		)
+		fakeProm.QueryResults[mustBuild(memQueries.contQuery.Build("", podResource, "some-ns", []string{cpuQueries.containerLabel}, labels.Everything(), "pod1"))] = buildQueryRes("container_memory_working_set_bytes",
+			buildPodSample("some-ns", "pod1", "cont1", 3100.0, 11),
+		)
+		skipProv, err := NewProvider(Options{Client: fakeProm, Mapper: restMapper(), Rules: cfg.ResourceRules, TerminatingPods: TerminatingPodsSkip})
+		Expect(err).NotTo(HaveOccurred())
+		podMetrics, err = skipProv.GetPodMetrics(pods...)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(podMetrics).To(HaveLen(1))
+		Expect(podMetrics[0].Name).To(Equal("pod1"))
+
+		By("reporting zero usage for terminating pods when zeroing them")
+		zeroProv, err := NewProvider(Options{Client: fakeProm, Mapper: restMapper(), Rules: cfg.ResourceRules, TerminatingPods: TerminatingPodsZero})
+		Expect(err).NotTo(HaveOccurred())
+		podMetrics, err = zeroProv.GetPodMetrics(pods...)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(podMetrics).To(HaveLen(2))
+		Expect(podMetrics[0].Containers).To(ConsistOf(
+			metrics.ContainerMetrics{Name: "cont1", Usage: buildResList(1100.0, 3100.0)},
+		))
+		Expect(podMetrics[1].Annotations).To(HaveKeyWithValue(TerminatingAnnotation, "true"))
+		Expect(podMetrics[1].Containers).To(ConsistOf(
+			metrics.ContainerMetrics{Name: "cont1", Usage: buildResList(0, 0)},
+		))
+
+		By("rejecting unknown policies")
+		_, err = NewProvider(Options{Client: fakeProm, Mapper: restMapper(), Rules: cfg.ResourceRules, TerminatingPods: "drop"})
+		Expect(err).To(HaveOccurred())
+	})
+
 	It("should return metrics of value zero when pod metrics have NaN or negative values", func() {
 		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
 			mustBuild(cpuQueries.contQuery.Build("", podResource, "some-ns", []string{cpuQueries.containerLabel}, labels.Everything(), "pod1", "pod3")): buildQueryRes("container_cpu_usage_seconds_total",
@@ -349,4 +517,221 @@ var _ = Describe("Resource Metrics Provider", func() {
 		Expect(nodeMetrics[0].Usage).To(Equal(buildResList(0, 2100.0)))
 		Expect(nodeMetrics[1].Usage).To(Equal(buildResList(1200.0, 0)))
 	})
+
+	It("should use the queries of the matching variant for some nodes, and merge the results", func() {
+		By("setting up a provider with a variant for Windows nodes")
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		winCPU := cfg.ResourceRules.CPU
+		winCPU.NodeQuery = "sum(rate(windows_cpu_time_total{mode!=\"idle\",<<.LabelMatchers>>}[<<.Window>>])) by (<<.GroupBy>>)"
+		winMem := cfg.ResourceRules.Memory
+		winMem.NodeQuery = "sum(windows_os_visible_memory_bytes{<<.LabelMatchers>>}) by (<<.GroupBy>>)"
+		cfg.ResourceRules.Variants = []adaptercfg.ResourceRulesVariant{{
+			NodeSelector: map[string]string{"kubernetes.io/os": "windows"},
+			CPU:          winCPU,
+			Memory:       winMem,
+			Window:       pmodel.Duration(5 * time.Minute),
+		}}
+		prov, err := NewProvider(Options{Client: fakeProm, Mapper: restMapper(), Rules: cfg.ResourceRules})
+		Expect(err).NotTo(HaveOccurred())
+		winCPUQueries, err := newResourceQuery(winCPU, pmodel.Duration(5*time.Minute), restMapper(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		winMemQueries, err := newResourceQuery(winMem, pmodel.Duration(5*time.Minute), restMapper(), nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			mustBuild(cpuQueries.nodeQuery.Build("", nodeResource, "", nil, labels.Everything(), "node1")): buildQueryRes("container_cpu_usage_seconds_total",
+				buildNodeSample("node1", 1100.0, 10),
+			),
+			mustBuild(memQueries.nodeQuery.Build("", nodeResource, "", nil, labels.Everything(), "node1")): buildQueryRes("container_memory_working_set_bytes",
+				buildNodeSample("node1", 2100.0, 11),
+			),
+			mustBuild(winCPUQueries.nodeQuery.Build("", nodeResource, "", nil, labels.Everything(), "win1")): buildQueryRes("windows_cpu_time_total",
+				buildNodeSample("win1", 1200.0, 14),
+			),
+			mustBuild(winMemQueries.nodeQuery.Build("", nodeResource, "", nil, labels.Everything(), "win1")): buildQueryRes("windows_os_visible_memory_bytes",
+				buildNodeSample("win1", 2200.0, 12),
+			),
+		}
+
+		By("querying for metrics for a Linux and a Windows node")
+		nodeMetrics, err := prov.GetNodeMetrics(
+			&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"kubernetes.io/os": "linux"}}},
+			&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "win1", Labels: map[string]string{"kubernetes.io/os": "windows"}}},
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("verifying that each node got the metrics and window of its own queries")
+		Expect(nodeMetrics).To(HaveLen(2))
+		Expect(nodeMetrics[0].Usage).To(Equal(buildResList(1100.0, 2100.0)))
+		Expect(nodeMetrics[0].Window.Duration).To(Equal(time.Minute))
+		Expect(nodeMetrics[1].Usage).To(Equal(buildResList(1200.0, 2200.0)))
+		Expect(nodeMetrics[1].Window.Duration).To(Equal(5 * time.Minute))
+	})
+
+	It("should fill in pods missing from the default results with the results of variants", func() {
+		By("setting up a provider with a variant using a different container label")
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		winCPU := cfg.ResourceRules.CPU
+		winCPU.ContainerQuery = "sum(rate(windows_container_cpu_usage_seconds_total{<<.LabelMatchers>>}[<<.Window>>])) by (<<.GroupBy>>)"
+		winCPU.ContainerLabel = "container_name"
+		winMem := cfg.ResourceRules.Memory
+		winMem.ContainerQuery = "sum(windows_container_memory_usage_private_working_set_bytes{<<.LabelMatchers>>}) by (<<.GroupBy>>)"
+		winMem.ContainerLabel = "container_name"
+		cfg.ResourceRules.Variants = []adaptercfg.ResourceRulesVariant{{
+			NodeSelector: map[string]string{"kubernetes.io/os": "windows"},
+			CPU:          winCPU,
+			Memory:       winMem,
+		}}
+		prov, err := NewProvider(Options{Client: fakeProm, Mapper: restMapper(), Rules: cfg.ResourceRules})
+		Expect(err).NotTo(HaveOccurred())
+		winCPUQueries, err := newResourceQuery(winCPU, cfg.ResourceRules.Window, restMapper(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		winMemQueries, err := newResourceQuery(winMem, cfg.ResourceRules.Window, restMapper(), nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		winSample := func(pod string, val float64, ts int64) *pmodel.Sample {
+			sample := buildPodSample("some-ns", pod, "", val, ts)
+			delete(sample.Metric, "container")
+			sample.Metric["container_name"] = "wincont"
+			return sample
+		}
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			mustBuild(cpuQueries.contQuery.Build("", podResource, "some-ns", []string{cpuQueries.containerLabel}, labels.Everything(), "pod1", "winpod")): buildQueryRes("container_cpu_usage_seconds_total",
+				buildPodSample("some-ns", "pod1", "cont1", 1100.0, 10),
+			),
+			mustBuild(memQueries.contQuery.Build("", podResource, "some-ns", []string{memQueries.containerLabel}, labels.Everything(), "pod1", "winpod")): buildQueryRes("container_memory_working_set_bytes",
+				buildPodSample("some-ns", "pod1", "cont1", 3100.0, 11),
+			),
+			mustBuild(winCPUQueries.contQuery.Build("", podResource, "some-ns", []string{winCPUQueries.containerLabel}, labels.Everything(), "pod1", "winpod")): buildQueryRes("windows_container_cpu_usage_seconds_total",
+				winSample("winpod", 1200.0, 12),
+			),
+			mustBuild(winMemQueries.contQuery.Build("", podResource, "some-ns", []string{winMemQueries.containerLabel}, labels.Everything(), "pod1", "winpod")): buildQueryRes("windows_container_memory_usage_private_working_set_bytes",
+				winSample("winpod", 3200.0, 13),
+			),
+		}
+
+		By("querying for metrics for a Linux and a Windows pod")
+		podMetrics, err := prov.GetPodMetrics(
+			&metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: "some-ns", Name: "pod1"}},
+			&metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: "some-ns", Name: "winpod"}},
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("verifying that both pods have metrics, with the right container names")
+		Expect(podMetrics).To(HaveLen(2))
+		Expect(podMetrics[0].Containers).To(ConsistOf(
+			metrics.ContainerMetrics{Name: "cont1", Usage: buildResList(1100.0, 3100.0)},
+		))
+		Expect(podMetrics[1].Containers).To(ConsistOf(
+			metrics.ContainerMetrics{Name: "wincont", Usage: buildResList(1200.0, 3200.0)},
+		))
+	})
+
+	It("should report the usage of extra resources where their queries return values", func() {
+		By("setting up a provider with rules for GPUs")
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		gpu := cfg.ResourceRules.Memory
+		gpu.ContainerQuery = "sum(DCGM_FI_DEV_GPU_UTIL{<<.LabelMatchers>>}) by (<<.GroupBy>>)"
+		gpu.NodeQuery = "sum(DCGM_FI_DEV_GPU_UTIL{<<.LabelMatchers>>}) by (<<.GroupBy>>)"
+		cfg.ResourceRules.ExtraResources = map[string]adaptercfg.ResourceRule{"nvidia.com/gpu": gpu}
+		prov, err := NewProvider(Options{Client: fakeProm, Mapper: restMapper(), Rules: cfg.ResourceRules})
+		Expect(err).NotTo(HaveOccurred())
+		gpuQueries, err := newResourceQuery(gpu, cfg.ResourceRules.Window, restMapper(), nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			mustBuild(cpuQueries.contQuery.Build("", podResource, "some-ns", []string{cpuQueries.containerLabel}, labels.Everything(), "pod1")): buildQueryRes("container_cpu_usage_seconds_total",
+				buildPodSample("some-ns", "pod1", "cont1", 1100.0, 10),
+				buildPodSample("some-ns", "pod1", "cont2", 1110.0, 20),
+			),
+			mustBuild(memQueries.contQuery.Build("", podResource, "some-ns", []string{memQueries.containerLabel}, labels.Everything(), "pod1")): buildQueryRes("container_memory_working_set_bytes",
+				buildPodSample("some-ns", "pod1", "cont1", 3100.0, 11),
+				buildPodSample("some-ns", "pod1", "cont2", 3110.0, 21),
+			),
+			mustBuild(gpuQueries.contQuery.Build("", podResource, "some-ns", []string{gpuQueries.containerLabel}, labels.Everything(), "pod1")): buildQueryRes("DCGM_FI_DEV_GPU_UTIL",
+				buildPodSample("some-ns", "pod1", "cont1", 2.0, 12),
+			),
+			mustBuild(cpuQueries.nodeQuery.Build("", nodeResource, "", nil, labels.Everything(), "node1")): buildQueryRes("container_cpu_usage_seconds_total",
+				buildNodeSample("node1", 1100.0, 10),
+			),
+			mustBuild(memQueries.nodeQuery.Build("", nodeResource, "", nil, labels.Everything(), "node1")): buildQueryRes("container_memory_working_set_bytes",
+				buildNodeSample("node1", 2100.0, 11),
+			),
+			mustBuild(gpuQueries.nodeQuery.Build("", nodeResource, "", nil, labels.Everything(), "node1")): buildQueryRes("DCGM_FI_DEV_GPU_UTIL",
+				buildNodeSample("node1", 4.0, 12),
+			),
+		}
+
+		By("verifying that the GPU usage is reported for the containers using GPUs")
+		podMetrics, err := prov.GetPodMetrics(&metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: "some-ns", Name: "pod1"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(podMetrics).To(HaveLen(1))
+		cont1Usage := buildResList(1100.0, 3100.0)
+		cont1Usage["nvidia.com/gpu"] = *resource.NewMilliQuantity(2000, resource.DecimalSI)
+		Expect(podMetrics[0].Containers).To(ConsistOf(
+			metrics.ContainerMetrics{Name: "cont1", Usage: cont1Usage},
+			metrics.ContainerMetrics{Name: "cont2", Usage: buildResList(1110.0, 3110.0)},
+		))
+
+		By("verifying that the GPU usage is reported for nodes")
+		nodeMetrics, err := prov.GetNodeMetrics(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nodeMetrics).To(HaveLen(1))
+		nodeUsage := buildResList(1100.0, 2100.0)
+		nodeUsage["nvidia.com/gpu"] = *resource.NewMilliQuantity(4000, resource.DecimalSI)
+		Expect(nodeMetrics[0].Usage).To(Equal(nodeUsage))
+	})
+
+	It("should refuse rules for CPU or memory among the extra resources", func() {
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		cfg.ResourceRules.ExtraResources = map[string]adaptercfg.ResourceRule{"memory": cfg.ResourceRules.Memory}
+		_, err := NewProvider(Options{Client: fakeProm, Mapper: restMapper(), Rules: cfg.ResourceRules})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should match node results by internal IP address, ignoring ports", func() {
+		By("setting up a provider identifying nodes by internal IP")
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		cfg.ResourceRules.NodeIdentifier = adaptercfg.NodeIdentifierInternalIP
+		prov, err := NewProvider(Options{Client: fakeProm, Mapper: restMapper(), Rules: cfg.ResourceRules})
+		Expect(err).NotTo(HaveOccurred())
+		cpuIPQueries, err := newResourceQuery(cfg.ResourceRules.CPU, cfg.ResourceRules.Window, restMapper(), nil, naming.WithNamePatterns())
+		Expect(err).NotTo(HaveOccurred())
+		memIPQueries, err := newResourceQuery(cfg.ResourceRules.Memory, cfg.ResourceRules.Window, restMapper(), nil, naming.WithNamePatterns())
+		Expect(err).NotTo(HaveOccurred())
+
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			mustBuild(cpuIPQueries.nodeQuery.Build("", nodeResource, "", nil, labels.Everything(), `10\.0\.0\.1(:[0-9]+)?`)): buildQueryRes("container_cpu_usage_seconds_total",
+				buildNodeSample("10.0.0.1:9100", 1100.0, 10),
+			),
+			mustBuild(memIPQueries.nodeQuery.Build("", nodeResource, "", nil, labels.Everything(), `10\.0\.0\.1(:[0-9]+)?`)): buildQueryRes("container_memory_working_set_bytes",
+				buildNodeSample("10.0.0.1:9100", 2100.0, 11),
+			),
+		}
+
+		By("querying for metrics for a node with an internal IP, and one without")
+		nodeMetrics, err := prov.GetNodeMetrics(
+			&corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+				Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+					{Type: corev1.NodeHostName, Address: "node1"},
+					{Type: corev1.NodeInternalIP, Address: "10.0.0.1"},
+				}},
+			},
+			&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("verifying that the node with an internal IP got its metrics")
+		Expect(nodeMetrics).To(HaveLen(1))
+		Expect(nodeMetrics[0].Name).To(Equal("node1"))
+		Expect(nodeMetrics[0].Usage).To(Equal(buildResList(1100.0, 2100.0)))
+	})
+
+	It("should refuse unknown node identifiers", func() {
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		cfg.ResourceRules.NodeIdentifier = "ExternalIP"
+		_, err := NewProvider(Options{Client: fakeProm, Mapper: restMapper(), Rules: cfg.ResourceRules})
+		Expect(err).To(HaveOccurred())
+	})
 })
@@ -0,0 +1,92 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resourceprovider
+
+import (
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metrics "k8s.io/metrics/pkg/apis/metrics"
+
+	"sigs.k8s.io/metrics-server/pkg/api"
+
+	"sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+// ReloadableProvider is a resource metrics provider whose rules can be
+// replaced while it's serving requests.
+type ReloadableProvider struct {
+	opts Options
+
+	mu      sync.RWMutex
+	current api.MetricsGetter
+}
+
+// NewReloadableProvider is like NewProvider, but returns a provider whose rules
+// may later be replaced using SetRules.
+func NewReloadableProvider(opts Options) (*ReloadableProvider, error) {
+	p := &ReloadableProvider{opts: opts}
+	if err := p.SetRules(opts.Rules); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetRules replaces the rules used to fetch resource metrics.  If the new
+// rules are invalid, the existing ones are kept.
+func (p *ReloadableProvider) SetRules(cfg *config.ResourceRules) error {
+	apply, err := p.PrepareRules(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// PrepareRules checks the given rules, without using them yet: the returned
+// function replaces the rules used to fetch resource metrics.
+func (p *ReloadableProvider) PrepareRules(cfg *config.ResourceRules) (func(), error) {
+	opts := p.opts
+	opts.Rules = cfg
+	provider, err := NewProvider(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.current = provider
+	}, nil
+}
+
+func (p *ReloadableProvider) getter() api.MetricsGetter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.current
+}
+
+// GetPodMetrics implements the api.MetricsProvider interface.
+func (p *ReloadableProvider) GetPodMetrics(pods ...*metav1.PartialObjectMetadata) ([]metrics.PodMetrics, error) {
+	return p.getter().GetPodMetrics(pods...)
+}
+
+// GetNodeMetrics implements the api.MetricsProvider interface.
+func (p *ReloadableProvider) GetNodeMetrics(nodes ...*corev1.Node) ([]metrics.NodeMetrics, error) {
+	return p.getter().GetNodeMetrics(nodes...)
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package snapshot knows how to write and read a compact, protobuf-encoded
+// snapshot of the metrics currently exposed by the adapter.  The snapshot is
+// written to a local file so that tooling running next to the adapter (e.g.
+// a debugging sidecar) can inspect discovered metrics without going through
+// the API server.  The schema lives in snapshot.proto.
+package snapshot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// field numbers, as per snapshot.proto
+const (
+	snapshotTimestampField       protowire.Number = 1
+	snapshotCustomMetricsField   protowire.Number = 2
+	snapshotExternalMetricsField protowire.Number = 3
+
+	customGroupField      protowire.Number = 1
+	customResourceField   protowire.Number = 2
+	customNamespacedField protowire.Number = 3
+	customMetricField     protowire.Number = 4
+
+	externalMetricField protowire.Number = 1
+)
+
+// RegistrySnapshot is the set of metrics exposed by the adapter at a given time.
+type RegistrySnapshot struct {
+	Timestamp       time.Time
+	CustomMetrics   []provider.CustomMetricInfo
+	ExternalMetrics []provider.ExternalMetricInfo
+}
+
+// Marshal encodes the snapshot in its protobuf wire format.
+func (s *RegistrySnapshot) Marshal() []byte {
+	var b []byte
+	if !s.Timestamp.IsZero() {
+		b = protowire.AppendTag(b, snapshotTimestampField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(s.Timestamp.UnixNano()))
+	}
+
+	for _, info := range s.CustomMetrics {
+		var msg []byte
+		msg = appendString(msg, customGroupField, info.GroupResource.Group)
+		msg = appendString(msg, customResourceField, info.GroupResource.Resource)
+		if info.Namespaced {
+			msg = protowire.AppendTag(msg, customNamespacedField, protowire.VarintType)
+			msg = protowire.AppendVarint(msg, protowire.EncodeBool(true))
+		}
+		msg = appendString(msg, customMetricField, info.Metric)
+
+		b = protowire.AppendTag(b, snapshotCustomMetricsField, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+
+	for _, info := range s.ExternalMetrics {
+		msg := appendString(nil, externalMetricField, info.Metric)
+
+		b = protowire.AppendTag(b, snapshotExternalMetricsField, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+
+	return b
+}
+
+// Unmarshal decodes a snapshot from its protobuf wire format.  Unknown fields
+// are skipped, so that older readers can consume snapshots from newer adapters.
+func Unmarshal(data []byte) (*RegistrySnapshot, error) {
+	res := &RegistrySnapshot{}
+	err := forEachField(data, func(num protowire.Number, typ protowire.Type, val []byte, varint uint64) error {
+		switch {
+		case num == snapshotTimestampField && typ == protowire.VarintType:
+			res.Timestamp = time.Unix(0, int64(varint))
+		case num == snapshotCustomMetricsField && typ == protowire.BytesType:
+			info, err := unmarshalCustomMetric(val)
+			if err != nil {
+				return err
+			}
+			res.CustomMetrics = append(res.CustomMetrics, info)
+		case num == snapshotExternalMetricsField && typ == protowire.BytesType:
+			info := provider.ExternalMetricInfo{}
+			err := forEachField(val, func(num protowire.Number, typ protowire.Type, val []byte, _ uint64) error {
+				if num == externalMetricField && typ == protowire.BytesType {
+					info.Metric = string(val)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			res.ExternalMetrics = append(res.ExternalMetrics, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode registry snapshot: %v", err)
+	}
+	return res, nil
+}
+
+func unmarshalCustomMetric(data []byte) (provider.CustomMetricInfo, error) {
+	info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{}}
+	err := forEachField(data, func(num protowire.Number, typ protowire.Type, val []byte, varint uint64) error {
+		switch {
+		case num == customGroupField && typ == protowire.BytesType:
+			info.GroupResource.Group = string(val)
+		case num == customResourceField && typ == protowire.BytesType:
+			info.GroupResource.Resource = string(val)
+		case num == customNamespacedField && typ == protowire.VarintType:
+			info.Namespaced = protowire.DecodeBool(varint)
+		case num == customMetricField && typ == protowire.BytesType:
+			info.Metric = string(val)
+		}
+		return nil
+	})
+	return info, err
+}
+
+// WriteFile atomically replaces the contents of the given file with the
+// encoded snapshot, so that readers never observe a partially-written file.
+func WriteFile(filename string, s *RegistrySnapshot) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary snapshot file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(s.Marshal()); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("unable to write snapshot: %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("unable to write snapshot: %v", err)
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return fmt.Errorf("unable to set snapshot permissions: %v", err)
+	}
+	if err := os.Rename(tmpFile.Name(), filename); err != nil {
+		return fmt.Errorf("unable to replace snapshot file %q: %v", filename, err)
+	}
+	return nil
+}
+
+// ReadFile loads a snapshot previously written with WriteFile.
+func ReadFile(filename string) (*RegistrySnapshot, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read snapshot file: %v", err)
+	}
+	return Unmarshal(data)
+}
+
+func appendString(b []byte, num protowire.Number, val string) []byte {
+	if val == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, val)
+}
+
+// forEachField walks the top-level fields of an encoded message, calling fn
+// with the raw bytes (for length-delimited fields) or the value (for varints).
+func forEachField(data []byte, fn func(num protowire.Number, typ protowire.Type, val []byte, varint uint64) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var val []byte
+		var varint uint64
+		switch typ {
+		case protowire.VarintType:
+			varint, n = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			val, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if err := fn(num, typ, val, varint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
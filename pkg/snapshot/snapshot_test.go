@@ -0,0 +1,64 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	snap := &RegistrySnapshot{
+		Timestamp: time.Unix(1700000000, 42),
+		CustomMetrics: []provider.CustomMetricInfo{
+			{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"},
+			{GroupResource: schema.GroupResource{Group: "apps", Resource: "deployments"}, Namespaced: true, Metric: "queue_depth"},
+			{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_gigawatts"},
+		},
+		ExternalMetrics: []provider.ExternalMetricInfo{
+			{Metric: "queue_length"},
+		},
+	}
+
+	filename := filepath.Join(t.TempDir(), "registry.pb")
+	require.NoError(t, WriteFile(filename, snap))
+
+	got, err := ReadFile(filename)
+	require.NoError(t, err)
+	require.True(t, snap.Timestamp.Equal(got.Timestamp))
+	require.Equal(t, snap.CustomMetrics, got.CustomMetrics)
+	require.Equal(t, snap.ExternalMetrics, got.ExternalMetrics)
+}
+
+func TestUnmarshalRejectsTruncatedData(t *testing.T) {
+	snap := &RegistrySnapshot{
+		CustomMetrics: []provider.CustomMetricInfo{
+			{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"},
+		},
+	}
+	data := snap.Marshal()
+
+	_, err := Unmarshal(data[:len(data)-3])
+	require.Error(t, err)
+}
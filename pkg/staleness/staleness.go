@@ -0,0 +1,186 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package staleness tracks how old the samples served by the adapter's
+// metrics APIs are, so that operators can tell when the data feeding
+// autoscalers goes stale even though requests keep succeeding.
+package staleness
+
+import (
+	"sync"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// The APIs for which staleness is tracked.
+const (
+	CustomAPI   = "custom"
+	ExternalAPI = "external"
+	ResourceAPI = "resource"
+)
+
+const (
+	// window is the period over which the oldest served sample is reported.
+	window = 5 * time.Minute
+	// numBuckets is the number of buckets the window is split into.  Observations
+	// expire from the window one bucket at a time.
+	numBuckets = 10
+)
+
+var (
+	stalenessDesc = metrics.NewDesc(
+		"prometheus_adapter_served_sample_staleness_seconds",
+		"Age, at the time it was served, of the oldest sample served over the last 5 minutes, by metrics API",
+		[]string{"api"},
+		nil,
+		metrics.ALPHA,
+		"",
+	)
+
+	defaultTracker = newTracker(window, numBuckets)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers the staleness collector with the legacy registry,
+// which is served on the adapter's /metrics endpoint.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.CustomMustRegister(&collector{tracker: defaultTracker})
+	})
+}
+
+// Observe records that a sample with the given timestamp was served by the given API.
+func Observe(api string, sampleTime time.Time) {
+	registerMetrics()
+	defaultTracker.observe(api, time.Now(), sampleTime)
+}
+
+// ObserveVector records that the samples in the given vector were served by the given API.
+func ObserveVector(api string, vector pmodel.Vector) {
+	if len(vector) == 0 {
+		return
+	}
+
+	oldest := pmodel.Latest
+	for _, sample := range vector {
+		if sample != nil && sample.Timestamp.Before(oldest) {
+			oldest = sample.Timestamp
+		}
+	}
+	if oldest == pmodel.Latest {
+		return
+	}
+	Observe(api, oldest.Time())
+}
+
+// bucket holds the maximum sample age observed during a slice of the window.
+type bucket struct {
+	start  time.Time
+	maxAge time.Duration
+}
+
+// tracker keeps the maximum sample age per API over a rolling window,
+// split into a ring of fixed-width buckets.
+type tracker struct {
+	window      time.Duration
+	bucketWidth time.Duration
+
+	mu      sync.Mutex
+	buckets map[string][]bucket
+}
+
+func newTracker(window time.Duration, numBuckets int) *tracker {
+	return &tracker{
+		window:      window,
+		bucketWidth: window / time.Duration(numBuckets),
+		buckets:     make(map[string][]bucket),
+	}
+}
+
+func (t *tracker) observe(api string, now, sampleTime time.Time) {
+	age := now.Sub(sampleTime)
+	if age < 0 {
+		age = 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ring, ok := t.buckets[api]
+	if !ok {
+		ring = make([]bucket, int(t.window/t.bucketWidth))
+		t.buckets[api] = ring
+	}
+
+	start := now.Truncate(t.bucketWidth)
+	b := &ring[int(start.UnixNano()/int64(t.bucketWidth))%len(ring)]
+	if !b.start.Equal(start) {
+		*b = bucket{start: start}
+	}
+	if age > b.maxAge {
+		b.maxAge = age
+	}
+}
+
+// oldest returns the maximum sample age observed within the window for each
+// API with observations in the window.
+func (t *tracker) oldest(now time.Time) map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := make(map[string]time.Duration, len(t.buckets))
+	cutoff := now.Add(-t.window)
+	for api, ring := range t.buckets {
+		found := false
+		var maxAge time.Duration
+		for _, b := range ring {
+			if b.start.IsZero() || !b.start.After(cutoff) {
+				continue
+			}
+			found = true
+			if b.maxAge > maxAge {
+				maxAge = b.maxAge
+			}
+		}
+		if found {
+			res[api] = maxAge
+		}
+	}
+	return res
+}
+
+// collector exposes the staleness of each API, computed at scrape time so
+// that old observations age out of the window even without new requests.
+type collector struct {
+	metrics.BaseStableCollector
+
+	tracker *tracker
+}
+
+func (c *collector) DescribeWithStability(ch chan<- *metrics.Desc) {
+	ch <- stalenessDesc
+}
+
+func (c *collector) CollectWithStability(ch chan<- metrics.Metric) {
+	for api, age := range c.tracker.oldest(time.Now()) {
+		ch <- metrics.NewLazyConstMetric(stalenessDesc, metrics.GaugeValue, age.Seconds(), api)
+	}
+}
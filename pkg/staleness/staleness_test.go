@@ -0,0 +1,60 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package staleness
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackerReportsOldestSampleInWindow(t *testing.T) {
+	tracker := newTracker(time.Minute, 6)
+	now := time.Unix(1700000000, 0)
+
+	tracker.observe(CustomAPI, now, now.Add(-30*time.Second))
+	tracker.observe(CustomAPI, now.Add(20*time.Second), now.Add(10*time.Second))
+	tracker.observe(ExternalAPI, now, now.Add(-5*time.Second))
+
+	require.Equal(t, map[string]time.Duration{
+		CustomAPI:   30 * time.Second,
+		ExternalAPI: 5 * time.Second,
+	}, tracker.oldest(now.Add(30*time.Second)))
+
+	// once the oldest observation has left the window, only the newer ones count
+	require.Equal(t, map[string]time.Duration{
+		CustomAPI: 10 * time.Second,
+	}, tracker.oldest(now.Add(70*time.Second)))
+
+	// and once everything has left the window, nothing is reported
+	require.Empty(t, tracker.oldest(now.Add(2*time.Minute)))
+}
+
+func TestTrackerReusesExpiredBuckets(t *testing.T) {
+	tracker := newTracker(time.Minute, 6)
+	now := time.Unix(1700000000, 0)
+
+	tracker.observe(ResourceAPI, now, now.Add(-time.Hour))
+	// a full window later, the same bucket gets reused and must be reset
+	later := now.Add(time.Minute)
+	tracker.observe(ResourceAPI, later, later.Add(-time.Second))
+
+	require.Equal(t, map[string]time.Duration{
+		ResourceAPI: time.Second,
+	}, tracker.oldest(later))
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/clientcmd"
+	externalmetrics "k8s.io/metrics/pkg/client/external_metrics"
+
+	adaptercfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/keda"
+)
+
+const (
+	kedaManifest  = "../keda-manifests/scaled-object.yaml"
+	configMap     = "adapter-config"
+	configMapKey  = "config.yaml"
+	kedaTarget    = "keda-target"
+	kedaMaxTarget = 3
+)
+
+func TestKEDAScaledObject(t *testing.T) {
+	if os.Getenv("KEDA_E2E") == "" {
+		t.Skip("KEDA_E2E not set")
+	}
+	ctx := context.Background()
+
+	f, err := os.Open(kedaManifest)
+	require.NoError(t, err)
+	defer f.Close()
+	objects, err := keda.ParseScaledObjects(f)
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	// the manifests are deployed in the test namespace
+	objects[0].Metadata.Namespace = ns
+	rules, err := keda.ExternalRules(objects)
+	require.NoError(t, err)
+
+	// serve the ScaledObject from prometheus-adapter, and restart it
+	cm, err := client.CoreV1().ConfigMaps(ns).Get(ctx, configMap, metav1.GetOptions{})
+	require.NoError(t, err)
+	cfg, err := adaptercfg.FromYAML([]byte(cm.Data[configMapKey]))
+	require.NoError(t, err)
+	cfg.ExternalRules = append(cfg.ExternalRules, rules...)
+	contents, err := yaml.Marshal(cfg)
+	require.NoError(t, err)
+	cm.Data[configMapKey] = string(contents)
+	_, err = client.CoreV1().ConfigMaps(ns).Update(ctx, cm, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"e2e.prometheus-adapter/restarted-at":%q}}}}}`, time.Now().Format(time.RFC3339))
+	_, err = client.AppsV1().Deployments(ns).Patch(ctx, deployment, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	require.NoError(t, err)
+	require.NoError(t, waitForRollout(ctx, ns, deployment))
+
+	externalClient, err := newExternalMetricsClient()
+	require.NoError(t, err)
+	name := keda.MetricName(0, objects[0].Spec.Triggers[0])
+	selector := labels.SelectorFromSet(labels.Set{keda.ScaledObjectLabel: objects[0].Metadata.Name})
+	err = wait.PollUntilContextTimeout(ctx, 5*time.Second, 2*time.Minute, true, func(ctx context.Context) (bool, error) {
+		values, err := externalClient.NamespacedMetrics(ns).List(name, selector)
+		if err != nil {
+			t.Logf("External metric %s not served yet: %v. Retrying.", name, err)
+			return false, nil
+		}
+		if len(values.Items) != 1 || values.Items[0].Value.CmpInt64(5) != 0 {
+			t.Logf("External metric %s is %v, expected 5. Retrying.", name, values.Items)
+			return false, nil
+		}
+		return true, nil
+	})
+	require.NoErrorf(t, err, "External metric %s should be served", name)
+
+	err = wait.PollUntilContextTimeout(ctx, 5*time.Second, 5*time.Minute, true, func(ctx context.Context) (bool, error) {
+		target, err := client.AppsV1().Deployments(ns).Get(ctx, kedaTarget, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if *target.Spec.Replicas != kedaMaxTarget {
+			t.Logf("Deployment %s has %d replicas, expected %d. Retrying.", kedaTarget, *target.Spec.Replicas, kedaMaxTarget)
+			return false, nil
+		}
+		return true, nil
+	})
+	require.NoErrorf(t, err, "Deployment %s should be scaled by KEDA", kedaTarget)
+}
+
+func newExternalMetricsClient() (externalmetrics.ExternalMetricsClient, error) {
+	cfg, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+	if err != nil {
+		return nil, fmt.Errorf("Error during client configuration with %v", err)
+	}
+	return externalmetrics.NewForConfig(cfg)
+}
+
+func waitForRollout(ctx context.Context, namespace string, name string) error {
+	return wait.PollUntilContextTimeout(ctx, 5*time.Second, 2*time.Minute, true, func(ctx context.Context) (bool, error) {
+		d, err := client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		replicas := *d.Spec.Replicas
+		if d.Status.ObservedGeneration >= d.Generation && d.Status.UpdatedReplicas == replicas &&
+			d.Status.Replicas == replicas && d.Status.ReadyReplicas == replicas {
+			return true, nil
+		}
+		return false, nil
+	})
+}
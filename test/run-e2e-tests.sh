@@ -22,6 +22,7 @@ set -o nounset
 K8S_VERSION=${KUBERNETES_VERSION:-v1.30.0}   # cf https://hub.docker.com/r/kindest/node/tags
 KIND_VERSION=${KIND_VERSION:-v0.23.0}        # cf https://github.com/kubernetes-sigs/kind/releases
 PROM_OPERATOR_VERSION=${PROM_OPERATOR_VERSION:-v0.73.2} # cf https://github.com/prometheus-operator/prometheus-operator/releases
+KEDA_VERSION=${KEDA_VERSION:-v2.14.0}        # cf https://github.com/kedacore/keda/releases
 
 # Variables; set to empty if unbound/empty
 REGISTRY=${REGISTRY:-}
@@ -29,6 +30,7 @@ KIND_E2E=${KIND_E2E:-}
 SKIP_INSTALL=${SKIP_INSTALL:-}
 SKIP_CLEAN_AFTER=${SKIP_CLEAN_AFTER:-}
 CLEAN_BEFORE=${CLEAN_BEFORE:-}
+KEDA_E2E=${KEDA_E2E:-}
 
 # KUBECONFIG - will be overriden if a cluster is deployed with Kind
 KUBECONFIG=${KUBECONFIG:-"${HOME}/.kube/config"}
@@ -48,6 +50,10 @@ function clean {
     if [[ -n "${KIND_E2E}" ]]; then
         kind delete cluster || true
     else
+        if [[ -n "${KEDA_E2E}" ]]; then
+            kubectl delete -f "${E2E_DIR}/keda-manifests" || true
+            kubectl delete -f "https://github.com/kedacore/keda/releases/download/${KEDA_VERSION}/keda-${KEDA_VERSION#v}.yaml" || true
+        fi
         kubectl delete -f ./deploy/manifests || true
         kubectl delete -f ./test/prometheus-manifests || true
         kubectl delete namespace "${NAMESPACE}" || true
@@ -129,6 +135,18 @@ find "${E2E_DIR}/manifests" -type f -exec sed -i -e "s|namespace: monitoring|nam
 # Deploy prometheus-adapter
 kubectl apply -f "${E2E_DIR}/manifests" --server-side
 
+if [[ -n "${KEDA_E2E}" ]]; then
+    # Install KEDA, and let prometheus-adapter serve the external metrics API
+    # in its place
+    kubectl apply -f "https://github.com/kedacore/keda/releases/download/${KEDA_VERSION}/keda-${KEDA_VERSION#v}.yaml" --server-side
+    kubectl wait --for condition=established --timeout=60s crd/scaledobjects.keda.sh
+    kubectl delete apiservice v1beta1.external.metrics.k8s.io
+    cp -r ./test/keda-manifests "${E2E_DIR}/keda-manifests"
+    find "${E2E_DIR}/keda-manifests" -type f -exec sed -i -e "s|monitoring|${NAMESPACE}|g" {} \;
+    kubectl apply -f "${E2E_DIR}/keda-manifests" --server-side
+fi
+
 PROJECT_PREFIX="sigs.k8s.io/prometheus-adapter"
 export KUBECONFIG
+export KEDA_E2E
 go test "${PROJECT_PREFIX}/test/e2e/" -v -count=1